@@ -166,6 +166,50 @@ func IterMapCmdOutput(output []byte, f MapIter) error {
 	return nil
 }
 
+// PerCPUMapIter is called for each entry of a per-CPU map with the value of the entry on each CPU, indexed by CPU.
+type PerCPUMapIter func(k []byte, values [][]byte)
+
+type perCPUMapEntry struct {
+	Key    []string         `json:"key"`
+	Values []perCPUMapValue `json:"values"`
+}
+
+type perCPUMapValue struct {
+	CPU   int      `json:"cpu"`
+	Value []string `json:"value"`
+}
+
+// IterPerCPUMapCmdOutput iterates over the output of a command obtained by DumpMapCmd for a per-CPU map, in which each
+// entry has a value for each CPU.
+func IterPerCPUMapCmdOutput(output []byte, f PerCPUMapIter) error {
+	var mp []perCPUMapEntry
+	err := json.Unmarshal(output, &mp)
+	if err != nil {
+		return errors.Errorf("cannot parse json output: %v\n%s", err, output)
+	}
+
+	for _, me := range mp {
+		k, err := hexStringsToBytes(me.Key)
+		if err != nil {
+			return errors.Errorf("failed parsing entry %v key: %v", me, err)
+		}
+		var values [][]byte
+		for _, cv := range me.Values {
+			v, err := hexStringsToBytes(cv.Value)
+			if err != nil {
+				return errors.Errorf("failed parsing entry %v value of CPU %d: %v", me, cv.CPU, err)
+			}
+			for len(values) <= cv.CPU {
+				values = append(values, nil)
+			}
+			values[cv.CPU] = v
+		}
+		f(k, values)
+	}
+
+	return nil
+}
+
 func (b *PinnedMap) Iter(f MapIter) error {
 	cmd, err := DumpMapCmd(b)
 	if err != nil {
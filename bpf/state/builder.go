@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"net"
+)
+
+// Builder constructs State values, converting addresses and ports to the representation used by the BPF programs. This
+// is intended for building the input and expected states in tests.
+type Builder struct {
+	s State
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+func (b *Builder) WithProto(proto uint8) *Builder {
+	b.s.IPProto = proto
+	return b
+}
+
+func (b *Builder) WithSrc(addr net.IP, port uint16) *Builder {
+	b.s.SrcAddr = ipToAddr(addr)
+	b.s.SrcPort = port
+	return b
+}
+
+func (b *Builder) WithDst(addr net.IP, port uint16) *Builder {
+	b.s.DstAddr = ipToAddr(addr)
+	b.s.DstPort = port
+	return b
+}
+
+func (b *Builder) WithPostNATDst(addr net.IP, port uint16) *Builder {
+	b.s.PostNATDstAddr = ipToAddr(addr)
+	b.s.PostNATDstPort = port
+	return b
+}
+
+// WithNATDest sets the NAT backend, and also the post-NAT destination since the program sets both when it NATs a
+// packet.
+func (b *Builder) WithNATDest(addr net.IP, port uint16) *Builder {
+	b.s.SetNATDestAddr(ipToAddr(addr))
+	b.s.SetNATDestPort(port)
+	return b.WithPostNATDst(addr, port)
+}
+
+func (b *Builder) WithPolicyRC(rc int32) *Builder {
+	b.s.PolicyRC = rc
+	return b
+}
+
+func (b *Builder) Build() State {
+	return b.s
+}
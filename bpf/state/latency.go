@@ -0,0 +1,183 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The program records its start time in State.ProgStartTime from bpf_ktime_get_ns(), which is CLOCK_MONOTONIC in
+// nanoseconds, and only when it is compiled with INFO logging or above. A zero start time therefore means the program
+// did not record it.
+//
+// The state map is a per-CPU array: each CPU has its own copy of the state, written by whichever programs ran on that
+// CPU. The monotonic clock is synchronised across CPUs, but only to within the skew of the CPU clocks, so a start time
+// recorded on one CPU may be slightly behind a start time recorded earlier on another. The deltas allow for this skew,
+// and a delta that goes further backwards is discarded rather than recorded as a huge latency.
+//
+// The start times are unsigned and are subtracted modulo 2^64, so the delta is correct across a wraparound of the
+// clock. A delta is treated as backwards if it is at least 2^63, i.e. negative as a signed value.
+
+// MaxClockSkew is the largest amount by which a start time may be behind the previous start time, because they were
+// recorded on CPUs with skewed clocks, and still be recorded as a zero latency.
+const MaxClockSkew = 10 * time.Microsecond
+
+// DefaultLatencyBuckets are the upper bounds of the buckets of a Histogram created by NewHistogram.
+var DefaultLatencyBuckets = []time.Duration{
+	1 * time.Microsecond,
+	2 * time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+}
+
+// Histogram counts the latencies between the BPF programs that processed a packet, in fixed buckets. The latency is the
+// delta between the start times recorded in the states written by the programs, so it covers the processing of the
+// earlier program and anything that ran between the two programs.
+type Histogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in ascending order. Counts has a count for each bound and
+	// a final count for the latencies above the last bound.
+	Bounds []time.Duration
+	Counts []uint64
+
+	// The sum and maximum of the recorded latencies.
+	Sum time.Duration
+	Max time.Duration
+
+	// Unrecorded counts the pairs of states that were discarded because a program did not record its start time, and
+	// Skewed the pairs whose start time went backwards by more than MaxClockSkew.
+	Unrecorded uint64
+	Skewed     uint64
+}
+
+// NewHistogram creates a Histogram with the DefaultLatencyBuckets.
+func NewHistogram() *Histogram {
+	return NewHistogramWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewHistogramWithBuckets creates a Histogram with buckets up to each of the bounds, which must be in ascending order.
+func NewHistogramWithBuckets(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		Bounds: append([]time.Duration(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// ProgStartDelta returns the time from the start of the program that wrote the previous state to the start of the
+// program that wrote the current state. ok is false if either program did not record its start time, or if the
+// current start time is more than MaxClockSkew behind the previous start time. A delta within the skew is returned as
+// zero.
+func ProgStartDelta(prev, cur State) (delta time.Duration, ok bool) {
+	if prev.ProgStartTime == 0 || cur.ProgStartTime == 0 {
+		return 0, false
+	}
+	// Subtract modulo 2^64 so that a wraparound of the clock gives the right delta, then interpret the result as
+	// signed to detect a start time that went backwards.
+	signed := int64(cur.ProgStartTime - prev.ProgStartTime)
+	if signed < 0 {
+		if -signed > int64(MaxClockSkew) {
+			return 0, false
+		}
+		return 0, true
+	}
+	return time.Duration(signed), true
+}
+
+// RecordLatency records the latency between the programs that wrote the previous and the current state for the same
+// packet, e.g. when the tc test harness runs a packet through multiple programs. Returns the latency and whether it
+// was recorded.
+func (h *Histogram) RecordLatency(prev, cur State) (time.Duration, bool) {
+	delta, ok := ProgStartDelta(prev, cur)
+	if !ok {
+		if prev.ProgStartTime == 0 || cur.ProgStartTime == 0 {
+			h.Unrecorded++
+		} else {
+			h.Skewed++
+		}
+		return 0, false
+	}
+	h.Record(delta)
+	return delta, true
+}
+
+// RecordPerCPU records the latencies between two reads of a per-CPU state map, indexed by CPU. Each CPU's state is
+// only compared with the previous state of the same CPU, and a CPU whose start time has not changed has not processed
+// a packet since the previous read and is skipped.
+func (h *Histogram) RecordPerCPU(prev, cur []State) {
+	for cpu := range cur {
+		if cpu >= len(prev) || cur[cpu].ProgStartTime == prev[cpu].ProgStartTime {
+			continue
+		}
+		h.RecordLatency(prev[cpu], cur[cpu])
+	}
+}
+
+// Record records a latency.
+func (h *Histogram) Record(d time.Duration) {
+	bucket := len(h.Bounds)
+	for i, bound := range h.Bounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.Counts[bucket]++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Total returns the number of recorded latencies.
+func (h *Histogram) Total() uint64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	return total
+}
+
+// Mean returns the mean of the recorded latencies, or zero if none have been recorded.
+func (h *Histogram) Mean() time.Duration {
+	total := h.Total()
+	if total == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(total)
+}
+
+// String formats the histogram with a line per bucket, for printing by the debug tools.
+func (h *Histogram) String() string {
+	var sb strings.Builder
+	lower := time.Duration(0)
+	for i, c := range h.Counts {
+		if i < len(h.Bounds) {
+			fmt.Fprintf(&sb, "%10v - %-10v %d\n", lower, h.Bounds[i], c)
+			lower = h.Bounds[i]
+		} else {
+			fmt.Fprintf(&sb, "%10v +           %d\n", lower, c)
+		}
+	}
+	fmt.Fprintf(&sb, "total=%d mean=%v max=%v unrecorded=%d skewed=%d\n",
+		h.Total(), h.Mean(), h.Max, h.Unrecorded, h.Skewed)
+	return sb.String()
+}
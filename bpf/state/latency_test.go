@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state_test
+
+import (
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/bpf/state"
+)
+
+func stateAt(startTime uint64) state.State {
+	return state.State{ProgStartTime: startTime}
+}
+
+var _ = Describe("BPF program latency", func() {
+	var h *state.Histogram
+
+	BeforeEach(func() {
+		h = state.NewHistogramWithBuckets([]time.Duration{time.Microsecond, 10 * time.Microsecond})
+	})
+
+	It("should bucket the deltas of a sequence of states", func() {
+		// A packet run through four programs.
+		seq := []state.State{stateAt(1000), stateAt(1500), stateAt(6500), stateAt(56500)}
+		for i := 1; i < len(seq); i++ {
+			_, ok := h.RecordLatency(seq[i-1], seq[i])
+			Expect(ok).To(BeTrue())
+		}
+		Expect(h.Counts).To(Equal([]uint64{1, 1, 1}))
+		Expect(h.Total()).To(Equal(uint64(3)))
+		Expect(h.Max).To(Equal(50 * time.Microsecond))
+		Expect(h.Mean()).To(Equal(55500 * time.Nanosecond / 3))
+	})
+
+	It("should include the bound in its bucket", func() {
+		h.Record(time.Microsecond)
+		h.Record(time.Microsecond + 1)
+		Expect(h.Counts).To(Equal([]uint64{1, 1, 0}))
+	})
+
+	It("should discard states without a start time", func() {
+		_, ok := h.RecordLatency(stateAt(0), stateAt(1000))
+		Expect(ok).To(BeFalse())
+		_, ok = h.RecordLatency(stateAt(1000), stateAt(0))
+		Expect(ok).To(BeFalse())
+		Expect(h.Total()).To(BeZero())
+		Expect(h.Unrecorded).To(Equal(uint64(2)))
+	})
+
+	It("should handle a wraparound of the clock", func() {
+		d, ok := state.ProgStartDelta(stateAt(math.MaxUint64-499), stateAt(500))
+		Expect(ok).To(BeTrue())
+		Expect(d).To(Equal(time.Microsecond))
+	})
+
+	It("should record a start time behind by less than the clock skew as zero latency", func() {
+		d, ok := h.RecordLatency(stateAt(100000), stateAt(100000-uint64(state.MaxClockSkew)))
+		Expect(ok).To(BeTrue())
+		Expect(d).To(BeZero())
+		Expect(h.Counts[0]).To(Equal(uint64(1)))
+	})
+
+	It("should discard a start time behind by more than the clock skew", func() {
+		_, ok := h.RecordLatency(stateAt(100000), stateAt(100000-uint64(state.MaxClockSkew)-1))
+		Expect(ok).To(BeFalse())
+		Expect(h.Total()).To(BeZero())
+		Expect(h.Skewed).To(Equal(uint64(1)))
+
+		// Going backwards across the wraparound is also discarded.
+		_, ok = h.RecordLatency(stateAt(500000), stateAt(math.MaxUint64-499))
+		Expect(ok).To(BeFalse())
+		Expect(h.Skewed).To(Equal(uint64(2)))
+	})
+
+	It("should only compare the per-CPU copies of the same CPU", func() {
+		// CPU 0 processes a packet, CPU 1 does not, and CPU 2's clock is far behind CPU 0's, which must not matter.
+		prev := []state.State{stateAt(1000000), stateAt(2000000), stateAt(5000)}
+		cur := []state.State{stateAt(1000500), stateAt(2000000), stateAt(10000)}
+		h.RecordPerCPU(prev, cur)
+		Expect(h.Counts).To(Equal([]uint64{1, 1, 0}))
+		Expect(h.Skewed).To(BeZero())
+	})
+
+	It("should format the buckets", func() {
+		h.Record(500 * time.Nanosecond)
+		h.Record(time.Millisecond)
+		Expect(h.String()).To(Equal(
+			"        0s - 1µs        1\n" +
+				"       1µs - 10µs       0\n" +
+				"      10µs +           1\n" +
+				"total=2 mean=500.25µs max=1ms unrecorded=0 skewed=0\n"))
+	})
+})
@@ -15,11 +15,15 @@
 package state
 
 import (
+	"fmt"
+	"net"
+	"os/exec"
 	"unsafe"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/bpf"
+	"github.com/projectcalico/felix/ip"
 )
 
 // struct cali_tc_state {
@@ -58,6 +62,154 @@ type State struct {
 
 const expectedSize = 64
 
+// natDest matches the layout of struct calico_nat_dest { uint32_t addr; uint16_t port; uint8_t pad[2]; }, which is
+// stored in State.NATData.
+type natDest struct {
+	addr uint32
+	port uint16
+	pad  [2]uint8
+}
+
+func (s *State) natDest() *natDest {
+	return (*natDest)(unsafe.Pointer(&s.NATData))
+}
+
+// NATDestAddr returns the address of the NAT backend selected by the program. As with the other addresses in the
+// state, the address is in network byte order.
+func (s *State) NATDestAddr() uint32 {
+	return s.natDest().addr
+}
+
+// SetNATDestAddr sets the address of the NAT backend, in network byte order.
+func (s *State) SetNATDestAddr(addr uint32) {
+	s.natDest().addr = addr
+}
+
+// NATDestPort returns the port of the NAT backend selected by the program. The port is in host byte order.
+func (s *State) NATDestPort() uint16 {
+	return s.natDest().port
+}
+
+// SetNATDestPort sets the port of the NAT backend, in host byte order.
+func (s *State) SetNATDestPort(port uint16) {
+	s.natDest().port = port
+}
+
+// WasNATed returns true if the program selected a NAT backend. As in the C program, a zero address means that the
+// packet was not NATed.
+func (s *State) WasNATed() bool {
+	return s.NATDestAddr() != 0
+}
+
+// NATBackend returns the NAT backend selected by the program as "ip:port", or an empty string if the packet was not
+// NATed.
+func (s *State) NATBackend() string {
+	if !s.WasNATed() {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", addrToIP(s.NATDestAddr()), s.NATDestPort())
+}
+
+// addrToIP converts an address in network byte order, as stored in the state, to an IP.
+func addrToIP(addr uint32) net.IP {
+	ip := make(net.IP, 4)
+	copy(ip, (*[4]byte)(unsafe.Pointer(&addr))[:])
+	return ip
+}
+
+// ipToAddr converts an IPv4 address to the network byte order representation stored in the state.
+func ipToAddr(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		log.WithField("ip", ip).Panic("Bad IP")
+	}
+	var addr uint32
+	copy((*[4]byte)(unsafe.Pointer(&addr))[:], ip4)
+	return addr
+}
+
+// SrcIP returns the source address of the packet.
+func (s *State) SrcIP() ip.Addr {
+	return addrToV4Addr(s.SrcAddr)
+}
+
+// SetSrcIP sets the source address of the packet. The address must be an IPv4 address.
+func (s *State) SetSrcIP(addr ip.Addr) {
+	s.SrcAddr = v4AddrToAddr(addr)
+}
+
+// DstIP returns the destination address of the packet, before NAT.
+func (s *State) DstIP() ip.Addr {
+	return addrToV4Addr(s.DstAddr)
+}
+
+// SetDstIP sets the destination address of the packet, before NAT. The address must be an IPv4 address.
+func (s *State) SetDstIP(addr ip.Addr) {
+	s.DstAddr = v4AddrToAddr(addr)
+}
+
+// PostNATDstIP returns the destination address of the packet after NAT.
+func (s *State) PostNATDstIP() ip.Addr {
+	return addrToV4Addr(s.PostNATDstAddr)
+}
+
+// SetPostNATDstIP sets the destination address of the packet after NAT. The address must be an IPv4 address.
+func (s *State) SetPostNATDstIP(addr ip.Addr) {
+	s.PostNATDstAddr = v4AddrToAddr(addr)
+}
+
+// addrToV4Addr converts an address in network byte order, as stored in the state, to a V4Addr. The bytes of the
+// uint32 in memory are the address bytes in network order, whatever the byte order of the host.
+func addrToV4Addr(addr uint32) ip.V4Addr {
+	return ip.V4Addr(*(*[4]byte)(unsafe.Pointer(&addr)))
+}
+
+// v4AddrToAddr converts an IPv4 address to the network byte order representation stored in the state.
+func v4AddrToAddr(addr ip.Addr) uint32 {
+	v4, ok := addr.(ip.V4Addr)
+	if !ok {
+		log.WithField("ip", addr).Panic("Bad IP")
+	}
+	var a uint32
+	*(*[4]byte)(unsafe.Pointer(&a)) = v4
+	return a
+}
+
+// Diff compares the actual state with the expected state and returns a readable description of each field that
+// differs, for example "post-NAT dst expected 10.1.2.3 got 10.1.2.4". It returns nil if the states are equal.
+func Diff(expected, actual State) []string {
+	var diffs []string
+	diffAddr := func(name string, exp, act uint32) {
+		if exp != act {
+			diffs = append(diffs, fmt.Sprintf("%s expected %s got %s", name, addrToV4Addr(exp), addrToV4Addr(act)))
+		}
+	}
+	diffNum := func(name string, exp, act interface{}) {
+		if exp != act {
+			diffs = append(diffs, fmt.Sprintf("%s expected %v got %v", name, exp, act))
+		}
+	}
+	diffAddr("src", expected.SrcAddr, actual.SrcAddr)
+	diffAddr("dst", expected.DstAddr, actual.DstAddr)
+	diffAddr("post-NAT dst", expected.PostNATDstAddr, actual.PostNATDstAddr)
+	diffAddr("NAT tunnel src", expected.NATTunSrcAddr, actual.NATTunSrcAddr)
+	diffNum("policy RC", expected.PolicyRC, actual.PolicyRC)
+	diffNum("src port", expected.SrcPort, actual.SrcPort)
+	diffNum("dst port", expected.DstPort, actual.DstPort)
+	diffNum("post-NAT dst port", expected.PostNATDstPort, actual.PostNATDstPort)
+	diffNum("IP proto", expected.IPProto, actual.IPProto)
+	diffNum("pad", expected.Pad, actual.Pad)
+	diffNum("conntrack result type", expected.ConntrackResultType, actual.ConntrackResultType)
+	diffNum("conntrack data", expected.ConntrackData, actual.ConntrackData)
+	diffNum("conntrack tunnel data", expected.ConntrackDataTun, actual.ConntrackDataTun)
+	diffNum("pad2", expected.Pad2, actual.Pad2)
+	diffAddr("NAT dest", expected.NATDestAddr(), actual.NATDestAddr())
+	diffNum("NAT dest port", expected.NATDestPort(), actual.NATDestPort())
+	diffNum("NAT dest pad", expected.natDest().pad, actual.natDest().pad)
+	diffNum("prog start time", expected.ProgStartTime, actual.ProgStartTime)
+	return diffs
+}
+
 func (s *State) AsBytes() []byte {
 	size := unsafe.Sizeof(State{})
 	if size != expectedSize {
@@ -87,6 +239,38 @@ func Map(mc *bpf.MapContext) bpf.Map {
 	})
 }
 
+// ReadPerCPU reads the state of each CPU from the per-CPU state map, indexed by CPU.
+func ReadPerCPU(m bpf.Map) ([]State, error) {
+	cmd, err := bpf.DumpMapCmd(m)
+	if err != nil {
+		return nil, err
+	}
+	output, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump the state map: %v", err)
+	}
+	return StatesFromPerCPUDump(output)
+}
+
+// StatesFromPerCPUDump parses the state of each CPU, indexed by CPU, from the bpftool dump of the per-CPU state map.
+// A CPU without a complete value in the dump has the zero state.
+func StatesFromPerCPUDump(output []byte) ([]State, error) {
+	var states []State
+	err := bpf.IterPerCPUMapCmdOutput(output, func(k []byte, values [][]byte) {
+		// The state map has a single entry.
+		states = make([]State, len(values))
+		for cpu, v := range values {
+			if len(v) == expectedSize {
+				states[cpu] = StateFromBytes(v)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
 func MapForTest(mc *bpf.MapContext) bpf.Map {
 	return mc.NewPinnedMap(bpf.MapParameters{
 		Filename:   "/sys/fs/bpf/tc/globals/test_v4_state",
@@ -0,0 +1,200 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/bpf/state"
+	"github.com/projectcalico/felix/ip"
+)
+
+// The states below are laid out as struct cali_tc_state is written by the C program on a little-endian host. The
+// addresses are in network byte order and the ports are in host byte order.
+var (
+	// A TCP packet from 10.0.0.1:12345 to the service 10.96.0.10:80, NATed to the backend 10.65.0.2:8080.
+	natedStateBytes = []byte{
+		10, 0, 0, 1, // ip_src
+		10, 96, 0, 10, // ip_dst
+		10, 65, 0, 2, // post_nat_ip_dst
+		0, 0, 0, 0, // nat_tun_src
+		0, 0, 0, 0, // pol_rc
+		0x39, 0x30, // sport
+		80, 0, // dport
+		0x90, 0x1f, // post_nat_dport
+		6,          // ip_proto
+		0,          // flags
+		0, 0, 0, 0, // ct_result.rc
+		0, 0, 0, 0, 0, 0, 0, 0, // ct_result.nat_ip, ct_result.nat_port etc.
+		0, 0, 0, 0, // ct_result.tun_ret_ip
+		0, 0, 0, 0, // padding
+		10, 65, 0, 2, // nat_dest.addr
+		0x90, 0x1f, // nat_dest.port
+		0, 0, // nat_dest.pad
+		0, 0, 0, 0, 0, 0, 0, 0, // prog_start_time
+	}
+
+	// A UDP packet from 10.0.0.1:12345 to 10.65.0.3:53, which was not NATed.
+	unnatedStateBytes = []byte{
+		10, 0, 0, 1, // ip_src
+		10, 65, 0, 3, // ip_dst
+		10, 65, 0, 3, // post_nat_ip_dst
+		0, 0, 0, 0, // nat_tun_src
+		0, 0, 0, 0, // pol_rc
+		0x39, 0x30, // sport
+		53, 0, // dport
+		53, 0, // post_nat_dport
+		17,         // ip_proto
+		0,          // flags
+		0, 0, 0, 0, // ct_result.rc
+		0, 0, 0, 0, 0, 0, 0, 0, // ct_result.nat_ip, ct_result.nat_port etc.
+		0, 0, 0, 0, // ct_result.tun_ret_ip
+		0, 0, 0, 0, // padding
+		0, 0, 0, 0, // nat_dest.addr
+		0, 0, // nat_dest.port
+		0, 0, // nat_dest.pad
+		0, 0, 0, 0, 0, 0, 0, 0, // prog_start_time
+	}
+)
+
+var _ = Describe("BPF state", func() {
+	It("should decode the NAT backend of a NATed packet", func() {
+		s := state.StateFromBytes(natedStateBytes)
+		Expect(s.WasNATed()).To(BeTrue())
+		Expect(s.NATBackend()).To(Equal("10.65.0.2:8080"))
+		Expect(s.NATDestPort()).To(Equal(uint16(8080)))
+		Expect(s.NATDestAddr()).To(Equal(s.PostNATDstAddr))
+		Expect(s.PostNATDstPort).To(Equal(uint16(8080)))
+	})
+
+	It("should decode a packet that was not NATed", func() {
+		s := state.StateFromBytes(unnatedStateBytes)
+		Expect(s.WasNATed()).To(BeFalse())
+		Expect(s.NATBackend()).To(Equal(""))
+		Expect(s.NATDestAddr()).To(BeZero())
+		Expect(s.NATDestPort()).To(BeZero())
+	})
+
+	It("should round trip the NAT backend", func() {
+		s := state.StateFromBytes(natedStateBytes)
+		Expect(s.AsBytes()).To(Equal(natedStateBytes))
+
+		s.SetNATDestAddr(0)
+		s.SetNATDestPort(0)
+		Expect(s.WasNATed()).To(BeFalse())
+		Expect(s.AsBytes()[48:56]).To(Equal(make([]byte, 8)))
+
+		nated := state.StateFromBytes(natedStateBytes)
+		s = state.StateFromBytes(unnatedStateBytes)
+		s.SetNATDestAddr(nated.NATDestAddr())
+		s.SetNATDestPort(8080)
+		Expect(s.AsBytes()[48:56]).To(Equal(natedStateBytes[48:56]))
+	})
+
+	It("should build states matching the C layout", func() {
+		s := state.NewBuilder().
+			WithProto(6).
+			WithSrc(net.ParseIP("10.0.0.1"), 12345).
+			WithDst(net.ParseIP("10.96.0.10"), 80).
+			WithNATDest(net.ParseIP("10.65.0.2"), 8080).
+			Build()
+		Expect(s.AsBytes()).To(Equal(natedStateBytes))
+
+		s = state.NewBuilder().
+			WithProto(17).
+			WithSrc(net.ParseIP("10.0.0.1"), 12345).
+			WithDst(net.ParseIP("10.65.0.3"), 53).
+			WithPostNATDst(net.ParseIP("10.65.0.3"), 53).
+			Build()
+		Expect(s.AsBytes()).To(Equal(unnatedStateBytes))
+	})
+
+	It("should convert the addresses in network byte order", func() {
+		s := state.StateFromBytes(natedStateBytes)
+		Expect(s.SrcIP()).To(Equal(ip.FromString("10.0.0.1")))
+		Expect(s.DstIP()).To(Equal(ip.FromString("10.96.0.10")))
+		Expect(s.PostNATDstIP()).To(Equal(ip.FromString("10.65.0.2")))
+
+		s.SetSrcIP(ip.FromString("10.1.2.3"))
+		s.SetDstIP(ip.FromString("10.4.5.6"))
+		s.SetPostNATDstIP(ip.FromString("192.168.0.1"))
+		Expect(s.AsBytes()[0:12]).To(Equal([]byte{
+			10, 1, 2, 3, // ip_src
+			10, 4, 5, 6, // ip_dst
+			192, 168, 0, 1, // post_nat_ip_dst
+		}))
+		Expect(s.AsBytes()[12:]).To(Equal(natedStateBytes[12:]))
+	})
+
+	It("should panic when setting an IPv6 address", func() {
+		s := state.State{}
+		Expect(func() { s.SetSrcIP(ip.FromString("fd00::1")) }).To(Panic())
+	})
+
+	It("should describe the differences between states", func() {
+		expected := state.StateFromBytes(natedStateBytes)
+		Expect(state.Diff(expected, expected)).To(BeEmpty())
+
+		actual := expected
+		actual.SetPostNATDstIP(ip.FromString("10.65.0.3"))
+		actual.PolicyRC = 1
+		actual.SetNATDestPort(80)
+		Expect(state.Diff(expected, actual)).To(Equal([]string{
+			"post-NAT dst expected 10.65.0.2 got 10.65.0.3",
+			"policy RC expected 0 got 1",
+			"NAT dest port expected 8080 got 80",
+		}))
+	})
+})
+
+var _ = Describe("BPF per-CPU state dump", func() {
+	// hexValue formats bytes as bpftool formats the keys and values of a map in its JSON output.
+	hexValue := func(bytes []byte) string {
+		var values []string
+		for _, b := range bytes {
+			values = append(values, fmt.Sprintf(`"0x%02x"`, b))
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	}
+
+	It("should parse the state of each CPU", func() {
+		dump := fmt.Sprintf(`[{"key":%s,"values":[{"cpu":0,"value":%s},{"cpu":1,"value":%s}]}]`,
+			hexValue([]byte{0, 0, 0, 0}), hexValue(unnatedStateBytes), hexValue(natedStateBytes))
+		states, err := state.StatesFromPerCPUDump([]byte(dump))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(states).To(Equal([]state.State{
+			state.StateFromBytes(unnatedStateBytes),
+			state.StateFromBytes(natedStateBytes),
+		}))
+	})
+
+	It("should return the zero state for a CPU without a complete value", func() {
+		dump := fmt.Sprintf(`[{"key":%s,"values":[{"cpu":1,"value":%s}]}]`,
+			hexValue([]byte{0, 0, 0, 0}), hexValue(natedStateBytes))
+		states, err := state.StatesFromPerCPUDump([]byte(dump))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(states).To(Equal([]state.State{{}, state.StateFromBytes(natedStateBytes)}))
+	})
+
+	It("should fail on invalid output", func() {
+		_, err := state.StatesFromPerCPUDump([]byte("Error: bpf obj get"))
+		Expect(err).To(HaveOccurred())
+	})
+})
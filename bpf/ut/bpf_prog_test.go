@@ -192,12 +192,57 @@ func runBpfTest(t *testing.T, section string, rules [][][]*proto.Rule, testFn fu
 			log.Debugf("dataIn  = %+v", dataIn)
 			if err == nil {
 				log.Debugf("dataOut = %+v", res.dataOut)
+				recordPerCPUProgLatency()
 			}
 			return res, err
 		})
 	})
 }
 
+// progLatency collects the latencies between the programs that the tests run packets through, from the start times
+// recorded in the states that the programs write. The latencies are only collected, and printed at the end of the run,
+// if BPF_UT_LATENCY=true, and are only recorded if the programs are compiled with INFO logging or above.
+var (
+	progLatencyEnabled = os.Getenv("BPF_UT_LATENCY") == "true"
+	progLatency        = state.NewHistogram()
+
+	// The outputs of the previous program run by the policy program tests, and the per-CPU states after the previous
+	// program run by the tc program tests.
+	lastProgStateOut   *state.State
+	lastPerCPUStateOut []state.State
+)
+
+// recordProgLatency records the latency between the previous program output and the output of the program that the
+// policy program tests just ran.
+func recordProgLatency(cur state.State) {
+	if !progLatencyEnabled {
+		return
+	}
+	if lastProgStateOut != nil {
+		if d, ok := progLatency.RecordLatency(*lastProgStateOut, cur); ok {
+			log.WithField("latency", d).Debug("BPF program latency")
+		}
+	}
+	lastProgStateOut = &cur
+}
+
+// recordPerCPUProgLatency records the latency between the previous program output and the output of the program that
+// the tc program tests just ran, on the CPU that ran the program.
+func recordPerCPUProgLatency() {
+	if !progLatencyEnabled {
+		return
+	}
+	cur, err := state.ReadPerCPU(stateMap)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read the state map, not recording the BPF program latency")
+		return
+	}
+	if lastPerCPUStateOut != nil {
+		progLatency.RecordPerCPU(lastPerCPUStateOut, cur)
+	}
+	lastPerCPUStateOut = cur
+}
+
 type forceAllocator struct {
 	alloc *idalloc.IDAllocator
 }
@@ -17,6 +17,7 @@
 package ut_test
 
 import (
+	"fmt"
 	"os"
 	"testing"
 )
@@ -26,5 +27,8 @@ func TestMain(m *testing.M) {
 	cleanUpMaps()
 	rc := m.Run()
 	cleanUpMaps()
+	if progLatencyEnabled {
+		fmt.Print("BPF program latency:\n" + progLatency.String())
+	}
 	os.Exit(rc)
 }
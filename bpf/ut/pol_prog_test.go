@@ -1004,12 +1004,13 @@ func (p *polProgramTest) runProgram(stateIn state.State, stateMap bpf.Map, progF
 	log.WithField("stateBytes", stateBytesOut).Debug("State bytes out")
 	stateOut := state.StateFromBytes(stateBytesOut)
 	log.Debugf("State out %#v", stateOut)
+	recordProgLatency(stateOut)
 	Expect(stateOut.PolicyRC).To(BeNumerically("==", expPolRC), "policy RC was incorrect")
 	Expect(result.RC).To(BeNumerically("==", expProgRC), "program RC was incorrect")
 	// Check no other fields got clobbered.
 	expectedStateOut := stateIn
 	expectedStateOut.PolicyRC = int32(expPolRC)
-	Expect(stateOut).To(Equal(expectedStateOut), "policy program modified unexpected parts of the state")
+	Expect(state.Diff(expectedStateOut, stateOut)).To(BeEmpty(), "policy program modified unexpected parts of the state")
 }
 
 func (p *polProgramTest) setUpIPSets(alloc *idalloc.IDAllocator, ipsMap bpf.Map) {
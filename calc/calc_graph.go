@@ -79,6 +79,7 @@ type passthruCallbacks interface {
 	OnNamespaceRemove(proto.NamespaceID)
 	OnWireguardUpdate(string, *model.Wireguard)
 	OnWireguardRemove(string)
+	OnWireguardNodeInfoUpdate(string, WireguardNodeInfo)
 }
 
 type routeCallbacks interface {
@@ -298,8 +299,17 @@ func NewCalculationGraph(callbacks PipelineCallbacks, conf *config.Config) *Calc
 	//
 	hostIPPassthru := NewDataplanePassthru(callbacks)
 	hostIPPassthru.RegisterWith(allUpdDispatcher)
+	if !conf.UseNodeResourceUpdates() {
+		// The readiness of the peers is only known from their node resources, see WireguardNodeInfo, so without them a
+		// peer is treated as ready once it has a public key.
+		if conf.WireguardRequirePeerReady {
+			log.Warn("WireguardRequirePeerReady is set but node resource updates are not available, wireguard " +
+				"peers are treated as ready once they have a public key")
+		}
+		hostIPPassthru.EnableWireguardReadyOnKey()
+	}
 
-	if conf.BPFEnabled || conf.VXLANEnabled || conf.WireguardEnabled {
+	if conf.BPFEnabled || conf.VXLANEnabled || conf.WireguardEnabled || conf.WireguardAllowEnabledOverride {
 		// Calculate simple node-ownership routes.
 		//        ...
 		//     Dispatcher (all updates)
@@ -18,6 +18,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/dispatcher"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -30,19 +31,38 @@ type DataplanePassthru struct {
 	callbacks passthruCallbacks
 
 	hostIPs map[string]*net.IP
+
+	// The wireguard configuration of each node, and the wireguard configuration carried by the node resources, see
+	// WireguardNodeInfo. The wireguard configuration of a node is passed through again when its node info changes.
+	wireguard         map[string]*model.Wireguard
+	wireguardNodeInfo map[string]WireguardNodeInfo
+
+	// Whether a node is treated as ready once it has a wireguard public key, because the node resources, which carry
+	// the readiness of the nodes, are not received, see EnableWireguardReadyOnKey.
+	wireguardReadyOnKey bool
 }
 
 func NewDataplanePassthru(callbacks passthruCallbacks) *DataplanePassthru {
 	return &DataplanePassthru{
-		callbacks: callbacks,
-		hostIPs:   map[string]*net.IP{},
+		callbacks:         callbacks,
+		hostIPs:           map[string]*net.IP{},
+		wireguard:         map[string]*model.Wireguard{},
+		wireguardNodeInfo: map[string]WireguardNodeInfo{},
 	}
 }
 
+// EnableWireguardReadyOnKey treats a node as ready for wireguard traffic once it has a public key. This is used when
+// the node resources are not received, see config.Config.UseNodeResourceUpdates, since the node resources carry
+// whether a node is ready, see WireguardNodeInfo. Otherwise no node would ever be ready.
+func (h *DataplanePassthru) EnableWireguardReadyOnKey() {
+	h.wireguardReadyOnKey = true
+}
+
 func (h *DataplanePassthru) RegisterWith(dispatcher *dispatcher.Dispatcher) {
 	dispatcher.Register(model.HostIPKey{}, h.OnUpdate)
 	dispatcher.Register(model.IPPoolKey{}, h.OnUpdate)
 	dispatcher.Register(model.WireguardKey{}, h.OnUpdate)
+	dispatcher.Register(model.ResourceKey{}, h.OnUpdate)
 }
 
 func (h *DataplanePassthru) OnUpdate(update api.Update) (filterOut bool) {
@@ -79,12 +99,54 @@ func (h *DataplanePassthru) OnUpdate(update api.Update) (filterOut bool) {
 	case model.WireguardKey:
 		if update.Value == nil {
 			log.WithField("update", update).Debug("Passing-through Wireguard deletion")
+			delete(h.wireguard, key.NodeName)
+			if h.wireguardReadyOnKey {
+				h.onWireguardNodeInfoUpdate(key.NodeName, WireguardNodeInfo{})
+			}
 			h.callbacks.OnWireguardRemove(key.NodeName)
 		} else {
 			log.WithField("update", update).Debug("Passing-through Wireguard update")
 			wg := update.Value.(*model.Wireguard)
+			if h.wireguardReadyOnKey {
+				h.onWireguardNodeInfoUpdate(key.NodeName, WireguardNodeInfo{Ready: wg.PublicKey != ""})
+			}
+			h.wireguard[key.NodeName] = wg
 			h.callbacks.OnWireguardUpdate(key.NodeName, wg)
 		}
+	case model.ResourceKey:
+		if key.Kind != apiv3.KindNode {
+			return
+		}
+		var info WireguardNodeInfo
+		if update.Value != nil {
+			info = wireguardNodeInfoFromNode(update.Value.(*apiv3.Node))
+		}
+		h.onWireguardNodeInfoUpdate(key.Name, info)
 	}
 	return
 }
+
+// onWireguardNodeInfoUpdate passes through the wireguard configuration carried by the resource of a node if it has
+// changed, and then passes through the wireguard configuration and, if the enabled override changed, the host IP of the
+// node again, so that they are sent to the dataplane with the updated node info. The zero info is passed through when
+// the node is deleted.
+func (h *DataplanePassthru) onWireguardNodeInfoUpdate(nodeName string, info WireguardNodeInfo) {
+	if info == h.wireguardNodeInfo[nodeName] {
+		return
+	}
+	log.WithField("node", nodeName).WithField("info", info).Debug("Passing-through Wireguard node info update")
+	oldInfo := h.wireguardNodeInfo[nodeName]
+	if info == (WireguardNodeInfo{}) {
+		delete(h.wireguardNodeInfo, nodeName)
+	} else {
+		h.wireguardNodeInfo[nodeName] = info
+	}
+	h.callbacks.OnWireguardNodeInfoUpdate(nodeName, info)
+	if wg, ok := h.wireguard[nodeName]; ok {
+		h.callbacks.OnWireguardUpdate(nodeName, wg)
+	}
+	// The enabled override is sent with the host metadata.
+	if ip, ok := h.hostIPs[nodeName]; ok && info.EnabledOverride != oldInfo.EnabledOverride {
+		h.callbacks.OnHostIPUpdate(nodeName, ip)
+	}
+}
@@ -74,6 +74,10 @@ type EventSequencer struct {
 	pendingWireguardUpdates      map[string]*model.Wireguard
 	pendingWireguardDeletes      set.Set
 
+	// The wireguard configuration carried by the node resources, which is merged into the wireguard and host metadata
+	// updates when they are flushed.
+	wireguardNodeInfo map[string]WireguardNodeInfo
+
 	// Sets to record what we've sent downstream.  Updated whenever we flush.
 	sentIPSets          set.Set
 	sentPolicies        set.Set
@@ -129,6 +133,7 @@ func NewEventSequencer(conf configInterface) *EventSequencer {
 		pendingVTEPDeletes:           set.New(),
 		pendingWireguardUpdates:      map[string]*model.Wireguard{},
 		pendingWireguardDeletes:      set.New(),
+		wireguardNodeInfo:            map[string]WireguardNodeInfo{},
 
 		// Sets to record what we've sent downstream.  Updated whenever we flush.
 		sentIPSets:          set.New(),
@@ -466,8 +471,9 @@ func (buf *EventSequencer) OnHostIPUpdate(hostname string, ip *net.IP) {
 func (buf *EventSequencer) flushHostIPUpdates() {
 	for hostname, hostIP := range buf.pendingHostIPUpdates {
 		buf.Callback(&proto.HostMetadataUpdate{
-			Hostname: hostname,
-			Ipv4Addr: hostIP.IP.String(),
+			Hostname:                 hostname,
+			Ipv4Addr:                 hostIP.IP.String(),
+			WireguardEnabledOverride: buf.wireguardNodeInfo[hostname].EnabledOverride,
 		})
 		buf.sentHostIPs.Add(hostname)
 		delete(buf.pendingHostIPUpdates, hostname)
@@ -521,10 +527,17 @@ func (buf *EventSequencer) flushHostWireguardUpdates() {
 		if wg.InterfaceIPv4Addr != nil {
 			ipstr = wg.InterfaceIPv4Addr.String()
 		}
+		info := buf.wireguardNodeInfo[nodename]
 		buf.Callback(&proto.WireguardEndpointUpdate{
 			Hostname:      nodename,
 			PublicKey:     wg.PublicKey,
 			InterfaceAddr: ipstr,
+			ListeningPort: int32(info.ListeningPort),
+
+			PreviousPublicKey:   info.PreviousPublicKey,
+			PreviousKeyDeadline: info.PreviousKeyDeadline,
+			EncryptionOptOut:    info.EncryptionOptOut,
+			Ready:               info.Ready,
 		})
 		buf.sentWireguard.Add(nodename)
 		delete(buf.pendingWireguardUpdates, nodename)
@@ -759,6 +772,21 @@ func (buf *EventSequencer) OnWireguardRemove(nodename string) {
 	buf.pendingWireguardDeletes.Add(nodename)
 }
 
+// OnWireguardNodeInfoUpdate records the wireguard configuration carried by the resource of a node, see
+// WireguardNodeInfo. The info is sent with the next wireguard and host metadata updates of the node, which the
+// DataplanePassthru triggers whenever the info changes.
+func (buf *EventSequencer) OnWireguardNodeInfoUpdate(nodename string, info WireguardNodeInfo) {
+	log.WithFields(log.Fields{
+		"nodename": nodename,
+		"info":     info,
+	}).Debug("Wireguard node info updated")
+	if info == (WireguardNodeInfo{}) {
+		delete(buf.wireguardNodeInfo, nodename)
+	} else {
+		buf.wireguardNodeInfo[nodename] = info
+	}
+}
+
 func (buf *EventSequencer) flushNamespaces() {
 	// Order doesn't matter, but send removes first to reduce max occupancy
 	buf.pendingNamespaceDeletes.Iter(func(item interface{}) error {
@@ -25,6 +25,8 @@ import (
 	"github.com/projectcalico/felix/calc"
 	"github.com/projectcalico/felix/config"
 	"github.com/projectcalico/felix/proto"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/net"
 )
@@ -353,6 +355,201 @@ var _ = Describe("IPPool update/remove", func() {
 	})
 })
 
+var _ = Describe("Wireguard update/remove", func() {
+	var uut *calc.EventSequencer
+	var passthru *calc.DataplanePassthru
+	var recorder *dataplaneRecorder
+
+	const key = "pS0ZlgTuhBpjh4nkaPH0cgQvpdgVpGzjtO/7Z8MVD1I="
+
+	BeforeEach(func() {
+		uut = calc.NewEventSequencer(&dummyConfigInterface{})
+		recorder = &dataplaneRecorder{}
+		uut.Callback = recorder.record
+		passthru = calc.NewDataplanePassthru(uut)
+	})
+
+	nodeUpdate := func(annotations map[string]string) api.Update {
+		node := apiv3.NewNode()
+		node.Name = "node1"
+		node.Annotations = annotations
+		return api.Update{
+			KVPair: model.KVPair{
+				Key:   model.ResourceKey{Kind: apiv3.KindNode, Name: "node1"},
+				Value: node,
+			},
+			UpdateType: api.UpdateTypeKVUpdated,
+		}
+	}
+	wireguardUpdate := func() api.Update {
+		return api.Update{
+			KVPair: model.KVPair{
+				Key:   model.WireguardKey{NodeName: "node1"},
+				Value: &model.Wireguard{PublicKey: key},
+			},
+			UpdateType: api.UpdateTypeKVUpdated,
+		}
+	}
+
+	It("should send the listening port published in the node annotations", func() {
+		passthru.OnUpdate(wireguardUpdate())
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key},
+		}))
+
+		By("sending the wireguard update again when the port is published")
+		recorder.Messages = nil
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardListeningPortAnnotation: "51821"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key, ListeningPort: 51821},
+		}))
+
+		By("not sending the wireguard update again if the port is unchanged")
+		recorder.Messages = nil
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardListeningPortAnnotation: "51821"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(BeNil())
+
+		By("ignoring an invalid port")
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardListeningPortAnnotation: "70000"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key},
+		}))
+	})
+
+	It("should send the previous public key published in the node annotations during a key transition", func() {
+		const previousKey = "lT1uOGtC1phTcCEKfNtdHz3alm1LzOfEHpBZgqoR7Vg="
+		passthru.OnUpdate(wireguardUpdate())
+		passthru.OnUpdate(nodeUpdate(map[string]string{
+			calc.WireguardPreviousPublicKeyAnnotation:   previousKey,
+			calc.WireguardPreviousKeyDeadlineAnnotation: "1600000000",
+		}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{
+				Hostname:            "node1",
+				PublicKey:           key,
+				PreviousPublicKey:   previousKey,
+				PreviousKeyDeadline: 1600000000,
+			},
+		}))
+
+		By("ignoring the previous public key without a valid deadline")
+		recorder.Messages = nil
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardPreviousPublicKeyAnnotation: previousKey}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key},
+		}))
+	})
+
+	It("should send that the node is ready once it has published that its key is in use", func() {
+		passthru.OnUpdate(wireguardUpdate())
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardKeyStateAnnotation: "waiting-for-local-address"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key},
+		}))
+
+		recorder.Messages = nil
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardKeyStateAnnotation: "published"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key, Ready: true},
+		}))
+	})
+
+	It("should send that the node is ready once it has a key if the node resources are not received", func() {
+		passthru.EnableWireguardReadyOnKey()
+		passthru.OnUpdate(wireguardUpdate())
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key, Ready: true},
+		}))
+
+		By("not sending that the node is ready once its key is removed")
+		recorder.Messages = nil
+		update := wireguardUpdate()
+		update.Value = &model.Wireguard{}
+		passthru.OnUpdate(update)
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1"},
+		}))
+	})
+
+	It("should send the encryption opt-out labelled on the node", func() {
+		passthru.OnUpdate(wireguardUpdate())
+		update := nodeUpdate(nil)
+		update.Value.(*apiv3.Node).Labels = map[string]string{calc.WireguardEncryptionOptOutLabel: "true"}
+		passthru.OnUpdate(update)
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key, EncryptionOptOut: true},
+		}))
+
+		By("opting in again when the label is removed")
+		recorder.Messages = nil
+		passthru.OnUpdate(nodeUpdate(nil))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key},
+		}))
+	})
+
+	It("should send the enabled override labelled on the node with its host metadata", func() {
+		hostIP := mustParseIP("10.0.0.1")
+		passthru.OnUpdate(api.Update{
+			KVPair:     model.KVPair{Key: model.HostIPKey{Hostname: "node1"}, Value: &hostIP},
+			UpdateType: api.UpdateTypeKVNew,
+		})
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.HostMetadataUpdate{Hostname: "node1", Ipv4Addr: "10.0.0.1"},
+		}))
+
+		By("sending the host metadata again when the node is labelled")
+		recorder.Messages = nil
+		update := nodeUpdate(nil)
+		update.Value.(*apiv3.Node).Labels = map[string]string{calc.WireguardEnabledLabel: "Enabled"}
+		passthru.OnUpdate(update)
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.HostMetadataUpdate{Hostname: "node1", Ipv4Addr: "10.0.0.1", WireguardEnabledOverride: "Enabled"},
+		}))
+
+		By("not sending the host metadata again if only the wireguard annotations change")
+		recorder.Messages = nil
+		update = nodeUpdate(map[string]string{calc.WireguardListeningPortAnnotation: "51821"})
+		update.Value.(*apiv3.Node).Labels = map[string]string{calc.WireguardEnabledLabel: "Enabled"}
+		passthru.OnUpdate(update)
+		uut.Flush()
+		Expect(recorder.Messages).To(BeNil())
+
+		By("clearing the override when the label is removed")
+		passthru.OnUpdate(nodeUpdate(nil))
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.HostMetadataUpdate{Hostname: "node1", Ipv4Addr: "10.0.0.1"},
+		}))
+	})
+
+	It("should send the listening port with a wireguard update that follows the node update", func() {
+		passthru.OnUpdate(nodeUpdate(map[string]string{calc.WireguardListeningPortAnnotation: "51821"}))
+		uut.Flush()
+		Expect(recorder.Messages).To(BeNil())
+
+		passthru.OnUpdate(wireguardUpdate())
+		uut.Flush()
+		Expect(recorder.Messages).To(Equal([]interface{}{
+			&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key, ListeningPort: 51821},
+		}))
+	})
+})
+
 type dataplaneRecorder struct {
 	Messages []interface{}
 }
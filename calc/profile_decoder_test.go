@@ -160,6 +160,10 @@ func (p *passthruCallbackRecorder) OnWireguardRemove(string) {
 	Fail("OnWireguardRemove received")
 }
 
+func (p *passthruCallbackRecorder) OnWireguardNodeInfoUpdate(string, calc.WireguardNodeInfo) {
+	Fail("OnWireguardNodeInfoUpdate received")
+}
+
 func (p *passthruCallbackRecorder) OnServiceAccountUpdate(update *proto.ServiceAccountUpdate) {
 	p.saUpdates = append(p.saUpdates, update)
 }
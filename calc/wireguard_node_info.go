@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+
+	"github.com/projectcalico/felix/wireguard"
+)
+
+// The annotations of the node resource in which the felix of the node publishes the parts of its wireguard status that
+// the node resource has no fields for. The annotations are written along with the public key, see the daemon.
+const (
+	// WireguardListeningPortAnnotation is the listening port programmed on the wireguard interface of the node.
+	WireguardListeningPortAnnotation = "projectcalico.org/WireguardListeningPort"
+
+	// WireguardPreviousPublicKeyAnnotation is the previous public key of the node during a key transition, which the
+	// peers may use until the time in WireguardPreviousKeyDeadlineAnnotation, in seconds since the Unix epoch.
+	WireguardPreviousPublicKeyAnnotation   = "projectcalico.org/WireguardPreviousPublicKey"
+	WireguardPreviousKeyDeadlineAnnotation = "projectcalico.org/WireguardPreviousKeyDeadline"
+
+	// WireguardKeyStateAnnotation is the state of the public key of the node, e.g. "published", and
+	// WireguardEnabledSourceAnnotation is what determines whether wireguard is enabled on the node, "config" or
+	// "node-override". The key state determines whether the node is ready, the enabled source is informational.
+	WireguardKeyStateAnnotation      = "projectcalico.org/WireguardKeyState"
+	WireguardEnabledSourceAnnotation = "projectcalico.org/WireguardEnabledSource"
+)
+
+// WireguardEnabledLabel is the label of the node resource with which an administrator overrides whether wireguard is
+// enabled on the node, "Enabled" or "Disabled", see config.Config.WireguardAllowEnabledOverride.
+const WireguardEnabledLabel = "projectcalico.org/wireguard-enabled"
+
+// WireguardEncryptionOptOutLabel is the label of the node resource with which an administrator excludes the traffic to
+// the node from wireguard encryption, if set to "true". The node is then not programmed as a wireguard peer by the other
+// nodes, even though it has a public key.
+const WireguardEncryptionOptOutLabel = "projectcalico.org/wireguard-encryption-opt-out"
+
+// WireguardNodeInfo is the wireguard configuration of a node that is carried by the node resource alongside the
+// wireguard configuration passed through by libcalico-go, see DataplanePassthru. It is only known if the calculation
+// graph receives the node resources, see config.Config.UseNodeResourceUpdates.
+type WireguardNodeInfo struct {
+	// ListeningPort is the listening port of the wireguard interface of the node, or zero if it is not published, in
+	// which case the peers use their own port.
+	ListeningPort int
+
+	// PreviousPublicKey is the previous public key of the node during a key transition, which the peers may use until
+	// PreviousKeyDeadline, in seconds since the Unix epoch. Both are zero outside of a key transition.
+	PreviousPublicKey   string
+	PreviousKeyDeadline int64
+
+	// EnabledOverride is the value of the WireguardEnabledLabel of the node, or empty if the label is not set. It is
+	// passed through with the host metadata of the node rather than with its wireguard configuration.
+	EnabledOverride string
+
+	// EncryptionOptOut is true if the traffic to the node is excluded from encryption, see
+	// WireguardEncryptionOptOutLabel.
+	EncryptionOptOut bool
+
+	// Ready is true if the node has published that its public key is in use, see WireguardKeyStateAnnotation, so that
+	// it is ready to receive wireguard traffic. This is what config.Config.WireguardRequirePeerReady waits for. If the
+	// node resources are not received a node is ready once it has a public key, see EnableWireguardReadyOnKey.
+	Ready bool
+}
+
+// wireguardNodeInfoFromNode returns the wireguard configuration carried by the annotations and labels of a node
+// resource. Values that cannot be parsed are ignored, as if they were not set.
+func wireguardNodeInfoFromNode(node *apiv3.Node) WireguardNodeInfo {
+	var info WireguardNodeInfo
+	if value, ok := node.Annotations[WireguardListeningPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			log.WithField("node", node.Name).WithField("port", value).Warn(
+				"Ignoring invalid wireguard listening port annotation")
+		} else {
+			info.ListeningPort = port
+		}
+	}
+	if key, ok := node.Annotations[WireguardPreviousPublicKeyAnnotation]; ok && key != "" {
+		value := node.Annotations[WireguardPreviousKeyDeadlineAnnotation]
+		deadline, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || deadline <= 0 {
+			log.WithField("node", node.Name).WithField("deadline", value).Warn(
+				"Ignoring wireguard previous public key annotation with an invalid deadline")
+		} else {
+			info.PreviousPublicKey = key
+			info.PreviousKeyDeadline = deadline
+		}
+	}
+	info.Ready = node.Annotations[WireguardKeyStateAnnotation] == string(wireguard.KeyStatePublished)
+	info.EnabledOverride = node.Labels[WireguardEnabledLabel]
+	if value, ok := node.Labels[WireguardEncryptionOptOutLabel]; ok {
+		optOut, err := strconv.ParseBool(value)
+		if err != nil {
+			log.WithField("node", node.Name).WithField("value", value).Warn(
+				"Ignoring invalid wireguard encryption opt-out label")
+		}
+		info.EncryptionOptOut = optOut
+	}
+	return info
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/projectcalico/felix/bpf"
+	"github.com/projectcalico/felix/bpf/state"
+)
+
+var (
+	stateWatchLatency  bool
+	stateWatchInterval time.Duration
+	stateWatchDuration time.Duration
+)
+
+func init() {
+	stateWatchCmd.Flags().BoolVar(&stateWatchLatency, "latency", false,
+		"record the latencies between the BPF programs and print a histogram at the end of the run")
+	stateWatchCmd.Flags().DurationVar(&stateWatchInterval, "interval", 100*time.Millisecond,
+		"interval between the reads of the state map")
+	stateWatchCmd.Flags().DurationVar(&stateWatchDuration, "duration", 10*time.Second,
+		"duration of the run, or zero to run until interrupted")
+	stateCmd.AddCommand(stateWatchCmd)
+	rootCmd.AddCommand(stateCmd)
+}
+
+var stateWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "watches the per-CPU state written by the BPF programs",
+	Long: "Reads the per-CPU state map at each interval and prints the state of each CPU that has run a BPF program " +
+		"since the previous read. With --latency, the latencies between the start times of the programs that ran on " +
+		"each CPU are recorded instead, and printed as a histogram at the end of the run. The programs only record " +
+		"their start time if they are compiled with INFO logging or above.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := watchState(); err != nil {
+			log.WithError(err).Error("Failed to watch the state map.")
+		}
+	},
+}
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspects the state written by the BPF programs",
+}
+
+func watchState() error {
+	mc := &bpf.MapContext{}
+	stateMap := state.Map(mc)
+
+	prev, err := state.ReadPerCPU(stateMap)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	var deadline <-chan time.Time
+	if stateWatchDuration > 0 {
+		deadline = time.After(stateWatchDuration)
+	}
+	ticker := time.NewTicker(stateWatchInterval)
+	defer ticker.Stop()
+
+	histogram := state.NewHistogram()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			printLatency(histogram)
+			return nil
+		case <-deadline:
+			printLatency(histogram)
+			return nil
+		}
+
+		cur, err := state.ReadPerCPU(stateMap)
+		if err != nil {
+			return err
+		}
+		if stateWatchLatency {
+			histogram.RecordPerCPU(prev, cur)
+		} else {
+			for cpu := range cur {
+				if cpu < len(prev) && cur[cpu] == prev[cpu] {
+					continue
+				}
+				fmt.Printf("CPU %d: %+v\n", cpu, cur[cpu])
+			}
+		}
+		prev = cur
+	}
+}
+
+func printLatency(histogram *state.Histogram) {
+	if stateWatchLatency {
+		fmt.Print("BPF program latency:\n" + histogram.String())
+	}
+}
@@ -109,6 +109,203 @@ type Config struct {
 	WireguardRoutingRulePriority int    `config:"int;99"`
 	WireguardInterfaceName       string `config:"iface-param;wireguard.cali;non-zero"`
 	WireguardMTU                 int    `config:"int;1420;non-zero"`
+	// WireguardAdditionalRouteTypes lists the route types, in addition to remote workload routes, whose traffic should
+	// be routed through the wireguard tunnel. This is currently only configurable locally.
+	WireguardAdditionalRouteTypes []string `config:"oneof-list(RemoteHost);;local"`
+	// WireguardUserspaceFallbackEnabled enables the use of a userspace wireguard implementation when the kernel does
+	// not support wireguard. The device is created externally, or by running WireguardUserspaceHelper with the
+	// interface name as its argument.
+	WireguardUserspaceFallbackEnabled bool   `config:"bool;false;local"`
+	WireguardUserspaceHelper          string `config:"file(must-exist,executable);;local"`
+	// WireguardRoutingRulePriorityRange is the maximum distance from WireguardRoutingRulePriority that the wireguard
+	// routing rule may be moved to if another component has a rule at the configured priority.
+	WireguardRoutingRulePriorityRange int `config:"int(0,100);1;local"`
+	// WireguardRepairWrongLinkType deletes and recreates the wireguard interface if another type of device is using the
+	// interface name.
+	WireguardRepairWrongLinkType bool `config:"bool;false;local"`
+	// WireguardInterfaceAddressPrefixLength is the prefix length of the address configured on the wireguard interface.
+	// If zero, a host prefix is used.
+	WireguardInterfaceAddressPrefixLength int `config:"int(0,128);0;local"`
+	// WireguardRequirePeerReady only routes traffic to a peer through wireguard once the peer has reported that it is
+	// ready. This avoids a connectivity gap while migrating a cluster from IPIP or VXLAN to wireguard. A peer reports
+	// that it is ready by publishing the state of its key on its node resource. Without the node resource updates, see
+	// UseNodeResourceUpdates, a peer is treated as ready once it has a public key.
+	WireguardRequirePeerReady bool `config:"bool;false;local"`
+	// WireguardProgramPeersWithoutEndpoint programs the wireguard peers that have no endpoint address, so that they may
+	// initiate the handshake. If false, the traffic to such a peer is not routed through wireguard.
+	WireguardProgramPeersWithoutEndpoint bool `config:"bool;false;local"`
+	// WireguardPublishKeyWithoutEndpoint publishes the wireguard public key of this node even while no endpoint address
+	// is known for it. If false, the key is held back until the address is known, so that the peers do not program an
+	// endpoint that they cannot reach.
+	WireguardPublishKeyWithoutEndpoint bool `config:"bool;false;local"`
+	// WireguardMaxPeers and WireguardMaxAllowedIPsPerPeer limit the number of wireguard peers and the number of allowed
+	// IPs of each peer. Peers and allowed IPs over the limits are not routed through wireguard. Zero is unlimited.
+	WireguardMaxPeers             int `config:"int(0,65535);0;local"`
+	WireguardMaxAllowedIPsPerPeer int `config:"int(0,65535);0;local"`
+	// WireguardStrictTableOwnership removes all unexpected routes from the wireguard routing table. If false, only
+	// routes programmed by Felix are removed, so that the table may be shared with other static routes.
+	WireguardStrictTableOwnership bool `config:"bool;true;local"`
+	// WireguardLegacyRouteProtocols lists the route protocols that Felix previously programmed the wireguard routes with,
+	// e.g. before DeviceRouteProtocol was changed. Routes with these protocols are treated as programmed by Felix, and
+	// rewritten with the current protocol, even if WireguardStrictTableOwnership is false.
+	WireguardLegacyRouteProtocols []int `config:"int-list(0,255);;local"`
+	// WireguardLogSeverity optionally overrides the log severity of the wireguard module, so that wireguard may be debugged
+	// without enabling debug logging for the rest of felix. The more verbose wireguard logs are written to the log
+	// destinations with the most verbose log severity.
+	WireguardLogSeverity string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);;local"`
+	// WireguardUnderlayInterface is the interface used by the wireguard traffic on nodes with multiple underlay
+	// interfaces, and WireguardUnderlaySourceIP the source address of that traffic, by default the node address. The
+	// traffic sent by wireguard is routed through the interface using an additional routing table.
+	WireguardUnderlayInterface string `config:"iface-param;;local"`
+	WireguardUnderlaySourceIP  net.IP `config:"ipv4;;local"`
+	// WireguardFullRebuildAfterResyncs is the number of consecutive resyncs that find the wireguard device does not
+	// match the expected configuration after which the wireguard device configuration and routing tables are rebuilt
+	// from scratch. Zero disables the rebuild.
+	WireguardFullRebuildAfterResyncs int `config:"int(0,100);0;local"`
+	// WireguardResyncDivergencePercent is the percentage of the wireguard peers that a resync must find missing from
+	// the device, after a resync that found the device in-sync, before the device is read again to confirm that the
+	// peers are missing rather than the read being incomplete, e.g. while `wg show` reads the device. The device is
+	// only reconfigured if the second read confirms. Zero disables the second read.
+	WireguardResyncDivergencePercent int `config:"int(0,100);50;local"`
+	// WireguardApplyTimeout is the deadline for applying the wireguard configuration. The remaining updates are
+	// abandoned when the deadline is exceeded and retried on the next apply, so that an unresponsive netlink socket
+	// does not stall the dataplane. Zero disables the deadline.
+	WireguardApplyTimeout time.Duration `config:"seconds;0;local"`
+	// WireguardRouteNetlinkTimeout is the timeout of the netlink sockets used to program the wireguard routing tables,
+	// which are separate from the socket used for the wireguard interface and routing rules, so that a slow routing
+	// table does not hold up the rules. Zero uses NetlinkTimeoutSecs.
+	WireguardRouteNetlinkTimeout time.Duration `config:"seconds;0;local"`
+	// WireguardInterfaceAddressSource is the source of the wireguard interface address: the datastore, where it is
+	// allocated by another component, the node IP, or an address derived from a hash of the hostname within
+	// WireguardInterfaceAddressPool. Addresses that are not from the datastore are written to the datastore.
+	WireguardInterfaceAddressSource string `config:"oneof(datastore,node-ip,derived);datastore;local"`
+	WireguardInterfaceAddressPool   string `config:"cidr;;local"`
+	// WireguardTeardownOnExit removes the wireguard interface, routing rule and routes when felix is stopped, e.g. when
+	// the node is being removed from the cluster. By default they are left in place for the next felix to take over.
+	WireguardTeardownOnExit bool `config:"bool;false;local"`
+	// WireguardApplyStallMultiplier reports felix as not live if a wireguard apply has been in progress, or wireguard
+	// updates have been waiting for an apply, for longer than this multiple of NetlinkTimeoutSecs. This catches a
+	// stalled wireguard apply while the rest of the dataplane is still making progress. Zero disables the check.
+	WireguardApplyStallMultiplier int `config:"int(0,1000);6;local"`
+	// WireguardNotSupportedReprobeInterval is the interval at which felix checks again whether wireguard is supported
+	// once it has been found not to be, e.g. so that wireguard is enabled after the kernel module is loaded. The first
+	// check is after 30s. Zero disables the checks, in which case support is only checked on a route refresh.
+	WireguardNotSupportedReprobeInterval time.Duration `config:"seconds;1800;local"`
+	// WireguardRoutePriority is the priority (metric) of the routes in the wireguard routing table. A non-zero priority
+	// allows backup routes for the same destinations, with a higher priority, to be programmed alongside the wireguard
+	// routes.
+	WireguardRoutePriority int `config:"int(0,2147483647);0;local"`
+	// WireguardRouteViaPeerTunnelIP programs the routes of the workload CIDRs of each wireguard peer via the wireguard
+	// interface address of the peer, so that a traceroute through wireguard shows the peer as a hop. The routes of a
+	// peer whose interface address is not known are device routes.
+	WireguardRouteViaPeerTunnelIP bool `config:"bool;false;local"`
+	// WireguardStaleHandshakeThreshold is the age of the last handshake with a wireguard peer after which the peer is
+	// reported as stale in the wireguard diagnostics.
+	WireguardStaleHandshakeThreshold time.Duration `config:"seconds;180;local"`
+	// WireguardCapacityStatsInterval is the interval at which the counts of the programmed wireguard peers, allowed IPs
+	// and routes are published to the Prometheus metrics and the wireguard status. Zero disables the counts.
+	WireguardCapacityStatsInterval time.Duration `config:"seconds;60;local"`
+	// WireguardCoverageLogThreshold is the change in the wireguard encryption coverage of the workload CIDRs of the
+	// other nodes, in percentage points, that is logged. The coverage report is served on the wireguard admin interface,
+	// see WireguardAdminSocketPath. Zero disables the logging.
+	WireguardCoverageLogThreshold int `config:"int(0,100);0;local"`
+	// WireguardPeerBatchThreshold coalesces bursts of wireguard peer updates, e.g. when most nodes publish new keys
+	// during an upgrade: once more than this many peers have been updated within WireguardPeerBatchWindow, the peers
+	// and their routes are programmed as one batch at the end of the window. Updates of our own key, and peers that had
+	// no key, are programmed immediately. Zero disables the batching.
+	WireguardPeerBatchThreshold int           `config:"int(0,2147483647);0;local"`
+	WireguardPeerBatchWindow    time.Duration `config:"seconds;10;local"`
+	// WireguardAllowEnabledOverride allows WireguardEnabled to be overridden on each node by the wireguard enabled
+	// override of the node, e.g. so that wireguard is rolled out to a canary pool of nodes first. The wireguard mark bit
+	// and routing table are then reserved even if wireguard is not enabled.
+	WireguardAllowEnabledOverride bool `config:"bool;false"`
+	// WireguardRoutingTableIndexAuto chooses a free routing table for wireguard between WireguardRoutingTableIndexAutoMin
+	// and WireguardRoutingTableIndexAutoMax, rather than allocating the table from RouteTableRange. The table used
+	// previously is used again after a restart. The range should not overlap RouteTableRange or other routing tables
+	// that may not yet be programmed.
+	WireguardRoutingTableIndexAuto    bool `config:"bool;false;local"`
+	WireguardRoutingTableIndexAutoMin int  `config:"int(1,2147483647);1000;local"`
+	WireguardRoutingTableIndexAutoMax int  `config:"int(1,2147483647);1999;local"`
+	// WireguardParentInterfaces lists the interfaces, or /regex/ patterns of interfaces, that carry the wireguard
+	// traffic. When one of these interfaces comes up the wireguard routing rules, interface address and device
+	// configuration are resynced, since the kernel may have flushed them while the interface was down.
+	WireguardParentInterfaces []*regexp.Regexp `config:"iface-list-regexp;;local"`
+	// WireguardAdoptExistingDevice adopts the wireguard device left by a previous felix on startup, keeping its private
+	// key and leaving its peers in place until the datastore is in sync, so that a restart does not disrupt the
+	// encrypted traffic.
+	WireguardAdoptExistingDevice bool `config:"bool;true;local"`
+	// WireguardCIDRFlapMaxMoves damps workload CIDRs that repeatedly move between nodes: once a CIDR has moved more than
+	// this many times within WireguardCIDRFlapWindow, its moves are not programmed until it has not moved for
+	// WireguardCIDRFlapHoldDown. While damped the CIDR keeps its last stable node or, if WireguardCIDRFlapThrowRoute is
+	// set, is routed outside of wireguard. Zero disables the damping.
+	WireguardCIDRFlapMaxMoves   int           `config:"int(0,2147483647);0;local"`
+	WireguardCIDRFlapWindow     time.Duration `config:"seconds;60;local"`
+	WireguardCIDRFlapHoldDown   time.Duration `config:"seconds;60;local"`
+	WireguardCIDRFlapThrowRoute bool          `config:"bool;false;local"`
+	// WireguardEndpointFailoverTimeout switches the wireguard endpoint of a node that has a secondary address to that
+	// address if there has been no handshake through the primary address within the timeout, alternating between the
+	// addresses until there is a handshake. Zero disables the failover.
+	WireguardEndpointFailoverTimeout time.Duration `config:"seconds;0;local"`
+	// WireguardProvisionalKeyTimeout gives a node that is added with the endpoint address of a node removed within the
+	// timeout the wireguard key of the removed node, until its own key arrives, e.g. when a node is replaced in place
+	// under a new name. This avoids routing around wireguard while the key of the new node is published. The key is
+	// dropped if the key of the new node has not arrived within the timeout. Zero disables the carry over.
+	WireguardProvisionalKeyTimeout time.Duration `config:"seconds;0;local"`
+	// WireguardKeyTransitionTimeout publishes the previous wireguard key alongside a new key for the timeout, and keeps
+	// the peer of the previous key of another node until its published deadline, capped at the timeout, or until there
+	// is a handshake with its new key. This shortens the loss of connectivity during a key rotation. Zero disables the
+	// key transitions.
+	WireguardKeyTransitionTimeout time.Duration `config:"seconds;0;local"`
+	// WireguardLocalCIDRsAsThrow programs throw routes in the wireguard routing table for the CIDRs of the local node,
+	// so that local traffic is never routed to wireguard while felix is reconciling the routes.
+	WireguardLocalCIDRsAsThrow bool `config:"bool;false;local"`
+	// WireguardMaxPauseDuration is the longest the wireguard reconciliation may be paused for through the wireguard
+	// admin socket, after which it is resumed automatically.
+	WireguardMaxPauseDuration time.Duration `config:"seconds;600;local"`
+	// WireguardConntrackCleanup removes the conntrack entries of a workload CIDR when it is no longer routed through
+	// wireguard, e.g. because the peer has disabled wireguard, so that established connections are not left to hang.
+	WireguardConntrackCleanup bool `config:"bool;false;local"`
+	// WireguardHostnameCanonicalization is how the node names in the wireguard updates are canonicalized, so that the
+	// names of the same node that differ in format are treated as the same node. Lowercase lowercases the names and
+	// trims any trailing dots, and None uses the names as they are.
+	WireguardHostnameCanonicalization string `config:"oneof(Lowercase,None);Lowercase;local"`
+	// WireguardRuleSelectors select the traffic that the wireguard routing rule sends to the wireguard routing table.
+	// The traffic must match all of the selectors: fwmark matches the traffic not sent by wireguard itself, source the
+	// traffic from the IPAM blocks of this node, and iif the traffic from the interfaces whose names start with
+	// WireguardRuleIifPrefix.
+	WireguardRuleSelectors []string `config:"oneof-list(fwmark,source,iif);fwmark;local"`
+	WireguardRuleIifPrefix string   `config:"iface-param;cali;local"`
+	// WireguardNonWireguardPeerHandling controls how the traffic to the nodes that are not routed over wireguard
+	// bypasses the wireguard routing table: throw programs a throw route for each of their CIDRs, and rule-exclude
+	// programs no routes, only a routing rule for each of their CIDRs that is within a CIDR routed over wireguard.
+	WireguardNonWireguardPeerHandling string `config:"oneof(throw,rule-exclude);throw;local"`
+	// WireguardAllowedIPsChunkSize is the maximum number of allowed IPs in a single wireguard device update. The
+	// allowed IPs of a peer with more are configured over several updates, so that an update does not exceed the
+	// netlink message size.
+	WireguardAllowedIPsChunkSize int `config:"int(1,65535);1000;local"`
+	// WireguardNodeOverridesFile is the path of an optional JSON file of node-local overrides of the wireguard listening
+	// port, MTU, persistent keepalive and routing rule priority, e.g. {"listeningPort": 51821, "mtu": 1380}. The file
+	// is re-read on each resync of the wireguard configuration.
+	WireguardNodeOverridesFile string `config:"file;;local"`
+	// WireguardDSCP is the DSCP set on the encrypted wireguard traffic sent from WireguardListeningPort, so that the
+	// traffic can be given a QoS class by the network, and the realm of the routes to the wireguard interface. -1, the
+	// default, disables the marking.
+	WireguardDSCP int `config:"int(-1,63);-1;local"`
+	// WireguardCatchAllRoute programs a single default route to the wireguard interface in place of a route for each
+	// CIDR of the wireguard peers, for clusters where all of the traffic between the nodes is encrypted. The CIDRs of
+	// the local node, the WireguardCatchAllThrowCIDRs, e.g. the underlay CIDRs of the nodes, and the CIDRs of the nodes
+	// that are not routed over wireguard are thrown back to the main routing table. Implies WireguardLocalCIDRsAsThrow.
+	WireguardCatchAllRoute      bool     `config:"bool;false;local"`
+	WireguardCatchAllThrowCIDRs []string `config:"cidr-list;;local"`
+	// WireguardTraceBufferSize is the number of the most recent netlink and wireguard operations made by the wireguard
+	// module that are kept, along with why each operation was made and its result, for debugging routes, rules or
+	// peers that are being rewritten. The trace is returned in the dump of the wireguard admin interface, see
+	// WireguardAdminSocketPath. Zero disables the trace.
+	WireguardTraceBufferSize int `config:"int(0,100000);0;local"`
+	// WireguardAdminSocketPath is the path of the Unix domain socket on which the wireguard admin interface is served,
+	// conventionally /var/run/calico/wireguard-admin.sock. The socket is only accessible by the user felix runs as.
+	// Empty disables the admin interface.
+	WireguardAdminSocketPath string `config:"file;;local"`
 
 	BPFEnabled                         bool           `config:"bool;false"`
 	BPFDisableUnprivileged             bool           `config:"bool;true"`
@@ -206,6 +403,11 @@ type Config struct {
 	IpInIpMtu        int    `config:"int;1440;non-zero"`
 	IpInIpTunnelAddr net.IP `config:"ipv4;"`
 
+	// HostMTU is the MTU of the host network. When set, Felix sets the MTU of the workload interfaces to the host MTU
+	// less the overhead of the active encapsulation: IPIP, VXLAN or wireguard (if supported by the kernel). When zero,
+	// the workload interface MTU is not managed by Felix.
+	HostMTU int `config:"int;0;local"`
+
 	ReportingIntervalSecs time.Duration `config:"seconds;30"`
 	ReportingTTLSecs      time.Duration `config:"seconds;90"`
 
@@ -572,6 +774,17 @@ func loadParams() {
 				}
 			}
 			param = &IntParam{Min: min, Max: max}
+		case "int-list":
+			minAndMax := strings.Split(kindParams, ",")
+			min, err := strconv.Atoi(minAndMax[0])
+			if err != nil {
+				log.Panicf("Failed to parse min value for %v", field.Name)
+			}
+			max, err := strconv.Atoi(minAndMax[1])
+			if err != nil {
+				log.Panicf("Failed to parse max value for %v", field.Name)
+			}
+			param = &IntSliceParam{Min: min, Max: max}
 		case "int32":
 			param = &Int32Param{}
 		case "mark-bitmask":
@@ -631,9 +844,19 @@ func loadParams() {
 			}
 			param = &OneofListParam{
 				lowerCaseOptionsToCanonical: lowerCaseToCanon}
+		case "oneof-list":
+			options := strings.Split(kindParams, ",")
+			lowerCaseToCanon := make(map[string]string)
+			for _, option := range options {
+				lowerCaseToCanon[strings.ToLower(option)] = option
+			}
+			param = &OneofSliceParam{
+				lowerCaseOptionsToCanonical: lowerCaseToCanon}
 		case "string":
 			param = &RegexpParam{Regexp: StringRegexp,
 				Msg: "invalid string"}
+		case "cidr":
+			param = &CIDRParam{}
 		case "cidr-list":
 			param = &CIDRListParam{}
 		case "route-table-range":
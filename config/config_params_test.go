@@ -247,6 +247,8 @@ var _ = DescribeTable("Config parsing",
 	Entry("IpInIpEnabled", "IpInIpEnabled", "True", true),
 
 	Entry("IpInIpMtu", "IpInIpMtu", "1234", int(1234)),
+	Entry("HostMTU", "HostMTU", "1500", int(1500)),
+	Entry("HostMTU invalid", "HostMTU", "not-a-number", int(0)),
 	Entry("IpInIpTunnelAddr", "IpInIpTunnelAddr",
 		"10.0.0.1", net.ParseIP("10.0.0.1")),
 
@@ -372,6 +374,124 @@ var _ = DescribeTable("Config parsing",
 
 	Entry("IptablesNATOutgoingInterfaceFilter", "IptablesNATOutgoingInterfaceFilter", "cali-123", "cali-123"),
 	Entry("IptablesNATOutgoingInterfaceFilter", "IptablesNATOutgoingInterfaceFilter", "cali@123", "", false),
+
+	Entry("WireguardAdditionalRouteTypes", "WireguardAdditionalRouteTypes", "RemoteHost", []string{"RemoteHost"}),
+	Entry("WireguardAdditionalRouteTypes lower case", "WireguardAdditionalRouteTypes", "remotehost", []string{"RemoteHost"}),
+	Entry("WireguardAdditionalRouteTypes empty", "WireguardAdditionalRouteTypes", "", []string(nil)),
+	Entry("WireguardAdditionalRouteTypes invalid", "WireguardAdditionalRouteTypes", "RemoteHost,Foo", []string(nil)),
+	Entry("WireguardUserspaceFallbackEnabled", "WireguardUserspaceFallbackEnabled", "true", true),
+	Entry("WireguardRepairWrongLinkType", "WireguardRepairWrongLinkType", "true", true),
+	Entry("WireguardRoutingRulePriorityRange", "WireguardRoutingRulePriorityRange", "5", int(5)),
+	Entry("WireguardRoutingRulePriorityRange out of range", "WireguardRoutingRulePriorityRange", "101", int(1)),
+	Entry("WireguardInterfaceAddressPrefixLength", "WireguardInterfaceAddressPrefixLength", "24", int(24)),
+	Entry("WireguardInterfaceAddressPrefixLength out of range", "WireguardInterfaceAddressPrefixLength", "129", int(0)),
+	Entry("WireguardRequirePeerReady", "WireguardRequirePeerReady", "true", true),
+	Entry("WireguardProgramPeersWithoutEndpoint", "WireguardProgramPeersWithoutEndpoint", "true", true),
+	Entry("WireguardPublishKeyWithoutEndpoint", "WireguardPublishKeyWithoutEndpoint", "true", true),
+	Entry("WireguardMaxPeers", "WireguardMaxPeers", "500", int(500)),
+	Entry("WireguardMaxPeers negative", "WireguardMaxPeers", "-1", int(0)),
+	Entry("WireguardMaxAllowedIPsPerPeer", "WireguardMaxAllowedIPsPerPeer", "1000", int(1000)),
+	Entry("WireguardStrictTableOwnership", "WireguardStrictTableOwnership", "false", false),
+	Entry("WireguardStrictTableOwnership default", "WireguardStrictTableOwnership", "", true),
+	Entry("WireguardLegacyRouteProtocols", "WireguardLegacyRouteProtocols", "80, 0x10", []int{80, 16}),
+	Entry("WireguardLegacyRouteProtocols default", "WireguardLegacyRouteProtocols", "", []int(nil)),
+	Entry("WireguardLegacyRouteProtocols out of range", "WireguardLegacyRouteProtocols", "80,256", []int(nil)),
+	Entry("WireguardLegacyRouteProtocols invalid", "WireguardLegacyRouteProtocols", "80,boot", []int(nil)),
+	Entry("WireguardLogSeverity", "WireguardLogSeverity", "debug", "DEBUG"),
+	Entry("WireguardLogSeverity default", "WireguardLogSeverity", "", ""),
+	Entry("WireguardUnderlayInterface", "WireguardUnderlayInterface", "eth1", "eth1"),
+	Entry("WireguardUnderlayInterface invalid", "WireguardUnderlayInterface", "eth 1", "", false),
+	Entry("WireguardUnderlaySourceIP", "WireguardUnderlaySourceIP", "10.0.0.1", net.ParseIP("10.0.0.1")),
+	Entry("WireguardFullRebuildAfterResyncs", "WireguardFullRebuildAfterResyncs", "3", int(3)),
+	Entry("WireguardFullRebuildAfterResyncs out of range", "WireguardFullRebuildAfterResyncs", "101", int(0)),
+	Entry("WireguardResyncDivergencePercent", "WireguardResyncDivergencePercent", "25", int(25)),
+	Entry("WireguardResyncDivergencePercent default", "WireguardResyncDivergencePercent", "", int(50)),
+	Entry("WireguardResyncDivergencePercent out of range", "WireguardResyncDivergencePercent", "101", int(50)),
+	Entry("WireguardApplyTimeout", "WireguardApplyTimeout", "5", 5*time.Second),
+	Entry("WireguardRouteNetlinkTimeout", "WireguardRouteNetlinkTimeout", "3", 3*time.Second),
+	Entry("WireguardRouteNetlinkTimeout default", "WireguardRouteNetlinkTimeout", "", time.Duration(0)),
+	Entry("WireguardInterfaceAddressSource", "WireguardInterfaceAddressSource", "Derived", "derived"),
+	Entry("WireguardInterfaceAddressSource default", "WireguardInterfaceAddressSource", "", "datastore"),
+	Entry("WireguardInterfaceAddressPool", "WireguardInterfaceAddressPool", "10.10.0.0/16", "10.10.0.0/16"),
+	Entry("WireguardInterfaceAddressPool invalid", "WireguardInterfaceAddressPool", "10.10.0.0/33", "", false),
+	Entry("WireguardTeardownOnExit", "WireguardTeardownOnExit", "true", true),
+	Entry("WireguardApplyStallMultiplier", "WireguardApplyStallMultiplier", "3", 3),
+	Entry("WireguardApplyStallMultiplier default", "WireguardApplyStallMultiplier", "", 6),
+	Entry("WireguardNotSupportedReprobeInterval", "WireguardNotSupportedReprobeInterval", "60", 60*time.Second),
+	Entry("WireguardNotSupportedReprobeInterval default", "WireguardNotSupportedReprobeInterval", "", 30*time.Minute),
+	Entry("WireguardRoutePriority", "WireguardRoutePriority", "100", 100),
+	Entry("WireguardRouteViaPeerTunnelIP", "WireguardRouteViaPeerTunnelIP", "true", true),
+	Entry("WireguardRouteViaPeerTunnelIP default", "WireguardRouteViaPeerTunnelIP", "", false),
+	Entry("WireguardStaleHandshakeThreshold", "WireguardStaleHandshakeThreshold", "300", 300*time.Second),
+	Entry("WireguardStaleHandshakeThreshold default", "WireguardStaleHandshakeThreshold", "", 180*time.Second),
+	Entry("WireguardCapacityStatsInterval", "WireguardCapacityStatsInterval", "10", 10*time.Second),
+	Entry("WireguardCapacityStatsInterval default", "WireguardCapacityStatsInterval", "", 60*time.Second),
+	Entry("WireguardCoverageLogThreshold", "WireguardCoverageLogThreshold", "5", 5),
+	Entry("WireguardCoverageLogThreshold default", "WireguardCoverageLogThreshold", "", 0),
+	Entry("WireguardPeerBatchThreshold", "WireguardPeerBatchThreshold", "50", 50),
+	Entry("WireguardPeerBatchThreshold default", "WireguardPeerBatchThreshold", "", 0),
+	Entry("WireguardPeerBatchWindow", "WireguardPeerBatchWindow", "5", 5*time.Second),
+	Entry("WireguardPeerBatchWindow default", "WireguardPeerBatchWindow", "", 10*time.Second),
+	Entry("WireguardAllowEnabledOverride", "WireguardAllowEnabledOverride", "true", true),
+	Entry("WireguardAllowEnabledOverride default", "WireguardAllowEnabledOverride", "", false),
+	Entry("WireguardRoutingTableIndexAuto", "WireguardRoutingTableIndexAuto", "true", true),
+	Entry("WireguardRoutingTableIndexAutoMin default", "WireguardRoutingTableIndexAutoMin", "", 1000),
+	Entry("WireguardRoutingTableIndexAutoMax", "WireguardRoutingTableIndexAutoMax", "300", 300),
+	Entry("WireguardRoutingTableIndexAutoMin out of range", "WireguardRoutingTableIndexAutoMin", "0", int(1000)),
+	Entry("WireguardParentInterfaces", "WireguardParentInterfaces", "eth0,/^bond.*$/", []*regexp.Regexp{
+		regexp.MustCompile("^eth0$"),
+		regexp.MustCompile("^bond.*$"),
+	}),
+	Entry("WireguardParentInterfaces invalid", "WireguardParentInterfaces", "eth 0", []*regexp.Regexp(nil), false),
+	Entry("WireguardAdoptExistingDevice", "WireguardAdoptExistingDevice", "false", false),
+	Entry("WireguardAdoptExistingDevice default", "WireguardAdoptExistingDevice", "", true),
+	Entry("WireguardCIDRFlapMaxMoves", "WireguardCIDRFlapMaxMoves", "3", 3),
+	Entry("WireguardCIDRFlapMaxMoves default", "WireguardCIDRFlapMaxMoves", "", 0),
+	Entry("WireguardCIDRFlapHoldDown", "WireguardCIDRFlapHoldDown", "120", 120*time.Second),
+	Entry("WireguardCIDRFlapWindow default", "WireguardCIDRFlapWindow", "", 60*time.Second),
+	Entry("WireguardCIDRFlapThrowRoute", "WireguardCIDRFlapThrowRoute", "true", true),
+	Entry("WireguardEndpointFailoverTimeout", "WireguardEndpointFailoverTimeout", "90", 90*time.Second),
+	Entry("WireguardEndpointFailoverTimeout default", "WireguardEndpointFailoverTimeout", "", time.Duration(0)),
+	Entry("WireguardProvisionalKeyTimeout", "WireguardProvisionalKeyTimeout", "300", 300*time.Second),
+	Entry("WireguardProvisionalKeyTimeout default", "WireguardProvisionalKeyTimeout", "", time.Duration(0)),
+	Entry("WireguardKeyTransitionTimeout", "WireguardKeyTransitionTimeout", "120", 120*time.Second),
+	Entry("WireguardKeyTransitionTimeout default", "WireguardKeyTransitionTimeout", "", time.Duration(0)),
+	Entry("WireguardLocalCIDRsAsThrow", "WireguardLocalCIDRsAsThrow", "true", true),
+	Entry("WireguardLocalCIDRsAsThrow default", "WireguardLocalCIDRsAsThrow", "", false),
+	Entry("WireguardMaxPauseDuration", "WireguardMaxPauseDuration", "120", 120*time.Second),
+	Entry("WireguardMaxPauseDuration default", "WireguardMaxPauseDuration", "", 10*time.Minute),
+	Entry("WireguardConntrackCleanup", "WireguardConntrackCleanup", "true", true),
+	Entry("WireguardHostnameCanonicalization", "WireguardHostnameCanonicalization", "none", "None"),
+	Entry("WireguardHostnameCanonicalization default", "WireguardHostnameCanonicalization", "", "Lowercase"),
+	Entry("WireguardHostnameCanonicalization invalid", "WireguardHostnameCanonicalization", "Upper", "Lowercase"),
+	Entry("WireguardRuleSelectors", "WireguardRuleSelectors", "Source,iif", []string{"source", "iif"}),
+	Entry("WireguardRuleSelectors default", "WireguardRuleSelectors", "", []string{"fwmark"}),
+	Entry("WireguardRuleSelectors invalid", "WireguardRuleSelectors", "fwmark,dst", []string{"fwmark"}),
+	Entry("WireguardRuleIifPrefix", "WireguardRuleIifPrefix", "tap", "tap"),
+	Entry("WireguardRuleIifPrefix default", "WireguardRuleIifPrefix", "", "cali"),
+	Entry("WireguardNonWireguardPeerHandling", "WireguardNonWireguardPeerHandling", "rule-exclude", "rule-exclude"),
+	Entry("WireguardNonWireguardPeerHandling default", "WireguardNonWireguardPeerHandling", "", "throw"),
+	Entry("WireguardNonWireguardPeerHandling invalid", "WireguardNonWireguardPeerHandling", "drop", "throw"),
+	Entry("WireguardAllowedIPsChunkSize", "WireguardAllowedIPsChunkSize", "200", int(200)),
+	Entry("WireguardAllowedIPsChunkSize default", "WireguardAllowedIPsChunkSize", "", int(1000)),
+	Entry("WireguardAllowedIPsChunkSize out of range", "WireguardAllowedIPsChunkSize", "0", int(1000)),
+	Entry("WireguardNodeOverridesFile", "WireguardNodeOverridesFile", "/etc/calico/wg.json", "/etc/calico/wg.json"),
+	Entry("WireguardNodeOverridesFile default", "WireguardNodeOverridesFile", "", ""),
+	Entry("WireguardDSCP", "WireguardDSCP", "46", int(46)),
+	Entry("WireguardDSCP default", "WireguardDSCP", "", int(-1)),
+	Entry("WireguardDSCP out of range", "WireguardDSCP", "64", int(-1)),
+	Entry("WireguardCatchAllRoute", "WireguardCatchAllRoute", "true", true),
+	Entry("WireguardCatchAllRoute default", "WireguardCatchAllRoute", "", false),
+	Entry("WireguardCatchAllThrowCIDRs", "WireguardCatchAllThrowCIDRs", "10.0.0.0/16,192.168.1.0/24",
+		[]string{"10.0.0.0/16", "192.168.1.0/24"}),
+	Entry("WireguardCatchAllThrowCIDRs default", "WireguardCatchAllThrowCIDRs", "", []string(nil)),
+	Entry("WireguardTraceBufferSize", "WireguardTraceBufferSize", "1000", int(1000)),
+	Entry("WireguardTraceBufferSize default", "WireguardTraceBufferSize", "", int(0)),
+	Entry("WireguardTraceBufferSize out of range", "WireguardTraceBufferSize", "-1", int(0)),
+	Entry("WireguardAdminSocketPath", "WireguardAdminSocketPath",
+		"/var/run/calico/wireguard-admin.sock", "/var/run/calico/wireguard-admin.sock"),
+	Entry("WireguardAdminSocketPath default", "WireguardAdminSocketPath", "", ""),
+	Entry("WireguardUserspaceHelper missing", "WireguardUserspaceHelper", "/usr/bin/does-not-exist-boringtun", "", false),
 )
 
 var _ = DescribeTable("OpenStack heuristic tests",
@@ -103,6 +103,32 @@ func (p *IntParam) Parse(raw string) (interface{}, error) {
 	return result, err
 }
 
+// IntSliceParam parses a comma separated list of ints, each of which must be within the range.
+type IntSliceParam struct {
+	Metadata
+	Min int
+	Max int
+}
+
+func (p *IntSliceParam) Parse(raw string) (interface{}, error) {
+	result := []int{}
+	for _, in := range strings.Split(raw, ",") {
+		val := strings.Trim(in, " ")
+		if len(val) == 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			return nil, p.parseFailed(raw, "invalid int "+val)
+		}
+		if int(value) < p.Min || int(value) > p.Max {
+			return nil, p.parseFailed(raw, fmt.Sprintf("value %v must be between %v and %v", val, p.Min, p.Max))
+		}
+		result = append(result, int(value))
+	}
+	return result, nil
+}
+
 type Int32Param struct {
 	Metadata
 }
@@ -457,6 +483,29 @@ func (p *OneofListParam) Parse(raw string) (result interface{}, err error) {
 	return
 }
 
+// OneofSliceParam parses a comma separated list of values, each of which must be one of the configured options.
+type OneofSliceParam struct {
+	Metadata
+	lowerCaseOptionsToCanonical map[string]string
+}
+
+func (p *OneofSliceParam) Parse(raw string) (result interface{}, err error) {
+	resultSlice := []string{}
+	for _, in := range strings.Split(raw, ",") {
+		val := strings.Trim(in, " ")
+		if len(val) == 0 {
+			continue
+		}
+		canon, ok := p.lowerCaseOptionsToCanonical[strings.ToLower(val)]
+		if !ok {
+			err = p.parseFailed(raw, "unknown option "+val)
+			return
+		}
+		resultSlice = append(resultSlice, canon)
+	}
+	return resultSlice, nil
+}
+
 type CIDRListParam struct {
 	Metadata
 }
@@ -484,6 +533,23 @@ func (c *CIDRListParam) Parse(raw string) (result interface{}, err error) {
 	return resultSlice, nil
 }
 
+type CIDRParam struct {
+	Metadata
+}
+
+func (c *CIDRParam) Parse(raw string) (result interface{}, err error) {
+	ip, net, e := cnet.ParseCIDROrIP(strings.Trim(raw, " "))
+	if e != nil {
+		err = c.parseFailed(raw, "invalid CIDR or IP")
+		return
+	}
+	if ip.Version() != 4 {
+		err = c.parseFailed(raw, "invalid CIDR or IP (not v4)")
+		return
+	}
+	return net.String(), nil
+}
+
 type RegionParam struct {
 	Metadata
 }
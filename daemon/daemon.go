@@ -572,6 +572,16 @@ configRetry:
 	// Start communicating with the dataplane driver.
 	dpConnector.Start()
 
+	// If the dataplane driver cleans up the dataplane when felix stops, e.g. to remove the wireguard configuration, it
+	// is only notified when felix has been asked to stop, rather than when restarting after a failure or config change.
+	var exitSignalChans []chan<- *sync.WaitGroup
+	if stoppableDriver, ok := dpDriver.(dp.StoppableDataplaneDriver); ok {
+		if sc := stoppableDriver.StopChannel(); sc != nil {
+			log.Info("Dataplane driver cleans up the dataplane when felix stops")
+			exitSignalChans = append(exitSignalChans, sc)
+		}
+	}
+
 	if policySyncProcessor != nil {
 		log.WithField("policySyncPathPrefix", configParams.PolicySyncPathPrefix).Info(
 			"Policy sync API enabled.  Starting the policy sync server.")
@@ -604,7 +614,7 @@ configRetry:
 
 	// Now monitor the worker process and our worker threads and shut
 	// down the process gracefully if they fail.
-	monitorAndManageShutdown(failureReportChan, dpDriverCmd, stopSignalChans)
+	monitorAndManageShutdown(failureReportChan, dpDriverCmd, stopSignalChans, exitSignalChans)
 }
 
 func servePrometheusMetrics(configParams *config.Config) {
@@ -633,7 +643,12 @@ func servePrometheusMetrics(configParams *config.Config) {
 	}
 }
 
-func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.Cmd, stopSignalChans []chan<- *sync.WaitGroup) {
+func monitorAndManageShutdown(
+	failureReportChan <-chan string,
+	driverCmd *exec.Cmd,
+	stopSignalChans []chan<- *sync.WaitGroup,
+	exitSignalChans []chan<- *sync.WaitGroup,
+) {
 	// Ask the runtime to tell us if we get a term/int signal.
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGTERM)
@@ -677,7 +692,11 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 	logCxt.Warn("Felix is shutting down")
 
 	// Notify other components to stop.  Each notified component must call Done() on the wait
-	// group when it has completed its shutdown.
+	// group when it has completed its shutdown.  The components that clean up when felix exits
+	// are only notified if we received a signal to stop.
+	if receivedFatalSignal {
+		stopSignalChans = append(stopSignalChans, exitSignalChans...)
+	}
 	var stopWG sync.WaitGroup
 	for _, c := range stopSignalChans {
 		stopWG.Add(1)
@@ -896,6 +915,16 @@ type DataplaneConnector struct {
 	firstStatusReportSent bool
 
 	wireguardStatUpdateFromDataplane chan *proto.WireguardStatusUpdate
+
+	// The wireguard public key this felix last stored for our node, or found already stored, and whether a key has been
+	// stored yet. A different key found in the datastore was stored by another felix for our node, see
+	// wireguardKeyConflicts. These are only accessed from the goroutine that reconciles the wireguard status.
+	wireguardStoredKey   string
+	wireguardKeyIsStored bool
+
+	// The wireguard key conflicts to send to the dataplane, see sendWireguardKeyConflict. This holds at most the latest
+	// conflict, which supersedes any conflict not yet sent.
+	wireguardKeyConflictToDataplane chan *proto.WireguardKeyConflict
 }
 
 type Startable interface {
@@ -920,6 +949,7 @@ func newConnector(configParams *config.Config,
 		failureReportChan:                failureReportChan,
 		dataplane:                        dataplane,
 		wireguardStatUpdateFromDataplane: make(chan *proto.WireguardStatusUpdate, 1),
+		wireguardKeyConflictToDataplane:  make(chan *proto.WireguardKeyConflict, 1),
 	}
 	return felixConn
 }
@@ -1002,7 +1032,55 @@ func (fc *DataplaneConnector) handleProcessStatusUpdate(ctx context.Context, msg
 	}
 }
 
-func (fc *DataplaneConnector) reconcileWireguardStatUpdate(dpPubKey string) error {
+// updateWireguardStatusAnnotations updates the annotations of the node resource that carry the parts of the wireguard
+// status that the node resource has no fields for, see calc.WireguardNodeInfo. The annotations that describe the public
+// key are removed along with the public key, the state of the key and the source of the enabled state are kept. Returns
+// true if the annotations were changed.
+func updateWireguardStatusAnnotations(node *apiv3.Node, update *proto.WireguardStatusUpdate) bool {
+	annotations := map[string]string{}
+	if update.PublicKey != "" && update.ListeningPort != 0 {
+		annotations[calc.WireguardListeningPortAnnotation] = strconv.Itoa(int(update.ListeningPort))
+	}
+	if update.PublicKey != "" && update.PreviousPublicKey != "" {
+		annotations[calc.WireguardPreviousPublicKeyAnnotation] = update.PreviousPublicKey
+		annotations[calc.WireguardPreviousKeyDeadlineAnnotation] = strconv.FormatInt(update.PreviousKeyDeadline, 10)
+	}
+	if update.KeyState != "" {
+		annotations[calc.WireguardKeyStateAnnotation] = update.KeyState
+	}
+	if update.EnabledSource != "" {
+		annotations[calc.WireguardEnabledSourceAnnotation] = update.EnabledSource
+	}
+
+	changed := false
+	for _, name := range []string{
+		calc.WireguardListeningPortAnnotation,
+		calc.WireguardPreviousPublicKeyAnnotation,
+		calc.WireguardPreviousKeyDeadlineAnnotation,
+		calc.WireguardKeyStateAnnotation,
+		calc.WireguardEnabledSourceAnnotation,
+	} {
+		value, ok := annotations[name]
+		stored, storedOK := node.Annotations[name]
+		if ok == storedOK && value == stored {
+			continue
+		}
+		changed = true
+		if !ok {
+			delete(node.Annotations, name)
+			continue
+		}
+		if node.Annotations == nil {
+			node.Annotations = map[string]string{}
+		}
+		node.Annotations[name] = value
+	}
+	return changed
+}
+
+func (fc *DataplaneConnector) reconcileWireguardStatUpdate(update *proto.WireguardStatusUpdate) error {
+	dpPubKey, dpIfaceAddr := update.PublicKey, update.InterfaceAddr
+
 	// In case of a recoverable failure (ErrorResourceUpdateConflict), retry update 3 times.
 	for iter := 0; iter < 3; iter++ {
 		// Read node resource from datastore and compare it with the publicKey from dataplane.
@@ -1027,11 +1105,37 @@ func (fc *DataplaneConnector) reconcileWireguardStatUpdate(dpPubKey string) erro
 			return err
 		}
 
-		// Check if the public-key needs to be updated.
+		// Check if the public-key, or the interface address if chosen by the dataplane, needs to be updated.
 		storedPublicKey := node.Status.WireguardPublicKey
-		if storedPublicKey != dpPubKey {
+		storedIfaceAddr := ""
+		if node.Spec.Wireguard != nil {
+			storedIfaceAddr = node.Spec.Wireguard.InterfaceIPv4Address
+		}
+		if fc.wireguardKeyConflicts(storedPublicKey, dpPubKey) {
+			// Another felix has stored its key for our node since we stored ours. Rather than overwriting its key, which
+			// would flap the key seen by the peers, report the conflict to the dataplane, which backs off publication of
+			// our key or adopts the stored key.
+			log.WithFields(log.Fields{
+				"ourKey":    dpPubKey,
+				"storedKey": storedPublicKey,
+			}).Warning("Wireguard public key stored for this node was not stored by this felix, not overwriting it")
+			fc.sendWireguardKeyConflict(&proto.WireguardKeyConflict{
+				PublicKey:       dpPubKey,
+				StoredPublicKey: storedPublicKey,
+			})
+			return nil
+		}
+		updateIfaceAddr := dpIfaceAddr != "" && storedIfaceAddr != dpIfaceAddr
+		updateAnnotations := updateWireguardStatusAnnotations(node, update)
+		if storedPublicKey != dpPubKey || updateIfaceAddr || updateAnnotations {
 			updateCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 			node.Status.WireguardPublicKey = dpPubKey
+			if updateIfaceAddr {
+				if node.Spec.Wireguard == nil {
+					node.Spec.Wireguard = &apiv3.NodeWireguardSpec{}
+				}
+				node.Spec.Wireguard.InterfaceIPv4Address = dpIfaceAddr
+			}
 			_, err := fc.datastorev3.Nodes().Update(updateCtx, node, options.SetOptions{})
 			cancel()
 			if err != nil {
@@ -1047,11 +1151,33 @@ func (fc *DataplaneConnector) reconcileWireguardStatUpdate(dpPubKey string) erro
 			}
 			log.Debugf("Updated Wireguard public-key from %s to %s", storedPublicKey, dpPubKey)
 		}
+		fc.wireguardStoredKey = dpPubKey
+		fc.wireguardKeyIsStored = true
 		break
 	}
 	return nil
 }
 
+// wireguardKeyConflicts returns true if the public key stored for our node is neither the key in the status update nor
+// the key this felix last stored, i.e. it has been stored by another felix running for our node. Until this felix has
+// stored a key any stored key is overwritten, since the key of a previous felix for our node is expected to be
+// replaced. A stored key that has been removed is not a conflict.
+func (fc *DataplaneConnector) wireguardKeyConflicts(storedPublicKey, dpPubKey string) bool {
+	return fc.wireguardKeyIsStored && dpPubKey != "" && storedPublicKey != "" &&
+		storedPublicKey != dpPubKey && storedPublicKey != fc.wireguardStoredKey
+}
+
+// sendWireguardKeyConflict queues a wireguard key conflict to be sent to the dataplane, replacing any conflict not yet
+// sent. This does not block, since the dataplane may itself be blocked sending us its status.
+func (fc *DataplaneConnector) sendWireguardKeyConflict(conflict *proto.WireguardKeyConflict) {
+	select {
+	case <-fc.wireguardKeyConflictToDataplane:
+		log.Debug("Replacing the wireguard key conflict not yet sent to the dataplane")
+	default:
+	}
+	fc.wireguardKeyConflictToDataplane <- conflict
+}
+
 func (fc *DataplaneConnector) handleWireguardStatUpdateFromDataplane() {
 	var current *proto.WireguardStatusUpdate
 	var ticker *jitter.Ticker
@@ -1070,7 +1196,7 @@ func (fc *DataplaneConnector) handleWireguardStatUpdateFromDataplane() {
 		}
 
 		// Try and reconcile the current wireguard status data.
-		err := fc.reconcileWireguardStatUpdate(current.PublicKey)
+		err := fc.reconcileWireguardStatUpdate(current)
 		if err == nil {
 			current = nil
 			retryC = nil
@@ -1092,7 +1218,11 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 
 	var config map[string]string
 	for {
-		msg := <-fc.ToDataplane
+		var msg interface{}
+		select {
+		case msg = <-fc.ToDataplane:
+		case msg = <-fc.wireguardKeyConflictToDataplane:
+		}
 		switch msg := msg.(type) {
 		case *proto.InSync:
 			log.Info("Datastore now in sync.")
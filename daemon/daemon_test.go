@@ -17,7 +17,10 @@ package daemon
 import (
 	v1 "k8s.io/api/core/v1"
 
+	"github.com/projectcalico/felix/calc"
 	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/proto"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -50,3 +53,132 @@ var _ = Describe("Typha address discovery", func() {
 		Expect(typhaAddr).To(Equal("[fd5f:65af::2]:8156"))
 	})
 })
+
+var _ = Describe("Wireguard status annotations", func() {
+	const key = "pS0ZlgTuhBpjh4nkaPH0cgQvpdgVpGzjtO/7Z8MVD1I="
+
+	var node *apiv3.Node
+
+	BeforeEach(func() {
+		node = apiv3.NewNode()
+		node.Name = "node1"
+	})
+
+	It("should publish the listening port", func() {
+		changed := updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{
+			PublicKey:     key,
+			ListeningPort: 51821,
+		})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(Equal(map[string]string{calc.WireguardListeningPortAnnotation: "51821"}))
+
+		By("not changing the annotations if the port is unchanged")
+		changed = updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{
+			PublicKey:     key,
+			ListeningPort: 51821,
+		})
+		Expect(changed).To(BeFalse())
+	})
+
+	It("should remove the listening port with the public key", func() {
+		node.Annotations = map[string]string{
+			calc.WireguardListeningPortAnnotation: "51821",
+			"other":                               "value",
+		}
+		changed := updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{ListeningPort: 51821})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(Equal(map[string]string{"other": "value"}))
+	})
+
+	It("should publish the previous public key until the end of the key transition", func() {
+		const previousKey = "lT1uOGtC1phTcCEKfNtdHz3alm1LzOfEHpBZgqoR7Vg="
+		changed := updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{
+			PublicKey:           key,
+			PreviousPublicKey:   previousKey,
+			PreviousKeyDeadline: 1600000000,
+		})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(Equal(map[string]string{
+			calc.WireguardPreviousPublicKeyAnnotation:   previousKey,
+			calc.WireguardPreviousKeyDeadlineAnnotation: "1600000000",
+		}))
+
+		By("removing the previous public key once the transition has ended")
+		changed = updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{PublicKey: key})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(BeEmpty())
+	})
+
+	It("should publish the key state and the enabled source with or without a public key", func() {
+		changed := updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{
+			PublicKey:     key,
+			ListeningPort: 51821,
+			KeyState:      "published",
+			EnabledSource: "config",
+		})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(Equal(map[string]string{
+			calc.WireguardListeningPortAnnotation: "51821",
+			calc.WireguardKeyStateAnnotation:      "published",
+			calc.WireguardEnabledSourceAnnotation: "config",
+		}))
+
+		By("keeping them once the key is withdrawn")
+		changed = updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{
+			KeyState:      "disabled-by-override",
+			EnabledSource: "node-override",
+		})
+		Expect(changed).To(BeTrue())
+		Expect(node.Annotations).To(Equal(map[string]string{
+			calc.WireguardKeyStateAnnotation:      "disabled-by-override",
+			calc.WireguardEnabledSourceAnnotation: "node-override",
+		}))
+	})
+
+	It("should not change a node without annotations if there is nothing to publish", func() {
+		changed := updateWireguardStatusAnnotations(node, &proto.WireguardStatusUpdate{})
+		Expect(changed).To(BeFalse())
+		Expect(node.Annotations).To(BeNil())
+	})
+})
+
+var _ = Describe("Wireguard key conflicts", func() {
+	const (
+		ourKey   = "pS0ZlgTuhBpjh4nkaPH0cgQvpdgVpGzjtO/7Z8MVD1I="
+		newKey   = "lT1uOGtC1phTcCEKfNtdHz3alm1LzOfEHpBZgqoR7Vg="
+		otherKey = "2Q8Nq6nS0pA3CNLPvvmMEfXlAWuJkBnDSQ+DXn9sZ04="
+	)
+
+	var fc *DataplaneConnector
+
+	BeforeEach(func() {
+		fc = newConnector(config.New(), nil, nil, nil, nil, nil)
+	})
+
+	It("should overwrite any stored key until our key has been stored", func() {
+		Expect(fc.wireguardKeyConflicts(otherKey, ourKey)).To(BeFalse())
+	})
+
+	It("should report a key stored by another felix once our key has been stored", func() {
+		fc.wireguardStoredKey, fc.wireguardKeyIsStored = ourKey, true
+		Expect(fc.wireguardKeyConflicts(ourKey, ourKey)).To(BeFalse())
+		Expect(fc.wireguardKeyConflicts(ourKey, newKey)).To(BeFalse())
+		Expect(fc.wireguardKeyConflicts("", newKey)).To(BeFalse())
+		Expect(fc.wireguardKeyConflicts(otherKey, "")).To(BeFalse())
+		Expect(fc.wireguardKeyConflicts(otherKey, ourKey)).To(BeTrue())
+		Expect(fc.wireguardKeyConflicts(otherKey, newKey)).To(BeTrue())
+	})
+
+	It("should report a key stored by another felix once our key has been removed", func() {
+		fc.wireguardStoredKey, fc.wireguardKeyIsStored = "", true
+		Expect(fc.wireguardKeyConflicts(otherKey, ourKey)).To(BeTrue())
+	})
+
+	It("should send only the latest conflict without blocking", func() {
+		fc.sendWireguardKeyConflict(&proto.WireguardKeyConflict{PublicKey: ourKey, StoredPublicKey: otherKey})
+		fc.sendWireguardKeyConflict(&proto.WireguardKeyConflict{PublicKey: newKey, StoredPublicKey: otherKey})
+		Expect(fc.wireguardKeyConflictToDataplane).To(Receive(Equal(
+			&proto.WireguardKeyConflict{PublicKey: newKey, StoredPublicKey: otherKey})))
+		Expect(fc.wireguardKeyConflictToDataplane).NotTo(Receive())
+	})
+})
@@ -36,6 +36,7 @@ import (
 	intdataplane "github.com/projectcalico/felix/dataplane/linux"
 	"github.com/projectcalico/felix/idalloc"
 	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/logutils"
 	"github.com/projectcalico/felix/markbits"
@@ -64,8 +65,11 @@ func StartDataplaneDriver(configParams *config.Config,
 		markAccept, _ := markBitsManager.NextSingleBitMark()
 		markPass, _ := markBitsManager.NextSingleBitMark()
 
+		// If wireguard may be enabled by the node override, the mark bit and routing table are reserved so that wireguard
+		// can be enabled without a restart.
+		wireguardMayBeEnabled := configParams.WireguardEnabled || configParams.WireguardAllowEnabledOverride
 		var markWireguard uint32
-		if configParams.WireguardEnabled {
+		if wireguardMayBeEnabled {
 			log.Info("Wireguard enabled, allocating a mark bit")
 			markWireguard, _ = markBitsManager.NextSingleBitMark()
 			if markWireguard == 0 {
@@ -109,17 +113,134 @@ func StartDataplaneDriver(configParams *config.Config,
 		// to simplify table tidy-up.
 		routeTableIndexAllocator := idalloc.NewIndexAllocator(configParams.RouteTableRange)
 
-		var wireguardEnabled bool
+		var wireguardTableAssigned bool
 		var wireguardTableIndex int
-		if configParams.WireguardEnabled {
+		if wireguardMayBeEnabled && configParams.WireguardRoutingTableIndexAuto {
+			// The wireguard module chooses its own routing table outside of the route table range.
+			log.Debug("Wireguard table index is chosen automatically")
+			wireguardTableAssigned = true
+		} else if wireguardMayBeEnabled {
 			if idx, err := routeTableIndexAllocator.GrabIndex(); err == nil {
 				log.Debugf("Assigned wireguard table index: %d", idx)
-				wireguardEnabled = true
+				wireguardTableAssigned = true
 				wireguardTableIndex = idx
 			} else {
 				log.WithError(err).Warning("Unable to assign table index for wireguard - disabling wireguard on this node")
 			}
 		}
+		var wireguardUnderlayTableIndex int
+		if wireguardTableAssigned && configParams.WireguardUnderlayInterface != "" {
+			if idx, err := routeTableIndexAllocator.GrabIndex(); err == nil {
+				log.Debugf("Assigned wireguard underlay table index: %d", idx)
+				wireguardUnderlayTableIndex = idx
+			} else {
+				log.WithError(err).Warning("Unable to assign table index for the wireguard underlay interface")
+			}
+		}
+		var wireguardAddressPool ip.CIDR
+		if configParams.WireguardInterfaceAddressPool != "" {
+			// The pool has already been validated by the config parsing.
+			wireguardAddressPool = ip.MustParseCIDROrIP(configParams.WireguardInterfaceAddressPool)
+		}
+
+		wireguardConfig, err := wireguard.NewConfig(wireguard.Settings{
+			Enabled:             wireguardTableAssigned && configParams.WireguardEnabled,
+			ListeningPort:       configParams.WireguardListeningPort,
+			FirewallMark:        int(markWireguard),
+			RoutingRulePriority: configParams.WireguardRoutingRulePriority,
+			RoutingTableIndex:   wireguardTableIndex,
+			InterfaceName:       configParams.WireguardInterfaceName,
+			MTU:                 configParams.WireguardMTU,
+		}, func(c *wireguard.Config) {
+			c.EnableUserspaceFallback = configParams.WireguardUserspaceFallbackEnabled
+			c.UserspaceHelper = configParams.WireguardUserspaceHelper
+			c.RepairWrongLinkType = configParams.WireguardRepairWrongLinkType
+			c.RoutingRulePriorityRange = configParams.WireguardRoutingRulePriorityRange
+
+			c.RoutingTableIndexAuto = configParams.WireguardRoutingTableIndexAuto
+			c.RoutingTableIndexAutoMin = configParams.WireguardRoutingTableIndexAutoMin
+			c.RoutingTableIndexAutoMax = configParams.WireguardRoutingTableIndexAutoMax
+
+			c.InterfaceAddressPrefixLength = configParams.WireguardInterfaceAddressPrefixLength
+			c.RequirePeerReady = configParams.WireguardRequirePeerReady
+			c.ProgramPeersWithoutEndpoint = configParams.WireguardProgramPeersWithoutEndpoint
+			c.PublishKeyWithoutEndpoint = configParams.WireguardPublishKeyWithoutEndpoint
+			c.MaxPeers = configParams.WireguardMaxPeers
+			c.MaxAllowedIPsPerPeer = configParams.WireguardMaxAllowedIPsPerPeer
+			c.StrictTableOwnership = configParams.WireguardStrictTableOwnership
+			c.LegacyRouteProtocols = configParams.WireguardLegacyRouteProtocols
+			c.LogLevel = logutils.WireguardLogLevel(configParams)
+
+			c.UnderlayInterface = configParams.WireguardUnderlayInterface
+			c.UnderlaySourceIP = ip.FromNetIP(configParams.WireguardUnderlaySourceIP)
+			c.UnderlayRoutingTableIndex = wireguardUnderlayTableIndex
+			c.ParentInterfaces = configParams.WireguardParentInterfaces
+
+			c.ApplyTimeout = configParams.WireguardApplyTimeout
+			c.RouteNetlinkTimeout = configParams.WireguardRouteNetlinkTimeout
+			c.NotSupportedReprobeInterval = configParams.WireguardNotSupportedReprobeInterval
+			c.RoutePriority = configParams.WireguardRoutePriority
+			c.RouteViaPeerTunnelIP = configParams.WireguardRouteViaPeerTunnelIP
+			c.StaleHandshakeThreshold = configParams.WireguardStaleHandshakeThreshold
+			c.CapacityStatsInterval = configParams.WireguardCapacityStatsInterval
+			c.CoverageLogThreshold = configParams.WireguardCoverageLogThreshold
+			c.PeerBatchThreshold = configParams.WireguardPeerBatchThreshold
+			c.PeerBatchWindow = configParams.WireguardPeerBatchWindow
+			c.AllowEnabledOverride = wireguardTableAssigned && configParams.WireguardAllowEnabledOverride
+			c.AdoptExistingDevice = configParams.WireguardAdoptExistingDevice
+			c.CIDRFlapMaxMoves = configParams.WireguardCIDRFlapMaxMoves
+			c.CIDRFlapWindow = configParams.WireguardCIDRFlapWindow
+			c.CIDRFlapHoldDown = configParams.WireguardCIDRFlapHoldDown
+			c.CIDRFlapThrowRoute = configParams.WireguardCIDRFlapThrowRoute
+			c.EndpointFailoverTimeout = configParams.WireguardEndpointFailoverTimeout
+			c.ProvisionalKeyTimeout = configParams.WireguardProvisionalKeyTimeout
+			c.KeyTransitionTimeout = configParams.WireguardKeyTransitionTimeout
+			c.LocalCIDRsAsThrow = configParams.WireguardLocalCIDRsAsThrow || configParams.WireguardCatchAllRoute
+			c.MaxPauseDuration = configParams.WireguardMaxPauseDuration
+			c.ConntrackCleanup = configParams.WireguardConntrackCleanup
+
+			c.InterfaceAddressSource = wireguard.InterfaceAddressSource(configParams.WireguardInterfaceAddressSource)
+			c.InterfaceAddressPool = wireguardAddressPool
+			for _, selector := range configParams.WireguardRuleSelectors {
+				c.RuleSelectors = append(c.RuleSelectors, wireguard.RuleSelector(selector))
+			}
+			c.RuleIifPrefix = configParams.WireguardRuleIifPrefix
+			c.NonWireguardPeerHandling = wireguard.NonWireguardPeerHandling(
+				configParams.WireguardNonWireguardPeerHandling)
+			c.AllowedIPsChunkSize = configParams.WireguardAllowedIPsChunkSize
+			c.ResyncDivergencePercent = configParams.WireguardResyncDivergencePercent
+			c.NodeOverridesFile = configParams.WireguardNodeOverridesFile
+			if configParams.WireguardDSCP >= 0 {
+				dscp := uint8(configParams.WireguardDSCP)
+				c.DSCP = &dscp
+			}
+			c.CatchAllRoute = configParams.WireguardCatchAllRoute
+			for _, cidr := range configParams.WireguardCatchAllThrowCIDRs {
+				c.CatchAllThrowCIDRs = append(c.CatchAllThrowCIDRs, ip.MustParseCIDROrIP(cidr))
+			}
+			c.TraceBufferSize = configParams.WireguardTraceBufferSize
+		})
+		if err != nil {
+			// Disable wireguard rather than program an invalid configuration. The wireguard configuration of a previous
+			// felix is still removed, so the disabled configuration has the defaults and the configured routing table,
+			// routing rule and interface. If even that is invalid, felix refuses to start rather than leaving the
+			// previous configuration in place.
+			log.WithError(err).Error("Invalid wireguard configuration - disabling wireguard on this node")
+			wireguardConfig, err = wireguard.NewConfig(wireguard.Settings{
+				FirewallMark:        int(markWireguard),
+				RoutingRulePriority: configParams.WireguardRoutingRulePriority,
+				RoutingTableIndex:   wireguardTableIndex,
+				InterfaceName:       configParams.WireguardInterfaceName,
+			}, func(c *wireguard.Config) {
+				c.RoutingTableIndexAuto = configParams.WireguardRoutingTableIndexAuto
+				c.RoutingTableIndexAutoMin = configParams.WireguardRoutingTableIndexAutoMin
+				c.RoutingTableIndexAutoMax = configParams.WireguardRoutingTableIndexAutoMax
+			})
+			if err != nil {
+				log.WithError(err).Panic("Invalid wireguard configuration - unable to remove the wireguard configuration")
+			}
+		}
+		wireguardDSCP, wireguardDSCPEnabled := wireguardConfig.DSCPMarking()
 
 		dpConfig := intdataplane.Config{
 			Hostname: configParams.FelixHostname,
@@ -160,6 +281,10 @@ func StartDataplaneDriver(configParams *config.Config,
 				VXLANPort:    configParams.VXLANPort,
 				VXLANVNI:     configParams.VXLANVNI,
 
+				WireguardDSCPEnabled:   wireguardDSCPEnabled,
+				WireguardDSCP:          wireguardDSCP,
+				WireguardListeningPort: wireguardConfig.ListeningPort,
+
 				IPIPEnabled:        configParams.IpInIpEnabled,
 				IPIPTunnelAddress:  configParams.IpInIpTunnelAddr,
 				VXLANTunnelAddress: configParams.IPv4VXLANTunnelAddr,
@@ -179,17 +304,11 @@ func StartDataplaneDriver(configParams *config.Config,
 				NATOutgoingAddress:                 configParams.NATOutgoingAddress,
 				BPFEnabled:                         configParams.BPFEnabled,
 			},
-			Wireguard: wireguard.Config{
-				Enabled:             wireguardEnabled,
-				ListeningPort:       configParams.WireguardListeningPort,
-				FirewallMark:        int(markWireguard),
-				RoutingRulePriority: configParams.WireguardRoutingRulePriority,
-				RoutingTableIndex:   wireguardTableIndex,
-				InterfaceName:       configParams.WireguardInterfaceName,
-				MTU:                 configParams.WireguardMTU,
-			},
+			Wireguard:                      wireguardConfig,
+			WireguardAdditionalRouteTypes:  configParams.WireguardAdditionalRouteTypes,
 			IPIPMTU:                        configParams.IpInIpMtu,
 			VXLANMTU:                       configParams.VXLANMTU,
+			HostMTU:                        configParams.HostMTU,
 			IptablesBackend:                configParams.IptablesBackend,
 			IptablesRefreshInterval:        configParams.IptablesRefreshInterval,
 			RouteRefreshInterval:           configParams.RouteRefreshInterval,
@@ -207,6 +326,12 @@ func StartDataplaneDriver(configParams *config.Config,
 			StatusReportingInterval:        configParams.ReportingIntervalSecs,
 			XDPRefreshInterval:             configParams.XDPRefreshInterval,
 
+			WireguardFullRebuildAfterResyncs:  configParams.WireguardFullRebuildAfterResyncs,
+			WireguardTeardownOnExit:           configParams.WireguardTeardownOnExit,
+			WireguardHostnameCanonicalization: configParams.WireguardHostnameCanonicalization,
+			WireguardApplyStallMultiplier:     configParams.WireguardApplyStallMultiplier,
+			WireguardAdminSocketPath:          configParams.WireguardAdminSocketPath,
+
 			NetlinkTimeout: configParams.NetlinkTimeoutSecs,
 
 			ConfigChangedRestartCallback: configChangedRestartCallback,
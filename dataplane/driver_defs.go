@@ -14,7 +14,17 @@
 
 package dataplane
 
+import "sync"
+
 type DataplaneDriver interface {
 	SendMessage(msg interface{}) error
 	RecvMessage() (msg interface{}, err error)
 }
+
+// StoppableDataplaneDriver is a dataplane driver that cleans up the dataplane when felix stops. A wait group is sent
+// on the stop channel when felix is stopping, and the driver calls Done() on it once the dataplane is cleaned up. The
+// stop channel is nil if there is nothing to clean up.
+type StoppableDataplaneDriver interface {
+	DataplaneDriver
+	StopChannel() chan<- *sync.WaitGroup
+}
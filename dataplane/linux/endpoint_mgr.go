@@ -162,6 +162,9 @@ type endpointManager struct {
 	// their configuration (sysctls etc.) refreshed.
 	wlIfaceNamesToReconfigure set.Set
 
+	// workloadMTU is the MTU to set on workload interfaces, or 0 if the MTU is not managed.
+	workloadMTU int
+
 	// epIDsToUpdateStatus contains IDs of endpoints that we need to report status for.
 	// Mix of host and workload endpoint IDs.
 	epIDsToUpdateStatus set.Set
@@ -339,6 +342,16 @@ func (m *endpointManager) OnUpdate(protoBufMsg interface{}) {
 	}
 }
 
+// OnWorkloadMTUUpdate is called when the calculated workload MTU changes.  The workload interfaces
+// are reconfigured with the new MTU in CompleteDeferredWork().
+func (m *endpointManager) OnWorkloadMTUUpdate(mtu int) {
+	log.WithField("mtu", mtu).Info("Workload MTU updated")
+	m.workloadMTU = mtu
+	for ifaceName := range m.activeWlIfaceNameToID {
+		m.wlIfaceNamesToReconfigure.Add(ifaceName)
+	}
+}
+
 func (m *endpointManager) CompleteDeferredWork() error {
 	// Copy the pending interface state to the active set and mark any interfaces that have
 	// changed state for reconfiguration by resolveWorkload/HostEndpoints()
@@ -1103,6 +1116,14 @@ func (m *endpointManager) configureInterface(name string) error {
 			return err
 		}
 	}
+	if m.workloadMTU != 0 {
+		// The interface MTU is exposed through sysfs rather than /proc/sys, but it can be written in the
+		// same way.
+		err := m.writeProcSys(fmt.Sprintf("/sys/class/net/%s/mtu", name), fmt.Sprint(m.workloadMTU))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
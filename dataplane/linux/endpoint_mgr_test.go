@@ -1589,6 +1589,21 @@ func endpointManagerTests(ipVersion uint8) func() {
 						}
 					})
 
+					It("should set the workload MTU on the interface when it changes", func() {
+						mtuPath := "/sys/class/net/cali12345-ab/mtu"
+						Expect(mockProcSys.state).NotTo(HaveKey(mtuPath))
+
+						epMgr.OnWorkloadMTUUpdate(1440)
+						err := epMgr.CompleteDeferredWork()
+						Expect(err).ToNot(HaveOccurred())
+						Expect(mockProcSys.state).To(HaveKeyWithValue(mtuPath, "1440"))
+
+						epMgr.OnWorkloadMTUUpdate(1480)
+						err = epMgr.CompleteDeferredWork()
+						Expect(err).ToNot(HaveOccurred())
+						Expect(mockProcSys.state).To(HaveKeyWithValue(mtuPath, "1480"))
+					})
+
 					Context("with floating IPs added to the endpoint", func() {
 						JustBeforeEach(func() {
 							epMgr.OnUpdate(&proto.WorkloadEndpointUpdate{
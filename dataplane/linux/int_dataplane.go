@@ -94,6 +94,10 @@ var (
 		Help: "Number of interface address messages processed in each batch. Higher " +
 			"values indicate we're doing more batching to try to keep up.",
 	})
+	summaryWireguardApplyTime = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "felix_int_dataplane_wireguard_apply_time_seconds",
+		Help: "Time in seconds that it took to apply the wireguard updates, in total and by subsystem.",
+	}, []string{"subsystem"})
 
 	processStartTime time.Time
 	zeroKey          = wgtypes.Key{}
@@ -106,6 +110,7 @@ func init() {
 	prometheus.MustRegister(summaryBatchSize)
 	prometheus.MustRegister(summaryIfaceBatchSize)
 	prometheus.MustRegister(summaryAddrBatchSize)
+	prometheus.MustRegister(summaryWireguardApplyTime)
 	processStartTime = time.Now()
 }
 
@@ -116,6 +121,9 @@ type Config struct {
 	RuleRendererOverride rules.RuleRenderer
 	IPIPMTU              int
 	VXLANMTU             int
+	// HostMTU is the MTU of the host network, used to calculate the workload interface MTU. Zero if
+	// the workload interface MTU is not managed.
+	HostMTU int
 
 	MaxIPSetSize int
 
@@ -134,6 +142,23 @@ type Config struct {
 	XDPRefreshInterval             time.Duration
 
 	Wireguard wireguard.Config
+	// WireguardAdditionalRouteTypes lists the route types, in addition to remote workload routes, that are routed
+	// through the wireguard tunnel.
+	WireguardAdditionalRouteTypes []string
+	// WireguardFullRebuildAfterResyncs is the number of consecutive resyncs that find the wireguard device does not
+	// match the expected configuration after which the wireguard configuration is rebuilt. Zero disables the rebuild.
+	WireguardFullRebuildAfterResyncs int
+	// WireguardTeardownOnExit removes the wireguard configuration from the dataplane when felix stops.
+	WireguardTeardownOnExit bool
+	// WireguardHostnameCanonicalization is the canonicalization of the node names in the wireguard updates, see
+	// wireguardHostnameCanonicalizers. The node names are lowercased if not set.
+	WireguardHostnameCanonicalization string
+	// WireguardApplyStallMultiplier is the multiple of NetlinkTimeout after which a wireguard Apply that is still in
+	// progress, or updates that are still waiting for an Apply, report felix as not live. Zero disables the check.
+	WireguardApplyStallMultiplier int
+	// WireguardAdminSocketPath is the path of the Unix domain socket of the wireguard admin interface. Empty disables
+	// the admin interface.
+	WireguardAdminSocketPath string
 
 	NetlinkTimeout time.Duration
 
@@ -215,7 +240,10 @@ type InternalDataplane struct {
 
 	ipipManager *ipipManager
 
-	wireguardManager *wireguardManager
+	wireguardManager     *wireguardManager
+	wireguardAdminServer *wireguardAdminServer
+
+	workloadMTUCalculator *workloadMTUCalculator
 
 	ifaceMonitor     *ifacemonitor.InterfaceMonitor
 	ifaceUpdates     chan *ifaceUpdate
@@ -248,6 +276,14 @@ type InternalDataplane struct {
 	reschedTimer *time.Timer
 	reschedC     <-chan time.Time
 
+	// applyKickC is kicked by components that need an apply outside of the usual update processing, e.g. when the
+	// wireguard interface comes up. It has a buffer of one so that multiple kicks are coalesced.
+	applyKickC chan struct{}
+
+	// stopC receives a wait group when felix is stopping, if the dataplane needs to be cleaned up before felix exits.
+	// It is nil otherwise. It has a buffer of one so that the stop is not missed while an apply is in progress.
+	stopC chan *sync.WaitGroup
+
 	applyThrottle *throttle.Throttle
 
 	config Config
@@ -286,6 +322,10 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		ifaceAddrUpdates:  make(chan *ifaceAddrsUpdate, 100),
 		config:            config,
 		applyThrottle:     throttle.New(10),
+		applyKickC:        make(chan struct{}, 1),
+	}
+	if config.WireguardTeardownOnExit {
+		dp.stopC = make(chan *sync.WaitGroup, 1)
 	}
 	dp.applyThrottle.Refill() // Allow the first apply() immediately.
 	dp.ifaceMonitor.StateCallback = dp.onIfaceStateChange
@@ -606,17 +646,30 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 
 	// Add a manager for wireguard configuration. This is added irrespective of whether wireguard is actually enabled
 	// because it may need to tidy up some of the routing rules when disabled.
+	wireguardStatus := newWireguardStatusReporter(dp.fromDataplane)
 	cryptoRouteTableWireguard := wireguard.New(config.Hostname, &config.Wireguard, config.NetlinkTimeout,
-		config.DeviceRouteProtocol, func(publicKey wgtypes.Key) error {
-			if publicKey == zeroKey {
-				dp.fromDataplane <- &proto.WireguardStatusUpdate{PublicKey: ""}
-			} else {
-				dp.fromDataplane <- &proto.WireguardStatusUpdate{PublicKey: publicKey.String()}
-			}
-			return nil
-		})
-	dp.wireguardManager = newWireguardManager(cryptoRouteTableWireguard)
+		config.DeviceRouteProtocol, wireguardStatus.OnStatusUpdate, dp.kickApply)
+	cryptoRouteTableWireguard.SetApplyTimingCallback(observeWireguardApplyTiming)
+	dp.wireguardManager = newWireguardManager(cryptoRouteTableWireguard, config)
+	dp.wireguardManager.statusReporter = wireguardStatus
 	dp.RegisterManager(dp.wireguardManager) // IPv4-only
+	registerWireguardHTTPHandler(dp.wireguardManager)
+	if config.WireguardAdminSocketPath != "" {
+		dp.wireguardAdminServer = newWireguardAdminServer(dp.wireguardManager, config.WireguardAdminSocketPath)
+	}
+
+	if config.HostMTU != 0 {
+		// Calculate the workload interface MTU from the active encapsulation. Wireguard is only active once it has been
+		// found to be supported, so the MTU is recalculated after each apply.
+		dp.workloadMTUCalculator = newWorkloadMTUCalculator(
+			config.HostMTU,
+			staticMTUOverhead{enabled: config.RulesConfig.IPIPEnabled, overhead: ipipMTUOverhead},
+			staticMTUOverhead{enabled: config.RulesConfig.VXLANEnabled, overhead: vxlanMTUOverhead},
+			dp.wireguardManager,
+		)
+		dp.workloadMTUCalculator.Subscribe(epManager.OnWorkloadMTUUpdate)
+		dp.workloadMTUCalculator.Recalculate()
+	}
 
 	if config.IPv6Enabled {
 		mangleTableV6 := iptables.NewTable(
@@ -773,6 +826,13 @@ func (d *InternalDataplane) Start() {
 	go d.loopUpdatingDataplane()
 	go d.loopReportingStatus()
 	go d.ifaceMonitor.MonitorInterfaces()
+
+	if d.wireguardAdminServer != nil {
+		if err := d.wireguardAdminServer.Start(); err != nil {
+			// The admin interface is only used for debugging, so carry on without it.
+			log.WithError(err).Error("Failed to start the wireguard admin server")
+		}
+	}
 }
 
 // onIfaceStateChange is our interface monitor callback.  It gets called from the monitor's thread.
@@ -926,6 +986,10 @@ func (d *InternalDataplane) setUpIptablesBPF() {
 			Action: iptables.JumpAction{Target: rules.ChainRawPrerouting},
 		}})
 	}
+
+	for _, t := range d.iptablesMangleTables {
+		d.setUpManglePostrouting(t)
+	}
 }
 
 func (d *InternalDataplane) setUpIptablesNormal() {
@@ -969,6 +1033,7 @@ func (d *InternalDataplane) setUpIptablesNormal() {
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainManglePrerouting},
 		}})
+		d.setUpManglePostrouting(t)
 	}
 	if d.xdpState != nil {
 		if err := d.setXDPFailsafePorts(); err != nil {
@@ -980,6 +1045,19 @@ func (d *InternalDataplane) setUpIptablesNormal() {
 	}
 }
 
+// setUpManglePostrouting programs the mangle POSTROUTING chain, which is only needed to mark the encrypted wireguard
+// traffic.
+func (d *InternalDataplane) setUpManglePostrouting(t *iptables.Table) {
+	chains := d.ruleRenderer.StaticManglePostroutingChains(t.IPVersion)
+	if len(chains) == 0 {
+		return
+	}
+	t.UpdateChains(chains)
+	t.SetRuleInsertions("POSTROUTING", []iptables.Rule{{
+		Action: iptables.JumpAction{Target: rules.ChainManglePostrouting},
+	}})
+}
+
 func stringToProtocol(protocol string) (labelindex.IPSetPortProtocol, error) {
 	switch protocol {
 	case "tcp":
@@ -1195,6 +1273,16 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			d.dataplaneNeedsSync = true
 			// nil out the channel to record that the timer is now inactive.
 			d.reschedC = nil
+		case <-d.applyKickC:
+			log.Debug("Apply kick received")
+			d.dataplaneNeedsSync = true
+		case stopWG := <-d.stopC:
+			log.Info("Dataplane stopping, cleaning up")
+			if d.wireguardAdminServer != nil {
+				d.wireguardAdminServer.Stop()
+			}
+			d.wireguardManager.OnStop()
+			stopWG.Done()
 		case <-throttleC:
 			d.applyThrottle.Refill()
 		case <-healthTicks:
@@ -1283,7 +1371,7 @@ func (d *InternalDataplane) configureKernel() {
 			log.WithError(err).Error("Failed to set unprivileged_bpf_disabled sysctl")
 		}
 	}
-	if d.config.Wireguard.Enabled {
+	if d.config.Wireguard.Enabled || d.config.Wireguard.AllowEnabledOverride {
 		// wireguard module is available in linux kernel >= 5.6
 		mpwg := newModProbe(moduleWireguard, newRealCmd)
 		out, err = mpwg.Exec()
@@ -1428,6 +1516,61 @@ func (d *InternalDataplane) apply() {
 	// Wait for the route updates to finish.
 	routesWG.Wait()
 
+	// If wireguard is not supported, apply again when it is due to check whether it is now supported.
+	if reprobeAfter := d.wireguardManager.ReprobeAfter(); reprobeAfter != 0 &&
+		(reschedDelay == 0 || reprobeAfter < reschedDelay) {
+		reschedDelay = reprobeAfter
+	}
+
+	// If the publication of the wireguard key is backing off after a key conflict, apply again when it is due.
+	if retryAfter := d.wireguardManager.PublishRetryAfter(); retryAfter != 0 &&
+		(reschedDelay == 0 || retryAfter < reschedDelay) {
+		reschedDelay = retryAfter
+	}
+
+	// If the moves of a flapping CIDR are damped, apply again when the CIDR is due to be released.
+	if releaseAfter := d.wireguardManager.DampingReleaseAfter(); releaseAfter != 0 &&
+		(reschedDelay == 0 || releaseAfter < reschedDelay) {
+		reschedDelay = releaseAfter
+	}
+
+	// If a wireguard peer may need to fail over to the secondary address of its node, apply again when it is due.
+	if checkAfter := d.wireguardManager.FailoverCheckAfter(); checkAfter != 0 &&
+		(reschedDelay == 0 || checkAfter < reschedDelay) {
+		reschedDelay = checkAfter
+	}
+
+	// If a wireguard peer is using the key of a removed node provisionally, apply again when the key is due to expire.
+	if expiryAfter := d.wireguardManager.ProvisionalKeyExpiryAfter(); expiryAfter != 0 &&
+		(reschedDelay == 0 || expiryAfter < reschedDelay) {
+		reschedDelay = expiryAfter
+	}
+
+	// If a node is in a wireguard key transition, apply again to check whether the peer of its previous key can be
+	// removed.
+	if checkAfter := d.wireguardManager.KeyTransitionCheckAfter(); checkAfter != 0 &&
+		(reschedDelay == 0 || checkAfter < reschedDelay) {
+		reschedDelay = checkAfter
+	}
+
+	// If the wireguard reconciliation is paused, apply again when it is due to be resumed.
+	if resumeAfter := d.wireguardManager.ResumeAfter(); resumeAfter != 0 &&
+		(reschedDelay == 0 || resumeAfter < reschedDelay) {
+		reschedDelay = resumeAfter
+	}
+
+	// If a burst of wireguard peer updates is being coalesced, apply again when the held updates are due.
+	if flushAfter := d.wireguardManager.PeerBatchFlushAfter(); flushAfter != 0 &&
+		(reschedDelay == 0 || flushAfter < reschedDelay) {
+		reschedDelay = flushAfter
+	}
+
+	// Applying the routes may have enabled wireguard or found it to be unsupported, which changes the workload MTU. The
+	// endpoint managers reconfigure the workload interfaces on the next apply.
+	if d.workloadMTUCalculator != nil && d.workloadMTUCalculator.Recalculate() {
+		d.dataplaneNeedsSync = true
+	}
+
 	// And publish and status updates.
 	d.endpointStatusCombiner.Apply()
 
@@ -1457,6 +1600,33 @@ func (d *InternalDataplane) apply() {
 	}
 }
 
+// StopChannel returns the channel used to stop the dataplane, see dataplane.StoppableDataplaneDriver. This is nil if
+// the dataplane does not need to be cleaned up when felix stops.
+func (d *InternalDataplane) StopChannel() chan<- *sync.WaitGroup {
+	return d.stopC
+}
+
+// kickApply requests an apply of the dataplane. This does not block, and may be called from any goroutine.
+func (d *InternalDataplane) kickApply() {
+	select {
+	case d.applyKickC <- struct{}{}:
+	default:
+		// A kick is already pending.
+	}
+}
+
+// observeWireguardApplyTiming records the time taken by a wireguard apply in the summary metrics. Every subsystem is
+// observed, including those with no work, so that the series have no gaps.
+func observeWireguardApplyTiming(took time.Duration, timing wireguard.ApplyTiming) {
+	summaryWireguardApplyTime.WithLabelValues("total").Observe(took.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("link").Observe(timing.Link.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("address").Observe(timing.Address.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("rules").Observe(timing.Rules.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("device-read").Observe(timing.DeviceRead.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("device-configure").Observe(timing.DeviceConfigure.Seconds())
+	summaryWireguardApplyTime.WithLabelValues("routes").Observe(timing.Routes.Seconds())
+}
+
 func (d *InternalDataplane) applyXDPActions() error {
 	var err error = nil
 	for i := 0; i < 10; i++ {
@@ -1506,6 +1676,9 @@ func (d *InternalDataplane) reportHealth() {
 			&health.HealthReport{Live: true, Ready: d.doneFirstApply},
 		)
 	}
+	if d.wireguardManager != nil {
+		d.wireguardManager.reportHealth()
+	}
 }
 
 type dummyLock struct{}
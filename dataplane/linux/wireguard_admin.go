@@ -0,0 +1,440 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/wireguard"
+	"github.com/projectcalico/felix/wireguard/admin"
+)
+
+// WireguardAdmin is the administrative interface of the wireguard configuration, which is served on the wireguard admin
+// socket, see wireguardAdminServer. It is implemented by the wireguard manager. The methods may be called from any
+// goroutine, and do not wait for an apply except for WhatIf.
+type WireguardAdmin interface {
+	// Status returns the local wireguard configuration and the diagnostics of the peers.
+	Status() *admin.Status
+	// Dump returns the status, the progress of the applies and the full trace of the operations.
+	Dump() *admin.Dump
+	// Resync queues a resync of the wireguard configuration, and requests an apply.
+	Resync()
+	// FullRebuild queues a rebuild of the wireguard configuration from scratch, and requests an apply.
+	FullRebuild()
+	// Drain and Undrain administratively drain and undrain the peer of a node.
+	Drain(nodeName string) error
+	Undrain(nodeName string) error
+	// Pause and Resume pause and resume the reconciliation of the wireguard configuration.
+	Pause()
+	Resume()
+	// WhatIf reports how the traffic to a destination is routed and encrypted once the next apply completes, or
+	// returns errWireguardApplyTimeout if the apply does not complete within the timeout.
+	WhatIf(dst ip.Addr, timeout time.Duration) (*admin.PathReport, error)
+	// Coverage reports the encryption coverage of the workload CIDRs of the remote nodes once the next apply
+	// completes, or returns errWireguardApplyTimeout if the apply does not complete within the timeout.
+	Coverage(timeout time.Duration) (*admin.CoverageReport, error)
+}
+
+var errWireguardApplyTimeout = errors.New("timed out waiting for the wireguard apply")
+
+var errWireguardNoNodeName = errors.New("node must be specified")
+
+// Status returns the local wireguard configuration and the diagnostics of the peers. Only the enabled state, the
+// support and the capabilities of wireguard, and the recent operations, are returned if the wireguard device is not
+// programmed, e.g. because wireguard is disabled or not supported.
+func (m *wireguardManager) Status() *admin.Status {
+	var status admin.Status
+	publicKey, port, ifaceName, ok := m.wireguardRouteTable.LocalConfig()
+	if ok {
+		status = admin.Status{
+			Programmed:    true,
+			PublicKey:     publicKey.String(),
+			ListeningPort: port,
+			InterfaceName: ifaceName,
+			Mode:          string(m.wireguardRouteTable.Mode()),
+			Peers:         m.peerDiagnostics(),
+
+			ExcludedByPolicy: m.wireguardRouteTable.OptedOutNodes(),
+
+			KeyDriftsCorrected: m.wireguardRouteTable.KeyDriftsCorrected(),
+
+			Capacity: m.capacityStatus(),
+		}
+	}
+	enabled, source := m.wireguardRouteTable.Enabled()
+	status.Enabled = enabled
+	status.EnabledSource = string(source)
+	if notSupported, reprobeTime := m.wireguardRouteTable.NotSupported(); notSupported {
+		status.NotSupported = true
+		if !reprobeTime.IsZero() {
+			status.NextReprobe = &reprobeTime
+		}
+	}
+	if caps := m.wireguardRouteTable.Capabilities(); caps.Probed {
+		status.Capabilities = &admin.Capabilities{
+			KernelVersion:                 caps.KernelVersion,
+			ConfigurationPath:             string(caps.ConfigurationPath),
+			CompatModule:                  caps.CompatModule,
+			PresharedKeys:                 caps.PresharedKeys,
+			KeepaliveGranularity:          caps.KeepaliveGranularity.String(),
+			MaxKeepalive:                  caps.MaxKeepalive.String(),
+			MaxAllowedIPsPerConfiguration: caps.MaxAllowedIPsPerConfiguration,
+		}
+	}
+
+	if trace := m.traceEntries(); len(trace) > wireguardTraceDumpEntries {
+		status.RecentOperations = trace[len(trace)-wireguardTraceDumpEntries:]
+	} else {
+		status.RecentOperations = trace
+	}
+	return &status
+}
+
+// Dump returns the status, the progress of the applies and the full trace of the operations.
+func (m *wireguardManager) Dump() *admin.Dump {
+	dump := &admin.Dump{
+		Status: *m.Status(),
+		Trace:  m.traceEntries(),
+	}
+	if dump.Trace == nil {
+		dump.Trace = []admin.TraceEntry{}
+	}
+
+	snapshot := m.wireguardRouteTable.HealthSnapshot()
+	dump.Health.ApplyInProgress = snapshot.ApplyInProgress
+	dump.Health.DiscrepantResyncs = m.wireguardRouteTable.DiscrepantResyncs()
+	dump.Health.LastApplyStart = optionalTime(snapshot.LastApplyStart)
+	dump.Health.LastApplyEnd = optionalTime(snapshot.LastApplyEnd)
+	dump.Health.PendingSince = optionalTime(snapshot.PendingSince)
+	return dump
+}
+
+// optionalTime returns the time, or nil if it is zero, so that the zero time is omitted from the JSON responses.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Resync queues a resync of the wireguard configuration, and requests an apply.
+func (m *wireguardManager) Resync() {
+	log.Info("Resyncing the wireguard configuration on request")
+	m.wireguardRouteTable.QueueResync()
+	m.wireguardRouteTable.RequestApply()
+}
+
+// FullRebuild queues a rebuild of the wireguard configuration from scratch, and requests an apply.
+func (m *wireguardManager) FullRebuild() {
+	log.Warn("Rebuilding the wireguard configuration on request")
+	m.wireguardRouteTable.QueueFullRebuild()
+	m.wireguardRouteTable.RequestApply()
+}
+
+// Drain administratively drains the peer of a node. The drain is processed by the next apply.
+func (m *wireguardManager) Drain(nodeName string) error {
+	if nodeName = m.canonicalHostname(nodeName); nodeName == "" {
+		return errWireguardNoNodeName
+	}
+	log.WithField("node", nodeName).Info("Draining wireguard peer")
+	m.wireguardRouteTable.EndpointDrain(nodeName)
+	return nil
+}
+
+// Undrain reverses Drain.
+func (m *wireguardManager) Undrain(nodeName string) error {
+	if nodeName = m.canonicalHostname(nodeName); nodeName == "" {
+		return errWireguardNoNodeName
+	}
+	log.WithField("node", nodeName).Info("Undraining wireguard peer")
+	m.wireguardRouteTable.EndpointUndrain(nodeName)
+	return nil
+}
+
+// Pause pauses the reconciliation of the wireguard configuration, e.g. while the node networking is reconfigured during
+// maintenance.
+func (m *wireguardManager) Pause() {
+	log.Info("Pausing wireguard reconciliation")
+	m.wireguardRouteTable.Pause()
+}
+
+// Resume reverses Pause. The resume is processed by the next apply, which resyncs all of the wireguard configuration.
+func (m *wireguardManager) Resume() {
+	log.Info("Resuming wireguard reconciliation")
+	m.wireguardRouteTable.Resume()
+}
+
+// WhatIf reports how the traffic to a destination is routed and encrypted. The query is answered by the wireguard
+// module once its next apply completes, which is requested.
+func (m *wireguardManager) WhatIf(dst ip.Addr, timeout time.Duration) (*admin.PathReport, error) {
+	type result struct {
+		report *wireguard.PathReport
+		err    error
+	}
+	resultC := make(chan result, 1)
+	m.wireguardRouteTable.QueueWhatIf(dst, func(report *wireguard.PathReport, err error) {
+		resultC <- result{report: report, err: err}
+	})
+
+	var res result
+	select {
+	case res = <-resultC:
+	case <-time.After(timeout):
+		return nil, errWireguardApplyTimeout
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return newWireguardPathReport(res.report), nil
+}
+
+// Coverage reports the encryption coverage of the workload CIDRs of the remote nodes. The report is made by the
+// wireguard module once its next apply completes, which is requested.
+func (m *wireguardManager) Coverage(timeout time.Duration) (*admin.CoverageReport, error) {
+	reportC := make(chan wireguard.CoverageReport, 1)
+	m.wireguardRouteTable.QueueCoverageReport(func(report wireguard.CoverageReport) {
+		reportC <- report
+	})
+
+	select {
+	case report := <-reportC:
+		return newWireguardCoverageReport(report), nil
+	case <-time.After(timeout):
+		return nil, errWireguardApplyTimeout
+	}
+}
+
+// wireguardAdminSocketMode is the mode of the wireguard admin socket, which is only accessible by the user felix runs
+// as. This is the only authorization of the admin requests.
+const wireguardAdminSocketMode os.FileMode = 0600
+
+// wireguardAdminServer serves the wireguard admin interface, see the admin package, on a Unix domain socket.
+type wireguardAdminServer struct {
+	backend    WireguardAdmin
+	socketPath string
+	server     *http.Server
+	listener   net.Listener
+}
+
+func newWireguardAdminServer(backend WireguardAdmin, socketPath string) *wireguardAdminServer {
+	s := &wireguardAdminServer{
+		backend:    backend,
+		socketPath: socketPath,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(admin.PathStatus, s.serveStatus)
+	mux.HandleFunc(admin.PathDump, s.serveDump)
+	mux.HandleFunc(admin.PathResync, s.serveResync)
+	mux.HandleFunc(admin.PathFullRebuild, s.serveFullRebuild)
+	mux.HandleFunc(admin.PathDrain, func(w http.ResponseWriter, r *http.Request) {
+		serveWireguardDrain(s.backend, w, r)
+	})
+	mux.HandleFunc(admin.PathPause, func(w http.ResponseWriter, r *http.Request) {
+		serveWireguardPause(s.backend, w, r)
+	})
+	mux.HandleFunc(admin.PathWhatIf, func(w http.ResponseWriter, r *http.Request) {
+		serveWireguardWhatIf(s.backend, w, r)
+	})
+	mux.HandleFunc(admin.PathCoverage, func(w http.ResponseWriter, r *http.Request) {
+		serveWireguardCoverage(s.backend, w, r)
+	})
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Start listens on the socket, replacing the socket left by a previous felix, and serves the requests in the
+// background until Stop is called. The socket is created with the default permissions, which do not allow other
+// users to connect with the usual umask, and then restricted to wireguardAdminSocketMode.
+func (s *wireguardAdminServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.socketPath, wireguardAdminSocketMode); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+
+	log.WithField("socket", s.socketPath).Info("Serving the wireguard admin interface")
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Wireguard admin server failed")
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving the requests and removes the socket. The requests in progress are abandoned. The listener is
+// closed here, as well as by the server, since the server may not have started serving it yet.
+func (s *wireguardAdminServer) Stop() {
+	if s.listener == nil {
+		return
+	}
+	if err := s.server.Close(); err != nil {
+		log.WithError(err).Warn("Failed to stop the wireguard admin server")
+	}
+	s.listener.Close()
+	s.listener = nil
+}
+
+func (s *wireguardAdminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeWireguardStatus(w, s.backend.Status())
+}
+
+func (s *wireguardAdminServer) serveDump(w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeWireguardJSON(w, http.StatusOK, s.backend.Dump())
+}
+
+func (s *wireguardAdminServer) serveResync(w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodPost) {
+		return
+	}
+	s.backend.Resync()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *wireguardAdminServer) serveFullRebuild(w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodPost) {
+		return
+	}
+	s.backend.FullRebuild()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// allowWireguardAdminMethod returns true if the request uses the method, and otherwise fails the request.
+func allowWireguardAdminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeWireguardStatus writes the status, with a service unavailable status if the device is not programmed.
+func writeWireguardStatus(w http.ResponseWriter, status *admin.Status) {
+	code := http.StatusOK
+	if !status.Programmed {
+		code = http.StatusServiceUnavailable
+	}
+	writeWireguardJSON(w, code, status)
+}
+
+func writeWireguardJSON(w http.ResponseWriter, code int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if code != http.StatusOK {
+		w.WriteHeader(code)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.WithError(err).Warn("Failed to write wireguard response")
+	}
+}
+
+// serveWireguardDrain drains the peer named by the node query parameter with a POST, and undrains it with a DELETE.
+// The request is processed by the next apply, so this returns an accepted status.
+func serveWireguardDrain(backend WireguardAdmin, w http.ResponseWriter, r *http.Request) {
+	nodeName := r.URL.Query().Get("node")
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = backend.Drain(nodeName)
+	case http.MethodDelete:
+		err = backend.Undrain(nodeName)
+	default:
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveWireguardPause pauses the reconciliation of the wireguard configuration with a POST, and resumes it with a
+// DELETE. A resume is processed by the next apply, so this returns an accepted status.
+func serveWireguardPause(backend WireguardAdmin, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		backend.Pause()
+	case http.MethodDelete:
+		backend.Resume()
+	default:
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveWireguardWhatIf reports how the traffic to the destination named by the dst query parameter is routed and
+// encrypted, once the next apply completes.
+func serveWireguardWhatIf(backend WireguardAdmin, w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodGet) {
+		return
+	}
+	dst := ip.FromString(r.URL.Query().Get("dst"))
+	if dst == nil {
+		http.Error(w, "dst must be an IP address", http.StatusBadRequest)
+		return
+	}
+
+	report, err := backend.WhatIf(dst, wireguardApplyWaitTimeout)
+	if err == errWireguardApplyTimeout {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeWireguardJSON(w, http.StatusOK, report)
+}
+
+// serveWireguardCoverage reports the encryption coverage of the workload CIDRs of the remote nodes, once the next apply
+// completes.
+func serveWireguardCoverage(backend WireguardAdmin, w http.ResponseWriter, r *http.Request) {
+	if !allowWireguardAdminMethod(w, r, http.MethodGet) {
+		return
+	}
+	report, err := backend.Coverage(wireguardApplyWaitTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	writeWireguardJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,502 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/wireguard"
+	"github.com/projectcalico/felix/wireguard/admin"
+)
+
+// applyingWireguardRouteTable is a mock wireguard route table that, like the wireguard module, queues the drains until
+// the next Apply and answers the what-if queries and the coverage reports once an Apply completes. Each Apply blocks
+// until it is released, so that the admin requests can be made while an Apply is in flight. The admin requests may be
+// made from any goroutine.
+type applyingWireguardRouteTable struct {
+	*mockWireguardRouteTable
+
+	lock            sync.Mutex
+	queued          []func()
+	whatIfs         []func()
+	applyInProgress bool
+
+	applyStarted chan struct{}
+	releaseApply chan struct{}
+}
+
+func newApplyingWireguardRouteTable(rt *mockWireguardRouteTable) *applyingWireguardRouteTable {
+	return &applyingWireguardRouteTable{
+		mockWireguardRouteTable: rt,
+		applyStarted:            make(chan struct{}, 1),
+		releaseApply:            make(chan struct{}, 1),
+	}
+}
+
+func (a *applyingWireguardRouteTable) Apply() error {
+	a.lock.Lock()
+	queued := a.queued
+	a.queued = nil
+	a.applyInProgress = true
+	a.lock.Unlock()
+
+	a.applyStarted <- struct{}{}
+	<-a.releaseApply
+
+	a.lock.Lock()
+	for _, update := range queued {
+		update()
+	}
+	whatIfs := a.whatIfs
+	a.whatIfs = nil
+	a.applyInProgress = false
+	a.lock.Unlock()
+
+	for _, answer := range whatIfs {
+		answer()
+	}
+	return nil
+}
+
+// applyInBackground starts an Apply and waits until it is in flight. The Apply completes once released.
+func (a *applyingWireguardRouteTable) applyInBackground() {
+	go func() {
+		defer GinkgoRecover()
+		Expect(a.Apply()).To(Succeed())
+	}()
+	Eventually(a.applyStarted).Should(Receive())
+}
+
+func (a *applyingWireguardRouteTable) EndpointDrain(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.queued = append(a.queued, func() { a.mockWireguardRouteTable.EndpointDrain(name) })
+}
+
+func (a *applyingWireguardRouteTable) EndpointUndrain(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.queued = append(a.queued, func() { a.mockWireguardRouteTable.EndpointUndrain(name) })
+}
+
+func (a *applyingWireguardRouteTable) QueueResync() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mockWireguardRouteTable.QueueResync()
+}
+
+func (a *applyingWireguardRouteTable) QueueFullRebuild() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mockWireguardRouteTable.QueueFullRebuild()
+}
+
+func (a *applyingWireguardRouteTable) RequestApply() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mockWireguardRouteTable.RequestApply()
+}
+
+func (a *applyingWireguardRouteTable) Pause() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mockWireguardRouteTable.Pause()
+}
+
+func (a *applyingWireguardRouteTable) Resume() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mockWireguardRouteTable.Resume()
+}
+
+func (a *applyingWireguardRouteTable) DiscrepantResyncs() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.mockWireguardRouteTable.DiscrepantResyncs()
+}
+
+func (a *applyingWireguardRouteTable) QueueWhatIf(dst ip.Addr, callback func(*wireguard.PathReport, error)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.whatIfDsts = append(a.whatIfDsts, dst)
+	report, err := a.whatIfReport, a.whatIfErr
+	a.whatIfs = append(a.whatIfs, func() { callback(report, err) })
+}
+
+func (a *applyingWireguardRouteTable) QueueCoverageReport(callback func(wireguard.CoverageReport)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	report := a.coverageReport
+	a.whatIfs = append(a.whatIfs, func() { callback(report) })
+}
+
+func (a *applyingWireguardRouteTable) HealthSnapshot() wireguard.HealthSnapshot {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	snapshot := a.healthSnapshot
+	snapshot.ApplyInProgress = a.applyInProgress
+	return snapshot
+}
+
+// counts returns the number of resyncs, full rebuilds and apply requests.
+func (a *applyingWireguardRouteTable) counts() (resyncs, fullRebuilds, applyRequests int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.numResyncs, a.numFullRebuilds, a.numApplyRequests
+}
+
+// isPaused returns whether the reconciliation is paused.
+func (a *applyingWireguardRouteTable) isPaused() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.paused
+}
+
+// drainedNodes returns the names of the drained nodes.
+func (a *applyingWireguardRouteTable) drainedNodes() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var names []string
+	for name := range a.drained {
+		names = append(names, name)
+	}
+	return names
+}
+
+var _ = Describe("Wireguard admin server", func() {
+	var (
+		rt         *mockWireguardRouteTable
+		art        *applyingWireguardRouteTable
+		manager    *wireguardManager
+		server     *wireguardAdminServer
+		client     *admin.Client
+		dir        string
+		socketPath string
+		ctx        context.Context
+		cancel     context.CancelFunc
+		key        wgtypes.Key
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "wireguard-admin")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(dir, "run", "wireguard-admin.sock")
+
+		rt = newMockWireguardRouteTable()
+		art = newApplyingWireguardRouteTable(rt)
+		manager = newWireguardManager(art, Config{WireguardHostnameCanonicalization: "Lowercase"})
+		server = newWireguardAdminServer(manager, socketPath)
+		Expect(server.Start()).To(Succeed())
+		client = admin.NewClient(socketPath)
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+
+		privateKey, err := wgtypes.GeneratePrivateKey()
+		Expect(err).NotTo(HaveOccurred())
+		key = privateKey.PublicKey()
+	})
+
+	AfterEach(func() {
+		cancel()
+		client.Close()
+		server.Stop()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should only allow the owner to connect to the socket", func() {
+		info, err := os.Stat(socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("should replace the socket of a previous server and remove the socket when stopped", func() {
+		server.Stop()
+		Expect(ioutil.WriteFile(socketPath, nil, 0600)).To(Succeed())
+
+		server = newWireguardAdminServer(manager, socketPath)
+		Expect(server.Start()).To(Succeed())
+		_, err := client.Status(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*admin.RequestError).StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		server.Stop()
+		_, err = os.Stat(socketPath)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should return the status", func() {
+		By("returning the status with an error before the device is programmed")
+		rt.notSupported = true
+		rt.reprobeTime = time.Now().Add(time.Hour).Round(0)
+		status, err := client.Status(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*admin.RequestError).StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(status.Programmed).To(BeFalse())
+		Expect(status.NotSupported).To(BeTrue())
+		Expect(status.NextReprobe.Equal(rt.reprobeTime)).To(BeTrue())
+
+		By("returning the status once the device is programmed")
+		rt.notSupported = false
+		rt.localConfig = &wireguardLocalConfig{
+			PublicKey:     key.String(),
+			ListeningPort: 51820,
+			InterfaceName: "wireguard.cali",
+			Mode:          "kernel",
+		}
+		rt.peerDiags = map[string]wireguard.PeerDiagnostics{
+			"node1": {PublicKey: key, HandshakeState: wireguard.HandshakeStateNone},
+		}
+		status, err = client.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*status).To(Equal(admin.Status{
+			Programmed:    true,
+			PublicKey:     key.String(),
+			ListeningPort: 51820,
+			InterfaceName: "wireguard.cali",
+			Mode:          "kernel",
+			Peers: []admin.PeerDiagnostics{{
+				NodeName:       "node1",
+				PublicKey:      key.String(),
+				HandshakeState: string(wireguard.HandshakeStateNone),
+			}},
+		}))
+
+		By("including the capacity stats once reported")
+		rt.capacityStats(wireguard.CapacityStats{
+			ProgrammedPeers: 1,
+			AllowedIPs:      2,
+			UnicastRoutes:   2,
+			ThrowRoutes:     1,
+			TopPeers:        []wireguard.PeerCapacity{{Name: "node1", CIDRs: 3, AllowedIPs: 2}},
+		})
+		status, err = client.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Capacity).To(Equal(&admin.CapacityStats{
+			ProgrammedPeers: 1,
+			AllowedIPs:      2,
+			UnicastRoutes:   2,
+			ThrowRoutes:     1,
+			TopPeers:        []admin.PeerCapacity{{NodeName: "node1", CIDRs: 3, AllowedIPs: 2}},
+		}))
+	})
+
+	It("should return the dump", func() {
+		rt.discrepantResyncs = 2
+		rt.healthSnapshot.LastApplyStart = time.Now().Round(0)
+		rt.trace = []wireguard.TraceEntry{
+			{Seq: 1, Op: wireguard.TraceOpRouteAdd, CIDR: "10.42.7.0/24", Cause: "route update"},
+		}
+		dump, err := client.Dump(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dump.Status.Programmed).To(BeFalse())
+		Expect(dump.Health.LastApplyStart.Equal(rt.healthSnapshot.LastApplyStart)).To(BeTrue())
+		Expect(dump.Health.LastApplyEnd).To(BeNil())
+		Expect(dump.Health.ApplyInProgress).To(BeFalse())
+		Expect(dump.Health.DiscrepantResyncs).To(Equal(2))
+		Expect(dump.Trace).To(HaveLen(1))
+		Expect(dump.Trace[0].Op).To(Equal(string(wireguard.TraceOpRouteAdd)))
+		Expect(dump.Trace[0].CIDR).To(Equal("10.42.7.0/24"))
+	})
+
+	It("should queue a resync and a full rebuild and request an apply", func() {
+		Expect(client.Resync(ctx)).To(Succeed())
+		resyncs, fullRebuilds, applyRequests := art.counts()
+		Expect(resyncs).To(Equal(1))
+		Expect(fullRebuilds).To(BeZero())
+		Expect(applyRequests).To(Equal(1))
+
+		Expect(client.FullRebuild(ctx)).To(Succeed())
+		resyncs, fullRebuilds, applyRequests = art.counts()
+		Expect(resyncs).To(Equal(1))
+		Expect(fullRebuilds).To(Equal(1))
+		Expect(applyRequests).To(Equal(2))
+	})
+
+	It("should drain and undrain a peer by its canonical name", func() {
+		Expect(client.Drain(ctx, "Node1")).To(Succeed())
+		art.applyInBackground()
+		art.releaseApply <- struct{}{}
+		Eventually(art.drainedNodes).Should(ConsistOf("node1"))
+
+		Expect(client.Undrain(ctx, "node1")).To(Succeed())
+		art.applyInBackground()
+		art.releaseApply <- struct{}{}
+		Eventually(art.drainedNodes).Should(BeEmpty())
+
+		By("rejecting a drain without a node")
+		err := client.Drain(ctx, "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*admin.RequestError).StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(err.(*admin.RequestError).Message).To(Equal("node must be specified"))
+	})
+
+	It("should pause and resume the reconciliation", func() {
+		Expect(client.Pause(ctx)).To(Succeed())
+		Expect(art.isPaused()).To(BeTrue())
+
+		Expect(client.Resume(ctx)).To(Succeed())
+		Expect(art.isPaused()).To(BeFalse())
+
+		By("rejecting invalid requests")
+		rec := httptest.NewRecorder()
+		serveWireguardPause(manager, rec, httptest.NewRequest(http.MethodGet, admin.PathPause, nil))
+		Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(art.isPaused()).To(BeFalse())
+	})
+
+	It("should report the path to a destination once the apply completes", func() {
+		rt.whatIfReport = &wireguard.PathReport{
+			Destination: ip.FromString("10.42.7.9"),
+			Verdict:     wireguard.PathVerdictFallThrough,
+			Reason:      "no route in the wireguard routing tables",
+		}
+		reportC := make(chan *admin.PathReport, 1)
+		go func() {
+			defer GinkgoRecover()
+			report, err := client.WhatIf(ctx, "10.42.7.9")
+			Expect(err).NotTo(HaveOccurred())
+			reportC <- report
+		}()
+		Consistently(reportC, "100ms").ShouldNot(Receive())
+
+		art.applyInBackground()
+		art.releaseApply <- struct{}{}
+		Eventually(reportC).Should(Receive(Equal(&admin.PathReport{
+			Destination: "10.42.7.9",
+			Verdict:     "FallThrough",
+			Reason:      "no route in the wireguard routing tables",
+		})))
+
+		By("rejecting an invalid destination")
+		_, err := client.WhatIf(ctx, "not-an-address")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*admin.RequestError).StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should report the encryption coverage once the apply completes", func() {
+		rt.coverageReport = wireguard.CoverageReport{
+			Active:      true,
+			CIDRs:       4,
+			Tunneled:    3,
+			Percent:     75,
+			FallThrough: map[wireguard.CoverageReason]int{wireguard.CoverageReasonConflict: 1},
+			Peers: []wireguard.PeerCoverage{
+				{Name: "node1", CIDRs: 3, Tunneled: 3, FallThrough: map[wireguard.CoverageReason]int{}},
+				{Name: "node2", CIDRs: 1, FallThrough: map[wireguard.CoverageReason]int{wireguard.CoverageReasonConflict: 1}},
+			},
+		}
+		reportC := make(chan *admin.CoverageReport, 1)
+		go func() {
+			defer GinkgoRecover()
+			report, err := client.Coverage(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			reportC <- report
+		}()
+		Consistently(reportC, "100ms").ShouldNot(Receive())
+
+		art.applyInBackground()
+		art.releaseApply <- struct{}{}
+		Eventually(reportC).Should(Receive(Equal(&admin.CoverageReport{
+			Active:      true,
+			CIDRs:       4,
+			Tunneled:    3,
+			Percent:     75,
+			FallThrough: map[string]int{"Conflict": 1},
+			Peers: []admin.PeerCoverage{
+				{NodeName: "node1", CIDRs: 3, Tunneled: 3},
+				{NodeName: "node2", CIDRs: 1, FallThrough: map[string]int{"Conflict": 1}},
+			},
+		})))
+	})
+
+	It("should serve concurrent requests while an apply is in flight", func() {
+		rt.whatIfReport = &wireguard.PathReport{
+			Destination: ip.FromString("10.42.7.9"),
+			Verdict:     wireguard.PathVerdictFallThrough,
+		}
+		art.applyInBackground()
+
+		const numClients = 10
+		var wg sync.WaitGroup
+		for i := 0; i < numClients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, err := client.Status(ctx)
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*admin.RequestError).StatusCode).To(Equal(http.StatusServiceUnavailable))
+				dump, err := client.Dump(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dump.Health.ApplyInProgress).To(BeTrue())
+				Expect(client.Resync(ctx)).To(Succeed())
+				Expect(client.FullRebuild(ctx)).To(Succeed())
+				Expect(client.Drain(ctx, fmt.Sprintf("node%d", i))).To(Succeed())
+			}(i)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		Eventually(done).Should(BeClosed())
+
+		By("answering the what-if queries once the apply completes")
+		reportC := make(chan *admin.PathReport, numClients)
+		for i := 0; i < numClients; i++ {
+			go func() {
+				defer GinkgoRecover()
+				report, err := client.WhatIf(ctx, "10.42.7.9")
+				Expect(err).NotTo(HaveOccurred())
+				reportC <- report
+			}()
+		}
+		Eventually(func() int {
+			art.lock.Lock()
+			defer art.lock.Unlock()
+			return len(art.whatIfs)
+		}).Should(Equal(numClients))
+		Consistently(reportC, "100ms").ShouldNot(Receive())
+		art.releaseApply <- struct{}{}
+		for i := 0; i < numClients; i++ {
+			Eventually(reportC).Should(Receive())
+		}
+
+		By("applying the drains queued during the apply with the next apply")
+		resyncs, fullRebuilds, applyRequests := art.counts()
+		Expect(resyncs).To(Equal(numClients))
+		Expect(fullRebuilds).To(Equal(numClients))
+		Expect(applyRequests).To(Equal(2 * numClients))
+		Expect(art.drainedNodes()).To(BeEmpty())
+
+		art.applyInBackground()
+		art.releaseApply <- struct{}{}
+		Eventually(art.drainedNodes).Should(HaveLen(numClients))
+	})
+})
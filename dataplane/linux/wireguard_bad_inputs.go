@@ -0,0 +1,191 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	timeshim "github.com/projectcalico/felix/time"
+)
+
+// wireguardBadInputType is the type of a datastore value that the wireguard manager failed to parse.
+type wireguardBadInputType string
+
+const (
+	wireguardBadInputPublicKey         wireguardBadInputType = "public-key"
+	wireguardBadInputPreviousPublicKey wireguardBadInputType = "previous-public-key"
+	wireguardBadInputInterfaceAddr     wireguardBadInputType = "interface-address"
+	wireguardBadInputCIDR              wireguardBadInputType = "cidr"
+	wireguardBadInputEnabledOverride   wireguardBadInputType = "enabled-override"
+)
+
+var wireguardBadInputTypes = []wireguardBadInputType{
+	wireguardBadInputPublicKey,
+	wireguardBadInputPreviousPublicKey,
+	wireguardBadInputInterfaceAddr,
+	wireguardBadInputCIDR,
+	wireguardBadInputEnabledOverride,
+}
+
+// wireguardBadInputReminderInterval is the interval at which a bad input that is still outstanding is logged again.
+const wireguardBadInputReminderInterval = 5 * time.Minute
+
+var gaugeWireguardBadInputs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "felix_int_dataplane_wireguard_bad_inputs",
+	Help: "Number of datastore values currently ignored by wireguard because they could not be parsed, by type.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(gaugeWireguardBadInputs)
+}
+
+type wireguardBadInputKey struct {
+	inputType wireguardBadInputType
+	hostname  string
+	value     string
+}
+
+type wireguardBadInput struct {
+	// The time the value was first seen, and the time it was last logged at info level or above.
+	firstSeen  time.Time
+	lastLogged time.Time
+
+	// The number of updates with the value, and the number since it was last logged at info level or above.
+	updates            int
+	updatesSinceLogged int
+}
+
+// wireguardBadInputs is a negative cache of the datastore values that the wireguard manager failed to parse, keyed by
+// the node and the raw value. The same value is typically resent with every update of the node, so a bad value is
+// logged as an error when first seen, then at debug level, with a periodic reminder while it is outstanding.
+type wireguardBadInputs struct {
+	time             timeshim.Time
+	reminderInterval time.Duration
+
+	inputs map[wireguardBadInputKey]*wireguardBadInput
+}
+
+func newWireguardBadInputs(timeShim timeshim.Time) *wireguardBadInputs {
+	b := &wireguardBadInputs{
+		time:             timeShim,
+		reminderInterval: wireguardBadInputReminderInterval,
+		inputs:           map[wireguardBadInputKey]*wireguardBadInput{},
+	}
+	b.updateGauge()
+	return b
+}
+
+// record records an update of the node with a value that could not be parsed.
+func (b *wireguardBadInputs) record(inputType wireguardBadInputType, hostname, value string, err error) {
+	key := wireguardBadInputKey{inputType: inputType, hostname: hostname, value: value}
+	logCxt := log.WithError(err).WithFields(log.Fields{"type": inputType, "node": hostname, "value": value})
+	if input, ok := b.inputs[key]; ok {
+		input.updates++
+		input.updatesSinceLogged++
+		logCxt.Debug("Wireguard datastore value still cannot be parsed, ignoring")
+		return
+	}
+	now := b.time.Now()
+	b.inputs[key] = &wireguardBadInput{firstSeen: now, lastLogged: now, updates: 1}
+	logCxt.Error("Unable to parse wireguard datastore value, ignoring until corrected")
+	b.updateGauge()
+}
+
+// clearNode removes the bad values of the type for the node, once the node has a value of the type that can be parsed.
+func (b *wireguardBadInputs) clearNode(inputType wireguardBadInputType, hostname string) {
+	b.clear(func(key wireguardBadInputKey) bool {
+		return key.inputType == inputType && key.hostname == hostname
+	})
+}
+
+// clearValue removes the bad value of the type for all nodes, e.g. once the route of a bad CIDR is removed.
+func (b *wireguardBadInputs) clearValue(inputType wireguardBadInputType, value string) bool {
+	return b.clear(func(key wireguardBadInputKey) bool {
+		return key.inputType == inputType && key.value == value
+	})
+}
+
+// clearAll removes the bad values of all types for the node, once the node is removed.
+func (b *wireguardBadInputs) clearAll(hostname string) {
+	b.clear(func(key wireguardBadInputKey) bool {
+		return key.hostname == hostname
+	})
+}
+
+func (b *wireguardBadInputs) clear(match func(key wireguardBadInputKey) bool) bool {
+	cleared := false
+	for key, input := range b.inputs {
+		if !match(key) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"type":    key.inputType,
+			"node":    key.hostname,
+			"value":   key.value,
+			"updates": input.updates,
+		}).Info("Wireguard datastore value that could not be parsed has been corrected or removed")
+		delete(b.inputs, key)
+		cleared = true
+	}
+	if cleared {
+		b.updateGauge()
+	}
+	return cleared
+}
+
+// remind logs each bad value that has been outstanding for the reminder interval since it was last logged, with the
+// number of updates since then.
+func (b *wireguardBadInputs) remind() {
+	if len(b.inputs) == 0 {
+		return
+	}
+	now := b.time.Now()
+	for key, input := range b.inputs {
+		if now.Sub(input.lastLogged) < b.reminderInterval {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"type":          key.inputType,
+			"node":          key.hostname,
+			"value":         key.value,
+			"outstanding":   now.Sub(input.firstSeen),
+			"updates":       input.updates,
+			"recentUpdates": input.updatesSinceLogged,
+		}).Info("Wireguard datastore value still cannot be parsed, ignoring until corrected")
+		input.lastLogged = now
+		input.updatesSinceLogged = 0
+	}
+}
+
+// counts returns the number of bad values of each type.
+func (b *wireguardBadInputs) counts() map[wireguardBadInputType]int {
+	counts := map[wireguardBadInputType]int{}
+	for _, inputType := range wireguardBadInputTypes {
+		counts[inputType] = 0
+	}
+	for key := range b.inputs {
+		counts[key.inputType]++
+	}
+	return counts
+}
+
+func (b *wireguardBadInputs) updateGauge() {
+	for inputType, count := range b.counts() {
+		gaugeWireguardBadInputs.WithLabelValues(string(inputType)).Set(float64(count))
+	}
+}
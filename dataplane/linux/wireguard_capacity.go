@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/wireguard"
+	"github.com/projectcalico/felix/wireguard/admin"
+)
+
+// The kinds of the counts of the programmed wireguard configuration, see wireguard.CapacityStats.
+const (
+	wireguardCapacityProgrammedPeers = "programmed-peers"
+	wireguardCapacityAllowedIPs      = "allowed-ips"
+	wireguardCapacityUnicastRoutes   = "unicast-routes"
+	wireguardCapacityThrowRoutes     = "throw-routes"
+	wireguardCapacityPendingRoutes   = "pending-routes"
+	wireguardCapacitySuppressedCIDRs = "suppressed-cidrs"
+)
+
+var gaugeWireguardCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "felix_int_dataplane_wireguard_capacity",
+	Help: "Number of wireguard peers, allowed IPs and routes programmed, by kind.",
+}, []string{"kind"})
+
+var gaugeWireguardMaxPeerCIDRs = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "felix_int_dataplane_wireguard_max_peer_cidrs",
+	Help: "Largest number of CIDRs of a single wireguard peer.",
+})
+
+func init() {
+	prometheus.MustRegister(gaugeWireguardCapacity)
+	prometheus.MustRegister(gaugeWireguardMaxPeerCIDRs)
+}
+
+// onCapacityStats is the callback of the capacity stats of the wireguard module, which publishes the stats to the
+// Prometheus gauges and to the status of the admin interface. The top peers are only included in the status, so that
+// the gauges are not labelled by node.
+func (m *wireguardManager) onCapacityStats(stats wireguard.CapacityStats) {
+	m.capacityLock.Lock()
+	m.capacityStats = &stats
+	m.capacityLock.Unlock()
+
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacityProgrammedPeers).Set(float64(stats.ProgrammedPeers))
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacityAllowedIPs).Set(float64(stats.AllowedIPs))
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacityUnicastRoutes).Set(float64(stats.UnicastRoutes))
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacityThrowRoutes).Set(float64(stats.ThrowRoutes))
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacityPendingRoutes).Set(float64(stats.PendingRoutes))
+	gaugeWireguardCapacity.WithLabelValues(wireguardCapacitySuppressedCIDRs).Set(float64(stats.SuppressedCIDRs))
+	maxPeerCIDRs := 0
+	if len(stats.TopPeers) > 0 {
+		maxPeerCIDRs = stats.TopPeers[0].CIDRs
+	}
+	gaugeWireguardMaxPeerCIDRs.Set(float64(maxPeerCIDRs))
+}
+
+// capacityStatus returns the capacity stats last reported by the wireguard module for the admin status, or nil if none
+// have been reported.
+func (m *wireguardManager) capacityStatus() *admin.CapacityStats {
+	m.capacityLock.Lock()
+	defer m.capacityLock.Unlock()
+	if m.capacityStats == nil {
+		return nil
+	}
+	stats := m.capacityStats
+	status := &admin.CapacityStats{
+		ProgrammedPeers: stats.ProgrammedPeers,
+		AllowedIPs:      stats.AllowedIPs,
+		UnicastRoutes:   stats.UnicastRoutes,
+		ThrowRoutes:     stats.ThrowRoutes,
+		PendingRoutes:   stats.PendingRoutes,
+		SuppressedCIDRs: stats.SuppressedCIDRs,
+	}
+	for _, peer := range stats.TopPeers {
+		status.TopPeers = append(status.TopPeers, admin.PeerCapacity{
+			NodeName:   peer.Name,
+			CIDRs:      peer.CIDRs,
+			AllowedIPs: peer.AllowedIPs,
+		})
+	}
+	return status
+}
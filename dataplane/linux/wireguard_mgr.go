@@ -15,12 +15,25 @@
 package intdataplane
 
 import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/health"
+	"github.com/projectcalico/libcalico-go/lib/set"
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/projectcalico/felix/conntrack"
 	"github.com/projectcalico/felix/ip"
 	"github.com/projectcalico/felix/proto"
+	timeshim "github.com/projectcalico/felix/time"
 	"github.com/projectcalico/felix/wireguard"
+	"github.com/projectcalico/felix/wireguard/admin"
 )
 
 // wireguardManager manages the dataplane resources that are used for wireguard encrypted traffic. This includes:
@@ -36,17 +49,279 @@ import (
 // programming.
 type wireguardManager struct {
 	// Our dependencies.
-	wireguardRouteTable *wireguard.Wireguard
+	wireguardRouteTable wireguardRouteTable
+
+	// Our hostname, in canonical form. The wireguard configuration is torn down when the metadata of our host is
+	// removed.
+	hostname string
+
+	// The canonicalizer of the node names in the updates, so that the names of the same node that differ in format are
+	// treated as the same node, see wireguardHostnameCanonicalizers.
+	canonicalHostname wireguard.NodeNameCanonicalizer
+
+	// Whether the wireguard configuration is torn down when felix stops.
+	teardownOnExit bool
+
+	// Whether our host has been removed, and so the wireguard configuration torn down. The wireguard module is not
+	// rebuilt if the host is added back, wireguard is only programmed again once felix restarts.
+	localHostRemoved bool
+
+	// The raw value of the override of whether wireguard is enabled on our host last passed to the wireguard module,
+	// see updateEnabledOverride.
+	enabledOverride string
+
+	// The set of route types whose destinations are routed through the wireguard tunnel.
+	routeTypes map[proto.RouteType]bool
+
+	// The CIDRs that have been sent to the wireguard module, and the node and route class of each. This allows the
+	// manager to handle changes in route type and ownership.
+	cidrToRoute map[ip.CIDR]wireguardRoute
+
+	// The IPAM blocks of the wireguard IP version and the node each block is affine to. These are used to verify the
+	// CIDRs that are attributed to the wireguard peers, see verifyCIDR.
+	blockToNodeName map[ip.CIDR]string
+
+	// The IPAM blocks affine to our host, and the addresses our workloads have borrowed from the blocks of other nodes.
+	// These are the source CIDRs of the wireguard routing rules, see wireguard.RuleSelectorSource, and are sent to the
+	// wireguard module once changed.
+	localPodCIDRs      set.Set
+	localPodCIDRsDirty bool
+
+	// The number of consecutive resyncs finding discrepancies after which the wireguard configuration is rebuilt, or
+	// zero if the configuration is never rebuilt.
+	fullRebuildAfterResyncs int
+
+	// The conntrack implementation used to remove the conntrack entries of the CIDRs no longer routed to wireguard.
+	conntrack wireguardConntrack
+
+	// The datastore values that could not be parsed, so that each is only logged once while it is outstanding.
+	badInputs *wireguardBadInputs
+
+	// The health aggregator the liveness of the wireguard Apply is reported to, or nil if the liveness is not reported,
+	// and the time after which an Apply in progress, or updates waiting for an Apply, are reported as not live, see
+	// reportHealth.
+	healthAggregator  *health.HealthAggregator
+	applyStallTimeout time.Duration
+
+	// Whether the last liveness report was live, so that a stall is only logged once. The health is reported from the
+	// goroutines of the dataplane, so this is protected by a lock.
+	healthLock   sync.Mutex
+	reportedLive bool
+
+	// The capacity stats last reported by the wireguard module, or nil if none have been reported. The stats are
+	// reported from the goroutine of the apply, and read by the admin interface, so these are protected by a lock.
+	capacityLock  sync.Mutex
+	capacityStats *wireguard.CapacityStats
+
+	// The reporter of the status of the wireguard module, which is told of the conflicts between our public key and the
+	// key stored for our host, or nil if the conflicts are not reported.
+	statusReporter *wireguardStatusReporter
+}
+
+// wireguardHealthName is the name of the reporter of the liveness of the wireguard Apply.
+const wireguardHealthName = "wireguard_apply"
+
+// wireguardConntrack is the interface provided by the conntrack package, as used by the routetables.
+type wireguardConntrack interface {
+	RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP)
+}
+
+// wireguardHostnameCanonicalizers maps the values of the WireguardHostnameCanonicalization parameter to the
+// canonicalizer of the node names. The node names are lowercased by default, since the datastore may hold the names
+// of the same node in a different case, e.g. if kubelet registered the node with an uppercase hostname.
+var wireguardHostnameCanonicalizers = map[string]wireguard.NodeNameCanonicalizer{
+	"":          canonicalWireguardHostname,
+	"Lowercase": canonicalWireguardHostname,
+	"None":      func(name string) string { return name },
+}
+
+// canonicalWireguardHostname lowercases a node name and trims any trailing dots, as in a fully qualified hostname.
+func canonicalWireguardHostname(name string) string {
+	return strings.TrimRight(strings.ToLower(name), ".")
+}
+
+// maxWireguardConntrackCleanupAddrs is the largest number of addresses in a CIDR whose conntrack entries are removed
+// when it is no longer routed to wireguard. The conntrack entries are removed one address at a time, so the entries of
+// larger CIDRs are left to expire.
+const maxWireguardConntrackCleanupAddrs = 256
+
+type wireguardRoute struct {
+	nodeName string
+	class    wireguard.RouteClass
+}
+
+// wireguardRouteTable is the interface provided by the wireguard module.
+type wireguardRouteTable interface {
+	routeTableSyncer
+	EndpointUpdate(name string, ipv4Addr ip.Addr)
+	EndpointRemove(name string)
+	EndpointAllowedCIDRAdd(name string, cidr ip.CIDR, class ...wireguard.RouteClass)
+	EndpointAllowedCIDRRemove(cidr ip.CIDR)
+	EndpointAllowedCIDRRemoveForNode(name string, cidr ip.CIDR)
+	EndpointWireguardUpdate(name string, publicKey wgtypes.Key, ipv4InterfaceAddr ip.Addr, listeningPort ...int)
+	EndpointWireguardPreviousKey(name string, previousKey wgtypes.Key, deadline time.Time)
+	EndpointWireguardRemove(name string)
+	EndpointWireguardReady(name string, ready bool)
+	EndpointWireguardOptOut(name string, optOut bool)
+	EndpointDrain(name string)
+	EndpointUndrain(name string)
+	SetCIDRVerifier(verifier wireguard.CIDRVerifier)
+	SetConntrackCleaner(cleaner wireguard.ConntrackCleaner)
+	SetCapacityStatsCallback(callback wireguard.CapacityStatsCallback)
+	SetNodeOverrideEnabled(enabled *bool)
+	Enabled() (enabled bool, source wireguard.EnabledSource)
+	SetNodeNameCanonicalizer(canonicalizer wireguard.NodeNameCanonicalizer)
+	SetRuleSourceCIDRs(cidrs []ip.CIDR)
+	DatastoreInSync()
+	RouteTableSyncers() []*wireguard.RouteTableSyncer
+	QueueFullRebuild()
+	RepublishKey()
+	RequestApply()
+	DiscrepantResyncs() int
+	KeyDriftsCorrected() int
+	LocalConfig() (publicKey wgtypes.Key, port int, ifaceName string, ok bool)
+	PeerDiagnostics() map[string]wireguard.PeerDiagnostics
+	OptedOutNodes() []string
+	Mode() wireguard.Mode
+	Capabilities() wireguard.Capabilities
+	NotSupported() (notSupported bool, reprobeTime time.Time)
+	ReprobeAfter() time.Duration
+	PublishRetryAfter() time.Duration
+	DampingReleaseAfter() time.Duration
+	EndpointSecondaryUpdate(name string, ipv4Addr ip.Addr)
+	FailoverCheckAfter() time.Duration
+	ProvisionalKeyExpiryAfter() time.Duration
+	KeyTransitionCheckAfter() time.Duration
+	QueueWhatIf(dst ip.Addr, callback func(*wireguard.PathReport, error))
+	QueueCoverageReport(callback func(wireguard.CoverageReport))
+	Pause()
+	Resume()
+	ResumeAfter() time.Duration
+	PeerBatchFlushAfter() time.Duration
+	Active() bool
+	IPVersion() uint8
+	Overhead() int
+	HealthSnapshot() wireguard.HealthSnapshot
+	DumpTrace() []wireguard.TraceEntry
+	Teardown() error
+}
+
+// wireguardHTTPPath is the path of the HTTP endpoint that returns the local wireguard configuration, allowing other
+// components on the node to query the programmed public key.
+const wireguardHTTPPath = "/wireguard"
+
+// wireguardApplyWaitTimeout is how long the admin requests that are answered once the next apply completes, e.g. the
+// what-if queries and the coverage reports, wait for the apply.
+const wireguardApplyWaitTimeout = 10 * time.Second
+
+// wireguardTraceDumpEntries is the number of the most recent operations included in the status of the admin interface.
+// The full trace is included in the dump.
+const wireguardTraceDumpEntries = 20
+
+// The JSON representations of the local wireguard configuration, the peer diagnostics, the trace, the path reports and
+// the coverage reports are those of the wireguard admin interface, see the admin package, so that the local
+// configuration endpoint and the admin interface return the same responses.
+type (
+	wireguardLocalConfig     = admin.Status
+	wireguardCapabilities    = admin.Capabilities
+	wireguardPeerDiagnostics = admin.PeerDiagnostics
+	wireguardTraceEntry      = admin.TraceEntry
+	wireguardPathReport      = admin.PathReport
+	wireguardCoverageReport  = admin.CoverageReport
+)
+
+var registerWireguardHTTPHandlerOnce sync.Once
+
+// registerWireguardHTTPHandler registers the wireguard manager with the default HTTP mux, which is served alongside the
+// Prometheus metrics when PrometheusMetricsEnabled is set. The health endpoint is served by libcalico-go and cannot be
+// extended. The mux does not allow a path to be registered twice, so only the first manager created in the process is
+// registered. The mux is served without authentication, so the operations that change the dataplane, e.g. the peer
+// drain, and those that request an apply, e.g. the what-if queries and the coverage reports, are only served on the
+// wireguard admin socket, see newWireguardAdminServer.
+func registerWireguardHTTPHandler(m *wireguardManager) {
+	registerWireguardHTTPHandlerOnce.Do(func() {
+		http.Handle(wireguardHTTPPath, m)
+	})
 }
 
 type WireguardStatusUpdateCallback func(ipVersion uint8, id interface{}, status string)
 
+// wireguardAdditionalRouteTypes maps the configured names of the additional route types to the proto route type.
+var wireguardAdditionalRouteTypes = map[string]proto.RouteType{
+	"RemoteHost": proto.RouteType_REMOTE_HOST,
+}
+
+// wireguardRouteClasses maps the route type to the wireguard route class, which determines the routing table used for
+// the route. Route types not included use the workload route class.
+var wireguardRouteClasses = map[proto.RouteType]wireguard.RouteClass{
+	proto.RouteType_REMOTE_WORKLOAD: wireguard.RouteClassWorkload,
+	proto.RouteType_REMOTE_HOST:     wireguard.RouteClassHost,
+}
+
 func newWireguardManager(
-	wireguardRouteTable *wireguard.Wireguard,
+	wireguardRouteTable wireguardRouteTable,
+	dpConfig Config,
 ) *wireguardManager {
-	return &wireguardManager{
-		wireguardRouteTable: wireguardRouteTable,
+	return newWireguardManagerWithShims(wireguardRouteTable, dpConfig, conntrack.New(), timeshim.NewRealTime())
+}
+
+func newWireguardManagerWithShims(
+	wireguardRouteTable wireguardRouteTable,
+	dpConfig Config,
+	conntrack wireguardConntrack,
+	timeShim timeshim.Time,
+) *wireguardManager {
+	routeTypes := map[proto.RouteType]bool{
+		proto.RouteType_REMOTE_WORKLOAD: true,
+	}
+	for _, name := range dpConfig.WireguardAdditionalRouteTypes {
+		if routeType, ok := wireguardAdditionalRouteTypes[name]; ok {
+			routeTypes[routeType] = true
+		} else {
+			log.WithField("routeType", name).Warn("Unknown wireguard route type, ignoring")
+		}
+	}
+	if dpConfig.Wireguard.LocalCIDRsAsThrow {
+		// The CIDRs of the local workloads are passed to the wireguard module, which programs throw routes for them.
+		routeTypes[proto.RouteType_LOCAL_WORKLOAD] = true
+	}
+	canonicalHostname, ok := wireguardHostnameCanonicalizers[dpConfig.WireguardHostnameCanonicalization]
+	if !ok {
+		log.WithField("canonicalization", dpConfig.WireguardHostnameCanonicalization).Warn(
+			"Unknown wireguard hostname canonicalization, lowercasing")
+		canonicalHostname = canonicalWireguardHostname
+	}
+	m := &wireguardManager{
+		wireguardRouteTable:     wireguardRouteTable,
+		hostname:                canonicalHostname(dpConfig.Hostname),
+		canonicalHostname:       canonicalHostname,
+		teardownOnExit:          dpConfig.WireguardTeardownOnExit,
+		routeTypes:              routeTypes,
+		cidrToRoute:             map[ip.CIDR]wireguardRoute{},
+		blockToNodeName:         map[ip.CIDR]string{},
+		localPodCIDRs:           set.New(),
+		fullRebuildAfterResyncs: dpConfig.WireguardFullRebuildAfterResyncs,
+		conntrack:               conntrack,
+		badInputs:               newWireguardBadInputs(timeShim),
+	}
+	wireguardRouteTable.SetCIDRVerifier(m.verifyCIDR)
+	// The node names are canonicalized before they are passed to the wireguard module, but the module also
+	// canonicalizes its own hostname, and merges any nodes it already has under names that are not canonical.
+	wireguardRouteTable.SetNodeNameCanonicalizer(canonicalHostname)
+	if dpConfig.Wireguard.ConntrackCleanup {
+		wireguardRouteTable.SetConntrackCleaner(m.removeConntrackFlows)
 	}
+	wireguardRouteTable.SetCapacityStatsCallback(m.onCapacityStats)
+	mayBeEnabled := dpConfig.Wireguard.Enabled || dpConfig.Wireguard.AllowEnabledOverride
+	if dpConfig.HealthAggregator != nil && mayBeEnabled && dpConfig.WireguardApplyStallMultiplier > 0 {
+		// The rest of the dataplane may make progress while the wireguard Apply is stalled, so the wireguard Apply has
+		// its own liveness reporter.
+		m.healthAggregator = dpConfig.HealthAggregator
+		m.applyStallTimeout = time.Duration(dpConfig.WireguardApplyStallMultiplier) * dpConfig.NetlinkTimeout
+		m.reportedLive = true
+		m.healthAggregator.RegisterReporter(wireguardHealthName, &health.HealthReport{Live: true}, healthInterval*2)
+	}
+	return m
 }
 
 func (m *wireguardManager) OnUpdate(protoBufMsg interface{}) {
@@ -54,52 +329,560 @@ func (m *wireguardManager) OnUpdate(protoBufMsg interface{}) {
 	switch msg := protoBufMsg.(type) {
 	case *proto.HostMetadataUpdate:
 		log.WithField("msg", msg).Debug("HostMetadataUpdate update")
-		m.wireguardRouteTable.EndpointUpdate(msg.Hostname, ip.FromString(msg.Ipv4Addr))
+		hostname := m.canonicalHostname(msg.Hostname)
+		m.wireguardRouteTable.EndpointUpdate(hostname, ip.FromString(msg.Ipv4Addr))
+		m.wireguardRouteTable.EndpointSecondaryUpdate(hostname, ip.FromString(msg.Ipv4SecondaryAddr))
+		if hostname == m.hostname {
+			if m.localHostRemoved {
+				log.Warn("Local host has been added back after it was removed, the wireguard configuration remains " +
+					"torn down until felix restarts")
+			}
+			m.updateEnabledOverride(msg.WireguardEnabledOverride)
+		}
 	case *proto.HostMetadataRemove:
 		log.WithField("msg", msg).Debug("HostMetadataRemove update")
-		m.wireguardRouteTable.EndpointRemove(msg.Hostname)
+		hostname := m.canonicalHostname(msg.Hostname)
+		m.wireguardRouteTable.EndpointRemove(hostname)
+		m.removeNodeCIDRs(hostname)
+		m.badInputs.clearAll(hostname)
+		if hostname == m.hostname {
+			// Our host has been removed from the cluster, e.g. because the node is being decommissioned, so remove the
+			// wireguard configuration rather than leaving it on the host. The configuration is not programmed again if
+			// the host is added back.
+			m.localHostRemoved = true
+			m.teardown("local host removed")
+		}
 	case *proto.RouteUpdate:
 		log.WithField("msg", msg).Debug("RouteUpdate update")
-		if msg.Type != proto.RouteType_REMOTE_WORKLOAD {
-			log.Debug("RouteUpdate is not a peer workload update, ignoring")
+		// The CIDR is parsed into its canonical form, with any host bits masked and a bare IP as a full length CIDR, so
+		// the update and the removal of a route match whichever form each of them uses.
+		cidr, err := ip.ParseCIDROrIP(msg.Dst)
+		if err != nil {
+			m.badInputs.record(wireguardBadInputCIDR, m.canonicalHostname(msg.DstNodeName), msg.Dst, err)
 			return
 		}
-		cidr := ip.MustParseCIDROrIP(msg.Dst)
-		if cidr != nil {
-			m.wireguardRouteTable.EndpointAllowedCIDRAdd(msg.DstNodeName, cidr)
+		if cidr.Version() != m.wireguardRouteTable.IPVersion() {
+			// The wireguard module only programs a single IP version, so a CIDR of the other version would never be
+			// routed over wireguard.
+			log.WithField("cidr", cidr).Warn("RouteUpdate CIDR is not the wireguard IP version, ignoring")
+			return
 		}
+		m.updateBlock(cidr, msg)
+		m.updateLocalPodCIDR(cidr, msg)
+		if !m.routeTypes[msg.Type] {
+			// The route is not routed over wireguard. If the route type has changed we may previously have added the
+			// CIDR, so make sure it is removed.
+			log.Debug("RouteUpdate is not a wireguard route type, ignoring")
+			m.removeCIDR(cidr)
+			return
+		}
+		route := wireguardRoute{nodeName: m.canonicalHostname(msg.DstNodeName), class: wireguard.RouteClassWorkload}
+		if class, ok := wireguardRouteClasses[msg.Type]; ok {
+			route.class = class
+		}
+		if existing, ok := m.cidrToRoute[cidr]; ok {
+			if existing == route {
+				log.Debug("RouteUpdate CIDR is unchanged")
+				return
+			}
+			// The CIDR has moved to a different node or route class. Remove before adding it back.
+			log.Debugf("RouteUpdate CIDR has moved from node %s (class %s)", existing.nodeName, existing.class)
+			m.removeCIDR(cidr)
+		}
+		m.wireguardRouteTable.EndpointAllowedCIDRAdd(route.nodeName, cidr, route.class)
+		m.cidrToRoute[cidr] = route
 	case *proto.RouteRemove:
 		log.WithField("msg", msg).Debug("RouteRemove update")
-		cidr := ip.MustParseCIDROrIP(msg.Dst)
-		if cidr != nil {
-			m.wireguardRouteTable.EndpointAllowedCIDRRemove(cidr)
-		} else {
-			log.Error("error parsing RouteRemove CIDR", msg.Dst)
+		cidr, err := ip.ParseCIDROrIP(msg.Dst)
+		if err == nil {
+			delete(m.blockToNodeName, cidr)
+			m.removeLocalPodCIDR(cidr)
+			m.removeCIDR(cidr)
+		} else if !m.badInputs.clearValue(wireguardBadInputCIDR, msg.Dst) {
+			// The removal of a route whose CIDR was already ignored as bad is expected, anything else is not.
+			log.WithError(err).Error("error parsing RouteRemove CIDR ", msg.Dst)
 		}
 	case *proto.WireguardEndpointUpdate:
 		log.WithField("msg", msg).Debug("WireguardEndpointUpdate update")
+		hostname := m.canonicalHostname(msg.Hostname)
 		key, err := wgtypes.ParseKey(msg.PublicKey)
 		if err != nil {
-			log.WithError(err).Errorf("error parsing wireguard public key %s for node %s", msg.PublicKey, msg.Hostname)
+			// Without a valid key the node is not wireguard capable, so remove rather than programming a zero key.
+			m.badInputs.record(wireguardBadInputPublicKey, hostname, msg.PublicKey, err)
+			m.wireguardRouteTable.EndpointWireguardRemove(hostname)
+			return
 		}
+		m.badInputs.clearNode(wireguardBadInputPublicKey, hostname)
 		ifaceAddr := ip.FromString(msg.InterfaceAddr)
 		if ifaceAddr == nil && msg.InterfaceAddr != "" {
 			// Unable to parse the wireguard interface address. We can still enable wireguard without this, so treat as
 			// an update with no interface address.
-			log.WithError(err).Errorf("error parsing wireguard interface address %s for node %s", msg.InterfaceAddr, msg.Hostname)
+			m.badInputs.record(wireguardBadInputInterfaceAddr, hostname, msg.InterfaceAddr,
+				errors.New("invalid IP address"))
+		} else {
+			m.badInputs.clearNode(wireguardBadInputInterfaceAddr, hostname)
 		}
-		m.wireguardRouteTable.EndpointWireguardUpdate(msg.Hostname, key, ifaceAddr)
+		m.wireguardRouteTable.EndpointWireguardUpdate(hostname, key, ifaceAddr, int(msg.ListeningPort))
+		if hostname == m.hostname && m.statusReporter != nil {
+			m.statusReporter.onStoredKeyChanged(key)
+		}
+		previousKey, deadline := m.previousKey(hostname, msg)
+		m.wireguardRouteTable.EndpointWireguardPreviousKey(hostname, previousKey, deadline)
+		m.wireguardRouteTable.EndpointWireguardReady(hostname, msg.Ready)
+		m.wireguardRouteTable.EndpointWireguardOptOut(hostname, msg.EncryptionOptOut)
 	case *proto.WireguardEndpointRemove:
 		log.WithField("msg", msg).Debug("WireguardEndpointRemove update")
-		m.wireguardRouteTable.EndpointWireguardRemove(msg.Hostname)
+		hostname := m.canonicalHostname(msg.Hostname)
+		m.wireguardRouteTable.EndpointWireguardRemove(hostname)
+		m.badInputs.clearNode(wireguardBadInputPublicKey, hostname)
+		m.badInputs.clearNode(wireguardBadInputPreviousPublicKey, hostname)
+		m.badInputs.clearNode(wireguardBadInputInterfaceAddr, hostname)
+		if hostname == m.hostname && m.statusReporter != nil {
+			m.statusReporter.onStoredKeyChanged(zeroKey)
+		}
+	case *proto.WireguardKeyConflict:
+		log.WithField("msg", msg).Debug("WireguardKeyConflict update")
+		m.onKeyConflict(msg)
+	case *proto.InSync:
+		// All of the peers have been received, so the peers adopted from a previous felix that are not confirmed by
+		// the datastore can be removed.
+		m.wireguardRouteTable.DatastoreInSync()
 	}
 }
 
+// onKeyConflict handles the report that the datastore holds a key for our host stored by another felix, rather than our
+// key. The conflict is recorded by the status reporter and our key is republished, so that the wireguard module is told
+// of the conflict by the status callback, and backs off publication of our key or adopts the stored key.
+func (m *wireguardManager) onKeyConflict(msg *proto.WireguardKeyConflict) {
+	if m.statusReporter == nil {
+		log.Debug("Wireguard key conflicts are not reported, ignoring")
+		return
+	}
+	publicKey, err := wgtypes.ParseKey(msg.PublicKey)
+	if err != nil {
+		log.WithError(err).WithField("key", msg.PublicKey).Error("Unable to parse our key in the key conflict, ignoring")
+		return
+	}
+	storedKey, err := wgtypes.ParseKey(msg.StoredPublicKey)
+	if err != nil {
+		// The stored key is also passed to the wireguard module as the key of our host, and so is recorded as a bad
+		// input from the WireguardEndpointUpdate.
+		log.WithError(err).WithField("key", msg.StoredPublicKey).Debug("Unable to parse the stored key, ignoring")
+		return
+	}
+	if m.statusReporter.onKeyConflict(publicKey, storedKey) {
+		m.wireguardRouteTable.RepublishKey()
+	}
+}
+
+// wireguardEnabledOverrides maps the values of the wireguard enabled override of our host to whether wireguard is
+// enabled, see wireguard.Wireguard.SetNodeOverrideEnabled. An empty value follows the felix configuration.
+var wireguardEnabledOverrides = map[string]bool{
+	"Enabled":  true,
+	"Disabled": false,
+}
+
+var errWireguardEnabledOverride = errors.New("expected Enabled, Disabled or no value")
+
+// updateEnabledOverride passes the override of whether wireguard is enabled on our host to the wireguard module once
+// it changes. A value that cannot be parsed is ignored, so the previous override is retained until it is corrected.
+func (m *wireguardManager) updateEnabledOverride(value string) {
+	if value == m.enabledOverride {
+		return
+	}
+	var override *bool
+	if value != "" {
+		enabled, ok := wireguardEnabledOverrides[value]
+		if !ok {
+			m.badInputs.record(wireguardBadInputEnabledOverride, m.hostname, value, errWireguardEnabledOverride)
+			return
+		}
+		override = &enabled
+	}
+	m.badInputs.clearNode(wireguardBadInputEnabledOverride, m.hostname)
+	log.WithField("override", value).Info("Wireguard enabled override of this host updated")
+	m.enabledOverride = value
+	m.wireguardRouteTable.SetNodeOverrideEnabled(override)
+}
+
+// previousKey returns the previous public key of a node in a key transition and the deadline of the transition, or a
+// zero key if the node is not in a key transition. A previous key that cannot be parsed is ignored, so the peer of
+// the previous key is simply not kept.
+func (m *wireguardManager) previousKey(hostname string, msg *proto.WireguardEndpointUpdate) (wgtypes.Key, time.Time) {
+	if msg.PreviousPublicKey == "" {
+		m.badInputs.clearNode(wireguardBadInputPreviousPublicKey, hostname)
+		return zeroKey, time.Time{}
+	}
+	key, err := wgtypes.ParseKey(msg.PreviousPublicKey)
+	if err != nil {
+		m.badInputs.record(wireguardBadInputPreviousPublicKey, hostname, msg.PreviousPublicKey, err)
+		return zeroKey, time.Time{}
+	}
+	m.badInputs.clearNode(wireguardBadInputPreviousPublicKey, hostname)
+	return key, time.Unix(msg.PreviousKeyDeadline, 0)
+}
+
+// removeCIDR removes the CIDR from the wireguard module if it was previously added.
+func (m *wireguardManager) removeCIDR(cidr ip.CIDR) {
+	existing, ok := m.cidrToRoute[cidr]
+	if !ok {
+		return
+	}
+	m.wireguardRouteTable.EndpointAllowedCIDRRemoveForNode(existing.nodeName, cidr)
+	delete(m.cidrToRoute, cidr)
+}
+
+// removeNodeCIDRs forgets the CIDRs of a removed node. The wireguard module removes the CIDRs along with the node, and
+// the RouteRemove for each CIDR may never be received, e.g. if it was missed across a restart.
+func (m *wireguardManager) removeNodeCIDRs(nodeName string) {
+	for cidr, route := range m.cidrToRoute {
+		if route.nodeName == nodeName {
+			delete(m.cidrToRoute, cidr)
+		}
+	}
+}
+
+// updateBlock records the node that an IPAM block is affine to. The calculation graph sends a workload route for each
+// IPAM block, and for each workload address that is borrowed from the block of another node, so the workload routes in
+// an IP pool that are not for a single address are the IPAM blocks.
+func (m *wireguardManager) updateBlock(cidr ip.CIDR, msg *proto.RouteUpdate) {
+	isWorkload := msg.Type == proto.RouteType_REMOTE_WORKLOAD || msg.Type == proto.RouteType_LOCAL_WORKLOAD
+	if isWorkload && msg.IpPoolType != proto.IPPoolType_NONE && !isSingleAddress(cidr) {
+		m.blockToNodeName[cidr] = m.canonicalHostname(msg.DstNodeName)
+	} else {
+		delete(m.blockToNodeName, cidr)
+	}
+}
+
+// updateLocalPodCIDR records whether a CIDR is a local pod CIDR, i.e. an IPAM block affine to our host or an address
+// borrowed by one of our workloads.
+func (m *wireguardManager) updateLocalPodCIDR(cidr ip.CIDR, msg *proto.RouteUpdate) {
+	isLocal := msg.Type == proto.RouteType_LOCAL_WORKLOAD && msg.IpPoolType != proto.IPPoolType_NONE &&
+		m.canonicalHostname(msg.DstNodeName) == m.hostname
+	if !isLocal {
+		m.removeLocalPodCIDR(cidr)
+	} else if !m.localPodCIDRs.Contains(cidr) {
+		m.localPodCIDRs.Add(cidr)
+		m.localPodCIDRsDirty = true
+	}
+}
+
+// removeLocalPodCIDR forgets a CIDR if it was a local pod CIDR.
+func (m *wireguardManager) removeLocalPodCIDR(cidr ip.CIDR) {
+	if m.localPodCIDRs.Contains(cidr) {
+		m.localPodCIDRs.Discard(cidr)
+		m.localPodCIDRsDirty = true
+	}
+}
+
+// verifyCIDR is the CIDR verifier of the wireguard module. A CIDR within the IPAM block of a different node is denied,
+// so that a node cannot claim part of the block of another node, unless the CIDR is a single address which may have been
+// borrowed from the block. Other CIDRs, e.g. the IPAM blocks themselves and host addresses, are allowed.
+func (m *wireguardManager) verifyCIDR(nodeName string, cidr ip.CIDR) bool {
+	for prefix := int(cidr.Prefix()) - 1; prefix >= 0; prefix-- {
+		block := ip.CIDRFromAddrAndPrefix(cidr.Addr(), prefix)
+		blockNodeName, ok := m.blockToNodeName[block]
+		if !ok {
+			continue
+		} else if blockNodeName == nodeName || isSingleAddress(cidr) {
+			return true
+		}
+		log.WithFields(log.Fields{
+			"cidr":          cidr,
+			"nodeName":      nodeName,
+			"block":         block,
+			"blockNodeName": blockNodeName,
+		}).Debug("CIDR is within the IPAM block of another node")
+		return false
+	}
+	return true
+}
+
+// removeConntrackFlows removes the conntrack entries of each address of a CIDR that is no longer routed to wireguard.
+// This is called from a background goroutine by the wireguard module.
+func (m *wireguardManager) removeConntrackFlows(cidr ip.CIDR) {
+	ipNet := cidr.ToIPNet()
+	ones, bits := ipNet.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits >= 31 || 1<<hostBits > maxWireguardConntrackCleanupAddrs {
+		log.WithField("cidr", cidr).Info("CIDR no longer routed to wireguard is too large to remove its conntrack entries")
+		return
+	}
+	addr := append(net.IP(nil), ipNet.IP...)
+	for i := 0; i < 1<<hostBits; i++ {
+		m.conntrack.RemoveConntrackFlows(cidr.Version(), append(net.IP(nil), addr...))
+		// Increment the address.
+		for j := len(addr) - 1; j >= 0; j-- {
+			addr[j]++
+			if addr[j] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// isSingleAddress returns true if the CIDR is a single /32 or /128 address.
+func isSingleAddress(cidr ip.CIDR) bool {
+	return len(cidr.Addr().AsNetIP())*8 == int(cidr.Prefix())
+}
+
 func (m *wireguardManager) CompleteDeferredWork() error {
-	// Dataplane programming is handled through the routetable interface.
+	if m.localPodCIDRsDirty {
+		// Send the local pod CIDRs once all of the route updates of the batch have been processed, so that the
+		// routing rules are not churned as the blocks are received.
+		cidrs := make([]ip.CIDR, 0, m.localPodCIDRs.Len())
+		m.localPodCIDRs.Iter(func(item interface{}) error {
+			cidrs = append(cidrs, item.(ip.CIDR))
+			return nil
+		})
+		m.wireguardRouteTable.SetRuleSourceCIDRs(cidrs)
+		m.localPodCIDRsDirty = false
+	}
+
+	// Remind of the datastore values that still cannot be parsed, which are otherwise only logged when first seen.
+	m.badInputs.remind()
+
+	// Dataplane programming is handled through the routetable interface. If the resyncs keep finding that the wireguard
+	// device does not match the expected configuration, rebuild the configuration from scratch on the next resync.
+	if m.fullRebuildAfterResyncs > 0 {
+		if resyncs := m.wireguardRouteTable.DiscrepantResyncs(); resyncs >= m.fullRebuildAfterResyncs {
+			log.WithField("discrepantResyncs", resyncs).Warn(
+				"Wireguard resyncs are not converging, queueing a full rebuild of the wireguard configuration")
+			m.wireguardRouteTable.QueueFullRebuild()
+		}
+	}
 	return nil
 }
 
 func (m *wireguardManager) GetRouteTableSyncers() []routeTableSyncer {
-	return []routeTableSyncer{m.wireguardRouteTable}
+	// The wireguard module applies its routing tables as part of its own Apply, but also return a syncer for each of
+	// the routing tables so that each table is synced independently by the dataplane.
+	rts := []routeTableSyncer{m.wireguardRouteTable}
+	for _, rt := range m.wireguardRouteTable.RouteTableSyncers() {
+		rts = append(rts, rt)
+	}
+	return rts
+}
+
+// OnStop is called when felix stops. The wireguard configuration is torn down if configured to do so, otherwise it is
+// left in place for the next felix to take over.
+func (m *wireguardManager) OnStop() {
+	if m.teardownOnExit {
+		m.teardown("felix stopping")
+	}
+}
+
+// teardown removes the wireguard configuration from the dataplane. No further wireguard configuration is programmed.
+func (m *wireguardManager) teardown(reason string) {
+	log.WithField("reason", reason).Warn("Tearing down the wireguard configuration")
+	if err := m.wireguardRouteTable.Teardown(); err != nil {
+		log.WithError(err).Error("Failed to remove all of the wireguard configuration")
+	}
+}
+
+// Active returns true if wireguard is enabled and supported by the kernel, and so workload traffic to wireguard capable
+// peers is encapsulated.
+func (m *wireguardManager) Active() bool {
+	return m.wireguardRouteTable.Active()
+}
+
+// ReprobeAfter returns the time after which an apply is required to check again whether wireguard is supported, or zero
+// if no check is scheduled.
+func (m *wireguardManager) ReprobeAfter() time.Duration {
+	return m.wireguardRouteTable.ReprobeAfter()
+}
+
+// PublishRetryAfter returns the time after which an apply is required to publish the wireguard public key again after
+// a key conflict, or zero if no retry is scheduled.
+func (m *wireguardManager) PublishRetryAfter() time.Duration {
+	return m.wireguardRouteTable.PublishRetryAfter()
+}
+
+// DampingReleaseAfter returns the time after which an apply is required to program a CIDR whose moves between nodes
+// were damped, or zero if no CIDR is damped.
+func (m *wireguardManager) DampingReleaseAfter() time.Duration {
+	return m.wireguardRouteTable.DampingReleaseAfter()
+}
+
+// FailoverCheckAfter returns the time after which an apply is required to check whether a peer should fail over to the
+// secondary address of its node, or zero if no check is scheduled.
+func (m *wireguardManager) FailoverCheckAfter() time.Duration {
+	return m.wireguardRouteTable.FailoverCheckAfter()
+}
+
+// ProvisionalKeyExpiryAfter returns the time after which an apply is required to drop a public key carried over from
+// a removed node that has not been confirmed, or zero if no peer has a provisional key.
+func (m *wireguardManager) ProvisionalKeyExpiryAfter() time.Duration {
+	return m.wireguardRouteTable.ProvisionalKeyExpiryAfter()
+}
+
+// KeyTransitionCheckAfter returns the time after which an apply is required to check whether the peer of the previous
+// key of a node in a key transition can be removed, or zero if no node is in a key transition.
+func (m *wireguardManager) KeyTransitionCheckAfter() time.Duration {
+	return m.wireguardRouteTable.KeyTransitionCheckAfter()
+}
+
+// ResumeAfter returns the time after which an apply is required to resume the paused reconciliation of the wireguard
+// configuration, or zero if it is not paused.
+func (m *wireguardManager) ResumeAfter() time.Duration {
+	return m.wireguardRouteTable.ResumeAfter()
+}
+
+// PeerBatchFlushAfter returns the time after which an apply is required to program the wireguard peer updates held to
+// coalesce a burst of updates, or zero if no updates are held.
+func (m *wireguardManager) PeerBatchFlushAfter() time.Duration {
+	return m.wireguardRouteTable.PeerBatchFlushAfter()
+}
+
+// reportHealth reports the liveness of the wireguard Apply, which is not live once an Apply has been in progress, or
+// updates have been waiting for an Apply, for longer than the stall timeout, see wireguard.HealthSnapshot. This is
+// called whenever the dataplane reports its health, which may be from any goroutine.
+func (m *wireguardManager) reportHealth() {
+	if m.healthAggregator == nil {
+		return
+	}
+	snapshot := m.wireguardRouteTable.HealthSnapshot()
+	err := snapshot.Stalled(m.applyStallTimeout)
+	live := err == nil
+
+	m.healthLock.Lock()
+	if live != m.reportedLive {
+		if live {
+			log.Info("Wireguard apply is making progress again, reporting live")
+		} else {
+			log.WithError(err).WithFields(log.Fields{
+				"timeout":               m.applyStallTimeout,
+				"longestStatusCallback": snapshot.LongestStatusCallback,
+			}).Error("Wireguard apply has stalled, reporting not live")
+		}
+		m.reportedLive = live
+	}
+	m.healthLock.Unlock()
+
+	m.healthAggregator.Report(wireguardHealthName, &health.HealthReport{Live: live})
+}
+
+// Overhead returns the number of bytes added to each packet by wireguard encapsulation.
+func (m *wireguardManager) Overhead() int {
+	return m.wireguardRouteTable.Overhead()
+}
+
+// ServeHTTP returns the programmed local wireguard configuration as JSON. If the wireguard device is not programmed,
+// e.g. because wireguard is disabled or not supported, this returns a service unavailable status. The trace of the
+// operations is left out, as it is only served on the admin socket.
+func (m *wireguardManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := m.Status()
+	status.RecentOperations = nil
+	writeWireguardStatus(w, status)
+}
+
+// peerDiagnostics returns the JSON representation of the wireguard peer diagnostics, sorted by node name.
+func (m *wireguardManager) peerDiagnostics() []wireguardPeerDiagnostics {
+	var peers []wireguardPeerDiagnostics
+	for name, diag := range m.wireguardRouteTable.PeerDiagnostics() {
+		peer := wireguardPeerDiagnostics{
+			NodeName:           name,
+			PublicKey:          diag.PublicKey.String(),
+			HandshakeState:     string(diag.HandshakeState),
+			ReceiveBytes:       diag.ReceiveBytes,
+			TransmitBytes:      diag.TransmitBytes,
+			ProvisionalKeyFrom: diag.ProvisionalKeyFrom,
+		}
+		if diag.ConfiguredEndpoint != nil {
+			peer.ConfiguredEndpoint = diag.ConfiguredEndpoint.String()
+		}
+		if diag.KernelEndpoint != nil {
+			peer.KernelEndpoint = diag.KernelEndpoint.String()
+		}
+		if !diag.LastHandshakeTime.IsZero() {
+			lastHandshakeTime := diag.LastHandshakeTime
+			peer.LastHandshakeTime = &lastHandshakeTime
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].NodeName < peers[j].NodeName
+	})
+	return peers
+}
+
+// traceEntries returns the JSON representation of the trace of the wireguard operations, oldest first.
+func (m *wireguardManager) traceEntries() []wireguardTraceEntry {
+	var entries []wireguardTraceEntry
+	for _, entry := range m.wireguardRouteTable.DumpTrace() {
+		entries = append(entries, wireguardTraceEntry{
+			Seq:        entry.Seq,
+			Time:       entry.Time,
+			Op:         string(entry.Op),
+			CIDR:       entry.CIDR,
+			TableIndex: entry.TableIndex,
+			Priority:   entry.Priority,
+			PeerKey:    entry.PeerKey,
+			Detail:     entry.Detail,
+			Cause:      entry.Cause,
+			Error:      entry.Error,
+		})
+	}
+	return entries
+}
+
+// newWireguardPathReport returns the JSON representation of a path report.
+func newWireguardPathReport(report *wireguard.PathReport) *wireguardPathReport {
+	resp := &wireguardPathReport{
+		Destination: report.Destination.String(),
+		Verdict:     string(report.Verdict),
+		Reason:      report.Reason,
+		Peer:        report.Peer,
+		Diverged:    report.Diverged,
+	}
+	if report.Route != nil {
+		resp.Route = report.Route.String()
+		resp.TableIndex = report.TableIndex
+	}
+	if report.Peer != "" {
+		resp.PublicKey = report.PublicKey.String()
+	}
+	if report.Endpoint != nil {
+		resp.Endpoint = report.Endpoint.String()
+	}
+	for _, selector := range report.RuleSelectors {
+		resp.RuleSelectors = append(resp.RuleSelectors, string(selector))
+	}
+	if report.Desired != nil {
+		resp.Desired = newWireguardPathReport(report.Desired)
+	}
+	return resp
+}
+
+// newWireguardCoverageReport returns the JSON representation of a coverage report.
+func newWireguardCoverageReport(report wireguard.CoverageReport) *wireguardCoverageReport {
+	resp := &wireguardCoverageReport{
+		Active:      report.Active,
+		CIDRs:       report.CIDRs,
+		Tunneled:    report.Tunneled,
+		Percent:     report.Percent,
+		FallThrough: coverageReasonCounts(report.FallThrough),
+	}
+	for _, peer := range report.Peers {
+		resp.Peers = append(resp.Peers, admin.PeerCoverage{
+			NodeName:    peer.Name,
+			CIDRs:       peer.CIDRs,
+			Tunneled:    peer.Tunneled,
+			FallThrough: coverageReasonCounts(peer.FallThrough),
+		})
+	}
+	return resp
+}
+
+// coverageReasonCounts returns the JSON representation of the counts of the CIDRs by the reason they are not tunneled,
+// or nil if there are none.
+func coverageReasonCounts(counts map[wireguard.CoverageReason]int) map[string]int {
+	if len(counts) == 0 {
+		return nil
+	}
+	resp := map[string]int{}
+	for reason, n := range counts {
+		resp[string(reason)] = n
+	}
+	return resp
 }
@@ -0,0 +1,1832 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/health"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	mocknetlink "github.com/projectcalico/felix/netlink/mock"
+	"github.com/projectcalico/felix/proto"
+	mocktime "github.com/projectcalico/felix/time/mock"
+	"github.com/projectcalico/felix/wireguard"
+	"github.com/projectcalico/felix/wireguard/admin"
+)
+
+type mockWireguardRouteTable struct {
+	endpoints      map[string]ip.Addr
+	cidrToNodeName map[ip.CIDR]string
+	cidrToClass    map[ip.CIDR]wireguard.RouteClass
+	numAdds        int
+	numRemoves     int
+	publicKeys     map[string]wgtypes.Key
+	listeningPorts map[string]int
+	previousKeys   map[string]mockPreviousKey
+	localConfig    *wireguardLocalConfig
+	peerDiags      map[string]wireguard.PeerDiagnostics
+	drained        map[string]bool
+	ready          map[string]bool
+	optedOut       map[string]bool
+	active         bool
+	notSupported   bool
+	reprobeTime    time.Time
+	capabilities   wireguard.Capabilities
+	publishRetry   time.Duration
+	dampingRelease time.Duration
+	secondaries    map[string]ip.Addr
+	failoverCheck  time.Duration
+	paused         bool
+	resumeAfter    time.Duration
+	batchFlush     time.Duration
+	verifier       wireguard.CIDRVerifier
+	cleaner        wireguard.ConntrackCleaner
+	capacityStats  wireguard.CapacityStatsCallback
+	override       *bool
+	numOverrides   int
+	enabled        bool
+	enabledSource  wireguard.EnabledSource
+	canonicalizer  wireguard.NodeNameCanonicalizer
+	ruleSources    []ip.CIDR
+	numRuleSources int
+	inSync         bool
+
+	discrepantResyncs  int
+	keyDriftsCorrected int
+	numFullRebuilds    int
+	numResyncs         int
+	numRepublishes     int
+	numApplyRequests   int
+	numTeardowns       int
+	healthSnapshot     wireguard.HealthSnapshot
+
+	provisionalKeyExpiry time.Duration
+	keyTransitionCheck   time.Duration
+
+	whatIfReport *wireguard.PathReport
+	whatIfErr    error
+	whatIfDsts   []ip.Addr
+
+	coverageReport wireguard.CoverageReport
+
+	trace []wireguard.TraceEntry
+}
+
+// mockPreviousKey is the previous key of a node in a key transition, and the deadline of the transition.
+type mockPreviousKey struct {
+	key      wgtypes.Key
+	deadline time.Time
+}
+
+func newMockWireguardRouteTable() *mockWireguardRouteTable {
+	return &mockWireguardRouteTable{
+		endpoints:      map[string]ip.Addr{},
+		cidrToNodeName: map[ip.CIDR]string{},
+		cidrToClass:    map[ip.CIDR]wireguard.RouteClass{},
+		publicKeys:     map[string]wgtypes.Key{},
+		listeningPorts: map[string]int{},
+		previousKeys:   map[string]mockPreviousKey{},
+		drained:        map[string]bool{},
+		ready:          map[string]bool{},
+		optedOut:       map[string]bool{},
+		secondaries:    map[string]ip.Addr{},
+	}
+}
+
+func (m *mockWireguardRouteTable) OnIfaceStateChanged(string, ifacemonitor.State) {}
+
+func (m *mockWireguardRouteTable) QueueResync() {
+	m.numResyncs++
+}
+
+func (m *mockWireguardRouteTable) Apply() error {
+	return nil
+}
+
+func (m *mockWireguardRouteTable) EndpointUpdate(name string, ipv4Addr ip.Addr) {
+	m.endpoints[name] = ipv4Addr
+}
+
+func (m *mockWireguardRouteTable) EndpointRemove(name string) {
+	delete(m.endpoints, name)
+	// The CIDRs of the node are removed along with the node.
+	for cidr, nodeName := range m.cidrToNodeName {
+		if nodeName == name {
+			delete(m.cidrToNodeName, cidr)
+			delete(m.cidrToClass, cidr)
+		}
+	}
+}
+
+func (m *mockWireguardRouteTable) EndpointAllowedCIDRAdd(name string, cidr ip.CIDR, class ...wireguard.RouteClass) {
+	Expect(m.cidrToNodeName).NotTo(HaveKey(cidr), "CIDR added without first being removed")
+	Expect(class).To(HaveLen(1), "CIDR added without a route class")
+	m.cidrToNodeName[cidr] = name
+	m.cidrToClass[cidr] = class[0]
+	m.numAdds++
+}
+
+func (m *mockWireguardRouteTable) EndpointAllowedCIDRRemove(cidr ip.CIDR) {
+	Expect(m.cidrToNodeName).To(HaveKey(cidr), "CIDR removed without first being added")
+	delete(m.cidrToNodeName, cidr)
+	delete(m.cidrToClass, cidr)
+	m.numRemoves++
+}
+
+func (m *mockWireguardRouteTable) EndpointAllowedCIDRRemoveForNode(name string, cidr ip.CIDR) {
+	Expect(m.cidrToNodeName).To(HaveKeyWithValue(cidr, name), "CIDR removed for a node that does not own it")
+	m.EndpointAllowedCIDRRemove(cidr)
+}
+
+func (m *mockWireguardRouteTable) EndpointWireguardUpdate(
+	name string, publicKey wgtypes.Key, ipv4InterfaceAddr ip.Addr, listeningPort ...int,
+) {
+	m.publicKeys[name] = publicKey
+	if len(listeningPort) > 0 && listeningPort[0] != 0 {
+		m.listeningPorts[name] = listeningPort[0]
+	} else {
+		delete(m.listeningPorts, name)
+	}
+}
+
+func (m *mockWireguardRouteTable) EndpointWireguardPreviousKey(name string, key wgtypes.Key, deadline time.Time) {
+	Expect(m.publicKeys).To(HaveKey(name), "Previous key set without a public key")
+	if key == zeroKey {
+		delete(m.previousKeys, name)
+		return
+	}
+	m.previousKeys[name] = mockPreviousKey{key: key, deadline: deadline}
+}
+
+func (m *mockWireguardRouteTable) EndpointWireguardRemove(name string) {
+	delete(m.publicKeys, name)
+	delete(m.listeningPorts, name)
+	delete(m.previousKeys, name)
+	delete(m.ready, name)
+	delete(m.optedOut, name)
+}
+
+func (m *mockWireguardRouteTable) EndpointWireguardReady(name string, ready bool) {
+	Expect(m.publicKeys).To(HaveKey(name), "Ready status set without a public key")
+	m.ready[name] = ready
+}
+
+func (m *mockWireguardRouteTable) EndpointWireguardOptOut(name string, optOut bool) {
+	Expect(m.publicKeys).To(HaveKey(name), "Opt-out set without a public key")
+	m.optedOut[name] = optOut
+}
+
+func (m *mockWireguardRouteTable) EndpointDrain(name string) {
+	m.drained[name] = true
+}
+
+func (m *mockWireguardRouteTable) EndpointUndrain(name string) {
+	delete(m.drained, name)
+}
+
+func (m *mockWireguardRouteTable) SetCIDRVerifier(verifier wireguard.CIDRVerifier) {
+	m.verifier = verifier
+}
+
+func (m *mockWireguardRouteTable) SetConntrackCleaner(cleaner wireguard.ConntrackCleaner) {
+	m.cleaner = cleaner
+}
+
+func (m *mockWireguardRouteTable) SetCapacityStatsCallback(callback wireguard.CapacityStatsCallback) {
+	m.capacityStats = callback
+}
+
+func (m *mockWireguardRouteTable) SetNodeOverrideEnabled(enabled *bool) {
+	m.override = enabled
+	m.numOverrides++
+}
+
+func (m *mockWireguardRouteTable) Enabled() (bool, wireguard.EnabledSource) {
+	return m.enabled, m.enabledSource
+}
+
+func (m *mockWireguardRouteTable) SetNodeNameCanonicalizer(canonicalizer wireguard.NodeNameCanonicalizer) {
+	m.canonicalizer = canonicalizer
+}
+
+func (m *mockWireguardRouteTable) SetRuleSourceCIDRs(cidrs []ip.CIDR) {
+	m.ruleSources = cidrs
+	m.numRuleSources++
+}
+
+func (m *mockWireguardRouteTable) DatastoreInSync() {
+	m.inSync = true
+}
+
+func (m *mockWireguardRouteTable) RouteTableSyncers() []*wireguard.RouteTableSyncer {
+	return nil
+}
+
+func (m *mockWireguardRouteTable) QueueFullRebuild() {
+	m.discrepantResyncs = 0
+	m.numFullRebuilds++
+}
+
+func (m *mockWireguardRouteTable) RepublishKey() {
+	m.numRepublishes++
+}
+
+func (m *mockWireguardRouteTable) RequestApply() {
+	m.numApplyRequests++
+}
+
+func (m *mockWireguardRouteTable) DiscrepantResyncs() int {
+	return m.discrepantResyncs
+}
+
+func (m *mockWireguardRouteTable) KeyDriftsCorrected() int {
+	return m.keyDriftsCorrected
+}
+
+func (m *mockWireguardRouteTable) PeerDiagnostics() map[string]wireguard.PeerDiagnostics {
+	return m.peerDiags
+}
+
+func (m *mockWireguardRouteTable) OptedOutNodes() []string {
+	var names []string
+	for name, optedOut := range m.optedOut {
+		if optedOut {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *mockWireguardRouteTable) Mode() wireguard.Mode {
+	if m.localConfig == nil {
+		return wireguard.ModeKernel
+	}
+	return wireguard.Mode(m.localConfig.Mode)
+}
+
+func (m *mockWireguardRouteTable) Capabilities() wireguard.Capabilities {
+	return m.capabilities
+}
+
+func (m *mockWireguardRouteTable) NotSupported() (bool, time.Time) {
+	return m.notSupported, m.reprobeTime
+}
+
+func (m *mockWireguardRouteTable) ReprobeAfter() time.Duration {
+	if !m.notSupported || m.reprobeTime.IsZero() {
+		return 0
+	}
+	return time.Until(m.reprobeTime)
+}
+
+func (m *mockWireguardRouteTable) PublishRetryAfter() time.Duration {
+	return m.publishRetry
+}
+
+func (m *mockWireguardRouteTable) DampingReleaseAfter() time.Duration {
+	return m.dampingRelease
+}
+
+func (m *mockWireguardRouteTable) EndpointSecondaryUpdate(name string, ipv4Addr ip.Addr) {
+	if ipv4Addr == nil {
+		delete(m.secondaries, name)
+	} else {
+		m.secondaries[name] = ipv4Addr
+	}
+}
+
+func (m *mockWireguardRouteTable) FailoverCheckAfter() time.Duration {
+	return m.failoverCheck
+}
+
+func (m *mockWireguardRouteTable) ProvisionalKeyExpiryAfter() time.Duration {
+	return m.provisionalKeyExpiry
+}
+
+func (m *mockWireguardRouteTable) KeyTransitionCheckAfter() time.Duration {
+	return m.keyTransitionCheck
+}
+
+func (m *mockWireguardRouteTable) QueueWhatIf(dst ip.Addr, callback func(*wireguard.PathReport, error)) {
+	m.whatIfDsts = append(m.whatIfDsts, dst)
+	callback(m.whatIfReport, m.whatIfErr)
+}
+
+func (m *mockWireguardRouteTable) QueueCoverageReport(callback func(wireguard.CoverageReport)) {
+	callback(m.coverageReport)
+}
+
+func (m *mockWireguardRouteTable) Pause() {
+	m.paused = true
+}
+
+func (m *mockWireguardRouteTable) Resume() {
+	m.paused = false
+}
+
+func (m *mockWireguardRouteTable) ResumeAfter() time.Duration {
+	return m.resumeAfter
+}
+
+func (m *mockWireguardRouteTable) PeerBatchFlushAfter() time.Duration {
+	return m.batchFlush
+}
+
+func (m *mockWireguardRouteTable) Active() bool {
+	return m.active
+}
+
+func (m *mockWireguardRouteTable) IPVersion() uint8 {
+	return 4
+}
+
+func (m *mockWireguardRouteTable) Overhead() int {
+	return wireguard.OverheadForIPVersion(4)
+}
+
+func (m *mockWireguardRouteTable) HealthSnapshot() wireguard.HealthSnapshot {
+	return m.healthSnapshot
+}
+
+func (m *mockWireguardRouteTable) DumpTrace() []wireguard.TraceEntry {
+	return m.trace
+}
+
+func (m *mockWireguardRouteTable) Teardown() error {
+	m.numTeardowns++
+	return nil
+}
+
+func (m *mockWireguardRouteTable) LocalConfig() (publicKey wgtypes.Key, port int, ifaceName string, ok bool) {
+	if m.localConfig == nil {
+		return
+	}
+	publicKey, err := wgtypes.ParseKey(m.localConfig.PublicKey)
+	Expect(err).NotTo(HaveOccurred())
+	return publicKey, m.localConfig.ListeningPort, m.localConfig.InterfaceName, true
+}
+
+var _ = Describe("Wireguard manager", func() {
+	var (
+		rt      *mockWireguardRouteTable
+		manager *wireguardManager
+	)
+
+	clusterIPCIDR := ip.MustParseCIDROrIP("10.96.0.0/24")
+
+	Context("with only remote workload routes", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{})
+		})
+
+		It("should add remote workload routes", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{
+				ip.MustParseCIDROrIP("192.168.0.0/26"): "node1",
+			}))
+			Expect(rt.cidrToClass).To(Equal(map[ip.CIDR]wireguard.RouteClass{
+				ip.MustParseCIDROrIP("192.168.0.0/26"): wireguard.RouteClassWorkload,
+			}))
+		})
+
+		It("should match the route updates and removals in canonical and non-canonical form", func() {
+			for _, forms := range [][2]string{
+				{"10.0.5.7/24", "10.0.5.0/24"},
+				{"10.0.5.0/24", "10.0.5.7/24"},
+				{"10.0.5.7", "10.0.5.7/32"},
+				{"10.0.5.7/32", "10.0.5.7"},
+			} {
+				manager.OnUpdate(&proto.RouteUpdate{
+					Type:        proto.RouteType_REMOTE_WORKLOAD,
+					Dst:         forms[0],
+					DstNodeName: "node1",
+				})
+				Expect(rt.cidrToNodeName).To(HaveLen(1), "route %s not added", forms[0])
+				Expect(rt.cidrToNodeName).To(HaveKey(ip.MustParseCIDROrIP(forms[1])))
+
+				manager.OnUpdate(&proto.RouteRemove{Dst: forms[1]})
+				Expect(rt.cidrToNodeName).To(BeEmpty(), "route %s not removed by %s", forms[0], forms[1])
+				Expect(manager.cidrToRoute).To(BeEmpty())
+			}
+		})
+
+		It("should forget the CIDRs of a removed node", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "192.168.1.0/26",
+				DstNodeName: "node2",
+			})
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "node1"})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{
+				ip.MustParseCIDROrIP("192.168.1.0/26"): "node2",
+			}))
+
+			// The RouteRemove for the CIDR of the removed node is ignored, and the CIDR is added again if the node is
+			// added back.
+			manager.OnUpdate(&proto.RouteRemove{Dst: "192.168.0.0/26"})
+			Expect(rt.numRemoves).To(BeZero())
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(HaveKeyWithValue(ip.MustParseCIDROrIP("192.168.0.0/26"), "node1"))
+			Expect(rt.numAdds).To(Equal(3))
+		})
+
+		It("should remove the wireguard endpoint if the public key is not valid", func() {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+			})
+			Expect(rt.publicKeys).To(Equal(map[string]wgtypes.Key{"node1": key.PublicKey()}))
+
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: "not-a-key",
+			})
+			Expect(rt.publicKeys).To(BeEmpty())
+		})
+
+		It("should pass through the ready status of the wireguard endpoint", func() {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+			})
+			Expect(rt.ready).To(Equal(map[string]bool{"node1": false}))
+
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+				Ready:     true,
+			})
+			Expect(rt.ready).To(Equal(map[string]bool{"node1": true}))
+
+			manager.OnUpdate(&proto.WireguardEndpointRemove{
+				Hostname: "node1",
+			})
+			Expect(rt.ready).To(BeEmpty())
+		})
+
+		It("should pass through the encryption opt-out of the wireguard endpoint", func() {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+			})
+			Expect(rt.optedOut).To(Equal(map[string]bool{"node1": false}))
+
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:         "node1",
+				PublicKey:        key.PublicKey().String(),
+				EncryptionOptOut: true,
+			})
+			Expect(rt.optedOut).To(Equal(map[string]bool{"node1": true}))
+
+			manager.OnUpdate(&proto.WireguardEndpointRemove{
+				Hostname: "node1",
+			})
+			Expect(rt.optedOut).To(BeEmpty())
+		})
+
+		It("should pass through the listening port of the wireguard endpoint", func() {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:      "node1",
+				PublicKey:     key.PublicKey().String(),
+				ListeningPort: 51821,
+			})
+			Expect(rt.listeningPorts).To(Equal(map[string]int{"node1": 51821}))
+
+			// An update without a port reverts to the locally configured port.
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+			})
+			Expect(rt.listeningPorts).To(BeEmpty())
+		})
+
+		It("should pass through the previous key of a wireguard endpoint in a key transition", func() {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			prevKey, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:            "node1",
+				PublicKey:           key.PublicKey().String(),
+				PreviousPublicKey:   prevKey.PublicKey().String(),
+				PreviousKeyDeadline: 1600000000,
+			})
+			Expect(rt.previousKeys).To(Equal(map[string]mockPreviousKey{
+				"node1": {key: prevKey.PublicKey(), deadline: time.Unix(1600000000, 0)},
+			}))
+
+			// An update without a previous key ends the transition.
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname:  "node1",
+				PublicKey: key.PublicKey().String(),
+			})
+			Expect(rt.previousKeys).To(BeEmpty())
+		})
+
+		It("should pass through the secondary address of the host", func() {
+			manager.OnUpdate(&proto.HostMetadataUpdate{
+				Hostname:          "node1",
+				Ipv4Addr:          "10.0.0.1",
+				Ipv4SecondaryAddr: "10.1.0.1",
+			})
+			Expect(rt.secondaries).To(Equal(map[string]ip.Addr{"node1": ip.FromString("10.1.0.1")}))
+
+			// An update without a secondary address removes it.
+			manager.OnUpdate(&proto.HostMetadataUpdate{
+				Hostname: "node1",
+				Ipv4Addr: "10.0.0.1",
+			})
+			Expect(rt.secondaries).To(BeEmpty())
+		})
+
+		It("should serve the local wireguard configuration", func() {
+			get := func() (int, wireguardLocalConfig) {
+				rec := httptest.NewRecorder()
+				manager.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, wireguardHTTPPath, nil))
+				Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+				var resp wireguardLocalConfig
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				return rec.Code, resp
+			}
+
+			By("querying before the device is programmed")
+			code, resp := get()
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp).To(Equal(wireguardLocalConfig{}))
+
+			By("querying once the device is programmed")
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			rt.localConfig = &wireguardLocalConfig{
+				Programmed:    true,
+				PublicKey:     key.PublicKey().String(),
+				ListeningPort: 51820,
+				InterfaceName: "wireguard.cali",
+				Mode:          "userspace",
+			}
+			code, resp = get()
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp).To(Equal(*rt.localConfig))
+
+			By("including the number of key drifts corrected")
+			rt.keyDriftsCorrected = 2
+			code, resp = get()
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.KeyDriftsCorrected).To(Equal(2))
+
+			By("including the peer diagnostics sorted by node name")
+			handshake := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			rt.peerDiags = map[string]wireguard.PeerDiagnostics{
+				"node2": {
+					PublicKey:          key.PublicKey(),
+					ConfiguredEndpoint: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 51820},
+					HandshakeState:     wireguard.HandshakeStateNone,
+					ProvisionalKeyFrom: "node0",
+				},
+				"node1": {
+					PublicKey:          key.PublicKey(),
+					ConfiguredEndpoint: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51820},
+					KernelEndpoint:     &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234},
+					LastHandshakeTime:  handshake,
+					HandshakeState:     wireguard.HandshakeStateStale,
+					ReceiveBytes:       1000,
+					TransmitBytes:      2000,
+				},
+			}
+			code, resp = get()
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.Peers).To(Equal([]wireguardPeerDiagnostics{
+				{
+					NodeName:           "node1",
+					PublicKey:          key.PublicKey().String(),
+					ConfiguredEndpoint: "10.0.0.1:51820",
+					KernelEndpoint:     "192.168.0.1:1234",
+					LastHandshakeTime:  &handshake,
+					HandshakeState:     "stale",
+					ReceiveBytes:       1000,
+					TransmitBytes:      2000,
+				},
+				{
+					NodeName:           "node2",
+					PublicKey:          key.PublicKey().String(),
+					ConfiguredEndpoint: "10.0.0.2:51820",
+					HandshakeState:     "none",
+					ProvisionalKeyFrom: "node0",
+				},
+			}))
+
+			By("including the nodes excluded from encryption by policy")
+			rt.publicKeys["node3"] = key.PublicKey()
+			rt.optedOut["node3"] = true
+			code, resp = get()
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.ExcludedByPolicy).To(Equal([]string{"node3"}))
+		})
+
+		It("should serve the capabilities of the wireguard device once probed", func() {
+			get := func() wireguardLocalConfig {
+				rec := httptest.NewRecorder()
+				manager.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, wireguardHTTPPath, nil))
+				var resp wireguardLocalConfig
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				return resp
+			}
+			Expect(get().Capabilities).To(BeNil())
+
+			rt.capabilities = wireguard.Capabilities{
+				Probed:                        true,
+				KernelVersion:                 "4.19.0",
+				ConfigurationPath:             wireguard.ConfigurationPathNetlink,
+				CompatModule:                  true,
+				PresharedKeys:                 true,
+				KeepaliveGranularity:          time.Second,
+				MaxKeepalive:                  65535 * time.Second,
+				MaxAllowedIPsPerConfiguration: 500,
+			}
+			Expect(get().Capabilities).To(Equal(&wireguardCapabilities{
+				KernelVersion:                 "4.19.0",
+				ConfigurationPath:             "netlink",
+				CompatModule:                  true,
+				PresharedKeys:                 true,
+				KeepaliveGranularity:          "1s",
+				MaxKeepalive:                  "18h12m15s",
+				MaxAllowedIPsPerConfiguration: 500,
+			}))
+		})
+
+		It("should report that wireguard is not supported", func() {
+			rt.notSupported = true
+			rt.reprobeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			rec := httptest.NewRecorder()
+			manager.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, wireguardHTTPPath, nil))
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			var resp wireguardLocalConfig
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.NotSupported).To(BeTrue())
+			Expect(resp.NextReprobe).NotTo(BeNil())
+			Expect(resp.NextReprobe.Equal(rt.reprobeTime)).To(BeTrue())
+
+			By("reprobing at the scheduled time")
+			rt.reprobeTime = time.Now().Add(time.Minute)
+			Expect(manager.ReprobeAfter()).To(BeNumerically("~", time.Minute, time.Second))
+			rt.notSupported = false
+			Expect(manager.ReprobeAfter()).To(BeZero())
+		})
+
+		It("should drain and undrain a peer", func() {
+			drain := func(method, target string) int {
+				rec := httptest.NewRecorder()
+				serveWireguardDrain(manager, rec, httptest.NewRequest(method, target, nil))
+				return rec.Code
+			}
+
+			Expect(drain(http.MethodPost, admin.PathDrain+"?node=node1")).To(Equal(http.StatusAccepted))
+			Expect(rt.drained).To(Equal(map[string]bool{"node1": true}))
+
+			Expect(drain(http.MethodDelete, admin.PathDrain+"?node=node1")).To(Equal(http.StatusAccepted))
+			Expect(rt.drained).To(BeEmpty())
+
+			By("rejecting invalid requests")
+			Expect(drain(http.MethodPost, admin.PathDrain)).To(Equal(http.StatusBadRequest))
+			Expect(drain(http.MethodGet, admin.PathDrain+"?node=node1")).To(Equal(http.StatusMethodNotAllowed))
+			Expect(rt.drained).To(BeEmpty())
+		})
+
+		It("should pause and resume the reconciliation", func() {
+			manager.Pause()
+			Expect(rt.paused).To(BeTrue())
+
+			By("resuming at the scheduled time")
+			rt.resumeAfter = time.Minute
+			Expect(manager.ResumeAfter()).To(Equal(time.Minute))
+
+			manager.Resume()
+			Expect(rt.paused).To(BeFalse())
+		})
+
+		It("should report the path to a destination", func() {
+			whatIf := func(method, target string) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				serveWireguardWhatIf(manager, rec, httptest.NewRequest(method, target, nil))
+				return rec
+			}
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			rt.whatIfReport = &wireguard.PathReport{
+				Destination:   ip.FromString("10.42.7.9"),
+				Verdict:       wireguard.PathVerdictEncrypted,
+				Route:         ip.MustParseCIDROrIP("10.42.7.0/24"),
+				TableIndex:    1,
+				Peer:          "node1",
+				PublicKey:     key.PublicKey(),
+				Endpoint:      &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51820},
+				RuleSelectors: []wireguard.RuleSelector{wireguard.RuleSelectorFwmark},
+				Diverged:      true,
+				Desired: &wireguard.PathReport{
+					Destination: ip.FromString("10.42.7.9"),
+					Verdict:     wireguard.PathVerdictFallThrough,
+					Reason:      "no route in the wireguard routing tables",
+				},
+			}
+
+			rec := whatIf(http.MethodGet, admin.PathWhatIf+"?dst=10.42.7.9")
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rt.whatIfDsts).To(Equal([]ip.Addr{ip.FromString("10.42.7.9")}))
+			var resp wireguardPathReport
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp).To(Equal(wireguardPathReport{
+				Destination:   "10.42.7.9",
+				Verdict:       "Encrypted",
+				Route:         "10.42.7.0/24",
+				TableIndex:    1,
+				Peer:          "node1",
+				PublicKey:     key.PublicKey().String(),
+				Endpoint:      "10.0.0.1:51820",
+				RuleSelectors: []string{"fwmark"},
+				Diverged:      true,
+				Desired: &wireguardPathReport{
+					Destination: "10.42.7.9",
+					Verdict:     "FallThrough",
+					Reason:      "no route in the wireguard routing tables",
+				},
+			}))
+
+			By("rejecting invalid requests")
+			Expect(whatIf(http.MethodGet, admin.PathWhatIf).Code).To(Equal(http.StatusBadRequest))
+			Expect(whatIf(http.MethodPost, admin.PathWhatIf+"?dst=10.42.7.9").Code).To(
+				Equal(http.StatusMethodNotAllowed))
+			rt.whatIfErr = errors.New("destination 2001:db8::1 is not IPv4")
+			Expect(whatIf(http.MethodGet, admin.PathWhatIf+"?dst=2001:db8::1").Code).To(
+				Equal(http.StatusBadRequest))
+		})
+
+		It("should report the encryption coverage", func() {
+			coverage := func(method string) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				serveWireguardCoverage(manager, rec, httptest.NewRequest(method, admin.PathCoverage, nil))
+				return rec
+			}
+			rt.coverageReport = wireguard.CoverageReport{
+				Active:   true,
+				CIDRs:    3,
+				Tunneled: 1,
+				Percent:  100.0 / 3,
+				FallThrough: map[wireguard.CoverageReason]int{
+					wireguard.CoverageReasonNoKey:    1,
+					wireguard.CoverageReasonExcluded: 1,
+				},
+				Peers: []wireguard.PeerCoverage{
+					{Name: "node1", CIDRs: 2, Tunneled: 1, FallThrough: map[wireguard.CoverageReason]int{
+						wireguard.CoverageReasonExcluded: 1,
+					}},
+					{Name: "node2", CIDRs: 1, FallThrough: map[wireguard.CoverageReason]int{
+						wireguard.CoverageReasonNoKey: 1,
+					}},
+				},
+			}
+
+			rec := coverage(http.MethodGet)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var resp wireguardCoverageReport
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp).To(Equal(wireguardCoverageReport{
+				Active:      true,
+				CIDRs:       3,
+				Tunneled:    1,
+				Percent:     100.0 / 3,
+				FallThrough: map[string]int{"NoKey": 1, "Excluded": 1},
+				Peers: []admin.PeerCoverage{
+					{NodeName: "node1", CIDRs: 2, Tunneled: 1, FallThrough: map[string]int{"Excluded": 1}},
+					{NodeName: "node2", CIDRs: 1, FallThrough: map[string]int{"NoKey": 1}},
+				},
+			}))
+
+			By("rejecting invalid requests")
+			Expect(coverage(http.MethodPost).Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+
+		It("should return the trace of the wireguard operations", func() {
+			By("returning an empty trace when the trace is not enabled")
+			Expect(manager.Dump().Trace).To(Equal([]wireguardTraceEntry{}))
+
+			now := time.Now().UTC()
+			for i := 1; i <= wireguardTraceDumpEntries+5; i++ {
+				rt.trace = append(rt.trace, wireguard.TraceEntry{
+					Seq:        uint64(i),
+					Time:       now,
+					Op:         wireguard.TraceOpRouteAdd,
+					CIDR:       "10.42.7.0/24",
+					TableIndex: 1,
+					Cause:      "CIDR 10.42.7.0/24 moved from node node1 to node node2",
+					Error:      "file exists",
+				})
+			}
+			entries := manager.Dump().Trace
+			Expect(entries).To(HaveLen(wireguardTraceDumpEntries + 5))
+			Expect(entries[0]).To(Equal(wireguardTraceEntry{
+				Seq:        1,
+				Time:       now,
+				Op:         "route-add",
+				CIDR:       "10.42.7.0/24",
+				TableIndex: 1,
+				Cause:      "CIDR 10.42.7.0/24 moved from node node1 to node node2",
+				Error:      "file exists",
+			}))
+
+			By("including the most recent operations in the status of the admin interface")
+			rec := httptest.NewRecorder()
+			writeWireguardStatus(rec, manager.Status())
+			var resp wireguardLocalConfig
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.RecentOperations).To(HaveLen(wireguardTraceDumpEntries))
+			Expect(resp.RecentOperations[0].Seq).To(Equal(uint64(6)))
+
+			By("not including the operations in the local configuration served alongside the metrics")
+			rec = httptest.NewRecorder()
+			manager.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, wireguardHTTPPath, nil))
+			resp = wireguardLocalConfig{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.RecentOperations).To(BeEmpty())
+		})
+
+		It("should return the wireguard route table syncer", func() {
+			Expect(manager.GetRouteTableSyncers()).To(Equal([]routeTableSyncer{rt}))
+		})
+
+		It("should notify when the datastore is in sync", func() {
+			Expect(rt.inSync).To(BeFalse())
+			manager.OnUpdate(&proto.InSync{})
+			Expect(rt.inSync).To(BeTrue())
+		})
+
+		It("should ignore remote host routes", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+
+			manager.OnUpdate(&proto.RouteRemove{
+				Dst: clusterIPCIDR.String(),
+			})
+			Expect(rt.numRemoves).To(BeZero())
+		})
+
+		It("should ignore routes of the wrong IP version", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "dead:beef::/122",
+				DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{
+				ip.MustParseCIDROrIP("192.168.0.0/26"): "node1",
+			}))
+
+			manager.OnUpdate(&proto.RouteRemove{
+				Dst: "dead:beef::/122",
+			})
+			Expect(rt.numRemoves).To(BeZero())
+		})
+
+		It("should verify CIDRs against the IPAM block ownership", func() {
+			Expect(rt.verifier).NotTo(BeNil())
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_LOCAL_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         "192.168.1.0/26",
+				DstNodeName: "local-host",
+			})
+
+			// Part of the block of another node is denied, but a borrowed address is allowed.
+			Expect(rt.verifier("node1", ip.MustParseCIDROrIP("192.168.0.0/26"))).To(BeTrue())
+			Expect(rt.verifier("node1", ip.MustParseCIDROrIP("192.168.0.16/28"))).To(BeTrue())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("192.168.0.16/28"))).To(BeFalse())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("192.168.0.5/32"))).To(BeTrue())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("192.168.1.0/27"))).To(BeFalse())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("10.0.0.0/28"))).To(BeTrue())
+
+			// Routes that are not IPAM blocks, and removed blocks, are not used to verify CIDRs.
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         "10.0.0.0/24",
+				DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteRemove{Dst: "192.168.0.0/26"})
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("10.0.0.0/28"))).To(BeTrue())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("192.168.0.16/28"))).To(BeTrue())
+		})
+	})
+
+	Context("with remote host routes enabled", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{
+				WireguardAdditionalRouteTypes: []string{"RemoteHost"},
+			})
+		})
+
+		It("should add and remove a ClusterIP block", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{clusterIPCIDR: "node1"}))
+			Expect(rt.cidrToClass).To(Equal(map[ip.CIDR]wireguard.RouteClass{clusterIPCIDR: wireguard.RouteClassHost}))
+
+			By("sending the same update again")
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			Expect(rt.numAdds).To(Equal(1))
+
+			By("removing the route")
+			manager.OnUpdate(&proto.RouteRemove{
+				Dst: clusterIPCIDR.String(),
+			})
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+			Expect(rt.numRemoves).To(Equal(1))
+		})
+
+		It("should move a ClusterIP block when the node changes", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node2",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{clusterIPCIDR: "node2"}))
+			Expect(rt.numAdds).To(Equal(2))
+			Expect(rt.numRemoves).To(Equal(1))
+		})
+
+		It("should handle a ClusterIP block changing route type", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_HOST,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+
+			By("changing to a remote workload route on the same node")
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{clusterIPCIDR: "node1"}))
+			Expect(rt.cidrToClass).To(Equal(map[ip.CIDR]wireguard.RouteClass{clusterIPCIDR: wireguard.RouteClassWorkload}))
+			Expect(rt.numAdds).To(Equal(2))
+			Expect(rt.numRemoves).To(Equal(1))
+
+			By("changing to a route type that is not routed over wireguard")
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_CIDR_INFO,
+				Dst:         clusterIPCIDR.String(),
+				DstNodeName: "node1",
+			})
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+			Expect(rt.numRemoves).To(Equal(2))
+		})
+	})
+
+	Context("with local CIDRs as throw routes", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{
+				Hostname:  "local-host",
+				Wireguard: wireguard.Config{LocalCIDRsAsThrow: true},
+			})
+		})
+
+		It("should pass the local workload routes to the wireguard module", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_LOCAL_WORKLOAD,
+				Dst:         "192.168.1.0/26",
+				DstNodeName: "local-host",
+			})
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{
+				ip.MustParseCIDROrIP("192.168.1.0/26"): "local-host",
+			}))
+
+			manager.OnUpdate(&proto.RouteRemove{Dst: "192.168.1.0/26"})
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+		})
+	})
+
+	Context("with a full rebuild after discrepant resyncs", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{
+				WireguardFullRebuildAfterResyncs: 3,
+			})
+		})
+
+		It("should queue a full rebuild once the number of discrepant resyncs is reached", func() {
+			rt.discrepantResyncs = 2
+			Expect(manager.CompleteDeferredWork()).To(Succeed())
+			Expect(rt.numFullRebuilds).To(BeZero())
+
+			rt.discrepantResyncs = 3
+			Expect(manager.CompleteDeferredWork()).To(Succeed())
+			Expect(rt.numFullRebuilds).To(Equal(1))
+
+			By("not queueing another rebuild until the resyncs find discrepancies again")
+			Expect(manager.CompleteDeferredWork()).To(Succeed())
+			Expect(rt.numFullRebuilds).To(Equal(1))
+		})
+
+		It("should never queue a full rebuild if not configured", func() {
+			manager = newWireguardManager(rt, Config{})
+			rt.discrepantResyncs = 100
+			Expect(manager.CompleteDeferredWork()).To(Succeed())
+			Expect(rt.numFullRebuilds).To(BeZero())
+		})
+	})
+
+	Context("with the apply liveness reporter", func() {
+		var aggregator *health.HealthAggregator
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			aggregator = health.NewHealthAggregator()
+			manager = newWireguardManager(rt, Config{
+				Wireguard:                     wireguard.Config{Enabled: true},
+				WireguardApplyStallMultiplier: 6,
+				NetlinkTimeout:                10 * time.Second,
+				HealthAggregator:              aggregator,
+			})
+		})
+
+		It("should report not live while an apply is stalled, and live once it recovers", func() {
+			rt.healthSnapshot = wireguard.HealthSnapshot{
+				Time:                     start.Add(30 * time.Second),
+				LastApplyStart:           start,
+				ApplyInProgress:          true,
+				LastStatusCallbackStart:  start,
+				StatusCallbackInProgress: true,
+			}
+			manager.reportHealth()
+			Expect(aggregator.Summary().Live).To(BeTrue())
+
+			rt.healthSnapshot.Time = start.Add(61 * time.Second)
+			manager.reportHealth()
+			Expect(aggregator.Summary().Live).To(BeFalse())
+
+			rt.healthSnapshot = wireguard.HealthSnapshot{
+				Time:                  start.Add(62 * time.Second),
+				LastApplyStart:        start,
+				LastApplyEnd:          start.Add(62 * time.Second),
+				LastStatusCallbackEnd: start.Add(62 * time.Second),
+				LongestStatusCallback: 62 * time.Second,
+			}
+			manager.reportHealth()
+			Expect(aggregator.Summary().Live).To(BeTrue())
+		})
+
+		It("should report not live while updates are pending without an apply", func() {
+			rt.healthSnapshot = wireguard.HealthSnapshot{
+				Time:           start.Add(80 * time.Second),
+				LastApplyStart: start,
+				LastApplyEnd:   start,
+				PendingSince:   start.Add(30 * time.Second),
+			}
+			manager.reportHealth()
+			Expect(aggregator.Summary().Live).To(BeTrue())
+
+			rt.healthSnapshot.Time = start.Add(2 * time.Minute)
+			manager.reportHealth()
+			Expect(aggregator.Summary().Live).To(BeFalse())
+		})
+
+		It("should not report the liveness if not configured", func() {
+			manager = newWireguardManager(rt, Config{
+				Wireguard:        wireguard.Config{Enabled: true},
+				NetlinkTimeout:   10 * time.Second,
+				HealthAggregator: health.NewHealthAggregator(),
+			})
+			Expect(manager.healthAggregator).To(BeNil())
+			manager.reportHealth()
+		})
+	})
+
+	Context("with teardown", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{
+				Hostname:                "local-host",
+				WireguardTeardownOnExit: true,
+			})
+		})
+
+		It("should tear down wireguard when the local host is removed", func() {
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "node1"})
+			Expect(rt.numTeardowns).To(BeZero())
+
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "local-host"})
+			Expect(rt.numTeardowns).To(Equal(1))
+			Expect(manager.localHostRemoved).To(BeTrue())
+
+			By("leaving the configuration torn down if the local host is added back")
+			manager.OnUpdate(&proto.HostMetadataUpdate{Hostname: "local-host", Ipv4Addr: "10.0.0.1"})
+			Expect(rt.numTeardowns).To(Equal(1))
+			Expect(manager.localHostRemoved).To(BeTrue())
+		})
+
+		It("should tear down wireguard when stopping, only if configured", func() {
+			manager.OnStop()
+			Expect(rt.numTeardowns).To(Equal(1))
+
+			manager = newWireguardManager(rt, Config{Hostname: "local-host"})
+			manager.OnStop()
+			Expect(rt.numTeardowns).To(Equal(1))
+		})
+	})
+
+	Context("with capacity stats", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{})
+		})
+
+		It("should publish the capacity stats reported by the wireguard module", func() {
+			Expect(rt.capacityStats).NotTo(BeNil())
+			Expect(manager.capacityStatus()).To(BeNil())
+
+			rt.capacityStats(wireguard.CapacityStats{
+				ProgrammedPeers: 2,
+				AllowedIPs:      3,
+				UnicastRoutes:   3,
+				ThrowRoutes:     1,
+				PendingRoutes:   1,
+				TopPeers: []wireguard.PeerCapacity{
+					{Name: "node1", CIDRs: 2, AllowedIPs: 2},
+					{Name: "node2", CIDRs: 1, AllowedIPs: 1},
+				},
+			})
+			Expect(testutil.ToFloat64(gaugeWireguardCapacity.WithLabelValues("programmed-peers"))).To(Equal(2.0))
+			Expect(testutil.ToFloat64(gaugeWireguardCapacity.WithLabelValues("allowed-ips"))).To(Equal(3.0))
+			Expect(testutil.ToFloat64(gaugeWireguardCapacity.WithLabelValues("throw-routes"))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(gaugeWireguardCapacity.WithLabelValues("pending-routes"))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(gaugeWireguardMaxPeerCIDRs)).To(Equal(2.0))
+			Expect(manager.capacityStatus().TopPeers).To(Equal([]admin.PeerCapacity{
+				{NodeName: "node1", CIDRs: 2, AllowedIPs: 2},
+				{NodeName: "node2", CIDRs: 1, AllowedIPs: 1},
+			}))
+
+			rt.capacityStats(wireguard.CapacityStats{})
+			Expect(testutil.ToFloat64(gaugeWireguardCapacity.WithLabelValues("programmed-peers"))).To(BeZero())
+			Expect(testutil.ToFloat64(gaugeWireguardMaxPeerCIDRs)).To(BeZero())
+			Expect(manager.capacityStatus()).To(Equal(&admin.CapacityStats{}))
+		})
+	})
+
+	Context("with a node override of the enabled state", func() {
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{Hostname: "local-host"})
+		})
+
+		override := func(hostname, value string) {
+			manager.OnUpdate(&proto.HostMetadataUpdate{
+				Hostname: hostname, Ipv4Addr: "10.0.0.1", WireguardEnabledOverride: value,
+			})
+		}
+
+		// overridden returns the override last passed to the wireguard module.
+		overridden := func() string {
+			if rt.override == nil {
+				return "none"
+			} else if *rt.override {
+				return "enabled"
+			}
+			return "disabled"
+		}
+
+		It("should pass the override of our host to the wireguard module once changed", func() {
+			override("local-host", "")
+			override("node1", "Enabled")
+			Expect(rt.numOverrides).To(BeZero())
+
+			override("local-host", "Enabled")
+			Expect(rt.numOverrides).To(Equal(1))
+			Expect(overridden()).To(Equal("enabled"))
+			override("local-host", "Enabled")
+			Expect(rt.numOverrides).To(Equal(1))
+
+			override("local-host", "Disabled")
+			Expect(rt.numOverrides).To(Equal(2))
+			Expect(overridden()).To(Equal("disabled"))
+
+			override("local-host", "")
+			Expect(rt.numOverrides).To(Equal(3))
+			Expect(overridden()).To(Equal("none"))
+		})
+
+		It("should retain the previous override while the value cannot be parsed", func() {
+			override("local-host", "Disabled")
+			override("local-host", "Off")
+			Expect(rt.numOverrides).To(Equal(1))
+			Expect(overridden()).To(Equal("disabled"))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("enabled-override"))).To(Equal(1.0))
+
+			override("local-host", "Enabled")
+			Expect(rt.numOverrides).To(Equal(2))
+			Expect(overridden()).To(Equal("enabled"))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("enabled-override"))).To(BeZero())
+		})
+
+		It("should report the enabled state and its source", func() {
+			rt.enabled = true
+			rt.enabledSource = wireguard.EnabledSourceOverride
+			status := manager.Status()
+			Expect(status.Programmed).To(BeFalse())
+			Expect(status.Enabled).To(BeTrue())
+			Expect(status.EnabledSource).To(Equal("node-override"))
+		})
+	})
+
+	Context("with key conflicts reported by the status reporter", func() {
+		var fromDataplane chan interface{}
+		var reporter *wireguardStatusReporter
+		var ourKey, storedKey wgtypes.Key
+
+		generateKey := func() wgtypes.Key {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			return key.PublicKey()
+		}
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{Hostname: "local-host"})
+			fromDataplane = make(chan interface{}, 10)
+			reporter = newWireguardStatusReporter(fromDataplane)
+			manager.statusReporter = reporter
+			ourKey = generateKey()
+			storedKey = generateKey()
+		})
+
+		status := func(key wgtypes.Key) wireguard.StatusUpdate {
+			return wireguard.StatusUpdate{
+				PublicKey:     key,
+				ListeningPort: 1000,
+				InterfaceName: "wireguard.cali",
+				KeyState:      wireguard.KeyStatePublished,
+			}
+		}
+		conflict := func() {
+			manager.OnUpdate(&proto.WireguardKeyConflict{
+				PublicKey:       ourKey.String(),
+				StoredPublicKey: storedKey.String(),
+			})
+		}
+		storedKeyUpdate := func(key wgtypes.Key) {
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "local-host", PublicKey: key.String()})
+		}
+
+		It("should send the status until a conflict is reported", func() {
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(Succeed())
+			Expect(fromDataplane).To(Receive(Equal(&proto.WireguardStatusUpdate{
+				PublicKey:     ourKey.String(),
+				ListeningPort: 1000,
+				InterfaceName: "wireguard.cali",
+				KeyState:      "published",
+			})))
+
+			By("republishing our key once a conflict is reported")
+			conflict()
+			Expect(rt.numRepublishes).To(Equal(1))
+			conflict()
+			Expect(rt.numRepublishes).To(Equal(1))
+
+			By("returning the conflict from the status callback rather than sending the status")
+			err := reporter.OnStatusUpdate(status(ourKey))
+			var conflictErr *wireguard.KeyConflictError
+			Expect(errors.As(err, &conflictErr)).To(BeTrue())
+			Expect(conflictErr.StoredKey).To(Equal(storedKey))
+			Expect(fromDataplane).NotTo(Receive())
+
+			By("sending the status of a different key")
+			newKey := generateKey()
+			Expect(reporter.OnStatusUpdate(status(newKey))).To(Succeed())
+			Expect(fromDataplane).To(Receive())
+		})
+
+		It("should keep the conflict while the conflicting key is stored", func() {
+			conflict()
+			storedKeyUpdate(storedKey)
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: generateKey().String()})
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(HaveOccurred())
+		})
+
+		It("should clear the conflict once the stored key of our host changes", func() {
+			conflict()
+			storedKeyUpdate(storedKey)
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(HaveOccurred())
+			storedKeyUpdate(ourKey)
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(Succeed())
+			Expect(fromDataplane).To(Receive())
+		})
+
+		It("should clear the conflict once the stored key of our host is removed", func() {
+			conflict()
+			manager.OnUpdate(&proto.WireguardEndpointRemove{Hostname: "node1"})
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(HaveOccurred())
+			manager.OnUpdate(&proto.WireguardEndpointRemove{Hostname: "local-host"})
+			Expect(reporter.OnStatusUpdate(status(ourKey))).To(Succeed())
+		})
+
+		It("should back off publication in the wireguard module once a conflict is reported", func() {
+			wgDataplane := mocknetlink.NewMockNetlinkDataplane()
+			rtDataplane := mocknetlink.NewMockNetlinkDataplane()
+			t := mocktime.NewMockTime()
+			wgDataplane.AddIface(10, "wireguard.cali", true, true)
+			rtDataplane.AddIface(10, "wireguard.cali", true, true)
+			wg := wireguard.NewWithShims(
+				"local-host",
+				&wireguard.Config{
+					Enabled:             true,
+					ListeningPort:       1000,
+					FirewallMark:        1,
+					RoutingRulePriority: 99,
+					RoutingTableIndex:   99,
+					InterfaceName:       "wireguard.cali",
+					MTU:                 1042,
+				},
+				rtDataplane.NewMockNetlink,
+				wgDataplane.NewMockNetlink,
+				wgDataplane.NewMockWireguard,
+				nil,
+				10*time.Second,
+				t,
+				80,
+				reporter.OnStatusUpdate,
+				nil,
+			)
+			manager = newWireguardManager(wg, Config{Hostname: "local-host"})
+			manager.statusReporter = reporter
+			manager.OnUpdate(&proto.HostMetadataUpdate{Hostname: "local-host", Ipv4Addr: "10.0.0.1"})
+			wg.OnIfaceStateChanged("wireguard.cali", ifacemonitor.StateUp)
+			Expect(wg.Apply()).To(Succeed())
+			var update *proto.WireguardStatusUpdate
+			Expect(fromDataplane).To(Receive(&update))
+			ourKey, _, _, _ = wg.LocalConfig()
+			Expect(update.PublicKey).To(Equal(ourKey.String()))
+
+			By("republishing our key once a conflict is reported, and backing off")
+			conflict()
+			err := wg.Apply()
+			var conflictErr *wireguard.KeyConflictError
+			Expect(errors.As(err, &conflictErr)).To(BeTrue())
+			Expect(conflictErr.StoredKey).To(Equal(storedKey))
+			Expect(fromDataplane).NotTo(Receive())
+			Expect(wg.PublishRetryAfter()).To(Equal(5 * time.Second))
+
+			By("publishing our key once the conflicting key is removed")
+			manager.OnUpdate(&proto.WireguardEndpointRemove{Hostname: "local-host"})
+			t.IncrementTime(wg.PublishRetryAfter())
+			Expect(wg.Apply()).To(Succeed())
+			Expect(fromDataplane).To(Receive(&update))
+			Expect(update.PublicKey).To(Equal(ourKey.String()))
+			Expect(wg.PublishRetryAfter()).To(BeZero())
+		})
+
+		It("should send the zero key during a conflict", func() {
+			conflict()
+			Expect(reporter.OnStatusUpdate(wireguard.StatusUpdate{KeyState: wireguard.KeyStateDisabled})).To(Succeed())
+			Expect(fromDataplane).To(Receive(Equal(&proto.WireguardStatusUpdate{KeyState: "disabled"})))
+		})
+	})
+
+	Context("with conntrack cleanup", func() {
+		var ct *mockWireguardConntrack
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			ct = &mockWireguardConntrack{}
+			manager = newWireguardManagerWithShims(rt, Config{
+				Wireguard: wireguard.Config{ConntrackCleanup: true},
+			}, ct, mocktime.NewMockTime())
+		})
+
+		It("should remove the conntrack entries of each address of the CIDR", func() {
+			Expect(rt.cleaner).NotTo(BeNil())
+			rt.cleaner(ip.MustParseCIDROrIP("10.0.0.1/32"))
+			Expect(ct.removed).To(Equal([]string{"10.0.0.1"}))
+
+			ct.removed = nil
+			rt.cleaner(ip.MustParseCIDROrIP("10.0.0.254/31"))
+			Expect(ct.removed).To(Equal([]string{"10.0.0.254", "10.0.0.255"}))
+
+			ct.removed = nil
+			rt.cleaner(ip.MustParseCIDROrIP("10.0.1.0/24"))
+			Expect(ct.removed).To(HaveLen(256))
+			Expect(ct.removed[255]).To(Equal("10.0.1.255"))
+		})
+
+		It("should leave the conntrack entries of a large CIDR to expire", func() {
+			rt.cleaner(ip.MustParseCIDROrIP("10.0.0.0/16"))
+			Expect(ct.removed).To(BeEmpty())
+		})
+
+		It("should not set the cleaner if not configured", func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManagerWithShims(rt, Config{}, ct, mocktime.NewMockTime())
+			Expect(rt.cleaner).To(BeNil())
+		})
+	})
+
+	Context("with hostname canonicalization", func() {
+		var key wgtypes.Key
+		cidr := ip.MustParseCIDROrIP("192.168.0.0/26")
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{
+				Hostname:                "Local-Host.",
+				WireguardTeardownOnExit: true,
+			})
+			privateKey, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			key = privateKey.PublicKey()
+		})
+
+		sendSplitNode := func() {
+			manager.OnUpdate(&proto.HostMetadataUpdate{Hostname: "Node1.Example.Com.", Ipv4Addr: "10.0.0.1"})
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node1.example.com", PublicKey: key.String()})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         cidr.String(),
+				DstNodeName: "NODE1.example.com",
+			})
+		}
+
+		It("should pass the canonicalizer to the wireguard module", func() {
+			Expect(rt.canonicalizer).NotTo(BeNil())
+			Expect(rt.canonicalizer("Node1.Example.Com.")).To(Equal("node1.example.com"))
+			Expect(rt.canonicalizer("node1")).To(Equal("node1"))
+		})
+
+		It("should treat the names of a node that differ in case or trailing dots as the same node", func() {
+			sendSplitNode()
+			Expect(rt.endpoints).To(Equal(map[string]ip.Addr{"node1.example.com": ip.FromString("10.0.0.1")}))
+			Expect(rt.publicKeys).To(Equal(map[string]wgtypes.Key{"node1.example.com": key}))
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{cidr: "node1.example.com"}))
+
+			// The CIDR is unchanged if it is updated under another form of the name, and removed with the node.
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				Dst:         cidr.String(),
+				DstNodeName: "node1.example.com.",
+			})
+			Expect(rt.numAdds).To(Equal(1))
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "Node1.example.com"})
+			Expect(rt.endpoints).To(BeEmpty())
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+
+			manager.OnUpdate(&proto.WireguardEndpointRemove{Hostname: "NODE1.EXAMPLE.COM"})
+			Expect(rt.publicKeys).To(BeEmpty())
+		})
+
+		It("should verify the CIDRs against the blocks of the canonical node", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         "192.168.1.0/26",
+				DstNodeName: "Node1",
+			})
+			Expect(rt.verifier("node1", ip.MustParseCIDROrIP("192.168.1.0/28"))).To(BeTrue())
+			Expect(rt.verifier("node2", ip.MustParseCIDROrIP("192.168.1.0/28"))).To(BeFalse())
+		})
+
+		It("should tear down wireguard when the local host is removed under another form of its name", func() {
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "local-host"})
+			Expect(rt.numTeardowns).To(Equal(1))
+			Expect(manager.localHostRemoved).To(BeTrue())
+
+			By("leaving the configuration torn down if the local host is added back")
+			manager.OnUpdate(&proto.HostMetadataUpdate{Hostname: "local-host", Ipv4Addr: "10.0.0.1"})
+			Expect(rt.numTeardowns).To(Equal(1))
+			Expect(manager.localHostRemoved).To(BeTrue())
+		})
+
+		It("should use the names as they are if canonicalization is disabled", func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{WireguardHostnameCanonicalization: "None"})
+			sendSplitNode()
+			Expect(rt.endpoints).To(HaveKey("Node1.Example.Com."))
+			Expect(rt.publicKeys).To(HaveKey("node1.example.com"))
+			Expect(rt.cidrToNodeName).To(Equal(map[ip.CIDR]string{cidr: "NODE1.example.com"}))
+		})
+	})
+
+	Context("with local pod CIDRs", func() {
+		block := ip.MustParseCIDROrIP("192.168.0.0/26")
+		borrowed := ip.MustParseCIDROrIP("192.168.5.3/32")
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			manager = newWireguardManager(rt, Config{Hostname: "local-host"})
+		})
+
+		sendLocalRoute := func(cidr ip.CIDR, nodeName string) {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_LOCAL_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         cidr.String(),
+				DstNodeName: nodeName,
+			})
+		}
+
+		It("should send the local blocks and borrowed addresses once the updates have been processed", func() {
+			sendLocalRoute(block, "Local-Host")
+			sendLocalRoute(borrowed, "local-host")
+			Expect(rt.numRuleSources).To(BeZero())
+
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(rt.ruleSources).To(ConsistOf(block, borrowed))
+
+			// Nothing is sent if the CIDRs are unchanged.
+			sendLocalRoute(block, "local-host")
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(rt.numRuleSources).To(Equal(1))
+		})
+
+		It("should not send the CIDRs of other nodes or outside of the IP pools", func() {
+			sendLocalRoute(block, "node1")
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_LOCAL_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_NONE,
+				Dst:         borrowed.String(),
+				DstNodeName: "local-host",
+			})
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         "192.168.1.0/26",
+				DstNodeName: "node1",
+			})
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(rt.numRuleSources).To(BeZero())
+		})
+
+		It("should send the CIDRs when a local CIDR is removed or moves to another node", func() {
+			sendLocalRoute(block, "local-host")
+			sendLocalRoute(borrowed, "local-host")
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+
+			manager.OnUpdate(&proto.RouteRemove{Dst: borrowed.String()})
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(rt.ruleSources).To(Equal([]ip.CIDR{block}))
+
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type:        proto.RouteType_REMOTE_WORKLOAD,
+				IpPoolType:  proto.IPPoolType_VXLAN,
+				Dst:         block.String(),
+				DstNodeName: "node1",
+			})
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(rt.ruleSources).To(BeEmpty())
+			Expect(rt.numRuleSources).To(Equal(3))
+		})
+	})
+
+	Context("with datastore values that cannot be parsed", func() {
+		var (
+			t        *mocktime.MockTime
+			hook     *logtest.Hook
+			stdHooks log.LevelHooks
+			key      wgtypes.Key
+		)
+
+		BeforeEach(func() {
+			rt = newMockWireguardRouteTable()
+			t = mocktime.NewMockTime()
+			manager = newWireguardManagerWithShims(rt, Config{}, &mockWireguardConntrack{}, t)
+			privateKey, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			key = privateKey.PublicKey()
+
+			stdHooks = log.StandardLogger().Hooks
+			log.StandardLogger().Hooks = make(log.LevelHooks)
+			hook = logtest.NewGlobal()
+		})
+
+		AfterEach(func() {
+			log.StandardLogger().Hooks = stdHooks
+		})
+
+		numLogs := func(level log.Level) int {
+			n := 0
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == level {
+					n++
+				}
+			}
+			return n
+		}
+
+		sendBadKey := func(hostname string) {
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: hostname, PublicKey: "not-a-key"})
+		}
+
+		It("should only log a bad value as an error when first seen", func() {
+			for i := 0; i < 5; i++ {
+				sendBadKey("node1")
+				manager.OnUpdate(&proto.WireguardEndpointUpdate{
+					Hostname: "node2", PublicKey: key.String(), InterfaceAddr: "not-an-address",
+				})
+				manager.OnUpdate(&proto.RouteUpdate{
+					Type: proto.RouteType_REMOTE_WORKLOAD, Dst: "192.168.0.0/99", DstNodeName: "node3",
+				})
+			}
+			Expect(numLogs(log.ErrorLevel)).To(Equal(3))
+			Expect(rt.publicKeys).To(Equal(map[string]wgtypes.Key{"node2": key}))
+			Expect(rt.cidrToNodeName).To(BeEmpty())
+
+			// A different bad value of the same node is logged.
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: "another-bad-key"})
+			Expect(numLogs(log.ErrorLevel)).To(Equal(4))
+		})
+
+		It("should periodically remind of the bad values that are outstanding", func() {
+			sendBadKey("node1")
+			sendBadKey("node1")
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(numLogs(log.InfoLevel)).To(BeZero())
+
+			t.IncrementTime(wireguardBadInputReminderInterval)
+			sendBadKey("node1")
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(numLogs(log.InfoLevel)).To(Equal(1))
+			entry := hook.LastEntry()
+			Expect(entry.Data["node"]).To(Equal("node1"))
+			Expect(entry.Data["updates"]).To(Equal(3))
+			Expect(entry.Data["recentUpdates"]).To(Equal(2))
+
+			// The next reminder is an interval after the last.
+			t.IncrementTime(wireguardBadInputReminderInterval / 2)
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(numLogs(log.InfoLevel)).To(Equal(1))
+			t.IncrementTime(wireguardBadInputReminderInterval / 2)
+			Expect(manager.CompleteDeferredWork()).NotTo(HaveOccurred())
+			Expect(numLogs(log.InfoLevel)).To(Equal(2))
+			Expect(hook.LastEntry().Data["recentUpdates"]).To(Equal(0))
+			Expect(numLogs(log.ErrorLevel)).To(Equal(1))
+		})
+
+		It("should forget a bad value once corrected, and log it again if it recurs", func() {
+			sendBadKey("node1")
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key.String()})
+			Expect(rt.publicKeys).To(HaveKeyWithValue("node1", key))
+			Expect(manager.badInputs.counts()[wireguardBadInputPublicKey]).To(BeZero())
+
+			sendBadKey("node1")
+			Expect(numLogs(log.ErrorLevel)).To(Equal(2))
+			Expect(rt.publicKeys).NotTo(HaveKey("node1"))
+		})
+
+		It("should ignore a previous key that cannot be parsed, keeping the new key", func() {
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname: "node1", PublicKey: key.String(), PreviousPublicKey: "not-a-key", PreviousKeyDeadline: 1,
+			})
+			Expect(rt.publicKeys).To(HaveKeyWithValue("node1", key))
+			Expect(rt.previousKeys).To(BeEmpty())
+			Expect(manager.badInputs.counts()[wireguardBadInputPreviousPublicKey]).To(Equal(1))
+			Expect(numLogs(log.ErrorLevel)).To(Equal(1))
+
+			// The bad value is forgotten once the transition has ended.
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node1", PublicKey: key.String()})
+			Expect(manager.badInputs.counts()[wireguardBadInputPreviousPublicKey]).To(BeZero())
+		})
+
+		It("should forget the bad values of a removed node", func() {
+			sendBadKey("node1")
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type: proto.RouteType_REMOTE_WORKLOAD, Dst: "bad-cidr", DstNodeName: "Node1",
+			})
+			manager.OnUpdate(&proto.HostMetadataRemove{Hostname: "node1"})
+			Expect(manager.badInputs.counts()).To(Equal(map[wireguardBadInputType]int{
+				wireguardBadInputPublicKey:         0,
+				wireguardBadInputPreviousPublicKey: 0,
+				wireguardBadInputInterfaceAddr:     0,
+				wireguardBadInputCIDR:              0,
+				wireguardBadInputEnabledOverride:   0,
+			}))
+		})
+
+		It("should forget a bad CIDR once its route is removed", func() {
+			manager.OnUpdate(&proto.RouteUpdate{
+				Type: proto.RouteType_REMOTE_WORKLOAD, Dst: "bad-cidr", DstNodeName: "node1",
+			})
+			manager.OnUpdate(&proto.RouteRemove{Dst: "bad-cidr"})
+			Expect(manager.badInputs.counts()[wireguardBadInputCIDR]).To(BeZero())
+			Expect(numLogs(log.ErrorLevel)).To(Equal(1))
+
+			// The removal of a bad CIDR that was never added is still an error.
+			manager.OnUpdate(&proto.RouteRemove{Dst: "other-bad-cidr"})
+			Expect(numLogs(log.ErrorLevel)).To(Equal(2))
+		})
+
+		It("should count the bad values of each type", func() {
+			sendBadKey("node1")
+			sendBadKey("node2")
+			sendBadKey("node2")
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{
+				Hostname: "node3", PublicKey: key.String(), InterfaceAddr: "not-an-address",
+			})
+			Expect(manager.badInputs.counts()).To(Equal(map[wireguardBadInputType]int{
+				wireguardBadInputPublicKey:         2,
+				wireguardBadInputPreviousPublicKey: 0,
+				wireguardBadInputInterfaceAddr:     1,
+				wireguardBadInputCIDR:              0,
+				wireguardBadInputEnabledOverride:   0,
+			}))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("public-key"))).To(Equal(2.0))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("interface-address"))).To(Equal(1.0))
+
+			manager.OnUpdate(&proto.WireguardEndpointUpdate{Hostname: "node3", PublicKey: key.String()})
+			manager.OnUpdate(&proto.WireguardEndpointRemove{Hostname: "node2"})
+			Expect(manager.badInputs.counts()[wireguardBadInputPublicKey]).To(Equal(1))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("public-key"))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(gaugeWireguardBadInputs.WithLabelValues("interface-address"))).To(BeZero())
+		})
+	})
+})
+
+type mockWireguardConntrack struct {
+	removed []string
+}
+
+func (m *mockWireguardConntrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	Expect(ipVersion).To(Equal(uint8(4)))
+	m.removed = append(m.removed, ipAddr.String())
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/wireguard"
+)
+
+// wireguardStatusReporter reports the wireguard status of our host to the calculation graph, and so to the datastore.
+// OnStatusUpdate is the status callback of the wireguard module. If the datastore holds a key for our host that was
+// stored by another felix, the conflict is reported back by the calculation graph in a WireguardKeyConflict, and the
+// status update for our conflicting key returns a KeyConflictError rather than being sent, until the stored key
+// changes.
+type wireguardStatusReporter struct {
+	fromDataplane chan<- interface{}
+
+	// The outstanding key conflict, or nil if there is none. The status is reported from the goroutine of the Apply,
+	// while the conflict is recorded from the goroutine of the updates, so this is protected by a lock.
+	lock        sync.Mutex
+	keyConflict *wireguardKeyConflict
+}
+
+type wireguardKeyConflict struct {
+	publicKey wgtypes.Key
+	storedKey wgtypes.Key
+}
+
+func newWireguardStatusReporter(fromDataplane chan<- interface{}) *wireguardStatusReporter {
+	return &wireguardStatusReporter{fromDataplane: fromDataplane}
+}
+
+// OnStatusUpdate sends a status update of the wireguard module to the calculation graph, or returns a KeyConflictError
+// if the key in the update conflicts with the key stored for our host.
+func (r *wireguardStatusReporter) OnStatusUpdate(status wireguard.StatusUpdate) error {
+	// While the key is held back the zero key is reported, which removes any key from the datastore. The state of the
+	// key and the source of the enabled state are reported either way.
+	if status.PublicKey == zeroKey {
+		r.fromDataplane <- &proto.WireguardStatusUpdate{
+			PublicKey:     "",
+			KeyState:      string(status.KeyState),
+			EnabledSource: string(status.EnabledSource),
+		}
+		return nil
+	}
+
+	r.lock.Lock()
+	conflict := r.keyConflict
+	r.lock.Unlock()
+	if conflict != nil && conflict.publicKey == status.PublicKey {
+		log.WithFields(log.Fields{
+			"ourKey":    status.PublicKey,
+			"storedKey": conflict.storedKey,
+		}).Debug("Wireguard public key conflicts with the stored key, not sending the status update")
+		return &wireguard.KeyConflictError{StoredKey: conflict.storedKey}
+	}
+
+	update := &proto.WireguardStatusUpdate{
+		PublicKey:         status.PublicKey.String(),
+		ListeningPort:     int32(status.ListeningPort),
+		InterfaceName:     status.InterfaceName,
+		RoutingTableIndex: int32(status.RoutingTableIndex),
+		KeyState:          string(status.KeyState),
+		EnabledSource:     string(status.EnabledSource),
+	}
+	if status.InterfaceAddr != nil {
+		update.InterfaceAddr = status.InterfaceAddr.String()
+	}
+	if status.PreviousPublicKey != zeroKey {
+		update.PreviousPublicKey = status.PreviousPublicKey.String()
+		update.PreviousKeyDeadline = status.PreviousKeyDeadline.Unix()
+	}
+	r.fromDataplane <- update
+	return nil
+}
+
+// onKeyConflict records a conflict between our public key and the key stored for our host. Returns false if the
+// conflict is already recorded.
+func (r *wireguardStatusReporter) onKeyConflict(publicKey, storedKey wgtypes.Key) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	conflict := &wireguardKeyConflict{publicKey: publicKey, storedKey: storedKey}
+	if r.keyConflict != nil && *r.keyConflict == *conflict {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"ourKey":    publicKey,
+		"storedKey": storedKey,
+	}).Warning("Wireguard public key conflicts with the key stored for this host by another felix")
+	r.keyConflict = conflict
+	return true
+}
+
+// onStoredKeyChanged clears any key conflict once the key stored for our host is no longer the conflicting key, so that
+// our key is sent again, or the zero key if the stored key has been removed.
+func (r *wireguardStatusReporter) onStoredKeyChanged(storedKey wgtypes.Key) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.keyConflict == nil || r.keyConflict.storedKey == storedKey {
+		return
+	}
+	log.WithField("storedKey", storedKey).Info("Wireguard public key stored for this host changed, key conflict cleared")
+	r.keyConflict = nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The number of bytes added to each packet by IPIP and VXLAN encapsulation.
+	ipipMTUOverhead  = 20
+	vxlanMTUOverhead = 50
+)
+
+// mtuOverheadSource is implemented by each encapsulation that may be used for workload traffic.
+type mtuOverheadSource interface {
+	// Active returns true if the encapsulation is currently in use.
+	Active() bool
+	// Overhead returns the number of bytes the encapsulation adds to each packet.
+	Overhead() int
+}
+
+// staticMTUOverhead is an encapsulation that is enabled or disabled by configuration, such as IPIP or VXLAN.
+type staticMTUOverhead struct {
+	enabled  bool
+	overhead int
+}
+
+func (s staticMTUOverhead) Active() bool {
+	return s.enabled
+}
+
+func (s staticMTUOverhead) Overhead() int {
+	return s.overhead
+}
+
+// workloadMTUCalculator calculates the MTU of the workload interfaces from the MTU of the host network, less the
+// largest overhead of the active encapsulations. Only one encapsulation is applied to a packet, so the overheads are
+// not cumulative. An encapsulation may become active or inactive at runtime (e.g. wireguard is only active if it is
+// supported by the kernel), so the MTU is recalculated after each apply and the subscribers are notified of changes.
+type workloadMTUCalculator struct {
+	hostMTU     int
+	sources     []mtuOverheadSource
+	subscribers []func(mtu int)
+
+	// The last calculated MTU, or 0 if not yet calculated.
+	mtu int
+}
+
+func newWorkloadMTUCalculator(hostMTU int, sources ...mtuOverheadSource) *workloadMTUCalculator {
+	return &workloadMTUCalculator{
+		hostMTU: hostMTU,
+		sources: sources,
+	}
+}
+
+// Subscribe registers a callback that is invoked with the calculated MTU each time it changes.
+func (c *workloadMTUCalculator) Subscribe(onMTUUpdate func(mtu int)) {
+	c.subscribers = append(c.subscribers, onMTUUpdate)
+}
+
+// Recalculate calculates the workload MTU from the current state of the encapsulations and notifies the subscribers
+// if it has changed. Returns true if the MTU changed.
+func (c *workloadMTUCalculator) Recalculate() bool {
+	overhead := 0
+	for _, s := range c.sources {
+		if s.Active() && s.Overhead() > overhead {
+			overhead = s.Overhead()
+		}
+	}
+	mtu := c.hostMTU - overhead
+	if mtu == c.mtu {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"hostMTU":  c.hostMTU,
+		"overhead": overhead,
+		"oldMTU":   c.mtu,
+		"newMTU":   mtu,
+	}).Info("Workload MTU updated")
+	c.mtu = mtu
+	for _, onMTUUpdate := range c.subscribers {
+		onMTUUpdate(mtu)
+	}
+	return true
+}
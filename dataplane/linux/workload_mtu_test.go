@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Workload MTU calculator", func() {
+	var (
+		rt         *mockWireguardRouteTable
+		wgManager  *wireguardManager
+		updatedMTU []int
+	)
+
+	newCalculator := func(ipipEnabled, vxlanEnabled bool) *workloadMTUCalculator {
+		c := newWorkloadMTUCalculator(
+			1500,
+			staticMTUOverhead{enabled: ipipEnabled, overhead: ipipMTUOverhead},
+			staticMTUOverhead{enabled: vxlanEnabled, overhead: vxlanMTUOverhead},
+			wgManager,
+		)
+		c.Subscribe(func(mtu int) {
+			updatedMTU = append(updatedMTU, mtu)
+		})
+		return c
+	}
+
+	BeforeEach(func() {
+		rt = newMockWireguardRouteTable()
+		wgManager = newWireguardManager(rt, Config{})
+		updatedMTU = nil
+	})
+
+	It("should use the host MTU with no encapsulation", func() {
+		c := newCalculator(false, false)
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(updatedMTU).To(Equal([]int{1500}))
+	})
+
+	It("should only notify the subscribers when the MTU changes", func() {
+		c := newCalculator(true, false)
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(c.Recalculate()).To(BeFalse())
+		Expect(updatedMTU).To(Equal([]int{1480}))
+	})
+
+	It("should lower the MTU when wireguard is active and raise it when wireguard is not", func() {
+		c := newCalculator(true, false)
+		Expect(c.Recalculate()).To(BeTrue())
+
+		By("enabling wireguard")
+		rt.active = true
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(updatedMTU).To(Equal([]int{1480, 1440}))
+
+		By("finding wireguard is not supported")
+		rt.active = false
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(updatedMTU).To(Equal([]int{1480, 1440, 1480}))
+	})
+
+	It("should use the largest overhead of the active encapsulations", func() {
+		rt.active = true
+		c := newCalculator(false, true)
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(updatedMTU).To(Equal([]int{1440}))
+
+		By("disabling wireguard")
+		rt.active = false
+		Expect(c.Recalculate()).To(BeTrue())
+		Expect(updatedMTU).To(Equal([]int{1440, 1450}))
+	})
+})
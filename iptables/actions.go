@@ -190,6 +190,20 @@ func (c SetMaskedMarkAction) String() string {
 	return fmt.Sprintf("Set:%#x", c.Mark)
 }
 
+// SetDSCPAction sets the DSCP field of the packet, e.g. so that the underlay network can prioritize the traffic.
+type SetDSCPAction struct {
+	DSCP        uint8
+	TypeSetDSCP struct{}
+}
+
+func (c SetDSCPAction) ToFragment(features *Features) string {
+	return fmt.Sprintf("--jump DSCP --set-dscp %d", c.DSCP)
+}
+
+func (c SetDSCPAction) String() string {
+	return fmt.Sprintf("SetDSCP:%d", c.DSCP)
+}
+
 type NoTrackAction struct {
 	TypeNoTrack struct{}
 }
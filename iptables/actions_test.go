@@ -42,4 +42,5 @@ var _ = DescribeTable("Actions",
 		Mark: 0x1000,
 		Mask: 0xf000,
 	}, "--jump MARK --set-mark 0x1000/0xf000"),
+	Entry("SetDSCPAction", Features{}, SetDSCPAction{DSCP: 46}, "--jump DSCP --set-dscp 46"),
 )
@@ -103,6 +103,22 @@ func ConfigureLogging(configParams *config.Config) {
 	// are filtered out as early as possible.
 	log.SetLevel(mostVerboseLevel)
 
+	// The wireguard module may log at a more verbose level than the rest of felix.  The global
+	// setting still filters the logs of the other modules, so the destinations that log at the
+	// most verbose level can also accept the more verbose wireguard logs.
+	if wireguardLevel := WireguardLogLevel(configParams); wireguardLevel != nil && *wireguardLevel > mostVerboseLevel {
+		if logLevelScreen == mostVerboseLevel {
+			logLevelScreen = *wireguardLevel
+		}
+		if logLevelFile == mostVerboseLevel {
+			logLevelFile = *wireguardLevel
+		}
+		if logLevelSyslog == mostVerboseLevel {
+			logLevelSyslog = *wireguardLevel
+		}
+		mostVerboseLevel = *wireguardLevel
+	}
+
 	// Screen target.
 	var dests []*logutils.Destination
 	if configParams.LogSeverityScreen != "" {
@@ -161,6 +177,16 @@ func ConfigureLogging(configParams *config.Config) {
 	}
 }
 
+// WireguardLogLevel returns the log level of the wireguard module, or nil if the wireguard
+// module uses the felix log level.
+func WireguardLogLevel(configParams *config.Config) *log.Level {
+	if configParams.WireguardLogSeverity == "" {
+		return nil
+	}
+	level := logutils.SafeParseLogLevel(configParams.WireguardLogSeverity)
+	return &level
+}
+
 func getScreenDestination(configParams *config.Config, logLevel log.Level) *logutils.Destination {
 	return logutils.NewStreamDestination(
 		logLevel,
@@ -0,0 +1,211 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netlink
+
+import (
+	"context"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// minSocketTimeout is the smallest socket timeout set for a call close to the context deadline. A zero socket timeout
+// would disable the timeout altogether.
+const minSocketTimeout = time.Millisecond
+
+// ContextError returns the error of a context, as context.Context.Err, except that a context whose deadline has passed is
+// treated as done even if its timer has not yet fired. Otherwise a call that fails on reaching the deadline may be
+// followed by calls that are not yet abandoned.
+func ContextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// NetlinkWithContext returns a Netlink client whose calls are bounded by the context. The netlink library does not
+// accept a context, so instead each call fails with the context error once the context is done, and if the context
+// deadline is sooner than the socket timeout of the client, the socket timeout is reduced for the duration of the call
+// so that a wedged socket does not block beyond the deadline. The timeout is the socket timeout configured on the
+// client, zero if there is none. The client is returned unchanged if the context can never be done.
+func NetlinkWithContext(ctx context.Context, nl Netlink, timeout time.Duration) Netlink {
+	if ctx.Done() == nil {
+		return nl
+	}
+	return &contextNetlink{ctx: ctx, nl: nl, timeout: timeout}
+}
+
+type contextNetlink struct {
+	ctx     context.Context
+	nl      Netlink
+	timeout time.Duration
+}
+
+// do makes a call if the context is not done, limiting the socket timeout to the time remaining until the deadline.
+func (c *contextNetlink) do(call func() error) error {
+	if err := ContextError(c.ctx); err != nil {
+		return err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return call()
+	}
+	remaining := time.Until(deadline)
+	if c.timeout > 0 && remaining >= c.timeout {
+		return call()
+	} else if remaining < minSocketTimeout {
+		remaining = minSocketTimeout
+	}
+	if err := c.nl.SetSocketTimeout(remaining); err != nil {
+		return err
+	}
+	err := call()
+	if errRestore := c.nl.SetSocketTimeout(c.timeout); err == nil {
+		err = errRestore
+	}
+	return err
+}
+
+func (c *contextNetlink) SetSocketTimeout(to time.Duration) error {
+	c.timeout = to
+	return c.nl.SetSocketTimeout(to)
+}
+
+func (c *contextNetlink) LinkList() (links []netlink.Link, err error) {
+	err = c.do(func() (err error) {
+		links, err = c.nl.LinkList()
+		return
+	})
+	return
+}
+
+func (c *contextNetlink) LinkByName(name string) (link netlink.Link, err error) {
+	err = c.do(func() (err error) {
+		link, err = c.nl.LinkByName(name)
+		return
+	})
+	return
+}
+
+func (c *contextNetlink) LinkAdd(link netlink.Link) error {
+	return c.do(func() error { return c.nl.LinkAdd(link) })
+}
+
+func (c *contextNetlink) LinkDel(link netlink.Link) error {
+	return c.do(func() error { return c.nl.LinkDel(link) })
+}
+
+func (c *contextNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return c.do(func() error { return c.nl.LinkSetMTU(link, mtu) })
+}
+
+func (c *contextNetlink) LinkSetUp(link netlink.Link) error {
+	return c.do(func() error { return c.nl.LinkSetUp(link) })
+}
+
+func (c *contextNetlink) RouteListFiltered(
+	family int, filter *netlink.Route, filterMask uint64,
+) (routes []netlink.Route, err error) {
+	err = c.do(func() (err error) {
+		routes, err = c.nl.RouteListFiltered(family, filter, filterMask)
+		return
+	})
+	return
+}
+
+func (c *contextNetlink) RouteAdd(route *netlink.Route) error {
+	return c.do(func() error { return c.nl.RouteAdd(route) })
+}
+
+func (c *contextNetlink) RouteDel(route *netlink.Route) error {
+	return c.do(func() error { return c.nl.RouteDel(route) })
+}
+
+func (c *contextNetlink) RouteReplace(route *netlink.Route) error {
+	return c.do(func() error { return c.nl.RouteReplace(route) })
+}
+
+func (c *contextNetlink) AddrList(link netlink.Link, family int) (addrs []netlink.Addr, err error) {
+	err = c.do(func() (err error) {
+		addrs, err = c.nl.AddrList(link, family)
+		return
+	})
+	return
+}
+
+func (c *contextNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return c.do(func() error { return c.nl.AddrAdd(link, addr) })
+}
+
+func (c *contextNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return c.do(func() error { return c.nl.AddrDel(link, addr) })
+}
+
+func (c *contextNetlink) RuleList(family int) (rules []netlink.Rule, err error) {
+	err = c.do(func() (err error) {
+		rules, err = c.nl.RuleList(family)
+		return
+	})
+	return
+}
+
+func (c *contextNetlink) RuleAdd(rule *netlink.Rule) error {
+	return c.do(func() error { return c.nl.RuleAdd(rule) })
+}
+
+func (c *contextNetlink) RuleDel(rule *netlink.Rule) error {
+	return c.do(func() error { return c.nl.RuleDel(rule) })
+}
+
+func (c *contextNetlink) Delete() {
+	c.nl.Delete()
+}
+
+// WireguardWithContext returns a Wireguard client whose calls fail with the context error once the context is done.
+// The wireguard control library does not accept a context or support a socket timeout, so a call that is already in
+// progress is not interrupted. The client is returned unchanged if the context can never be done.
+func WireguardWithContext(ctx context.Context, wg Wireguard) Wireguard {
+	if ctx.Done() == nil {
+		return wg
+	}
+	return &contextWireguard{ctx: ctx, wg: wg}
+}
+
+type contextWireguard struct {
+	ctx context.Context
+	wg  Wireguard
+}
+
+func (c *contextWireguard) Close() error {
+	return c.wg.Close()
+}
+
+func (c *contextWireguard) DeviceByName(name string) (*wgtypes.Device, error) {
+	if err := ContextError(c.ctx); err != nil {
+		return nil, err
+	}
+	return c.wg.DeviceByName(name)
+}
+
+func (c *contextWireguard) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if err := ContextError(c.ctx); err != nil {
+		return err
+	}
+	return c.wg.ConfigureDevice(name, cfg)
+}
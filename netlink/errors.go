@@ -3,6 +3,7 @@ package netlink
 import (
 	"os"
 	"strings"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
@@ -33,3 +34,21 @@ func IsNotExist(err error) bool {
 	}
 	return strings.Contains(err.Error(), "not found")
 }
+
+// IsBusy returns true if the error indicates the device or resource is busy (EBUSY).
+func IsBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == syscall.EBUSY || strings.Contains(err.Error(), "device or resource busy")
+}
+
+// IsNoBufferSpace returns true if the error indicates that a message was too large to be sent or processed (ENOBUFS or
+// EMSGSIZE), e.g. a wireguard device configuration with too many allowed IPs.
+func IsNoBufferSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == syscall.ENOBUFS || err == syscall.EMSGSIZE ||
+		strings.Contains(err.Error(), "no buffer space available") || strings.Contains(err.Error(), "message too long")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,6 +21,7 @@ import (
 
 	"github.com/projectcalico/felix/ip"
 	netlinkshim "github.com/projectcalico/felix/netlink"
+	timeshim "github.com/projectcalico/felix/time"
 	"github.com/projectcalico/libcalico-go/lib/set"
 )
 
@@ -55,9 +57,11 @@ var (
 	FileDoesNotExistError = errors.New("file does not exist")
 	AlreadyExistsError    = errors.New("already exists")
 	NotSupportedError     = errors.New("operation not supported")
+	NoBufferSpaceError    = errors.New("no buffer space available")
+	BusyError             = errors.New("device or resource busy")
 )
 
-type FailFlags uint32
+type FailFlags uint64
 
 const (
 	FailNextLinkList FailFlags = 1 << iota
@@ -79,12 +83,34 @@ const (
 	FailNextAddrDel
 	FailNextRuleList
 	FailNextRuleAdd
+	FailNextRuleAddExists
 	FailNextRuleDel
 	FailNextNewWireguard
 	FailNextNewWireguardNotSupported
 	FailNextWireguardClose
 	FailNextWireguardDeviceByName
 	FailNextWireguardConfigureDevice
+	FailNextWireguardDeviceByNameStale
+	FailNextLinkDelBusy
+	// The RouteAdd and RuleAdd race with another process that adds the same route or rule first, so the add fails with
+	// EEXIST. With FailNextRouteAddRaceConflict the route added by the other process has other content, and with
+	// FailNextRuleAddRaceConflict the add fails with EEXIST, but the rule is not added.
+	FailNextRouteAddRace
+	FailNextRouteAddRaceConflict
+	FailNextRuleAddRace
+	FailNextRuleAddRaceConflict
+	// The RouteDel and RuleDel race with another process that deletes the route or rule first, so the delete fails
+	// with ESRCH, or ENOENT for a rule. With FailNextRouteDelRaceConflict the delete fails with ESRCH, but the route
+	// remains.
+	FailNextRouteDelRace
+	FailNextRouteDelRaceConflict
+	FailNextRuleDelRace
+	// The RouteReplace fails, as the kernel may fail to replace a route with a route of another type. The RouteReplace
+	// also fails with FailNextRouteAdd.
+	FailNextRouteReplace
+	// The DeviceByName returns only half of the peers of the device, as may be read while another process, e.g. `wg`,
+	// is reading or updating the device.
+	FailNextWireguardDeviceByNamePartial
 	FailNone FailFlags = 0
 )
 
@@ -160,6 +186,9 @@ func (f FailFlags) String() string {
 	if f&FailNextRuleAdd != 0 {
 		parts = append(parts, "FailNextRuleAdd")
 	}
+	if f&FailNextRuleAddExists != 0 {
+		parts = append(parts, "FailNextRuleAddExists")
+	}
 	if f&FailNextRuleDel != 0 {
 		parts = append(parts, "FailNextRuleDel")
 	}
@@ -178,6 +207,39 @@ func (f FailFlags) String() string {
 	if f&FailNextWireguardConfigureDevice != 0 {
 		parts = append(parts, "FailNextWireguardConfigureDevice")
 	}
+	if f&FailNextWireguardDeviceByNameStale != 0 {
+		parts = append(parts, "FailNextWireguardDeviceByNameStale")
+	}
+	if f&FailNextLinkDelBusy != 0 {
+		parts = append(parts, "FailNextLinkDelBusy")
+	}
+	if f&FailNextRouteAddRace != 0 {
+		parts = append(parts, "FailNextRouteAddRace")
+	}
+	if f&FailNextRouteAddRaceConflict != 0 {
+		parts = append(parts, "FailNextRouteAddRaceConflict")
+	}
+	if f&FailNextRuleAddRace != 0 {
+		parts = append(parts, "FailNextRuleAddRace")
+	}
+	if f&FailNextRuleAddRaceConflict != 0 {
+		parts = append(parts, "FailNextRuleAddRaceConflict")
+	}
+	if f&FailNextRouteDelRace != 0 {
+		parts = append(parts, "FailNextRouteDelRace")
+	}
+	if f&FailNextRouteDelRaceConflict != 0 {
+		parts = append(parts, "FailNextRouteDelRaceConflict")
+	}
+	if f&FailNextRuleDelRace != 0 {
+		parts = append(parts, "FailNextRuleDelRace")
+	}
+	if f&FailNextRouteReplace != 0 {
+		parts = append(parts, "FailNextRouteReplace")
+	}
+	if f&FailNextWireguardDeviceByNamePartial != 0 {
+		parts = append(parts, "FailNextWireguardDeviceByNamePartial")
+	}
 	if f == 0 {
 		parts = append(parts, "FailNone")
 	}
@@ -195,6 +257,13 @@ type MockNetlinkDataplane struct {
 	AddedRules   []netlink.Rule
 	DeletedRules []netlink.Rule
 
+	// AllowDuplicateRules simulates a kernel that does not reject the addition of a rule that already exists.
+	AllowDuplicateRules bool
+
+	// As with the kernel, each address added to a link has a local route in the local routing table, which is removed
+	// along with the address. LocalRoutesLinger simulates a local route that remains once its address is removed.
+	LocalRoutesLinger bool
+
 	RouteKeyToRoute  map[string]netlink.Route
 	AddedRouteKeys   set.Set
 	DeletedRouteKeys set.Set
@@ -202,17 +271,63 @@ type MockNetlinkDataplane struct {
 
 	NumNewNetlinkCalls     int
 	NetlinkOpen            bool
+	NumOpenNetlinks        int
 	NumNewWireguardCalls   int
 	WireguardOpen          bool
 	NumLinkAddCalls        int
 	NumLinkDeleteCalls     int
 	ImmediateLinkUp        bool
+	NumRuleListCalls       int
 	NumRuleAddCalls        int
 	NumRuleDelCalls        int
 	WireguardConfigUpdated bool
 
+	NumWireguardDeviceReads      int
+	NumWireguardDeviceConfigures int
+
+	// ConfiguredWireguardPeers is the set of public keys of the peers included in a wireguard device configuration.
+	ConfiguredWireguardPeers set.Set
+
+	// ConfiguredWireguardPrivateKeys are the private keys included in the wireguard device configurations, in order.
+	ConfiguredWireguardPrivateKeys []wgtypes.Key
+
+	// MaxPeersPerWireguardConfigure simulates the netlink message size limit by failing a wireguard device
+	// configuration with more peers. Unlimited if not set.
+	MaxPeersPerWireguardConfigure int
+
+	// MaxAllowedIPsPerWireguardConfigure likewise fails a wireguard device configuration with more allowed IPs across
+	// all of its peers. Unlimited if not set.
+	MaxAllowedIPsPerWireguardConfigure int
+
+	// WireguardConfigureAllowedIPs is the number of allowed IPs in each wireguard device configuration, in order,
+	// including the configurations that failed.
+	WireguardConfigureAllowedIPs []int
+
+	// WireguardConfigurePeers are the peers of each wireguard device configuration, in order, including the
+	// configurations that failed.
+	WireguardConfigurePeers [][]wgtypes.PeerConfig
+
+	// AddedRouteKeyOrder and DeletedRouteKeyOrder are the keys of the routes added, or replaced, and deleted, in order.
+	AddedRouteKeyOrder   []string
+	DeletedRouteKeyOrder []string
+
+	// FailWireguardConfigureCall fails the wireguard device configuration with this number, counted by
+	// NumWireguardDeviceConfigures, e.g. to fail a configuration part way through a batched update. Not set if zero.
+	FailWireguardConfigureCall int
+
+	// Time is the clock used for the handshake times of the wireguard peers, so that tests control the clock, e.g.
+	// with a MockTime. The real time is used if not set.
+	Time timeshim.Time
+
+	// The device returned by the last read of each wireguard device, returned again by a read that fails with
+	// FailNextWireguardDeviceByNameStale.
+	lastWireguardDevices map[string]wgtypes.Device
+
 	PersistentlyFailToConnect bool
 
+	// MaxOpenNetlinks is the number of netlink connections that may be open at once. Defaults to 1 if not set.
+	MaxOpenNetlinks int
+
 	PersistFailures    bool
 	FailuresToSimulate FailFlags
 
@@ -221,6 +336,24 @@ type MockNetlinkDataplane struct {
 	mutex                   sync.Mutex
 	deletedConntrackEntries []net.IP
 	ConntrackSleep          time.Duration
+	LinkByNameSleep         time.Duration
+
+	// CallLatency simulates slow netlink and wireguard calls, keyed by the name of the call, e.g. "RouteAdd". A netlink
+	// call slower than the socket timeout set by SetSocketTimeout fails with EAGAIN once the timeout expires, as with a
+	// real netlink socket. Calls records the name of each call, in order, and SocketTimeout is the socket timeout.
+	CallLatency   map[string]time.Duration
+	Calls         []string
+	SocketTimeout time.Duration
+
+	// CallClock, if set, is a clock such as a mock time shim that each call advances by its step in CallClockSteps,
+	// keyed by the name of the call as for CallLatency, so that the time taken by the calls is deterministic.
+	CallClock      CallClock
+	CallClockSteps map[string]time.Duration
+}
+
+// CallClock is a clock advanced by the mock calls, see MockNetlinkDataplane.CallClock.
+type CallClock interface {
+	IncrementTime(t time.Duration)
 }
 
 func (d *MockNetlinkDataplane) ResetDeltas() {
@@ -236,9 +369,19 @@ func (d *MockNetlinkDataplane) ResetDeltas() {
 	d.NumLinkDeleteCalls = 0
 	d.NumNewNetlinkCalls = 0
 	d.NumNewWireguardCalls = 0
+	d.NumRuleListCalls = 0
 	d.AddedRules = nil
 	d.DeletedRules = nil
 	d.WireguardConfigUpdated = false
+	d.NumWireguardDeviceReads = 0
+	d.NumWireguardDeviceConfigures = 0
+	d.ConfiguredWireguardPeers = set.New()
+	d.ConfiguredWireguardPrivateKeys = nil
+	d.WireguardConfigureAllowedIPs = nil
+	d.WireguardConfigurePeers = nil
+	d.AddedRouteKeyOrder = nil
+	d.DeletedRouteKeyOrder = nil
+	d.Calls = nil
 }
 
 // ----- Mock dataplane management functions for test code -----
@@ -270,6 +413,20 @@ func (d *MockNetlinkDataplane) AddIface(idx int, name string, up bool, running b
 	return link
 }
 
+// RecreateIface simulates an out-of-band delete and recreate of an interface. The recreated interface has a new index
+// and no configuration, and, as with the kernel, any routes via the old interface are removed.
+func (d *MockNetlinkDataplane) RecreateIface(idx int, name string, up bool, running bool) *MockLink {
+	if link, ok := d.NameToLink[name]; ok {
+		Expect(link.LinkAttrs.Index).NotTo(Equal(idx), "Recreated interface should have a new index")
+		for key, route := range d.RouteKeyToRoute {
+			if route.LinkIndex == link.LinkAttrs.Index {
+				delete(d.RouteKeyToRoute, key)
+			}
+		}
+	}
+	return d.AddIface(idx, name, up, running)
+}
+
 func (d *MockNetlinkDataplane) SetIface(name string, up bool, running bool) {
 	link, ok := d.NameToLink[name]
 	Expect(ok).To(BeTrue())
@@ -297,7 +454,12 @@ func (d *MockNetlinkDataplane) NewMockNetlink() (netlinkshim.Netlink, error) {
 	if d.PersistentlyFailToConnect || d.shouldFail(FailNextNewNetlink) {
 		return nil, SimulatedError
 	}
-	Expect(d.NetlinkOpen).To(BeFalse())
+	maxOpenNetlinks := d.MaxOpenNetlinks
+	if maxOpenNetlinks == 0 {
+		maxOpenNetlinks = 1
+	}
+	Expect(d.NumOpenNetlinks).To(BeNumerically("<", maxOpenNetlinks))
+	d.NumOpenNetlinks++
 	d.NetlinkOpen = true
 	return d, nil
 }
@@ -310,10 +472,15 @@ func (d *MockNetlinkDataplane) Delete() {
 	defer GinkgoRecover()
 
 	Expect(d.NetlinkOpen).To(BeTrue())
-	d.NetlinkOpen = false
+	d.NumOpenNetlinks--
+	d.NetlinkOpen = d.NumOpenNetlinks > 0
 }
 
 func (d *MockNetlinkDataplane) SetSocketTimeout(to time.Duration) error {
+	if err := d.simulateCall("SetSocketTimeout", false); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -322,10 +489,15 @@ func (d *MockNetlinkDataplane) SetSocketTimeout(to time.Duration) error {
 	if d.shouldFail(FailNextSetSocketTimeout) {
 		return SimulatedError
 	}
+	d.SocketTimeout = to
 	return nil
 }
 
 func (d *MockNetlinkDataplane) LinkList() ([]netlink.Link, error) {
+	if err := d.simulateCall("LinkList", true); err != nil {
+		return nil, err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -342,6 +514,13 @@ func (d *MockNetlinkDataplane) LinkList() ([]netlink.Link, error) {
 }
 
 func (d *MockNetlinkDataplane) LinkByName(name string) (netlink.Link, error) {
+	if err := d.simulateCall("LinkByName", true); err != nil {
+		return nil, err
+	}
+
+	// Simulate a slow netlink call before taking the lock.
+	time.Sleep(d.LinkByNameSleep)
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -360,6 +539,10 @@ func (d *MockNetlinkDataplane) LinkByName(name string) (netlink.Link, error) {
 }
 
 func (d *MockNetlinkDataplane) LinkAdd(link netlink.Link) error {
+	if err := d.simulateCall("LinkAdd", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -387,6 +570,10 @@ func (d *MockNetlinkDataplane) LinkAdd(link netlink.Link) error {
 }
 
 func (d *MockNetlinkDataplane) LinkDel(link netlink.Link) error {
+	if err := d.simulateCall("LinkDel", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -397,6 +584,9 @@ func (d *MockNetlinkDataplane) LinkDel(link netlink.Link) error {
 	if d.shouldFail(FailNextLinkDel) {
 		return SimulatedError
 	}
+	if d.shouldFail(FailNextLinkDelBusy) {
+		return BusyError
+	}
 
 	if _, ok := d.NameToLink[link.Attrs().Name]; !ok {
 		return NotFoundError
@@ -408,6 +598,10 @@ func (d *MockNetlinkDataplane) LinkDel(link netlink.Link) error {
 }
 
 func (d *MockNetlinkDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
+	if err := d.simulateCall("LinkSetMTU", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -425,6 +619,10 @@ func (d *MockNetlinkDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
 }
 
 func (d *MockNetlinkDataplane) LinkSetUp(link netlink.Link) error {
+	if err := d.simulateCall("LinkSetUp", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -445,6 +643,10 @@ func (d *MockNetlinkDataplane) LinkSetUp(link netlink.Link) error {
 }
 
 func (d *MockNetlinkDataplane) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	if err := d.simulateCall("AddrList", true); err != nil {
+		return nil, err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -454,12 +656,27 @@ func (d *MockNetlinkDataplane) AddrList(link netlink.Link, family int) ([]netlin
 		return nil, SimulatedError
 	}
 	if link, ok := d.NameToLink[link.Attrs().Name]; ok {
-		return link.Addrs, nil
+		// Return a copy of the addresses of the family, the caller may modify the link addresses whilst iterating.
+		var addrs []netlink.Addr
+		for _, addr := range link.Addrs {
+			addrFamily := netlink.FAMILY_V4
+			if addr.IP.To4() == nil {
+				addrFamily = netlink.FAMILY_V6
+			}
+			if family == netlink.FAMILY_ALL || family == addrFamily {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs, nil
 	}
 	return nil, NotFoundError
 }
 
 func (d *MockNetlinkDataplane) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if err := d.simulateCall("AddrAdd", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -478,6 +695,8 @@ func (d *MockNetlinkDataplane) AddrAdd(link netlink.Link, addr *netlink.Addr) er
 		d.AddedAddrs.Add(addr.IPNet.String())
 		link.Addrs = append(link.Addrs, *addr)
 		d.NameToLink[link.Attrs().Name] = link
+		localRoute := LocalRouteForAddr(link, addr)
+		d.RouteKeyToRoute[KeyForRoute(&localRoute)] = localRoute
 		return nil
 	}
 
@@ -485,6 +704,10 @@ func (d *MockNetlinkDataplane) AddrAdd(link netlink.Link, addr *netlink.Addr) er
 }
 
 func (d *MockNetlinkDataplane) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	if err := d.simulateCall("AddrDel", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -507,6 +730,10 @@ func (d *MockNetlinkDataplane) AddrDel(link netlink.Link, addr *netlink.Addr) er
 		link.Addrs = link.Addrs[:newIdx]
 		d.NameToLink[link.Attrs().Name] = link
 		d.DeletedAddrs.Add(addr.IPNet.String())
+		if !d.LocalRoutesLinger {
+			localRoute := LocalRouteForAddr(link, addr)
+			delete(d.RouteKeyToRoute, KeyForRoute(&localRoute))
+		}
 		return nil
 	}
 
@@ -514,19 +741,35 @@ func (d *MockNetlinkDataplane) AddrDel(link netlink.Link, addr *netlink.Addr) er
 }
 
 func (d *MockNetlinkDataplane) RuleList(family int) ([]netlink.Rule, error) {
+	if err := d.simulateCall("RuleList", true); err != nil {
+		return nil, err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
 
 	Expect(d.NetlinkOpen).To(BeTrue())
+	d.NumRuleListCalls++
 	if d.shouldFail(FailNextRuleList) {
 		return nil, SimulatedError
 	}
 
-	return d.Rules, nil
+	// Rules with no family are IPv4 rules.
+	var rules []netlink.Rule
+	for _, rule := range d.Rules {
+		if family == netlink.FAMILY_ALL || family == rule.Family || (family == netlink.FAMILY_V4 && rule.Family == 0) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
 }
 
 func (d *MockNetlinkDataplane) RuleAdd(rule *netlink.Rule) error {
+	if err := d.simulateCall("RuleAdd", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -536,10 +779,19 @@ func (d *MockNetlinkDataplane) RuleAdd(rule *netlink.Rule) error {
 	if d.shouldFail(FailNextRuleAdd) {
 		return SimulatedError
 	}
+	if d.shouldFail(FailNextRuleAddExists) {
+		return AlreadyExistsError
+	}
+	if d.shouldFail(FailNextRuleAddRace) {
+		d.Rules = append(d.Rules, *rule)
+		return syscall.EEXIST
+	}
+	if d.shouldFail(FailNextRuleAddRaceConflict) {
+		return syscall.EEXIST
+	}
 
 	for _, existing := range d.Rules {
-		if existing.Priority == rule.Priority && existing.Table == rule.Table &&
-			existing.Mark == rule.Mark && existing.Mask == rule.Mask {
+		if !d.AllowDuplicateRules && rulesMatch(existing, *rule) {
 			return AlreadyExistsError
 		}
 	}
@@ -548,7 +800,28 @@ func (d *MockNetlinkDataplane) RuleAdd(rule *netlink.Rule) error {
 	return nil
 }
 
+// rulesMatch returns true if the rules have the same priority, table, selectors and suppression, in which case the
+// kernel rejects the second rule as a duplicate.
+func rulesMatch(a, b netlink.Rule) bool {
+	return a.Priority == b.Priority && a.Table == b.Table && a.Mark == b.Mark && a.Mask == b.Mask &&
+		a.Invert == b.Invert && ipNetString(a.Src) == ipNetString(b.Src) && ipNetString(a.Dst) == ipNetString(b.Dst) &&
+		a.IifName == b.IifName && a.SuppressPrefixlen == b.SuppressPrefixlen
+}
+
+// ipNetString returns the string form of an optional CIDR, so that CIDRs are compared regardless of the length of the
+// IP.
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
+
 func (d *MockNetlinkDataplane) RuleDel(rule *netlink.Rule) error {
+	if err := d.simulateCall("RuleDel", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -558,28 +831,29 @@ func (d *MockNetlinkDataplane) RuleDel(rule *netlink.Rule) error {
 	if d.shouldFail(FailNextRuleDel) {
 		return SimulatedError
 	}
+	raced := d.shouldFail(FailNextRuleDelRace)
 
-	var offset int
+	// As with the kernel, only the first matching rule is deleted.
 	for idx, existing := range d.Rules {
 		log.Debugf("Compare rule %#v against %#v", existing, *rule)
 		if reflect.DeepEqual(existing, *rule) {
-			offset++
-			continue
-		}
-		if offset > 0 {
-			d.Rules[idx-offset] = d.Rules[idx]
+			d.Rules = append(d.Rules[:idx:idx], d.Rules[idx+1:]...)
+			if raced {
+				return syscall.ENOENT
+			}
+			d.DeletedRules = append(d.DeletedRules, *rule)
+			return nil
 		}
 	}
-	if offset == 0 {
-		return NotFoundError
-	}
-	d.Rules = d.Rules[:len(d.Rules)-offset]
-	d.DeletedRules = append(d.DeletedRules, *rule)
 
-	return nil
+	return NotFoundError
 }
 
 func (d *MockNetlinkDataplane) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	if err := d.simulateCall("RouteListFiltered", true); err != nil {
+		return nil, err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -605,8 +879,10 @@ func (d *MockNetlinkDataplane) RouteListFiltered(family int, filter *netlink.Rou
 			log.Debug("Does not match main table")
 			continue
 		}
-		if filter != nil && filterMask&netlink.RT_FILTER_TABLE != 0 && route.Table != filter.Table {
-			// Filtering by table and table indices do not match.
+		if filter != nil && filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != unix.RT_TABLE_UNSPEC &&
+			route.Table != filter.Table {
+			// Filtering by table and table indices do not match. Filtering by the unspecified table includes all of
+			// the tables.
 			log.Debugf("Does not match table %d", filter.Table)
 			continue
 		}
@@ -625,12 +901,116 @@ func (d *MockNetlinkDataplane) AddMockRoute(route *netlink.Route) {
 	d.RouteKeyToRoute[key] = r
 }
 
+// RouteLookup simulates the policy routing of a packet by the kernel, returning the route used for the packet to the
+// destination, from the source and incoming interface if set, and with the firewall mark. It returns nil if there is
+// no route. The rules of the dataplane are evaluated in order of priority against the routes of the routes dataplane,
+// which may be the same dataplane. The lookup continues with the next rule if the table of a rule has no route to the
+// destination, if the route is a throw route, or if the prefix length of the route is suppressed by the rule. Only the
+// rule selectors used by felix are supported.
+func (d *MockNetlinkDataplane) RouteLookup(
+	routes *MockNetlinkDataplane, dst, src ip.Addr, iifName string, mark int,
+) *netlink.Route {
+	d.mutex.Lock()
+	rules := append([]netlink.Rule(nil), d.Rules...)
+	d.mutex.Unlock()
+
+	// As with the kernel, rules with the same priority are evaluated in the order they were added.
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	for _, rule := range rules {
+		if !ruleSelects(rule, dst, src, iifName, mark) {
+			continue
+		}
+		route := routes.lookupTable(rule.Table, dst)
+		if route == nil || route.Type == syscall.RTN_THROW {
+			continue
+		}
+		if prefixLen, _ := route.Dst.Mask.Size(); prefixLen <= suppressPrefixLen(rule) {
+			continue
+		}
+		return route
+	}
+	return nil
+}
+
+// suppressPrefixLen returns the suppress_prefixlength of the rule, or -1 if it is not set. The rules that are not
+// created with netlink.NewRule, such as the default rules of the mock, have a zero mark and mask, and their zero
+// suppress_prefixlength is treated as not set.
+func suppressPrefixLen(rule netlink.Rule) int {
+	if rule.Mark == 0 && rule.Mask == 0 {
+		return -1
+	}
+	return rule.SuppressPrefixlen
+}
+
+// ruleSelects returns true if the rule selects the packet, see RouteLookup.
+func ruleSelects(rule netlink.Rule, dst, src ip.Addr, iifName string, mark int) bool {
+	family := rule.Family
+	if family == 0 {
+		family = netlink.FAMILY_V4
+	}
+	if (family == netlink.FAMILY_V4) != (dst.Version() == 4) {
+		return false
+	}
+	selects := (rule.Src == nil || (src != nil && rule.Src.Contains(src.AsNetIP()))) &&
+		(rule.Dst == nil || rule.Dst.Contains(dst.AsNetIP())) &&
+		(rule.IifName == "" || rule.IifName == iifName)
+	if rule.Mark > 0 || rule.Mask > 0 {
+		ruleMark, mask := uint32(0), uint32(0xffffffff)
+		if rule.Mark > 0 {
+			ruleMark = uint32(rule.Mark)
+		}
+		if rule.Mask > 0 {
+			mask = uint32(rule.Mask)
+		}
+		selects = selects && (uint32(mark)^ruleMark)&mask == 0
+	}
+	return selects != rule.Invert
+}
+
+// lookupTable returns the route in the routing table with the longest prefix that contains the destination, or nil if
+// there is none. A route with no destination is a default route.
+func (d *MockNetlinkDataplane) lookupTable(tableIndex int, dst ip.Addr) *netlink.Route {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var best *netlink.Route
+	bestPrefixLen := -1
+	for _, route := range d.RouteKeyToRoute {
+		table := route.Table
+		if table == 0 {
+			table = unix.RT_TABLE_MAIN
+		}
+		if table != tableIndex {
+			continue
+		}
+		route := route
+		if route.Dst == nil {
+			route.Dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+			if dst.Version() == 6 {
+				route.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+			}
+		}
+		prefixLen, bits := route.Dst.Mask.Size()
+		if bits != 8*len(dst.AsNetIP()) || !route.Dst.Contains(dst.AsNetIP()) || prefixLen <= bestPrefixLen {
+			continue
+		}
+		best, bestPrefixLen = &route, prefixLen
+	}
+	return best
+}
+
 func (d *MockNetlinkDataplane) RemoveMockRoute(route *netlink.Route) {
 	key := KeyForRoute(route)
 	delete(d.RouteKeyToRoute, key)
 }
 
 func (d *MockNetlinkDataplane) RouteAdd(route *netlink.Route) error {
+	if err := d.simulateCall("RouteAdd", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -640,8 +1020,19 @@ func (d *MockNetlinkDataplane) RouteAdd(route *netlink.Route) error {
 		return SimulatedError
 	}
 	key := KeyForRoute(route)
+	if d.shouldFail(FailNextRouteAddRace) {
+		d.RouteKeyToRoute[key] = *route
+		return syscall.EEXIST
+	}
+	if d.shouldFail(FailNextRouteAddRaceConflict) {
+		conflicting := *route
+		conflicting.Protocol = syscall.RTPROT_STATIC
+		d.RouteKeyToRoute[key] = conflicting
+		return syscall.EEXIST
+	}
 	log.WithField("routeKey", key).Info("Mock dataplane: RouteAdd called")
 	d.AddedRouteKeys.Add(key)
+	d.AddedRouteKeyOrder = append(d.AddedRouteKeyOrder, key)
 	if _, ok := d.RouteKeyToRoute[key]; ok {
 		return AlreadyExistsError
 	} else {
@@ -655,7 +1046,50 @@ func (d *MockNetlinkDataplane) RouteAdd(route *netlink.Route) error {
 	}
 }
 
+// RouteReplace adds the route, replacing any existing route with the same key. As with the kernel, a route to another
+// interface with the same destination and priority is also replaced.
+func (d *MockNetlinkDataplane) RouteReplace(route *netlink.Route) error {
+	if err := d.simulateCall("RouteReplace", true); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	defer GinkgoRecover()
+
+	Expect(d.NetlinkOpen).To(BeTrue())
+	if d.shouldFail(FailNextRouteAdd) || d.shouldFail(FailNextRouteReplace) {
+		return SimulatedError
+	}
+	key := KeyForRoute(route)
+	log.WithField("routeKey", key).Info("Mock dataplane: RouteReplace called")
+	d.AddedRouteKeys.Add(key)
+	d.AddedRouteKeyOrder = append(d.AddedRouteKeyOrder, key)
+	if _, ok := d.RouteKeyToRoute[key]; ok {
+		d.UpdatedRouteKeys.Add(key)
+	}
+	r := *route
+	if r.Table == unix.RT_TABLE_MAIN {
+		// Store main table routes with 0 index for simplicity of comparison.
+		r.Table = 0
+	}
+	for existingKey, existing := range d.RouteKeyToRoute {
+		if existingKey != key && existing.Table == r.Table && existing.Priority == r.Priority &&
+			existing.Dst.String() == r.Dst.String() {
+			log.WithField("routeKey", existingKey).Info("Mock dataplane: RouteReplace replaced route to other interface")
+			delete(d.RouteKeyToRoute, existingKey)
+			d.UpdatedRouteKeys.Add(key)
+		}
+	}
+	d.RouteKeyToRoute[key] = r
+	return nil
+}
+
 func (d *MockNetlinkDataplane) RouteDel(route *netlink.Route) error {
+	if err := d.simulateCall("RouteDel", true); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
@@ -665,8 +1099,21 @@ func (d *MockNetlinkDataplane) RouteDel(route *netlink.Route) error {
 		return SimulatedError
 	}
 	key := KeyForRoute(route)
+	if d.shouldFail(FailNextRouteDelRace) {
+		delete(d.RouteKeyToRoute, key)
+		return syscall.ESRCH
+	}
+	if d.shouldFail(FailNextRouteDelRaceConflict) {
+		return syscall.ESRCH
+	}
 	log.WithField("routeKey", key).Info("Mock dataplane: RouteDel called")
 	d.DeletedRouteKeys.Add(key)
+	d.DeletedRouteKeyOrder = append(d.DeletedRouteKeyOrder, key)
+	// Mimic the kernel - if a protocol is specified, only a route with that protocol is deleted.
+	if existing, ok := d.RouteKeyToRoute[key]; ok && route.Protocol != 0 && existing.Protocol != route.Protocol {
+		log.WithField("routeKey", key).Info("Mock dataplane: RouteDel protocol does not match")
+		return nil
+	}
 	// Route was deleted, but is planned on being readded
 	if _, ok := d.RouteKeyToRoute[key]; ok {
 		delete(d.RouteKeyToRoute, key)
@@ -714,6 +1161,29 @@ func (d *MockNetlinkDataplane) RemoveConntrackFlows(ipVersion uint8, ipAddr net.
 
 // ----- Internals -----
 
+// simulateCall records a call and sleeps for the latency configured for the call. If the call is subject to the socket
+// timeout and the latency exceeds it, this only sleeps until the timeout and returns EAGAIN. This is called before the
+// mutex is taken, so that other calls may proceed concurrently.
+func (d *MockNetlinkDataplane) simulateCall(name string, socketTimeout bool) error {
+	d.mutex.Lock()
+	d.Calls = append(d.Calls, name)
+	latency := d.CallLatency[name]
+	timeout := d.SocketTimeout
+	clock, step := d.CallClock, d.CallClockSteps[name]
+	d.mutex.Unlock()
+
+	if clock != nil {
+		clock.IncrementTime(step)
+	}
+
+	if socketTimeout && timeout > 0 && latency > timeout {
+		time.Sleep(timeout)
+		return unix.EAGAIN
+	}
+	time.Sleep(latency)
+	return nil
+}
+
 func (d *MockNetlinkDataplane) shouldFail(flag FailFlags) bool {
 	flagPresent := d.FailuresToSimulate&flag != 0
 	if !d.PersistFailures {
@@ -731,6 +1201,11 @@ func KeyForRoute(route *netlink.Route) string {
 		table = unix.RT_TABLE_MAIN
 	}
 	key := fmt.Sprintf("%v-%v-%v", table, route.LinkIndex, route.Dst)
+	if route.Priority != 0 {
+		// Routes for the same destination with different priorities may coexist. The priority is only included when
+		// set so that the keys of routes without a priority are unchanged.
+		key = fmt.Sprintf("%v-%v", key, route.Priority)
+	}
 	log.WithField("routeKey", key).Debug("Calculated route key")
 	return key
 }
@@ -747,6 +1222,20 @@ type MockLink struct {
 	WireguardPeers        map[wgtypes.Key]wgtypes.Peer
 }
 
+// LocalRouteForAddr returns the route that the kernel adds to the local routing table for an address of the link.
+func LocalRouteForAddr(link *MockLink, addr *netlink.Addr) netlink.Route {
+	dst := ip.FromNetIP(addr.IP).AsCIDR().ToIPNet()
+	return netlink.Route{
+		LinkIndex: link.LinkAttrs.Index,
+		Dst:       &dst,
+		Src:       addr.IP,
+		Table:     unix.RT_TABLE_LOCAL,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+		Protocol:  unix.RTPROT_KERNEL,
+	}
+}
+
 func (l *MockLink) Attrs() *netlink.LinkAttrs {
 	return &l.LinkAttrs
 }
@@ -1,7 +1,9 @@
 package mock
 
 import (
+	"net"
 	"sort"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -59,6 +61,73 @@ func (d *MockNetlinkDataplane) NewMockWireguard() (netlinkshim.Wireguard, error)
 	return d, nil
 }
 
+// SetWireguardPeerKernelState sets the endpoint and last handshake time of a programmed wireguard peer, as learned by
+// the kernel from the peer's handshakes. The endpoint may differ from the configured endpoint, e.g. if the peer is
+// behind NAT.
+func (d *MockNetlinkDataplane) SetWireguardPeerKernelState(
+	name string, publicKey wgtypes.Key, endpoint *net.UDPAddr, lastHandshakeTime time.Time,
+) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	link, ok := d.NameToLink[name]
+	Expect(ok).To(BeTrue())
+	peer, ok := link.WireguardPeers[publicKey]
+	Expect(ok).To(BeTrue())
+	peer.Endpoint = endpoint
+	peer.LastHandshakeTime = lastHandshakeTime
+	link.WireguardPeers[publicKey] = peer
+}
+
+// SetWireguardPrivateKey sets the private key of a wireguard link out of band, e.g. as with `wg set private-key`.
+func (d *MockNetlinkDataplane) SetWireguardPrivateKey(name string, privateKey wgtypes.Key) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	link, ok := d.NameToLink[name]
+	Expect(ok).To(BeTrue())
+	link.WireguardPrivateKey = privateKey
+	link.WireguardPublicKey = privateKey.PublicKey()
+}
+
+// WireguardPeerHandshake simulates a handshake with a programmed wireguard peer, setting the last handshake time of the
+// peer to the current time of the mock dataplane clock.
+func (d *MockNetlinkDataplane) WireguardPeerHandshake(name string, publicKey wgtypes.Key) {
+	d.updateWireguardPeer(name, publicKey, func(peer *wgtypes.Peer) {
+		peer.LastHandshakeTime = d.now()
+	})
+}
+
+// AddWireguardPeerTraffic simulates traffic to and from a programmed wireguard peer, adding to the byte counters of the
+// peer.
+func (d *MockNetlinkDataplane) AddWireguardPeerTraffic(
+	name string, publicKey wgtypes.Key, receiveBytes, transmitBytes int64,
+) {
+	d.updateWireguardPeer(name, publicKey, func(peer *wgtypes.Peer) {
+		peer.ReceiveBytes += receiveBytes
+		peer.TransmitBytes += transmitBytes
+	})
+}
+
+func (d *MockNetlinkDataplane) updateWireguardPeer(name string, publicKey wgtypes.Key, update func(peer *wgtypes.Peer)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	link, ok := d.NameToLink[name]
+	Expect(ok).To(BeTrue())
+	peer, ok := link.WireguardPeers[publicKey]
+	Expect(ok).To(BeTrue())
+	update(&peer)
+	link.WireguardPeers[publicKey] = peer
+}
+
+func (d *MockNetlinkDataplane) now() time.Time {
+	if d.Time == nil {
+		return time.Now()
+	}
+	return d.Time.Now()
+}
+
 // ----- Wireguard API -----
 
 func (d *MockNetlinkDataplane) Close() error {
@@ -76,25 +145,41 @@ func (d *MockNetlinkDataplane) Close() error {
 }
 
 func (d *MockNetlinkDataplane) DeviceByName(name string) (*wgtypes.Device, error) {
+	if err := d.simulateCall("DeviceByName", false); err != nil {
+		return nil, err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
 
+	d.NumWireguardDeviceReads++
+
 	Expect(d.WireguardOpen).To(BeTrue())
 	if d.shouldFail(FailNextWireguardDeviceByName) {
 		return nil, SimulatedError
 	}
+	if last, ok := d.lastWireguardDevices[name]; ok && d.shouldFail(FailNextWireguardDeviceByNameStale) {
+		// Return the data of the previous read, e.g. counters that have not been updated since.
+		device := last
+		device.Peers = append([]wgtypes.Peer(nil), last.Peers...)
+		return &device, nil
+	}
 	link, ok := d.NameToLink[name]
 	if !ok {
 		return nil, NotFoundError
 	}
-	if link.Type() != "wireguard" {
+	deviceType := wgtypes.LinuxKernel
+	if link.Type() == "tun" {
+		// A tun device is treated as a userspace wireguard device.
+		deviceType = wgtypes.Userspace
+	} else if link.Type() != "wireguard" {
 		return nil, FileDoesNotExistError
 	}
 
 	device := &wgtypes.Device{
 		Name:         name,
-		Type:         wgtypes.LinuxKernel,
+		Type:         deviceType,
 		PrivateKey:   link.WireguardPrivateKey,
 		PublicKey:    link.WireguardPublicKey,
 		ListenPort:   link.WireguardListenPort,
@@ -103,19 +188,52 @@ func (d *MockNetlinkDataplane) DeviceByName(name string) (*wgtypes.Device, error
 	for _, peer := range link.WireguardPeers {
 		device.Peers = append(device.Peers, peer)
 	}
+	if d.shouldFail(FailNextWireguardDeviceByNamePartial) {
+		// Return the peers found before the read was interrupted. The partial read is not the last read of the device.
+		device.Peers = device.Peers[:len(device.Peers)/2]
+		return device, nil
+	}
+
+	if d.lastWireguardDevices == nil {
+		d.lastWireguardDevices = map[string]wgtypes.Device{}
+	}
+	last := *device
+	last.Peers = append([]wgtypes.Peer(nil), device.Peers...)
+	d.lastWireguardDevices[name] = last
 
 	return device, nil
 }
 
 func (d *MockNetlinkDataplane) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if err := d.simulateCall("ConfigureDevice", false); err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	defer GinkgoRecover()
 
+	d.NumWireguardDeviceConfigures++
+	numAllowedIPs := 0
+	for _, peerCfg := range cfg.Peers {
+		numAllowedIPs += len(peerCfg.AllowedIPs)
+	}
+	d.WireguardConfigureAllowedIPs = append(d.WireguardConfigureAllowedIPs, numAllowedIPs)
+	d.WireguardConfigurePeers = append(d.WireguardConfigurePeers, append([]wgtypes.PeerConfig(nil), cfg.Peers...))
+
 	Expect(d.WireguardOpen).To(BeTrue())
 	if d.shouldFail(FailNextWireguardConfigureDevice) {
 		return SimulatedError
 	}
+	if d.FailWireguardConfigureCall > 0 && d.NumWireguardDeviceConfigures == d.FailWireguardConfigureCall {
+		return SimulatedError
+	}
+	if d.MaxPeersPerWireguardConfigure > 0 && len(cfg.Peers) > d.MaxPeersPerWireguardConfigure {
+		return NoBufferSpaceError
+	}
+	if d.MaxAllowedIPsPerWireguardConfigure > 0 && numAllowedIPs > d.MaxAllowedIPsPerWireguardConfigure {
+		return NoBufferSpaceError
+	}
 	link, ok := d.NameToLink[name]
 	if !ok {
 		return NotFoundError
@@ -132,6 +250,7 @@ func (d *MockNetlinkDataplane) ConfigureDevice(name string, cfg wgtypes.Config)
 	if cfg.PrivateKey != nil {
 		link.WireguardPrivateKey = *cfg.PrivateKey
 		link.WireguardPublicKey = link.WireguardPrivateKey.PublicKey()
+		d.ConfiguredWireguardPrivateKeys = append(d.ConfiguredWireguardPrivateKeys, *cfg.PrivateKey)
 		d.WireguardConfigUpdated = true
 	}
 	if cfg.ReplacePeers || len(cfg.Peers) > 0 {
@@ -143,6 +262,7 @@ func (d *MockNetlinkDataplane) ConfigureDevice(name string, cfg wgtypes.Config)
 		}
 		for _, peerCfg := range cfg.Peers {
 			d.WireguardConfigUpdated = true
+			d.ConfiguredWireguardPeers.Add(peerCfg.PublicKey)
 			Expect(peerCfg.PublicKey).NotTo(Equal(wgtypes.Key{}))
 			if peerCfg.UpdateOnly {
 				_, ok := existing[peerCfg.PublicKey]
@@ -65,6 +65,7 @@
 		VXLANTunnelEndpointRemove
 		WireguardEndpointUpdate
 		WireguardEndpointRemove
+		WireguardKeyConflict
 */
 package proto
 
@@ -244,6 +245,7 @@ type ToDataplane struct {
 	//	*ToDataplane_VtepRemove
 	//	*ToDataplane_WireguardEndpointUpdate
 	//	*ToDataplane_WireguardEndpointRemove
+	//	*ToDataplane_WireguardKeyConflict
 	Payload isToDataplane_Payload `protobuf_oneof:"payload"`
 }
 
@@ -339,6 +341,9 @@ type ToDataplane_WireguardEndpointUpdate struct {
 type ToDataplane_WireguardEndpointRemove struct {
 	WireguardEndpointRemove *WireguardEndpointRemove `protobuf:"bytes,28,opt,name=wireguard_endpoint_remove,json=wireguardEndpointRemove,oneof"`
 }
+type ToDataplane_WireguardKeyConflict struct {
+	WireguardKeyConflict *WireguardKeyConflict `protobuf:"bytes,29,opt,name=wireguard_key_conflict,json=wireguardKeyConflict,oneof"`
+}
 
 func (*ToDataplane_InSync) isToDataplane_Payload()                  {}
 func (*ToDataplane_IpsetUpdate) isToDataplane_Payload()             {}
@@ -367,6 +372,7 @@ func (*ToDataplane_VtepUpdate) isToDataplane_Payload()              {}
 func (*ToDataplane_VtepRemove) isToDataplane_Payload()              {}
 func (*ToDataplane_WireguardEndpointUpdate) isToDataplane_Payload() {}
 func (*ToDataplane_WireguardEndpointRemove) isToDataplane_Payload() {}
+func (*ToDataplane_WireguardKeyConflict) isToDataplane_Payload()    {}
 
 func (m *ToDataplane) GetPayload() isToDataplane_Payload {
 	if m != nil {
@@ -571,6 +577,13 @@ func (m *ToDataplane) GetWireguardEndpointRemove() *WireguardEndpointRemove {
 	return nil
 }
 
+func (m *ToDataplane) GetWireguardKeyConflict() *WireguardKeyConflict {
+	if x, ok := m.GetPayload().(*ToDataplane_WireguardKeyConflict); ok {
+		return x.WireguardKeyConflict
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*ToDataplane) XXX_OneofFuncs() (func(msg proto1.Message, b *proto1.Buffer) error, func(msg proto1.Message, tag, wire int, b *proto1.Buffer) (bool, error), func(msg proto1.Message) (n int), []interface{}) {
 	return _ToDataplane_OneofMarshaler, _ToDataplane_OneofUnmarshaler, _ToDataplane_OneofSizer, []interface{}{
@@ -601,6 +614,7 @@ func (*ToDataplane) XXX_OneofFuncs() (func(msg proto1.Message, b *proto1.Buffer)
 		(*ToDataplane_VtepRemove)(nil),
 		(*ToDataplane_WireguardEndpointUpdate)(nil),
 		(*ToDataplane_WireguardEndpointRemove)(nil),
+		(*ToDataplane_WireguardKeyConflict)(nil),
 	}
 }
 
@@ -743,6 +757,11 @@ func _ToDataplane_OneofMarshaler(msg proto1.Message, b *proto1.Buffer) error {
 		if err := b.EncodeMessage(x.WireguardEndpointRemove); err != nil {
 			return err
 		}
+	case *ToDataplane_WireguardKeyConflict:
+		_ = b.EncodeVarint(29<<3 | proto1.WireBytes)
+		if err := b.EncodeMessage(x.WireguardKeyConflict); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("ToDataplane.Payload has unexpected type %T", x)
@@ -969,6 +988,14 @@ func _ToDataplane_OneofUnmarshaler(msg proto1.Message, tag, wire int, b *proto1.
 		err := b.DecodeMessage(msg)
 		m.Payload = &ToDataplane_WireguardEndpointRemove{msg}
 		return true, err
+	case 29: // payload.wireguard_key_conflict
+		if wire != proto1.WireBytes {
+			return true, proto1.ErrInternalBadWireType
+		}
+		msg := new(WireguardKeyConflict)
+		err := b.DecodeMessage(msg)
+		m.Payload = &ToDataplane_WireguardKeyConflict{msg}
+		return true, err
 	default:
 		return false, nil
 	}
@@ -1113,6 +1140,11 @@ func _ToDataplane_OneofSizer(msg proto1.Message) (n int) {
 		n += proto1.SizeVarint(28<<3 | proto1.WireBytes)
 		n += proto1.SizeVarint(uint64(s))
 		n += s
+	case *ToDataplane_WireguardKeyConflict:
+		s := proto1.Size(x.WireguardKeyConflict)
+		n += proto1.SizeVarint(29<<3 | proto1.WireBytes)
+		n += proto1.SizeVarint(uint64(s))
+		n += s
 	case nil:
 	default:
 		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
@@ -2944,6 +2976,22 @@ func (m *WorkloadEndpointStatusRemove) GetId() *WorkloadEndpointID {
 type WireguardStatusUpdate struct {
 	// Wireguard public-key set on the interface.
 	PublicKey string `protobuf:"bytes,1,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	// The listening port programmed on the interface.
+	ListeningPort int32 `protobuf:"varint,2,opt,name=listening_port,json=listeningPort,proto3" json:"listening_port,omitempty"`
+	// The name of the wireguard interface.
+	InterfaceName string `protobuf:"bytes,3,opt,name=interface_name,json=interfaceName,proto3" json:"interface_name,omitempty"`
+	// The IPv4 address of the wireguard interface, if chosen by the dataplane. If empty, the address is not updated.
+	InterfaceAddr string `protobuf:"bytes,4,opt,name=interface_addr,json=interfaceAddr,proto3" json:"interface_addr,omitempty"`
+	// The index of the wireguard routing table, which may have been chosen by the dataplane.
+	RoutingTableIndex int32 `protobuf:"varint,5,opt,name=routing_table_index,json=routingTableIndex,proto3" json:"routing_table_index,omitempty"`
+	// The previous public key of the interface, while the peers may still use it after the key has changed.
+	PreviousPublicKey string `protobuf:"bytes,6,opt,name=previous_public_key,json=previousPublicKey,proto3" json:"previous_public_key,omitempty"`
+	// The time until which the peers may use the previous public key, in seconds since the Unix epoch.
+	PreviousKeyDeadline int64 `protobuf:"varint,7,opt,name=previous_key_deadline,json=previousKeyDeadline,proto3" json:"previous_key_deadline,omitempty"`
+	// The state of the public key, e.g. "published", or "disabled" if the key is withdrawn because wireguard is disabled.
+	KeyState string `protobuf:"bytes,8,opt,name=key_state,json=keyState,proto3" json:"key_state,omitempty"`
+	// What determines whether wireguard is enabled, "config" or "node-override".
+	EnabledSource string `protobuf:"bytes,9,opt,name=enabled_source,json=enabledSource,proto3" json:"enabled_source,omitempty"`
 }
 
 func (m *WireguardStatusUpdate) Reset()         { *m = WireguardStatusUpdate{} }
@@ -2960,9 +3008,71 @@ func (m *WireguardStatusUpdate) GetPublicKey() string {
 	return ""
 }
 
+func (m *WireguardStatusUpdate) GetListeningPort() int32 {
+	if m != nil {
+		return m.ListeningPort
+	}
+	return 0
+}
+
+func (m *WireguardStatusUpdate) GetInterfaceName() string {
+	if m != nil {
+		return m.InterfaceName
+	}
+	return ""
+}
+
+func (m *WireguardStatusUpdate) GetInterfaceAddr() string {
+	if m != nil {
+		return m.InterfaceAddr
+	}
+	return ""
+}
+
+func (m *WireguardStatusUpdate) GetRoutingTableIndex() int32 {
+	if m != nil {
+		return m.RoutingTableIndex
+	}
+	return 0
+}
+
+func (m *WireguardStatusUpdate) GetPreviousPublicKey() string {
+	if m != nil {
+		return m.PreviousPublicKey
+	}
+	return ""
+}
+
+func (m *WireguardStatusUpdate) GetPreviousKeyDeadline() int64 {
+	if m != nil {
+		return m.PreviousKeyDeadline
+	}
+	return 0
+}
+
+func (m *WireguardStatusUpdate) GetKeyState() string {
+	if m != nil {
+		return m.KeyState
+	}
+	return ""
+}
+
+func (m *WireguardStatusUpdate) GetEnabledSource() string {
+	if m != nil {
+		return m.EnabledSource
+	}
+	return ""
+}
+
 type HostMetadataUpdate struct {
 	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
 	Ipv4Addr string `protobuf:"bytes,2,opt,name=ipv4_addr,json=ipv4Addr,proto3" json:"ipv4_addr,omitempty"`
+	// An optional secondary IPv4 address of the host, used to reach the host if its primary address is unreachable,
+	// e.g. when the hosts are in different networks.
+	Ipv4SecondaryAddr string `protobuf:"bytes,3,opt,name=ipv4_secondary_addr,json=ipv4SecondaryAddr,proto3" json:"ipv4_secondary_addr,omitempty"`
+	// An optional override of whether wireguard is enabled on the host, "Enabled" or "Disabled", or empty to follow the
+	// felix configuration.
+	WireguardEnabledOverride string `protobuf:"bytes,4,opt,name=wireguard_enabled_override,json=wireguardEnabledOverride,proto3" json:"wireguard_enabled_override,omitempty"`
 }
 
 func (m *HostMetadataUpdate) Reset()                    { *m = HostMetadataUpdate{} }
@@ -2984,6 +3094,20 @@ func (m *HostMetadataUpdate) GetIpv4Addr() string {
 	return ""
 }
 
+func (m *HostMetadataUpdate) GetIpv4SecondaryAddr() string {
+	if m != nil {
+		return m.Ipv4SecondaryAddr
+	}
+	return ""
+}
+
+func (m *HostMetadataUpdate) GetWireguardEnabledOverride() string {
+	if m != nil {
+		return m.WireguardEnabledOverride
+	}
+	return ""
+}
+
 type HostMetadataRemove struct {
 	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
 	Ipv4Addr string `protobuf:"bytes,2,opt,name=ipv4_addr,json=ipv4Addr,proto3" json:"ipv4_addr,omitempty"`
@@ -3353,6 +3477,16 @@ type WireguardEndpointUpdate struct {
 	PublicKey string `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
 	// The IP address of the wireguard interface.
 	InterfaceAddr string `protobuf:"bytes,3,opt,name=interface_addr,json=interfaceAddr,proto3" json:"interface_addr,omitempty"`
+	// Whether the host is ready to receive wireguard traffic.
+	Ready bool `protobuf:"varint,4,opt,name=ready,proto3" json:"ready,omitempty"`
+	// The listening port of the wireguard interface. If zero, the locally configured port is used.
+	ListeningPort int32 `protobuf:"varint,5,opt,name=listening_port,json=listeningPort,proto3" json:"listening_port,omitempty"`
+	// The previous public key of this endpoint, which may still be used until the deadline.
+	PreviousPublicKey string `protobuf:"bytes,6,opt,name=previous_public_key,json=previousPublicKey,proto3" json:"previous_public_key,omitempty"`
+	// The time until which the previous public key may be used, in seconds since the Unix epoch.
+	PreviousKeyDeadline int64 `protobuf:"varint,7,opt,name=previous_key_deadline,json=previousKeyDeadline,proto3" json:"previous_key_deadline,omitempty"`
+	// Whether traffic to this host is excluded from encryption by policy.
+	EncryptionOptOut bool `protobuf:"varint,8,opt,name=encryption_opt_out,json=encryptionOptOut,proto3" json:"encryption_opt_out,omitempty"`
 }
 
 func (m *WireguardEndpointUpdate) Reset()         { *m = WireguardEndpointUpdate{} }
@@ -3383,6 +3517,41 @@ func (m *WireguardEndpointUpdate) GetInterfaceAddr() string {
 	return ""
 }
 
+func (m *WireguardEndpointUpdate) GetReady() bool {
+	if m != nil {
+		return m.Ready
+	}
+	return false
+}
+
+func (m *WireguardEndpointUpdate) GetListeningPort() int32 {
+	if m != nil {
+		return m.ListeningPort
+	}
+	return 0
+}
+
+func (m *WireguardEndpointUpdate) GetPreviousPublicKey() string {
+	if m != nil {
+		return m.PreviousPublicKey
+	}
+	return ""
+}
+
+func (m *WireguardEndpointUpdate) GetPreviousKeyDeadline() int64 {
+	if m != nil {
+		return m.PreviousKeyDeadline
+	}
+	return 0
+}
+
+func (m *WireguardEndpointUpdate) GetEncryptionOptOut() bool {
+	if m != nil {
+		return m.EncryptionOptOut
+	}
+	return false
+}
+
 type WireguardEndpointRemove struct {
 	// The name of the wireguard host.
 	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
@@ -3402,6 +3571,34 @@ func (m *WireguardEndpointRemove) GetHostname() string {
 	return ""
 }
 
+type WireguardKeyConflict struct {
+	// The public key reported in the WireguardStatusUpdate.
+	PublicKey string `protobuf:"bytes,1,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	// The conflicting public key stored for the host in the datastore.
+	StoredPublicKey string `protobuf:"bytes,2,opt,name=stored_public_key,json=storedPublicKey,proto3" json:"stored_public_key,omitempty"`
+}
+
+func (m *WireguardKeyConflict) Reset()         { *m = WireguardKeyConflict{} }
+func (m *WireguardKeyConflict) String() string { return proto1.CompactTextString(m) }
+func (*WireguardKeyConflict) ProtoMessage()    {}
+func (*WireguardKeyConflict) Descriptor() ([]byte, []int) {
+	return fileDescriptorFelixbackend, []int{57}
+}
+
+func (m *WireguardKeyConflict) GetPublicKey() string {
+	if m != nil {
+		return m.PublicKey
+	}
+	return ""
+}
+
+func (m *WireguardKeyConflict) GetStoredPublicKey() string {
+	if m != nil {
+		return m.StoredPublicKey
+	}
+	return ""
+}
+
 func init() {
 	proto1.RegisterType((*SyncRequest)(nil), "felix.SyncRequest")
 	proto1.RegisterType((*ToDataplane)(nil), "felix.ToDataplane")
@@ -3461,6 +3658,7 @@ func init() {
 	proto1.RegisterType((*VXLANTunnelEndpointRemove)(nil), "felix.VXLANTunnelEndpointRemove")
 	proto1.RegisterType((*WireguardEndpointUpdate)(nil), "felix.WireguardEndpointUpdate")
 	proto1.RegisterType((*WireguardEndpointRemove)(nil), "felix.WireguardEndpointRemove")
+	proto1.RegisterType((*WireguardKeyConflict)(nil), "felix.WireguardKeyConflict")
 	proto1.RegisterEnum("felix.IPVersion", IPVersion_name, IPVersion_value)
 	proto1.RegisterEnum("felix.RouteType", RouteType_name, RouteType_value)
 	proto1.RegisterEnum("felix.IPPoolType", IPPoolType_name, IPPoolType_value)
@@ -4056,6 +4254,22 @@ func (m *ToDataplane_WireguardEndpointRemove) MarshalTo(dAtA []byte) (int, error
 	}
 	return i, nil
 }
+func (m *ToDataplane_WireguardKeyConflict) MarshalTo(dAtA []byte) (int, error) {
+	i := 0
+	if m.WireguardKeyConflict != nil {
+		dAtA[i] = 0xea
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.WireguardKeyConflict.Size()))
+		n29, err := m.WireguardKeyConflict.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n29
+	}
+	return i, nil
+}
 func (m *FromDataplane) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -6073,6 +6287,51 @@ func (m *WireguardStatusUpdate) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.PublicKey)))
 		i += copy(dAtA[i:], m.PublicKey)
 	}
+	if m.ListeningPort != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.ListeningPort))
+	}
+	if len(m.InterfaceName) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.InterfaceName)))
+		i += copy(dAtA[i:], m.InterfaceName)
+	}
+	if len(m.InterfaceAddr) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.InterfaceAddr)))
+		i += copy(dAtA[i:], m.InterfaceAddr)
+	}
+	if m.RoutingTableIndex != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.RoutingTableIndex))
+	}
+	if len(m.PreviousPublicKey) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.PreviousPublicKey)))
+		i += copy(dAtA[i:], m.PreviousPublicKey)
+	}
+	if m.PreviousKeyDeadline != 0 {
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.PreviousKeyDeadline))
+	}
+	if len(m.KeyState) > 0 {
+		dAtA[i] = 0x42
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.KeyState)))
+		i += copy(dAtA[i:], m.KeyState)
+	}
+	if len(m.EnabledSource) > 0 {
+		dAtA[i] = 0x4a
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.EnabledSource)))
+		i += copy(dAtA[i:], m.EnabledSource)
+	}
 	return i, nil
 }
 
@@ -6103,6 +6362,18 @@ func (m *HostMetadataUpdate) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.Ipv4Addr)))
 		i += copy(dAtA[i:], m.Ipv4Addr)
 	}
+	if len(m.Ipv4SecondaryAddr) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.Ipv4SecondaryAddr)))
+		i += copy(dAtA[i:], m.Ipv4SecondaryAddr)
+	}
+	if len(m.WireguardEnabledOverride) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.WireguardEnabledOverride)))
+		i += copy(dAtA[i:], m.WireguardEnabledOverride)
+	}
 	return i, nil
 }
 
@@ -6627,6 +6898,42 @@ func (m *WireguardEndpointUpdate) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.InterfaceAddr)))
 		i += copy(dAtA[i:], m.InterfaceAddr)
 	}
+	if m.Ready {
+		dAtA[i] = 0x20
+		i++
+		if m.Ready {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.ListeningPort != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.ListeningPort))
+	}
+	if len(m.PreviousPublicKey) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.PreviousPublicKey)))
+		i += copy(dAtA[i:], m.PreviousPublicKey)
+	}
+	if m.PreviousKeyDeadline != 0 {
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(m.PreviousKeyDeadline))
+	}
+	if m.EncryptionOptOut {
+		dAtA[i] = 0x40
+		i++
+		if m.EncryptionOptOut {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
 	return i, nil
 }
 
@@ -6654,6 +6961,36 @@ func (m *WireguardEndpointRemove) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *WireguardKeyConflict) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *WireguardKeyConflict) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.PublicKey) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.PublicKey)))
+		i += copy(dAtA[i:], m.PublicKey)
+	}
+	if len(m.StoredPublicKey) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintFelixbackend(dAtA, i, uint64(len(m.StoredPublicKey)))
+		i += copy(dAtA[i:], m.StoredPublicKey)
+	}
+	return i, nil
+}
+
 func encodeVarintFelixbackend(dAtA []byte, offset int, v uint64) int {
 	for v >= 1<<7 {
 		dAtA[offset] = uint8(v&0x7f | 0x80)
@@ -6924,6 +7261,15 @@ func (m *ToDataplane_WireguardEndpointRemove) Size() (n int) {
 	}
 	return n
 }
+func (m *ToDataplane_WireguardKeyConflict) Size() (n int) {
+	var l int
+	_ = l
+	if m.WireguardKeyConflict != nil {
+		l = m.WireguardKeyConflict.Size()
+		n += 2 + l + sovFelixbackend(uint64(l))
+	}
+	return n
+}
 func (m *FromDataplane) Size() (n int) {
 	var l int
 	_ = l
@@ -7789,6 +8135,35 @@ func (m *WireguardStatusUpdate) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovFelixbackend(uint64(l))
 	}
+	if m.ListeningPort != 0 {
+		n += 1 + sovFelixbackend(uint64(m.ListeningPort))
+	}
+	l = len(m.InterfaceName)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	l = len(m.InterfaceAddr)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	if m.RoutingTableIndex != 0 {
+		n += 1 + sovFelixbackend(uint64(m.RoutingTableIndex))
+	}
+	l = len(m.PreviousPublicKey)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	if m.PreviousKeyDeadline != 0 {
+		n += 1 + sovFelixbackend(uint64(m.PreviousKeyDeadline))
+	}
+	l = len(m.KeyState)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	l = len(m.EnabledSource)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
 	return n
 }
 
@@ -7803,6 +8178,14 @@ func (m *HostMetadataUpdate) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovFelixbackend(uint64(l))
 	}
+	l = len(m.Ipv4SecondaryAddr)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	l = len(m.WireguardEnabledOverride)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
 	return n
 }
 
@@ -8027,6 +8410,22 @@ func (m *WireguardEndpointUpdate) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovFelixbackend(uint64(l))
 	}
+	if m.Ready {
+		n += 2
+	}
+	if m.ListeningPort != 0 {
+		n += 1 + sovFelixbackend(uint64(m.ListeningPort))
+	}
+	l = len(m.PreviousPublicKey)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	if m.PreviousKeyDeadline != 0 {
+		n += 1 + sovFelixbackend(uint64(m.PreviousKeyDeadline))
+	}
+	if m.EncryptionOptOut {
+		n += 2
+	}
 	return n
 }
 
@@ -8040,6 +8439,20 @@ func (m *WireguardEndpointRemove) Size() (n int) {
 	return n
 }
 
+func (m *WireguardKeyConflict) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.PublicKey)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	l = len(m.StoredPublicKey)
+	if l > 0 {
+		n += 1 + l + sovFelixbackend(uint64(l))
+	}
+	return n
+}
+
 func sovFelixbackend(x uint64) (n int) {
 	for {
 		n++
@@ -9015,13 +9428,45 @@ func (m *ToDataplane) Unmarshal(dAtA []byte) error {
 			}
 			m.Payload = &ToDataplane_WireguardEndpointRemove{v}
 			iNdEx = postIndex
-		default:
-			iNdEx = preIndex
-			skippy, err := skipFelixbackend(dAtA[iNdEx:])
-			if err != nil {
-				return err
+		case 29:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WireguardKeyConflict", wireType)
 			}
-			if skippy < 0 {
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			v := &WireguardKeyConflict{}
+			if err := v.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			m.Payload = &ToDataplane_WireguardKeyConflict{v}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipFelixbackend(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
 				return ErrInvalidLengthFelixbackend
 			}
 			if (iNdEx + skippy) > l {
@@ -14671,6 +15116,208 @@ func (m *WireguardStatusUpdate) Unmarshal(dAtA []byte) error {
 			}
 			m.PublicKey = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ListeningPort", wireType)
+			}
+			m.ListeningPort = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ListeningPort |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InterfaceName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.InterfaceName = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InterfaceAddr", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.InterfaceAddr = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RoutingTableIndex", wireType)
+			}
+			m.RoutingTableIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RoutingTableIndex |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PreviousPublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PreviousPublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PreviousKeyDeadline", wireType)
+			}
+			m.PreviousKeyDeadline = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PreviousKeyDeadline |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KeyState", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KeyState = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EnabledSource", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EnabledSource = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFelixbackend(dAtA[iNdEx:])
@@ -14779,6 +15426,64 @@ func (m *HostMetadataUpdate) Unmarshal(dAtA []byte) error {
 			}
 			m.Ipv4Addr = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ipv4SecondaryAddr", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ipv4SecondaryAddr = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WireguardEnabledOverride", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.WireguardEnabledOverride = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFelixbackend(dAtA[iNdEx:])
@@ -16628,6 +17333,113 @@ func (m *WireguardEndpointUpdate) Unmarshal(dAtA []byte) error {
 			}
 			m.InterfaceAddr = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ready", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Ready = bool(v != 0)
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ListeningPort", wireType)
+			}
+			m.ListeningPort = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ListeningPort |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PreviousPublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PreviousPublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PreviousKeyDeadline", wireType)
+			}
+			m.PreviousKeyDeadline = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PreviousKeyDeadline |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptionOptOut", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.EncryptionOptOut = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFelixbackend(dAtA[iNdEx:])
@@ -16728,6 +17540,114 @@ func (m *WireguardEndpointRemove) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *WireguardKeyConflict) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowFelixbackend
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: WireguardKeyConflict: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: WireguardKeyConflict: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StoredPublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFelixbackend
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.StoredPublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipFelixbackend(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthFelixbackend
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipFelixbackend(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -16836,209 +17756,222 @@ var (
 func init() { proto1.RegisterFile("felixbackend.proto", fileDescriptorFelixbackend) }
 
 var fileDescriptorFelixbackend = []byte{
-	// 3256 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x5a, 0xdb, 0x6e, 0x1c, 0xc7,
-	0xd1, 0xe6, 0x2e, 0xc9, 0xe5, 0x6c, 0xed, 0x69, 0xdc, 0x14, 0xc9, 0x25, 0x25, 0x51, 0xf2, 0xc8,
-	0x82, 0x68, 0xfd, 0xb0, 0x24, 0xc8, 0x12, 0x65, 0xf9, 0x07, 0x64, 0xac, 0xb8, 0xb4, 0xb9, 0xb6,
-	0xb4, 0x24, 0x86, 0xb4, 0xfc, 0xfb, 0x87, 0x81, 0xc9, 0x68, 0xa6, 0x49, 0x4e, 0xb4, 0x3b, 0x33,
-	0x9e, 0xe9, 0xe5, 0x21, 0xbe, 0xcb, 0x95, 0x11, 0x20, 0x48, 0xae, 0x82, 0x3c, 0x40, 0x10, 0x20,
-	0x40, 0xde, 0x20, 0xd7, 0x01, 0xec, 0xbb, 0x3c, 0x42, 0xe0, 0x3c, 0x41, 0xde, 0x20, 0xe8, 0xe3,
-	0x1c, 0x97, 0x92, 0x82, 0x20, 0x57, 0xdc, 0xae, 0xfe, 0xea, 0xeb, 0xea, 0xaa, 0x9a, 0xee, 0xea,
-	0x6e, 0x02, 0x3a, 0xc4, 0x23, 0xef, 0xec, 0xa5, 0xed, 0xbc, 0xc2, 0xbe, 0x7b, 0x27, 0x8c, 0x02,
-	0x12, 0xa0, 0x79, 0x26, 0x33, 0x5a, 0xd0, 0xd8, 0x3f, 0xf7, 0x1d, 0x13, 0x7f, 0x3b, 0xc1, 0x31,
-	0x31, 0xbe, 0xd7, 0xa1, 0x71, 0x10, 0xf4, 0x6d, 0x62, 0x87, 0x23, 0xdb, 0xc7, 0x68, 0x03, 0x16,
-	0x3c, 0xdf, 0x8a, 0xcf, 0x7d, 0xa7, 0x5b, 0xb9, 0x5e, 0xd9, 0x68, 0xdc, 0x6f, 0xdd, 0x61, 0x7a,
-	0x77, 0x06, 0x3e, 0x55, 0xdb, 0x99, 0x31, 0x6b, 0x1e, 0xfb, 0x85, 0x1e, 0x41, 0xd3, 0x0b, 0x63,
-	0x4c, 0xac, 0x49, 0xe8, 0xda, 0x04, 0x77, 0xab, 0x0c, 0x8e, 0x24, 0x7c, 0x6f, 0x1f, 0x93, 0x2f,
-	0x59, 0xcf, 0xce, 0x8c, 0xd9, 0x60, 0x48, 0xde, 0x44, 0x9f, 0x01, 0xe2, 0x8a, 0x2e, 0x1e, 0x11,
-	0x5b, 0xaa, 0xcf, 0x32, 0xf5, 0x95, 0xb4, 0x7a, 0x9f, 0xf6, 0x2b, 0x0e, 0x9d, 0x29, 0xa5, 0x64,
-	0x89, 0x05, 0x11, 0x1e, 0x07, 0x27, 0xb8, 0x3b, 0x57, 0xb4, 0xc0, 0x64, 0x3d, 0xca, 0x02, 0xde,
-	0x44, 0x7b, 0xb0, 0x64, 0x3b, 0xc4, 0x3b, 0xc1, 0x56, 0x18, 0x05, 0x87, 0xde, 0x08, 0x4b, 0x23,
-	0xe6, 0x19, 0xc3, 0x9a, 0x60, 0xe8, 0x31, 0xcc, 0x1e, 0x87, 0x28, 0x3b, 0x16, 0xed, 0xa2, 0xb8,
-	0x84, 0x51, 0xd8, 0x54, 0x9b, 0xce, 0xa8, 0x6c, 0xcb, 0x32, 0x0a, 0x1b, 0x9f, 0xc3, 0x25, 0xc9,
-	0x18, 0x8c, 0x3c, 0xe7, 0x5c, 0x9a, 0xb8, 0xc0, 0x08, 0x57, 0xb3, 0x84, 0x0c, 0xa1, 0x2c, 0x44,
-	0x76, 0x41, 0x5a, 0xa4, 0x13, 0xf6, 0x69, 0x53, 0xe9, 0x94, 0x79, 0x19, 0xba, 0xc4, 0xba, 0xe3,
-	0x20, 0x26, 0x16, 0xf6, 0xdd, 0x30, 0xf0, 0x7c, 0x95, 0x04, 0xf5, 0x0c, 0xdd, 0x4e, 0x10, 0x93,
-	0x6d, 0x81, 0x48, 0xac, 0x3b, 0x2e, 0x48, 0x8b, 0x74, 0xc2, 0x3a, 0x98, 0x4a, 0x97, 0x58, 0x77,
-	0x5c, 0x90, 0xa2, 0xaf, 0xa1, 0x7b, 0x1a, 0x44, 0xaf, 0x46, 0x81, 0xed, 0x16, 0x2c, 0x6c, 0x30,
-	0xca, 0xab, 0x82, 0xf2, 0x2b, 0x01, 0x2b, 0x58, 0xb9, 0x7c, 0x5a, 0xda, 0x53, 0x4e, 0x2d, 0xac,
-	0x6d, 0x5e, 0x48, 0xad, 0x2c, 0x2e, 0x50, 0x0b, 0xab, 0x3f, 0x86, 0x96, 0x13, 0xf8, 0x87, 0xde,
-	0x91, 0x34, 0xb5, 0xc5, 0xf8, 0x16, 0x05, 0xdf, 0x16, 0xeb, 0x53, 0x06, 0x36, 0x9d, 0x54, 0x5b,
-	0x39, 0x70, 0x8c, 0x89, 0xed, 0xda, 0xc9, 0x57, 0xd5, 0x2e, 0x38, 0xf0, 0xb9, 0x40, 0x64, 0xe3,
-	0x91, 0x95, 0xa2, 0x5b, 0xd0, 0x89, 0xe9, 0x02, 0xe1, 0x3b, 0xd8, 0xf2, 0x27, 0xe3, 0x97, 0x38,
-	0xea, 0x76, 0xae, 0x57, 0x36, 0xe6, 0xcc, 0xb6, 0x14, 0x0f, 0x99, 0x14, 0xf5, 0x40, 0xf7, 0x42,
-	0x7b, 0x6c, 0x85, 0x41, 0x30, 0x92, 0x63, 0xea, 0x6c, 0xcc, 0x25, 0xf5, 0x19, 0xf6, 0x9e, 0xef,
-	0x05, 0xc1, 0x48, 0x8d, 0xd7, 0xa6, 0x0a, 0x89, 0x24, 0x4b, 0x21, 0x3c, 0xf9, 0x4e, 0x29, 0x85,
-	0xf2, 0xa0, 0xa2, 0xc8, 0x65, 0xa3, 0x9a, 0xbd, 0xa0, 0x41, 0x53, 0x67, 0x9f, 0x4d, 0x9f, 0xac,
-	0x14, 0xed, 0xc3, 0x72, 0x8c, 0xa3, 0x13, 0xcf, 0xc1, 0x96, 0xed, 0x38, 0xc1, 0x24, 0x49, 0x9e,
-	0x45, 0x46, 0x78, 0x59, 0x10, 0xee, 0x73, 0x50, 0x8f, 0x63, 0xd4, 0x04, 0x2f, 0xc5, 0x25, 0xf2,
-	0x32, 0x52, 0x61, 0xe5, 0xa5, 0x0b, 0x48, 0x95, 0x9d, 0x39, 0x52, 0x61, 0xe9, 0x16, 0xe8, 0xbe,
-	0x3d, 0xc6, 0x71, 0x68, 0x3b, 0x6a, 0x0d, 0x5b, 0x62, 0x74, 0xcb, 0x82, 0x6e, 0x28, 0xbb, 0x95,
-	0x79, 0x1d, 0x3f, 0x2b, 0xca, 0x92, 0x08, 0x9b, 0x96, 0xcb, 0x49, 0x94, 0x39, 0x09, 0x89, 0xb0,
-	0xe4, 0x11, 0x34, 0xa3, 0x60, 0x42, 0x94, 0x15, 0x2b, 0x99, 0xb5, 0xd8, 0xa4, 0x5d, 0xc9, 0x6e,
-	0x10, 0x25, 0xcd, 0x44, 0x51, 0x8c, 0xdc, 0x2d, 0x2a, 0x26, 0x8b, 0x78, 0x94, 0x34, 0xd1, 0x16,
-	0x34, 0x4e, 0x08, 0x0e, 0xe5, 0x80, 0xab, 0x4c, 0xef, 0xba, 0xd0, 0x7b, 0xf1, 0x7f, 0xcf, 0x7a,
-	0xc3, 0x83, 0x89, 0xef, 0xe3, 0x51, 0xe1, 0xd3, 0x06, 0xaa, 0xa6, 0xe6, 0xce, 0x49, 0xc4, 0xe0,
-	0x6b, 0xaf, 0x23, 0x51, 0xa6, 0x30, 0x12, 0x61, 0xc9, 0x37, 0xb0, 0x7a, 0xea, 0x45, 0xf8, 0x68,
-	0x62, 0x47, 0xc5, 0xf5, 0xe6, 0x32, 0xa3, 0x5c, 0x97, 0x8b, 0x82, 0xc4, 0x15, 0xac, 0x5a, 0x39,
-	0x2d, 0xef, 0x9a, 0xc2, 0x2e, 0x0c, 0xbe, 0x72, 0x31, 0xbb, 0x32, 0xb7, 0xc8, 0xce, 0xbb, 0x9e,
-	0xd6, 0x61, 0x21, 0xb4, 0xcf, 0xe9, 0x6a, 0x64, 0xfc, 0x7a, 0x1e, 0x5a, 0x9f, 0x46, 0xc1, 0x38,
-	0x29, 0x06, 0xf6, 0x60, 0x29, 0x8c, 0x02, 0x07, 0xc7, 0xb1, 0x15, 0x13, 0x9b, 0x4c, 0xe2, 0xec,
-	0x66, 0x2d, 0x77, 0xb5, 0x3d, 0x8e, 0xd9, 0x67, 0x90, 0x64, 0x9f, 0x0c, 0x8b, 0x62, 0xf4, 0x33,
-	0xb8, 0x9c, 0x5d, 0xe8, 0xb3, 0xbc, 0x7c, 0x07, 0xbf, 0x56, 0xb2, 0xde, 0xe7, 0xc8, 0xbb, 0xc7,
-	0x53, 0xfa, 0xa6, 0x8e, 0x20, 0x1c, 0x36, 0xff, 0x9a, 0x11, 0x94, 0xc7, 0x4a, 0x46, 0x10, 0xe1,
-	0x1e, 0xc1, 0xb5, 0xe2, 0x16, 0x90, 0x9d, 0x07, 0xdf, 0xf5, 0x6f, 0x4c, 0xd9, 0x09, 0x72, 0x73,
-	0xb9, 0x72, 0x7a, 0x41, 0xff, 0x85, 0xa3, 0x89, 0x39, 0x2d, 0xbc, 0xc1, 0x68, 0x6a, 0x5e, 0x53,
-	0x46, 0x13, 0x73, 0x2b, 0x59, 0xf8, 0xb5, 0xd2, 0x85, 0xff, 0x05, 0x24, 0x29, 0x95, 0x9b, 0x3c,
-	0xaf, 0x01, 0xae, 0xe4, 0x73, 0x32, 0x37, 0xeb, 0xa5, 0xd3, 0xb2, 0x8e, 0x74, 0x3e, 0xfe, 0xb2,
-	0x02, 0xcd, 0xf4, 0xa6, 0x87, 0x1e, 0x41, 0x8d, 0x6f, 0x7a, 0xdd, 0xca, 0xf5, 0xd9, 0x54, 0x14,
-	0xd3, 0x20, 0xd1, 0xd8, 0xf6, 0x49, 0x74, 0x6e, 0x0a, 0xf8, 0xda, 0x63, 0x68, 0xa4, 0xc4, 0x48,
-	0x87, 0xd9, 0x57, 0xf8, 0x9c, 0xd5, 0xb7, 0x75, 0x93, 0xfe, 0x44, 0x97, 0x60, 0xfe, 0xc4, 0x1e,
-	0x4d, 0x78, 0x11, 0x5b, 0x37, 0x79, 0xe3, 0xe3, 0xea, 0x47, 0x15, 0x43, 0x83, 0x1a, 0xaf, 0x7c,
-	0x8d, 0xdf, 0x57, 0xa0, 0x91, 0xaa, 0x6a, 0x51, 0x1b, 0xaa, 0x9e, 0x2b, 0x48, 0xaa, 0x9e, 0x8b,
-	0xba, 0xb0, 0x30, 0xc6, 0xd4, 0x37, 0x71, 0xb7, 0x7a, 0x7d, 0x76, 0xa3, 0x6e, 0xca, 0x26, 0xba,
-	0x07, 0x73, 0xe4, 0x3c, 0xe4, 0x5f, 0x4d, 0x5b, 0x39, 0x26, 0xc5, 0xc5, 0x7f, 0x1f, 0x9c, 0x87,
-	0xd8, 0x64, 0x48, 0xe3, 0x03, 0xa8, 0x2b, 0x11, 0xaa, 0x41, 0x75, 0xb0, 0xa7, 0xcf, 0xa0, 0x0e,
-	0x1d, 0xdf, 0xea, 0x0d, 0xfb, 0xd6, 0xde, 0xae, 0x79, 0xa0, 0x57, 0xd0, 0x02, 0xcc, 0x0e, 0xb7,
-	0x0f, 0xf4, 0xaa, 0x11, 0x82, 0x9e, 0x2f, 0x98, 0x0b, 0xe6, 0xdd, 0x80, 0x96, 0xed, 0xba, 0xd8,
-	0xb5, 0xb2, 0x46, 0x36, 0x99, 0xf0, 0xb9, 0xb0, 0xf4, 0x16, 0x74, 0x78, 0x4e, 0x25, 0xb0, 0x59,
-	0x06, 0x6b, 0x0b, 0xb1, 0x00, 0x1a, 0x57, 0x85, 0x2f, 0x44, 0xda, 0xe4, 0x06, 0x33, 0x6c, 0x58,
-	0x2c, 0x29, 0x9e, 0xd1, 0x75, 0x05, 0x6b, 0xdc, 0xd7, 0x93, 0xc5, 0x83, 0x22, 0x06, 0x7d, 0x66,
-	0xe5, 0x06, 0x2c, 0x88, 0x02, 0x5a, 0x9c, 0x27, 0xda, 0x59, 0x98, 0x29, 0xbb, 0x8d, 0x47, 0xb9,
-	0x21, 0x84, 0x25, 0xaf, 0x1d, 0xc2, 0xb8, 0x06, 0x75, 0x25, 0x40, 0x08, 0xe6, 0xe8, 0x4e, 0x26,
-	0x4c, 0x67, 0xbf, 0x8d, 0x00, 0x16, 0x04, 0x00, 0xdd, 0x83, 0x96, 0xe7, 0xbf, 0x0c, 0x26, 0xbe,
-	0x6b, 0x45, 0x93, 0x11, 0x8e, 0x45, 0xe2, 0x35, 0xe4, 0xee, 0x34, 0x19, 0x61, 0xb3, 0x29, 0x10,
-	0xb4, 0x11, 0xa3, 0xfb, 0xd0, 0x0e, 0x26, 0x24, 0xad, 0x52, 0x2d, 0xaa, 0xb4, 0x24, 0x84, 0xe9,
-	0x18, 0xdf, 0x00, 0x2a, 0xd6, 0xf1, 0xe8, 0x5a, 0x6a, 0x26, 0x1d, 0x39, 0x13, 0x06, 0x10, 0xbe,
-	0xba, 0x09, 0x35, 0x5e, 0xcb, 0x0b, 0x57, 0xb5, 0x32, 0x20, 0x53, 0x74, 0x1a, 0x0f, 0xb3, 0xec,
-	0xc2, 0x4f, 0xaf, 0x63, 0x37, 0xee, 0x83, 0x26, 0xdb, 0xd4, 0x4b, 0xc4, 0xc3, 0x91, 0xf4, 0x12,
-	0xfd, 0xad, 0x3c, 0x57, 0x4d, 0x79, 0xee, 0xaf, 0x15, 0xa8, 0x71, 0xa5, 0xff, 0x8e, 0xe7, 0xd0,
-	0x15, 0xa8, 0x4f, 0x7c, 0x12, 0xd1, 0x73, 0xae, 0xcb, 0x3e, 0x2f, 0xcd, 0x4c, 0x04, 0x68, 0x15,
-	0xb4, 0x30, 0xc2, 0x96, 0xeb, 0xdb, 0x84, 0xed, 0x2c, 0x1a, 0xcd, 0x1e, 0xdc, 0xf7, 0x6d, 0x42,
-	0x15, 0x55, 0x05, 0xc3, 0xf6, 0x84, 0xba, 0x99, 0x08, 0x8c, 0x5f, 0xb5, 0x61, 0x8e, 0x0e, 0x80,
-	0x96, 0xa1, 0x46, 0x0f, 0x3f, 0x81, 0x2f, 0xa6, 0x2e, 0x5a, 0xe8, 0x2e, 0x80, 0x17, 0x5a, 0x27,
-	0x38, 0x8a, 0x69, 0x5f, 0x95, 0x7d, 0xd7, 0xba, 0xfa, 0xae, 0x5f, 0x70, 0xb9, 0x59, 0xf7, 0x42,
-	0xf1, 0x13, 0xfd, 0x0f, 0x35, 0x25, 0x20, 0x81, 0x13, 0x8c, 0xc4, 0xe6, 0xd9, 0x49, 0x92, 0x93,
-	0x89, 0x4d, 0x05, 0x40, 0x2b, 0xb0, 0x10, 0x47, 0x8e, 0xe5, 0x63, 0x6a, 0x36, 0xfd, 0xfa, 0x6a,
-	0x71, 0xe4, 0x0c, 0x31, 0x41, 0x1f, 0x40, 0x9d, 0x76, 0x84, 0x41, 0x44, 0xe2, 0xee, 0x3c, 0xf3,
-	0x8e, 0xca, 0xf1, 0x20, 0x22, 0xa6, 0xed, 0x1f, 0x61, 0x53, 0x8b, 0x23, 0x87, 0xb6, 0x62, 0xca,
-	0xe3, 0xc6, 0x84, 0xf1, 0xd4, 0x38, 0x8f, 0x1b, 0x13, 0xc1, 0x43, 0x3b, 0x38, 0xcf, 0xc2, 0x34,
-	0x1e, 0x37, 0x26, 0x9c, 0xe7, 0x2a, 0xd4, 0x3d, 0x67, 0x1c, 0x5a, 0x6c, 0x11, 0xa3, 0xdb, 0xc1,
-	0xfc, 0xce, 0x8c, 0xa9, 0x51, 0x11, 0x5b, 0x9f, 0x9e, 0x40, 0x5b, 0x75, 0x5b, 0x4e, 0xe0, 0xca,
-	0x1d, 0x40, 0x56, 0x8f, 0x03, 0x01, 0xec, 0xf9, 0xee, 0x56, 0xe0, 0xb2, 0xb3, 0x8b, 0xd4, 0xa5,
-	0x6d, 0x74, 0x03, 0xda, 0x74, 0x56, 0x5e, 0x68, 0xd1, 0xb3, 0xbc, 0xe7, 0xc6, 0x5d, 0x60, 0xd6,
-	0x36, 0xe2, 0xc8, 0x19, 0x84, 0xfb, 0x98, 0x0c, 0xdc, 0x98, 0x82, 0xa8, 0xc9, 0x29, 0x50, 0x83,
-	0x83, 0xdc, 0x98, 0x28, 0xd0, 0x23, 0x58, 0x65, 0x8e, 0xb3, 0xc7, 0xd8, 0x65, 0xb3, 0x4b, 0xe3,
-	0x9b, 0x0c, 0x7f, 0x89, 0xba, 0x92, 0xf6, 0xd3, 0xa9, 0xa5, 0x15, 0x99, 0xa7, 0x4a, 0x15, 0x5b,
-	0x5c, 0x91, 0xfa, 0xae, 0xa0, 0x78, 0x1f, 0x9a, 0x7e, 0x40, 0x2c, 0x15, 0xdb, 0xc3, 0xf2, 0xd8,
-	0x36, 0xfc, 0x80, 0xc8, 0x06, 0x5a, 0x07, 0xda, 0xb4, 0x64, 0x88, 0x8f, 0x18, 0x7d, 0xdd, 0x0f,
-	0xc8, 0x3e, 0x8f, 0xf2, 0x03, 0x68, 0xc9, 0x7e, 0x1e, 0xa1, 0xe3, 0x29, 0x11, 0x6a, 0x70, 0x1d,
-	0x1e, 0x24, 0xc1, 0x2a, 0x03, 0xee, 0x29, 0xd6, 0x3e, 0x8f, 0xb9, 0x60, 0x4d, 0xe2, 0xfe, 0xf3,
-	0x0b, 0x58, 0xfb, 0x32, 0xf4, 0xef, 0x71, 0xad, 0x24, 0xfc, 0xaf, 0x58, 0xf8, 0x2b, 0x0c, 0x25,
-	0x03, 0x8b, 0xb6, 0x01, 0x65, 0x50, 0x3c, 0x0b, 0x46, 0x17, 0x66, 0x41, 0xc5, 0xec, 0xa4, 0x28,
-	0x58, 0x22, 0xdc, 0xe6, 0x34, 0xb9, 0x64, 0x18, 0xf3, 0x0d, 0x88, 0xcf, 0x55, 0x39, 0x5e, 0x60,
-	0x73, 0x39, 0xe1, 0x2b, 0x6c, 0x3f, 0x95, 0x16, 0x4f, 0xe0, 0xaa, 0x72, 0x78, 0x69, 0x84, 0x43,
-	0xa6, 0xb6, 0x22, 0x42, 0x50, 0x08, 0xb2, 0xd0, 0x9f, 0x9e, 0x21, 0xdf, 0x2a, 0xfd, 0x7e, 0x79,
-	0x92, 0x2c, 0x05, 0x91, 0x77, 0xe4, 0xf9, 0xf6, 0x88, 0x19, 0x11, 0xe3, 0x11, 0x76, 0x48, 0x10,
-	0x75, 0x23, 0xb6, 0xa8, 0x2c, 0xca, 0xce, 0xfd, 0xc8, 0xd9, 0x17, 0x5d, 0x19, 0x1d, 0x3a, 0xb0,
-	0xd2, 0x89, 0xb3, 0x3a, 0xfd, 0x98, 0x28, 0x9d, 0x6d, 0xb8, 0x96, 0x19, 0x27, 0x39, 0xd5, 0x29,
-	0x6d, 0xc2, 0xb4, 0xaf, 0xa4, 0x46, 0x54, 0x67, 0xbb, 0x52, 0x1a, 0x39, 0xe7, 0x1c, 0xcd, 0x24,
-	0x4b, 0x23, 0x66, 0x9d, 0xa5, 0x79, 0x0c, 0xab, 0x8a, 0x46, 0xba, 0x5f, 0x11, 0x9c, 0x30, 0x82,
-	0x65, 0x09, 0x18, 0x32, 0xcf, 0x4f, 0x55, 0xcd, 0x38, 0xe0, 0xb4, 0xa0, 0x9a, 0xf6, 0xc1, 0x97,
-	0x7c, 0x09, 0xc8, 0x1f, 0xb5, 0xc7, 0x36, 0x71, 0x8e, 0xbb, 0x67, 0x99, 0x63, 0x4b, 0xf6, 0xa4,
-	0xfd, 0x9c, 0x22, 0xcc, 0xe5, 0x98, 0x9a, 0x51, 0x90, 0x53, 0x5a, 0x6e, 0x44, 0x19, 0xed, 0xf9,
-	0xeb, 0x69, 0x5d, 0x6a, 0x62, 0x91, 0xf6, 0x2e, 0xc0, 0x31, 0x21, 0xa1, 0xe0, 0xf9, 0x45, 0xa6,
-	0x6a, 0xd9, 0x39, 0x38, 0xd8, 0xe3, 0xda, 0x75, 0x8a, 0x91, 0x0a, 0x9a, 0xbc, 0xe4, 0xe8, 0x7e,
-	0x97, 0xb9, 0x1e, 0xa2, 0xfb, 0x95, 0xba, 0xc7, 0x50, 0x20, 0x5a, 0x95, 0xd2, 0xcd, 0xd4, 0xf2,
-	0xdc, 0xee, 0x8f, 0x62, 0x0f, 0xa3, 0xed, 0x81, 0xfb, 0xb4, 0x06, 0x73, 0xf4, 0x83, 0x7d, 0x0a,
-	0xa0, 0xc9, 0x8f, 0xf7, 0xf3, 0x9a, 0xf6, 0x43, 0x45, 0xff, 0xb1, 0x62, 0xc2, 0x28, 0x38, 0xb2,
-	0xc2, 0x08, 0x1f, 0x7a, 0x67, 0xc6, 0x67, 0xb0, 0x58, 0x66, 0xfa, 0x1a, 0x68, 0x2a, 0x24, 0x9c,
-	0x58, 0xb5, 0x69, 0x39, 0xcd, 0x92, 0x46, 0xd4, 0x98, 0xbc, 0x61, 0xfc, 0xa1, 0x02, 0x75, 0x35,
-	0x29, 0x5e, 0x2e, 0x93, 0xe3, 0xc0, 0xe5, 0xa5, 0x01, 0x2b, 0x97, 0x59, 0x13, 0xdd, 0x83, 0xf9,
-	0xd0, 0x26, 0xc7, 0x72, 0xff, 0x5f, 0xcb, 0xfb, 0xe3, 0xce, 0x9e, 0x4d, 0x8e, 0xb9, 0x67, 0x38,
-	0x70, 0xed, 0x0b, 0xa8, 0x2b, 0x19, 0x5a, 0x86, 0x79, 0x7c, 0x66, 0x3b, 0x84, 0x5b, 0xb5, 0x33,
-	0x63, 0xf2, 0x26, 0xea, 0x42, 0x8d, 0xcf, 0x88, 0x97, 0x2c, 0x3b, 0x33, 0xa6, 0x68, 0x3f, 0x6d,
-	0x02, 0x50, 0x1e, 0x1e, 0x05, 0xe3, 0x77, 0x15, 0x68, 0xa6, 0x9d, 0x89, 0x3e, 0x85, 0x86, 0xed,
-	0xfb, 0x01, 0xb1, 0xe9, 0xd6, 0x2f, 0x0b, 0x99, 0xf7, 0x4a, 0xdc, 0x7e, 0xa7, 0x97, 0xc0, 0xf8,
-	0x01, 0x24, 0xad, 0xb8, 0xf6, 0x04, 0xf4, 0x3c, 0xe0, 0xad, 0x8e, 0x22, 0x8f, 0xa1, 0x93, 0x5b,
-	0x44, 0x59, 0x61, 0x46, 0x57, 0x65, 0xaa, 0x3f, 0xcf, 0xcf, 0x0e, 0x54, 0xc6, 0x96, 0xdf, 0x2a,
-	0x97, 0xd1, 0xdf, 0xc6, 0x33, 0xd0, 0xd4, 0xf6, 0xd3, 0x85, 0x9a, 0x38, 0xd9, 0x55, 0xc4, 0x56,
-	0x2e, 0xda, 0xe8, 0x52, 0xba, 0xa4, 0xdb, 0x99, 0xe1, 0x45, 0xdd, 0x53, 0x1d, 0xda, 0xbc, 0xdf,
-	0x0a, 0x22, 0xb6, 0x16, 0x18, 0x0f, 0xa1, 0xae, 0xb6, 0x0b, 0x6a, 0xef, 0xa1, 0x17, 0xc5, 0x44,
-	0xd8, 0xc0, 0x1b, 0xd4, 0x88, 0x91, 0x1d, 0x13, 0x69, 0x04, 0xfd, 0x6d, 0xfc, 0xa6, 0x02, 0x28,
-	0x7f, 0x38, 0x1d, 0xf4, 0xe9, 0x99, 0x23, 0x88, 0x9c, 0x63, 0x1c, 0x93, 0xc8, 0x26, 0x41, 0x44,
-	0x33, 0x95, 0x4f, 0xbd, 0x9d, 0x16, 0x0f, 0x5c, 0x74, 0x0d, 0x1a, 0xea, 0x24, 0xec, 0xf1, 0x72,
-	0xaf, 0x6e, 0x82, 0x14, 0x71, 0x80, 0x3a, 0x21, 0x7b, 0x2e, 0x2b, 0xf9, 0xea, 0x26, 0x48, 0xd1,
-	0xc0, 0xfd, 0x7c, 0x4e, 0xab, 0xe8, 0x55, 0x53, 0xa3, 0x27, 0x7b, 0x36, 0x91, 0x33, 0x58, 0x2e,
-	0xbf, 0x00, 0x46, 0xef, 0xa7, 0xca, 0xe3, 0xd5, 0x29, 0x07, 0x6b, 0x51, 0x86, 0x7f, 0x08, 0x9a,
-	0x1c, 0x42, 0xdc, 0x2e, 0xac, 0x4c, 0xbb, 0x01, 0x56, 0x40, 0xe3, 0x8f, 0x55, 0xd0, 0xf3, 0xdd,
-	0xd4, 0x95, 0xf4, 0x24, 0x2d, 0x4f, 0x23, 0xbc, 0x51, 0x56, 0x68, 0xd3, 0xb4, 0x19, 0xdb, 0x8e,
-	0x70, 0x01, 0xfd, 0x49, 0xe7, 0x2e, 0x5f, 0x1e, 0xe8, 0x8e, 0xc4, 0xeb, 0x46, 0x10, 0x22, 0xba,
-	0x09, 0x5d, 0x86, 0xba, 0x17, 0x9e, 0x3c, 0xa0, 0xc5, 0x01, 0xaf, 0x1d, 0xeb, 0xa6, 0x46, 0x05,
-	0x43, 0x4c, 0x64, 0xe7, 0x26, 0xef, 0xac, 0xa9, 0xce, 0x4d, 0xd6, 0x79, 0x13, 0xe6, 0x69, 0xc5,
-	0x2f, 0x2b, 0x45, 0x59, 0xdc, 0x1c, 0x78, 0x38, 0x1a, 0xf8, 0x87, 0x81, 0xc9, 0x7b, 0xd1, 0xfb,
-	0xa0, 0xf1, 0x01, 0x6c, 0xd2, 0xd5, 0x18, 0xb2, 0xad, 0xae, 0x0f, 0x09, 0x03, 0x2e, 0xb0, 0xf1,
-	0x6c, 0x22, 0xa0, 0x9b, 0x0c, 0x5a, 0x9f, 0x0a, 0xdd, 0x1c, 0xda, 0xc4, 0xd8, 0x2a, 0x86, 0x48,
-	0x9c, 0x60, 0xde, 0x3c, 0x44, 0x46, 0x0f, 0xda, 0xe9, 0x9b, 0x9e, 0x41, 0x3f, 0x9f, 0x2a, 0xd5,
-	0xd7, 0xa6, 0xca, 0x08, 0x50, 0xf1, 0x35, 0x03, 0xdd, 0x4c, 0xd9, 0xb0, 0x54, 0x72, 0xa7, 0x24,
-	0x52, 0xe4, 0x6e, 0x2a, 0x45, 0x66, 0x33, 0xab, 0x76, 0xe6, 0x49, 0x23, 0x49, 0x8f, 0x7f, 0x56,
-	0xa1, 0x99, 0xee, 0x2a, 0x3b, 0xa7, 0xe6, 0x43, 0x5e, 0x2d, 0x84, 0x5c, 0x05, 0x6e, 0xf6, 0xc2,
-	0xc0, 0xdd, 0x81, 0x45, 0x7c, 0x16, 0x62, 0x87, 0x60, 0xd7, 0x62, 0x11, 0xb4, 0x5d, 0x37, 0x92,
-	0x29, 0xf4, 0x8e, 0xec, 0x1a, 0x84, 0x27, 0x0f, 0x7a, 0xb4, 0x23, 0x8f, 0xdf, 0x14, 0xf8, 0xf9,
-	0x02, 0x7e, 0x93, 0xe3, 0x3f, 0x82, 0x8e, 0x3a, 0x93, 0x59, 0xdc, 0xa0, 0x5a, 0xb9, 0x41, 0x6d,
-	0x85, 0x3b, 0x60, 0x96, 0x3d, 0x84, 0xb6, 0x3c, 0xc0, 0x59, 0x17, 0xa6, 0x60, 0x53, 0x9c, 0xeb,
-	0xb8, 0xda, 0x03, 0x68, 0x1d, 0x06, 0xd1, 0xa9, 0x1d, 0xc9, 0xe1, 0xb4, 0x29, 0x5a, 0x02, 0xc5,
-	0xb4, 0x8c, 0xff, 0xcd, 0x46, 0x58, 0x64, 0xd9, 0x9b, 0x45, 0xd8, 0x88, 0x40, 0x93, 0xb4, 0xa5,
-	0xb1, 0x7a, 0x1f, 0x74, 0xcf, 0x3f, 0x8a, 0x70, 0x1c, 0xf3, 0xf7, 0x37, 0x4f, 0x6d, 0x8e, 0x1d,
-	0x21, 0xdf, 0x13, 0x62, 0xba, 0x1e, 0xe2, 0x1c, 0x52, 0xdc, 0xc1, 0xe0, 0x0c, 0xd0, 0x78, 0x04,
-	0x0b, 0xe2, 0x73, 0x41, 0x4b, 0x50, 0xc3, 0x67, 0xb4, 0x24, 0x95, 0x4b, 0x07, 0x3e, 0x23, 0x83,
-	0x90, 0x8a, 0x59, 0x82, 0x87, 0x72, 0x33, 0xa1, 0x06, 0x87, 0x86, 0x09, 0x8b, 0x25, 0x57, 0xb6,
-	0xe8, 0x06, 0xb4, 0xbc, 0x38, 0xb0, 0x88, 0x37, 0xc6, 0x31, 0xb1, 0xc7, 0x92, 0xab, 0xe9, 0xc5,
-	0xc1, 0x81, 0x94, 0xd1, 0x13, 0xf1, 0x24, 0xa4, 0x10, 0x46, 0x59, 0x31, 0x45, 0xcb, 0x08, 0xa1,
-	0x3b, 0xed, 0xba, 0xf6, 0x4d, 0xbf, 0x92, 0x0f, 0xa0, 0xc6, 0x2f, 0x12, 0xc5, 0x7d, 0x86, 0x84,
-	0xe6, 0x2e, 0x2a, 0x05, 0xc8, 0xd8, 0x80, 0x76, 0xb6, 0x87, 0xda, 0x26, 0x08, 0x44, 0xa5, 0x23,
-	0x90, 0xbd, 0x32, 0xdb, 0xde, 0x2e, 0xbe, 0x67, 0x70, 0xe5, 0xa2, 0x5b, 0xdc, 0xb7, 0xd9, 0x2f,
-	0xde, 0x72, 0x9a, 0x83, 0x69, 0x23, 0xbf, 0xfd, 0x32, 0xb8, 0x09, 0x4b, 0xa5, 0xb7, 0xb1, 0xe8,
-	0x2a, 0x40, 0x38, 0x79, 0x39, 0xf2, 0x1c, 0x2b, 0x29, 0x46, 0xea, 0x5c, 0xf2, 0x05, 0x3e, 0x37,
-	0x9e, 0xf3, 0x2f, 0x23, 0xf7, 0x46, 0xb8, 0x06, 0x6a, 0x75, 0x94, 0x05, 0xa0, 0x6c, 0xab, 0xcd,
-	0x86, 0xae, 0x0c, 0x22, 0xf7, 0xd8, 0xe6, 0x40, 0x17, 0x84, 0x3c, 0x9d, 0x98, 0xc7, 0xbf, 0x4d,
-	0xb7, 0x0d, 0xed, 0xec, 0x1b, 0x63, 0xc9, 0xd5, 0xe7, 0x5c, 0x18, 0x04, 0x23, 0xe1, 0xef, 0x4e,
-	0xfe, 0x55, 0x91, 0x75, 0x1a, 0xd7, 0x13, 0x9a, 0x29, 0x97, 0x9a, 0x4f, 0x40, 0x93, 0x08, 0x56,
-	0x64, 0x79, 0xae, 0xba, 0x11, 0xa3, 0xbf, 0xd1, 0x3a, 0xc0, 0xd8, 0x8e, 0xbf, 0x9d, 0xe0, 0xc8,
-	0x16, 0xe5, 0x97, 0x66, 0xa6, 0x24, 0xc6, 0x5f, 0x2a, 0x70, 0xa9, 0xec, 0xc9, 0x10, 0xdd, 0x4a,
-	0x85, 0x70, 0xa5, 0xf4, 0x14, 0x21, 0x52, 0xe7, 0x13, 0xa8, 0x8d, 0xec, 0x97, 0x78, 0x24, 0x4b,
-	0xe3, 0x5b, 0x17, 0x3c, 0x44, 0xde, 0x79, 0xc6, 0x90, 0xe2, 0x22, 0x9c, 0xab, 0xad, 0x3d, 0x86,
-	0x46, 0x4a, 0xfc, 0x56, 0xd5, 0xe7, 0x27, 0x79, 0xe3, 0xd5, 0x8b, 0xc1, 0x9b, 0x19, 0x6f, 0xf4,
-	0x41, 0xcf, 0xcb, 0xb3, 0xd7, 0x70, 0x95, 0xdc, 0x35, 0x5c, 0xe9, 0x15, 0xe3, 0x9f, 0x2b, 0xd0,
-	0xc9, 0xbd, 0x69, 0x22, 0x23, 0x65, 0x02, 0xca, 0x3f, 0x59, 0x0a, 0xd7, 0x7d, 0x9c, 0x73, 0x9d,
-	0x51, 0xfe, 0x3e, 0xfa, 0x9f, 0xf6, 0xda, 0xc3, 0x94, 0xb5, 0xc2, 0x61, 0x6f, 0x60, 0xad, 0xf1,
-	0x2e, 0x34, 0x52, 0xa2, 0xd2, 0x5b, 0xea, 0x3f, 0x55, 0xa1, 0x91, 0x7a, 0x56, 0x45, 0xef, 0xa5,
-	0x8e, 0x02, 0xc9, 0x65, 0x24, 0x43, 0x24, 0x0f, 0x0b, 0xe8, 0x43, 0x68, 0x7a, 0x21, 0x7f, 0x6a,
-	0x67, 0x68, 0x7e, 0x75, 0xf9, 0x8e, 0xfa, 0x24, 0x68, 0x72, 0x33, 0x38, 0x78, 0xa1, 0xfc, 0x4d,
-	0x27, 0xec, 0xc6, 0x44, 0x56, 0x9b, 0x6e, 0x4c, 0x90, 0x01, 0x2d, 0x76, 0x33, 0x10, 0xb8, 0x98,
-	0x1d, 0x09, 0x44, 0xad, 0xdd, 0x70, 0x63, 0x32, 0x0c, 0x5c, 0x4c, 0x6d, 0x47, 0xeb, 0xd0, 0x50,
-	0x18, 0x2f, 0x94, 0x97, 0xac, 0x02, 0x31, 0x08, 0x69, 0xf9, 0x12, 0xdb, 0x63, 0x6c, 0xc5, 0x93,
-	0x97, 0x3e, 0x26, 0xec, 0x11, 0x4b, 0x33, 0x81, 0x8a, 0xf6, 0x99, 0x04, 0xbd, 0x0b, 0x4d, 0xba,
-	0xf1, 0x07, 0x13, 0x72, 0x14, 0x78, 0xfe, 0x11, 0xbb, 0x79, 0xd4, 0xcc, 0x86, 0x6f, 0x93, 0x5d,
-	0x21, 0x42, 0x37, 0xa1, 0x3d, 0x0a, 0x1c, 0x7b, 0x64, 0xc9, 0x53, 0x00, 0xbb, 0x7a, 0xd4, 0xcc,
-	0x16, 0x93, 0xca, 0x65, 0xd0, 0xb8, 0x26, 0x5c, 0x25, 0x22, 0x20, 0xe6, 0x53, 0x55, 0xf3, 0x31,
-	0xbe, 0xaf, 0xc0, 0xea, 0xd4, 0x27, 0x63, 0xe6, 0x7e, 0x7a, 0xa2, 0x92, 0xee, 0xa7, 0x27, 0x2f,
-	0x51, 0x81, 0x57, 0x93, 0x0a, 0x3c, 0xb3, 0x48, 0xcd, 0x66, 0x17, 0x29, 0xb4, 0x01, 0x7a, 0x68,
-	0x47, 0xd8, 0x27, 0x96, 0x8b, 0xd9, 0x0d, 0x82, 0x17, 0x0a, 0x9f, 0xb5, 0xb9, 0xbc, 0xcf, 0xc4,
-	0x83, 0xd0, 0xb8, 0x5b, 0x6a, 0x89, 0xb0, 0xbc, 0xc4, 0x12, 0xe3, 0x3b, 0x58, 0x99, 0xf2, 0xaa,
-	0x7c, 0xe1, 0x9a, 0x9a, 0x5d, 0xf3, 0xab, 0xb9, 0x35, 0x9f, 0x7a, 0xd6, 0xf3, 0x09, 0x8e, 0x0e,
-	0x6d, 0x07, 0xa7, 0xa7, 0xd4, 0x52, 0x52, 0xb6, 0xf8, 0x3e, 0x2c, 0x19, 0xfc, 0xf5, 0x0b, 0xfa,
-	0xed, 0x0d, 0xa8, 0xab, 0x6b, 0x72, 0xb4, 0x00, 0xb3, 0xbd, 0xe1, 0xd7, 0xfa, 0x0c, 0xd2, 0x60,
-	0x6e, 0xb0, 0xf7, 0xe2, 0x81, 0x3e, 0x27, 0x7e, 0x6d, 0xea, 0xb5, 0xdb, 0x2e, 0xd4, 0x55, 0x0e,
-	0xa3, 0x16, 0xd4, 0xb7, 0x06, 0x7d, 0xd3, 0x1a, 0x0c, 0x3f, 0xdd, 0xd5, 0x67, 0xd0, 0x22, 0x74,
-	0xcc, 0xed, 0xe7, 0xbb, 0x07, 0xdb, 0xd6, 0x57, 0xbb, 0xe6, 0x17, 0xcf, 0x76, 0x7b, 0x7d, 0xbd,
-	0x82, 0x3a, 0xd0, 0x10, 0xc2, 0x9d, 0xdd, 0xfd, 0x03, 0xbd, 0x8a, 0x10, 0xb4, 0x9f, 0xed, 0x6e,
-	0xf5, 0x9e, 0x25, 0xa0, 0x59, 0xd4, 0x06, 0xe0, 0x32, 0x86, 0x99, 0xbb, 0xfd, 0x18, 0x20, 0xc9,
-	0x7d, 0x3a, 0xfa, 0x70, 0x77, 0xb8, 0xad, 0xcf, 0xa0, 0x26, 0x68, 0xc3, 0x5d, 0x6b, 0x7b, 0xb8,
-	0xd5, 0xdb, 0xd3, 0x2b, 0xa8, 0x0e, 0xf3, 0x2c, 0x34, 0x7a, 0x95, 0x1b, 0x38, 0xd8, 0xd3, 0x67,
-	0xef, 0x3f, 0x01, 0xe0, 0x4f, 0x1e, 0xec, 0x9f, 0xe2, 0xee, 0xc1, 0x1c, 0xfb, 0x2b, 0x3f, 0xec,
-	0xd4, 0xbf, 0xda, 0xad, 0x49, 0x59, 0xea, 0xdf, 0xed, 0xee, 0x55, 0x9e, 0xae, 0xfc, 0xf0, 0xd3,
-	0x7a, 0xe5, 0x6f, 0x3f, 0xad, 0x57, 0xfe, 0xfe, 0xd3, 0x7a, 0xe5, 0xb7, 0xff, 0x58, 0x9f, 0xf9,
-	0xff, 0x79, 0x76, 0x9b, 0xfc, 0xb2, 0xc6, 0xfe, 0x7c, 0xf8, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff,
-	0x37, 0x7b, 0xdd, 0x7d, 0xcc, 0x27, 0x00, 0x00,
+	// 3470 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x5a, 0x5b, 0x6f, 0x1b, 0xc7,
+	0xf5, 0x17, 0x49, 0x91, 0x22, 0x0f, 0x45, 0x6a, 0x3d, 0xba, 0x51, 0xb2, 0x2d, 0x2b, 0x9b, 0x18,
+	0x56, 0xfc, 0x47, 0x1c, 0xc3, 0xf1, 0x25, 0xce, 0x1f, 0x70, 0x40, 0x8b, 0x4a, 0xc4, 0xd8, 0xa6,
+	0x88, 0x95, 0xe2, 0x34, 0x45, 0x80, 0xed, 0x6a, 0x77, 0x24, 0x6d, 0x4d, 0xee, 0x6e, 0x76, 0x87,
+	0x92, 0xd8, 0xa2, 0x2f, 0x7d, 0x2a, 0x0a, 0x14, 0xed, 0x53, 0xd1, 0x87, 0x3e, 0x16, 0x05, 0x0a,
+	0xf4, 0x1b, 0xf4, 0xb9, 0x40, 0xf2, 0x56, 0xa0, 0xcf, 0x05, 0x8a, 0xf4, 0x13, 0xf4, 0x1b, 0x14,
+	0x73, 0xdd, 0x0b, 0x97, 0x92, 0x5d, 0x14, 0x79, 0xe2, 0xce, 0x39, 0xbf, 0x73, 0xe6, 0xcc, 0x99,
+	0xcb, 0x39, 0x67, 0x86, 0x80, 0x8e, 0xf0, 0xc0, 0x3d, 0x3f, 0xb4, 0xec, 0x57, 0xd8, 0x73, 0xee,
+	0x04, 0xa1, 0x4f, 0x7c, 0x54, 0x66, 0x34, 0xbd, 0x01, 0xf5, 0xfd, 0xb1, 0x67, 0x1b, 0xf8, 0xeb,
+	0x11, 0x8e, 0x88, 0xfe, 0x0f, 0x0d, 0xea, 0x07, 0x7e, 0xc7, 0x22, 0x56, 0x30, 0xb0, 0x3c, 0x8c,
+	0xb6, 0x60, 0xce, 0xf5, 0xcc, 0x68, 0xec, 0xd9, 0xad, 0xc2, 0x66, 0x61, 0xab, 0x7e, 0xaf, 0x71,
+	0x87, 0xc9, 0xdd, 0xe9, 0x7a, 0x54, 0x6c, 0x77, 0xc6, 0xa8, 0xb8, 0xec, 0x0b, 0x3d, 0x82, 0x79,
+	0x37, 0x88, 0x30, 0x31, 0x47, 0x81, 0x63, 0x11, 0xdc, 0x2a, 0x32, 0x38, 0x92, 0xf0, 0xfe, 0x3e,
+	0x26, 0x9f, 0x33, 0xce, 0xee, 0x8c, 0x51, 0x67, 0x48, 0xde, 0x44, 0x9f, 0x02, 0xe2, 0x82, 0x0e,
+	0x1e, 0x10, 0x4b, 0x8a, 0x97, 0x98, 0xf8, 0x6a, 0x52, 0xbc, 0x43, 0xf9, 0x4a, 0x87, 0xc6, 0x84,
+	0x12, 0xb4, 0xd8, 0x82, 0x10, 0x0f, 0xfd, 0x53, 0xdc, 0x9a, 0x9d, 0xb4, 0xc0, 0x60, 0x1c, 0x65,
+	0x01, 0x6f, 0xa2, 0x3e, 0x2c, 0x5b, 0x36, 0x71, 0x4f, 0xb1, 0x19, 0x84, 0xfe, 0x91, 0x3b, 0xc0,
+	0xd2, 0x88, 0x32, 0xd3, 0xb0, 0x2e, 0x34, 0xb4, 0x19, 0xa6, 0xcf, 0x21, 0xca, 0x8e, 0x45, 0x6b,
+	0x92, 0x9c, 0xa3, 0x51, 0xd8, 0x54, 0x99, 0xae, 0x51, 0xd9, 0xb6, 0x68, 0x4d, 0x92, 0xd1, 0x0b,
+	0x58, 0x92, 0x1a, 0xfd, 0x81, 0x6b, 0x8f, 0xa5, 0x89, 0x73, 0x4c, 0xe1, 0x5a, 0x5a, 0x21, 0x43,
+	0x28, 0x0b, 0x91, 0x35, 0x41, 0x9d, 0x54, 0x27, 0xec, 0xab, 0x4e, 0x55, 0xa7, 0xcc, 0x43, 0xd6,
+	0x04, 0x95, 0xaa, 0x3b, 0xf1, 0x23, 0x62, 0x62, 0xcf, 0x09, 0x7c, 0xd7, 0x53, 0x8b, 0xa0, 0x96,
+	0x52, 0xb7, 0xeb, 0x47, 0x64, 0x47, 0x20, 0x62, 0xeb, 0x4e, 0x26, 0xa8, 0x93, 0xea, 0x84, 0x75,
+	0x30, 0x55, 0x5d, 0x6c, 0xdd, 0xc9, 0x04, 0x15, 0x7d, 0x09, 0xad, 0x33, 0x3f, 0x7c, 0x35, 0xf0,
+	0x2d, 0x67, 0xc2, 0xc2, 0x3a, 0x53, 0x79, 0x5d, 0xa8, 0xfc, 0x42, 0xc0, 0x26, 0xac, 0x5c, 0x39,
+	0xcb, 0xe5, 0xe4, 0xab, 0x16, 0xd6, 0xce, 0x5f, 0xa8, 0x5a, 0x59, 0xbc, 0x72, 0x96, 0xcb, 0x41,
+	0x1f, 0x41, 0xc3, 0xf6, 0xbd, 0x23, 0xf7, 0x58, 0x9a, 0xda, 0x60, 0xfa, 0x16, 0x85, 0xbe, 0x6d,
+	0xc6, 0x53, 0x06, 0xce, 0xdb, 0x89, 0xb6, 0x72, 0xe0, 0x10, 0x13, 0xcb, 0xb1, 0xe2, 0x5d, 0xd5,
+	0x9c, 0x70, 0xe0, 0x0b, 0x81, 0x48, 0xcf, 0x47, 0x9a, 0x8a, 0x6e, 0xc1, 0x42, 0x44, 0x0f, 0x08,
+	0xcf, 0xc6, 0xa6, 0x37, 0x1a, 0x1e, 0xe2, 0xb0, 0xb5, 0xb0, 0x59, 0xd8, 0x9a, 0x35, 0x9a, 0x92,
+	0xdc, 0x63, 0x54, 0xd4, 0x06, 0xcd, 0x0d, 0xac, 0xa1, 0x19, 0xf8, 0xfe, 0x40, 0xf6, 0xa9, 0xb1,
+	0x3e, 0x97, 0xd5, 0x36, 0x6c, 0xbf, 0xe8, 0xfb, 0xfe, 0x40, 0xf5, 0xd7, 0xa4, 0x02, 0x31, 0x25,
+	0xad, 0x42, 0x78, 0xf2, 0x4a, 0xae, 0x0a, 0xe5, 0x41, 0xa5, 0x22, 0xb3, 0x1a, 0xd5, 0xe8, 0x85,
+	0x1a, 0x34, 0x75, 0xf4, 0xe9, 0xe5, 0x93, 0xa6, 0xa2, 0x7d, 0x58, 0x89, 0x70, 0x78, 0xea, 0xda,
+	0xd8, 0xb4, 0x6c, 0xdb, 0x1f, 0xc5, 0x8b, 0x67, 0x91, 0x29, 0xbc, 0x2a, 0x14, 0xee, 0x73, 0x50,
+	0x9b, 0x63, 0xd4, 0x00, 0x97, 0xa2, 0x1c, 0x7a, 0x9e, 0x52, 0x61, 0xe5, 0xd2, 0x05, 0x4a, 0x95,
+	0x9d, 0x4b, 0x51, 0x0e, 0x1d, 0x6d, 0x83, 0xe6, 0x59, 0x43, 0x1c, 0x05, 0x96, 0xad, 0xce, 0xb0,
+	0x65, 0xa6, 0x6e, 0x45, 0xa8, 0xeb, 0x49, 0xb6, 0x32, 0x6f, 0xc1, 0x4b, 0x93, 0xd2, 0x4a, 0x84,
+	0x4d, 0x2b, 0xf9, 0x4a, 0x94, 0x39, 0x0b, 0x5e, 0x9a, 0x44, 0xcf, 0xe2, 0xd0, 0x1f, 0x11, 0x65,
+	0xc5, 0x6a, 0xea, 0x2c, 0x36, 0x28, 0x2b, 0x8e, 0x06, 0x61, 0xdc, 0x8c, 0x05, 0x45, 0xcf, 0xad,
+	0x49, 0xc1, 0xf8, 0x10, 0x0f, 0xe3, 0x26, 0xda, 0x86, 0xfa, 0x29, 0xc1, 0x81, 0xec, 0x70, 0x8d,
+	0xc9, 0x6d, 0x0a, 0xb9, 0x97, 0x3f, 0x78, 0xde, 0xee, 0x1d, 0x8c, 0x3c, 0x0f, 0x0f, 0x26, 0xb6,
+	0x36, 0x50, 0x31, 0x35, 0x76, 0xae, 0x44, 0x74, 0xbe, 0x7e, 0x99, 0x12, 0x65, 0x0a, 0x53, 0x22,
+	0x2c, 0xf9, 0x0a, 0xd6, 0xce, 0xdc, 0x10, 0x1f, 0x8f, 0xac, 0x70, 0xf2, 0xbc, 0xb9, 0xca, 0x54,
+	0x6e, 0xc8, 0x43, 0x41, 0xe2, 0x26, 0xac, 0x5a, 0x3d, 0xcb, 0x67, 0x4d, 0xd1, 0x2e, 0x0c, 0xbe,
+	0x76, 0xb1, 0x76, 0x65, 0xee, 0xea, 0x59, 0x3e, 0x8b, 0x2e, 0xcb, 0x58, 0xfb, 0x2b, 0x3c, 0x36,
+	0xe9, 0xb1, 0x32, 0x70, 0x6d, 0xd2, 0xba, 0x9e, 0x5a, 0x96, 0x4a, 0xf5, 0x33, 0x3c, 0xde, 0x16,
+	0x10, 0xba, 0x2c, 0xcf, 0x72, 0xe8, 0x4f, 0x6b, 0x30, 0x17, 0x58, 0x63, 0x7a, 0xc4, 0xe9, 0xbf,
+	0x2a, 0x43, 0xe3, 0x93, 0xd0, 0x1f, 0xc6, 0x19, 0x46, 0x1f, 0x96, 0x83, 0xd0, 0xb7, 0x71, 0x14,
+	0x99, 0x11, 0xb1, 0xc8, 0x28, 0x4a, 0x67, 0x00, 0x32, 0x54, 0xf6, 0x39, 0x66, 0x9f, 0x41, 0xe2,
+	0xe0, 0x1b, 0x4c, 0x92, 0xd1, 0x8f, 0xe0, 0x6a, 0x3a, 0x7a, 0xa4, 0xf5, 0xf2, 0xb4, 0xe0, 0x46,
+	0x4e, 0x10, 0xc9, 0x28, 0x6f, 0x9d, 0x4c, 0xe1, 0x4d, 0xed, 0x41, 0xcc, 0x42, 0xf9, 0x92, 0x1e,
+	0xd4, 0x34, 0xb4, 0x4e, 0xa6, 0xf0, 0xd0, 0x00, 0x6e, 0x4c, 0xc6, 0x95, 0xf4, 0x38, 0x78, 0x2a,
+	0xf1, 0xf6, 0x94, 0xf0, 0x92, 0x19, 0xcb, 0xb5, 0xb3, 0x0b, 0xf8, 0x17, 0xf6, 0x26, 0xc6, 0x34,
+	0xf7, 0x1a, 0xbd, 0xa9, 0x71, 0x5d, 0x3b, 0xbb, 0x80, 0x9f, 0x17, 0x4d, 0xaa, 0xb9, 0xd1, 0xe4,
+	0x25, 0xc4, 0xeb, 0x34, 0x33, 0x78, 0x9e, 0x58, 0x5c, 0xcb, 0xae, 0xc6, 0xcc, 0xa8, 0x97, 0xcf,
+	0xf2, 0x18, 0xc9, 0xf5, 0xf8, 0xf3, 0x02, 0xcc, 0x27, 0x23, 0x29, 0x7a, 0x04, 0x15, 0x1e, 0x49,
+	0x5b, 0x85, 0xcd, 0x52, 0x62, 0x16, 0x93, 0x20, 0xd1, 0xd8, 0xf1, 0x48, 0x38, 0x36, 0x04, 0x7c,
+	0xfd, 0x31, 0xd4, 0x13, 0x64, 0xa4, 0x41, 0xe9, 0x15, 0x1e, 0xb3, 0xa4, 0xb9, 0x66, 0xd0, 0x4f,
+	0xb4, 0x04, 0xe5, 0x53, 0x6b, 0x30, 0xe2, 0x99, 0x71, 0xcd, 0xe0, 0x8d, 0x8f, 0x8a, 0x1f, 0x16,
+	0xf4, 0x2a, 0x54, 0x78, 0x3a, 0xad, 0xff, 0xae, 0x00, 0xf5, 0x44, 0xaa, 0x8c, 0x9a, 0x50, 0x74,
+	0x1d, 0xa1, 0xa4, 0xe8, 0x3a, 0xa8, 0x05, 0x73, 0x43, 0x4c, 0x7d, 0x13, 0xb5, 0x8a, 0x9b, 0xa5,
+	0xad, 0x9a, 0x21, 0x9b, 0xe8, 0x2e, 0xcc, 0x92, 0x71, 0xc0, 0x77, 0x4d, 0x53, 0x39, 0x26, 0xa1,
+	0x8b, 0x7f, 0x1f, 0x8c, 0x03, 0x6c, 0x30, 0xa4, 0xfe, 0x1e, 0xd4, 0x14, 0x09, 0x55, 0xa0, 0xd8,
+	0xed, 0x6b, 0x33, 0x68, 0x81, 0xf6, 0x6f, 0xb6, 0x7b, 0x1d, 0xb3, 0xbf, 0x67, 0x1c, 0x68, 0x05,
+	0x34, 0x07, 0xa5, 0xde, 0xce, 0x81, 0x56, 0xd4, 0x03, 0xd0, 0xb2, 0x59, 0xf8, 0x84, 0x79, 0x6f,
+	0x43, 0xc3, 0x72, 0x1c, 0xec, 0x98, 0x69, 0x23, 0xe7, 0x19, 0xf1, 0x85, 0xb0, 0xf4, 0x16, 0x2c,
+	0xf0, 0x35, 0x15, 0xc3, 0x4a, 0x0c, 0xd6, 0x14, 0x64, 0x01, 0xd4, 0xaf, 0x0b, 0x5f, 0x88, 0x65,
+	0x93, 0xe9, 0x4c, 0xb7, 0x60, 0x31, 0x27, 0x23, 0x47, 0x9b, 0x0a, 0x56, 0xbf, 0xa7, 0xc5, 0x87,
+	0x07, 0x45, 0x74, 0x3b, 0xcc, 0xca, 0x2d, 0x98, 0x13, 0x59, 0xb9, 0x28, 0x52, 0x9a, 0x69, 0x98,
+	0x21, 0xd9, 0xfa, 0xa3, 0x4c, 0x17, 0xc2, 0x92, 0x4b, 0xbb, 0xd0, 0x6f, 0x40, 0x4d, 0x11, 0x10,
+	0x82, 0x59, 0x1a, 0x1e, 0x85, 0xe9, 0xec, 0x5b, 0xf7, 0x61, 0x4e, 0x00, 0xd0, 0x5d, 0x68, 0xb8,
+	0xde, 0xa1, 0x3f, 0xf2, 0x1c, 0x33, 0x1c, 0x0d, 0x70, 0x24, 0x16, 0x5e, 0x5d, 0x86, 0xbc, 0xd1,
+	0x00, 0x1b, 0xf3, 0x02, 0x41, 0x1b, 0x11, 0xba, 0x07, 0x4d, 0x7f, 0x44, 0x92, 0x22, 0xc5, 0x49,
+	0x91, 0x86, 0x84, 0x30, 0x19, 0xfd, 0x2b, 0x40, 0x93, 0xc5, 0x01, 0xba, 0x91, 0x18, 0xc9, 0x82,
+	0x1c, 0x09, 0x03, 0x08, 0x5f, 0xdd, 0x84, 0x0a, 0x2f, 0x10, 0x5a, 0xc5, 0x54, 0xf9, 0xc7, 0x41,
+	0x86, 0x60, 0xea, 0x0f, 0xd2, 0xda, 0x85, 0x9f, 0x2e, 0xd3, 0xae, 0xdf, 0x83, 0xaa, 0x6c, 0x53,
+	0x2f, 0x11, 0x17, 0x87, 0xd2, 0x4b, 0xf4, 0x5b, 0x79, 0xae, 0x98, 0xf0, 0xdc, 0x5f, 0x0b, 0x50,
+	0xe1, 0x42, 0xdf, 0x8f, 0xe7, 0xd0, 0x35, 0xa8, 0x8d, 0x3c, 0x12, 0xd2, 0xe2, 0xd9, 0x61, 0xdb,
+	0xab, 0x6a, 0xc4, 0x04, 0xb4, 0x06, 0xd5, 0x20, 0xc4, 0xa6, 0xe3, 0x59, 0x84, 0x45, 0x96, 0x2a,
+	0x5d, 0x3d, 0xb8, 0xe3, 0x59, 0x84, 0x0a, 0xaa, 0xb4, 0x88, 0xc5, 0x84, 0x9a, 0x11, 0x13, 0xf4,
+	0x5f, 0x36, 0x61, 0x96, 0x76, 0x80, 0x56, 0xa0, 0x42, 0x2b, 0x2a, 0xdf, 0x13, 0x43, 0x17, 0x2d,
+	0xf4, 0x3e, 0x80, 0x1b, 0x98, 0xa7, 0x38, 0x8c, 0x28, 0xaf, 0xc8, 0xf6, 0xb5, 0xa6, 0xf6, 0xf5,
+	0x4b, 0x4e, 0x37, 0x6a, 0x6e, 0x20, 0x3e, 0xd1, 0xff, 0x51, 0x53, 0x7c, 0xe2, 0xdb, 0xfe, 0xa0,
+	0x55, 0x4a, 0x3b, 0x5d, 0x90, 0x0d, 0x05, 0x40, 0xab, 0x30, 0x17, 0x85, 0xb6, 0xe9, 0x61, 0x6a,
+	0x36, 0xdd, 0x7d, 0x95, 0x28, 0xb4, 0x7b, 0x98, 0xa0, 0xf7, 0xa0, 0x46, 0x19, 0x81, 0x1f, 0x92,
+	0xa8, 0x55, 0x66, 0xde, 0x51, 0x6b, 0xdc, 0x0f, 0x89, 0x61, 0x79, 0xc7, 0xd8, 0xa8, 0x46, 0xa1,
+	0x4d, 0x5b, 0x11, 0xd5, 0xe3, 0x44, 0x84, 0xe9, 0xa9, 0x70, 0x3d, 0x4e, 0x44, 0x84, 0x1e, 0xca,
+	0xe0, 0x7a, 0xe6, 0xa6, 0xe9, 0x71, 0x22, 0xc2, 0xf5, 0x5c, 0x87, 0x9a, 0x6b, 0x0f, 0x03, 0x93,
+	0x1d, 0x62, 0x34, 0x1c, 0x94, 0x77, 0x67, 0x8c, 0x2a, 0x25, 0xb1, 0xf3, 0xe9, 0x09, 0x34, 0x15,
+	0xdb, 0xb4, 0x7d, 0x47, 0x46, 0x00, 0x99, 0x92, 0x76, 0x05, 0xb0, 0xed, 0x39, 0xdb, 0xbe, 0xc3,
+	0x0a, 0x22, 0x29, 0x4b, 0xdb, 0xe8, 0x6d, 0x68, 0xd2, 0x51, 0xb9, 0x81, 0x49, 0x2f, 0x08, 0x5c,
+	0x27, 0x6a, 0x01, 0xb3, 0xb6, 0x1e, 0x85, 0x76, 0x37, 0xd8, 0xc7, 0xa4, 0xeb, 0x44, 0x14, 0x44,
+	0x4d, 0x4e, 0x80, 0xea, 0x1c, 0xe4, 0x44, 0x44, 0x81, 0x1e, 0xc1, 0x1a, 0x73, 0x9c, 0x35, 0xc4,
+	0x0e, 0x1b, 0x5d, 0x12, 0x3f, 0xcf, 0xf0, 0x4b, 0xd4, 0x95, 0x94, 0x4f, 0x87, 0x96, 0x14, 0x64,
+	0x9e, 0xca, 0x15, 0x6c, 0x70, 0x41, 0xea, 0xbb, 0x09, 0xc1, 0x7b, 0x30, 0xef, 0xf9, 0xc4, 0x54,
+	0x73, 0x7b, 0x94, 0x3f, 0xb7, 0x75, 0xcf, 0x27, 0xb2, 0x81, 0x36, 0x80, 0x36, 0x4d, 0x39, 0xc5,
+	0xc7, 0x4c, 0x7d, 0xcd, 0xf3, 0xc9, 0x3e, 0x9f, 0xe5, 0xfb, 0xd0, 0x90, 0x7c, 0x3e, 0x43, 0x27,
+	0x53, 0x66, 0xa8, 0xce, 0x65, 0xf8, 0x24, 0x09, 0xad, 0x72, 0xc2, 0x5d, 0xa5, 0xb5, 0x13, 0x91,
+	0x84, 0xd6, 0x78, 0xde, 0x7f, 0x7c, 0x81, 0xd6, 0x8e, 0x9c, 0xfa, 0x77, 0xb8, 0x54, 0x3c, 0xfd,
+	0xaf, 0xd8, 0xf4, 0x17, 0x18, 0x4a, 0x4e, 0x2c, 0xda, 0x01, 0x94, 0x42, 0xf1, 0x55, 0x30, 0xb8,
+	0x70, 0x15, 0x14, 0x8c, 0x85, 0x84, 0x0a, 0x4a, 0x42, 0xb7, 0x01, 0xc9, 0x81, 0x27, 0xdc, 0x3f,
+	0xe4, 0x01, 0x88, 0x8f, 0x55, 0x39, 0x5e, 0x60, 0x33, 0x6b, 0xc2, 0x53, 0xd8, 0x4e, 0x62, 0x59,
+	0x3c, 0x81, 0xeb, 0xca, 0xe1, 0xb9, 0x33, 0x1c, 0x30, 0xb1, 0x55, 0x31, 0x05, 0x13, 0x93, 0x2c,
+	0xe4, 0xa7, 0xaf, 0x90, 0xaf, 0x95, 0x7c, 0x27, 0x7f, 0x91, 0x2c, 0xfb, 0xa1, 0x7b, 0xec, 0x7a,
+	0xd6, 0x80, 0x19, 0x11, 0xe1, 0x01, 0xb6, 0x89, 0x1f, 0xb6, 0x42, 0x76, 0xa8, 0x2c, 0x4a, 0xe6,
+	0x7e, 0x68, 0xef, 0x0b, 0x56, 0x4a, 0x86, 0x76, 0xac, 0x64, 0xa2, 0xb4, 0x4c, 0x27, 0x22, 0x4a,
+	0x66, 0x07, 0x6e, 0xa4, 0xfa, 0x89, 0x4b, 0x45, 0x25, 0x4d, 0x98, 0xf4, 0xb5, 0x44, 0x8f, 0xaa,
+	0x60, 0xcc, 0x55, 0x23, 0xc7, 0x9c, 0x51, 0x33, 0x4a, 0xab, 0x11, 0xa3, 0x4e, 0xab, 0x79, 0x0c,
+	0x6b, 0x4a, 0x8d, 0x74, 0xbf, 0x52, 0x70, 0xca, 0x14, 0xac, 0x48, 0x40, 0x8f, 0x79, 0x7e, 0xaa,
+	0x68, 0xca, 0x01, 0x67, 0x13, 0xa2, 0x49, 0x1f, 0x7c, 0xce, 0x8f, 0x80, 0x6c, 0xfd, 0x3e, 0xb4,
+	0x88, 0x7d, 0xd2, 0x3a, 0x4f, 0x95, 0x2d, 0xe9, 0xf2, 0xfd, 0x05, 0x45, 0x18, 0x2b, 0x51, 0x68,
+	0xe7, 0xd0, 0xa9, 0x5a, 0x6e, 0x44, 0x9e, 0xda, 0xf1, 0xe5, 0x6a, 0x9d, 0x88, 0xe4, 0xd0, 0x69,
+	0x1c, 0x39, 0x21, 0x24, 0x10, 0x7a, 0x7e, 0x92, 0xca, 0x5a, 0x76, 0x0f, 0x0e, 0xfa, 0x5c, 0xba,
+	0x46, 0x31, 0x52, 0xa0, 0x2a, 0x6f, 0x4e, 0x5a, 0x3f, 0x4d, 0xdd, 0x39, 0xd1, 0x78, 0xa5, 0x2e,
+	0x47, 0x14, 0x88, 0x66, 0xa5, 0x34, 0x98, 0x9a, 0xae, 0xd3, 0xfa, 0x56, 0xc4, 0x30, 0xda, 0xee,
+	0x3a, 0x4f, 0x2b, 0x30, 0x4b, 0x37, 0xec, 0x53, 0x80, 0xaa, 0xdc, 0xbc, 0x9f, 0x55, 0xaa, 0xdf,
+	0x14, 0xb4, 0x6f, 0x0b, 0x06, 0x0c, 0xfc, 0x63, 0x33, 0x08, 0xf1, 0x91, 0x7b, 0xae, 0x7f, 0x0a,
+	0x8b, 0x79, 0xa6, 0xaf, 0x43, 0x55, 0x4d, 0x09, 0x57, 0xac, 0xda, 0x34, 0x9d, 0x66, 0x8b, 0x46,
+	0xe4, 0x98, 0xbc, 0xa1, 0xff, 0xa1, 0x00, 0x35, 0x35, 0x28, 0x9e, 0x2e, 0x93, 0x13, 0xdf, 0xe1,
+	0xa9, 0x41, 0xcd, 0x90, 0x4d, 0x74, 0x17, 0xca, 0x81, 0x45, 0x4e, 0x64, 0xfc, 0x5f, 0xcf, 0xfa,
+	0xe3, 0x4e, 0xdf, 0x22, 0x27, 0xec, 0xcb, 0xe0, 0xc0, 0xf5, 0x67, 0x50, 0x53, 0x34, 0xb4, 0x02,
+	0x65, 0x7c, 0x6e, 0xd9, 0x84, 0x5b, 0xb5, 0x3b, 0x63, 0xf0, 0x26, 0x6a, 0x41, 0x85, 0x8f, 0x88,
+	0xa7, 0x2c, 0xf4, 0x7a, 0x9c, 0xb7, 0x9f, 0xce, 0x03, 0x50, 0x3d, 0x7c, 0x16, 0xf4, 0xdf, 0x16,
+	0x60, 0x3e, 0xe9, 0x4c, 0xf4, 0x09, 0xd4, 0x2d, 0xcf, 0xf3, 0x89, 0x45, 0x43, 0xbf, 0x4c, 0x64,
+	0xde, 0xc9, 0x71, 0xfb, 0x9d, 0x76, 0x0c, 0xe3, 0x05, 0x48, 0x52, 0x70, 0xfd, 0x09, 0x68, 0x59,
+	0xc0, 0x1b, 0x95, 0x22, 0x8f, 0x61, 0x21, 0x73, 0x88, 0xb2, 0xc4, 0x8c, 0x9e, 0xca, 0x54, 0xbe,
+	0xcc, 0x6b, 0x07, 0x4a, 0x63, 0xc7, 0x6f, 0x91, 0xd3, 0xe8, 0xb7, 0xfe, 0x1c, 0xaa, 0x2a, 0xfc,
+	0xb4, 0xa0, 0x22, 0x2a, 0xbb, 0x82, 0x08, 0xe5, 0xa2, 0x8d, 0x96, 0x92, 0x29, 0xdd, 0xee, 0x0c,
+	0x4f, 0xea, 0x9e, 0x6a, 0xd0, 0xe4, 0x7c, 0xd3, 0x0f, 0xd9, 0x59, 0xa0, 0x3f, 0x80, 0x9a, 0x0a,
+	0x17, 0xd4, 0xde, 0x23, 0x37, 0x8c, 0x88, 0xb0, 0x81, 0x37, 0xa8, 0x11, 0x03, 0x2b, 0x22, 0xd2,
+	0x08, 0xfa, 0xad, 0xff, 0xba, 0x00, 0x28, 0x5b, 0x9c, 0x76, 0x3b, 0xb4, 0xe6, 0xf0, 0x43, 0xfb,
+	0x04, 0x47, 0x24, 0xb4, 0x88, 0x1f, 0xd2, 0x95, 0xca, 0x87, 0xde, 0x4c, 0x92, 0xbb, 0x0e, 0xba,
+	0x01, 0x75, 0x55, 0x09, 0xbb, 0x3c, 0xdd, 0xab, 0x19, 0x20, 0x49, 0x1c, 0xa0, 0x2a, 0x64, 0xd7,
+	0x61, 0x29, 0x5f, 0xcd, 0x00, 0x49, 0xea, 0x3a, 0x9f, 0xcd, 0x56, 0x0b, 0x5a, 0xd1, 0xa8, 0xd2,
+	0xca, 0x9e, 0x0d, 0xe4, 0x1c, 0x56, 0xf2, 0x6f, 0x95, 0xd1, 0xbb, 0x89, 0xf4, 0x78, 0x6d, 0x4a,
+	0x61, 0x2d, 0xd2, 0xf0, 0x0f, 0xa0, 0x2a, 0xbb, 0x68, 0x95, 0x53, 0x2f, 0x23, 0x59, 0x01, 0x43,
+	0x01, 0xf5, 0x3f, 0x16, 0x41, 0xcb, 0xb2, 0xa9, 0x2b, 0x69, 0x25, 0x2d, 0xab, 0x11, 0xde, 0xc8,
+	0x4b, 0xb4, 0xe9, 0xb2, 0x19, 0x5a, 0xb6, 0x70, 0x01, 0xfd, 0xa4, 0x63, 0x97, 0xcf, 0x19, 0x34,
+	0x22, 0xf1, 0xbc, 0x11, 0x04, 0x89, 0x06, 0xa1, 0xab, 0x50, 0x73, 0x83, 0xd3, 0xfb, 0x34, 0x39,
+	0xe0, 0xb9, 0x63, 0xcd, 0xa8, 0x52, 0x42, 0x0f, 0x13, 0xc9, 0x7c, 0xc8, 0x99, 0x15, 0xc5, 0x7c,
+	0xc8, 0x98, 0x37, 0xa1, 0x4c, 0x5c, 0x1c, 0xca, 0x4c, 0x51, 0x26, 0x37, 0x07, 0x2e, 0x0e, 0xbb,
+	0xde, 0x91, 0x6f, 0x70, 0x2e, 0x7a, 0x17, 0xaa, 0xbc, 0x03, 0x8b, 0xb4, 0xaa, 0x9b, 0xa5, 0x44,
+	0xed, 0xd6, 0xb3, 0x08, 0x03, 0xce, 0xb1, 0xfe, 0x2c, 0x22, 0xa0, 0x0f, 0x19, 0xb4, 0x36, 0x15,
+	0xfa, 0xb0, 0x67, 0x11, 0x7d, 0x7b, 0x72, 0x8a, 0x44, 0x05, 0xf3, 0xfa, 0x53, 0xa4, 0xb7, 0xa1,
+	0x99, 0xbc, 0xe9, 0xe9, 0x76, 0xb2, 0x4b, 0xa5, 0x78, 0xe9, 0x52, 0x19, 0x00, 0x9a, 0x7c, 0x22,
+	0x41, 0x37, 0x13, 0x36, 0x2c, 0xe7, 0xdc, 0x29, 0x89, 0x25, 0xf2, 0x7e, 0x62, 0x89, 0x94, 0x52,
+	0xa7, 0x76, 0x12, 0x9c, 0x58, 0x1e, 0xff, 0x2e, 0xc2, 0x7c, 0x92, 0x95, 0x57, 0xa7, 0x66, 0xa7,
+	0xbc, 0x38, 0x31, 0xe5, 0x6a, 0xe2, 0x4a, 0x17, 0x4e, 0xdc, 0x1d, 0x58, 0xc4, 0xe7, 0x01, 0xb6,
+	0x09, 0x76, 0x4c, 0x36, 0x83, 0x96, 0xe3, 0x84, 0x72, 0x09, 0x5d, 0x91, 0xac, 0x6e, 0x70, 0x7a,
+	0xbf, 0xed, 0x38, 0x93, 0xf8, 0x87, 0x02, 0x5f, 0x9e, 0xc0, 0x3f, 0xe4, 0xf8, 0x0f, 0x61, 0x41,
+	0xd5, 0x64, 0x26, 0x37, 0xa8, 0x92, 0x6f, 0x50, 0x53, 0xe1, 0x0e, 0x98, 0x65, 0x0f, 0xa0, 0x29,
+	0x0b, 0x38, 0xf3, 0xc2, 0x25, 0x38, 0x2f, 0xea, 0x3a, 0x2e, 0x76, 0x1f, 0x1a, 0x47, 0x7e, 0x78,
+	0x46, 0x6f, 0xa6, 0xb8, 0x54, 0x75, 0x8a, 0x94, 0x40, 0x31, 0x29, 0xfd, 0xff, 0xd3, 0x33, 0x2c,
+	0x56, 0xd9, 0xeb, 0xcd, 0xb0, 0x1e, 0x42, 0x55, 0xaa, 0xcd, 0x9d, 0xab, 0x77, 0x41, 0x73, 0xbd,
+	0xe3, 0x90, 0xde, 0xa4, 0xb2, 0xb2, 0xdc, 0x55, 0xc1, 0x71, 0x41, 0xd0, 0xfb, 0x82, 0x4c, 0xcf,
+	0x43, 0x9c, 0x41, 0x8a, 0x3b, 0x18, 0x9c, 0x02, 0xea, 0x8f, 0x60, 0x4e, 0x6c, 0x17, 0xb4, 0x0c,
+	0x15, 0x7c, 0x4e, 0x53, 0x52, 0x79, 0x74, 0xe0, 0x73, 0xd2, 0x0d, 0x28, 0x99, 0x2d, 0xf0, 0x40,
+	0x06, 0x13, 0x6a, 0x70, 0xa0, 0x1b, 0xb0, 0x98, 0x73, 0x65, 0x4b, 0x6f, 0x88, 0xdc, 0xc8, 0x37,
+	0x89, 0x3b, 0xc4, 0x11, 0xb1, 0x86, 0x52, 0xd7, 0xbc, 0x1b, 0xf9, 0x07, 0x92, 0x46, 0x2b, 0xe2,
+	0x51, 0x40, 0x21, 0x4c, 0x65, 0xc1, 0x10, 0x2d, 0x3d, 0x80, 0xd6, 0xb4, 0xeb, 0xda, 0xd7, 0xdd,
+	0x25, 0xef, 0x41, 0x85, 0x5f, 0x24, 0xb6, 0x8a, 0x29, 0x68, 0x5a, 0xa7, 0x21, 0x40, 0xfa, 0x16,
+	0x34, 0xd3, 0x1c, 0x6a, 0x9b, 0x50, 0x20, 0x32, 0x1d, 0x81, 0x6c, 0xe7, 0xd9, 0xf6, 0x66, 0xf3,
+	0x7b, 0x0e, 0xd7, 0x2e, 0xba, 0xc5, 0x7d, 0x93, 0x78, 0xf1, 0x86, 0xc3, 0xec, 0x4e, 0xeb, 0xf9,
+	0xcd, 0x8f, 0xc1, 0xbf, 0x17, 0x61, 0x39, 0xf7, 0x3a, 0x16, 0x5d, 0x07, 0x08, 0x46, 0x87, 0x03,
+	0xd7, 0x36, 0xe3, 0x6c, 0xa4, 0xc6, 0x29, 0xcf, 0xf0, 0x18, 0xdd, 0x84, 0xe6, 0xc0, 0x8d, 0x08,
+	0xf6, 0x5c, 0xef, 0x98, 0x15, 0x3f, 0x22, 0xae, 0x37, 0x14, 0x95, 0xe6, 0x03, 0x14, 0xe6, 0x7a,
+	0x04, 0x87, 0x47, 0xb4, 0x56, 0x60, 0x5b, 0x80, 0x07, 0xa8, 0x86, 0xa2, 0xd2, 0x2a, 0x21, 0x0d,
+	0xa3, 0x67, 0x47, 0x6b, 0x36, 0x03, 0xa3, 0xe7, 0x06, 0x3d, 0x66, 0x82, 0x10, 0x9f, 0xba, 0xfe,
+	0x28, 0x32, 0x13, 0xc6, 0x55, 0x18, 0xf6, 0x8a, 0x64, 0xf5, 0x95, 0x91, 0xf7, 0x60, 0x59, 0x12,
+	0x29, 0xd0, 0x74, 0xb0, 0xe5, 0x0c, 0x5c, 0x8f, 0x5f, 0x8f, 0x97, 0x0c, 0xa5, 0xec, 0x19, 0x1e,
+	0x77, 0x04, 0x8b, 0xc6, 0x3d, 0x0a, 0xe5, 0x51, 0xb7, 0xca, 0xb3, 0xd8, 0x57, 0x78, 0x4c, 0x7d,
+	0xc3, 0xec, 0xc4, 0x9e, 0x75, 0x38, 0xc0, 0x8e, 0x19, 0xf9, 0xa3, 0xd0, 0xe6, 0xf7, 0x1a, 0x35,
+	0xa3, 0x21, 0xa8, 0xfb, 0x8c, 0xa8, 0xff, 0x8c, 0x9f, 0x1b, 0x99, 0x67, 0xd9, 0x75, 0x50, 0xb1,
+	0x43, 0xa6, 0xc7, 0xb2, 0xad, 0x42, 0x31, 0x1b, 0x3b, 0xdf, 0x99, 0x2c, 0x74, 0xca, 0x61, 0x33,
+	0x66, 0x84, 0x6d, 0xdf, 0x73, 0xac, 0x70, 0xcc, 0x61, 0xdc, 0x93, 0x57, 0x28, 0x6b, 0x5f, 0x72,
+	0x28, 0x5e, 0x7f, 0x91, 0xee, 0x5e, 0xac, 0x8a, 0xff, 0xb6, 0x7b, 0x7d, 0x07, 0x9a, 0xe9, 0x67,
+	0xe0, 0x9c, 0x8b, 0xe4, 0xd9, 0xc0, 0xf7, 0x07, 0x62, 0xf5, 0x2e, 0x64, 0x1f, 0x7e, 0x19, 0x53,
+	0xdf, 0x8c, 0xd5, 0x4c, 0xb9, 0x22, 0x7e, 0x02, 0x55, 0x89, 0x60, 0x29, 0xab, 0xeb, 0xa8, 0xfb,
+	0x45, 0xfa, 0x8d, 0x36, 0x00, 0x86, 0x56, 0xf4, 0xf5, 0x08, 0x87, 0x96, 0x48, 0x66, 0xab, 0x46,
+	0x82, 0xa2, 0xff, 0xa5, 0x00, 0x4b, 0x79, 0xaf, 0xba, 0xe8, 0x56, 0x62, 0x43, 0xac, 0xe6, 0xd6,
+	0x64, 0x62, 0x23, 0x7e, 0x0c, 0x95, 0x81, 0x75, 0x88, 0x07, 0xb2, 0xd0, 0xb8, 0x75, 0xc1, 0x5b,
+	0xf1, 0x9d, 0xe7, 0x0c, 0x29, 0x9e, 0x15, 0xb8, 0x18, 0x7d, 0x56, 0x48, 0x90, 0xdf, 0x28, 0x97,
+	0xff, 0x38, 0x6b, 0xbc, 0x7a, 0x7f, 0x79, 0x3d, 0xe3, 0xf5, 0x0e, 0x68, 0x59, 0x7a, 0xfa, 0x52,
+	0xb3, 0x90, 0xb9, 0xd4, 0xcc, 0xbd, 0xb0, 0xfd, 0x73, 0x01, 0x16, 0x32, 0xcf, 0xce, 0x48, 0x4f,
+	0x98, 0x80, 0xb2, 0xaf, 0xca, 0xc2, 0x75, 0x1f, 0x65, 0x5c, 0xa7, 0xe7, 0x3f, 0x61, 0xff, 0xaf,
+	0xbd, 0xf6, 0x20, 0x61, 0xad, 0x70, 0xd8, 0x6b, 0x58, 0xab, 0xbf, 0x05, 0xf5, 0x04, 0x29, 0xf7,
+	0xce, 0xff, 0x4f, 0x45, 0xa8, 0x27, 0x5e, 0xbe, 0xd1, 0x3b, 0x89, 0xc2, 0x2a, 0xbe, 0xda, 0x65,
+	0x88, 0xf8, 0x99, 0x06, 0x7d, 0x40, 0xff, 0xd5, 0xc4, 0xff, 0x0d, 0xc1, 0xd0, 0xfc, 0x22, 0xf8,
+	0x8a, 0xda, 0x12, 0x74, 0x71, 0x33, 0x38, 0xb8, 0x81, 0xfc, 0xa6, 0x03, 0x76, 0x22, 0x22, 0x73,
+	0x77, 0x27, 0x22, 0x48, 0x87, 0x06, 0xbb, 0x67, 0xf1, 0x1d, 0x71, 0x6c, 0xf2, 0xf3, 0x90, 0x5e,
+	0x6d, 0xf6, 0x7c, 0x87, 0x1f, 0x9a, 0x1b, 0x50, 0x57, 0x18, 0x37, 0x90, 0x57, 0xd6, 0x02, 0xd1,
+	0x0d, 0x68, 0x32, 0x18, 0x59, 0x43, 0x6c, 0x46, 0xa3, 0x43, 0x7a, 0xfd, 0x37, 0xc7, 0xf7, 0x0b,
+	0x25, 0xed, 0x33, 0x0a, 0x7a, 0x0b, 0xe6, 0x69, 0x1a, 0xe5, 0x8f, 0xc8, 0xb1, 0xef, 0x7a, 0xc7,
+	0xec, 0xb4, 0xab, 0x1a, 0x75, 0xcf, 0x22, 0x7b, 0x82, 0xc4, 0x8e, 0x79, 0xdf, 0xb6, 0x06, 0xa6,
+	0xac, 0xa9, 0xd8, 0x81, 0x57, 0x35, 0x1a, 0x8c, 0x2a, 0x83, 0x8a, 0x7e, 0x43, 0xb8, 0x4a, 0xcc,
+	0x80, 0x18, 0x4f, 0x51, 0x8d, 0x47, 0xff, 0x45, 0x01, 0xd6, 0xa6, 0xbe, 0xea, 0x33, 0xf7, 0xfb,
+	0x0e, 0x77, 0x2d, 0x75, 0xbf, 0xef, 0xa8, 0x7a, 0xa6, 0x18, 0xd7, 0x33, 0xa9, 0x43, 0xaa, 0x94,
+	0x39, 0x23, 0xb7, 0x40, 0x0b, 0xac, 0x10, 0x7b, 0xc4, 0x74, 0x30, 0xbb, 0x8f, 0x71, 0x03, 0xe1,
+	0xb3, 0x26, 0xa7, 0x77, 0x18, 0xb9, 0x1b, 0xe8, 0xef, 0xe7, 0x5a, 0x22, 0x2c, 0xcf, 0xb1, 0x44,
+	0xff, 0x7d, 0x11, 0x56, 0xa7, 0xbc, 0xfc, 0x5f, 0x78, 0xa8, 0xa6, 0x23, 0x68, 0x31, 0x27, 0x82,
+	0x66, 0x62, 0x5e, 0x29, 0x2f, 0xe6, 0x2d, 0x41, 0x39, 0xc4, 0x96, 0x33, 0x16, 0xcf, 0x15, 0xbc,
+	0x91, 0x13, 0x7e, 0xcb, 0x79, 0xe1, 0xf7, 0x7b, 0x08, 0x98, 0xfa, 0x83, 0x1c, 0xef, 0x5c, 0x1e,
+	0x72, 0x74, 0x0b, 0x96, 0xf2, 0xfe, 0x95, 0x70, 0x59, 0xde, 0x71, 0x1b, 0xae, 0x44, 0xc4, 0x0f,
+	0xe9, 0x8d, 0x6b, 0xd6, 0xb7, 0x0b, 0x9c, 0xa1, 0x46, 0x73, 0x7b, 0x8b, 0x3e, 0x99, 0xca, 0xe7,
+	0x96, 0x39, 0x28, 0xb5, 0x7b, 0x5f, 0x6a, 0x33, 0xa8, 0x0a, 0xb3, 0xdd, 0xfe, 0xcb, 0xfb, 0xda,
+	0xac, 0xf8, 0x7a, 0xa8, 0x55, 0x6e, 0x3b, 0x50, 0x53, 0x1b, 0x19, 0x35, 0xa0, 0xb6, 0xdd, 0xed,
+	0x18, 0x66, 0xb7, 0xf7, 0xc9, 0x9e, 0x36, 0x83, 0x16, 0x61, 0xc1, 0xd8, 0x79, 0xb1, 0x77, 0xb0,
+	0x63, 0x7e, 0xb1, 0x67, 0x3c, 0x7b, 0xbe, 0xd7, 0xee, 0x68, 0x05, 0xfa, 0xf0, 0x2a, 0x88, 0xbb,
+	0x7b, 0xfb, 0x07, 0x5a, 0x11, 0x21, 0x68, 0x3e, 0xdf, 0xdb, 0x6e, 0x3f, 0x8f, 0x41, 0x25, 0xd4,
+	0x04, 0xe0, 0x34, 0x86, 0x99, 0xbd, 0xfd, 0x18, 0x20, 0x3e, 0x00, 0x68, 0xef, 0xbd, 0xbd, 0xde,
+	0x8e, 0x36, 0x83, 0xe6, 0xa1, 0xda, 0xdb, 0x33, 0x77, 0x7a, 0xdb, 0xed, 0xbe, 0x56, 0x40, 0x35,
+	0x28, 0xb3, 0xf5, 0xa9, 0x15, 0xb9, 0x81, 0xdd, 0xbe, 0x56, 0xba, 0xf7, 0x04, 0x80, 0xbf, 0xa2,
+	0xb1, 0x3f, 0x6f, 0xde, 0x85, 0x59, 0xf6, 0x2b, 0x4f, 0xb7, 0xc4, 0x5f, 0x42, 0xd7, 0x25, 0x2d,
+	0xf1, 0xb7, 0xd0, 0xbb, 0x85, 0xa7, 0xab, 0xdf, 0x7c, 0xb7, 0x51, 0xf8, 0xdb, 0x77, 0x1b, 0x85,
+	0x7f, 0x7e, 0xb7, 0x51, 0xf8, 0xcd, 0xbf, 0x36, 0x66, 0x7e, 0x58, 0x66, 0x0f, 0x14, 0x87, 0x15,
+	0xf6, 0xf3, 0xc1, 0x7f, 0x06, 0x00, 0x8c, 0xf1, 0x77, 0x7a, 0x74, 0x2a, 0x00, 0x00,
 }
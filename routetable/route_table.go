@@ -15,10 +15,13 @@
 package routetable
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"net"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -38,6 +41,9 @@ import (
 const (
 	cleanupGracePeriod = 10 * time.Second
 	maxConnFailures    = 3
+
+	// The priority the kernel assigns to an IPv6 route that is added without a priority.
+	ipV6DefaultRoutePriority = 1024
 )
 
 var (
@@ -102,6 +108,21 @@ type Target struct {
 	CIDR    ip.CIDR
 	GW      ip.Addr
 	DestMAC net.HardwareAddr
+
+	// Scope optionally overrides the route scope that is otherwise determined by the target type.
+	Scope *netlink.Scope
+
+	// OnLink sets the onlink flag on the route.
+	OnLink bool
+
+	// Priority is the priority (metric) of the route, lower priorities are preferred. Routes for the same CIDR with a
+	// different priority may coexist, e.g. a lower preference backup route. Routes that are not Felix routes and have a
+	// different priority are left in place unless external routes are removed.
+	Priority int
+
+	// Realm is the routing realm of the route, which classifies the traffic of the route, e.g. for a tc route
+	// classifier. Unlike the TOS of a route, the realm does not restrict the traffic that matches the route.
+	Realm int
 }
 
 func (t Target) Equal(t2 Target) bool {
@@ -122,6 +143,9 @@ func (t Target) RouteType() int {
 }
 
 func (t Target) RouteScope() netlink.Scope {
+	if t.Scope != nil {
+		return *t.Scope
+	}
 	switch t.Type {
 	case TargetTypeThrow:
 		return netlink.SCOPE_UNIVERSE
@@ -152,9 +176,12 @@ type RouteTable struct {
 	numConsistentNetlinkFailures int
 	// Current netlink handle, or nil if we need to reconnect.
 	cachedNetlinkHandle netlinkshim.Netlink
+	// The context of the current Apply, which bounds the netlink calls.
+	applyCtx context.Context
 
 	// Interface update tracking.
 	reSync                bool
+	rebuild               bool
 	ifaceNameToUpdateType map[string]updateType
 	ifacePrefixRegexp     *regexp.Regexp
 	includeNoInterface    bool
@@ -175,6 +202,12 @@ type RouteTable struct {
 	deviceRouteProtocol  int
 	removeExternalRoutes bool
 
+	// The route protocols that routes were previously programmed with, see SetLegacyRouteProtocols.
+	legacyRouteProtocols map[int]bool
+
+	// Whether a route that moves between interfaces is replaced in place, see EnableReplaceOnMove.
+	replaceOnMove bool
+
 	// The route table index. A value of 0 defaults to the main table.
 	tableIndex int
 
@@ -265,6 +298,7 @@ func NewWithShims(
 		pendingConntrackCleanups:       map[ip.Addr]chan struct{}{},
 		newNetlinkHandle:               newNetlinkHandle,
 		netlinkTimeout:                 netlinkTimeout,
+		applyCtx:                       context.Background(),
 		addStaticARPEntry:              addStaticARPEntry,
 		conntrack:                      conntrack,
 		time:                           timeShim,
@@ -276,6 +310,36 @@ func NewWithShims(
 	}
 }
 
+// EnableReplaceOnMove replaces a route that moves between interfaces of the routing table in the same Apply in place,
+// rather than deleting the route from the old interface and adding it to the new interface, which leaves the CIDR
+// without a route in between. Unlike a route that is deleted, a route that is replaced does not have its conntrack
+// entries removed, so this must only be enabled for a routing table that does not rely on the routing table to clean
+// up conntrack, e.g. the wireguard routing tables, whose routes move between throw routes and the wireguard interface
+// in bulk and whose conntrack entries are cleaned up by the wireguard module. By default moving routes are deleted and
+// added back, and their conntrack entries are removed.
+func (r *RouteTable) EnableReplaceOnMove() {
+	r.replaceOnMove = true
+}
+
+// SetLegacyRouteProtocols sets the route protocols that our routes were previously programmed with, e.g. before the
+// configured route protocol was changed. Routes with these protocols are treated as our own routes even if external
+// routes are not removed, so they are removed if unexpected and rewritten with the current route protocol on the next
+// resync. Once rewritten they have the current protocol, so they are only rewritten once.
+func (r *RouteTable) SetLegacyRouteProtocols(protocols []int) {
+	r.legacyRouteProtocols = map[int]bool{}
+	for _, protocol := range protocols {
+		if protocol != r.deviceRouteProtocol {
+			r.legacyRouteProtocols[protocol] = true
+		}
+	}
+}
+
+// ownsRoute returns true if the route was programmed by us, or external routes are removed, so that the route may be
+// removed or rewritten.
+func (r *RouteTable) ownsRoute(route *netlink.Route) bool {
+	return r.removeExternalRoutes || route.Protocol == r.deviceRouteProtocol || r.legacyRouteProtocols[route.Protocol]
+}
+
 func (r *RouteTable) OnIfaceStateChanged(ifaceName string, state ifacemonitor.State) {
 	logCxt := r.logCxt.WithField("ifaceName", ifaceName)
 	if !r.ifacePrefixRegexp.MatchString(ifaceName) {
@@ -398,6 +462,70 @@ func (r *RouteTable) QueueResync() {
 	r.reSync = true
 }
 
+// QueueRebuild queues a resync that also removes the routes in the routing table that are on interfaces not managed by
+// this routing table, so that the routing table exactly matches the expected routes. Routes that are not Felix routes
+// are only removed if external routes are removed. The main routing table is shared, so this is the same as
+// QueueResync for the main table.
+func (r *RouteTable) QueueRebuild() {
+	r.logCxt.Info("Queueing a rebuild of routing table.")
+	r.reSync = true
+	r.rebuild = r.tableIndex != 0 && r.tableIndex != syscall.RT_TABLE_MAIN
+}
+
+// InSync returns true if there is nothing for Apply to do: no resync is pending, no interfaces need their routes
+// updating (including interfaces in their cleanup grace period) and there are no pending conntrack deletions.
+func (r *RouteTable) InSync() bool {
+	return !r.reSync && len(r.ifaceNameToUpdateType) == 0 && len(r.pendingConntrackCleanups) == 0
+}
+
+// InterfaceInSync returns true if the routes of the interface have been applied, and no resync of the interface or of
+// the table is pending. Unlike InSync, this ignores the pending conntrack cleanups.
+func (r *RouteTable) InterfaceInSync(ifaceName string) bool {
+	_, dirty := r.ifaceNameToUpdateType[ifaceName]
+	return !r.reSync && !dirty
+}
+
+// Targets returns the expected targets for an interface keyed off the target CIDR. This includes any pending deltas
+// that have not yet been applied.
+func (r *RouteTable) Targets(ifaceName string) map[ip.CIDR]Target {
+	targets := map[ip.CIDR]Target{}
+	for cidr, target := range r.ifaceNameToTargets[ifaceName] {
+		targets[cidr] = target
+	}
+	for cidr, target := range r.pendingIfaceNameToDeltaTargets[ifaceName] {
+		if target == nil {
+			delete(targets, cidr)
+		} else {
+			targets[cidr] = *target
+		}
+	}
+	return targets
+}
+
+// Target returns the expected target for a CIDR on an interface, as in Targets, without copying the targets of the
+// interface.
+func (r *RouteTable) Target(ifaceName string, cidr ip.CIDR) (Target, bool) {
+	if target, ok := r.pendingIfaceNameToDeltaTargets[ifaceName][cidr]; ok {
+		if target == nil {
+			return Target{}, false
+		}
+		return *target, true
+	}
+	target, ok := r.ifaceNameToTargets[ifaceName][cidr]
+	return target, ok
+}
+
+// AppliedTargets returns the targets for an interface keyed off the target CIDR, as of the last Apply. This excludes
+// any pending deltas. If the last Apply failed to program the routes of the interface, the interface is resynced by the
+// next Apply, and some of the targets may not be programmed.
+func (r *RouteTable) AppliedTargets(ifaceName string) map[ip.CIDR]Target {
+	targets := map[ip.CIDR]Target{}
+	for cidr, target := range r.ifaceNameToTargets[ifaceName] {
+		targets[cidr] = target
+	}
+	return targets
+}
+
 func (r *RouteTable) getNetlink() (netlinkshim.Netlink, error) {
 	if r.cachedNetlinkHandle == nil {
 		if r.numConsistentNetlinkFailures >= maxConnFailures {
@@ -427,7 +555,7 @@ func (r *RouteTable) getNetlink() (netlinkshim.Netlink, error) {
 			"Connected to netlink after previous failures.")
 		r.numConsistentNetlinkFailures = 0
 	}
-	return r.cachedNetlinkHandle, nil
+	return netlinkshim.NetlinkWithContext(r.applyCtx, r.cachedNetlinkHandle, r.netlinkTimeout), nil
 }
 
 func (r *RouteTable) closeNetlink() {
@@ -439,6 +567,22 @@ func (r *RouteTable) closeNetlink() {
 }
 
 func (r *RouteTable) Apply() error {
+	return r.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the pending updates, as Apply, with the netlink calls bounded by the context. Once the
+// context is done no further interfaces are synced, and the interfaces that have not been synced remain dirty for the
+// next Apply.
+func (r *RouteTable) ApplyWithContext(ctx context.Context) error {
+	r.applyCtx = ctx
+	defer func() {
+		r.applyCtx = context.Background()
+	}()
+	if err := netlinkshim.ContextError(ctx); err != nil {
+		r.logCxt.WithError(err).Warn("Apply cancelled before it started")
+		return UpdateFailed
+	}
+
 	if r.reSync {
 		listStartTime := time.Now()
 
@@ -491,6 +635,15 @@ func (r *RouteTable) Apply() error {
 			r.markIfaceForUpdate(InterfaceNone, true)
 		}
 
+		if r.rebuild {
+			if err := r.removeUnmanagedRoutes(nl, links); err != nil {
+				r.logCxt.WithError(err).Error("Failed to remove routes on unmanaged interfaces, retrying...")
+				r.closeNetlink() // Defensive: force a netlink reconnection next time.
+				return UpdateFailed
+			}
+			r.rebuild = false
+		}
+
 		r.reSync = false
 		listIfaceTime.Observe(r.time.Since(listStartTime).Seconds())
 	}
@@ -501,6 +654,12 @@ ifaceLoop:
 		logCxt := r.logCxt.WithField("ifaceName", ifaceName)
 		fullResync := ia == updateTypeFullResync
 		for retry := 0; retry < maxApplyRetries; retry++ {
+			if err := netlinkshim.ContextError(ctx); err != nil {
+				// Leave this and the remaining interfaces dirty for the next Apply.
+				logCxt.WithError(err).Warn("Apply cancelled, leaving remaining interfaces dirty.")
+				r.markIfaceForUpdate(ifaceName, fullResync)
+				break ifaceLoop
+			}
 			var err error
 			if r.vxlan {
 				// Sync L2 routes first.
@@ -555,6 +714,38 @@ ifaceLoop:
 	return nil
 }
 
+// removeUnmanagedRoutes removes the routes in the routing table that are not on one of the interfaces managed by this
+// routing table. The routes on the managed interfaces are reconciled by the resync.
+func (r *RouteTable) removeUnmanagedRoutes(nl netlinkshim.Netlink, links []netlink.Link) error {
+	managedLinkIndexes := set.New()
+	for _, link := range links {
+		if attrs := link.Attrs(); attrs != nil && r.ifacePrefixRegexp.MatchString(attrs.Name) {
+			managedLinkIndexes.Add(attrs.Index)
+		}
+	}
+
+	routes, err := nl.RouteListFiltered(r.netlinkFamily, &netlink.Route{Table: r.tableIndex}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if managedLinkIndexes.Contains(route.LinkIndex) || (route.LinkIndex == 0 && r.includeNoInterface) {
+			continue
+		}
+		if !r.ownsRoute(&route) {
+			continue
+		}
+		r.logCxt.WithFields(log.Fields{
+			"linkIndex": route.LinkIndex,
+			"dst":       route.Dst,
+		}).Info("Rebuild: removing route on unmanaged interface")
+		if err := nl.RouteDel(&route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *RouteTable) syncRoutesForLink(ifaceName string, fullSync bool) error {
 	startTime := time.Now()
 	defer func() {
@@ -630,22 +821,33 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string, fullSync bool) error {
 		routesToDelete = append(routesToDelete, r.createL3Route(linkAttrs, target))
 	}
 
-	// Delete the combined set of routes.
-	for _, route := range routesToDelete {
-		if err := nl.RouteDel(&route); err != nil {
-			logCxt.WithError(err).Warn("Failed to delete route")
-			updatesFailed = true
-		}
+	// If enabled, a route that is moving to another interface of the routing table, e.g. when a CIDR changes from a throw
+	// route to a route to an interface, is replaced in place rather than deleted here and added back by the sync of the
+	// other interface, which would leave the CIDR without a route in between.
+	if r.replaceOnMove {
+		routesToDelete = r.replaceRoutesMovingTo(nl, logCxt, ifaceName, routesToDelete)
 	}
 
-	// Now add target routes.
+	// Add the target routes before deleting the old routes, so that while a route is updated the traffic to the CIDR is
+	// not routed by a lower preference route for the CIDR. The kernel only allows one route with the same destination
+	// and priority, so a route that is being deleted is replaced in place by a route with the same destination and
+	// priority.
 	for _, target := range targetsToCreate {
 		route := r.createL3Route(linkAttrs, target)
 
 		// In case this IP is being re-used, wait for any previous conntrack entry
 		// to be cleaned up.  (No-op if there are no pending deletes.)
 		r.waitForPendingConntrackDeletion(target.CIDR.Addr())
-		if err := nl.RouteAdd(&route); err != nil {
+		var err error
+		if idx := r.indexOfRouteToReplace(routesToDelete, route); idx >= 0 {
+			routesToDelete = append(routesToDelete[:idx], routesToDelete[idx+1:]...)
+			err = nl.RouteReplace(&route)
+		} else if oldIfaceName, ok := r.ifaceMovingFrom(ifaceName, target); ok {
+			err = r.replaceRouteMovingFrom(nl, logCxt, oldIfaceName, route)
+		} else {
+			err = nl.RouteAdd(&route)
+		}
+		if err != nil {
 			logCxt.WithError(err).Warn("Failed to add route")
 			updatesFailed = true
 		}
@@ -659,6 +861,15 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string, fullSync bool) error {
 		}
 	}
 
+	// Delete the remaining routes.
+	sortRoutes(routesToDelete)
+	for _, route := range routesToDelete {
+		if err := nl.RouteDel(&route); err != nil {
+			logCxt.WithError(err).Warn("Failed to delete route")
+			updatesFailed = true
+		}
+	}
+
 	if updatesFailed {
 		r.closeNetlink() // Defensive: force a netlink reconnection next time.
 
@@ -671,6 +882,178 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string, fullSync bool) error {
 	return resyncErr
 }
 
+// indexOfRouteToReplace returns the index of the route with the same destination and priority as the route, or -1 if
+// there is none.
+func (r *RouteTable) indexOfRouteToReplace(routes []netlink.Route, route netlink.Route) int {
+	for idx, existing := range routes {
+		if existing.Dst != nil && existing.Dst.String() == route.Dst.String() &&
+			r.routePriority(existing.Priority) == r.routePriority(route.Priority) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// ifaceMovingFrom returns the other interface with the programmed route for the CIDR of the target if the route is
+// being removed from that interface, i.e. the route is moving to this interface, and moving routes are replaced in
+// place, see EnableReplaceOnMove. The kernel only allows one route with
+// the same destination and priority, so only a route with the same priority is moving.
+func (r *RouteTable) ifaceMovingFrom(ifaceName string, target Target) (string, bool) {
+	if !r.replaceOnMove {
+		return "", false
+	}
+	for otherIfaceName, deltaTargets := range r.pendingIfaceNameToDeltaTargets {
+		if otherIfaceName == ifaceName {
+			continue
+		}
+		if deltaTarget, ok := deltaTargets[target.CIDR]; !ok || deltaTarget != nil {
+			continue
+		}
+		if current, ok := r.ifaceNameToTargets[otherIfaceName][target.CIDR]; ok &&
+			r.routePriority(current.Priority) == r.routePriority(target.Priority) {
+			return otherIfaceName, true
+		}
+	}
+	return "", false
+}
+
+// ifaceMovingTo returns the other interface, and its target, if the route with the destination and priority that is
+// being deleted from this interface is being added to the other interface.
+func (r *RouteTable) ifaceMovingTo(ifaceName string, cidr ip.CIDR, priority int) (string, Target, bool) {
+	for otherIfaceName, deltaTargets := range r.pendingIfaceNameToDeltaTargets {
+		if otherIfaceName == ifaceName {
+			continue
+		}
+		deltaTarget := deltaTargets[cidr]
+		if deltaTarget == nil || deltaTarget.DestMAC != nil ||
+			r.routePriority(deltaTarget.Priority) != r.routePriority(priority) {
+			// No move, or the target needs an ARP entry which is only added by the sync of its own interface.
+			continue
+		}
+		if _, ok := r.ifaceNameToTargets[otherIfaceName][cidr]; ok {
+			// The target is an update of a route that is already programmed on the other interface.
+			continue
+		}
+		return otherIfaceName, *deltaTarget, true
+	}
+	return "", Target{}, false
+}
+
+// replaceRoutesMovingTo replaces the routes to delete from this interface that are moving to another interface by the
+// route to the other interface, and applies the delta of the other interface for the route. It returns the routes that
+// still need to be deleted, which includes a route whose replace failed, e.g. because the kernel does not support the
+// replace of a route by a route of a different type. That route is deleted and added back instead.
+func (r *RouteTable) replaceRoutesMovingTo(
+	nl netlinkshim.Netlink, logCxt *log.Entry, ifaceName string, routesToDelete []netlink.Route,
+) []netlink.Route {
+	remaining := routesToDelete[:0]
+	for _, route := range routesToDelete {
+		if route.Dst == nil {
+			remaining = append(remaining, route)
+			continue
+		}
+		cidr := ip.CIDRFromIPNet(route.Dst)
+		newIfaceName, target, ok := r.ifaceMovingTo(ifaceName, cidr, route.Priority)
+		if !ok {
+			remaining = append(remaining, route)
+			continue
+		}
+		linkAttrs, err := r.linkAttributesForMove(nl, newIfaceName)
+		if err != nil {
+			logCxt.WithError(err).WithField("newIfaceName", newIfaceName).Debug(
+				"Unable to get the interface the route is moving to, deleting the route")
+			remaining = append(remaining, route)
+			continue
+		}
+		newRoute := r.createL3Route(linkAttrs, target)
+		r.waitForPendingConntrackDeletion(cidr.Addr())
+		if err := nl.RouteReplace(&newRoute); err != nil {
+			logCxt.WithError(err).WithField("cidr", cidr).Info(
+				"Failed to replace route moving to another interface, deleting it and adding it back")
+			remaining = append(remaining, route)
+			continue
+		}
+		logCxt.WithFields(log.Fields{"cidr": cidr, "newIfaceName": newIfaceName}).Debug(
+			"Replaced route moving to another interface")
+		if r.ifaceNameToTargets[newIfaceName] == nil {
+			r.ifaceNameToTargets[newIfaceName] = map[ip.CIDR]Target{}
+		}
+		r.ifaceNameToTargets[newIfaceName][cidr] = target
+		delete(r.pendingIfaceNameToDeltaTargets[newIfaceName], cidr)
+	}
+	return remaining
+}
+
+// replaceRouteMovingFrom replaces the route that is moving from the other interface by the route to this interface, and
+// applies the removal of the route from the other interface. If the replace fails, the route on the other interface is
+// deleted and the route is added back.
+func (r *RouteTable) replaceRouteMovingFrom(
+	nl netlinkshim.Netlink, logCxt *log.Entry, oldIfaceName string, route netlink.Route,
+) error {
+	cidr := ip.CIDRFromIPNet(route.Dst)
+	err := nl.RouteReplace(&route)
+	if err == nil {
+		logCxt.WithFields(log.Fields{"cidr": cidr, "oldIfaceName": oldIfaceName}).Debug(
+			"Replaced route moving from another interface")
+	} else {
+		logCxt.WithError(err).WithField("cidr", cidr).Info(
+			"Failed to replace route moving from another interface, deleting it and adding it back")
+		linkAttrs, attrsErr := r.linkAttributesForMove(nl, oldIfaceName)
+		if attrsErr != nil {
+			return attrsErr
+		}
+		oldRoute := r.createL3Route(linkAttrs, r.ifaceNameToTargets[oldIfaceName][cidr])
+		if delErr := nl.RouteDel(&oldRoute); delErr != nil && !netlinkshim.IsNotExist(delErr) {
+			return delErr
+		}
+		err = nl.RouteAdd(&route)
+	}
+	delete(r.ifaceNameToTargets[oldIfaceName], cidr)
+	if len(r.ifaceNameToTargets[oldIfaceName]) == 0 {
+		delete(r.ifaceNameToTargets, oldIfaceName)
+	}
+	delete(r.pendingIfaceNameToDeltaTargets[oldIfaceName], cidr)
+	return err
+}
+
+// linkAttributesForMove returns the link attributes of the other interface of a moving route. Unlike
+// getLinkAttributes, a failure does not affect the netlink connection, since the route is then programmed by the syncs
+// of the interfaces as usual.
+func (r *RouteTable) linkAttributesForMove(nl netlinkshim.Netlink, ifaceName string) (*netlink.LinkAttrs, error) {
+	if ifaceName == InterfaceNone {
+		return nil, nil
+	}
+	link, err := nl.LinkByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	return link.Attrs(), nil
+}
+
+// routePriority returns the priority of a route as programmed by the kernel, which assigns a default priority to IPv6
+// routes that are added without a priority.
+func (r *RouteTable) routePriority(priority int) int {
+	if r.ipVersion == 6 && priority == 0 {
+		return ipV6DefaultRoutePriority
+	}
+	return priority
+}
+
+// coexistsWithTarget returns true if the route has a different priority to the expected or pending target for its
+// destination, in which case the route does not conflict with the route for the target.
+func (r *RouteTable) coexistsWithTarget(
+	route netlink.Route, expectedTargets map[ip.CIDR]Target, pendingDeltaTargets map[ip.CIDR]*Target, dest ip.CIDR,
+) bool {
+	target, ok := expectedTargets[dest]
+	if pendingTarget, pending := pendingDeltaTargets[dest]; pending {
+		if pendingTarget == nil {
+			return false
+		}
+		target, ok = *pendingTarget, true
+	}
+	return ok && r.routePriority(target.Priority) != r.routePriority(route.Priority)
+}
+
 func (r *RouteTable) applyRouteDeltas(ifaceName string) (targetsToCreate, targetsToDelete []Target) {
 	// Determine the set of deleted, created and current targets
 	cidrsToTarget := r.ifaceNameToTargets[ifaceName]
@@ -697,6 +1080,10 @@ func (r *RouteTable) applyRouteDeltas(ifaceName string) (targetsToCreate, target
 		}
 	}
 
+	// Sort the targets so that the routes are programmed in a deterministic order.
+	sortTargets(targetsToCreate)
+	sortTargets(targetsToDelete)
+
 	// Processed the deltas so remove them.
 	delete(r.pendingIfaceNameToDeltaTargets, ifaceName)
 
@@ -710,6 +1097,36 @@ func (r *RouteTable) applyRouteDeltas(ifaceName string) (targetsToCreate, target
 	return
 }
 
+// sortTargets sorts the targets by CIDR.
+func sortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		return compareIPNets(targets[i].CIDR.ToIPNet(), targets[j].CIDR.ToIPNet()) < 0
+	})
+}
+
+// sortRoutes sorts the routes by destination. A route without a destination is the default route.
+func sortRoutes(routes []netlink.Route) {
+	dst := func(route netlink.Route) net.IPNet {
+		if route.Dst == nil {
+			return net.IPNet{}
+		}
+		return *route.Dst
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return compareIPNets(dst(routes[i]), dst(routes[j])) < 0
+	})
+}
+
+// compareIPNets compares the networks by address and then by prefix length.
+func compareIPNets(a, b net.IPNet) int {
+	if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+		return c
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes - bOnes
+}
+
 func (r *RouteTable) createL3Route(linkAttrs *netlink.LinkAttrs, target Target) netlink.Route {
 	log.Debugf("Create L3 route for: %#v", target)
 	var linkIndex int
@@ -725,6 +1142,8 @@ func (r *RouteTable) createL3Route(linkAttrs *netlink.LinkAttrs, target Target)
 		Protocol:  r.deviceRouteProtocol,
 		Scope:     target.RouteScope(),
 		Table:     r.tableIndex,
+		Priority:  target.Priority,
+		Realm:     target.Realm,
 	}
 
 	if r.deviceRouteSourceAddress != nil {
@@ -740,6 +1159,10 @@ func (r *RouteTable) createL3Route(linkAttrs *netlink.LinkAttrs, target Target)
 		route.SetFlag(syscall.RTNH_F_ONLINK)
 	}
 
+	if target.OnLink {
+		route.SetFlag(syscall.RTNH_F_ONLINK)
+	}
+
 	return route
 }
 
@@ -821,7 +1244,33 @@ func (r *RouteTable) fullResyncRoutesForLink(logCxt *log.Entry, ifaceName string
 		}
 		logCxt := logCxt.WithField("dest", dest)
 		// Check if we should remove routes not added by us
-		if !r.removeExternalRoutes && route.Protocol != r.deviceRouteProtocol {
+		if !r.ownsRoute(&route) {
+			if r.coexistsWithTarget(route, expectedTargets, pendingDeltaTargets, dest) {
+				// The route has a different priority to our route for the CIDR, e.g. a lower preference backup route,
+				// so both routes may be programmed.
+				logCxt.WithField("priority", route.Priority).Debug(
+					"Syncing routes: leaving route that is not marked as a Felix route with a different priority")
+				continue
+			}
+			_, expected := expectedTargets[dest]
+			if pendingTarget := pendingDeltaTargets[dest]; pendingTarget != nil {
+				// There is a pending update for the CIDR. Store it as if programmed, since adding the route would fail.
+				if expectedTargets == nil {
+					expectedTargets = map[ip.CIDR]Target{}
+					r.ifaceNameToTargets[ifaceName] = expectedTargets
+				}
+				expectedTargets[dest] = *pendingTarget
+				delete(pendingDeltaTargets, dest)
+				expected = true
+			}
+			if expected {
+				// The route is for a CIDR we want to program. Leave the existing route in place rather than fail to
+				// add our route on each sync.
+				logCxt.WithField("protocol", route.Protocol).Warn(
+					"Syncing routes: route conflicts with a route that is not marked as a Felix route, leaving the existing route")
+				alreadyCorrectCIDRs.Add(dest)
+				continue
+			}
 			logCxt.Info("Syncing routes: not removing route as its not marked as Felix route")
 			continue
 		}
@@ -842,6 +1291,21 @@ func (r *RouteTable) fullResyncRoutesForLink(logCxt *log.Entry, ifaceName string
 			if expectedTargetFound && expectedTarget.RouteType() != route.Type {
 				routeProblems = append(routeProblems, "incorrect type")
 			}
+			if expectedTargetFound {
+				expectedRoute := r.createL3Route(linkAttrs, expectedTarget)
+				if expectedRoute.Scope != route.Scope {
+					routeProblems = append(routeProblems, "incorrect scope")
+				}
+				if expectedRoute.Flags&syscall.RTNH_F_ONLINK != route.Flags&syscall.RTNH_F_ONLINK {
+					routeProblems = append(routeProblems, "incorrect onlink flag")
+				}
+				if r.routePriority(expectedRoute.Priority) != r.routePriority(route.Priority) {
+					routeProblems = append(routeProblems, "incorrect priority")
+				}
+				if expectedRoute.Realm != route.Realm {
+					routeProblems = append(routeProblems, "incorrect realm")
+				}
+			}
 			if (route.Gw == nil && expectedTarget.GW != nil) ||
 				(route.Gw != nil && expectedTarget.GW == nil) ||
 				(route.Gw != nil && expectedTarget.GW != nil && !route.Gw.Equal(expectedTarget.GW.AsNetIP())) {
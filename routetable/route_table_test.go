@@ -19,6 +19,7 @@ import (
 
 	"fmt"
 	"net"
+	"strings"
 	"syscall"
 	"time"
 
@@ -193,6 +194,95 @@ var _ = Describe("RouteTable", func() {
 			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(gatewayRoute))
 			Expect(dataplane.AddedRouteKeys).To(BeEmpty())
 		})
+		It("should not be in-sync until the route cleanup delay has passed", func() {
+			t.SetAutoIncrement(0 * time.Second)
+			Expect(rt.InSync()).To(BeFalse())
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rt.InSync()).To(BeFalse())
+
+			// Once the routes are cleaned up, the table is in-sync after the conntrack deletions complete.
+			t.IncrementTime(11 * time.Second)
+			Eventually(func() bool {
+				Expect(rt.Apply()).To(Succeed())
+				return rt.InSync()
+			}).Should(BeTrue())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(gatewayRoute))
+
+			rt.RouteUpdate("cali1", Target{CIDR: ip.MustParseCIDROrIP("10.0.0.1/32")})
+			Expect(rt.InSync()).To(BeFalse())
+			err = rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rt.InSync()).To(BeTrue())
+		})
+		It("should track whether each interface is in-sync", func() {
+			t.SetAutoIncrement(0 * time.Second)
+			Expect(rt.InterfaceInSync("cali1")).To(BeFalse())
+			Expect(rt.Apply()).To(Succeed())
+			Expect(rt.InterfaceInSync("cali1")).To(BeFalse())
+
+			t.IncrementTime(11 * time.Second)
+			Expect(rt.Apply()).To(Succeed())
+			Expect(rt.InterfaceInSync("cali1")).To(BeTrue())
+			Expect(rt.InterfaceInSync("cali3")).To(BeTrue())
+
+			rt.RouteUpdate("cali1", Target{CIDR: ip.MustParseCIDROrIP("10.0.0.1/32")})
+			Expect(rt.InterfaceInSync("cali1")).To(BeFalse())
+			Expect(rt.InterfaceInSync("cali3")).To(BeTrue())
+			Expect(rt.Apply()).To(Succeed())
+			Expect(rt.InterfaceInSync("cali1")).To(BeTrue())
+		})
+		It("should include pending updates in the targets", func() {
+			cidr1 := ip.MustParseCIDROrIP("10.0.0.1/32")
+			cidr2 := ip.MustParseCIDROrIP("10.0.0.2/32")
+			rt.RouteUpdate("cali1", Target{CIDR: cidr1})
+			Expect(rt.Targets("cali1")).To(Equal(map[ip.CIDR]Target{cidr1: {CIDR: cidr1}}))
+			Expect(rt.Apply()).To(Succeed())
+
+			rt.RouteUpdate("cali1", Target{CIDR: cidr2})
+			rt.RouteRemove("cali1", cidr1)
+			Expect(rt.Targets("cali1")).To(Equal(map[ip.CIDR]Target{cidr2: {CIDR: cidr2}}))
+			Expect(rt.Targets("cali2")).To(BeEmpty())
+
+			By("looking up the target of a single CIDR")
+			target, ok := rt.Target("cali1", cidr2)
+			Expect(ok).To(BeTrue())
+			Expect(target).To(Equal(Target{CIDR: cidr2}))
+			_, ok = rt.Target("cali1", cidr1)
+			Expect(ok).To(BeFalse())
+			_, ok = rt.Target("cali2", cidr2)
+			Expect(ok).To(BeFalse())
+
+			By("excluding the pending updates from the applied targets")
+			Expect(rt.AppliedTargets("cali1")).To(Equal(map[ip.CIDR]Target{cidr1: {CIDR: cidr1}}))
+			Expect(rt.Apply()).To(Succeed())
+			Expect(rt.AppliedTargets("cali1")).To(Equal(map[ip.CIDR]Target{cidr2: {CIDR: cidr2}}))
+		})
+		It("should add and delete the routes in the order of their CIDRs", func() {
+			cidrs := []ip.CIDR{
+				ip.MustParseCIDROrIP("10.0.2.10/32"),
+				ip.MustParseCIDROrIP("10.0.2.9/32"),
+				ip.MustParseCIDROrIP("10.0.1.0/24"),
+				ip.MustParseCIDROrIP("10.0.2.0/24"),
+			}
+			var targets []Target
+			for _, cidr := range cidrs {
+				targets = append(targets, Target{CIDR: cidr})
+			}
+			rt.SetRoutes("cali2", targets)
+			Expect(rt.Apply()).To(Succeed())
+
+			var expected []string
+			for _, cidr := range []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.2.9/32", "10.0.2.10/32"} {
+				expected = append(expected, "254-2-"+cidr)
+			}
+			Expect(dataplane.AddedRouteKeyOrder).To(Equal(expected))
+
+			dataplane.ResetDeltas()
+			rt.SetRoutes("cali2", nil)
+			Expect(rt.Apply()).To(Succeed())
+			Expect(dataplane.DeletedRouteKeyOrder).To(Equal(expected))
+		})
 		It("should wait for the route cleanup delay when resyncing", func() {
 			t.SetAutoIncrement(0 * time.Second)
 			rt.QueueResync()
@@ -529,6 +619,83 @@ var _ = Describe("RouteTable", func() {
 			})
 		})
 
+		Describe("With route scope and onlink overrides", func() {
+			var updateLink *mocknetlink.MockLink
+			var updateRoute netlink.Route
+			scopeUniverse := netlink.SCOPE_UNIVERSE
+			BeforeEach(func() {
+				updateLink = dataplane.AddIface(5, "cali5", true, true)
+				updateRoute = netlink.Route{
+					LinkIndex: updateLink.LinkAttrs.Index,
+					Dst:       mustParseCIDR("10.0.0.5/32"),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  FelixRouteProtocol,
+					Scope:     netlink.SCOPE_LINK,
+				}
+			})
+
+			It("Should add routes with the scope and onlink flag", func() {
+				rt.SetRoutes(updateLink.LinkAttrs.Name, []Target{
+					{CIDR: ip.MustParseCIDROrIP("10.0.0.5"), Scope: &scopeUniverse, OnLink: true},
+				})
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+
+				expectedRoute := updateRoute
+				expectedRoute.Scope = netlink.SCOPE_UNIVERSE
+				expectedRoute.SetFlag(syscall.RTNH_F_ONLINK)
+				Expect(dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&updateRoute)]).To(Equal(expectedRoute))
+			})
+
+			It("Should update the scope of a route", func() {
+				rt.SetRoutes(updateLink.LinkAttrs.Name, []Target{
+					{CIDR: ip.MustParseCIDROrIP("10.0.0.5"), Scope: &scopeUniverse},
+				})
+				dataplane.AddMockRoute(&updateRoute)
+
+				fixedRoute := updateRoute
+				fixedRoute.Scope = netlink.SCOPE_UNIVERSE
+
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.UpdatedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&updateRoute)))
+				Expect(dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&updateRoute)]).To(Equal(fixedRoute))
+			})
+
+			It("Should restore a missing onlink flag and remove an unexpected one", func() {
+				rt.SetRoutes(updateLink.LinkAttrs.Name, []Target{
+					{CIDR: ip.MustParseCIDROrIP("10.0.0.5"), OnLink: true},
+				})
+				dataplane.AddMockRoute(&updateRoute)
+
+				fixedRoute := updateRoute
+				fixedRoute.SetFlag(syscall.RTNH_F_ONLINK)
+
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.UpdatedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&updateRoute)))
+				Expect(dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&updateRoute)]).To(Equal(fixedRoute))
+
+				By("removing the onlink flag from the target")
+				dataplane.ResetDeltas()
+				rt.SetRoutes(updateLink.LinkAttrs.Name, []Target{
+					{CIDR: ip.MustParseCIDROrIP("10.0.0.5")},
+				})
+				err = rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&updateRoute)]).To(Equal(updateRoute))
+
+				By("adding the onlink flag out-of-band and resyncing")
+				dataplane.AddMockRoute(&fixedRoute)
+				dataplane.ResetDeltas()
+				rt.QueueResync()
+				err = rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.UpdatedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&updateRoute)))
+				Expect(dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&updateRoute)]).To(Equal(updateRoute))
+			})
+		})
+
 		Describe("with a slow conntrack deletion", func() {
 			const delay = 300 * time.Millisecond
 			BeforeEach(func() {
@@ -1141,6 +1308,29 @@ var _ = Describe("RouteTable (table 100)", func() {
 			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute))
 			Expect(dataplane.AddedRouteKeys).To(BeEmpty())
 		})
+		It("should only remove routes on other interfaces from the required table on a rebuild", func() {
+			eth1 := dataplane.AddIface(2, "eth1", true, true)
+			eth1RouteTable100 := netlink.Route{
+				LinkIndex: eth1.LinkAttrs.Index,
+				Dst:       mustParseCIDR("10.0.0.4/32"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     100,
+			}
+			dataplane.AddMockRoute(&eth1RouteTable100)
+
+			rt.QueueResync()
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, eth1RouteTable100))
+
+			rt.QueueRebuild()
+			err = rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute))
+			Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+		})
 
 		Describe("after configuring a throw route", func() {
 			JustBeforeEach(func() {
@@ -1205,7 +1395,8 @@ var _ = Describe("RouteTable (table 100)", func() {
 					Table:     100,
 				}))
 				Expect(dataplane.AddedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
-				Expect(dataplane.DeletedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
+				Expect(dataplane.UpdatedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
+				Expect(dataplane.DeletedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeFalse())
 			})
 		})
 
@@ -1235,8 +1426,391 @@ var _ = Describe("RouteTable (table 100)", func() {
 					Table:     100,
 				}))
 				Expect(dataplane.AddedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
-				Expect(dataplane.DeletedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
+				Expect(dataplane.UpdatedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeTrue())
+				Expect(dataplane.DeletedRouteKeys.Contains("100-0-10.10.10.10/32")).To(BeFalse())
+			})
+		})
+
+		Describe("after configuring a throw route and then moving it to an interface", func() {
+			var cidr ip.CIDR
+			var caliMovedRoute netlink.Route
+			moveToCali := func() {
+				rt.RouteRemove(InterfaceNone, cidr)
+				rt.RouteUpdate("cali", Target{CIDR: cidr})
+			}
+			moveToThrow := func() {
+				rt.RouteRemove("cali", cidr)
+				rt.RouteUpdate(InterfaceNone, Target{CIDR: cidr, Type: TargetTypeThrow})
+			}
+
+			JustBeforeEach(func() {
+				cidr = ip.MustParseCIDROrIP("10.10.10.10/32")
+				caliMovedRoute = netlink.Route{
+					LinkIndex: cali.LinkAttrs.Index,
+					Dst:       mustParseCIDR("10.10.10.10/32"),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  FelixRouteProtocol,
+					Scope:     netlink.SCOPE_LINK,
+					Table:     100,
+				}
+				rt.EnableReplaceOnMove()
+				rt.RouteUpdate(InterfaceNone, Target{CIDR: cidr, Type: TargetTypeThrow})
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				dataplane.ResetDeltas()
 			})
+
+			It("should replace the route in place, whichever interface is synced first", func() {
+				for i := 0; i < 10; i++ {
+					moveToCali()
+					err := rt.Apply()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, caliMovedRoute))
+
+					moveToThrow()
+					err = rt.Apply()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, throwRoute))
+				}
+				Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+				Expect(dataplane.UpdatedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&caliMovedRoute)))
+				Expect(dataplane.UpdatedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&throwRoute)))
+				Consistently(dataplane.GetDeletedConntrackEntries).ShouldNot(ContainElement(
+					net.ParseIP("10.10.10.10").To4()))
+			})
+
+			It("should leave the routes in sync after the move", func() {
+				moveToCali()
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rt.AppliedTargets("cali")).To(HaveKey(cidr))
+				Expect(rt.AppliedTargets(InterfaceNone)).NotTo(HaveKey(cidr))
+
+				dataplane.ResetDeltas()
+				rt.QueueResync()
+				err = rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+				Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+				Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, caliMovedRoute))
+			})
+
+			It("should delete the route and add it back if the replace fails", func() {
+				dataplane.FailuresToSimulate = mocknetlink.FailNextRouteReplace
+				moveToCali()
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+				Expect(dataplane.DeletedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&throwRoute)))
+				Expect(dataplane.AddedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&caliMovedRoute)))
+				Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, caliMovedRoute))
+			})
+		})
+
+		Describe("after configuring a throw route and then moving it to an interface without replace on move", func() {
+			var cidr ip.CIDR
+			var caliMovedRoute netlink.Route
+
+			JustBeforeEach(func() {
+				cidr = ip.MustParseCIDROrIP("10.10.10.10/32")
+				caliMovedRoute = netlink.Route{
+					LinkIndex: cali.LinkAttrs.Index,
+					Dst:       mustParseCIDR("10.10.10.10/32"),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  FelixRouteProtocol,
+					Scope:     netlink.SCOPE_LINK,
+					Table:     100,
+				}
+				rt.RouteUpdate(InterfaceNone, Target{CIDR: cidr, Type: TargetTypeThrow})
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				dataplane.ResetDeltas()
+			})
+
+			It("should delete the route, add it back and remove the conntrack entries", func() {
+				rt.RouteRemove(InterfaceNone, cidr)
+				rt.RouteUpdate("cali", Target{CIDR: cidr})
+				err := rt.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dataplane.DeletedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&throwRoute)))
+				Expect(dataplane.AddedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&caliMovedRoute)))
+				Expect(dataplane.RouteKeyToRoute).To(ConsistOf(caliRoute, gatewayRoute, caliMovedRoute))
+				Eventually(dataplane.GetDeletedConntrackEntries).Should(ContainElement(net.ParseIP("10.10.10.10").To4()))
+			})
+		})
+	})
+})
+
+var _ = Describe("RouteTable (table 100) without removing external routes", func() {
+	var dataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var rt *RouteTable
+	var userRoute, userThrowRoute, felixRoute netlink.Route
+
+	BeforeEach(func() {
+		dataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		rt = NewWithShims(
+			[]string{"^cali$", InterfaceNone}, // exact interface match
+			4,
+			dataplane.NewMockNetlink,
+			false,
+			10*time.Second,
+			dataplane.AddStaticArpEntry,
+			dataplane,
+			t,
+			nil,
+			FelixRouteProtocol,
+			false,
+			100,
+		)
+
+		cali := dataplane.AddIface(1, "cali", true, true)
+		userRoute = netlink.Route{
+			LinkIndex: cali.LinkAttrs.Index,
+			Dst:       mustParseCIDR("10.0.0.1/32"),
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  syscall.RTPROT_STATIC,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     100,
+		}
+		dataplane.AddMockRoute(&userRoute)
+		userThrowRoute = netlink.Route{
+			Dst:      mustParseCIDR("10.10.10.10/32"),
+			Type:     syscall.RTN_THROW,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    100,
+		}
+		dataplane.AddMockRoute(&userThrowRoute)
+		felixRoute = netlink.Route{
+			LinkIndex: cali.LinkAttrs.Index,
+			Dst:       mustParseCIDR("10.0.0.2/32"),
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     100,
+		}
+		dataplane.AddMockRoute(&felixRoute)
+	})
+
+	It("should only remove unexpected routes with our protocol", func() {
+		err := rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute))
+		Expect(dataplane.DeletedRouteKeys).To(HaveLen(1))
+		Expect(dataplane.DeletedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&felixRoute)))
+	})
+
+	It("should leave a conflicting route in place", func() {
+		rt.RouteUpdate(InterfaceNone, Target{
+			CIDR: ip.MustParseCIDROrIP("10.10.10.10/32"),
+			Type: TargetTypeThrow,
+		})
+		rt.RouteUpdate("cali", Target{
+			CIDR: ip.MustParseCIDROrIP("10.0.0.1/32"),
+		})
+		err := rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute))
+		Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+
+		By("resyncing")
+		dataplane.ResetDeltas()
+		rt.QueueResync()
+		err = rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute))
+		Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+
+		By("removing our routes")
+		rt.RouteRemove(InterfaceNone, ip.MustParseCIDROrIP("10.10.10.10/32"))
+		rt.RouteRemove("cali", ip.MustParseCIDROrIP("10.0.0.1/32"))
+		err = rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute))
+	})
+
+	It("should add our route once a conflicting route is removed", func() {
+		rt.RouteUpdate(InterfaceNone, Target{
+			CIDR: ip.MustParseCIDROrIP("10.10.10.10/32"),
+			Type: TargetTypeThrow,
+		})
+		err := rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+
+		dataplane.RemoveMockRoute(&userThrowRoute)
+		rt.QueueResync()
+		err = rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		throwRoute := userThrowRoute
+		throwRoute.Protocol = FelixRouteProtocol
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, throwRoute))
+	})
+
+	It("should rewrite the routes with a legacy protocol once, and remove them if unexpected", func() {
+		rt.SetLegacyRouteProtocols([]int{syscall.RTPROT_STATIC})
+		rt.RouteUpdate(InterfaceNone, Target{
+			CIDR: ip.MustParseCIDROrIP("10.10.10.10/32"),
+			Type: TargetTypeThrow,
+		})
+		err := rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		throwRoute := userThrowRoute
+		throwRoute.Protocol = FelixRouteProtocol
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(throwRoute))
+		Expect(dataplane.DeletedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&userRoute)))
+		Expect(dataplane.DeletedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&felixRoute)))
+		Expect(dataplane.AddedRouteKeys).To(HaveKey(mocknetlink.KeyForRoute(&throwRoute)))
+
+		By("not rewriting the routes on later resyncs")
+		dataplane.ResetDeltas()
+		rt.QueueResync()
+		err = rt.Apply()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataplane.RouteKeyToRoute).To(ConsistOf(throwRoute))
+		Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+	})
+
+	Describe("with route priorities", func() {
+		routeCalls := func() []string {
+			var calls []string
+			for _, call := range dataplane.Calls {
+				if strings.HasPrefix(call, "Route") && call != "RouteListFiltered" {
+					calls = append(calls, call)
+				}
+			}
+			return calls
+		}
+
+		It("should program our route alongside a route with a different priority", func() {
+			rt.RouteUpdate("cali", Target{
+				CIDR:     ip.MustParseCIDROrIP("10.0.0.1/32"),
+				Priority: 10,
+			})
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			ourRoute := userRoute
+			ourRoute.Protocol = FelixRouteProtocol
+			ourRoute.Priority = 10
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, ourRoute))
+
+			By("resyncing")
+			dataplane.ResetDeltas()
+			rt.QueueResync()
+			err = rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, ourRoute))
+			Expect(dataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+		})
+
+		It("should add the route with a new priority before deleting the old route", func() {
+			rt.RouteUpdate("cali", Target{
+				CIDR:     ip.MustParseCIDROrIP("10.0.0.3/32"),
+				Priority: 10,
+			})
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+
+			dataplane.ResetDeltas()
+			rt.RouteUpdate("cali", Target{
+				CIDR:     ip.MustParseCIDROrIP("10.0.0.3/32"),
+				Priority: 20,
+			})
+			err = rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(routeCalls()).To(Equal([]string{"RouteAdd", "RouteDel"}))
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, netlink.Route{
+				LinkIndex: userRoute.LinkIndex,
+				Dst:       mustParseCIDR("10.0.0.3/32"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     100,
+				Priority:  20,
+			}))
+		})
+
+		It("should replace a route with an unchanged priority in place", func() {
+			rt.RouteUpdate(InterfaceNone, Target{
+				CIDR:     ip.MustParseCIDROrIP("10.0.0.4/32"),
+				Type:     TargetTypeBlackhole,
+				Priority: 10,
+			})
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+
+			dataplane.ResetDeltas()
+			rt.RouteUpdate(InterfaceNone, Target{
+				CIDR:     ip.MustParseCIDROrIP("10.0.0.4/32"),
+				Type:     TargetTypeProhibit,
+				Priority: 10,
+			})
+			err = rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(routeCalls()).To(Equal([]string{"RouteReplace"}))
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, netlink.Route{
+				Dst:      mustParseCIDR("10.0.0.4/32"),
+				Type:     syscall.RTN_PROHIBIT,
+				Protocol: FelixRouteProtocol,
+				Scope:    netlink.SCOPE_UNIVERSE,
+				Table:    100,
+				Priority: 10,
+			}))
+		})
+	})
+
+	Describe("with route realms", func() {
+		realmRoute := func(realm int) netlink.Route {
+			return netlink.Route{
+				LinkIndex: userRoute.LinkIndex,
+				Dst:       mustParseCIDR("10.0.0.5/32"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     100,
+				Realm:     realm,
+			}
+		}
+
+		BeforeEach(func() {
+			rt.RouteUpdate("cali", Target{
+				CIDR:  ip.MustParseCIDROrIP("10.0.0.5/32"),
+				Realm: 46,
+			})
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, realmRoute(46)))
+		})
+
+		It("should replace the route in place when the realm changes", func() {
+			dataplane.ResetDeltas()
+			rt.RouteUpdate("cali", Target{
+				CIDR:  ip.MustParseCIDROrIP("10.0.0.5/32"),
+				Realm: 10,
+			})
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.DeletedRouteKeys).To(BeEmpty())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, realmRoute(10)))
+		})
+
+		It("should correct a route with the wrong realm on a resync", func() {
+			route := realmRoute(0)
+			dataplane.RouteKeyToRoute[mocknetlink.KeyForRoute(&route)] = route
+
+			By("replacing the route with one with the correct realm")
+			dataplane.ResetDeltas()
+			rt.QueueResync()
+			err := rt.Apply()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataplane.RouteKeyToRoute).To(ConsistOf(userRoute, userThrowRoute, realmRoute(46)))
 		})
 	})
 })
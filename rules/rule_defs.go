@@ -52,7 +52,8 @@ const (
 	ChainNATOutput      = ChainNamePrefix + "OUTPUT"
 	ChainNATOutgoing    = ChainNamePrefix + "nat-outgoing"
 
-	ChainManglePrerouting = ChainNamePrefix + "PREROUTING"
+	ChainManglePrerouting  = ChainNamePrefix + "PREROUTING"
+	ChainManglePostrouting = ChainNamePrefix + "POSTROUTING"
 
 	IPSetIDNATOutgoingAllPools  = "all-ipam-pools"
 	IPSetIDNATOutgoingMasqPools = "masq-ipam-pools"
@@ -161,6 +162,7 @@ type RuleRenderer interface {
 	StaticNATPostroutingChains(ipVersion uint8) []*iptables.Chain
 	StaticRawTableChains(ipVersion uint8) []*iptables.Chain
 	StaticMangleTableChains(ipVersion uint8) []*iptables.Chain
+	StaticManglePostroutingChains(ipVersion uint8) []*iptables.Chain
 
 	WorkloadDispatchChains(map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint) []*iptables.Chain
 	WorkloadEndpointToIptablesChains(
@@ -254,6 +256,12 @@ type Config struct {
 	VXLANPort    int
 	VXLANVNI     int
 
+	// WireguardDSCPEnabled sets the DSCP of the encrypted wireguard traffic sent from WireguardListeningPort to
+	// WireguardDSCP, so that the underlay network can prioritize the traffic, see wireguard.Config.DSCPMarking.
+	WireguardDSCPEnabled   bool
+	WireguardDSCP          uint8
+	WireguardListeningPort int
+
 	IPIPEnabled bool
 	// IPIPTunnelAddress is an address chosen from an IPAM pool, used as a source address
 	// by the host when sending traffic to a workload over IPIP.
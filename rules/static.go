@@ -800,6 +800,23 @@ func (r *DefaultRuleRenderer) StaticManglePreroutingChain(ipVersion uint8) *Chai
 	}
 }
 
+// StaticManglePostroutingChains returns the chains of the mangle POSTROUTING hook, or none if there are no rules for
+// the hook. The DSCP of the encrypted wireguard traffic is set here because wireguard only copies the DSCP of the inner
+// packet in some configurations. Wireguard peers are only reached over IPv4.
+func (r *DefaultRuleRenderer) StaticManglePostroutingChains(ipVersion uint8) []*Chain {
+	if !r.WireguardDSCPEnabled || ipVersion != 4 {
+		return nil
+	}
+	return []*Chain{{
+		Name: ChainManglePostrouting,
+		Rules: []Rule{{
+			Match:   Match().Protocol("udp").SourcePorts(uint16(r.WireguardListeningPort)),
+			Action:  SetDSCPAction{DSCP: r.WireguardDSCP},
+			Comment: []string{"Set the DSCP of the encrypted wireguard traffic."},
+		}},
+	}}
+}
+
 func (r *DefaultRuleRenderer) StaticRawTableChains(ipVersion uint8) []*Chain {
 	return []*Chain{
 		r.failsafeInChain("raw"),
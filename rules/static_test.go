@@ -463,6 +463,38 @@ var _ = Describe("Static", func() {
 				}))
 			})
 
+			It("should not return a mangle POSTROUTING chain", func() {
+				Expect(rr.StaticManglePostroutingChains(4)).To(BeEmpty())
+				Expect(rr.StaticManglePostroutingChains(6)).To(BeEmpty())
+			})
+
+			Describe("with wireguard DSCP marking enabled", func() {
+				BeforeEach(func() {
+					conf.WireguardDSCPEnabled = true
+					conf.WireguardDSCP = 46
+					conf.WireguardListeningPort = 51820
+				})
+
+				It("IPv4: should return the expected mangle POSTROUTING chain", func() {
+					Expect(rr.StaticManglePostroutingChains(4)).To(Equal([]*Chain{{
+						Name: "cali-POSTROUTING",
+						Rules: []Rule{{
+							Match:   Match().Protocol("udp").SourcePorts(51820),
+							Action:  SetDSCPAction{DSCP: 46},
+							Comment: []string{"Set the DSCP of the encrypted wireguard traffic."},
+						}},
+					}}))
+				})
+				It("IPv6: should not return a mangle POSTROUTING chain", func() {
+					Expect(rr.StaticManglePostroutingChains(6)).To(BeEmpty())
+				})
+				It("should render the DSCP rule", func() {
+					chain := rr.StaticManglePostroutingChains(4)[0]
+					Expect(chain.Rules[0].Match.Render()).To(Equal("-p udp -m multiport --source-ports 51820"))
+					Expect(chain.Rules[0].Action.ToFragment(&Features{})).To(Equal("--jump DSCP --set-dscp 46"))
+				})
+			})
+
 			It("IPv4: should include the expected workload-to-host chain in the filter chains", func() {
 				Expect(findChain(rr.StaticFilterTableChains(4), "cali-wl-to-host")).To(Equal(&Chain{
 					Name: "cali-wl-to-host",
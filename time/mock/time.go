@@ -1,6 +1,7 @@
 package mock
 
 import (
+	"sync"
 	"time"
 
 	timeshim "github.com/projectcalico/felix/time"
@@ -15,14 +16,19 @@ func NewMockTime() *MockTime {
 
 var _ timeshim.Time = NewMockTime()
 
+// MockTime is a mock time shim. It may be used from multiple goroutines, e.g. when it is advanced by mock calls made
+// in parallel.
 type MockTime struct {
+	lock          sync.Mutex
 	currentTime   time.Time
 	autoIncrement time.Duration
 }
 
 func (m *MockTime) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	t := m.currentTime
-	m.IncrementTime(m.autoIncrement)
+	m.currentTime = m.currentTime.Add(m.autoIncrement)
 	return t
 }
 
@@ -31,9 +37,13 @@ func (m *MockTime) Since(t time.Time) time.Duration {
 }
 
 func (m *MockTime) SetAutoIncrement(t time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.autoIncrement = t
 }
 
 func (m *MockTime) IncrementTime(t time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.currentTime = m.currentTime.Add(t)
 }
@@ -0,0 +1,208 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin defines the wireguard admin interface that felix serves on a Unix domain socket, see
+// WireguardAdminSocketPath, and provides a client for it, e.g. for the node commands of calicoctl. The interface is
+// JSON over HTTP. Access is controlled by the permissions of the socket, which is only accessible by the user felix
+// runs as.
+//
+// The requests that change the wireguard configuration are processed by the next apply of the dataplane, which is
+// requested, so they are accepted rather than completed when the response is returned.
+package admin
+
+import "time"
+
+// DefaultSocketPath is the conventional path of the wireguard admin socket.
+const DefaultSocketPath = "/var/run/calico/wireguard-admin.sock"
+
+// The paths of the requests of the admin interface.
+const (
+	// PathStatus returns the Status with a GET.
+	PathStatus = "/status"
+
+	// PathDump returns the Dump with a GET.
+	PathDump = "/dump"
+
+	// PathResync queues a resync of the wireguard configuration with a POST.
+	PathResync = "/resync"
+
+	// PathFullRebuild queues a rebuild of the wireguard configuration from scratch with a POST.
+	PathFullRebuild = "/full-rebuild"
+
+	// PathDrain drains the peer named by the node query parameter with a POST, and undrains it with a DELETE.
+	PathDrain = "/drain"
+
+	// PathPause pauses the reconciliation of the wireguard configuration with a POST, and resumes it with a DELETE.
+	PathPause = "/pause"
+
+	// PathWhatIf returns the PathReport for the destination named by the dst query parameter with a GET.
+	PathWhatIf = "/whatif"
+
+	// PathCoverage returns the CoverageReport of the configuration programmed by the next apply with a GET.
+	PathCoverage = "/coverage"
+)
+
+// Status is the local wireguard configuration, and the diagnostics of the wireguard peers.
+type Status struct {
+	Programmed    bool   `json:"programmed"`
+	PublicKey     string `json:"publicKey,omitempty"`
+	ListeningPort int    `json:"listeningPort,omitempty"`
+	InterfaceName string `json:"interfaceName,omitempty"`
+	Mode          string `json:"mode,omitempty"`
+
+	// Enabled is whether wireguard is enabled on this node, and EnabledSource is what determines it: the configuration
+	// or the node override.
+	Enabled       bool   `json:"enabled"`
+	EnabledSource string `json:"enabledSource,omitempty"`
+
+	// KeyDriftsCorrected is the number of times the device was found with a private key other than ours, and was
+	// reprogrammed with our key. The private key itself is never reported.
+	KeyDriftsCorrected int `json:"keyDriftsCorrected,omitempty"`
+
+	// NotSupported is set if wireguard is enabled but not supported, with the time support is next checked.
+	NotSupported bool       `json:"notSupported,omitempty"`
+	NextReprobe  *time.Time `json:"nextReprobe,omitempty"`
+
+	// Capabilities are the features supported by the wireguard device, once probed.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+
+	Peers []PeerDiagnostics `json:"peers,omitempty"`
+
+	// ExcludedByPolicy are the nodes whose traffic is excluded from encryption by policy, which are not programmed as
+	// peers even though they have a public key.
+	ExcludedByPolicy []string `json:"excludedByPolicy,omitempty"`
+
+	// Capacity are the counts of the programmed configuration, once reported by the wireguard module.
+	Capacity *CapacityStats `json:"capacity,omitempty"`
+
+	// RecentOperations are the most recent operations of the trace, if the trace is enabled.
+	RecentOperations []TraceEntry `json:"recentOperations,omitempty"`
+}
+
+// Capabilities are the capabilities of the wireguard device.
+type Capabilities struct {
+	KernelVersion                 string `json:"kernelVersion,omitempty"`
+	ConfigurationPath             string `json:"configurationPath"`
+	CompatModule                  bool   `json:"compatModule"`
+	PresharedKeys                 bool   `json:"presharedKeys"`
+	KeepaliveGranularity          string `json:"keepaliveGranularity"`
+	MaxKeepalive                  string `json:"maxKeepalive"`
+	MaxAllowedIPsPerConfiguration int    `json:"maxAllowedIPsPerConfiguration,omitempty"`
+}
+
+// CapacityStats are the counts of the programmed peers and routes, for capacity planning of the wireguard routing
+// tables and of the allowed IPs of the peers.
+type CapacityStats struct {
+	ProgrammedPeers int            `json:"programmedPeers"`
+	AllowedIPs      int            `json:"allowedIPs"`
+	UnicastRoutes   int            `json:"unicastRoutes"`
+	ThrowRoutes     int            `json:"throwRoutes"`
+	PendingRoutes   int            `json:"pendingRoutes"`
+	SuppressedCIDRs int            `json:"suppressedCIDRs"`
+	TopPeers        []PeerCapacity `json:"topPeers,omitempty"`
+}
+
+// PeerCapacity is the number of CIDRs of a peer, and the number of those programmed as allowed IPs.
+type PeerCapacity struct {
+	NodeName   string `json:"nodeName"`
+	CIDRs      int    `json:"cidrs"`
+	AllowedIPs int    `json:"allowedIPs"`
+}
+
+// PeerDiagnostics are the diagnostics of a wireguard peer. The kernel endpoint, handshake time and traffic counters are
+// read from the device on each resync.
+type PeerDiagnostics struct {
+	NodeName           string     `json:"nodeName"`
+	PublicKey          string     `json:"publicKey"`
+	ConfiguredEndpoint string     `json:"configuredEndpoint,omitempty"`
+	KernelEndpoint     string     `json:"kernelEndpoint,omitempty"`
+	LastHandshakeTime  *time.Time `json:"lastHandshakeTime,omitempty"`
+	HandshakeState     string     `json:"handshakeState"`
+	ReceiveBytes       int64      `json:"receiveBytes"`
+	TransmitBytes      int64      `json:"transmitBytes"`
+	ProvisionalKeyFrom string     `json:"provisionalKeyFrom,omitempty"`
+}
+
+// TraceEntry is an operation in the trace of the netlink and wireguard operations made by the wireguard module.
+type TraceEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"`
+	CIDR       string    `json:"cidr,omitempty"`
+	TableIndex int       `json:"tableIndex,omitempty"`
+	Priority   int       `json:"priority,omitempty"`
+	PeerKey    string    `json:"peerKey,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Cause      string    `json:"cause"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// PathReport is the report of how the traffic to a destination is routed and encrypted.
+type PathReport struct {
+	Destination   string   `json:"destination"`
+	Verdict       string   `json:"verdict"`
+	Reason        string   `json:"reason,omitempty"`
+	Route         string   `json:"route,omitempty"`
+	TableIndex    int      `json:"tableIndex,omitempty"`
+	Peer          string   `json:"peer,omitempty"`
+	PublicKey     string   `json:"publicKey,omitempty"`
+	Endpoint      string   `json:"endpoint,omitempty"`
+	RuleSelectors []string `json:"ruleSelectors,omitempty"`
+
+	// Diverged is set if the desired configuration handles the destination differently, in which case Desired is the
+	// report for the desired configuration.
+	Diverged bool        `json:"diverged,omitempty"`
+	Desired  *PathReport `json:"desired,omitempty"`
+}
+
+// CoverageReport is the encryption coverage of the workload CIDRs of the remote nodes: how many are routed to the
+// wireguard interface, and the number of the others by the reason that their traffic is not encrypted.
+type CoverageReport struct {
+	Active      bool           `json:"active"`
+	CIDRs       int            `json:"cidrs"`
+	Tunneled    int            `json:"tunneled"`
+	Percent     float64        `json:"percent"`
+	FallThrough map[string]int `json:"fallThrough,omitempty"`
+	Peers       []PeerCoverage `json:"peers,omitempty"`
+}
+
+// PeerCoverage is the encryption coverage of the workload CIDRs of a remote node.
+type PeerCoverage struct {
+	NodeName    string         `json:"nodeName"`
+	CIDRs       int            `json:"cidrs"`
+	Tunneled    int            `json:"tunneled"`
+	FallThrough map[string]int `json:"fallThrough,omitempty"`
+}
+
+// Health is the progress of the applies of the wireguard configuration. The times are omitted until they are known.
+type Health struct {
+	LastApplyStart  *time.Time `json:"lastApplyStart,omitempty"`
+	LastApplyEnd    *time.Time `json:"lastApplyEnd,omitempty"`
+	ApplyInProgress bool       `json:"applyInProgress"`
+
+	// PendingSince is the time the oldest of the updates waiting for the next apply was queued.
+	PendingSince *time.Time `json:"pendingSince,omitempty"`
+
+	// DiscrepantResyncs is the number of consecutive resyncs that found the wireguard device did not match the
+	// expected configuration.
+	DiscrepantResyncs int `json:"discrepantResyncs"`
+}
+
+// Dump is everything known about the state of the wireguard module, for debugging: the status, the progress of the
+// applies and the full trace of the operations.
+type Dump struct {
+	Status Status       `json:"status"`
+	Health Health       `json:"health"`
+	Trace  []TraceEntry `json:"trace"`
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client is a client of the wireguard admin interface served on a Unix domain socket. It may be used concurrently.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a client of the wireguard admin interface served on the socket.
+func NewClient(socketPath string) *Client {
+	var dialer net.Dialer
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// RequestError is the error returned for a request that the server failed, with the HTTP status and the message of the
+// server.
+type RequestError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("wireguard admin request failed: %s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// Status returns the local wireguard configuration and the diagnostics of the peers. If the wireguard device is not
+// programmed, the status is returned along with a RequestError with the service unavailable status.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, PathStatus, nil, &status)
+	if reqErr, ok := err.(*RequestError); ok && reqErr.StatusCode == http.StatusServiceUnavailable {
+		return &status, err
+	} else if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Dump returns the status, the progress of the applies and the trace of the operations of the wireguard module.
+func (c *Client) Dump(ctx context.Context) (*Dump, error) {
+	var dump Dump
+	if err := c.do(ctx, http.MethodGet, PathDump, nil, &dump); err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
+
+// Resync queues a resync of the wireguard configuration.
+func (c *Client) Resync(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathResync, nil, nil)
+}
+
+// FullRebuild queues a rebuild of the wireguard configuration from scratch, which replaces all of the peers and routes.
+func (c *Client) FullRebuild(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathFullRebuild, nil, nil)
+}
+
+// Drain administratively drains the peer of a node, so that the traffic to the node is not encrypted.
+func (c *Client) Drain(ctx context.Context, node string) error {
+	return c.do(ctx, http.MethodPost, PathDrain, url.Values{"node": {node}}, nil)
+}
+
+// Undrain reverses Drain.
+func (c *Client) Undrain(ctx context.Context, node string) error {
+	return c.do(ctx, http.MethodDelete, PathDrain, url.Values{"node": {node}}, nil)
+}
+
+// Pause pauses the reconciliation of the wireguard configuration, e.g. while the node networking is reconfigured during
+// maintenance. The reconciliation resumes after WireguardMaxPauseDuration if Resume is not called.
+func (c *Client) Pause(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathPause, nil, nil)
+}
+
+// Resume reverses Pause. The next apply resyncs all of the wireguard configuration.
+func (c *Client) Resume(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, PathPause, nil, nil)
+}
+
+// WhatIf reports how the traffic to a destination address is routed and encrypted by the configuration programmed by
+// the next apply.
+func (c *Client) WhatIf(ctx context.Context, dst string) (*PathReport, error) {
+	var report PathReport
+	if err := c.do(ctx, http.MethodGet, PathWhatIf, url.Values{"dst": {dst}}, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Coverage reports the encryption coverage of the workload CIDRs of the remote nodes by the configuration programmed by
+// the next apply.
+func (c *Client) Coverage(ctx context.Context) (*CoverageReport, error) {
+	var report CoverageReport
+	if err := c.do(ctx, http.MethodGet, PathCoverage, nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// do makes a request and decodes the JSON response into resp, if not nil. The host of the URL is ignored, since the
+// connection is always to the socket.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, resp interface{}) error {
+	u := url.URL{Scheme: "http", Host: "wireguard", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	httpResp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	var reqErr error
+	if httpResp.StatusCode >= 300 {
+		if httpResp.Header.Get("Content-Type") != "application/json" || resp == nil {
+			msg, _ := ioutil.ReadAll(httpResp.Body)
+			return &RequestError{StatusCode: httpResp.StatusCode, Message: strings.TrimSpace(string(msg))}
+		}
+		// The status is returned as JSON even if it is not available.
+		reqErr = &RequestError{StatusCode: httpResp.StatusCode, Message: http.StatusText(httpResp.StatusCode)}
+	}
+	if resp != nil {
+		if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+			return fmt.Errorf("failed to decode the wireguard admin response: %v", err)
+		}
+	}
+	return reqErr
+}
+
+// Close closes the idle connections to the socket.
+func (c *Client) Close() {
+	c.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+}
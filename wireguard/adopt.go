@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// DatastoreInSync notifies that the datastore is in sync, i.e. that all of the peers have been received. If the first
+// Apply adopted the peers of an existing device, see Config.AdoptExistingDevice, the device is resynced by the next
+// Apply, which removes the adopted peers that have not been confirmed by the datastore.
+func (w *Wireguard) DatastoreInSync() {
+	w.queueUpdate(PendingWorkSummary{Peers: true}, func() {
+		if w.datastoreInSync {
+			return
+		}
+		w.datastoreInSync = true
+		if w.adoptedPeers.Len() > 0 {
+			w.logCxt.WithField("numAdopted", w.adoptedPeers.Len()).Info(
+				"Datastore is in sync, resyncing the adopted wireguard peers")
+			w.adoptedPeers = set.New()
+			w.inSyncWireguard = false
+		}
+	})
+}
+
+// adopting returns true while the adopted peers of an existing device are left intact.
+func (w *Wireguard) adopting() bool {
+	return w.adoptedPeers.Len() > 0
+}
+
+// adoptDevice adopts the existing wireguard device read by the first resync of the device, e.g. when felix is restarted
+// on a node whose device was programmed by the previous felix. The private key of the device is kept, and its public
+// key is published immediately. The peers on the device are left intact until the datastore is in sync, since until
+// then the peers may simply not have been received yet. The peers that the datastore confirms are then resynced as
+// usual, and the others are removed.
+//
+// Nothing is adopted if Config.AdoptExistingDevice is not set, if the datastore is already in sync, or if the device
+// has no private key, i.e. it was not previously programmed.
+func (w *Wireguard) adoptDevice(device *wgtypes.Device) {
+	if !w.config.AdoptExistingDevice || w.adoptionDone {
+		return
+	}
+	w.adoptionDone = true
+	if w.datastoreInSync || device.PrivateKey == zeroKey || device.PublicKey == zeroKey {
+		return
+	}
+	for i := range device.Peers {
+		w.adoptedPeers.Add(device.Peers[i].PublicKey)
+	}
+	w.logCxt.WithField("numAdopted", w.adoptedPeers.Len()).Infof(
+		"Adopted existing wireguard device with public key %s, leaving its peers intact until the datastore is in sync",
+		device.PublicKey)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// The maximum number of allowed IPs in a single wireguard device configuration if Config.AllowedIPsChunkSize is not
+// set.
+const defaultAllowedIPsChunkSize = 1000
+
+// allowedIPsChunkSize returns the maximum number of allowed IPs in a single wireguard device configuration.
+func (c *Config) allowedIPsChunkSize() int {
+	if c.AllowedIPsChunkSize == 0 {
+		return defaultAllowedIPsChunkSize
+	}
+	return c.AllowedIPsChunkSize
+}
+
+// peerChunk is the configuration of a peer, or of a chunk of its allowed IPs, in a wireguard device configuration.
+type peerChunk struct {
+	wgtypes.PeerConfig
+	// continued is set on the chunks other than the first chunk of a peer, which only append allowed IPs.
+	continued bool
+}
+
+// chunkPeers splits the configuration of each peer with more allowed IPs than the chunk size into chunks. The first
+// chunk has the rest of the configuration of the peer, and replaces its allowed IPs if the configuration does. The
+// remaining chunks are appended to the allowed IPs of the peer, which is created by the first chunk if required.
+func chunkPeers(peers []wgtypes.PeerConfig, size int) []peerChunk {
+	var chunks []peerChunk
+	for _, peer := range peers {
+		allowedIPs := peer.AllowedIPs
+		if len(allowedIPs) > size {
+			peer.AllowedIPs = allowedIPs[:size]
+		}
+		chunks = append(chunks, peerChunk{PeerConfig: peer})
+		for allowedIPs = allowedIPs[len(peer.AllowedIPs):]; len(allowedIPs) > 0; {
+			n := size
+			if len(allowedIPs) < n {
+				n = len(allowedIPs)
+			}
+			chunks = append(chunks, peerChunk{
+				PeerConfig: wgtypes.PeerConfig{
+					PublicKey:  peer.PublicKey,
+					UpdateOnly: true,
+					AllowedIPs: allowedIPs[:n],
+				},
+				continued: true,
+			})
+			allowedIPs = allowedIPs[n:]
+		}
+	}
+	return chunks
+}
+
+// nextBatch returns the number of chunks in the next wireguard device configuration, which has at most
+// maxPeersPerConfigureDevice chunks and at most size allowed IPs, but always at least one chunk.
+func nextBatch(chunks []peerChunk, size int) int {
+	n, allowedIPs := 0, 0
+	for n < len(chunks) && n < maxPeersPerConfigureDevice {
+		allowedIPs += len(chunks[n].AllowedIPs)
+		if n > 0 && allowedIPs > size {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// addConfiguredChunkRoutes adds the held back routes to the wireguard interface for the allowed IPs that were
+// configured before the wireguard configuration failed. The routes for the allowed IPs of the remaining chunks are
+// held back until the configuration is resumed by the next Apply, see constructWireguardDeltaForResync.
+func (w *Wireguard) addConfiguredChunkRoutes() {
+	for cidr, pending := range w.routesPendingWireguard {
+		if !w.configuredAllowedIPs[cidr] {
+			continue
+		}
+		w.logCxt.Debugf("Adding held back route to wireguard for %s, whose chunk was configured", cidr)
+		w.addPendingRoute(pending)
+	}
+}
+
+// trackConfiguredAllowedIPs records the allowed IPs of a wireguard device configuration that has been applied.
+func (w *Wireguard) trackConfiguredAllowedIPs(chunks []peerChunk) {
+	for _, chunk := range chunks {
+		for i := range chunk.AllowedIPs {
+			w.configuredAllowedIPs[ip.CIDRFromIPNet(&chunk.AllowedIPs[i])] = true
+		}
+	}
+}
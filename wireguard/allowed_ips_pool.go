@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// allowedIPsPool holds the allowed IPs of the wireguard device configurations built by an Apply. The configurations are
+// applied synchronously and are not retained once the Apply completes, so the memory is reused by the next Apply rather
+// than allocating the address and mask of every allowed IP of every configured peer. The memory of an Apply that needs
+// more than the pool holds is allocated as a single block, which the pool then keeps.
+type allowedIPsPool struct {
+	ipNets []net.IPNet
+	bytes  []byte
+}
+
+// reset releases the allowed IPs of the previous Apply for reuse.
+func (p *allowedIPsPool) reset() {
+	p.ipNets = p.ipNets[:0]
+	p.bytes = p.bytes[:0]
+}
+
+// allowedIPs returns the allowed IPs of the CIDRs, which are valid until the pool is reset. The capacity of the
+// returned slice is its length, so appending to it does not overwrite the allowed IPs of another peer.
+func (p *allowedIPsPool) allowedIPs(cidrs []ip.CIDR) []net.IPNet {
+	if len(cidrs) == 0 {
+		return []net.IPNet{}
+	}
+	numBytes := 0
+	for _, cidr := range cidrs {
+		numBytes += 2 * addrLen(cidr)
+	}
+	if cap(p.ipNets)-len(p.ipNets) < len(cidrs) {
+		p.ipNets = make([]net.IPNet, 0, 2*cap(p.ipNets)+len(cidrs))
+	}
+	if cap(p.bytes)-len(p.bytes) < numBytes {
+		p.bytes = make([]byte, 0, 2*cap(p.bytes)+numBytes)
+	}
+
+	start := len(p.ipNets)
+	for _, cidr := range cidrs {
+		n := addrLen(cidr)
+		b := p.bytes[len(p.bytes) : len(p.bytes)+2*n]
+		p.bytes = p.bytes[:len(p.bytes)+2*n]
+		switch cidr := cidr.(type) {
+		case ip.V4CIDR:
+			addr := cidr.Addr().(ip.V4Addr)
+			copy(b, addr[:])
+		case ip.V6CIDR:
+			addr := cidr.Addr().(ip.V6Addr)
+			copy(b, addr[:])
+		}
+		putMask(b[n:2*n], int(cidr.Prefix()))
+		p.ipNets = append(p.ipNets, net.IPNet{IP: net.IP(b[:n:n]), Mask: net.IPMask(b[n : 2*n : 2*n])})
+	}
+	return p.ipNets[start:len(p.ipNets):len(p.ipNets)]
+}
+
+// addrLen returns the length of the address of the CIDR, as a net.IP.
+func addrLen(cidr ip.CIDR) int {
+	if cidr.Version() == 4 {
+		return net.IPv4len
+	}
+	return net.IPv6len
+}
+
+// putMask writes the mask of the prefix length, as net.CIDRMask.
+func putMask(mask []byte, ones int) {
+	for i := range mask {
+		switch {
+		case ones >= 8:
+			mask[i] = 0xff
+		case ones > 0:
+			mask[i] = ^byte(0xff >> uint(ones))
+		default:
+			mask[i] = 0
+		}
+		ones -= 8
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Subsystem is a part of the dataplane programmed through its own handle, which has its own reconnection state. A
+// failure of one subsystem closes only the handle of that subsystem, see ApplyError.
+type Subsystem string
+
+const (
+	// SubsystemLink is the wireguard link, its addresses, the routing rules and the underlay routes, programmed through
+	// the netlink handle of the wireguard module.
+	SubsystemLink Subsystem = "link"
+	// SubsystemRoutes is the routes in the wireguard routing tables, programmed through the netlink handles of the
+	// routetables, see Config.RouteNetlinkTimeout.
+	SubsystemRoutes Subsystem = "routes"
+	// SubsystemWireguard is the configuration of the wireguard device, programmed through the wireguard client.
+	SubsystemWireguard Subsystem = "wireguard"
+)
+
+// subsystems is the order in which the failed subsystems are reported.
+var subsystems = []Subsystem{SubsystemLink, SubsystemRoutes, SubsystemWireguard}
+
+// ApplyError is returned by Apply when steps of the Apply failed, with the step that failed for each of the subsystems.
+// The routes are programmed whether or not the link handle is failing, and the routing rules whether or not the
+// routetables are failing, so more than one subsystem may have failed in the same Apply. The updates that were not
+// applied are retried by the next Apply. An ApplyError unwraps to ErrUpdateFailed.
+type ApplyError struct {
+	FailedSteps map[Subsystem]string
+}
+
+func (e *ApplyError) Error() string {
+	var failures []string
+	for _, subsystem := range subsystems {
+		if step, ok := e.FailedSteps[subsystem]; ok {
+			failures = append(failures, fmt.Sprintf("%s (%s)", subsystem, step))
+		}
+	}
+	return "wireguard apply failed: " + strings.Join(failures, ", ")
+}
+
+func (e *ApplyError) Unwrap() error {
+	return ErrUpdateFailed
+}
+
+// Failed returns true if a step of the subsystem failed.
+func (e *ApplyError) Failed(subsystem Subsystem) bool {
+	_, ok := e.FailedSteps[subsystem]
+	return ok
+}
+
+// updateFailed returns the ApplyError of a single failed step.
+func updateFailed(subsystem Subsystem, step string) *ApplyError {
+	return (&ApplyError{}).add(subsystem, step)
+}
+
+// add records the failed step of the subsystem. Only the first failed step of each subsystem is recorded, since the
+// remaining steps of the subsystem are not attempted.
+func (e *ApplyError) add(subsystem Subsystem, step string) *ApplyError {
+	if e.FailedSteps == nil {
+		e.FailedSteps = map[Subsystem]string{}
+	}
+	if _, ok := e.FailedSteps[subsystem]; !ok {
+		e.FailedSteps[subsystem] = step
+	}
+	return e
+}
+
+// firstStep returns the failed step of the first failed subsystem, which is the step reported if the Apply deadline
+// has been exceeded, see applyError.
+func (e *ApplyError) firstStep() string {
+	for _, subsystem := range subsystems {
+		if step, ok := e.FailedSteps[subsystem]; ok {
+			return step
+		}
+	}
+	return ""
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	timeshim "github.com/projectcalico/felix/time"
+)
+
+// ApplyTiming is the time spent by an Apply in the calls to each subsystem. The address calls are made in parallel with
+// the device and route calls, so the times may add up to more than the time taken by the Apply.
+type ApplyTiming struct {
+	// Link is the time spent creating, querying and updating the wireguard link.
+	Link time.Duration
+	// Address is the time spent reconciling the addresses of the wireguard interface, and their local routes.
+	Address time.Duration
+	// Rules is the time spent listing and updating the routing rules.
+	Rules time.Duration
+	// DeviceRead is the time spent reading the wireguard device configuration.
+	DeviceRead time.Duration
+	// DeviceConfigure is the time spent writing the wireguard device configuration.
+	DeviceConfigure time.Duration
+	// Routes is the time spent programming the routing tables.
+	Routes time.Duration
+}
+
+// ApplyTimingCallback is called once each Apply completes with the time taken by the Apply and its split by subsystem,
+// e.g. to observe the times in the felix metrics. A subsystem that had no work to do has a zero time. The callback is
+// called from the goroutine calling Apply, and must not block.
+type ApplyTimingCallback func(took time.Duration, timing ApplyTiming)
+
+// SetApplyTimingCallback sets the callback of the apply timing, or removes it if nil.
+func (w *Wireguard) SetApplyTimingCallback(callback ApplyTimingCallback) {
+	w.queueUpdate(PendingWorkSummary{}, func() {
+		w.applyTimingCallback = callback
+	})
+}
+
+// reportApplyTiming logs the summary of the Apply with its timing, and calls the apply timing callback.
+func (w *Wireguard) reportApplyTiming(took time.Duration) {
+	timing := w.applyTiming.get()
+	w.summary.log(w.logCxt, took, timing)
+	if w.applyTimingCallback != nil {
+		w.applyTimingCallback(took, timing)
+	}
+}
+
+// applySubsystem is the subsystem that a timed call is accounted to.
+type applySubsystem int
+
+const (
+	// subsystemByCall accounts each netlink call to the subsystem of the call, e.g. a RuleAdd to the rules.
+	subsystemByCall applySubsystem = iota
+	subsystemLink
+	subsystemAddress
+	subsystemRules
+	subsystemDeviceRead
+	subsystemDeviceConfigure
+	subsystemRoutes
+	numApplySubsystems
+)
+
+// applyTimer accumulates the time spent in the calls of each subsystem during an Apply. The calls are timed using the
+// time shim. The timer is shared by the goroutines of an Apply, and by the routing tables.
+type applyTimer struct {
+	time timeshim.Time
+
+	lock  sync.Mutex
+	times [numApplySubsystems]time.Duration
+}
+
+func newApplyTimer(timeShim timeshim.Time) *applyTimer {
+	return &applyTimer{time: timeShim}
+}
+
+// reset zeroes the times at the start of an Apply.
+func (t *applyTimer) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.times = [numApplySubsystems]time.Duration{}
+}
+
+func (t *applyTimer) get() ApplyTiming {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return ApplyTiming{
+		Link:            t.times[subsystemLink],
+		Address:         t.times[subsystemAddress],
+		Rules:           t.times[subsystemRules],
+		DeviceRead:      t.times[subsystemDeviceRead],
+		DeviceConfigure: t.times[subsystemDeviceConfigure],
+		Routes:          t.times[subsystemRoutes],
+	}
+}
+
+// timeCall makes the call, accounting the time it takes to the subsystem.
+func (t *applyTimer) timeCall(subsystem applySubsystem, call func() error) error {
+	start := t.time.Now()
+	err := call()
+	took := t.time.Since(start)
+	t.lock.Lock()
+	t.times[subsystem] += took
+	t.lock.Unlock()
+	return err
+}
+
+// netlink returns a netlink client whose calls are accounted to the subsystem, or to the subsystem of each call if
+// subsystemByCall.
+func (t *applyTimer) netlink(nl netlinkshim.Netlink, subsystem applySubsystem) netlinkshim.Netlink {
+	return &timedNetlink{Netlink: nl, timer: t, subsystem: subsystem}
+}
+
+// newNetlink wraps a netlink client factory so that the calls of the clients are accounted to the subsystem.
+func (t *applyTimer) newNetlink(
+	newNetlink func() (netlinkshim.Netlink, error), subsystem applySubsystem,
+) func() (netlinkshim.Netlink, error) {
+	return func() (netlinkshim.Netlink, error) {
+		nl, err := newNetlink()
+		if err != nil {
+			return nil, err
+		}
+		return t.netlink(nl, subsystem), nil
+	}
+}
+
+// wireguard returns a wireguard client whose device reads and writes are timed.
+func (t *applyTimer) wireguard(wg netlinkshim.Wireguard) netlinkshim.Wireguard {
+	return &timedWireguard{Wireguard: wg, timer: t}
+}
+
+// timedNetlink times the calls of a netlink client. The socket timeout and the deletion of the client are not timed.
+type timedNetlink struct {
+	netlinkshim.Netlink
+	timer     *applyTimer
+	subsystem applySubsystem
+}
+
+func (n *timedNetlink) do(subsystem applySubsystem, call func() error) error {
+	if n.subsystem != subsystemByCall {
+		subsystem = n.subsystem
+	}
+	return n.timer.timeCall(subsystem, call)
+}
+
+func (n *timedNetlink) LinkList() (links []netlink.Link, err error) {
+	err = n.do(subsystemLink, func() (err error) {
+		links, err = n.Netlink.LinkList()
+		return
+	})
+	return
+}
+
+func (n *timedNetlink) LinkByName(name string) (link netlink.Link, err error) {
+	err = n.do(subsystemLink, func() (err error) {
+		link, err = n.Netlink.LinkByName(name)
+		return
+	})
+	return
+}
+
+func (n *timedNetlink) LinkAdd(link netlink.Link) error {
+	return n.do(subsystemLink, func() error { return n.Netlink.LinkAdd(link) })
+}
+
+func (n *timedNetlink) LinkDel(link netlink.Link) error {
+	return n.do(subsystemLink, func() error { return n.Netlink.LinkDel(link) })
+}
+
+func (n *timedNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return n.do(subsystemLink, func() error { return n.Netlink.LinkSetMTU(link, mtu) })
+}
+
+func (n *timedNetlink) LinkSetUp(link netlink.Link) error {
+	return n.do(subsystemLink, func() error { return n.Netlink.LinkSetUp(link) })
+}
+
+func (n *timedNetlink) RouteListFiltered(
+	family int, filter *netlink.Route, filterMask uint64,
+) (routes []netlink.Route, err error) {
+	err = n.do(subsystemRoutes, func() (err error) {
+		routes, err = n.Netlink.RouteListFiltered(family, filter, filterMask)
+		return
+	})
+	return
+}
+
+func (n *timedNetlink) RouteAdd(route *netlink.Route) error {
+	return n.do(subsystemRoutes, func() error { return n.Netlink.RouteAdd(route) })
+}
+
+func (n *timedNetlink) RouteDel(route *netlink.Route) error {
+	return n.do(subsystemRoutes, func() error { return n.Netlink.RouteDel(route) })
+}
+
+func (n *timedNetlink) RouteReplace(route *netlink.Route) error {
+	return n.do(subsystemRoutes, func() error { return n.Netlink.RouteReplace(route) })
+}
+
+func (n *timedNetlink) AddrList(link netlink.Link, family int) (addrs []netlink.Addr, err error) {
+	err = n.do(subsystemAddress, func() (err error) {
+		addrs, err = n.Netlink.AddrList(link, family)
+		return
+	})
+	return
+}
+
+func (n *timedNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return n.do(subsystemAddress, func() error { return n.Netlink.AddrAdd(link, addr) })
+}
+
+func (n *timedNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return n.do(subsystemAddress, func() error { return n.Netlink.AddrDel(link, addr) })
+}
+
+func (n *timedNetlink) RuleList(family int) (rules []netlink.Rule, err error) {
+	err = n.do(subsystemRules, func() (err error) {
+		rules, err = n.Netlink.RuleList(family)
+		return
+	})
+	return
+}
+
+func (n *timedNetlink) RuleAdd(rule *netlink.Rule) error {
+	return n.do(subsystemRules, func() error { return n.Netlink.RuleAdd(rule) })
+}
+
+func (n *timedNetlink) RuleDel(rule *netlink.Rule) error {
+	return n.do(subsystemRules, func() error { return n.Netlink.RuleDel(rule) })
+}
+
+// timedWireguard times the device reads and writes of a wireguard client.
+type timedWireguard struct {
+	netlinkshim.Wireguard
+	timer *applyTimer
+}
+
+func (c *timedWireguard) DeviceByName(name string) (device *wgtypes.Device, err error) {
+	err = c.timer.timeCall(subsystemDeviceRead, func() (err error) {
+		device, err = c.Wireguard.DeviceByName(name)
+		return
+	})
+	return
+}
+
+func (c *timedWireguard) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return c.timer.timeCall(subsystemDeviceConfigure, func() error { return c.Wireguard.ConfigureDevice(name, cfg) })
+}
+
+// logFields returns the timing as log fields, including the subsystems that had no work to do.
+func (t ApplyTiming) logFields() logrus.Fields {
+	return logrus.Fields{
+		"linkTime":            t.Link,
+		"addressTime":         t.Address,
+		"rulesTime":           t.Rules,
+		"deviceReadTime":      t.DeviceRead,
+		"deviceConfigureTime": t.DeviceConfigure,
+		"routesTime":          t.Routes,
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The granularity of the keepalive interval, which wireguard configures in whole seconds.
+const keepaliveGranularity = time.Second
+
+// The first kernel version with the in-tree wireguard module. Older kernels use the out-of-tree compat module.
+const (
+	inTreeWireguardMajor = 5
+	inTreeWireguardMinor = 6
+)
+
+var kernelVersionRegexp = regexp.MustCompile(`Linux version (\d+\.\d+(\.\d+)?)`)
+
+// ConfigurationPath is the interface used to configure the wireguard device.
+type ConfigurationPath string
+
+const (
+	// ConfigurationPathNetlink is a kernel device configured over generic netlink.
+	ConfigurationPathNetlink ConfigurationPath = "netlink"
+	// ConfigurationPathUserspace is a userspace device configured over its UAPI socket.
+	ConfigurationPathUserspace ConfigurationPath = "userspace"
+)
+
+// Capabilities are the features supported by the wireguard device, see Wireguard.Capabilities.
+type Capabilities struct {
+	// Probed is set once the capabilities have been probed, when the wireguard client is first created. The other
+	// fields are not set until then.
+	Probed bool
+
+	// KernelVersion is the version of the running kernel, e.g. "5.4.0", or "" if it could not be determined.
+	KernelVersion string
+
+	// ConfigurationPath is the interface used to configure the device, which depends on the mode of the device.
+	ConfigurationPath ConfigurationPath
+
+	// CompatModule is set if the kernel device is provided by the out-of-tree compat module, because the kernel
+	// predates the in-tree wireguard module. This is assumed not to be the case if the kernel version is unknown.
+	CompatModule bool
+
+	// PresharedKeys is set if the device supports a preshared key per peer, which all implementations do.
+	PresharedKeys bool
+
+	// KeepaliveGranularity and MaxKeepalive are the granularity and the maximum of the persistent keepalive interval.
+	// A configured interval is rounded up to the granularity.
+	KeepaliveGranularity time.Duration
+	MaxKeepalive         time.Duration
+
+	// MaxAllowedIPsPerConfiguration is the maximum number of allowed IPs in a single device configuration, or 0 if
+	// only limited by Config.AllowedIPsChunkSize. This is learned when the device rejects a configuration as too large,
+	// and the allowed IPs are then configured in smaller chunks by the next Apply.
+	MaxAllowedIPsPerConfiguration int
+}
+
+// KernelVersionReader returns a reader of the kernel version, in the format of /proc/version, so that the kernel
+// version can be mocked. A reader that is also an io.Closer is closed once read.
+type KernelVersionReader func() (io.Reader, error)
+
+func readKernelVersion() (io.Reader, error) {
+	return os.Open("/proc/version")
+}
+
+// SetKernelVersionReader sets the reader of the kernel version used to probe the capabilities. This only takes effect
+// if the capabilities have not yet been probed.
+func (w *Wireguard) SetKernelVersionReader(reader KernelVersionReader) {
+	w.queueUpdate(PendingWorkSummary{}, func() {
+		w.kernelVersionReader = reader
+	})
+}
+
+// Capabilities returns the capabilities of the wireguard device, which are probed once when the wireguard client is
+// first created. This may be called from any goroutine.
+func (w *Wireguard) Capabilities() Capabilities {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.capabilities.forMode(w.mode)
+}
+
+// forMode returns the capabilities with the fields that depend on the mode of the device.
+func (c Capabilities) forMode(mode Mode) Capabilities {
+	if !c.Probed {
+		return c
+	}
+	c.ConfigurationPath = ConfigurationPathNetlink
+	if mode == ModeUserspace {
+		c.ConfigurationPath = ConfigurationPathUserspace
+	}
+	c.CompatModule = c.ConfigurationPath == ConfigurationPathNetlink && kernelPredatesWireguard(c.KernelVersion)
+	return c
+}
+
+// probeCapabilities probes the capabilities of the wireguard device, if not already probed. This is called once the
+// wireguard client has been created.
+func (w *Wireguard) probeCapabilities() {
+	if w.capabilities.Probed {
+		return
+	}
+	caps := Capabilities{
+		Probed:               true,
+		PresharedKeys:        true,
+		KeepaliveGranularity: keepaliveGranularity,
+		MaxKeepalive:         maxPersistentKeepalive,
+	}
+	if version, err := w.probeKernelVersion(); err != nil {
+		w.logCxt.WithError(err).Warn("Unable to determine the kernel version, assuming the in-tree wireguard module")
+	} else {
+		caps.KernelVersion = version
+	}
+
+	w.localConfigLock.Lock()
+	w.capabilities = caps
+	caps = caps.forMode(w.mode)
+	w.localConfigLock.Unlock()
+	w.logCxt.WithFields(caps.logFields()).Info("Probed wireguard capabilities")
+}
+
+// probeKernelVersion returns the version of the running kernel.
+func (w *Wireguard) probeKernelVersion() (string, error) {
+	reader, err := w.kernelVersionReader()
+	if err != nil {
+		return "", err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	matches := kernelVersionRegexp.FindStringSubmatch(string(raw))
+	if matches == nil {
+		return "", fmt.Errorf("failed to parse kernel version %q", raw)
+	}
+	return matches[1], nil
+}
+
+// kernelPredatesWireguard returns true if the kernel version is known, and older than the first kernel with the
+// in-tree wireguard module.
+func kernelPredatesWireguard(version string) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major < inTreeWireguardMajor || (major == inTreeWireguardMajor && minor < inTreeWireguardMinor)
+}
+
+// allowedIPsChunkSize returns the maximum number of allowed IPs in a single wireguard device configuration, which is
+// the configured chunk size unless the device has been found to support fewer. The capabilities are only updated by
+// Apply, so are read without the lock.
+func (w *Wireguard) allowedIPsChunkSize() int {
+	size := w.config.allowedIPsChunkSize()
+	if max := w.capabilities.MaxAllowedIPsPerConfiguration; max > 0 && max < size {
+		return max
+	}
+	return size
+}
+
+// limitAllowedIPsChunkSize halves the maximum number of allowed IPs in a single wireguard device configuration after
+// the device rejected a configuration of the peers as too large. A configuration with a single allowed IP cannot be
+// split.
+func (w *Wireguard) limitAllowedIPsChunkSize(peers []wgtypes.PeerConfig) {
+	numAllowedIPs := 0
+	for _, peer := range peers {
+		numAllowedIPs += len(peer.AllowedIPs)
+	}
+	limit := numAllowedIPs / 2
+	if limit == 0 {
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"allowedIPs":    numAllowedIPs,
+		"maxAllowedIPs": limit,
+	}).Warn("Wireguard device configuration is too large for the device, configuring fewer allowed IPs at a time")
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.capabilities.MaxAllowedIPsPerConfiguration = limit
+}
+
+// persistentKeepalive returns the configured keepalive interval rounded up to the keepalive granularity, so that the
+// interval matches the interval read back from the device. The rounding is logged once for each configured interval.
+func (w *Wireguard) persistentKeepalive() time.Duration {
+	keepalive := w.config.PersistentKeepalive
+	remainder := keepalive % keepaliveGranularity
+	if remainder == 0 {
+		return keepalive
+	}
+	rounded := keepalive - remainder + keepaliveGranularity
+	if w.loggedKeepalive != keepalive {
+		w.logCxt.WithFields(logrus.Fields{
+			"configured": keepalive,
+			"programmed": rounded,
+		}).Warn("Wireguard keepalive interval is not a whole number of seconds, rounding up")
+		w.loggedKeepalive = keepalive
+	}
+	return rounded
+}
+
+// logFields returns the capabilities as log fields.
+func (c Capabilities) logFields() logrus.Fields {
+	return logrus.Fields{
+		"kernelVersion":        c.KernelVersion,
+		"configurationPath":    c.ConfigurationPath,
+		"compatModule":         c.CompatModule,
+		"presharedKeys":        c.PresharedKeys,
+		"keepaliveGranularity": c.KeepaliveGranularity,
+		"maxKeepalive":         c.MaxKeepalive,
+	}
+}
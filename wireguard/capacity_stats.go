@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sort"
+
+	"github.com/projectcalico/felix/routetable"
+)
+
+// capacityTopPeers is the number of the peers with the most CIDRs that are reported in the CapacityStats.
+const capacityTopPeers = 5
+
+// CapacityStats are the aggregate counts of the programmed wireguard configuration, for capacity planning of the
+// wireguard routing tables and of the allowed IPs of the peers. The counts are of the configuration programmed by the
+// last Apply, and are zero while wireguard is not active.
+type CapacityStats struct {
+	// ProgrammedPeers is the number of peers programmed in wireguard, and AllowedIPs the total number of their allowed
+	// IPs.
+	ProgrammedPeers int
+	AllowedIPs      int
+
+	// UnicastRoutes is the number of routes to the wireguard interface, and ThrowRoutes the number of throw routes, in
+	// the wireguard routing tables. The routes to the wireguard interface are counted even if they are programmed
+	// through the catch-all route, see Config.CatchAllRoute.
+	UnicastRoutes int
+	ThrowRoutes   int
+
+	// PendingRoutes is the number of routes to the wireguard interface that are held back until the peer is configured,
+	// and SuppressedCIDRs is the number of CIDRs of the peers that have no route, as reported by RouteStatuses.
+	PendingRoutes   int
+	SuppressedCIDRs int
+
+	// TopPeers are the peers with the most CIDRs, up to five, in descending order of the number of CIDRs and then by
+	// name.
+	TopPeers []PeerCapacity
+}
+
+// PeerCapacity is the number of CIDRs of a peer, and the number of those that are programmed as allowed IPs of the
+// peer. Fewer CIDRs are programmed if some are excluded or exceed Config.MaxAllowedIPsPerPeer, and none are programmed
+// if the peer itself is not.
+type PeerCapacity struct {
+	Name       string
+	CIDRs      int
+	AllowedIPs int
+}
+
+// CapacityStatsCallback is called with the capacity stats once Config.CapacityStatsInterval has passed since it was
+// last called. The callback is called from the goroutine calling Apply, and must not block.
+type CapacityStatsCallback func(stats CapacityStats)
+
+// SetCapacityStatsCallback sets the callback of the capacity stats, or removes it if nil. The stats only change when
+// updates are applied, so the callback is called by the first Apply once Config.CapacityStatsInterval has passed, and
+// by the first Apply after it is set. The callback is never called if the interval is zero.
+func (w *Wireguard) SetCapacityStatsCallback(callback CapacityStatsCallback) {
+	w.queueUpdate(PendingWorkSummary{}, func() {
+		w.capacityStatsCallback = callback
+		w.capacityStatsReported = false
+	})
+}
+
+// peerCapacity is the contribution of a peer to the capacity stats.
+type peerCapacity struct {
+	programmed bool
+	cidrs      int
+	allowedIPs int
+}
+
+// capacityCounts are the counts of the programmed peers and their allowed IPs, maintained as the peers are applied so
+// that the capacity stats are available without scanning the CIDRs of every peer, see recountPeerCapacity. The counts
+// of the routes are maintained by the routing tables, see RouteTableSyncer.RouteCounts.
+type capacityCounts struct {
+	programmedPeers int
+	allowedIPs      int
+	peers           map[string]peerCapacity
+}
+
+// recountPeerCapacity updates the capacity counts with the current contribution of a peer. This is called for each
+// peer that has been updated, or whose programmed state has changed, once the updates have been applied.
+func (w *Wireguard) recountPeerCapacity(name string) {
+	c := &w.capacity
+	old, ok := c.peers[name]
+	if ok {
+		c.allowedIPs -= old.allowedIPs
+		if old.programmed {
+			c.programmedPeers--
+		}
+	}
+
+	node := w.peers[name]
+	if node == nil {
+		delete(c.peers, name)
+		return
+	}
+	pc := w.peerCapacity(node)
+	c.allowedIPs += pc.allowedIPs
+	if pc.programmed {
+		c.programmedPeers++
+	}
+	c.peers[name] = pc
+}
+
+// recountAllPeerCapacities recounts the contribution of every peer, e.g. once the peers have been imported.
+func (w *Wireguard) recountAllPeerCapacities() {
+	w.capacity = capacityCounts{peers: map[string]peerCapacity{}}
+	for name := range w.peers {
+		w.recountPeerCapacity(name)
+	}
+}
+
+// peerCapacity returns the contribution of a peer to the capacity stats.
+func (w *Wireguard) peerCapacity(node *peerData) peerCapacity {
+	pc := peerCapacity{programmed: node.programmedInWireguard, cidrs: node.cidrs.Len()}
+	if pc.programmed {
+		pc.allowedIPs = w.numIncludedCIDRs(node)
+		if w.config.MaxAllowedIPsPerPeer > 0 && pc.allowedIPs > w.config.MaxAllowedIPsPerPeer {
+			pc.allowedIPs = w.config.MaxAllowedIPsPerPeer
+		}
+	}
+	return pc
+}
+
+// CapacityStats returns the capacity stats of the configuration programmed by the last Apply. The counts are maintained
+// as the updates are applied, only the top peers are found by scanning the peers. This should be called from the same
+// goroutine as Apply.
+func (w *Wireguard) CapacityStats() CapacityStats {
+	if !w.Active() || w.tornDown {
+		return CapacityStats{}
+	}
+	stats := CapacityStats{
+		ProgrammedPeers: w.capacity.programmedPeers,
+		AllowedIPs:      w.capacity.allowedIPs,
+		PendingRoutes:   len(w.routesPendingWireguard),
+	}
+	for _, rt := range w.RouteTableSyncers() {
+		unicast, throw := rt.RouteCounts()
+		stats.UnicastRoutes += unicast
+		stats.ThrowRoutes += throw
+	}
+	stats.SuppressedCIDRs = len(w.cidrToNodeName) - w.numRoutedPeerCIDRs(stats.UnicastRoutes+stats.ThrowRoutes)
+	stats.TopPeers = w.topPeerCapacities()
+	return stats
+}
+
+// numRoutedPeerCIDRs returns the number of CIDRs of the peers that have a route or a route held back, given the number
+// of routes in the routing tables. Each route is for a CIDR of a peer, of the local host or that escapes the catch-all
+// route, and a CIDR whose route is held back may still have its previous route.
+func (w *Wireguard) numRoutedPeerCIDRs(numRoutes int) int {
+	n := numRoutes - len(w.localCIDRRoutes) - len(w.catchAllThrowRoutes) + len(w.routesPendingWireguard)
+	for cidr := range w.routesPendingWireguard {
+		for _, rt := range w.RouteTableSyncers() {
+			if rt.hasTarget(w.config.InterfaceName, cidr) || rt.hasTarget(routetable.InterfaceNone, cidr) {
+				n--
+				break
+			}
+		}
+	}
+	return n
+}
+
+// topPeerCapacities returns the peers with the most CIDRs, see CapacityStats.TopPeers.
+func (w *Wireguard) topPeerCapacities() []PeerCapacity {
+	var top []PeerCapacity
+	for name, pc := range w.capacity.peers {
+		if pc.cidrs == 0 {
+			continue
+		}
+		top = append(top, PeerCapacity{Name: name, CIDRs: pc.cidrs, AllowedIPs: pc.allowedIPs})
+		if len(top) > 2*capacityTopPeers {
+			// Trim as we go so that the peers are never all sorted.
+			sortPeerCapacities(top)
+			top = top[:capacityTopPeers]
+		}
+	}
+	sortPeerCapacities(top)
+	if len(top) > capacityTopPeers {
+		top = top[:capacityTopPeers]
+	}
+	return top
+}
+
+func sortPeerCapacities(peers []PeerCapacity) {
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].CIDRs != peers[j].CIDRs {
+			return peers[i].CIDRs > peers[j].CIDRs
+		}
+		return peers[i].Name < peers[j].Name
+	})
+}
+
+// reportCapacityStats calls the capacity stats callback once Config.CapacityStatsInterval has passed since it was last
+// called. This is called once each Apply completes.
+func (w *Wireguard) reportCapacityStats() {
+	if w.capacityStatsCallback == nil || w.config.CapacityStatsInterval <= 0 {
+		return
+	} else if w.capacityStatsReported && w.time.Since(w.capacityStatsTime) < w.config.CapacityStatsInterval {
+		return
+	}
+	w.capacityStatsReported = true
+	w.capacityStatsTime = w.time.Now()
+	w.capacityStatsCallback(w.CapacityStats())
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+var (
+	defaultCIDRV4 = ip.MustParseCIDROrIP("0.0.0.0/0")
+	defaultCIDRV6 = ip.MustParseCIDROrIP("::/0")
+)
+
+// validateCatchAllRoute returns an error if the catch-all route is enabled without the settings it relies on: the
+// CIDRs of the local host must have throw routes, there must be a single routing table for the catch-all route, and the
+// CIDRs of the peers that are not routed to wireguard must have throw routes rather than exclusion rules.
+func (c *Config) validateCatchAllRoute() error {
+	if !c.CatchAllRoute {
+		return nil
+	}
+	if !c.LocalCIDRsAsThrow {
+		return &ConfigError{Field: "LocalCIDRsAsThrow", Value: c.LocalCIDRsAsThrow, Reason: "must be set with CatchAllRoute"}
+	}
+	if len(c.RoutingTableIndexByClass) > 0 {
+		return &ConfigError{Field: "RoutingTableIndexByClass", Value: c.RoutingTableIndexByClass,
+			Reason: "must not be set with CatchAllRoute"}
+	}
+	if c.nonWireguardPeerHandling() != NonWireguardPeerHandlingThrow {
+		return &ConfigError{Field: "NonWireguardPeerHandling", Value: c.NonWireguardPeerHandling,
+			Reason: "must be throw with CatchAllRoute"}
+	}
+	return nil
+}
+
+// CatchAllRouteEnabled returns true if the routes to the wireguard interface are programmed through the catch-all
+// route, see Config.CatchAllRoute. The catch-all route is only programmed once the wireguard link is usable, and once
+// the throw routes of the CIDRs that escape it have been applied. This should be called from the same goroutine as
+// Apply.
+func (w *Wireguard) CatchAllRouteEnabled() bool {
+	rt := w.catchAllRouteTable()
+	if rt == nil {
+		return false
+	}
+	_, enabled := rt.catchAllRoute()
+	return enabled
+}
+
+// updateCatchAllRoute updates whether the catch-all route is programmed and the CIDRs that escape it. The routes are
+// switched over by the next Apply, see reconcileCatchAllRoute.
+func (w *Wireguard) updateCatchAllRoute(enabled bool, throwCIDRs []ip.CIDR) {
+	w.logCxt.Debugf("UpdateConfig: catchAllRoute=%v catchAllThrowCIDRs=%v", enabled, throwCIDRs)
+	if enabled && !w.config.LocalCIDRsAsThrow {
+		w.logCxt.Warning("The catch-all route requires throw routes for the local CIDRs, ignoring")
+		enabled = false
+	} else if enabled && len(w.config.RoutingTableIndexByClass) > 0 {
+		w.logCxt.Warning("The catch-all route requires a single wireguard routing table, ignoring")
+		enabled = false
+	}
+	if enabled != w.catchAllRoute {
+		w.logCxt.WithField("catchAllRoute", enabled).Info("Wireguard catch-all route updated, replacing the routes")
+	}
+	w.catchAllRoute = enabled
+	w.catchAllThrowCIDRs = throwCIDRs
+}
+
+// catchAllRouteTable returns the routing table of the catch-all route, which is the only wireguard routing table while
+// the catch-all route is enabled.
+func (w *Wireguard) catchAllRouteTable() *RouteTableSyncer {
+	return w.routetables[w.config.RoutingTableIndex]
+}
+
+// catchAllRouteWanted returns true if the catch-all route should be programmed. As with the routes of each CIDR, the
+// catch-all route is only programmed while the link is usable. With NonWireguardPeerHandlingRuleExclude the CIDRs of
+// the peers that are not routed to wireguard have no throw routes, so they would be caught by the catch-all route.
+func (w *Wireguard) catchAllRouteWanted() bool {
+	return w.catchAllRoute && w.linkUsable && !w.excludesNonWireguardPeersByRule() && w.catchAllRouteTable() != nil
+}
+
+// catchAllTarget returns the target of the catch-all route.
+func (w *Wireguard) catchAllTarget() routetable.Target {
+	cidr := defaultCIDRV4
+	if w.config.ipVersion() == 6 {
+		cidr = defaultCIDRV6
+	}
+	return w.routeTarget("", cidr)
+}
+
+// desiredCatchAllThrowCIDRs returns the CIDRs that have throw routes so that their traffic escapes the catch-all
+// route: the configured throw CIDRs, e.g. the underlay CIDRs, and the excluded CIDRs. The CIDRs of the local host have
+// throw routes regardless, see Config.LocalCIDRsAsThrow.
+func (w *Wireguard) desiredCatchAllThrowCIDRs() []ip.CIDR {
+	var cidrs []ip.CIDR
+	for _, cidrList := range [][]ip.CIDR{w.catchAllThrowCIDRs, w.excludeCIDRs} {
+		for _, cidr := range cidrList {
+			if cidr.Version() == w.config.ipVersion() {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+	return cidrs
+}
+
+// catchAllThrowRouteExpected returns true if the CIDR should have a throw route that escapes the catch-all route. A
+// CIDR that is also a CIDR of a peer or of the local host already has a route of its own.
+func (w *Wireguard) catchAllThrowRouteExpected(cidr ip.CIDR) bool {
+	if _, ok := w.cidrToNodeName[cidr]; ok {
+		return false
+	} else if _, ok := w.allowedCIDRToNodeName[cidr]; ok {
+		return false
+	} else if _, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+		return false
+	} else if _, ok := w.localCIDRs[cidr]; ok {
+		return false
+	}
+	for _, throwCIDR := range w.desiredCatchAllThrowCIDRs() {
+		if throwCIDR == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCatchAllThrowRoutes removes the throw routes of the CIDRs that no longer escape the catch-all route, or that
+// are now routed for a peer or the local host. As with removeLocalCIDRRoutes, this is called before the routes of the
+// peers are updated, so that a route programmed for a peer is not removed along with the throw route.
+func (w *Wireguard) removeCatchAllThrowRoutes() {
+	for cidr := range w.catchAllThrowRoutes {
+		if w.catchAllThrowRouteExpected(cidr) {
+			continue
+		}
+		w.logCxt.Debugf("Removing catch-all throw route for %s", cidr)
+		w.catchAllRouteTable().RouteRemove(routetable.InterfaceNone, cidr)
+		delete(w.catchAllThrowRoutes, cidr)
+		w.summary.routesRemoved++
+	}
+}
+
+// reconcileCatchAllRoute switches the routes to the wireguard interface between the catch-all route and the routes of
+// each CIDR, returning true if the routes have been updated. This is called once the routes of the peers have been
+// updated, and again after the routing tables have been applied, since the switch is made in steps so that the traffic
+// that should escape the catch-all route is never caught by it. When the catch-all route is enabled the throw routes
+// that escape it are added first, and the catch-all route is only added once those throw routes have been applied. When
+// the catch-all route is disabled the throw routes are only removed once the removal of the catch-all route has been
+// applied. The catch-all route and the routes of each CIDR are switched in a single update of the routing table,
+// which adds the new routes before deleting the old routes, so there is no window with neither.
+func (w *Wireguard) reconcileCatchAllRoute() bool {
+	rt := w.catchAllRouteTable()
+	if rt == nil {
+		return false
+	}
+	current, enabled := rt.catchAllRoute()
+
+	if !w.catchAllRouteWanted() {
+		if enabled {
+			w.logCxt.Info("Removing the wireguard catch-all route, routing each CIDR to wireguard")
+			rt.setCatchAllRoute(w.config.InterfaceName, nil)
+			w.summary.routesRemoved++
+			return true
+		}
+		if len(w.catchAllThrowRoutes) == 0 || !rt.InterfaceInSync(w.config.InterfaceName) {
+			// Nothing to remove, or the removal of the catch-all route has not yet been applied.
+			return false
+		}
+		for cidr := range w.catchAllThrowRoutes {
+			w.logCxt.Debugf("Removing catch-all throw route for %s", cidr)
+			rt.RouteRemove(routetable.InterfaceNone, cidr)
+			delete(w.catchAllThrowRoutes, cidr)
+			w.summary.routesRemoved++
+		}
+		return true
+	}
+
+	updated := false
+	for _, cidr := range w.desiredCatchAllThrowCIDRs() {
+		if w.catchAllThrowRoutes[cidr] || !w.catchAllThrowRouteExpected(cidr) {
+			continue
+		}
+		w.logCxt.Debugf("Adding catch-all throw route for %s", cidr)
+		rt.RouteUpdate(routetable.InterfaceNone, w.routeTarget(routetable.TargetTypeThrow, cidr))
+		w.catchAllThrowRoutes[cidr] = true
+		w.summary.routesAdded++
+		updated = true
+	}
+
+	target := w.catchAllTarget()
+	if enabled {
+		if !current.Equal(target) {
+			rt.setCatchAllRoute(w.config.InterfaceName, &target)
+			updated = true
+		}
+		return updated
+	}
+	if updated || !w.catchAllThrowRoutesApplied(rt) {
+		w.logCxt.Debug("Holding back the catch-all route until the throw routes are applied")
+		return updated
+	}
+	w.logCxt.WithField("numThrowRoutes", len(w.catchAllThrowRoutes)).Info(
+		"Adding the wireguard catch-all route, removing the route of each CIDR")
+	rt.setCatchAllRoute(w.config.InterfaceName, &target)
+	w.summary.routesAdded++
+	return true
+}
+
+// applyRoutes applies the routing tables, and then applies each step of the switch between the catch-all route and the
+// routes of each CIDR that is unblocked by the routes being applied, see reconcileCatchAllRoute.
+func (w *Wireguard) applyRoutes(ctx context.Context) error {
+	for {
+		if err := w.applyRouteTables(ctx, w.RouteTableSyncers()); err != nil {
+			return err
+		}
+		if !w.reconcileCatchAllRoute() {
+			return nil
+		}
+	}
+}
+
+// catchAllThrowRoutesApplied returns true if the throw routes that escape the catch-all route, and the throw routes of
+// the local CIDRs, have been applied.
+func (w *Wireguard) catchAllThrowRoutesApplied(rt *RouteTableSyncer) bool {
+	applied := rt.AppliedTargets(routetable.InterfaceNone)
+	for cidr := range w.catchAllThrowRoutes {
+		if _, ok := applied[cidr]; !ok {
+			return false
+		}
+	}
+	for cidr := range w.localCIDRRoutes {
+		if _, ok := applied[cidr]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// catchAllRoutes are the routes of the wireguard interface while the routes are programmed through the catch-all
+// route. The routes requested for each CIDR are not programmed, except those within a throw route, which would
+// otherwise take precedence over the catch-all route.
+type catchAllRoutes struct {
+	ifaceName string
+	target    routetable.Target
+
+	// The routes requested for the wireguard interface, and the routes requested as of the last successful Apply.
+	requested      map[ip.CIDR]routetable.Target
+	applied        map[ip.CIDR]routetable.Target
+	requestedDirty bool
+
+	// The CIDRs of the throw routes in the routing table.
+	throws map[ip.CIDR]bool
+}
+
+// catchAllRoute returns the catch-all route, and whether the routes are programmed through the catch-all route.
+func (r *RouteTableSyncer) catchAllRoute() (routetable.Target, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.catchAll == nil {
+		return routetable.Target{}, false
+	}
+	return r.catchAll.target, true
+}
+
+// setCatchAllRoute programs the routes of the wireguard interface through the catch-all route, or programs the route of
+// each CIDR again if the target is nil. The routes of the interface are replaced in a single update.
+func (r *RouteTableSyncer) setCatchAllRoute(ifaceName string, target *routetable.Target) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c := r.catchAll
+	if target == nil {
+		if c == nil {
+			return
+		}
+		r.catchAll = nil
+		r.routetable.SetRoutes(c.ifaceName, targetList(c.requested))
+		return
+	}
+	if c == nil {
+		c = &catchAllRoutes{
+			ifaceName: ifaceName,
+			requested: r.routetable.Targets(ifaceName),
+			applied:   r.routetable.AppliedTargets(ifaceName),
+			throws:    map[ip.CIDR]bool{},
+		}
+		for cidr, throw := range r.routetable.Targets(routetable.InterfaceNone) {
+			if throw.Type == routetable.TargetTypeThrow {
+				c.throws[cidr] = true
+			}
+		}
+		r.catchAll = c
+	}
+	c.target = *target
+	r.routetable.SetRoutes(ifaceName, c.programmed())
+}
+
+func (r *RouteTableSyncer) catchAllRouteUpdate(ifaceName string, target routetable.Target) {
+	c := r.catchAll
+	switch ifaceName {
+	case c.ifaceName:
+		c.requested[target.CIDR] = target
+		c.requestedDirty = true
+		r.programCatchAllRequested(target.CIDR)
+	case routetable.InterfaceNone:
+		r.routetable.RouteUpdate(ifaceName, target)
+		wasThrow, isThrow := c.throws[target.CIDR], target.Type == routetable.TargetTypeThrow
+		if isThrow {
+			c.throws[target.CIDR] = true
+		} else {
+			delete(c.throws, target.CIDR)
+		}
+		if wasThrow != isThrow {
+			r.programCatchAllRequestedWithin(target.CIDR)
+		}
+	default:
+		r.routetable.RouteUpdate(ifaceName, target)
+	}
+}
+
+func (r *RouteTableSyncer) catchAllRouteRemove(ifaceName string, cidr ip.CIDR) {
+	c := r.catchAll
+	switch ifaceName {
+	case c.ifaceName:
+		delete(c.requested, cidr)
+		c.requestedDirty = true
+		r.programCatchAllRequested(cidr)
+	case routetable.InterfaceNone:
+		r.routetable.RouteRemove(ifaceName, cidr)
+		if c.throws[cidr] {
+			delete(c.throws, cidr)
+			r.programCatchAllRequestedWithin(cidr)
+		}
+	default:
+		r.routetable.RouteRemove(ifaceName, cidr)
+	}
+}
+
+func (r *RouteTableSyncer) catchAllSetRoutes(ifaceName string, targets []routetable.Target) {
+	c := r.catchAll
+	switch ifaceName {
+	case c.ifaceName:
+		c.requested = map[ip.CIDR]routetable.Target{}
+		for _, target := range targets {
+			c.requested[target.CIDR] = target
+		}
+		c.requestedDirty = true
+	case routetable.InterfaceNone:
+		r.routetable.SetRoutes(ifaceName, targets)
+		c.throws = map[ip.CIDR]bool{}
+		for _, target := range targets {
+			if target.Type == routetable.TargetTypeThrow {
+				c.throws[target.CIDR] = true
+			}
+		}
+	default:
+		r.routetable.SetRoutes(ifaceName, targets)
+		return
+	}
+	r.routetable.SetRoutes(c.ifaceName, c.programmed())
+}
+
+// catchAllApplied records the requested routes as applied once the routing table has been applied successfully.
+func (r *RouteTableSyncer) catchAllApplied(err error) {
+	if c := r.catchAll; c != nil && err == nil && c.requestedDirty {
+		c.applied = copyTargets(c.requested)
+		c.requestedDirty = false
+	}
+}
+
+// programCatchAllRequested programs the requested route of the CIDR if it is within a throw route, and otherwise
+// removes any route programmed for the CIDR. The catch-all route itself is left in place.
+func (r *RouteTableSyncer) programCatchAllRequested(cidr ip.CIDR) {
+	c := r.catchAll
+	if cidr == c.target.CIDR {
+		return
+	}
+	if target, ok := c.requested[cidr]; ok && c.withinThrow(cidr) {
+		r.routetable.RouteUpdate(c.ifaceName, target)
+	} else {
+		r.routetable.RouteRemove(c.ifaceName, cidr)
+	}
+}
+
+// programCatchAllRequestedWithin reprograms the requested routes within the CIDR of a throw route that has been added
+// or removed.
+func (r *RouteTableSyncer) programCatchAllRequestedWithin(throwCIDR ip.CIDR) {
+	throwNet := throwCIDR.ToIPNet()
+	for cidr := range r.catchAll.requested {
+		if cidr.Prefix() > throwCIDR.Prefix() && throwNet.Contains(cidr.Addr().AsNetIP()) {
+			r.programCatchAllRequested(cidr)
+		}
+	}
+}
+
+// programmed returns the routes of the wireguard interface to program: the catch-all route, and the requested routes
+// within a throw route.
+func (c *catchAllRoutes) programmed() []routetable.Target {
+	targets := []routetable.Target{c.target}
+	for cidr, target := range c.requested {
+		if cidr != c.target.CIDR && c.withinThrow(cidr) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// withinThrow returns true if the CIDR is within the CIDR of a throw route.
+func (c *catchAllRoutes) withinThrow(cidr ip.CIDR) bool {
+	for prefix := int(cidr.Prefix()) - 1; prefix >= 0; prefix-- {
+		if c.throws[ip.CIDRFromAddrAndPrefix(cidr.Addr(), prefix)] {
+			return true
+		}
+	}
+	return false
+}
+
+func copyTargets(targets map[ip.CIDR]routetable.Target) map[ip.CIDR]routetable.Target {
+	copied := make(map[ip.CIDR]routetable.Target, len(targets))
+	for cidr, target := range targets {
+		copied[cidr] = target
+	}
+	return copied
+}
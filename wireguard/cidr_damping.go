@@ -0,0 +1,256 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+const (
+	// The default window in which the moves of a CIDR are counted, and the default hold-down period.
+	defaultCIDRFlapWindow   = 60 * time.Second
+	defaultCIDRFlapHoldDown = 60 * time.Second
+)
+
+// cidrFlapState tracks the recent moves of an allowed CIDR between peers, see Config.CIDRFlapMaxMoves.
+type cidrFlapState struct {
+	// The node the CIDR was last assigned to, and its route class. While the CIDR is damped this is the stable
+	// assignment that remains programmed.
+	node  string
+	class RouteClass
+
+	// The times of the moves within the window, oldest first, and the time of the last change of the assignment.
+	moves      []time.Time
+	lastChange time.Time
+
+	// Whether further moves are suppressed, and the latest assignment received while suppressed. An empty node
+	// indicates the CIDR has been removed.
+	damped       bool
+	desiredNode  string
+	desiredClass RouteClass
+}
+
+// cidrFlapWindow returns the window in which the moves of a CIDR are counted.
+func (c *Config) cidrFlapWindow() time.Duration {
+	if c.CIDRFlapWindow <= 0 {
+		return defaultCIDRFlapWindow
+	}
+	return c.CIDRFlapWindow
+}
+
+// cidrFlapHoldDown returns the period a damped CIDR must be stable for before its latest assignment is programmed.
+func (c *Config) cidrFlapHoldDown() time.Duration {
+	if c.CIDRFlapHoldDown <= 0 {
+		return defaultCIDRFlapHoldDown
+	}
+	return c.CIDRFlapHoldDown
+}
+
+// DampingReleaseAfter returns the time until the next damped CIDR is due to be released, or zero if no CIDR is damped.
+// Apply must be called after this time for the latest assignment of the CIDR to be programmed. This must be called
+// from the same goroutine as Apply.
+func (w *Wireguard) DampingReleaseAfter() time.Duration {
+	if w.tornDown || w.dampedCIDRs.Len() == 0 {
+		return 0
+	}
+	holdDown := w.config.cidrFlapHoldDown()
+	var releaseAfter time.Duration
+	for _, st := range w.cidrFlaps {
+		if !st.damped {
+			continue
+		}
+		after := holdDown - w.time.Since(st.lastChange)
+		if after <= 0 {
+			// The release is already due.
+			return time.Millisecond
+		}
+		if releaseAfter == 0 || after < releaseAfter {
+			releaseAfter = after
+		}
+	}
+	return releaseAfter
+}
+
+// isDampedThrowCIDR returns true if the CIDR is damped and routed outside of wireguard while damped.
+func (w *Wireguard) isDampedThrowCIDR(cidr ip.CIDR) bool {
+	return w.config.CIDRFlapThrowRoute && w.dampedCIDRs.Contains(cidr)
+}
+
+// dampCIDRAdd tracks the assignment of an allowed CIDR to a node. Returns true if the assignment is suppressed because
+// the CIDR is damped, in which case it is programmed once the CIDR has been stable for the hold-down period.
+func (w *Wireguard) dampCIDRAdd(name string, cidr ip.CIDR, class RouteClass) bool {
+	if w.config.CIDRFlapMaxMoves <= 0 {
+		return false
+	}
+	st := w.cidrFlaps[cidr]
+	if st != nil && st.damped {
+		if st.desiredNode != name {
+			w.logCxt.WithFields(logrus.Fields{"cidr": cidr, "from": st.desiredNode, "to": name}).Debug(
+				"Damped CIDR moved again, extending the hold-down")
+			st.lastChange = w.time.Now()
+		}
+		st.desiredNode, st.desiredClass = name, class
+		return true
+	}
+
+	prevNode := w.allowedCIDRToNodeName[cidr]
+	if st != nil {
+		prevNode = st.node
+	}
+	if prevNode == "" || prevNode == name {
+		// Not a move.
+		if st != nil {
+			st.class = class
+		}
+		return false
+	}
+	if st == nil {
+		st = &cidrFlapState{node: prevNode, class: w.cidrToRouteClass[cidr]}
+		w.cidrFlaps[cidr] = st
+	}
+
+	// Count the moves within the window, including this one.
+	now := w.time.Now()
+	window := w.config.cidrFlapWindow()
+	moves := st.moves[:0]
+	for _, t := range st.moves {
+		if now.Sub(t) < window {
+			moves = append(moves, t)
+		}
+	}
+	st.moves = append(moves, now)
+	st.lastChange = now
+	if len(st.moves) <= w.config.CIDRFlapMaxMoves {
+		st.node, st.class = name, class
+		return false
+	}
+
+	// The CIDR is flapping. Keep the stable assignment, which may have just been removed ahead of this move, and
+	// suppress further moves until the CIDR is stable.
+	w.logCxt.WithFields(logrus.Fields{
+		"cidr":     cidr,
+		"nodes":    []string{st.node, name},
+		"moves":    len(st.moves),
+		"window":   window,
+		"holdDown": w.config.cidrFlapHoldDown(),
+		"throw":    w.config.CIDRFlapThrowRoute,
+	}).Warning("CIDR is repeatedly moving between nodes, suppressing its moves until it is stable")
+	st.damped = true
+	st.desiredNode, st.desiredClass = name, class
+	w.dampedCIDRs.Add(cidr)
+	if owner, ok := w.allowedCIDRToNodeName[cidr]; !ok || owner != st.node {
+		w.assignAllowedCIDR(st.node, cidr, st.class)
+	}
+	if w.config.CIDRFlapThrowRoute {
+		w.reclassifyDampedCIDR(st.node, cidr)
+	}
+	return true
+}
+
+// dampCIDRRemove tracks the removal of an allowed CIDR from a node, or from whichever node it is assigned to if the
+// name is empty. Returns true if the removal is suppressed because the CIDR is damped.
+func (w *Wireguard) dampCIDRRemove(name string, cidr ip.CIDR) bool {
+	if w.config.CIDRFlapMaxMoves <= 0 {
+		return false
+	}
+	st := w.cidrFlaps[cidr]
+	if st != nil && st.damped {
+		if name != "" && st.desiredNode != name {
+			w.logCxt.Debugf("Damped CIDR %s is not assigned to node %s - ignoring", cidr, name)
+			return true
+		}
+		w.logCxt.WithField("cidr", cidr).Debug("Damped CIDR removed, deferring the removal until the hold-down")
+		if st.desiredNode != "" {
+			st.lastChange = w.time.Now()
+		}
+		st.desiredNode = ""
+		return true
+	}
+
+	// Remember the node the CIDR is removed from, so that adding it to another node counts as a move.
+	if owner, ok := w.allowedCIDRToNodeName[cidr]; ok && (name == "" || owner == name) {
+		if st == nil {
+			st = &cidrFlapState{}
+			w.cidrFlaps[cidr] = st
+		}
+		st.node, st.class = owner, w.cidrToRouteClass[cidr]
+		st.lastChange = w.time.Now()
+	}
+	return false
+}
+
+// dampedNodeRemoved drops a removed node from the latest assignments of the damped CIDRs, so that the CIDRs are not
+// assigned to the node when they are released.
+func (w *Wireguard) dampedNodeRemoved(name string) {
+	for _, st := range w.cidrFlaps {
+		if st.damped && st.desiredNode == name {
+			st.desiredNode = ""
+		}
+	}
+}
+
+// releaseDampedCIDRs programs the latest assignment of the damped CIDRs that have been stable for the hold-down
+// period, and forgets the moves of the other CIDRs once they are outside of the window.
+func (w *Wireguard) releaseDampedCIDRs() {
+	if len(w.cidrFlaps) == 0 {
+		return
+	}
+	window := w.config.cidrFlapWindow()
+	holdDown := w.config.cidrFlapHoldDown()
+	for cidr, st := range w.cidrFlaps {
+		stableFor := w.time.Since(st.lastChange)
+		if !st.damped {
+			if stableFor >= window {
+				delete(w.cidrFlaps, cidr)
+			}
+			continue
+		} else if stableFor < holdDown {
+			continue
+		}
+
+		w.logCxt.WithFields(logrus.Fields{
+			"cidr":      cidr,
+			"node":      st.desiredNode,
+			"stableFor": stableFor,
+		}).Info("Damped CIDR is stable, programming its latest assignment")
+		delete(w.cidrFlaps, cidr)
+		w.dampedCIDRs.Discard(cidr)
+		owner, assigned := w.allowedCIDRToNodeName[cidr]
+		if w.config.CIDRFlapThrowRoute && assigned {
+			w.reclassifyDampedCIDR(owner, cidr)
+		}
+		if st.desiredNode == "" {
+			if assigned {
+				w.unassignAllowedCIDR(cidr)
+			}
+		} else if !assigned || owner != st.desiredNode || w.cidrToRouteClass[cidr] != st.desiredClass {
+			w.assignAllowedCIDR(st.desiredNode, cidr, st.desiredClass)
+		}
+	}
+}
+
+// reclassifyDampedCIDR flags the peer with a damped CIDR for reprogramming when the CIDR is routed outside of
+// wireguard, or back through wireguard.
+func (w *Wireguard) reclassifyDampedCIDR(name string, cidr ip.CIDR) {
+	if node := w.peers[name]; node != nil && node.cidrs.Contains(cidr) {
+		update := w.getOrInitPeerUpdate(name)
+		update.cidrsReclassified = true
+		w.setPeerUpdate(name, update)
+	}
+}
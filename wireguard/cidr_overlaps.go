@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// logCIDROverlaps logs a warning for each CIDR just added to a peer that covers, or is covered by, a CIDR of another
+// peer, e.g. the block of one node and a smaller block within it after a block handoff.
+//
+// The overlapping CIDRs are both programmed, as allowed IPs and as routes. The device encrypts the traffic for the
+// peer with the longest allowed IP that contains the destination, and the kernel routes by longest prefix, so the more
+// specific CIDR takes precedence. The CIDR to node index is keyed by the exact CIDR, so the removal of one of the CIDRs
+// leaves the other programmed.
+func (w *Wireguard) logCIDROverlaps(added map[ip.CIDR]string) {
+	if len(added) == 0 {
+		return
+	}
+
+	// Only the prefix lengths in use need checking for a covering CIDR, which is typically just one or two.
+	var prefixes [129]bool
+	for cidr := range w.cidrToNodeName {
+		prefixes[cidr.Prefix()] = true
+	}
+
+	for cidr, name := range w.cidrToNodeName {
+		for prefix := int(cidr.Prefix()) - 1; prefix >= 0; prefix-- {
+			if !prefixes[prefix] {
+				continue
+			}
+			covering := ip.CIDRFromAddrAndPrefix(cidr.Addr(), prefix)
+			coveringName, ok := w.cidrToNodeName[covering]
+			if !ok || coveringName == name {
+				continue
+			}
+			_, cidrAdded := added[cidr]
+			_, coveringAdded := added[covering]
+			if !cidrAdded && !coveringAdded {
+				continue
+			}
+			w.logCxt.WithFields(logrus.Fields{
+				"cidr":         cidr,
+				"node":         name,
+				"coveringCIDR": covering,
+				"coveringNode": coveringName,
+			}).Warning("CIDR of a peer overlaps a CIDR of another peer, the longest prefix takes precedence")
+		}
+	}
+}
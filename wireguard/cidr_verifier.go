@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// deniedCIDRLogInterval is the minimum interval between the warnings logged for CIDRs denied by the CIDR verifier. The
+// denials in between are logged at debug level, and counted in the next warning.
+const deniedCIDRLogInterval = time.Minute
+
+// CIDRVerifier verifies that a CIDR belongs to a node before the CIDR is attributed to the wireguard peer of the node,
+// returning false to deny the CIDR. This guards against a node claiming the CIDRs of another node, which would
+// otherwise steer the traffic for those CIDRs into the wrong tunnel.
+type CIDRVerifier func(nodeName string, cidr ip.CIDR) bool
+
+// SetCIDRVerifier sets the verifier of the CIDRs attributed to the peers, or removes it if nil. A CIDR denied by the
+// verifier is treated as if it were excluded by Config.ExcludeCIDRs: it is not an allowed IP of the peer, and has a
+// throw route so that the traffic is not encrypted. The CIDRs are verified again on each resync, so that a denied CIDR
+// is routed to wireguard once its ownership is confirmed.
+//
+// The verifier is called from the goroutine calling Apply. The new verifier applies to all of the CIDRs on the next
+// Apply.
+func (w *Wireguard) SetCIDRVerifier(verifier CIDRVerifier) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() {
+		w.cidrVerifier = verifier
+		// A peer routed to wireguard may now have throw routes, see cidrsExcludedEver.
+		w.cidrsExcludedEver = w.cidrsExcludedEver || verifier != nil
+		w.reverifyCIDRs()
+	})
+}
+
+// DeniedCIDRs returns the number of CIDRs currently denied by the CIDR verifier, and the total number of times a CIDR
+// has been denied. This should be called from the same goroutine as Apply.
+func (w *Wireguard) DeniedCIDRs() (numDenied, numDenials int) {
+	return w.deniedCIDRs.Len(), w.numDeniedCIDRs
+}
+
+// verifyCIDR verifies a CIDR attributed to a node, recording whether the CIDR is denied. Returns true if the CIDR is
+// denied. A CIDR is always allowed if there is no verifier.
+func (w *Wireguard) verifyCIDR(name string, cidr ip.CIDR) bool {
+	if w.cidrVerifier == nil || w.cidrVerifier(name, cidr) {
+		if w.deniedCIDRs.Contains(cidr) {
+			w.logCxt.Infof("CIDR %s of node %s is now allowed by the CIDR verifier", cidr, name)
+			w.deniedCIDRs.Discard(cidr)
+		}
+		return false
+	}
+	if !w.deniedCIDRs.Contains(cidr) {
+		w.deniedCIDRs.Add(cidr)
+		w.numDeniedCIDRs++
+		w.logDeniedCIDR(name, cidr)
+	}
+	return true
+}
+
+// reverifyCIDRs verifies each CIDR attributed to a node again. The peers with a CIDR whose verification has changed are
+// flagged for a full update of the CIDRs. A CIDR that has not yet been added to the peer is programmed according to
+// the new verification when the peer update is applied.
+func (w *Wireguard) reverifyCIDRs() {
+	for cidr := range w.cidrToRouteClass {
+		name, ok := w.allowedCIDRToNodeName[cidr]
+		if !ok {
+			if name, ok = w.interfaceCIDRToNodeName[cidr]; !ok {
+				continue
+			}
+		}
+		wasDenied := w.deniedCIDRs.Contains(cidr)
+		if denied := w.verifyCIDR(name, cidr); denied == wasDenied {
+			continue
+		}
+		if node := w.peers[name]; node != nil && node.cidrs.Contains(cidr) {
+			update := w.getOrInitPeerUpdate(name)
+			update.cidrsReclassified = true
+			w.setPeerUpdate(name, update)
+		}
+	}
+}
+
+// isExcludedCIDR returns true if a CIDR of a peer is not programmed in wireguard because it is excluded by
+// Config.ExcludeCIDRs, denied by the CIDR verifier, or damped with Config.CIDRFlapThrowRoute set.
+func (w *Wireguard) isExcludedCIDR(cidr ip.CIDR) bool {
+	return excludedBy(cidr, w.excludeCIDRs) != nil || w.deniedCIDRs.Contains(cidr) || w.isDampedThrowCIDR(cidr)
+}
+
+// logDeniedCIDR logs a CIDR denied by the CIDR verifier. At most one warning is logged per deniedCIDRLogInterval, with
+// the number of CIDRs denied since the previous warning.
+func (w *Wireguard) logDeniedCIDR(name string, cidr ip.CIDR) {
+	w.numDenialsSinceLog++
+	logCxt := w.logCxt.WithFields(logrus.Fields{"node": name, "cidr": cidr})
+	if !w.lastDeniedCIDRLogTime.IsZero() && w.time.Since(w.lastDeniedCIDRLogTime) < deniedCIDRLogInterval {
+		logCxt.Debug("CIDR denied by the CIDR verifier, routing it outside of wireguard")
+		return
+	}
+	logCxt.WithFields(logrus.Fields{
+		"numDenied":      w.deniedCIDRs.Len(),
+		"deniedSinceLog": w.numDenialsSinceLog,
+	}).Warning("CIDR denied by the CIDR verifier, routing it outside of wireguard")
+	w.lastDeniedCIDRLogTime = w.time.Now()
+	w.numDenialsSinceLog = 0
+}
@@ -1,5 +1,41 @@
 package wireguard
 
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// RouteClass identifies the class of a destination that is routed over wireguard. Routes of different classes may be
+// programmed into different routing tables.
+type RouteClass string
+
+const (
+	// RouteClassWorkload is the class of remote workload CIDRs. This is the default class.
+	RouteClassWorkload RouteClass = "Workload"
+	// RouteClassHost is the class of remote host addresses, including the remote wireguard interface addresses.
+	RouteClassHost RouteClass = "Host"
+)
+
+// InterfaceAddressSource identifies the source of the address of the local wireguard interface.
+type InterfaceAddressSource string
+
+const (
+	// InterfaceAddressSourceDatastore uses the address in the local wireguard configuration in the datastore, which is
+	// allocated by another component. This is the default source.
+	InterfaceAddressSourceDatastore InterfaceAddressSource = "datastore"
+	// InterfaceAddressSourceNodeIP uses the IPv4 address of the local node.
+	InterfaceAddressSourceNodeIP InterfaceAddressSource = "node-ip"
+	// InterfaceAddressSourceDerived uses an address in InterfaceAddressPool derived from a hash of the hostname, so the
+	// same node always has the same address.
+	InterfaceAddressSourceDerived InterfaceAddressSource = "derived"
+)
+
 type Config struct {
 	// Wireguard configuration
 	Enabled             bool
@@ -9,4 +45,400 @@ type Config struct {
 	RoutingTableIndex   int
 	InterfaceName       string
 	MTU                 int
+
+	// RoutingRulePriorityRange is the maximum distance from RoutingRulePriority that the routing rules may be moved to
+	// if another component has a rule at the configured priority. If zero, the rules always use the configured priority.
+	RoutingRulePriorityRange int
+
+	// RoutingTableIndexByClass optionally maps a route class to the routing table used for routes of that class. Route
+	// classes that are not included use RoutingTableIndex.
+	RoutingTableIndexByClass map[RouteClass]int
+
+	// RoutingTableIndexAuto chooses RoutingTableIndex when the module is created, rather than using the configured
+	// index. The routing rules and routing tables are scanned and the lowest free routing table between
+	// RoutingTableIndexAutoMin and RoutingTableIndexAutoMax is chosen, or the table used previously if our routing
+	// rule to a table in the range is found. The chosen index is published with our public key, and used for the
+	// lifetime of the module. If there is no free routing table, nothing is programmed and Apply returns
+	// ErrInvalidRoutingTableIndex.
+	RoutingTableIndexAuto    bool
+	RoutingTableIndexAutoMin int
+	RoutingTableIndexAutoMax int
+
+	// RouteScope optionally overrides the scope of the unicast routes to the wireguard interface, and RouteOnLink sets
+	// the onlink flag on those routes. By default the routes are link scoped without the onlink flag.
+	RouteScope  *netlink.Scope
+	RouteOnLink bool
+
+	// RouteViaPeerTunnelIP programs the routes to the wireguard interface of the workload CIDRs of each peer with the
+	// interface address of the peer as the gateway, so that a traceroute through wireguard shows the peer as a hop. The
+	// gateway routes are universe scoped with the onlink flag, regardless of RouteScope. The route to the interface
+	// address of the peer remains a device route, and the CIDRs of a peer whose interface address is not known have
+	// device routes, as if this were not set. The catch-all route is not a route of a peer and is unaffected.
+	RouteViaPeerTunnelIP bool
+
+	// ThrowRouteScope optionally overrides the scope of the throw routes used for peers that do not support wireguard.
+	// Throw routes are universe scoped by default, regardless of the unicast route scope.
+	ThrowRouteScope *netlink.Scope
+
+	// RoutePriority is the priority (metric) of the unicast and throw routes. A non-zero priority allows our routes to
+	// coexist with routes for the same CIDRs, e.g. a higher priority backup route through the underlay. Routes with
+	// another route protocol and a different priority are not removed unless StrictTableOwnership is set. When the
+	// priority is changed the routes are replaced by adding the new route before deleting the old route.
+	RoutePriority int
+
+	// EnableUserspaceFallback enables the use of a userspace wireguard implementation (e.g. boringtun) when the kernel
+	// does not support wireguard. The userspace device is created externally, or by running UserspaceHelper with the
+	// interface name as its argument, and is configured through its UAPI socket.
+	EnableUserspaceFallback bool
+	UserspaceHelper         string
+
+	// RepairWrongLinkType deletes and recreates the wireguard interface if a device of another type is using the
+	// interface name. Otherwise Apply returns ErrWrongLinkType and no public key is published.
+	RepairWrongLinkType bool
+
+	// InterfaceAddressPrefixLength is the prefix length of the address configured on the wireguard interface. If zero,
+	// or longer than the address, a host prefix is used, i.e. /32 for IPv4 and /128 for IPv6.
+	InterfaceAddressPrefixLength int
+
+	// RequirePeerReady only routes traffic to a peer through wireguard once the peer has reported that it is ready, see
+	// Wireguard.EndpointWireguardReady. Until then, throw routes are used so that the traffic continues to use the
+	// existing encapsulation. This avoids a connectivity gap while a cluster migrates to wireguard.
+	RequirePeerReady bool
+
+	// ProgramPeersWithoutEndpoint programs the peers that have a public key but no endpoint address, e.g. because the
+	// endpoint of the node has been removed but its wireguard configuration has not, so that the peer may initiate the
+	// handshake and wireguard learns its endpoint. Otherwise such a peer is not programmed and its CIDRs have throw
+	// routes, since wireguard cannot send to a peer without an endpoint.
+	ProgramPeersWithoutEndpoint bool
+
+	// PublishKeyWithoutEndpoint publishes our public key even while the endpoint address of our node is not known.
+	// Otherwise the key is held back until the address is known, since the peers build their endpoint for our node
+	// from the datastore and so could not reach us. The device is still configured in the meantime. This may be set on
+	// a node that only initiates the handshakes, e.g. from a roaming address, whose endpoint is learned by the peers.
+	PublishKeyWithoutEndpoint bool
+
+	// MaxPeers and MaxAllowedIPsPerPeer limit the number of peers programmed in wireguard and the number of allowed IPs
+	// programmed for each peer. If zero, the number is unlimited. When a limit is exceeded the peers are selected in
+	// order of node name and the allowed IPs in order of CIDR. The remaining peers and CIDRs are not programmed and
+	// have throw routes, see Wireguard.LimitError.
+	MaxPeers             int
+	MaxAllowedIPsPerPeer int
+
+	// StrictTableOwnership removes all routes in the wireguard routing tables that are not expected, regardless of
+	// their route protocol. Otherwise only routes with the configured route protocol are removed, and a route with
+	// another protocol for the CIDR of a peer is left in place. Note that routes programmed with a previously
+	// configured route protocol are then also left in place, unless the protocol is listed in LegacyRouteProtocols.
+	StrictTableOwnership bool
+
+	// LegacyRouteProtocols are the route protocols that the wireguard routes were previously programmed with, e.g.
+	// before the configured route protocol was changed. Routes with these protocols in the wireguard routing tables
+	// are treated as our own, and are rewritten with the current route protocol on the first resync, even if
+	// StrictTableOwnership is not set.
+	LegacyRouteProtocols []int
+
+	// IPVersion is the IP version of the allowed CIDRs and routes programmed by this instance. If zero, IPv4 is used.
+	// Allowed CIDRs of the other IP version are ignored, since they cannot be programmed in the routing tables.
+	IPVersion uint8
+
+	// LogLevel optionally overrides the log level of the wireguard module, so that it may log at a more verbose level
+	// than the rest of felix. If nil, the level of the standard logger is used.
+	LogLevel *logrus.Level
+
+	// TraceBufferSize is the number of the most recent mutating netlink and wireguard operations kept in the trace of
+	// the operations, along with the cause and result of each operation, see Wireguard.DumpTrace. This shows why the
+	// routes, rules or peers are being rewritten. If zero, no trace is kept. This is read when the module is created.
+	TraceBufferSize int
+
+	// UnderlayInterface is the interface used by the encrypted wireguard traffic on a node with multiple underlay
+	// interfaces, and UnderlaySourceIP the source address of that traffic. If UnderlaySourceIP is not set the endpoint
+	// address of this node is used. The address is verified to be configured on the interface, and an additional rule
+	// sends the traffic sent by wireguard to UnderlayRoutingTableIndex, which contains a default route through the
+	// interface with the source address. This avoids asymmetric routing of the replies to peers, which peers drop.
+	UnderlayInterface         string
+	UnderlaySourceIP          ip.Addr
+	UnderlayRoutingTableIndex int
+
+	// ParentInterfaces match the names of the interfaces that carry the wireguard traffic, e.g. the underlay interface.
+	// The kernel may flush our routing rules or interface address when such an interface flaps, so when one of these
+	// interfaces comes up the routing rules, the interface address and the wireguard device configuration are resynced.
+	// The routes to the wireguard interface are not resynced, since they are not on the parent interface. The
+	// UnderlayInterface is always a parent interface.
+	ParentInterfaces []*regexp.Regexp
+
+	// ExcludeCIDRs are the destinations that are never routed through wireguard, e.g. latency critical subnets. Allowed
+	// CIDRs of a peer that are within, or overlap, an excluded CIDR are not programmed in wireguard and have throw routes
+	// so that they are routed by the normal routing tables. The exclusions may be changed by Wireguard.UpdateConfig.
+	ExcludeCIDRs []ip.CIDR
+
+	// InterfaceAddressSource is the source of the address of the local wireguard interface, by default the datastore.
+	// For the other sources the address in the local wireguard configuration in the datastore is ignored, and instead
+	// the chosen address is published with our public key so that peers learn it. InterfaceAddressPool is the pool the
+	// derived address is chosen from. Derived addresses may collide, this is not detected locally but left to the
+	// publication of the address. Both may be changed by Wireguard.UpdateConfig.
+	InterfaceAddressSource InterfaceAddressSource
+	InterfaceAddressPool   ip.CIDR
+
+	// ApplyTimeout is the deadline of Wireguard.Apply. Once it is exceeded the remaining netlink and wireguard calls are
+	// abandoned, and the updates that were not applied are retried by the next Apply. If zero, Apply has no deadline.
+	ApplyTimeout time.Duration
+
+	// RouteNetlinkTimeout is the socket timeout of the netlink handles of the routing tables, which are separate from
+	// the netlink handle used for the link, its addresses and the routing rules, and are reconnected independently. If
+	// zero, the netlink timeout passed to New is used.
+	RouteNetlinkTimeout time.Duration
+
+	// NotSupportedReprobeInterval is the interval at which wireguard support is re-probed once it has been found not to
+	// be supported, so that wireguard is programmed if support is added later, e.g. by loading the kernel module. The
+	// first re-probe is after 30s, or after the interval if that is shorter. If zero, support is only probed again on
+	// a resync.
+	NotSupportedReprobeInterval time.Duration
+
+	// StaleHandshakeThreshold is the age of the last handshake with a peer after which the handshake is reported as
+	// stale by Wireguard.PeerDiagnostics. If zero, 180s is used, which is when wireguard rejects the session.
+	StaleHandshakeThreshold time.Duration
+
+	// AdoptExistingDevice adopts the wireguard device programmed by a previous process, e.g. when felix is restarted:
+	// the private key of the device is kept and published by the first Apply, and the peers on the device are left
+	// intact until Wireguard.DatastoreInSync is called. Otherwise the peers that have not yet been received are
+	// removed by the first Apply.
+	AdoptExistingDevice bool
+
+	// CIDRFlapMaxMoves damps allowed CIDRs that repeatedly move between peers, e.g. due to a faulty controller. Once a
+	// CIDR has moved more than CIDRFlapMaxMoves times within CIDRFlapWindow its moves are suppressed, and the latest
+	// assignment is only programmed once the CIDR has not moved for CIDRFlapHoldDown. While suppressed the CIDR keeps
+	// the last stable assignment or, if CIDRFlapThrowRoute is set, is removed from wireguard and has a throw route. If
+	// zero, moves are not damped. The window and hold-down default to 60s. See Wireguard.DampingReleaseAfter.
+	CIDRFlapMaxMoves   int
+	CIDRFlapWindow     time.Duration
+	CIDRFlapHoldDown   time.Duration
+	CIDRFlapThrowRoute bool
+
+	// EndpointFailoverTimeout switches the endpoint of a peer to the secondary address of its node, see
+	// Wireguard.EndpointSecondaryUpdate, if there has been no handshake through the primary address within the timeout
+	// of the peer being programmed. The endpoints alternate between the addresses on each timeout until there is a
+	// handshake, so the primary address is used again if the secondary address also fails. If zero, the primary address
+	// is always used. See Wireguard.FailoverCheckAfter.
+	EndpointFailoverTimeout time.Duration
+
+	// ProvisionalKeyTimeout carries the public key of a removed node over to a node that is added with the same
+	// endpoint address within the timeout, e.g. when a node is replaced in place under a new name, keeping its address
+	// and its IPAM blocks. The new node uses the key provisionally until its own key arrives, so that its CIDRs are not
+	// given throw routes in the meantime. The provisional key is dropped if the key of the node has not arrived within
+	// the timeout. If zero, the keys are not carried over. See Wireguard.ProvisionalKeyExpiryAfter.
+	ProvisionalKeyTimeout time.Duration
+
+	// KeyTransitionTimeout shortens the loss of connectivity when our key changes, e.g. on a key rotation or when
+	// recovering from a drifted key. Our previous key is published alongside the new key until the timeout has passed.
+	// The peers then keep the peer of a node's previous key, without any allowed IPs, while programming the new key,
+	// until the deadline published by the node or until there is a handshake with the new key, whichever is first. The
+	// deadline is capped at our own timeout. If zero, the previous key is neither published nor honoured. See
+	// Wireguard.EndpointWireguardPreviousKey and Wireguard.KeyTransitionCheckAfter.
+	KeyTransitionTimeout time.Duration
+
+	// LocalCIDRsAsThrow programs throw routes in the wireguard routing tables for the CIDRs of the local host, so that a
+	// routing rule left by a previous instance can never route local traffic to wireguard while we are reconciling.
+	// The throw routes are applied before the routing rule. By default the CIDRs of the local host are ignored.
+	LocalCIDRsAsThrow bool
+
+	// MaxPauseDuration is the longest reconciliation is paused for by Wireguard.Pause before it is resumed
+	// automatically, so that it is never left paused. Defaults to 10 minutes. See Wireguard.ResumeAfter.
+	MaxPauseDuration time.Duration
+
+	// ConntrackCleanup removes the conntrack entries of a CIDR whose route to the wireguard interface is removed, or
+	// replaced by a throw route, so that the established connections to the CIDR do not hang on the entries of the
+	// old path. The entries are removed by the cleaner set by Wireguard.SetConntrackCleaner.
+	ConntrackCleanup bool
+
+	// RuleSelectors select the traffic that our routing rules send to the wireguard routing tables, by default all of
+	// the traffic that does not have our firewall mark. The traffic must match all of the selectors, e.g. the traffic
+	// from the local pod CIDRs that does not have our firewall mark. RuleIifPrefix is the prefix of the interfaces
+	// selected by RuleSelectorIif, by default the workload interfaces. The rules of the previous selectors are removed
+	// when the selectors are changed by Wireguard.UpdateConfig.
+	RuleSelectors []RuleSelector
+	RuleIifPrefix string
+
+	// NonWireguardPeerHandling is how the traffic to the peers that are not routed to wireguard, e.g. the nodes that do
+	// not have wireguard enabled, is kept out of the wireguard routing tables. By default each CIDR of those peers has
+	// a throw route, which scales with the number of those CIDRs. With NonWireguardPeerHandlingRuleExclude the CIDRs
+	// have no routes, and only the CIDRs within a CIDR routed to wireguard have exclusion rules. The routes or rules of
+	// the previous handling are removed when the handling is changed by Wireguard.UpdateConfig.
+	NonWireguardPeerHandling NonWireguardPeerHandling
+
+	// AllowedIPsChunkSize is the maximum number of allowed IPs in a single wireguard device configuration, so that the
+	// configuration does not exceed the netlink message size. The allowed IPs of a peer with more are configured in
+	// chunks: the first chunk replaces the allowed IPs of the peer if required, and the remaining chunks are appended.
+	// The routes to the CIDRs of a chunk are only added once the chunk is configured. Defaults to 1000.
+	AllowedIPsChunkSize int
+
+	// PersistentKeepalive is the interval of the keepalives sent to each peer, e.g. to keep the NAT mapping of a node
+	// behind NAT open. If zero, no keepalives are sent.
+	PersistentKeepalive time.Duration
+
+	// NodeOverridesFile is the path of an optional JSON file of node-local overrides of ListeningPort, MTU,
+	// PersistentKeepalive and RoutingRulePriority, see NodeOverrides. The overrides are merged over the configuration
+	// when the module is created, and the file is re-read on each resync, so an edit of the file is applied by
+	// Wireguard.QueueResync without a restart. If the file is malformed, or the merged configuration is not valid, the
+	// file is ignored with a warning and the previous settings are retained.
+	NodeOverridesFile string
+
+	// DSCP is the DSCP value set on the encrypted traffic sent by this node, so that the underlay network can
+	// prioritize it, or nil to leave the traffic unmarked. Wireguard only copies the DSCP of the inner packet in some
+	// configurations, so the encrypted traffic is marked by the iptables or BPF dataplane, see DSCPMarking. The value
+	// is also programmed as the realm of the IPv4 routes to the wireguard interface.
+	DSCP *uint8
+
+	// CatchAllRoute programs a single default route to the wireguard interface in place of the route of each CIDR of
+	// the peers, for clusters where all of the traffic between the nodes is encrypted. The allowed IPs of the peers are
+	// unchanged, so the traffic to a destination that is not a CIDR of a peer is dropped by wireguard. The traffic that
+	// must not be encrypted escapes the default route through throw routes: the CIDRs of the local host, the
+	// CatchAllThrowCIDRs, the ExcludeCIDRs and the CIDRs of the peers that are not routed to wireguard. A CIDR of a
+	// peer within a throw route keeps a route of its own. This requires LocalCIDRsAsThrow, a single routing table and
+	// NonWireguardPeerHandlingThrow. CatchAllRoute may be changed by Wireguard.UpdateConfig, in which case the default
+	// route and the routes of the CIDRs are swapped in a single update of the routing table.
+	CatchAllRoute bool
+
+	// CatchAllThrowCIDRs are the CIDRs that have throw routes while CatchAllRoute is set, e.g. the underlay CIDRs of
+	// the nodes, so that the encrypted traffic and the traffic to the underlay is not routed to wireguard.
+	CatchAllThrowCIDRs []ip.CIDR
+
+	// ResyncDivergencePercent guards the resync of the wireguard device against a read of the device that is missing
+	// peers, e.g. a read made while another process such as `wg show` reads the device. If a resync finds more than
+	// this percentage of the programmed peers missing from the device, and the previous resync found the device
+	// in-sync, the device is read again. If the second read also finds the peers missing they are added, otherwise
+	// the device is left as it is until the next resync. If zero, the device is not read again.
+	ResyncDivergencePercent int
+
+	// CapacityStatsInterval is the interval at which the counts of the programmed peers, allowed IPs and routes are
+	// reported to the callback set by Wireguard.SetCapacityStatsCallback. If zero, the counts are not reported.
+	CapacityStatsInterval time.Duration
+
+	// CoverageLogThreshold is the change in the encryption coverage, in percentage points, that is logged, see
+	// Wireguard.CoverageReport. A summary of the coverage is logged by the first Apply, and then whenever the coverage
+	// has changed by more than the threshold since the summary was last logged, which requires each Apply to scan the
+	// CIDRs of the peers. If zero, no summary is logged.
+	CoverageLogThreshold int
+
+	// AllowEnabledOverride allows Enabled to be overridden on this node, see Wireguard.SetNodeOverrideEnabled, e.g. so
+	// that wireguard is rolled out to a canary pool of nodes first. The configuration must then be valid for wireguard
+	// to be enabled even if Enabled is not set, and the updates are cached while wireguard is disabled so that it can
+	// be enabled without a restart.
+	AllowEnabledOverride bool
+
+	// PeerBatchThreshold coalesces bursts of peer updates, e.g. when most nodes publish new keys during an upgrade.
+	// Once more than PeerBatchThreshold peers have been updated within PeerBatchWindow, the programming of the peers
+	// and their routes is held until the window ends, and the held updates are then applied with a single device
+	// configuration. The held updates are applied immediately if our own public key is updated, or a peer that had no
+	// public key has one, since connectivity depends on those. PeerBatchWindow defaults to 10 seconds. If zero, the
+	// updates are not held. See Wireguard.PeerBatchFlushAfter.
+	PeerBatchThreshold int
+	PeerBatchWindow    time.Duration
+}
+
+// mayBeEnabled returns true if wireguard is enabled, or may be enabled by the node override, see AllowEnabledOverride.
+func (c *Config) mayBeEnabled() bool {
+	return c.Enabled || c.AllowEnabledOverride
+}
+
+// DSCPMarking returns the DSCP value to set on the encrypted traffic sent from the listening port, and whether the
+// traffic is marked, i.e. wireguard is enabled and DSCP is set.
+func (c *Config) DSCPMarking() (dscp uint8, enabled bool) {
+	if !c.Enabled || c.DSCP == nil {
+		return 0, false
+	}
+	return *c.DSCP, true
+}
+
+// routeRealm returns the realm of the routes to the wireguard interface, or 0 if the routes have no realm. Only IPv4
+// routes have a realm.
+func (c *Config) routeRealm() int {
+	if c.DSCP == nil || c.ipVersion() != 4 {
+		return 0
+	}
+	return int(*c.DSCP)
+}
+
+// isParentInterface returns true if the interface is one of the parent interfaces, see ParentInterfaces.
+func (c *Config) isParentInterface(ifaceName string) bool {
+	if c.UnderlayInterface != "" && ifaceName == c.UnderlayInterface {
+		return true
+	}
+	for _, exp := range c.ParentInterfaces {
+		if exp.MatchString(ifaceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipVersion returns the IP version of the allowed CIDRs and routes, defaulting to IPv4.
+func (c *Config) ipVersion() uint8 {
+	if c.IPVersion == 0 {
+		return 4
+	}
+	return c.IPVersion
+}
+
+// netlinkFamily returns the netlink family of the IP version.
+func (c *Config) netlinkFamily() int {
+	if c.ipVersion() == 6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// interfaceAddressSource returns the source of the local wireguard interface address, defaulting to the datastore.
+func (c *Config) interfaceAddressSource() InterfaceAddressSource {
+	if c.InterfaceAddressSource == "" {
+		return InterfaceAddressSourceDatastore
+	}
+	return c.InterfaceAddressSource
+}
+
+// interfaceAddressPrefixLength returns the prefix length of the wireguard interface address for an address with the
+// specified number of bits.
+func (c *Config) interfaceAddressPrefixLength(bits int) int {
+	if c.InterfaceAddressPrefixLength <= 0 || c.InterfaceAddressPrefixLength > bits {
+		return bits
+	}
+	return c.InterfaceAddressPrefixLength
+}
+
+// routingTableIndexForClass returns the index of the routing table used for routes of the specified class.
+func (c *Config) routingTableIndexForClass(class RouteClass) int {
+	if tableIndex, ok := c.RoutingTableIndexByClass[class]; ok {
+		return tableIndex
+	}
+	return c.RoutingTableIndex
+}
+
+// routingTableIndexes returns the sorted indexes of all of the routing tables used for wireguard routes.
+func (c *Config) routingTableIndexes() []int {
+	tableIndexes := []int{c.RoutingTableIndex}
+	for _, tableIndex := range c.RoutingTableIndexByClass {
+		found := false
+		for _, existing := range tableIndexes {
+			found = found || existing == tableIndex
+		}
+		if !found {
+			tableIndexes = append(tableIndexes, tableIndex)
+		}
+	}
+	sort.Ints(tableIndexes)
+	return tableIndexes
+}
+
+// excludedBy returns the excluded CIDR that contains or overlaps the specified CIDR, or nil if the CIDR is not excluded.
+// A CIDR that contains an excluded CIDR only partially overlaps the exclusion.
+func excludedBy(cidr ip.CIDR, excludeCIDRs []ip.CIDR) ip.CIDR {
+	ipNet := cidr.ToIPNet()
+	for _, exclude := range excludeCIDRs {
+		if exclude.Version() != cidr.Version() {
+			continue
+		}
+		excludeNet := exclude.ToIPNet()
+		if excludeNet.Contains(ipNet.IP) || ipNet.Contains(excludeNet.IP) {
+			return exclude
+		}
+	}
+	return nil
 }
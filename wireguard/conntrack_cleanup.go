@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// ConntrackCleaner removes the conntrack entries of a CIDR whose traffic is no longer routed through wireguard, so that
+// the established connections to the CIDR do not keep using the entries of the old path. The cleaner is called from a
+// background goroutine, and may block while the entries are removed.
+type ConntrackCleaner func(cidr ip.CIDR)
+
+// SetConntrackCleaner sets the cleaner of the conntrack entries of the CIDRs whose route to the wireguard interface is
+// removed, or replaced by a throw route, or removes it if nil. The cleaner is only called if Config.ConntrackCleanup
+// is set, once the routing tables have been applied.
+func (w *Wireguard) SetConntrackCleaner(cleaner ConntrackCleaner) {
+	w.queueUpdate(PendingWorkSummary{}, func() {
+		w.conntrackCleaner = cleaner
+	})
+}
+
+// conntrackCleanupEnabled returns true if the conntrack entries of the CIDRs moved off wireguard are removed.
+func (w *Wireguard) conntrackCleanupEnabled() bool {
+	return w.config.ConntrackCleanup && w.conntrackCleaner != nil
+}
+
+// wireguardRouteCIDRs returns the CIDRs that are routed to the wireguard interface in any of the routing tables,
+// including the routes held back until the peer is configured.
+func (w *Wireguard) wireguardRouteCIDRs() set.Set {
+	cidrs := set.New()
+	for _, rt := range w.RouteTableSyncers() {
+		for cidr := range rt.Targets(w.config.InterfaceName) {
+			cidrs.Add(cidr)
+		}
+	}
+	for cidr := range w.routesPendingWireguard {
+		cidrs.Add(cidr)
+	}
+	return cidrs
+}
+
+// queueConntrackCleanups queues the removal of the conntrack entries of the CIDRs that were routed to the wireguard
+// interface before the routes were updated, and no longer are. A CIDR whose route to wireguard is only updated, e.g.
+// because it moved to another wireguard peer or routing table, is not cleaned up, and nor is a CIDR that is newly
+// routed to wireguard.
+func (w *Wireguard) queueConntrackCleanups(routedBefore set.Set) {
+	if routedBefore == nil {
+		return
+	}
+	routedAfter := w.wireguardRouteCIDRs()
+	routedBefore.Iter(func(item interface{}) error {
+		if cidr := item.(ip.CIDR); !routedAfter.Contains(cidr) {
+			w.logCxt.Debugf("CIDR %s is no longer routed to wireguard, queueing conntrack cleanup", cidr)
+			w.conntrackPending.Add(cidr)
+		}
+		return nil
+	})
+}
+
+// startConntrackCleanups starts the removal of the conntrack entries of the queued CIDRs in the background, once the
+// routes have been applied. A CIDR that has been routed to wireguard again since it was queued is not cleaned up. The
+// pending removals are tracked so that a CIDR is not routed to wireguard again until its removal has completed, see
+// waitForConntrackCleanups.
+func (w *Wireguard) startConntrackCleanups() {
+	for cidr, done := range w.conntrackInFlight {
+		select {
+		case <-done:
+			delete(w.conntrackInFlight, cidr)
+		default:
+		}
+	}
+	if w.conntrackPending.Len() == 0 {
+		return
+	}
+	pending := w.conntrackPending
+	w.conntrackPending = set.New()
+	if !w.conntrackCleanupEnabled() {
+		return
+	}
+
+	routed := w.wireguardRouteCIDRs()
+	cleaner := w.conntrackCleaner
+	pending.Iter(func(item interface{}) error {
+		cidr := item.(ip.CIDR)
+		if routed.Contains(cidr) {
+			w.logCxt.Debugf("CIDR %s is routed to wireguard again, skipping conntrack cleanup", cidr)
+			return nil
+		} else if _, ok := w.conntrackInFlight[cidr]; ok {
+			w.logCxt.Debugf("Conntrack cleanup of CIDR %s is already in progress", cidr)
+			return nil
+		}
+		w.logCxt.WithField("cidr", cidr).Info("Removing conntrack entries of CIDR no longer routed to wireguard")
+		done := make(chan struct{})
+		w.conntrackInFlight[cidr] = done
+		go func() {
+			defer close(done)
+			cleaner(cidr)
+		}()
+		return nil
+	})
+}
+
+// waitForConntrackCleanups waits for the pending removals of the conntrack entries of the CIDRs that are about to be
+// routed to wireguard again, so that the entries of the new connections are not removed.
+func (w *Wireguard) waitForConntrackCleanups(rt *RouteTableSyncer) {
+	if len(w.conntrackInFlight) == 0 {
+		return
+	}
+	targets := rt.Targets(w.config.InterfaceName)
+	for cidr, done := range w.conntrackInFlight {
+		if _, ok := targets[cidr]; !ok {
+			continue
+		}
+		w.logCxt.WithField("cidr", cidr).Info("Waiting for pending conntrack cleanup to finish")
+		<-done
+		delete(w.conntrackInFlight, cidr)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"math"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// CoverageReason is the reason that the traffic to a workload CIDR of a peer falls through the wireguard routing and
+// is not encrypted, see Wireguard.CoverageReport.
+type CoverageReason string
+
+const (
+	// CoverageReasonNoKey is a CIDR of a node that has no public key, e.g. because its wireguard configuration has been
+	// removed while its CIDRs remain.
+	CoverageReasonNoKey CoverageReason = "NoKey"
+	// CoverageReasonConflict is a CIDR of a node whose public key is claimed by another node.
+	CoverageReasonConflict CoverageReason = "Conflict"
+	// CoverageReasonExcluded is a CIDR that is excluded by Config.ExcludeCIDRs, denied by the CIDR verifier or damped,
+	// or a CIDR of a node that is excluded from encryption by policy.
+	CoverageReasonExcluded CoverageReason = "Excluded"
+	// CoverageReasonPending is a CIDR whose route to the wireguard interface is held back or has yet to be applied, e.g.
+	// because the wireguard link is not yet up.
+	CoverageReasonPending CoverageReason = "Pending"
+	// CoverageReasonOverLimit is a CIDR of a node beyond Config.MaxPeers, or a CIDR beyond Config.MaxAllowedIPsPerPeer.
+	CoverageReasonOverLimit CoverageReason = "OverLimit"
+	// CoverageReasonNotRouted is a CIDR of a node that is not routed to wireguard for another reason, e.g. because it
+	// has no endpoint address, is drained or is not ready.
+	CoverageReasonNotRouted CoverageReason = "NotRouted"
+	// CoverageReasonInactive is a CIDR of any node while wireguard is not active, e.g. because it is not supported.
+	CoverageReasonInactive CoverageReason = "Inactive"
+)
+
+// CoverageReport is the encryption coverage of the workload CIDRs of the remote nodes: how many of the CIDRs are
+// routed to the wireguard interface and encrypted for their peer, and why the traffic to the others falls through to
+// the normal routing. The CIDRs of the node interface addresses are not included.
+type CoverageReport struct {
+	// Active is false if wireguard is not programmed, e.g. because it is not supported, in which case none of the CIDRs
+	// are tunneled.
+	Active bool
+
+	// CIDRs is the number of the workload CIDRs of the remote nodes, and Tunneled the number of those that are routed
+	// to the wireguard interface. Percent is Tunneled as a percentage of CIDRs, or zero if there are no CIDRs.
+	CIDRs    int
+	Tunneled int
+	Percent  float64
+
+	// FallThrough is the number of the CIDRs that are not tunneled, by reason.
+	FallThrough map[CoverageReason]int
+
+	// Peers is the coverage of each remote node with workload CIDRs, sorted by name.
+	Peers []PeerCoverage
+}
+
+// PeerCoverage is the encryption coverage of the workload CIDRs of a remote node.
+type PeerCoverage struct {
+	Name        string
+	CIDRs       int
+	Tunneled    int
+	FallThrough map[CoverageReason]int
+}
+
+// QueueCoverageReport queues a coverage report that is made once the next Apply completes, and requests an Apply, so
+// that the report is of the configuration of a single Apply. The callback is invoked from the goroutine calling Apply.
+// This may be called from any goroutine, e.g. to serve a diagnostics request.
+func (w *Wireguard) QueueCoverageReport(callback func(CoverageReport)) {
+	w.queuedUpdatesLock.Lock()
+	w.coverageQueries = append(w.coverageQueries, callback)
+	w.queuedUpdatesLock.Unlock()
+	w.kick()
+}
+
+// reportCoverage answers the reports queued by QueueCoverageReport, and logs a summary of the coverage if it has
+// changed by more than Config.CoverageLogThreshold percentage points since the summary was last logged. The report is
+// only made if it is queued or the threshold is set, since it scans every CIDR. This is called once an Apply completes.
+func (w *Wireguard) reportCoverage() {
+	w.queuedUpdatesLock.Lock()
+	queries := w.coverageQueries
+	w.coverageQueries = nil
+	w.queuedUpdatesLock.Unlock()
+
+	threshold := float64(w.config.CoverageLogThreshold)
+	if len(queries) == 0 && threshold <= 0 {
+		return
+	}
+	report := w.CoverageReport()
+	for _, callback := range queries {
+		callback(report)
+	}
+	if threshold <= 0 {
+		return
+	} else if w.coverageLogged && math.Abs(report.Percent-w.coverageLoggedPercent) <= threshold {
+		return
+	}
+	fields := logrus.Fields{
+		"percent":  report.Percent,
+		"cidrs":    report.CIDRs,
+		"tunneled": report.Tunneled,
+		"active":   report.Active,
+	}
+	if w.coverageLogged {
+		fields["previousPercent"] = w.coverageLoggedPercent
+	}
+	for reason, n := range report.FallThrough {
+		fields[string(reason)] = n
+	}
+	w.logCxt.WithFields(fields).Info("Wireguard encryption coverage changed")
+	w.coverageLogged = true
+	w.coverageLoggedPercent = report.Percent
+}
+
+// CoverageReport returns the encryption coverage of the configuration programmed by the last Apply. The report is
+// built from the cached configuration, without reading the routing tables or the device. A CIDR is tunneled if it has
+// an applied route to the wireguard interface that is not held back, while the routing rule and the wireguard link are
+// programmed. This should be called from the same goroutine as Apply, see QueueCoverageReport.
+func (w *Wireguard) CoverageReport() CoverageReport {
+	report := CoverageReport{
+		Active:      w.config.Enabled && !w.tornDown && !w.wireguardNotSupported && w.routingTableErr == nil,
+		FallThrough: map[CoverageReason]int{},
+	}
+	tunneled := map[ip.CIDR]bool{}
+	if report.Active {
+		for _, rt := range w.RouteTableSyncers() {
+			for cidr := range rt.AppliedTargets(w.config.InterfaceName) {
+				tunneled[cidr] = true
+			}
+		}
+	}
+
+	peers := map[string]*PeerCoverage{}
+	wireguardCIDRs := map[string]set.Set{}
+	for cidr, name := range w.cidrToNodeName {
+		if w.cidrToRouteClass[cidr] == RouteClassHost {
+			continue
+		}
+		pc := peers[name]
+		if pc == nil {
+			pc = &PeerCoverage{Name: name, FallThrough: map[CoverageReason]int{}}
+			peers[name] = pc
+		}
+		pc.CIDRs++
+		report.CIDRs++
+		if !report.Active {
+			pc.FallThrough[CoverageReasonInactive]++
+			report.FallThrough[CoverageReasonInactive]++
+			continue
+		}
+		if reason := w.fallThroughReason(name, cidr, tunneled[cidr], wireguardCIDRs); reason != "" {
+			pc.FallThrough[reason]++
+			report.FallThrough[reason]++
+			continue
+		}
+		pc.Tunneled++
+		report.Tunneled++
+	}
+
+	for _, pc := range peers {
+		report.Peers = append(report.Peers, *pc)
+	}
+	sort.Slice(report.Peers, func(i, j int) bool {
+		return report.Peers[i].Name < report.Peers[j].Name
+	})
+	if report.CIDRs > 0 {
+		report.Percent = 100 * float64(report.Tunneled) / float64(report.CIDRs)
+	}
+	return report
+}
+
+// fallThroughReason returns the reason that the traffic to a workload CIDR of a node falls through the wireguard
+// routing, or "" if the CIDR is tunneled, given whether the CIDR has an applied route to the wireguard interface. The
+// CIDRs programmed in wireguard for each node, see wireguardCIDRs, are cached in wireguardCIDRs for the other CIDRs of
+// the node.
+func (w *Wireguard) fallThroughReason(
+	name string, cidr ip.CIDR, routed bool, wireguardCIDRs map[string]set.Set,
+) CoverageReason {
+	if _, pending := w.routesPendingWireguard[cidr]; pending {
+		return CoverageReasonPending
+	}
+	node := w.peers[name]
+	if node == nil || node.publicKey == zeroKey {
+		return CoverageReasonNoKey
+	} else if w.isExcludedCIDR(cidr) {
+		return CoverageReasonExcluded
+	}
+	switch w.peerEligibility(name, node) {
+	case peerEligible:
+	case peerIneligibleKeyConflict:
+		return CoverageReasonConflict
+	case peerIneligibleOptedOut:
+		return CoverageReasonExcluded
+	default:
+		return CoverageReasonNotRouted
+	}
+	programmed, ok := wireguardCIDRs[name]
+	if !ok {
+		programmed = w.wireguardCIDRs(node)
+		wireguardCIDRs[name] = programmed
+	}
+	if containsName(w.overLimitNodes, name) || !programmed.Contains(cidr) {
+		return CoverageReasonOverLimit
+	} else if !routed || !node.programmedInWireguard || !w.linkUsable || !w.inSyncRouteRule {
+		return CoverageReasonPending
+	}
+	return ""
+}
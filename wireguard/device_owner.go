@@ -0,0 +1,422 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+// DeviceOwner coordinates the IPv4 and IPv6 Wireguard instances that share a single wireguard device on a dual-stack
+// node. A DeviceOwner is created once and passed to both instances. It owns the settings of the device: the interface
+// name, listening port, firewall mark and MTU of its configuration are used by both instances, whatever their own
+// configuration. It also owns the private key, which is generated once for the device, so both instances publish the
+// same public key. The link is only deleted by the last enabled instance.
+//
+// Each instance manages its own routing rules, routing tables and interface addresses. The peers are shared: each
+// instance programs the allowed IPs of its own IP version, and these are merged with the allowed IPs of the other IP
+// version into a single configuration of each peer, which is applied atomically. A peer is removed from the device once
+// neither instance requires it. The endpoint of a peer is taken from the IPv4 instance if it configures the peer, so
+// that the instances do not overwrite each other's endpoint.
+type DeviceOwner struct {
+	interfaceName      string
+	listeningPort      int
+	firewallMark       int
+	mtu                int
+	newWireguardDevice func() (netlinkshim.Wireguard, error)
+	logCxt             *logrus.Entry
+
+	// The lock serializes all access to the device through the shared wireguard client, so that the configuration of
+	// each peer is merged from the latest device state.
+	lock     sync.Mutex
+	client   netlinkshim.Wireguard
+	families map[uint8]*deviceFamily
+}
+
+// deviceFamily is the state of the instance for one IP version.
+type deviceFamily struct {
+	enabled bool
+
+	// The peers configured by the instance, and the endpoint the instance configured for each peer.
+	peers map[wgtypes.Key]*net.UDPAddr
+}
+
+// NewDeviceOwner creates a DeviceOwner for the device in the supplied configuration. Only the device settings of the
+// configuration are used.
+func NewDeviceOwner(config *Config, newWireguardDevice func() (netlinkshim.Wireguard, error)) *DeviceOwner {
+	return &DeviceOwner{
+		interfaceName:      config.InterfaceName,
+		listeningPort:      config.ListeningPort,
+		firewallMark:       config.FirewallMark,
+		mtu:                config.MTU,
+		newWireguardDevice: newWireguardDevice,
+		logCxt:             newLogger(config).WithField("wgIfaceName", config.InterfaceName),
+		families:           map[uint8]*deviceFamily{},
+	}
+}
+
+// deviceConfig returns a copy of the configuration with the device settings of the owner.
+func (o *DeviceOwner) deviceConfig(config *Config) *Config {
+	deviceConfig := *config
+	deviceConfig.InterfaceName = o.interfaceName
+	deviceConfig.ListeningPort = o.listeningPort
+	deviceConfig.FirewallMark = o.firewallMark
+	deviceConfig.MTU = o.mtu
+	return &deviceConfig
+}
+
+// register registers the instance for an IP version.
+func (o *DeviceOwner) register(ipVersion uint8, enabled bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.families[ipVersion] = &deviceFamily{
+		enabled: enabled,
+		peers:   map[wgtypes.Key]*net.UDPAddr{},
+	}
+}
+
+// release records that the instance for an IP version no longer uses the device, e.g. because it is being torn down.
+func (o *DeviceOwner) release(ipVersion uint8) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if family, ok := o.families[ipVersion]; ok {
+		family.enabled = false
+		family.peers = map[wgtypes.Key]*net.UDPAddr{}
+	}
+}
+
+// enable records that the instance for an IP version uses the device again, once wireguard is enabled on this node by
+// the node override, see Wireguard.SetNodeOverrideEnabled.
+func (o *DeviceOwner) enable(ipVersion uint8) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if family, ok := o.families[ipVersion]; ok {
+		family.enabled = true
+	}
+}
+
+// linkInUse returns true if the link is used by the enabled instance of another IP version, in which case the link
+// must not be deleted.
+func (o *DeviceOwner) linkInUse(ipVersion uint8) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for version, family := range o.families {
+		if version != ipVersion && family.enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// newClient returns a wireguard client for the instance of an IP version. The clients of both instances share the
+// wireguard client of the owner, which is opened if necessary.
+func (o *DeviceOwner) newClient(ipVersion uint8) (netlinkshim.Wireguard, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, err := o.getClient(); err != nil {
+		return nil, err
+	}
+	return &deviceOwnerClient{owner: o, ipVersion: ipVersion}, nil
+}
+
+// getClient returns the shared wireguard client, opening it if necessary. The lock must be held.
+func (o *DeviceOwner) getClient() (netlinkshim.Wireguard, error) {
+	if o.client == nil {
+		client, err := o.newWireguardDevice()
+		if err != nil {
+			return nil, err
+		}
+		o.client = client
+	}
+	return o.client, nil
+}
+
+// closeClient closes the shared wireguard client, it is opened again when next used. The lock must be held.
+func (o *DeviceOwner) closeClient() error {
+	if o.client == nil {
+		return nil
+	}
+	err := o.client.Close()
+	o.client = nil
+	return err
+}
+
+// claimedByOther returns true if the peer is configured by the instance of another IP version. The lock must be held.
+func (o *DeviceOwner) claimedByOther(ipVersion uint8, key wgtypes.Key) bool {
+	for version, family := range o.families {
+		if _, ok := family.peers[key]; ok && version != ipVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointOwner returns the IP version of the instance whose endpoint is used for the peer, i.e. the lowest IP version
+// that configured an endpoint for the peer, or 0 if there is none. The lock must be held.
+func (o *DeviceOwner) endpointOwner(key wgtypes.Key) uint8 {
+	var owner uint8
+	for version, family := range o.families {
+		if endpoint := family.peers[key]; endpoint != nil && (owner == 0 || version < owner) {
+			owner = version
+		}
+	}
+	return owner
+}
+
+// endpoint returns the endpoint of the peer configured by the endpoint owner, or nil if there is none. The lock must
+// be held.
+func (o *DeviceOwner) endpoint(key wgtypes.Key) *net.UDPAddr {
+	if owner := o.endpointOwner(key); owner != 0 {
+		return o.families[owner].peers[key]
+	}
+	return nil
+}
+
+// ensurePrivateKey generates the private key of the device if it does not have one, returning the device
+// configuration with the key. The key is only generated while one of the instances is enabled. The lock must be held.
+func (o *DeviceOwner) ensurePrivateKey(client netlinkshim.Wireguard, device *wgtypes.Device) (*wgtypes.Device, error) {
+	if device.PrivateKey != zeroKey && device.PublicKey != zeroKey {
+		return device, nil
+	}
+	enabled := false
+	for _, family := range o.families {
+		enabled = enabled || family.enabled
+	}
+	if !enabled {
+		return device, nil
+	}
+
+	o.logCxt.Info("Generate new private/public keypair for the shared wireguard device")
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.ConfigureDevice(o.interfaceName, wgtypes.Config{PrivateKey: &privateKey}); err != nil {
+		return nil, err
+	}
+	return client.DeviceByName(o.interfaceName)
+}
+
+// deviceOwnerClient is the wireguard client of the instance of one IP version. It presents the device as if it were
+// only used by that instance: the peers only have the allowed IPs of the IP version, and the peers only configured by
+// the other instance are hidden. The configuration applied by the instance is merged with the configuration of the
+// other instance.
+type deviceOwnerClient struct {
+	owner     *DeviceOwner
+	ipVersion uint8
+}
+
+func (c *deviceOwnerClient) Close() error {
+	c.owner.lock.Lock()
+	defer c.owner.lock.Unlock()
+	return c.owner.closeClient()
+}
+
+func (c *deviceOwnerClient) DeviceByName(name string) (*wgtypes.Device, error) {
+	o := c.owner
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	device, err := client.DeviceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if device, err = o.ensurePrivateKey(client, device); err != nil {
+		return nil, err
+	}
+
+	family := o.families[c.ipVersion]
+	view := *device
+	view.Peers = nil
+	for _, peer := range device.Peers {
+		ours, others := splitAllowedIPs(peer.AllowedIPs, c.ipVersion)
+		endpoint, claimed := family.peers[peer.PublicKey]
+		if !claimed && len(ours) == 0 && (len(others) > 0 || o.claimedByOther(c.ipVersion, peer.PublicKey)) {
+			// The peer is only used by the other instance.
+			continue
+		}
+		peer.AllowedIPs = ours
+		if claimed && endpoint != nil && o.endpointOwner(peer.PublicKey) != c.ipVersion {
+			// The endpoint of the other instance is used, report the endpoint this instance configured so that it
+			// does not keep updating the endpoint.
+			peer.Endpoint = endpoint
+		}
+		view.Peers = append(view.Peers, peer)
+	}
+	return &view, nil
+}
+
+func (c *deviceOwnerClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	o := c.owner
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	client, err := o.getClient()
+	if err != nil {
+		return err
+	}
+	device, err := client.DeviceByName(name)
+	if err != nil {
+		return err
+	}
+	devicePeers := map[wgtypes.Key]wgtypes.Peer{}
+	for _, peer := range device.Peers {
+		devicePeers[peer.PublicKey] = peer
+	}
+
+	// The private key is owned by the DeviceOwner, and the listening port and firewall mark are always those of the
+	// owner.
+	merged := wgtypes.Config{ReplacePeers: cfg.ReplacePeers}
+	if cfg.ListenPort != nil {
+		merged.ListenPort = &o.listeningPort
+	}
+	if cfg.FirewallMark != nil {
+		merged.FirewallMark = &o.firewallMark
+	}
+
+	family := o.families[c.ipVersion]
+	updated := map[wgtypes.Key]bool{}
+	for _, peerCfg := range cfg.Peers {
+		updated[peerCfg.PublicKey] = true
+	}
+	if cfg.ReplacePeers {
+		// The peers of this instance are replaced, so the peers that are still used by the other instance are
+		// configured again with their current configuration.
+		family.peers = map[wgtypes.Key]*net.UDPAddr{}
+		for _, peer := range device.Peers {
+			_, others := splitAllowedIPs(peer.AllowedIPs, c.ipVersion)
+			if updated[peer.PublicKey] || (len(others) == 0 && !o.claimedByOther(c.ipVersion, peer.PublicKey)) {
+				continue
+			}
+			keepalive := peer.PersistentKeepaliveInterval
+			retained := wgtypes.PeerConfig{
+				PublicKey:                   peer.PublicKey,
+				Endpoint:                    peer.Endpoint,
+				PersistentKeepaliveInterval: &keepalive,
+				ReplaceAllowedIPs:           true,
+				AllowedIPs:                  others,
+			}
+			if peer.PresharedKey != zeroKey {
+				presharedKey := peer.PresharedKey
+				retained.PresharedKey = &presharedKey
+			}
+			merged.Peers = append(merged.Peers, retained)
+		}
+	}
+
+	for _, peerCfg := range cfg.Peers {
+		devicePeer, exists := devicePeers[peerCfg.PublicKey]
+		ours, others := splitAllowedIPs(devicePeer.AllowedIPs, c.ipVersion)
+		if cfg.ReplacePeers {
+			// The peer is recreated.
+			exists = false
+			ours = nil
+		}
+
+		if peerCfg.Remove {
+			delete(family.peers, peerCfg.PublicKey)
+			if !exists {
+				continue
+			} else if len(others) == 0 && !o.claimedByOther(c.ipVersion, peerCfg.PublicKey) {
+				merged.Peers = append(merged.Peers, peerCfg)
+				continue
+			}
+			// The peer is still used by the other instance, so only remove our allowed IPs.
+			o.logCxt.WithField("ipVersion", c.ipVersion).Debugf(
+				"Peer %v is still used by the other IP version, removing the allowed IPs only", peerCfg.PublicKey)
+			peer := wgtypes.PeerConfig{
+				PublicKey:         peerCfg.PublicKey,
+				UpdateOnly:        true,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        others,
+			}
+			if endpoint := o.endpoint(peerCfg.PublicKey); !endpointsEqual(endpoint, devicePeer.Endpoint) {
+				peer.Endpoint = endpoint
+			}
+			merged.Peers = append(merged.Peers, peer)
+			continue
+		} else if peerCfg.UpdateOnly && !exists {
+			// The kernel ignores updates of peers that do not exist.
+			continue
+		}
+
+		if peerCfg.ReplaceAllowedIPs {
+			ours = nil
+		}
+		ours, _ = splitAllowedIPs(append(ours, peerCfg.AllowedIPs...), c.ipVersion)
+		if peerCfg.Endpoint != nil {
+			family.peers[peerCfg.PublicKey] = peerCfg.Endpoint
+		} else if _, ok := family.peers[peerCfg.PublicKey]; !ok {
+			family.peers[peerCfg.PublicKey] = nil
+		}
+
+		peer := peerCfg
+		peer.ReplaceAllowedIPs = true
+		peer.AllowedIPs = append(ours, others...)
+		if peerCfg.Endpoint != nil || !exists {
+			// Only the endpoint of the endpoint owner is configured.
+			peer.Endpoint = o.endpoint(peerCfg.PublicKey)
+			if exists && endpointsEqual(peer.Endpoint, devicePeer.Endpoint) {
+				peer.Endpoint = nil
+			}
+		}
+		merged.Peers = append(merged.Peers, peer)
+	}
+
+	if !merged.ReplacePeers && len(merged.Peers) == 0 && merged.ListenPort == nil && merged.FirewallMark == nil {
+		// Nothing to configure, e.g. the update only set the private key.
+		return nil
+	}
+	return client.ConfigureDevice(name, merged)
+}
+
+// splitAllowedIPs splits the allowed IPs into those of the IP version and those of the other IP version. The allowed
+// IPs of the IP version are de-duplicated and sorted.
+func splitAllowedIPs(allowedIPs []net.IPNet, ipVersion uint8) (ours, others []net.IPNet) {
+	seen := map[ip.CIDR]bool{}
+	for _, ipNet := range allowedIPs {
+		version := uint8(6)
+		if ipNet.IP.To4() != nil {
+			version = 4
+		}
+		if version != ipVersion {
+			others = append(others, ipNet)
+		} else if cidr := ip.CIDRFromIPNet(&ipNet); !seen[cidr] {
+			seen[cidr] = true
+			ours = append(ours, ipNet)
+		}
+	}
+	sort.Slice(ours, func(i, j int) bool { return ours[i].String() < ours[j].String() })
+	return ours, others
+}
+
+// endpointsEqual returns true if the endpoints are the same address and port.
+func endpointsEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
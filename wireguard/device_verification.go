@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+var counterDeviceRepairedAfterUp = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "felix_wireguard_device_repaired_after_up",
+	Help: "Number of times the wireguard device was found to have lost its configuration when the interface came up.",
+})
+
+func init() {
+	prometheus.MustRegister(counterDeviceRepairedAfterUp)
+}
+
+// verifyDeviceAfterUp checks the configuration of the wireguard device once the interface has been reported up, e.g.
+// after a suspend and resume of the node. The resume scripts may clear the key and the peers of the device without the
+// interface going down, or the link being recreated, so neither the interface state nor the link index show that the
+// device needs reprogramming. This reads the device once, and if the key, listening port, firewall mark or any of the
+// programmed peers are missing, the device is resynced by this Apply.
+//
+// If the key has been cleared the intended key is restored first, so that the resync does not generate a new key and
+// the peers are not left with our previous key until the new key has propagated.
+func (w *Wireguard) verifyDeviceAfterUp(ctx context.Context) {
+	if !w.deviceVerificationDue {
+		return
+	}
+	w.deviceVerificationDue = false
+	if !w.inSyncWireguard {
+		// The device is resynced by this Apply anyway.
+		return
+	}
+	if err := w.checkContext(ctx, "verify device"); err != nil {
+		// The device is verified by the resync instead.
+		w.inSyncWireguard = false
+		return
+	}
+	wireguardClient, err := w.getWireguardClient()
+	if err != nil {
+		w.logCxt.WithError(err).Info("Unable to verify the wireguard device after the interface came up, resyncing")
+		w.inSyncWireguard = false
+		return
+	}
+	device, err := netlinkshim.WireguardWithContext(ctx, wireguardClient).DeviceByName(w.config.InterfaceName)
+	if err != nil {
+		w.logCxt.WithError(err).Info("Unable to read the wireguard device after the interface came up, resyncing")
+		w.inSyncWireguard = false
+		return
+	}
+
+	problems := w.deviceConfigProblems(device)
+	if len(problems) == 0 {
+		w.logCxt.Debug("Wireguard device configuration intact after the interface came up")
+		return
+	}
+	w.logCxt.WithField("problems", problems).Warning(
+		"Wireguard device lost its configuration while the interface was up, reprogramming the device")
+	counterDeviceRepairedAfterUp.Inc()
+	w.inSyncWireguard = false
+
+	if device.PrivateKey == zeroKey && w.intendedKey != nil {
+		w.logCxt.WithField("publicKey", w.intendedKey.publicKey).Info("Restoring the private key of the wireguard device")
+		privateKey := w.intendedKey.privateKey
+		if err := w.applyWireguardConfig(wireguardClient, &wgtypes.Config{PrivateKey: &privateKey}); err != nil {
+			// The resync generates a new key instead.
+			w.logCxt.WithError(err).Warning("Failed to restore the private key of the wireguard device")
+		}
+	}
+}
+
+// deviceConfigProblems returns the parts of the configuration that the device has lost: our key, the listening port,
+// the firewall mark, and the peers that were programmed by a previous Apply. Peers are only checked for presence, their
+// allowed IPs and endpoints are left to the resync.
+func (w *Wireguard) deviceConfigProblems(device *wgtypes.Device) []string {
+	var problems []string
+	if device.PrivateKey == zeroKey {
+		problems = append(problems, "no private key")
+	} else if w.intendedKey != nil && device.PrivateKey.PublicKey() != w.intendedKey.publicKey {
+		problems = append(problems, "private key differs")
+	}
+	if device.ListenPort != w.config.ListeningPort {
+		problems = append(problems, "listening port differs")
+	}
+	if device.FirewallMark != w.config.FirewallMark {
+		problems = append(problems, "firewall mark differs")
+	}
+
+	devicePeers := make(map[wgtypes.Key]bool, len(device.Peers))
+	for i := range device.Peers {
+		devicePeers[device.Peers[i].PublicKey] = true
+	}
+	missing := 0
+	for _, node := range w.peers {
+		if node.programmedInWireguard && !devicePeers[node.publicKey] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		w.logCxt.WithFields(logrus.Fields{"missingPeers": missing, "devicePeers": len(device.Peers)}).Debug(
+			"Wireguard device is missing programmed peers")
+		problems = append(problems, "peers missing")
+	}
+	return problems
+}
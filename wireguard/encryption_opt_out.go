@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// EndpointWireguardOptOut sets whether our traffic to a node is excluded from encryption by policy, e.g. because the
+// traffic to the nodes of a federated cluster must traverse an inspection path unencrypted. A node that is opted out is
+// not programmed in wireguard even though it has a public key, and its CIDRs have throw routes exactly as if it had no
+// key. Its key is ignored when checking for nodes that claim the same key, so it does not remove the peer of another
+// node that shares its key. The opt-out is cleared when the wireguard configuration of the node, or the node itself,
+// is removed.
+func (w *Wireguard) EndpointWireguardOptOut(name string, optOut bool) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() {
+		w.endpointWireguardOptOut(w.nodeName(name), optOut)
+	})
+}
+
+// OptedOutNodes returns the sorted names of the nodes whose traffic is excluded from encryption by policy, see
+// EndpointWireguardOptOut. This may be called from any goroutine.
+func (w *Wireguard) OptedOutNodes() []string {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return append([]string(nil), w.optedOutNodesSnapshot...)
+}
+
+func (w *Wireguard) endpointWireguardOptOut(name string, optOut bool) {
+	w.logCxt.Debugf("EndpointWireguardOptOut: name=%s; optOut=%v", name, optOut)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.logCxt.Debug("Ignoring opt-out of the local node")
+		return
+	} else if w.optedOutNodes.Contains(name) == optOut {
+		w.logCxt.Debug("Opt-out state unchanged")
+		return
+	}
+
+	if optOut {
+		w.logCxt.Infof("Traffic to node %s is excluded from encryption by policy", name)
+		w.optedOutNodes.Add(name)
+	} else {
+		w.logCxt.Infof("Traffic to node %s is no longer excluded from encryption by policy", name)
+		w.optedOutNodes.Discard(name)
+	}
+	w.updateOptedOutNodesSnapshot()
+	w.updatePeerStatus(name)
+}
+
+// clearOptOut clears the opt-out of a node whose wireguard configuration has been removed.
+func (w *Wireguard) clearOptOut(name string) {
+	if w.optedOutNodes.Contains(name) {
+		w.optedOutNodes.Discard(name)
+		w.updateOptedOutNodesSnapshot()
+	}
+}
+
+// updateOptedOutNodesSnapshot updates the names of the opted out nodes returned by OptedOutNodes.
+func (w *Wireguard) updateOptedOutNodesSnapshot() {
+	names := make([]string, 0, w.optedOutNodes.Len())
+	w.optedOutNodes.Iter(func(item interface{}) error {
+		names = append(names, item.(string))
+		return nil
+	})
+	sort.Strings(names)
+
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.optedOutNodesSnapshot = names
+}
+
+// numKeyClaimants returns the number of nodes that claim a public key, other than the nodes that are opted out of
+// encryption, whose keys are never programmed.
+func (w *Wireguard) numKeyClaimants(key wgtypes.Key) int {
+	nodenames := w.publicKeyToNodeNames[key]
+	if nodenames == nil {
+		return 0
+	} else if w.optedOutNodes.Len() == 0 {
+		return nodenames.Len()
+	}
+	n := 0
+	nodenames.Iter(func(item interface{}) error {
+		if !w.optedOutNodes.Contains(item) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+// endpointFailover tracks whether a peer with a secondary address can be reached through its current endpoint, see
+// Config.EndpointFailoverTimeout.
+type endpointFailover struct {
+	// Whether the peer is reached through its secondary address, the time the current endpoint was programmed, and
+	// whether there has been a handshake through the current endpoint since.
+	usingSecondary bool
+	programmedTime time.Time
+	handshake      bool
+
+	// The number of times the endpoint has been switched, reported by PeerDiagnostics.
+	numFailovers int
+}
+
+// EndpointSecondaryUpdate updates the secondary IPv4 address of a node, which is used as the endpoint of the peer if
+// there is no handshake through the primary address, see Config.EndpointFailoverTimeout. A nil address indicates the
+// node has no secondary address.
+func (w *Wireguard) EndpointSecondaryUpdate(name string, ipv4Addr ip.Addr) {
+	w.queueUpdate(PendingWorkSummary{Peers: true}, func() { w.endpointSecondaryUpdate(w.nodeName(name), ipv4Addr) })
+}
+
+// FailoverCheckAfter returns the time until the endpoint of a peer with a secondary address is next checked for a
+// handshake, or zero if no check is scheduled. Apply must be called after this time for the endpoint to fail over.
+// This must be called from the same goroutine as Apply.
+func (w *Wireguard) FailoverCheckAfter() time.Duration {
+	if w.tornDown || w.config.EndpointFailoverTimeout <= 0 {
+		return 0
+	}
+	var checkAfter time.Duration
+	for _, st := range w.endpointFailovers {
+		if st.handshake {
+			continue
+		}
+		after := w.config.EndpointFailoverTimeout - w.time.Since(st.programmedTime)
+		if after <= 0 {
+			// The check is already due.
+			return time.Millisecond
+		}
+		if checkAfter == 0 || after < checkAfter {
+			checkAfter = after
+		}
+	}
+	return checkAfter
+}
+
+// failoverCheckDue returns true if a monitored peer has had no handshake through its current endpoint within
+// Config.EndpointFailoverTimeout.
+func (w *Wireguard) failoverCheckDue() bool {
+	for _, st := range w.endpointFailovers {
+		if !st.handshake && w.time.Since(st.programmedTime) >= w.config.EndpointFailoverTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Wireguard) endpointSecondaryUpdate(name string, ipv4Addr ip.Addr) {
+	w.logCxt.Debugf("EndpointSecondaryUpdate: name=%s; ipv4Addr=%v", name, ipv4Addr)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.logCxt.Debug("Local update - ignoring")
+		return
+	} else if w.nodeNameToSecondaryAddr[name] == ipv4Addr {
+		w.logCxt.Debug("Secondary address unchanged")
+		return
+	}
+
+	if ipv4Addr == nil {
+		delete(w.nodeNameToSecondaryAddr, name)
+	} else {
+		w.nodeNameToSecondaryAddr[name] = ipv4Addr
+	}
+
+	// Start monitoring again from the primary address, which must be reprogrammed if the secondary address is in use.
+	if st := w.endpointFailovers[name]; st != nil {
+		delete(w.endpointFailovers, name)
+		if st.usingSecondary {
+			w.logCxt.WithField("node", name).Info("Secondary address updated, reverting the endpoint to the primary address")
+			w.reprogramPeerEndpoint(name)
+		}
+	}
+}
+
+// peerEndpointAddr returns the address of the current endpoint of a peer, which is the secondary address of the node
+// after a failover, and the primary address otherwise.
+func (w *Wireguard) peerEndpointAddr(name string, node *peerData) ip.Addr {
+	if st := w.endpointFailovers[name]; st != nil && st.usingSecondary {
+		if secondary := w.nodeNameToSecondaryAddr[name]; secondary != nil {
+			return secondary
+		}
+	}
+	return node.ipv4EndpointAddr
+}
+
+// reprogramPeerEndpoint flags the endpoint of a programmed peer to be reprogrammed by the next delta update.
+func (w *Wireguard) reprogramPeerEndpoint(name string) {
+	node := w.peers[name]
+	if node == nil || !node.programmedInWireguard {
+		return
+	}
+	update := w.getOrInitPeerUpdate(name)
+	if update.ipv4EndpointAddr == nil {
+		addr := node.ipv4EndpointAddr
+		update.ipv4EndpointAddr = &addr
+	}
+	w.setPeerUpdate(name, update)
+}
+
+// trackEndpointFailovers starts monitoring the handshakes of the newly programmed peers that have a secondary address,
+// and stops monitoring the peers that are no longer programmed.
+func (w *Wireguard) trackEndpointFailovers() {
+	if w.config.EndpointFailoverTimeout <= 0 {
+		return
+	}
+	for name := range w.endpointFailovers {
+		if node := w.peers[name]; node == nil || !node.programmedInWireguard {
+			delete(w.endpointFailovers, name)
+		}
+	}
+	for name := range w.nodeNameToSecondaryAddr {
+		node := w.peers[name]
+		if node == nil || !node.programmedInWireguard || node.ipv4EndpointAddr == nil || w.endpointFailovers[name] != nil {
+			continue
+		}
+		w.logCxt.WithField("node", name).Debug("Monitoring handshakes through the primary address")
+		w.endpointFailovers[name] = &endpointFailover{programmedTime: w.time.Now()}
+	}
+}
+
+// checkEndpointFailovers switches the endpoint of each monitored peer that has had no handshake through its current
+// endpoint within Config.EndpointFailoverTimeout, alternating between the primary and the secondary address until
+// there is a handshake. The switched endpoints are programmed by this Apply. The device is only read if a check is due.
+func (w *Wireguard) checkEndpointFailovers(ctx context.Context) {
+	if !w.failoverCheckDue() {
+		return
+	}
+	wireguardClient, err := w.getWireguardClient()
+	if err != nil {
+		w.logCxt.WithError(err).Info("Wireguard client is not available, unable to check the peer handshakes")
+		return
+	}
+	device, err := netlinkshim.WireguardWithContext(ctx, wireguardClient).DeviceByName(w.config.InterfaceName)
+	if err != nil {
+		w.logCxt.WithError(err).Info("Unable to query the wireguard device, unable to check the peer handshakes")
+		w.closeWireguardClient()
+		return
+	}
+	devicePeers := make(map[wgtypes.Key]*wgtypes.Peer, len(device.Peers))
+	for peerIdx := range device.Peers {
+		devicePeers[device.Peers[peerIdx].PublicKey] = &device.Peers[peerIdx]
+	}
+
+	now := w.time.Now()
+	for name, st := range w.endpointFailovers {
+		if st.handshake || now.Sub(st.programmedTime) < w.config.EndpointFailoverTimeout {
+			continue
+		}
+		node := w.peers[name]
+		logCxt := w.logCxt.WithFields(logrus.Fields{"node": name, "endpoint": w.peerEndpointAddr(name, node)})
+		if devicePeer := devicePeers[node.publicKey]; devicePeer != nil &&
+			devicePeer.LastHandshakeTime.After(st.programmedTime) {
+			logCxt.Info("Handshake with the peer through the current endpoint")
+			st.handshake = true
+			continue
+		}
+
+		st.usingSecondary = !st.usingSecondary
+		st.programmedTime = now
+		st.numFailovers++
+		logCxt.WithFields(logrus.Fields{
+			"timeout":      w.config.EndpointFailoverTimeout,
+			"newEndpoint":  w.peerEndpointAddr(name, node),
+			"numFailovers": st.numFailovers,
+		}).Warning("No handshake with the peer through the current endpoint, switching to the other address of the node")
+		w.reprogramPeerEndpoint(name)
+	}
+	w.refreshDeviceStats(device)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthSnapshot is a snapshot of the progress of the Apply processing, see Wireguard.HealthSnapshot. The times are
+// those of the time shim of the module. This allows a stalled Apply to be detected, e.g. one that is blocked in the
+// status callback, even while the rest of the dataplane is making progress.
+type HealthSnapshot struct {
+	// Time is the time the snapshot was taken.
+	Time time.Time
+
+	// The start and end of the last Apply, and whether an Apply is in progress. The times are zero until the first
+	// Apply.
+	LastApplyStart  time.Time
+	LastApplyEnd    time.Time
+	ApplyInProgress bool
+
+	// The start and end of the last invocation of the status callback, whether the callback is in progress, and the
+	// longest duration of a completed invocation.
+	LastStatusCallbackStart  time.Time
+	LastStatusCallbackEnd    time.Time
+	StatusCallbackInProgress bool
+	LongestStatusCallback    time.Duration
+
+	// PendingSince is the time the oldest of the updates queued for the next Apply was queued, or zero if there are no
+	// queued updates.
+	PendingSince time.Time
+}
+
+// Stalled returns an error describing the stall if an Apply has been in progress for longer than the timeout, or if
+// updates have been queued for longer than the timeout without an Apply. The updates queued before the first Apply are
+// not checked, since the dataplane does not apply the updates until the datastore is in sync.
+func (s HealthSnapshot) Stalled(timeout time.Duration) error {
+	if s.ApplyInProgress {
+		if d := s.Time.Sub(s.LastApplyStart); d > timeout {
+			if s.StatusCallbackInProgress {
+				return fmt.Errorf("apply has been in progress for %v, blocked in the status callback for %v",
+					d, s.Time.Sub(s.LastStatusCallbackStart))
+			}
+			return fmt.Errorf("apply has been in progress for %v", d)
+		}
+		return nil
+	}
+	if !s.LastApplyStart.IsZero() && !s.PendingSince.IsZero() {
+		if d := s.Time.Sub(s.PendingSince); d > timeout {
+			return fmt.Errorf("updates have been pending for %v without an apply", d)
+		}
+	}
+	return nil
+}
+
+// HealthSnapshot returns a snapshot of the progress of the Apply processing. This may be called from any goroutine,
+// including while an Apply is in progress.
+func (w *Wireguard) HealthSnapshot() HealthSnapshot {
+	w.queuedUpdatesLock.Lock()
+	pendingSince := w.queuedSince
+	w.queuedUpdatesLock.Unlock()
+
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	snapshot := w.health
+	snapshot.Time = w.time.Now()
+	snapshot.PendingSince = pendingSince
+	return snapshot
+}
+
+// recordApplyStart records the start of an Apply, returning a function that records its end.
+func (w *Wireguard) recordApplyStart() func() {
+	w.healthLock.Lock()
+	w.health.LastApplyStart = w.time.Now()
+	w.health.ApplyInProgress = true
+	w.healthLock.Unlock()
+
+	return func() {
+		w.healthLock.Lock()
+		defer w.healthLock.Unlock()
+		w.health.LastApplyEnd = w.time.Now()
+		w.health.ApplyInProgress = false
+	}
+}
+
+// invokeStatusCallback invokes the status callback, recording the start and end of the invocation.
+func (w *Wireguard) invokeStatusCallback(update StatusUpdate) error {
+	w.healthLock.Lock()
+	start := w.time.Now()
+	w.health.LastStatusCallbackStart = start
+	w.health.StatusCallbackInProgress = true
+	w.healthLock.Unlock()
+
+	defer func() {
+		w.healthLock.Lock()
+		defer w.healthLock.Unlock()
+		end := w.time.Now()
+		w.health.LastStatusCallbackEnd = end
+		w.health.StatusCallbackInProgress = false
+		if d := end.Sub(start); d > w.health.LongestStatusCallback {
+			w.health.LongestStatusCallback = d
+		}
+	}()
+	update.EnabledSource = w.enabledSource
+	return w.statusCallback(update)
+}
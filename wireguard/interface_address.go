@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// DeriveInterfaceAddr returns the address in the pool derived from a hash of the hostname, or nil if the pool is not an
+// IPv4 pool. This is the interface address used by InterfaceAddressSourceDerived, and is the same for a hostname
+// wherever it is computed. The network and broadcast addresses of the pool are not used, unless the pool is too small
+// to exclude them.
+func DeriveInterfaceAddr(pool ip.CIDR, hostname string) ip.Addr {
+	v4Pool, ok := pool.(ip.V4CIDR)
+	if !ok {
+		return nil
+	}
+	hostBits := 32 - uint(v4Pool.Prefix())
+	if hostBits == 0 {
+		return v4Pool.Addr()
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(hostname))
+	sum := hash.Sum64()
+
+	var offset uint64
+	if hostBits == 1 {
+		offset = sum & 1
+	} else {
+		offset = 1 + sum%(uint64(1)<<hostBits-2)
+	}
+
+	var addr ip.V4Addr
+	binary.BigEndian.PutUint32(addr[:], v4Pool.Addr().(ip.V4Addr).AsUint32()+uint32(offset))
+	return addr
+}
+
+// selectInterfaceAddr returns our interface address from the configured source, or nil if the source does not provide
+// an address.
+func (w *Wireguard) selectInterfaceAddr() ip.Addr {
+	switch w.interfaceAddrSource {
+	case InterfaceAddressSourceNodeIP:
+		return w.ourIPv4EndpointAddr
+	case InterfaceAddressSourceDerived:
+		return DeriveInterfaceAddr(w.interfaceAddrPool, w.hostname)
+	default:
+		return w.datastoreIPv4InterfaceAddr
+	}
+}
+
+// publishedInterfaceAddr returns the interface address published with our public key. This is nil if the address is
+// from the datastore, in which case the address in the datastore is left unchanged.
+func (w *Wireguard) publishedInterfaceAddr() ip.Addr {
+	switch w.interfaceAddrSource {
+	case InterfaceAddressSourceNodeIP, InterfaceAddressSourceDerived:
+		return w.ourIPv4InterfaceAddr
+	default:
+		return nil
+	}
+}
+
+// updateOurInterfaceAddr selects our interface address from the configured source. The address on the wireguard link is
+// reconciled on every Apply. If the published address has changed our status is published again.
+func (w *Wireguard) updateOurInterfaceAddr() {
+	addr := w.selectInterfaceAddr()
+	if addr == w.ourIPv4InterfaceAddr {
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"source":  w.interfaceAddrSource,
+		"oldAddr": w.ourIPv4InterfaceAddr,
+		"newAddr": addr,
+	}).Info("Local interface address updated")
+	w.ourIPv4InterfaceAddr = addr
+	if w.publishedInterfaceAddr() != nil {
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
+	}
+}
+
+// updateInterfaceAddressSource updates the source of our interface address. The address from the previous source is
+// removed from the wireguard link by the next Apply.
+func (w *Wireguard) updateInterfaceAddressSource(source InterfaceAddressSource, pool ip.CIDR) {
+	w.logCxt.Debugf("UpdateConfig: interfaceAddressSource=%s; interfaceAddressPool=%v", source, pool)
+	if source == w.interfaceAddrSource && pool == w.interfaceAddrPool {
+		return
+	}
+	w.interfaceAddrSource = source
+	w.interfaceAddrPool = pool
+	if source == InterfaceAddressSourceDerived && DeriveInterfaceAddr(pool, w.hostname) == nil {
+		w.logCxt.WithField("pool", pool).Warning("No IPv4 interface address pool, the interface address cannot be derived")
+	}
+	w.updateOurInterfaceAddr()
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// CheckInvariants checks the internal consistency of the cached peer configuration, the pending updates and the
+// expected routes, returning an error describing the first inconsistency found. The routes are only checked when there
+// are no pending peer updates, i.e. after an Apply has processed them.
+//
+// This is intended for tests, and must be called from the same goroutine as Apply.
+func (w *Wireguard) CheckInvariants() error {
+	if err := w.checkPeerInvariants(); err != nil {
+		return err
+	}
+	if err := w.checkPendingUpdateInvariants(); err != nil {
+		return err
+	}
+	if len(w.peerUpdates) == 0 {
+		if err := w.checkCIDRSourceInvariants(); err != nil {
+			return err
+		}
+		if err := w.checkNoEmptyPeers(); err != nil {
+			return err
+		}
+		if err := w.checkKeyTransitionInvariants(); err != nil {
+			return err
+		}
+		if err := w.checkCapacityStatsInvariants(); err != nil {
+			return err
+		}
+		return w.checkRouteInvariants()
+	}
+	return nil
+}
+
+// checkPeerInvariants checks that each allowed CIDR maps to exactly one peer, and that the public key mappings match the
+// peer data.
+func (w *Wireguard) checkPeerInvariants() error {
+	for name, peer := range w.peers {
+		if name == w.hostname {
+			return fmt.Errorf("local node %s is a peer", name)
+		}
+		if peer.publicKey == zeroKey {
+			if peer.programmedInWireguard {
+				return fmt.Errorf("peer %s has no public key but is programmed in wireguard", name)
+			}
+		} else if nodenames := w.publicKeyToNodeNames[peer.publicKey]; nodenames == nil || !nodenames.Contains(name) {
+			return fmt.Errorf("peer %s is not associated with its public key %s", name, peer.publicKey)
+		}
+
+		var err error
+		peer.cidrs.Iter(func(item interface{}) error {
+			cidr := item.(ip.CIDR)
+			if owner, ok := w.cidrToNodeName[cidr]; !ok || owner != name {
+				err = fmt.Errorf("allowed CIDR %s of peer %s is associated with node %q", cidr, name, owner)
+				return set.StopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for cidr, name := range w.cidrToNodeName {
+		if peer := w.peers[name]; peer == nil || !peer.cidrs.Contains(cidr) {
+			return fmt.Errorf("CIDR %s is associated with node %s which does not have it as an allowed CIDR", cidr, name)
+		}
+	}
+
+	for key, nodenames := range w.publicKeyToNodeNames {
+		if key == zeroKey {
+			return fmt.Errorf("zero public key is associated with nodes %v", nodenames)
+		} else if nodenames.Len() == 0 {
+			return fmt.Errorf("public key %s is not associated with any nodes", key)
+		}
+		var err error
+		nodenames.Iter(func(item interface{}) error {
+			name := item.(string)
+			if peer := w.peers[name]; peer == nil || peer.publicKey != key {
+				err = fmt.Errorf("public key %s is associated with node %s which does not have that key", key, name)
+				return set.StopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkKeyTransitionInvariants checks that the peer of each previous key kept on the device is the peer of only one
+// node in a key transition, and that the key is not the key of a node, which takes precedence.
+func (w *Wireguard) checkKeyTransitionInvariants() error {
+	keptFor := map[wgtypes.Key]string{}
+	for name, t := range w.peerKeyTransitions {
+		if !t.programmed {
+			continue
+		} else if other, ok := keptFor[t.previousKey]; ok {
+			return fmt.Errorf("previous key %s is kept for nodes %s and %s", t.previousKey, other, name)
+		} else if nodenames := w.publicKeyToNodeNames[t.previousKey]; nodenames != nil {
+			return fmt.Errorf("previous key %s of node %s is the key of nodes %v", t.previousKey, name, nodenames)
+		}
+		keptFor[t.previousKey] = name
+	}
+	return nil
+}
+
+// checkPendingUpdateInvariants checks that the pending updates and the sources of the peer CIDRs only reference known
+// nodes, and are consistent with each other.
+func (w *Wireguard) checkPendingUpdateInvariants() error {
+	isKnown := func(name string) bool {
+		return name != w.hostname && (w.peers[name] != nil || w.peerUpdates[name] != nil)
+	}
+
+	for name, update := range w.peerUpdates {
+		if name == w.hostname {
+			return fmt.Errorf("pending update for the local node %s", name)
+		} else if update.deleted && w.peers[name] == nil {
+			return fmt.Errorf("pending deletion of node %s which is not a peer", name)
+		}
+		var err error
+		update.allowedCidrsAdded.Iter(func(item interface{}) error {
+			cidr := item.(ip.CIDR)
+			if owner := w.cidrToNodeNameUpdates[cidr]; owner != name {
+				err = fmt.Errorf("pending CIDR %s for node %s is associated with node %q", cidr, name, owner)
+				return set.StopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for cidr, name := range w.cidrToNodeNameUpdates {
+		update := w.peerUpdates[name]
+		if update == nil || !(update.allowedCidrsAdded.Contains(cidr) || update.allowedCidrsDeleted.Contains(cidr)) {
+			return fmt.Errorf("pending CIDR %s is associated with node %s which has no update for it", cidr, name)
+		}
+	}
+
+	for cidr, name := range w.allowedCIDRToNodeName {
+		if !isKnown(name) {
+			return fmt.Errorf("allowed CIDR %s is associated with unknown node %s", cidr, name)
+		}
+	}
+	for cidr, name := range w.interfaceCIDRToNodeName {
+		if ifaceCIDR, ok := w.nodeNameToInterfaceCIDR[name]; !ok || ifaceCIDR != cidr {
+			return fmt.Errorf("interface CIDR %s is associated with node %s which has interface CIDR %v", cidr, name, ifaceCIDR)
+		}
+	}
+	for name, cidr := range w.nodeNameToInterfaceCIDR {
+		if !isKnown(name) {
+			return fmt.Errorf("interface CIDR %s is associated with unknown node %s", cidr, name)
+		} else if owner := w.interfaceCIDRToNodeName[cidr]; owner != name {
+			return fmt.Errorf("interface CIDR %s of node %s is associated with node %q", cidr, name, owner)
+		}
+	}
+	return nil
+}
+
+// checkCIDRSourceInvariants checks that the allowed CIDRs of the peers match the sources of the CIDRs. The CIDRs added
+// through EndpointAllowedCIDRAdd take precedence over the interface addresses.
+// The CIDRs denied by the CIDR verifier must be attributed to a node.
+func (w *Wireguard) checkCIDRSourceInvariants() error {
+	for cidr, name := range w.allowedCIDRToNodeName {
+		if owner := w.cidrToNodeName[cidr]; owner != name {
+			return fmt.Errorf("allowed CIDR %s of node %s is associated with node %q", cidr, name, owner)
+		}
+	}
+	for cidr, name := range w.interfaceCIDRToNodeName {
+		if _, ok := w.allowedCIDRToNodeName[cidr]; ok {
+			continue
+		} else if owner := w.cidrToNodeName[cidr]; owner != name {
+			return fmt.Errorf("interface CIDR %s of node %s is associated with node %q", cidr, name, owner)
+		}
+	}
+	for cidr, name := range w.cidrToNodeName {
+		_, allowed := w.allowedCIDRToNodeName[cidr]
+		_, iface := w.interfaceCIDRToNodeName[cidr]
+		if !allowed && !iface {
+			return fmt.Errorf("CIDR %s of peer %s is neither an allowed CIDR nor an interface address", cidr, name)
+		}
+	}
+	var err error
+	w.deniedCIDRs.Iter(func(item interface{}) error {
+		if _, ok := w.cidrToRouteClass[item.(ip.CIDR)]; !ok {
+			err = fmt.Errorf("denied CIDR %s is not attributed to a node", item)
+			return set.StopIteration
+		}
+		return nil
+	})
+	return err
+}
+
+// checkNoEmptyPeers checks that the cache does not contain peers that have no configuration left.
+func (w *Wireguard) checkNoEmptyPeers() error {
+	for name, peer := range w.peers {
+		if _, ok := w.nodeNameToInterfaceCIDR[name]; !ok && peer.isEmpty() {
+			return fmt.Errorf("peer %s has no configuration", name)
+		}
+	}
+	return nil
+}
+
+// checkRouteInvariants checks that there is a single route for each allowed CIDR in the routing table for its route
+// class. CIDRs of wireguard capable peers are routed to the wireguard interface once the link is usable, and CIDRs of
+// other peers, or that exceed the maximum allowed IPs of a peer, have throw routes, as do the CIDRs of the local host
+// if Config.LocalCIDRsAsThrow is set. With NonWireguardPeerHandlingRuleExclude the CIDRs of the other peers have no
+// routes. It also checks the maximum number of peers is not exceeded.
+func (w *Wireguard) checkRouteInvariants() error {
+	routed := map[ip.CIDR]bool{}
+	for _, rt := range w.RouteTableSyncers() {
+		for _, ifaceName := range []string{w.config.InterfaceName, routetable.InterfaceNone} {
+			for cidr := range rt.Targets(ifaceName) {
+				name, ok := w.cidrToNodeName[cidr]
+				if tableIndex, local := w.localCIDRRoutes[cidr]; local {
+					// A throw route for a CIDR of the local host, which is not also routed for a peer.
+					if ok {
+						return fmt.Errorf("local CIDR %s is also routed for peer %s", cidr, name)
+					} else if ifaceName != routetable.InterfaceNone || rt.TableIndex() != tableIndex {
+						return fmt.Errorf("route for local CIDR %s is for interface %q in table %d, expected a throw "+
+							"route in table %d", cidr, ifaceName, rt.TableIndex(), tableIndex)
+					}
+				} else if w.catchAllThrowRoutes[cidr] {
+					// A throw route that escapes the catch-all route, which is not also routed for a peer.
+					if ok {
+						return fmt.Errorf("catch-all throw CIDR %s is also routed for peer %s", cidr, name)
+					} else if ifaceName != routetable.InterfaceNone || rt != w.catchAllRouteTable() {
+						return fmt.Errorf("route for catch-all throw CIDR %s is for interface %q in table %d, expected a "+
+							"throw route", cidr, ifaceName, rt.TableIndex())
+					}
+				} else if !ok {
+					return fmt.Errorf("route for %s in table %d is not for an allowed CIDR", cidr, rt.TableIndex())
+				} else if routed[cidr] {
+					return fmt.Errorf("multiple routes for %s", cidr)
+				} else if _, pending := w.routesPendingWireguard[cidr]; pending {
+					// The route to wireguard is held back, the previous route remains programmed until it is added.
+				} else if w.isExcludedByRule(name) {
+					return fmt.Errorf("route for %s of peer %s, which is excluded from wireguard by rule", cidr, name)
+				} else if tableIndex := w.tableIndexForCIDR(cidr); rt.TableIndex() != tableIndex {
+					return fmt.Errorf("route for %s is in table %d, expected table %d", cidr, rt.TableIndex(), tableIndex)
+				} else if toWireguard := w.shouldRouteToWireguard(name, w.peers[name]) &&
+					w.wireguardCIDRs(w.peers[name]).Contains(cidr); toWireguard != (ifaceName == w.config.InterfaceName) {
+					return fmt.Errorf("route for %s of peer %s is for interface %q", cidr, name, ifaceName)
+				}
+				routed[cidr] = true
+			}
+		}
+	}
+
+	for cidr, pending := range w.routesPendingWireguard {
+		name, ok := w.cidrToNodeName[cidr]
+		if !ok || name != pending.nodeName {
+			return fmt.Errorf("held back route for %s of peer %s is not for an allowed CIDR of the peer", cidr, pending.nodeName)
+		} else if !w.shouldRouteToWireguard(name, w.peers[name]) || !w.wireguardCIDRs(w.peers[name]).Contains(cidr) {
+			return fmt.Errorf("held back route for %s of peer %s should not be to wireguard", cidr, name)
+		}
+		routed[cidr] = true
+	}
+
+	for cidr, name := range w.cidrToNodeName {
+		if !routed[cidr] && !w.isExcludedByRule(name) {
+			return fmt.Errorf("no route for allowed CIDR %s of peer %s", cidr, name)
+		}
+	}
+
+	numProgrammed := 0
+	for name, peer := range w.peers {
+		shouldProgram := w.shouldProgramWireguardPeer(name, peer)
+		if shouldProgram {
+			numProgrammed++
+		}
+		if shouldRoute := w.shouldRouteToWireguard(name, peer); peer.routingToWireguard != shouldRoute {
+			return fmt.Errorf("peer %s routing to wireguard is %v, expected %v", name, peer.routingToWireguard, shouldRoute)
+		} else if peer.programmedInWireguard != shouldProgram {
+			return fmt.Errorf("peer %s programmed in wireguard is %v, expected %v", name, peer.programmedInWireguard, shouldProgram)
+		}
+	}
+	if w.config.MaxPeers > 0 && numProgrammed > w.config.MaxPeers {
+		return fmt.Errorf("%d peers are programmed, the maximum is %d", numProgrammed, w.config.MaxPeers)
+	}
+	return nil
+}
+
+// checkCapacityStatsInvariants checks that the capacity stats, which are maintained as the updates are applied, match
+// the stats recalculated from the cached peers and the routes in the routing tables.
+func (w *Wireguard) checkCapacityStatsInvariants() error {
+	if !w.Active() || w.tornDown {
+		return nil
+	}
+	expected := CapacityStats{PendingRoutes: len(w.routesPendingWireguard)}
+	var peers []PeerCapacity
+	for name, peer := range w.peers {
+		pc := PeerCapacity{Name: name, CIDRs: peer.cidrs.Len()}
+		if peer.programmedInWireguard {
+			pc.AllowedIPs = w.wireguardCIDRs(peer).Len()
+			expected.ProgrammedPeers++
+			expected.AllowedIPs += pc.AllowedIPs
+		}
+		if pc.CIDRs > 0 {
+			peers = append(peers, pc)
+		}
+	}
+	sortPeerCapacities(peers)
+	if len(peers) > capacityTopPeers {
+		peers = peers[:capacityTopPeers]
+	}
+	expected.TopPeers = peers
+
+	routed := set.New()
+	for _, rt := range w.RouteTableSyncers() {
+		for cidr := range rt.Targets(w.config.InterfaceName) {
+			expected.UnicastRoutes++
+			routed.Add(cidr)
+		}
+		for cidr, target := range rt.Targets(routetable.InterfaceNone) {
+			if target.Type == routetable.TargetTypeThrow {
+				expected.ThrowRoutes++
+			}
+			routed.Add(cidr)
+		}
+	}
+	for cidr := range w.cidrToNodeName {
+		if _, pending := w.routesPendingWireguard[cidr]; !pending && !routed.Contains(cidr) {
+			expected.SuppressedCIDRs++
+		}
+	}
+
+	if stats := w.CapacityStats(); !reflect.DeepEqual(stats, expected) {
+		return fmt.Errorf("capacity stats %+v do not match the recalculated stats %+v", stats, expected)
+	}
+	return nil
+}
+
+// isExcludedByRule returns true if the CIDRs of the peer should have no routes, see
+// NonWireguardPeerHandlingRuleExclude.
+func (w *Wireguard) isExcludedByRule(name string) bool {
+	return w.excludesNonWireguardPeersByRule() && !w.shouldRouteToWireguard(name, w.peers[name])
+}
+
+// CachedStateSize returns the total number of entries in the maps and sets that hold the cached per-node and per-CIDR
+// state, excluding the routing tables. This is zero once all of the peers have been removed and applied.
+//
+// This is intended for tests, and must be called from the same goroutine as Apply.
+func (w *Wireguard) CachedStateSize() int {
+	return len(w.peers) +
+		len(w.cidrToNodeName) +
+		len(w.publicKeyToNodeNames) +
+		len(w.allowedCIDRToNodeName) +
+		len(w.interfaceCIDRToNodeName) +
+		len(w.nodeNameToInterfaceCIDR) +
+		len(w.cidrToRouteClass) +
+		len(w.cidrToTableIndex) +
+		w.deniedCIDRs.Len() +
+		len(w.routesPendingWireguard) +
+		w.readyNodes.Len() +
+		w.optedOutNodes.Len() +
+		w.overLimitNodes.Len() +
+		len(w.nodeNameToSecondaryAddr) +
+		len(w.endpointFailovers) +
+		len(w.peerKeyTransitions) +
+		len(w.localCIDRs) +
+		len(w.localCIDRRoutes) +
+		len(w.capacity.peers) +
+		len(w.peerUpdates) +
+		len(w.cidrToNodeNameUpdates)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var counterKeyDriftCorrected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "felix_wireguard_key_drift_corrected",
+	Help: "Number of times the wireguard device was found with a private key other than ours, and was reprogrammed.",
+})
+
+func init() {
+	prometheus.MustRegister(counterKeyDriftCorrected)
+}
+
+// intendedKey is the private key that the wireguard device is intended to have, and its public key. The keys are only
+// compared by their public keys. The private key is only passed to the wireguard client to reprogram the device, and
+// the key formats as its public key so that the private key cannot be logged by accident.
+type intendedKey struct {
+	privateKey wgtypes.Key
+	publicKey  wgtypes.Key
+}
+
+func newIntendedKey(privateKey wgtypes.Key) *intendedKey {
+	return &intendedKey{privateKey: privateKey, publicKey: privateKey.PublicKey()}
+}
+
+func (k intendedKey) String() string {
+	return k.publicKey.String()
+}
+
+func (k intendedKey) GoString() string {
+	return "intendedKey{publicKey: " + k.publicKey.String() + "}"
+}
+
+// attestPrivateKey checks that the private key read from the device is the intended key, returning the public key of
+// the device once updated, and the private key to program if the device is to be updated. The keys are compared by
+// their public keys, and the private key read from the device is not retained, other than when it is adopted as the
+// intended key.
+//
+// If the device has no key a new key is generated. The key of the device is adopted by the first resync of the device,
+// e.g. when felix is restarted, or once we adopt the key stored for our node, see handleKeyConflict. Otherwise a
+// device whose key differs from the intended key, e.g. because it was changed with `wg set`, has drifted and is
+// reprogrammed with the intended key.
+func (w *Wireguard) attestPrivateKey(device *wgtypes.Device) (wgtypes.Key, *wgtypes.Key, error) {
+	if device.PrivateKey == zeroKey || device.PublicKey == zeroKey {
+		// One of the private or public key is not set. Generate a new private key and return the corresponding
+		// public key.
+		w.logCxt.Info("Generate new private/public keypair")
+		privateKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			w.logCxt.Errorf("error generating private-key: %v", err)
+			return zeroKey, nil, err
+		}
+		w.intendedKey = newIntendedKey(privateKey)
+		return w.intendedKey.publicKey, &privateKey, nil
+	}
+
+	devicePublicKey := device.PrivateKey.PublicKey()
+	if w.intendedKey == nil {
+		w.logCxt.WithField("publicKey", devicePublicKey).Debug("Adopting the private key of the wireguard device")
+		w.intendedKey = newIntendedKey(device.PrivateKey)
+		return devicePublicKey, nil, nil
+	} else if devicePublicKey == w.intendedKey.publicKey {
+		return devicePublicKey, nil, nil
+	}
+
+	w.logCxt.WithFields(logrus.Fields{
+		"intendedPublicKey": w.intendedKey.publicKey,
+		"devicePublicKey":   devicePublicKey,
+	}).Warning("Wireguard device private key has drifted from our key, reprogramming our key")
+	w.countKeyDriftCorrected()
+	privateKey := w.intendedKey.privateKey
+	return w.intendedKey.publicKey, &privateKey, nil
+}
+
+// forgetIntendedKey forgets the intended key, e.g. when the device is removed, or when the key stored for our node is
+// adopted from the device. The key of the device is adopted by the next resync.
+func (w *Wireguard) forgetIntendedKey() {
+	w.intendedKey = nil
+}
+
+// countKeyDriftCorrected counts a device that has been reprogrammed with the intended key.
+func (w *Wireguard) countKeyDriftCorrected() {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.keyDriftsCorrected++
+	counterKeyDriftCorrected.Inc()
+}
+
+// KeyDriftsCorrected returns the number of times the wireguard device was found with a private key other than ours,
+// and was reprogrammed with our key. This may be called from any goroutine.
+func (w *Wireguard) KeyDriftsCorrected() int {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.keyDriftsCorrected
+}
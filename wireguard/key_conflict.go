@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// The delay before our public key is published again after the first key conflict. The delay is doubled for each
+	// consecutive conflict, up to the maximum.
+	keyConflictInitialBackoff = 5 * time.Second
+	keyConflictMaxBackoff     = 5 * time.Minute
+)
+
+// KeyConflictError may be returned by the status callback if the datastore holds a different public key for our node,
+// and the key should not simply be overwritten, e.g. because another felix is running for the same node and publishing
+// its own key. StoredKey is the key held by the datastore.
+type KeyConflictError struct {
+	StoredKey wgtypes.Key
+}
+
+func (e *KeyConflictError) Error() string {
+	return fmt.Sprintf("wireguard public key conflicts with the stored key %s", e.StoredKey)
+}
+
+// PublishRetryAfter returns the time until the publication of our public key is retried after a key conflict, or
+// republished after a stale echo or at the end of our key transition, or zero if no retry is scheduled. Apply must be
+// called after this time for the key to be published. This must be called from the same goroutine as Apply.
+func (w *Wireguard) PublishRetryAfter() time.Duration {
+	if w.tornDown {
+		return 0
+	}
+	retryAfter := w.keyConflictRetryAfter()
+	if w.staleKeyRepublishDeferred {
+		after := w.staleKeyRepublishAfter()
+		if after == 0 {
+			// The republish is already due.
+			after = time.Millisecond
+		}
+		if retryAfter == 0 || after < retryAfter {
+			retryAfter = after
+		}
+	}
+	if after := w.localKeyTransitionEndAfter(); after > 0 && (retryAfter == 0 || after < retryAfter) {
+		retryAfter = after
+	}
+	return retryAfter
+}
+
+// keyConflictRetryAfter returns the time until the publication of our public key is retried after a key conflict, or
+// zero if no retry is scheduled.
+func (w *Wireguard) keyConflictRetryAfter() time.Duration {
+	if w.publishRetryTime.IsZero() || w.ourPublicKeyAgreesWithDataplaneMsg {
+		return 0
+	}
+	if after := w.publishRetryTime.Sub(w.time.Now()); after > 0 {
+		return after
+	}
+	// The retry is already due.
+	return time.Millisecond
+}
+
+// publishBackingOff returns true if the publication of our public key is backing off after a key conflict.
+func (w *Wireguard) publishBackingOff() bool {
+	return !w.publishRetryTime.IsZero() && w.time.Now().Before(w.publishRetryTime)
+}
+
+// handleKeyConflict handles a KeyConflictError returned by the status callback. If the wireguard device now has the
+// stored key, e.g. because another felix for our node has programmed the device, and no peer has exchanged traffic
+// using our key, then the stored key is adopted as our key. Otherwise publication is backed off with an exponential
+// delay, rather than overwriting the stored key on every Apply, which would flap the key seen by the peers. Returns nil
+// if the stored key is adopted.
+func (w *Wireguard) handleKeyConflict(conflict *KeyConflictError) error {
+	logCxt := w.logCxt.WithFields(logrus.Fields{"ourKey": *w.ourPublicKey, "storedKey": conflict.StoredKey})
+	if w.canAdoptKey(conflict.StoredKey) {
+		logCxt.Warning("Wireguard public key conflicts with the stored key, adopting the stored key from the device")
+		w.ourPublicKey = &conflict.StoredKey
+		w.ourPublicKeyAgreesWithDataplaneMsg = true
+		w.storedKey = conflict.StoredKey
+		w.localKeyTransition = nil
+		w.forgetIntendedKey()
+		w.setLocalConfig(&localConfig{
+			publicKey: conflict.StoredKey,
+			port:      w.config.ListeningPort,
+			ifaceName: w.config.InterfaceName,
+		})
+		w.clearKeyConflicts()
+		return nil
+	}
+
+	backoff := keyConflictMaxBackoff
+	if w.numKeyConflicts < 16 {
+		backoff = keyConflictInitialBackoff << uint(w.numKeyConflicts)
+		if backoff > keyConflictMaxBackoff {
+			backoff = keyConflictMaxBackoff
+		}
+	}
+	w.numKeyConflicts++
+	w.publishRetryTime = w.time.Now().Add(backoff)
+	logCxt.WithFields(logrus.Fields{
+		"numConflicts": w.numKeyConflicts,
+		"retryAfter":   backoff,
+	}).Error("Wireguard public key conflicts with the key stored for this node - another felix is probably running " +
+		"for the same node. Backing off publication of our key")
+	return conflict
+}
+
+// canAdoptKey returns true if the wireguard device has the key, and none of the peers on the device have exchanged
+// traffic with us.
+func (w *Wireguard) canAdoptKey(key wgtypes.Key) bool {
+	wireguardClient, err := w.getWireguardClient()
+	if err != nil {
+		w.logCxt.WithError(err).Info("Wireguard client is not available, unable to adopt the stored key")
+		return false
+	}
+	device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+	if err != nil {
+		w.logCxt.WithError(err).Info("Unable to query the wireguard device, unable to adopt the stored key")
+		w.closeWireguardClient()
+		return false
+	}
+	if device.PublicKey != key {
+		w.logCxt.Debug("Wireguard device does not have the stored key")
+		return false
+	}
+	for i := range device.Peers {
+		peer := &device.Peers[i]
+		if !peer.LastHandshakeTime.IsZero() || peer.ReceiveBytes > 0 || peer.TransmitBytes > 0 {
+			w.logCxt.WithField("peer", peer.PublicKey).Debug("Wireguard peer is carrying traffic, not adopting the key")
+			return false
+		}
+	}
+	return true
+}
+
+// clearKeyConflicts resets the back off of the publication of our key, once the key has been published or adopted.
+func (w *Wireguard) clearKeyConflicts() {
+	w.numKeyConflicts = 0
+	w.publishRetryTime = time.Time{}
+}
+
+// RepublishKey queues the republication of our public key, e.g. because the datastore is found to hold the key of
+// another felix for our node after our key was reported. Our key is reported again on the next Apply, so that the
+// status callback can return a KeyConflictError and the conflict is handled as for a conflict found at publication.
+func (w *Wireguard) RepublishKey() {
+	w.queueUpdate(PendingWorkSummary{Key: true}, func() { w.republishKey() })
+}
+
+func (w *Wireguard) republishKey() {
+	if w.ourPublicKey == nil || !w.ourPublicKeyAgreesWithDataplaneMsg {
+		w.logCxt.Debug("Public key not yet published - no need to republish")
+		return
+	}
+	w.logCxt.Info("Republishing our public key after a conflicting key was stored for our node")
+	w.ourPublicKeyAgreesWithDataplaneMsg = false
+}
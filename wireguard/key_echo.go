@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The minimum interval between the republications of our public key that are triggered by a local
+// EndpointWireguardUpdate with a stale key. A slow datastore may keep echoing back a stale key after our publish has
+// been acknowledged, and republishing on every echo would hammer the datastore.
+const staleKeyRepublishInterval = 30 * time.Second
+
+var counterStaleKeyEchoes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "felix_wireguard_stale_local_key_echoes",
+	Help: "Number of updates for the local host received with a public key that does not match our published key.",
+})
+
+func init() {
+	prometheus.MustRegister(counterStaleKeyEchoes)
+}
+
+// StaleKeyEchoes returns the number of local EndpointWireguardUpdates received with a key that does not match our
+// published key, after our key has been published. This should be called from the same goroutine as Apply.
+func (w *Wireguard) StaleKeyEchoes() int {
+	return w.numStaleKeyEchoes
+}
+
+// countStaleKeyEcho counts a local EndpointWireguardUpdate with a key that does not match our published key.
+func (w *Wireguard) countStaleKeyEcho() {
+	w.numStaleKeyEchoes++
+	counterStaleKeyEchoes.Inc()
+}
+
+// onStaleKeyEcho handles a local EndpointWireguardUpdate with a key that does not match ours once our latest publish
+// has been acknowledged. Our key is republished, unless it was already republished for a stale echo within
+// staleKeyRepublishInterval, in which case the republication is deferred until the interval has passed and is
+// cancelled if our key is echoed back in the meantime.
+func (w *Wireguard) onStaleKeyEcho() {
+	w.countStaleKeyEcho()
+	if w.staleKeyRepublishAfter() > 0 {
+		w.logCxt.WithField("lastRepublish", w.lastStaleKeyRepublish).Debug(
+			"Stored public key does not match, but key was recently republished - deferring republish")
+		w.staleKeyRepublishDeferred = true
+		return
+	}
+	w.republishStaleKey()
+}
+
+// republishStaleKey flags our key to be published again by this Apply, after a stale echo.
+func (w *Wireguard) republishStaleKey() {
+	w.ourPublicKeyAgreesWithDataplaneMsg = false
+	w.staleKeyRepublishDeferred = false
+	w.lastStaleKeyRepublish = w.time.Now()
+}
+
+// staleKeyRepublishAfter returns the time until our key may be republished after a stale echo, or zero if it may be
+// republished now.
+func (w *Wireguard) staleKeyRepublishAfter() time.Duration {
+	if w.lastStaleKeyRepublish.IsZero() {
+		return 0
+	}
+	if after := staleKeyRepublishInterval - w.time.Since(w.lastStaleKeyRepublish); after > 0 {
+		return after
+	}
+	return 0
+}
+
+// releaseStaleKeyRepublish republishes our key if a republish deferred by onStaleKeyEcho is now due.
+func (w *Wireguard) releaseStaleKeyRepublish() {
+	if w.staleKeyRepublishDeferred && w.staleKeyRepublishAfter() == 0 {
+		w.logCxt.Info("Stored public key still does not match, publishing again")
+		w.republishStaleKey()
+	}
+}
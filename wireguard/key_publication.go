@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+// keyPublicationReady returns true if the dataplane is ready for the peers to act on our key, so that the key may be
+// published by the status callback at the end of the Apply. The peers act on our key as soon as they receive it, so
+// the dataplane changes that they rely on must be made first:
+//
+//   - While wireguard is enabled, our key is only published once the device is configured with it, and so is ready to
+//     receive the traffic encrypted with it. The key of an adopted device is already in use, so it is published
+//     immediately.
+//   - While wireguard is disabled, the withdrawal of our key is only published once our traffic is no longer diverted
+//     to the wireguard routing tables, see withdrawKey. The peers route our CIDRs normally as soon as they see the
+//     withdrawal, so until then our traffic to them would be encrypted for peers that no longer accept it.
+func (w *Wireguard) keyPublicationReady() bool {
+	if !w.config.Enabled {
+		return w.ourPublicKey != nil && *w.ourPublicKey == zeroKey
+	}
+	return w.inSyncWireguard || w.adopting()
+}
+
+// publishedKeyState returns the state of the key published by the status callback: our public key while wireguard is
+// enabled, or the withdrawal of our key while it is disabled, along with what disabled it.
+func (w *Wireguard) publishedKeyState() KeyState {
+	if w.config.Enabled {
+		return KeyStatePublished
+	}
+	if w.enabledOverride != nil {
+		return KeyStateDisabledByOverride
+	}
+	return KeyStateDisabled
+}
+
+// withdrawKey zeroes our public key while wireguard is disabled, so that the withdrawal is published at the end of the
+// Apply. This is called by ensureDisabled once the routes have been flushed from the wireguard routing tables, so the
+// withdrawal is published even if the removal of the rules or the link fails and is retried by a later Apply.
+func (w *Wireguard) withdrawKey() {
+	if w.ourPublicKey == nil || *w.ourPublicKey != zeroKey {
+		w.logCxt.Info("Wireguard traffic is no longer routed, withdrawing our public key")
+	}
+	w.ourPublicKey = &zeroKey
+	w.forgetIntendedKey()
+	w.setLocalConfig(nil)
+	w.setPeerDiagnostics(nil)
+}
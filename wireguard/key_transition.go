@@ -0,0 +1,333 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// The longest interval between the checks for a handshake with the new key of a node in a key transition, which retire
+// the peer of the previous key once the new key is in use.
+const keyTransitionCheckInterval = 5 * time.Second
+
+// localKeyTransition is our own key transition: the previous key that the peers may still use, published alongside our
+// new key until the deadline.
+type localKeyTransition struct {
+	publicKey   wgtypes.Key
+	previousKey wgtypes.Key
+	deadline    time.Time
+}
+
+// peerKeyTransition is the key transition of a node that published its previous key alongside its new key. The peer
+// of the previous key is kept on the device, without any allowed IPs, until the deadline or until there is a handshake
+// with the new key.
+type peerKeyTransition struct {
+	previousKey wgtypes.Key
+	deadline    time.Time
+
+	// Whether the peer of the previous key has been kept on the device.
+	programmed bool
+}
+
+// keyTransitionToPublish returns the previous key and the deadline to publish alongside our public key, or a zero key
+// if we are not in a key transition. A transition starts when we publish a key other than the key stored for our node,
+// which the peers are still using, and lasts for Config.KeyTransitionTimeout. Publishing the key again during the
+// transition publishes the same previous key and deadline.
+func (w *Wireguard) keyTransitionToPublish(publicKey wgtypes.Key) (wgtypes.Key, time.Time) {
+	if w.config.KeyTransitionTimeout <= 0 || publicKey == zeroKey {
+		w.localKeyTransition = nil
+		return zeroKey, time.Time{}
+	}
+	if t := w.localKeyTransition; t != nil && t.publicKey == publicKey {
+		return t.previousKey, t.deadline
+	}
+	w.localKeyTransition = nil
+	if w.storedKey == zeroKey || w.storedKey == publicKey {
+		return zeroKey, time.Time{}
+	}
+
+	t := &localKeyTransition{
+		publicKey:   publicKey,
+		previousKey: w.storedKey,
+		deadline:    w.time.Now().Add(w.config.KeyTransitionTimeout),
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"previousKey": t.previousKey,
+		"deadline":    t.deadline,
+	}).Info("Public key has changed, publishing the previous key alongside the new key")
+	w.localKeyTransition = t
+	return t.previousKey, t.deadline
+}
+
+// expireLocalKeyTransition ends our key transition once its deadline has passed, and publishes our key again without
+// the previous key.
+func (w *Wireguard) expireLocalKeyTransition() {
+	t := w.localKeyTransition
+	if t == nil || w.time.Now().Before(t.deadline) {
+		return
+	}
+	w.logCxt.WithField("previousKey", t.previousKey).Info("Key transition has ended, publishing only the new key")
+	w.localKeyTransition = nil
+	if w.ourPublicKey != nil && *w.ourPublicKey == t.publicKey {
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
+	}
+}
+
+// localKeyTransitionEndAfter returns the time until our key transition ends, or zero if we are not in a key transition.
+func (w *Wireguard) localKeyTransitionEndAfter() time.Duration {
+	if w.localKeyTransition == nil {
+		return 0
+	}
+	if after := w.localKeyTransition.deadline.Sub(w.time.Now()); after > 0 {
+		return after
+	}
+	// The end is already due.
+	return time.Millisecond
+}
+
+// EndpointWireguardPreviousKey updates the previous public key of a node, published by the node alongside its new key
+// until the deadline, see Config.KeyTransitionTimeout. This must follow the EndpointWireguardUpdate of the new key. A
+// zero key indicates the node is not in a key transition.
+func (w *Wireguard) EndpointWireguardPreviousKey(name string, previousKey wgtypes.Key, deadline time.Time) {
+	w.queueUpdate(PendingWorkSummary{Peers: true}, func() {
+		w.endpointWireguardPreviousKey(w.nodeName(name), previousKey, deadline)
+	})
+}
+
+func (w *Wireguard) endpointWireguardPreviousKey(name string, previousKey wgtypes.Key, deadline time.Time) {
+	w.logCxt.Debugf("EndpointWireguardPreviousKey: name=%s; key=%s, deadline=%v", name, previousKey, deadline)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.logCxt.Debug("Local update - ignoring")
+		return
+	} else if w.config.KeyTransitionTimeout <= 0 {
+		w.logCxt.Debug("Key transitions are not enabled - ignoring")
+		return
+	}
+
+	// The deadline is capped by our own timeout, so that a peer is never kept indefinitely by a bad deadline.
+	now := w.time.Now()
+	if latest := now.Add(w.config.KeyTransitionTimeout); deadline.After(latest) {
+		deadline = latest
+	}
+	existing := w.peerKeyTransitions[name]
+	if previousKey == zeroKey || !now.Before(deadline) {
+		if existing != nil {
+			w.endPeerKeyTransition(name, existing, "the node is no longer in a key transition")
+		}
+		return
+	}
+	if existing != nil && existing.previousKey == previousKey {
+		existing.deadline = deadline
+		return
+	}
+	if existing != nil {
+		w.endPeerKeyTransition(name, existing, "the node has published another previous key")
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"node":        name,
+		"previousKey": previousKey,
+		"deadline":    deadline,
+	}).Info("Node is in a key transition, keeping the peer of its previous key")
+	w.peerKeyTransitions[name] = &peerKeyTransition{previousKey: previousKey, deadline: deadline}
+}
+
+// endPeerKeyTransition forgets the key transition of a node. If the peer of the previous key was kept on the device it
+// is removed by the next Apply, unless the key has since become the key of a node.
+func (w *Wireguard) endPeerKeyTransition(name string, t *peerKeyTransition, reason string) {
+	w.logCxt.WithFields(logrus.Fields{
+		"node":        name,
+		"previousKey": t.previousKey,
+	}).Infof("Key transition ended: %s", reason)
+	delete(w.peerKeyTransitions, name)
+	if t.programmed {
+		w.trace.annotateKey(t.previousKey, "end of the key transition of node %s", name)
+		w.retiredPreviousKeys.Add(t.previousKey)
+	}
+}
+
+// keepPreviousKeyPeer returns true if the peer of the key of a node, which is being replaced by a new key, is kept on
+// the device while the node is in a key transition. The current keys of the nodes take precedence over the previous
+// keys, so the peer is not kept if another node also has the key.
+func (w *Wireguard) keepPreviousKeyPeer(name string, node *peerData, newKey wgtypes.Key) bool {
+	t := w.peerKeyTransitions[name]
+	if t == nil || t.previousKey != node.publicKey || newKey == zeroKey || !w.time.Now().Before(t.deadline) {
+		return false
+	} else if nodenames := w.publicKeyToNodeNames[node.publicKey]; nodenames != nil && nodenames.Len() > 1 {
+		return false
+	} else if w.previousKeyKeptForOtherNode(name, t.previousKey) {
+		return false
+	}
+	t.programmed = true
+	return true
+}
+
+// keepDevicePreviousKeyPeer returns true if a peer on the device is the peer of the previous key of a node in a key
+// transition, which is kept without any allowed IPs. This is used when resyncing the device, so the peer is kept even
+// if the key of the node changed while the device was not in sync.
+func (w *Wireguard) keepDevicePreviousKeyPeer(key wgtypes.Key) bool {
+	if w.publicKeyToNodeNames[key] != nil {
+		// The key is the key of a node, which takes precedence.
+		return false
+	}
+	for name, t := range w.peerKeyTransitions {
+		if t.previousKey != key || !w.previousKeyValid(name, t) || w.previousKeyKeptForOtherNode(name, key) {
+			continue
+		}
+		t.programmed = true
+		return true
+	}
+	return false
+}
+
+// previousKeyKeptForOtherNode returns true if the peer of the key is kept for the key transition of another node.
+func (w *Wireguard) previousKeyKeptForOtherNode(name string, key wgtypes.Key) bool {
+	for otherName, t := range w.peerKeyTransitions {
+		if otherName != name && t.programmed && t.previousKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// previousKeyValid returns true if the peer of the previous key of a node may be kept on the device: the node is
+// programmed with a different key, no node has the previous key, and the deadline has not passed.
+func (w *Wireguard) previousKeyValid(name string, t *peerKeyTransition) bool {
+	node := w.peers[name]
+	if node == nil || node.publicKey == zeroKey || node.publicKey == t.previousKey {
+		return false
+	} else if w.publicKeyToNodeNames[t.previousKey] != nil {
+		return false
+	} else if !w.shouldProgramWireguardPeer(name, node) {
+		return false
+	}
+	return w.time.Now().Before(t.deadline)
+}
+
+// resetPeerKeyTransitions flags the peers of the previous keys as not kept on the device, before the device is resynced
+// or rebuilt, which determines whether the peers are kept.
+func (w *Wireguard) resetPeerKeyTransitions() {
+	for _, t := range w.peerKeyTransitions {
+		t.programmed = false
+	}
+}
+
+// applyPeerKeyTransitions ends the key transitions that are over, and removes the peers of their previous keys from the
+// device. A transition is over once the deadline has passed, there has been a handshake with the new key of the node,
+// or the peer of the previous key may no longer be kept. A transition whose previous key was not kept on the device,
+// e.g. because the key of the node changed before the transition was received, is simply forgotten. The device is only
+// read while peers of previous keys are kept, and the handshakes read from the device also refresh the peer
+// statistics.
+func (w *Wireguard) applyPeerKeyTransitions(ctx context.Context) {
+	if len(w.peerKeyTransitions) == 0 && w.retiredPreviousKeys.Len() == 0 {
+		return
+	}
+
+	var devicePeers map[wgtypes.Key]*wgtypes.Peer
+	var wireguardClient netlinkshim.Wireguard
+	for name, t := range w.peerKeyTransitions {
+		if !t.programmed {
+			w.logCxt.WithField("node", name).Debug("Peer of the previous key is not on the device, forgetting transition")
+			delete(w.peerKeyTransitions, name)
+		}
+	}
+	if len(w.peerKeyTransitions) > 0 || w.retiredPreviousKeys.Len() > 0 {
+		client, err := w.getWireguardClient()
+		if err != nil {
+			w.logCxt.WithError(err).Info("Wireguard client is not available, unable to check the key transitions")
+			return
+		}
+		wireguardClient = netlinkshim.WireguardWithContext(ctx, client)
+	}
+	if len(w.peerKeyTransitions) > 0 {
+		device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+		if err != nil {
+			w.logCxt.WithError(err).Info("Unable to query the wireguard device, unable to check the key transitions")
+			w.closeWireguardClient()
+			return
+		}
+		devicePeers = make(map[wgtypes.Key]*wgtypes.Peer, len(device.Peers))
+		for peerIdx := range device.Peers {
+			devicePeers[device.Peers[peerIdx].PublicKey] = &device.Peers[peerIdx]
+		}
+		w.refreshDeviceStats(device)
+	}
+
+	for name, t := range w.peerKeyTransitions {
+		if !w.previousKeyValid(name, t) {
+			w.endPeerKeyTransition(name, t, "the deadline has passed or the previous key may no longer be kept")
+		} else if devicePeer := devicePeers[w.peers[name].publicKey]; devicePeer != nil &&
+			!devicePeer.LastHandshakeTime.IsZero() {
+			w.endPeerKeyTransition(name, t, "handshake with the new key")
+		}
+	}
+	if w.retiredPreviousKeys.Len() == 0 {
+		return
+	}
+
+	var wireguardUpdate wgtypes.Config
+	w.retiredPreviousKeys.Iter(func(item interface{}) error {
+		key := item.(wgtypes.Key)
+		if w.publicKeyToNodeNames[key] != nil {
+			// The key is now the key of a node, whose peer is programmed with the key.
+			w.logCxt.WithField("previousKey", key).Debug("Previous key is the key of a node, not removing the peer")
+			return nil
+		}
+		w.logCxt.WithField("previousKey", key).Info("Removing the peer of the previous key")
+		wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		return nil
+	})
+	if len(wireguardUpdate.Peers) > 0 {
+		if err := wireguardClient.ConfigureDevice(w.config.InterfaceName, wireguardUpdate); err != nil {
+			// The peers are no longer expected, so the resync removes them.
+			w.logCxt.WithError(err).Info("Failed to remove the peers of the previous keys, resync the device")
+			w.closeWireguardClient()
+			w.inSyncWireguard = false
+		}
+	}
+	w.retiredPreviousKeys = set.New()
+}
+
+// KeyTransitionCheckAfter returns the time until the key transitions of the nodes are next checked, or zero if no node
+// is in a key transition. Apply must be called after this time for the peers of the previous keys to be removed once a
+// handshake with the new key has happened or the deadline has passed. This must be called from the same goroutine as
+// Apply.
+func (w *Wireguard) KeyTransitionCheckAfter() time.Duration {
+	if w.tornDown || len(w.peerKeyTransitions) == 0 {
+		return 0
+	}
+	checkAfter := keyTransitionCheckInterval
+	now := w.time.Now()
+	for _, t := range w.peerKeyTransitions {
+		after := t.deadline.Sub(now)
+		if after <= 0 {
+			// The check is already due.
+			return time.Millisecond
+		}
+		if after < checkAfter {
+			checkAfter = after
+		}
+	}
+	return checkAfter
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// KeyState is the state of our public key reported to the status callback.
+type KeyState string
+
+const (
+	// KeyStatePublished reports our public key, which the peers may use to program us.
+	KeyStatePublished KeyState = "published"
+
+	// KeyStateWaitingForLocalAddress reports that our public key is held back because the endpoint address of our
+	// node is not known. The reported key is the zero key, so that the peers do not program us until they can reach us.
+	KeyStateWaitingForLocalAddress KeyState = "waiting-for-local-address"
+
+	// KeyStateDisabled reports the withdrawal of our public key because wireguard is disabled by the configuration.
+	KeyStateDisabled KeyState = "disabled"
+
+	// KeyStateDisabledByOverride reports the withdrawal of our public key because wireguard is disabled on this node by
+	// the node override, see Wireguard.SetNodeOverrideEnabled.
+	KeyStateDisabledByOverride KeyState = "disabled-by-override"
+
+	// KeyStateTornDown reports the withdrawal of our public key because the wireguard configuration has been torn down,
+	// see Wireguard.Teardown.
+	KeyStateTornDown KeyState = "torn-down"
+)
+
+// MissingLocalAddressError is the error when wireguard is enabled but the endpoint address of our node is not known.
+// The wireguard device is configured but our public key is not published until the address is known.
+type MissingLocalAddressError struct {
+	Hostname string
+}
+
+func (e *MissingLocalAddressError) Error() string {
+	return fmt.Sprintf("no endpoint address is known for node %s, not publishing the wireguard public key", e.Hostname)
+}
+
+// LocalAddressError returns a MissingLocalAddressError if our public key is held back because the endpoint address of
+// our node is not known, or nil otherwise.
+func (w *Wireguard) LocalAddressError() error {
+	if !w.waitingForLocalAddress() {
+		return nil
+	}
+	return &MissingLocalAddressError{Hostname: w.hostname}
+}
+
+// waitingForLocalAddress returns true if our public key is held back because the endpoint address of our node is not
+// known.
+func (w *Wireguard) waitingForLocalAddress() bool {
+	return w.config.Enabled && !w.config.PublishKeyWithoutEndpoint && w.ourIPv4EndpointAddr == nil
+}
+
+// reportWaitingForLocalAddress reports the zero key to the status callback, once, while our public key is held back.
+// Any key we published before is withdrawn, so that the peers stop programming an endpoint they cannot reach.
+func (w *Wireguard) reportWaitingForLocalAddress() error {
+	if w.localAddressWaitReported {
+		return nil
+	}
+	w.logCxt.WithField("hostname", w.hostname).Warn(
+		"No endpoint address is known for this node, not publishing the wireguard public key until it is")
+	if err := w.invokeStatusCallback(StatusUpdate{
+		ListeningPort:     w.config.ListeningPort,
+		InterfaceName:     w.config.InterfaceName,
+		RoutingTableIndex: w.config.RoutingTableIndex,
+		KeyState:          KeyStateWaitingForLocalAddress,
+	}); err != nil {
+		return err
+	}
+	w.localAddressWaitReported = true
+	w.storedKey = zeroKey
+	return nil
+}
+
+// localAddressUpdated handles an update of the endpoint address of our node. Our public key is published once the
+// address is known, and withdrawn if the address is removed.
+func (w *Wireguard) localAddressUpdated(addr ip.Addr) {
+	if w.config.PublishKeyWithoutEndpoint || (w.ourIPv4EndpointAddr == nil) == (addr == nil) {
+		return
+	}
+	w.ourPublicKeyAgreesWithDataplaneMsg = false
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// localCIDRAdd tracks a CIDR of the local host so that it has a throw route, if Config.LocalCIDRsAsThrow is set.
+func (w *Wireguard) localCIDRAdd(cidr ip.CIDR, class RouteClass) {
+	if !w.config.LocalCIDRsAsThrow {
+		w.logCxt.Debug("Local update - ignoring")
+		return
+	} else if cidr.Version() != w.config.ipVersion() {
+		w.logCxt.Debugf("Local CIDR %s is not IPv%d - ignoring", cidr, w.config.ipVersion())
+		return
+	}
+	w.logCxt.Debugf("Local CIDR %s added, programming a throw route", cidr)
+	w.localCIDRs[cidr] = class
+}
+
+// localCIDRRemove stops tracking a CIDR of the local host, removing its throw route.
+func (w *Wireguard) localCIDRRemove(cidr ip.CIDR) {
+	if _, ok := w.localCIDRs[cidr]; ok {
+		w.logCxt.Debugf("Local CIDR %s removed, removing its throw route", cidr)
+		delete(w.localCIDRs, cidr)
+	}
+}
+
+// localCIDRTableIndex returns the routing table of the throw route for a local CIDR, and whether the CIDR should have
+// a throw route. A CIDR that is also assigned to a remote node, e.g. while it moves between nodes, is routed for the
+// remote node instead.
+func (w *Wireguard) localCIDRTableIndex(cidr ip.CIDR) (int, bool) {
+	class, ok := w.localCIDRs[cidr]
+	if !ok {
+		return 0, false
+	} else if _, ok := w.allowedCIDRToNodeName[cidr]; ok {
+		return 0, false
+	} else if _, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+		return 0, false
+	}
+	return w.config.routingTableIndexForClass(class), true
+}
+
+// removeLocalCIDRRoutes removes the throw routes of the local CIDRs that have been removed, or that are now routed for
+// a remote node. This is called before the routes of the peers are updated, so that a route programmed for a remote
+// node is not removed along with the throw route.
+func (w *Wireguard) removeLocalCIDRRoutes() {
+	for cidr, tableIndex := range w.localCIDRRoutes {
+		if expected, ok := w.localCIDRTableIndex(cidr); ok && expected == tableIndex {
+			continue
+		}
+		w.logCxt.Debugf("Removing throw route for local CIDR %s from table %d", cidr, tableIndex)
+		w.routetables[tableIndex].RouteRemove(routetable.InterfaceNone, cidr)
+		delete(w.localCIDRRoutes, cidr)
+		w.summary.routesRemoved++
+	}
+}
+
+// addLocalCIDRRoutes adds the throw routes of the local CIDRs. This is called after the routes of the peers are
+// updated, so that the throw route replaces the route of a remote node that the CIDR has moved from.
+func (w *Wireguard) addLocalCIDRRoutes() {
+	for cidr := range w.localCIDRs {
+		tableIndex, ok := w.localCIDRTableIndex(cidr)
+		if !ok {
+			continue
+		} else if _, ok := w.localCIDRRoutes[cidr]; ok {
+			continue
+		}
+		w.logCxt.Debugf("Adding throw route for local CIDR %s to table %d", cidr, tableIndex)
+		w.routetables[tableIndex].RouteUpdate(routetable.InterfaceNone, w.routeTarget(routetable.TargetTypeThrow, cidr))
+		w.localCIDRRoutes[cidr] = tableIndex
+		w.summary.routesAdded++
+	}
+}
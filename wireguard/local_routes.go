@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"errors"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+// The number of times the stale local routes are deleted before ensureNoStaleLocalRoutes gives up until the next
+// Apply.
+const maxLocalRouteAttempts = 3
+
+// ErrStaleLocalRoute is returned when the local route of an address that was removed from the wireguard link could not
+// be removed.
+var ErrStaleLocalRoute = errors.New("local route of a removed wireguard interface address remains")
+
+// ensureNoLinkAddresses removes the addresses of our IP version, and their local routes, from a wireguard link that is
+// left in place when wireguard is disabled, e.g. a shared link that is used by the instance for the other IP version.
+// The link would otherwise still be chosen as the source of the host traffic to the addresses of its subnet.
+func (w *Wireguard) ensureNoLinkAddresses(netlinkClient netlinkshim.Netlink) error {
+	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
+	if netlinkshim.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		w.logCxt.WithError(err).Warning("Failed to get device")
+		return err
+	}
+	w.logCxt.Debug("Removing the addresses from the wireguard device that is left in place")
+	return w.reconcileLinkAddresses(netlinkClient, link, nil, true)
+}
+
+// ensureNoStaleLocalRoutes ensures the local routing table has no route for an address of the wireguard link other
+// than the required addresses. The kernel adds a local route for each address of a link, and removes it along with the
+// address, but a local route that lingers once the address is removed is still used to select the source address of
+// the host traffic. The local routes are listed again once the stale routes are deleted to verify that they are gone,
+// and the deletion is retried up to maxLocalRouteAttempts times.
+func (w *Wireguard) ensureNoStaleLocalRoutes(
+	netlinkClient netlinkshim.Netlink, link netlink.Link, required map[ip.Addr]int,
+) error {
+	filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_LOCAL}
+	for attempt := 0; ; attempt++ {
+		routes, err := netlinkClient.RouteListFiltered(
+			w.config.netlinkFamily(), filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE,
+		)
+		if err != nil {
+			w.logCxt.WithError(err).Warn("failed to list the local routes of the wireguard device")
+			return err
+		}
+
+		var stale []netlink.Route
+		for _, route := range routes {
+			if route.Type != unix.RTN_LOCAL || route.Dst == nil {
+				continue
+			} else if _, ok := required[ip.FromNetIP(route.Dst.IP)]; !ok {
+				stale = append(stale, route)
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		} else if attempt == maxLocalRouteAttempts {
+			w.logCxt.WithField("numRoutes", len(stale)).Warn("Stale local routes of the wireguard device remain")
+			return ErrStaleLocalRoute
+		}
+
+		for _, route := range stale {
+			w.logCxt.WithField("dst", route.Dst).Info("Removing local route of a removed wireguard interface address")
+			if err := netlinkClient.RouteDel(&route); err != nil && !netlinkshim.IsNotExist(err) {
+				w.logCxt.WithError(err).Warn("failed to delete the local route of the wireguard device")
+				return err
+			}
+		}
+	}
+}
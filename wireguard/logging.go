@@ -0,0 +1,127 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newLogger returns the logger for the wireguard module. If Config.LogLevel is set, this is a logger with the output,
+// formatter and hooks of the standard logger but with its own level, otherwise it is the standard logger.
+func newLogger(config *Config) *logrus.Logger {
+	std := logrus.StandardLogger()
+	if config.LogLevel == nil {
+		return std
+	}
+	logger := logrus.New()
+	logger.Out = std.Out
+	logger.Formatter = std.Formatter
+	for level, hooks := range std.Hooks {
+		logger.Hooks[level] = append([]logrus.Hook(nil), hooks...)
+	}
+	logger.SetLevel(*config.LogLevel)
+	return logger
+}
+
+// debugPeer logs a debug message about a peer. The name is only converted for formatting, which allocates, if debug
+// logging is enabled, so this is used by the passes over all of the peers.
+func (w *Wireguard) debugPeer(format, name string) {
+	if w.logCxt.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		w.logCxt.Debugf(format, name)
+	}
+}
+
+// applySummary counts the changes made by an Apply. The routes are counted as they are updated in the routing tables,
+// which do not program routes that are unchanged. A route that changes between a throw route and a route to the
+// wireguard interface is counted as replaced.
+type applySummary struct {
+	peersAdded     int
+	peersRemoved   int
+	peersUpdated   int
+	routesAdded    int
+	routesRemoved  int
+	routesReplaced int
+	rulesAdded     int
+	rulesRemoved   int
+	deviceWrites   int
+}
+
+// countPeers counts the peer configuration written to the wireguard device.
+func (s *applySummary) countPeers(peers []wgtypes.PeerConfig) {
+	for _, peer := range peers {
+		switch {
+		case peer.Remove:
+			s.peersRemoved++
+		case peer.UpdateOnly:
+			s.peersUpdated++
+		default:
+			s.peersAdded++
+		}
+	}
+}
+
+// ApplyStats counts the changes made by an Apply, see Wireguard.LastApplyStats.
+type ApplyStats struct {
+	PeersAdded     int
+	PeersRemoved   int
+	PeersUpdated   int
+	RoutesAdded    int
+	RoutesRemoved  int
+	RoutesReplaced int
+	RulesAdded     int
+	RulesRemoved   int
+	DeviceWrites   int
+}
+
+// LastApplyStats returns the changes made by the last Apply that applied updates, i.e. that was not skipped because
+// wireguard is torn down, paused or has an invalid routing table. This allows benchmarks and tests to bound the work
+// done by an Apply without parsing the logs. This must be called from the same goroutine as Apply.
+func (w *Wireguard) LastApplyStats() ApplyStats {
+	return ApplyStats{
+		PeersAdded:     w.summary.peersAdded,
+		PeersRemoved:   w.summary.peersRemoved,
+		PeersUpdated:   w.summary.peersUpdated,
+		RoutesAdded:    w.summary.routesAdded,
+		RoutesRemoved:  w.summary.routesRemoved,
+		RoutesReplaced: w.summary.routesReplaced,
+		RulesAdded:     w.summary.rulesAdded,
+		RulesRemoved:   w.summary.rulesRemoved,
+		DeviceWrites:   w.summary.deviceWrites,
+	}
+}
+
+// log logs the summary as a single line with the apply timing, unless nothing was changed.
+func (s *applySummary) log(logCxt *logrus.Entry, took time.Duration, timing ApplyTiming) {
+	if *s == (applySummary{}) {
+		return
+	}
+	logCxt.WithFields(timing.logFields()).WithFields(logrus.Fields{
+		"peersAdded":     s.peersAdded,
+		"peersRemoved":   s.peersRemoved,
+		"peersUpdated":   s.peersUpdated,
+		"routesAdded":    s.routesAdded,
+		"routesRemoved":  s.routesRemoved,
+		"routesReplaced": s.routesReplaced,
+		"rulesAdded":     s.rulesAdded,
+		"rulesRemoved":   s.rulesRemoved,
+		"deviceWrites":   s.deviceWrites,
+		"took":           took,
+	}).Infof("wireguard apply: peers +%d/-%d/~%d, routes +%d/-%d/~%d, rules +%d/-%d, device-writes %d, took %v",
+		s.peersAdded, s.peersRemoved, s.peersUpdated, s.routesAdded, s.routesRemoved, s.routesReplaced, s.rulesAdded,
+		s.rulesRemoved, s.deviceWrites, took)
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+var counterBenignNetlinkRaces = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "felix_wireguard_netlink_benign_races",
+	Help: "Number of wireguard route and rule updates that failed because another process had already made the " +
+		"same update, and were treated as successful, by operation.",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(counterBenignNetlinkRaces)
+}
+
+// netlinkRaces tolerates the races with other processes that program the routes and rules of the shared routing
+// tables. An add that fails with EEXIST, or a delete that fails with ESRCH or ENOENT, is treated as successful if a
+// targeted read finds that the route or rule is already as intended. A route that exists with other content is
+// replaced, so that a conflicting route is still corrected. The netlink clients may be used from any goroutine.
+type netlinkRaces struct {
+	logCxt   *logrus.Entry
+	numRaces int64
+}
+
+func newNetlinkRaces(logCxt *logrus.Entry) *netlinkRaces {
+	return &netlinkRaces{logCxt: logCxt}
+}
+
+// BenignNetlinkRaces returns the number of route and rule updates that failed because the route or rule had already
+// been updated by another process, and that were treated as successful. This may be called from any goroutine.
+func (w *Wireguard) BenignNetlinkRaces() int {
+	return int(atomic.LoadInt64(&w.netlinkRaces.numRaces))
+}
+
+// netlink returns a netlink client that tolerates the races of the route and rule updates.
+func (r *netlinkRaces) netlink(nl netlinkshim.Netlink) netlinkshim.Netlink {
+	return &raceTolerantNetlink{Netlink: nl, races: r}
+}
+
+// newNetlink wraps a netlink client factory so that the clients tolerate the races of the route and rule updates.
+func (r *netlinkRaces) newNetlink(
+	newNetlink func() (netlinkshim.Netlink, error),
+) func() (netlinkshim.Netlink, error) {
+	return func() (netlinkshim.Netlink, error) {
+		nl, err := newNetlink()
+		if err != nil {
+			return nil, err
+		}
+		return r.netlink(nl), nil
+	}
+}
+
+// benign records an update that raced with another process and is treated as successful.
+func (r *netlinkRaces) benign(operation string, err error, fields logrus.Fields) {
+	atomic.AddInt64(&r.numRaces, 1)
+	counterBenignNetlinkRaces.WithLabelValues(operation).Inc()
+	r.logCxt.WithError(err).WithFields(fields).Warnf(
+		"Netlink %s failed but the dataplane is already as intended, treating as successful", operation)
+}
+
+// raceTolerantNetlink is a netlink client whose route and rule updates tolerate the races with other processes, see
+// netlinkRaces.
+type raceTolerantNetlink struct {
+	netlinkshim.Netlink
+	races *netlinkRaces
+}
+
+func (n *raceTolerantNetlink) RouteAdd(route *netlink.Route) error {
+	err := n.Netlink.RouteAdd(route)
+	if !isErrno(err, syscall.EEXIST) {
+		return err
+	}
+	existing, listErr := n.findRoute(route)
+	if listErr != nil {
+		return err
+	}
+	fields := logrus.Fields{"dst": route.Dst, "table": route.Table}
+	if existing != nil && routeContentMatches(*existing, *route) {
+		n.races.benign("route-add", err, fields)
+		return nil
+	}
+	n.races.logCxt.WithError(err).WithFields(fields).Warn("Route already exists with other content, replacing it")
+	return n.Netlink.RouteReplace(route)
+}
+
+func (n *raceTolerantNetlink) RouteDel(route *netlink.Route) error {
+	err := n.Netlink.RouteDel(route)
+	if !isErrno(err, syscall.ESRCH, syscall.ENOENT) {
+		return err
+	}
+	if existing, listErr := n.findRoute(route); listErr != nil || existing != nil {
+		// The route is still there, so the delete genuinely failed.
+		return err
+	}
+	n.races.benign("route-delete", err, logrus.Fields{"dst": route.Dst, "table": route.Table})
+	return nil
+}
+
+func (n *raceTolerantNetlink) RuleAdd(rule *netlink.Rule) error {
+	err := n.Netlink.RuleAdd(rule)
+	if !isErrno(err, syscall.EEXIST) {
+		return err
+	}
+	if found, listErr := n.findRule(rule); listErr != nil || !found {
+		// There is no such rule, the rule that exists conflicts with ours, e.g. another rule with the same priority.
+		return err
+	}
+	n.races.benign("rule-add", err, logrus.Fields{"priority": rule.Priority, "table": rule.Table})
+	return nil
+}
+
+func (n *raceTolerantNetlink) RuleDel(rule *netlink.Rule) error {
+	err := n.Netlink.RuleDel(rule)
+	if !isErrno(err, syscall.ESRCH, syscall.ENOENT) {
+		return err
+	}
+	if found, listErr := n.findRule(rule); listErr != nil || found {
+		return err
+	}
+	n.races.benign("rule-delete", err, logrus.Fields{"priority": rule.Priority, "table": rule.Table})
+	return nil
+}
+
+// findRoute returns the route in the routing table of the route with the same destination, interface and priority,
+// i.e. the route that the kernel would treat as the same route, or nil if there is none.
+func (n *raceTolerantNetlink) findRoute(route *netlink.Route) (*netlink.Route, error) {
+	family := netlink.FAMILY_V4
+	if route.Dst != nil && route.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	filter := &netlink.Route{Table: route.Table, LinkIndex: route.LinkIndex}
+	filterMask := uint64(netlink.RT_FILTER_TABLE)
+	if route.LinkIndex != 0 {
+		filterMask |= netlink.RT_FILTER_OIF
+	}
+	routes, err := n.Netlink.RouteListFiltered(family, filter, filterMask)
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		existing := routes[i]
+		if existing.LinkIndex == route.LinkIndex && ipNetString(existing.Dst) == ipNetString(route.Dst) &&
+			existing.Priority == route.Priority {
+			return &existing, nil
+		}
+	}
+	return nil, nil
+}
+
+// findRule returns true if the rule is programmed.
+func (n *raceTolerantNetlink) findRule(rule *netlink.Rule) (bool, error) {
+	family := rule.Family
+	if family == 0 {
+		family = netlink.FAMILY_V4
+	}
+	rules, err := n.Netlink.RuleList(family)
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range rules {
+		if reflect.DeepEqual(existing, *rule) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// routeContentMatches returns true if the route that exists for the destination routes the traffic as the route does.
+func routeContentMatches(existing, route netlink.Route) bool {
+	return routeType(existing.Type) == routeType(route.Type) && existing.Scope == route.Scope &&
+		existing.Protocol == route.Protocol && existing.Gw.Equal(route.Gw) && existing.Src.Equal(route.Src) &&
+		existing.Realm == route.Realm
+}
+
+// routeType returns the type of the route, as listed by the kernel, which lists a route added without a type as a
+// unicast route.
+func routeType(t int) int {
+	if t == 0 {
+		return syscall.RTN_UNICAST
+	}
+	return t
+}
+
+// ipNetString returns the CIDR of the destination, or "" if there is none.
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
+
+// isErrno returns true if the error is one of the errnos.
+func isErrno(err error, errnos ...syscall.Errno) bool {
+	for _, errno := range errnos {
+		if err == errno {
+			return true
+		}
+	}
+	return false
+}
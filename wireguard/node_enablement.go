@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// EnabledSource is what determines whether wireguard is enabled on this node, see Wireguard.Enabled.
+type EnabledSource string
+
+const (
+	// EnabledSourceConfig is the configuration, Config.Enabled.
+	EnabledSourceConfig EnabledSource = "config"
+
+	// EnabledSourceOverride is the node override, see Wireguard.SetNodeOverrideEnabled.
+	EnabledSourceOverride EnabledSource = "node-override"
+)
+
+// SetNodeOverrideEnabled overrides whether wireguard is enabled on this node, or follows Config.Enabled again if nil.
+// The override is ignored, with a warning, unless Config.AllowEnabledOverride is set. A change of the enabled state is
+// applied by the next Apply without recreating the wireguard module, so the cached configuration of the peers is
+// retained:
+//   - Once disabled, the wireguard configuration is removed in order and our public key is withdrawn, as if wireguard
+//     had been disabled from the start, see ensureDisabled.
+//   - Once enabled, the device, the routes and the rules are programmed from the cached configuration, as at start of
+//     day, and our public key is published once the device is configured.
+func (w *Wireguard) SetNodeOverrideEnabled(enabled *bool) {
+	if enabled != nil {
+		e := *enabled
+		enabled = &e
+	}
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true, Rules: true}, func() {
+		w.setNodeOverrideEnabled(enabled)
+	})
+	w.kick()
+}
+
+// Enabled returns whether wireguard is enabled on this node, and whether that is determined by the configuration or by
+// the node override. This reflects the overrides that have been processed by an Apply. This may be called from any
+// goroutine.
+func (w *Wireguard) Enabled() (enabled bool, source EnabledSource) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.enabled, w.enabledSource
+}
+
+func (w *Wireguard) setNodeOverrideEnabled(enabled *bool) {
+	if !w.config.AllowEnabledOverride {
+		if enabled != nil {
+			w.logCxt.WithField("enabled", *enabled).Warning(
+				"Wireguard node override of the enabled state is not allowed by the configuration, ignoring")
+		}
+		return
+	}
+	w.enabledOverride = enabled
+
+	effective, source := w.baseConfig.Enabled, EnabledSourceConfig
+	if enabled != nil {
+		effective, source = *enabled, EnabledSourceOverride
+	}
+	w.localConfigLock.Lock()
+	sourceChanged := source != w.enabledSource
+	w.enabled = effective
+	w.enabledSource = source
+	w.localConfigLock.Unlock()
+
+	if effective == w.config.Enabled {
+		w.logCxt.WithField("source", source).Debug("Wireguard enabled state is unchanged")
+		if sourceChanged {
+			// Publish our status again, so that the new source is reported.
+			w.ourPublicKeyAgreesWithDataplaneMsg = false
+		}
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{"enabled": effective, "source": source}).Info("Wireguard enabled state changed")
+	config := *w.config
+	config.Enabled = effective
+	w.config = &config
+	w.logCxt = w.logCxt.WithField("enabled", effective)
+	if effective {
+		w.onEnabled()
+	} else {
+		w.onDisabled()
+	}
+}
+
+// onEnabled prepares the programming of the wireguard configuration once wireguard is enabled at runtime. The next
+// Apply resyncs everything from the cached configuration.
+func (w *Wireguard) onEnabled() {
+	if w.deviceOwner != nil {
+		w.deviceOwner.enable(w.config.ipVersion())
+	}
+	w.queueResync()
+	w.ourPublicKeyAgreesWithDataplaneMsg = false
+}
+
+// onDisabled prepares the removal of the wireguard configuration once wireguard is disabled at runtime. The removal
+// itself is made by the next Apply, see ensureDisabled, which applies the routing tables flushed here. The cached
+// configuration of the peers is retained, with the peers and their routes flagged as no longer programmed, so that
+// everything is programmed again if wireguard is enabled again.
+func (w *Wireguard) onDisabled() {
+	if w.deviceOwner != nil {
+		w.deviceOwner.release(w.config.ipVersion())
+	}
+	w.clearRouteTargets()
+	w.cidrToTableIndex = map[ip.CIDR]int{}
+	w.routesPendingWireguard = map[ip.CIDR]pendingRoute{}
+	for name, node := range w.peers {
+		node.programmedInWireguard = false
+		node.routingToWireguard = false
+		update := w.getOrInitPeerUpdate(name)
+		update.cidrsReclassified = true
+		w.setPeerUpdate(name, update)
+		w.recountPeerCapacity(name)
+	}
+	w.resetPeerKeyTransitions()
+	w.retiredPreviousKeys = set.New()
+	w.localKeyTransition = nil
+	w.adoptedPeers = set.New()
+
+	w.setLinkUsable(false)
+	w.setAllInSync(false)
+	w.disableStep = disableStepPeers
+	w.ourPublicKeyAgreesWithDataplaneMsg = false
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/projectcalico/libcalico-go/lib/set"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// NodeState is the lifecycle state of a remote node in the cached configuration. The endpoint address, public key and
+// allowed CIDRs of a node arrive in separate updates, in any order, so the state is determined by which of the endpoint
+// address and public key are known. Whether the node is programmed as a wireguard peer, and the type of the routes of
+// its CIDRs, are decided from the state, see peerEligibility and cidrRouteType.
+type NodeState string
+
+const (
+	// NodeStateUnknown is a node with neither an endpoint address nor a public key. The node may have allowed CIDRs,
+	// which have throw routes, or have no cached configuration at all.
+	NodeStateUnknown NodeState = "unknown"
+
+	// NodeStateEndpointOnly is a node with an endpoint address but no public key, i.e. a node that has not enabled
+	// wireguard. Its CIDRs have throw routes.
+	NodeStateEndpointOnly NodeState = "endpoint-only"
+
+	// NodeStateKeyOnly is a node with a public key but no endpoint address, e.g. because the endpoint of the node has
+	// been removed but its wireguard configuration has not, or the endpoint of a new node has not yet been received.
+	// It is only programmed if Config.ProgramPeersWithoutEndpoint is set.
+	NodeStateKeyOnly NodeState = "key-only"
+
+	// NodeStateComplete is a node with both an endpoint address and a public key, which is programmed as a peer unless
+	// it is ineligible for another reason, e.g. it is drained or shares its key with another node.
+	NodeStateComplete NodeState = "complete"
+
+	// NodeStateRemoving is a node whose removal is being applied. Its peer and routes are removed, and its cached
+	// configuration is discarded, before any later updates of the node are applied.
+	NodeStateRemoving NodeState = "removing"
+)
+
+// NodeState returns the lifecycle state of a remote node.
+//
+// This is intended for tests and diagnostics, and must be called from the same goroutine as Apply.
+func (w *Wireguard) NodeState(name string) NodeState {
+	return w.nodeState(w.nodeName(name))
+}
+
+// nodeState returns the lifecycle state of a node, taking account of a removal that is being applied.
+func (w *Wireguard) nodeState(name string) NodeState {
+	node := w.peers[name]
+	if node == nil {
+		return NodeStateUnknown
+	} else if update := w.peerUpdates[name]; update != nil && update.deleted {
+		return NodeStateRemoving
+	}
+	return node.lifecycleState()
+}
+
+// lifecycleState returns the lifecycle state of the node data, from which of the endpoint address and public key are
+// known.
+func (p *peerData) lifecycleState() NodeState {
+	hasEndpoint, hasKey := p.ipv4EndpointAddr != nil, p.publicKey != zeroKey
+	switch {
+	case hasEndpoint && hasKey:
+		return NodeStateComplete
+	case hasKey:
+		return NodeStateKeyOnly
+	case hasEndpoint:
+		return NodeStateEndpointOnly
+	}
+	return NodeStateUnknown
+}
+
+// nodeStateChanged is called when the lifecycle state of a node changes, and logs the transitions that leave a peer
+// with a public key but no endpoint address, and the arrival of the missing endpoint address.
+func (w *Wireguard) nodeStateChanged(name string, node *peerData, from, to NodeState) {
+	if from == to {
+		return
+	}
+	logCxt := w.logCxt.WithFields(logrus.Fields{"node": name, "from": from, "to": to})
+	logCxt.Debug("Node lifecycle state changed")
+	if from != NodeStateKeyOnly && to != NodeStateKeyOnly {
+		return
+	}
+	logCxt = logCxt.WithField("publicKey", node.publicKey)
+	if to == NodeStateComplete {
+		logCxt.Info("Wireguard peer has received its endpoint address")
+	} else if to != NodeStateKeyOnly {
+		return
+	} else if w.config.ProgramPeersWithoutEndpoint {
+		logCxt.Warning("Wireguard peer has a public key but no endpoint address, programming it without an endpoint")
+	} else {
+		logCxt.Warning("Wireguard peer has a public key but no endpoint address, not routing its CIDRs through " +
+			"wireguard until the endpoint is updated or the wireguard configuration of the node is removed")
+	}
+}
+
+// peerIneligibility is the reason that a node cannot be programmed as a wireguard peer, see peerEligibility.
+type peerIneligibility int
+
+const (
+	peerEligible peerIneligibility = iota
+	peerIneligibleNoEndpoint
+	peerIneligibleNoKey
+	peerIneligibleOptedOut
+	peerIneligibleKeyConflict
+	peerIneligibleDrained
+	peerIneligibleNotReady
+)
+
+func (i peerIneligibility) String() string {
+	switch i {
+	case peerEligible:
+		return "eligible"
+	case peerIneligibleNoEndpoint:
+		return "no endpoint address"
+	case peerIneligibleNoKey:
+		return "no valid public key"
+	case peerIneligibleOptedOut:
+		return "excluded from encryption by policy"
+	case peerIneligibleKeyConflict:
+		return "multiple nodes are claiming the same key"
+	case peerIneligibleDrained:
+		return "administratively drained"
+	case peerIneligibleNotReady:
+		return "not ready for wireguard traffic"
+	}
+	return "unknown"
+}
+
+// peerEligibility returns whether a node can be programmed as a wireguard peer, from its lifecycle state and its
+// status. A node without a public key is never programmed, and a node with a key but no endpoint address only if
+// Config.ProgramPeersWithoutEndpoint is set. A node with a key may still be ineligible because it is opted out of
+// encryption, shares its key with another node, is drained, or, if Config.RequirePeerReady is set, is not ready.
+func (w *Wireguard) peerEligibility(name string, node *peerData) peerIneligibility {
+	switch node.lifecycleState() {
+	case NodeStateUnknown:
+		if !w.config.ProgramPeersWithoutEndpoint {
+			return peerIneligibleNoEndpoint
+		}
+		return peerIneligibleNoKey
+	case NodeStateEndpointOnly:
+		return peerIneligibleNoKey
+	case NodeStateKeyOnly:
+		if !w.config.ProgramPeersWithoutEndpoint {
+			return peerIneligibleNoEndpoint
+		}
+	}
+
+	if containsName(w.optedOutNodes, name) {
+		return peerIneligibleOptedOut
+	} else if w.numKeyClaimants(node.publicKey) != 1 {
+		return peerIneligibleKeyConflict
+	} else if containsName(w.drainedNodes, name) {
+		return peerIneligibleDrained
+	} else if w.config.RequirePeerReady && !containsName(w.readyNodes, name) {
+		return peerIneligibleNotReady
+	}
+	return peerEligible
+}
+
+// peerRouteType is the type of the route of a CIDR of a node.
+type peerRouteType int
+
+const (
+	// peerRouteNone is no route, so the lookup of our routing tables falls through to the next rule.
+	peerRouteNone peerRouteType = iota
+	// peerRouteThrow is a throw route, which returns the traffic to the default routing.
+	peerRouteThrow
+	// peerRouteWireguard is a unicast route to the wireguard interface.
+	peerRouteWireguard
+)
+
+// cidrRouteType returns the type of the route of a CIDR of a node. The CIDRs of a node that is routed to wireguard,
+// see shouldRouteToWireguard, are routed to the wireguard interface if they are programmed in wireguard, see
+// wireguardCIDRs, and have throw routes otherwise. The CIDRs of the other nodes have throw routes, or no routes if the
+// non-wireguard peers are excluded by our routing rules.
+func (w *Wireguard) cidrRouteType(routeToWireguard bool, wireguardCIDRs set.Set, cidr ip.CIDR) peerRouteType {
+	if !routeToWireguard && w.excludesNonWireguardPeersByRule() {
+		return peerRouteNone
+	} else if !routeToWireguard || !wireguardCIDRs.Contains(cidr) {
+		return peerRouteThrow
+	}
+	return peerRouteWireguard
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sort"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// NodeNameCanonicalizer returns the canonical form of a node name, so that the names of the same node that differ only
+// in format, e.g. in case, are treated as the same node. The canonicalizer must be idempotent.
+type NodeNameCanonicalizer func(name string) string
+
+// nodeNameState tracks the canonicalizer of the node names, and the order of the endpoint and public key updates of
+// the nodes. The order is used to prefer the newest endpoint and public key when the entries of two node names that
+// canonicalize to the same name are merged. The node names are interned, since each name is received again with every
+// update of the node and is held in many maps keyed by node name.
+type nodeNameState struct {
+	canonicalizer NodeNameCanonicalizer
+	seq           uint64
+	endpointSeq   map[string]uint64
+	keySeq        map[string]uint64
+	interned      map[string]string
+}
+
+func newNodeNameState() *nodeNameState {
+	return &nodeNameState{
+		endpointSeq: map[string]uint64{},
+		keySeq:      map[string]uint64{},
+		interned:    map[string]string{},
+	}
+}
+
+// intern returns the interned copy of a node name.
+func (s *nodeNameState) intern(name string) string {
+	if interned, ok := s.interned[name]; ok {
+		return interned
+	}
+	s.interned[name] = name
+	return name
+}
+
+// endpointUpdated records that the endpoint of a node has been updated.
+func (s *nodeNameState) endpointUpdated(name string) {
+	s.seq++
+	s.endpointSeq[name] = s.seq
+}
+
+// keyUpdated records that the public key of a node has been updated.
+func (s *nodeNameState) keyUpdated(name string) {
+	s.seq++
+	s.keySeq[name] = s.seq
+}
+
+// keyRemoved forgets the public key update of a node whose wireguard configuration has been removed.
+func (s *nodeNameState) keyRemoved(name string) {
+	delete(s.keySeq, name)
+}
+
+// nodeRemoved forgets the updates and the interned name of a removed node.
+func (s *nodeNameState) nodeRemoved(name string) {
+	delete(s.endpointSeq, name)
+	delete(s.keySeq, name)
+	delete(s.interned, name)
+}
+
+// SetNodeNameCanonicalizer sets the canonicalizer of the node names passed to the update methods, or removes it if nil.
+// The names of the subsequent updates, and our hostname, are canonicalized. The cached configuration of the nodes
+// received before the canonicalizer was set is re-keyed by the canonical name, merging the nodes whose names
+// canonicalize to the same name, see mergeNode.
+func (w *Wireguard) SetNodeNameCanonicalizer(canonicalizer NodeNameCanonicalizer) {
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true}, func() {
+		w.nodeNames.canonicalizer = canonicalizer
+		if canonicalizer == nil {
+			return
+		}
+		w.hostname = canonicalizer(w.hostname)
+		for _, name := range w.cachedNodeNames() {
+			if canonical := canonicalizer(name); canonical != name {
+				w.mergeNode(name, canonical)
+			}
+		}
+	})
+}
+
+// nodeName returns the interned canonical form of a node name, or of the name itself if there is no canonicalizer. This
+// is called when an update is applied, so that the canonicalizer in effect at the time is used.
+func (w *Wireguard) nodeName(name string) string {
+	if w.nodeNames.canonicalizer != nil {
+		name = w.nodeNames.canonicalizer(name)
+	}
+	return w.nodeNames.intern(name)
+}
+
+// containsName returns true if the set of node names contains the name. The name is only converted to an interface for
+// the lookup, which allocates, if the set is not empty, since the sets of drained, ready and over limit nodes are
+// checked for every peer by the passes over all of the peers and are usually empty.
+func containsName(names set.Set, name string) bool {
+	return names.Len() > 0 && names.Contains(name)
+}
+
+// cachedNodeNames returns the names of the nodes with any cached configuration, sorted so that the nodes are merged in
+// a consistent order.
+func (w *Wireguard) cachedNodeNames() []string {
+	names := map[string]bool{}
+	for name := range w.peers {
+		names[name] = true
+	}
+	for name := range w.peerUpdates {
+		names[name] = true
+	}
+	for _, name := range w.allowedCIDRToNodeName {
+		names[name] = true
+	}
+	for name := range w.nodeNameToInterfaceCIDR {
+		names[name] = true
+	}
+	for name := range w.nodeNameToSecondaryAddr {
+		names[name] = true
+	}
+	for _, nodes := range []set.Set{w.readyNodes, w.drainedNodes, w.optedOutNodes} {
+		nodes.Iter(func(item interface{}) error {
+			names[item.(string)] = true
+			return nil
+		})
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// nodeConfig is the cached configuration of a node, taking account of the pending updates.
+type nodeConfig struct {
+	endpointAddr  ip.Addr
+	publicKey     *peerKey
+	allowedCIDRs  map[ip.CIDR]RouteClass
+	ready         bool
+	drained       bool
+	optedOut      bool
+	secondaryAddr ip.Addr
+}
+
+// peerKey is the wireguard configuration of a node.
+type peerKey struct {
+	key           wgtypes.Key
+	port          int
+	interfaceAddr ip.Addr
+}
+
+// cachedNodeConfig returns the cached configuration of a node.
+func (w *Wireguard) cachedNodeConfig(name string) nodeConfig {
+	cfg := nodeConfig{
+		allowedCIDRs:  map[ip.CIDR]RouteClass{},
+		ready:         w.readyNodes.Contains(name),
+		drained:       w.drainedNodes.Contains(name),
+		optedOut:      w.optedOutNodes.Contains(name),
+		secondaryAddr: w.nodeNameToSecondaryAddr[name],
+	}
+	var key wgtypes.Key
+	var port int
+	update := w.peerUpdates[name]
+	if peer := w.peers[name]; peer != nil && (update == nil || !update.deleted) {
+		cfg.endpointAddr, key, port = peer.ipv4EndpointAddr, peer.publicKey, peer.listeningPort
+	}
+	if update != nil {
+		if update.ipv4EndpointAddr != nil {
+			cfg.endpointAddr = *update.ipv4EndpointAddr
+		}
+		if update.publicKey != nil {
+			key = *update.publicKey
+		}
+		if update.listeningPort != nil {
+			port = *update.listeningPort
+		}
+	}
+	if key != zeroKey {
+		cfg.publicKey = &peerKey{key: key, port: port}
+		if cidr, ok := w.nodeNameToInterfaceCIDR[name]; ok {
+			cfg.publicKey.interfaceAddr = cidr.Addr()
+		}
+	}
+	for cidr, cidrNodeName := range w.allowedCIDRToNodeName {
+		if cidrNodeName == name {
+			cfg.allowedCIDRs[cidr] = w.cidrToRouteClass[cidr]
+		}
+	}
+	return cfg
+}
+
+// mergeNode merges the cached configuration of a node into the node with the canonical form of its name, e.g. when the
+// host metadata and the wireguard configuration of the same node were received with names that differ in case. The
+// allowed CIDRs of both nodes are kept, and the newest of their endpoints and public keys is used. The node is then
+// removed.
+func (w *Wireguard) mergeNode(name, canonical string) {
+	from := w.cachedNodeConfig(name)
+	to := w.cachedNodeConfig(canonical)
+	w.logCxt.WithField("canonicalName", canonical).Warningf(
+		"Node name %s is not canonical, merging its configuration into the canonical node", name)
+
+	// Take the newest endpoint and key before removing the node, which forgets the order of its updates.
+	useEndpoint := from.endpointAddr != nil &&
+		(to.endpointAddr == nil || w.nodeNames.endpointSeq[name] > w.nodeNames.endpointSeq[canonical])
+	useKey := from.publicKey != nil &&
+		(to.publicKey == nil || w.nodeNames.keySeq[name] > w.nodeNames.keySeq[canonical])
+	w.endpointRemove(name)
+	w.drainedNodes.Discard(name)
+
+	if useEndpoint {
+		w.endpointUpdate(canonical, from.endpointAddr)
+	}
+	if useKey {
+		w.endpointWireguardUpdate(canonical, from.publicKey.key, from.publicKey.interfaceAddr, from.publicKey.port)
+	}
+	for cidr, class := range from.allowedCIDRs {
+		if _, ok := to.allowedCIDRs[cidr]; ok {
+			continue
+		} else if canonical == w.hostname {
+			w.localCIDRAdd(cidr, class)
+			continue
+		}
+		// This is not a move of the CIDR to a different node, so it is not subject to damping.
+		w.assignAllowedCIDR(canonical, cidr, class)
+	}
+	if from.secondaryAddr != nil && to.secondaryAddr == nil {
+		w.endpointSecondaryUpdate(canonical, from.secondaryAddr)
+	}
+	if from.ready && !to.ready {
+		w.endpointWireguardReady(canonical, true)
+	}
+	if from.drained && !to.drained {
+		w.endpointDrain(canonical, true)
+	}
+	if from.optedOut && !to.optedOut {
+		w.endpointWireguardOptOut(canonical, true)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NodeOverrides are the wireguard settings of this node that override the cluster-wide configuration, read from the
+// JSON file Config.NodeOverridesFile, e.g. {"listeningPort": 51821, "mtu": 1380}. The settings that are not set are
+// not overridden.
+type NodeOverrides struct {
+	ListeningPort *int `json:"listeningPort,omitempty"`
+	MTU           *int `json:"mtu,omitempty"`
+	// PersistentKeepalive is the keepalive interval in seconds, or 0 to disable the keepalives.
+	PersistentKeepalive *int `json:"persistentKeepalive,omitempty"`
+	RoutingRulePriority *int `json:"routingRulePriority,omitempty"`
+}
+
+// readNodeOverrides reads the overrides from the file. A file that does not exist has no overrides. Unknown settings
+// are rejected, so that a misspelt setting is not silently ignored.
+func readNodeOverrides(path string) (*NodeOverrides, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &NodeOverrides{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	overrides := &NodeOverrides{}
+	if err := decoder.Decode(overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// merge returns a copy of the configuration with the overrides.
+func (o *NodeOverrides) merge(config *Config) *Config {
+	merged := *config
+	if o.ListeningPort != nil {
+		merged.ListeningPort = *o.ListeningPort
+	}
+	if o.MTU != nil {
+		merged.MTU = *o.MTU
+	}
+	if o.PersistentKeepalive != nil {
+		merged.PersistentKeepalive = time.Duration(*o.PersistentKeepalive) * time.Second
+	}
+	if o.RoutingRulePriority != nil {
+		merged.RoutingRulePriority = *o.RoutingRulePriority
+	}
+	return &merged
+}
+
+// mergeNodeOverrides reads the overrides file and returns the base configuration merged with the overrides. If the
+// file cannot be read or parsed, or the merged configuration is not valid, a warning is logged and nil is returned, so
+// that the previous configuration is retained. The device settings of a shared device remain those of the owner.
+func mergeNodeOverrides(base *Config, deviceOwner *DeviceOwner, logCxt *logrus.Entry) *Config {
+	logCxt = logCxt.WithField("file", base.NodeOverridesFile)
+	overrides, err := readNodeOverrides(base.NodeOverridesFile)
+	if err != nil {
+		logCxt.WithError(err).Warning("Unable to read the wireguard node overrides, retaining the previous settings")
+		return nil
+	}
+	merged := overrides.merge(base)
+	if deviceOwner != nil {
+		merged = deviceOwner.deviceConfig(merged)
+	}
+	if err := merged.Validate(); err != nil {
+		logCxt.WithError(err).Warning("Wireguard node overrides are not valid, retaining the previous settings")
+		return nil
+	}
+	return merged
+}
+
+// reloadNodeOverrides reads the overrides file again, e.g. on a resync, so that an edit of the file is applied without
+// a restart. The settings that have changed are reprogrammed by the resync, and the listening port is published again.
+func (w *Wireguard) reloadNodeOverrides() {
+	if w.baseConfig.NodeOverridesFile == "" {
+		return
+	}
+	merged := mergeNodeOverrides(w.baseConfig, w.deviceOwner, w.logCxt)
+	if merged == nil || nodeOverridesEqual(merged, w.config) {
+		return
+	}
+	// The enabled state may be overridden separately, see SetNodeOverrideEnabled.
+	merged.Enabled = w.config.Enabled
+	w.logCxt.WithFields(logrus.Fields{
+		"listeningPort":       merged.ListeningPort,
+		"mtu":                 merged.MTU,
+		"persistentKeepalive": merged.PersistentKeepalive,
+		"routingRulePriority": merged.RoutingRulePriority,
+	}).Info("Wireguard node overrides updated")
+	if merged.ListeningPort != w.config.ListeningPort {
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
+	}
+	w.config = merged
+}
+
+// nodeOverridesEqual returns true if the settings that may be overridden are the same in both configurations.
+func nodeOverridesEqual(a, b *Config) bool {
+	return a.ListeningPort == b.ListeningPort && a.MTU == b.MTU && a.PersistentKeepalive == b.PersistentKeepalive &&
+		a.RoutingRulePriority == b.RoutingRulePriority
+}
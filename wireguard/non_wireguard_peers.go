@@ -0,0 +1,253 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/projectcalico/libcalico-go/lib/set"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// NonWireguardPeerHandling is how the traffic to the peers that are not routed to wireguard is kept out of the
+// wireguard routing tables, see Config.NonWireguardPeerHandling.
+type NonWireguardPeerHandling string
+
+const (
+	// NonWireguardPeerHandlingThrow programs a throw route for each CIDR of the peers that are not routed to
+	// wireguard. This is the default.
+	NonWireguardPeerHandlingThrow NonWireguardPeerHandling = "throw"
+	// NonWireguardPeerHandlingRuleExclude programs no routes for the CIDRs of the peers that are not routed to
+	// wireguard, so that the lookup of our routing tables falls through to the next routing rule. The CIDRs within a
+	// CIDR that is routed to wireguard, e.g. an address borrowed from the IPAM block of a wireguard peer, would match
+	// the route of that CIDR, so they have exclusion rules instead, see exclusionRules.
+	NonWireguardPeerHandlingRuleExclude NonWireguardPeerHandling = "rule-exclude"
+)
+
+// nonWireguardPeerHandling returns how the peers that are not routed to wireguard are handled, defaulting to
+// NonWireguardPeerHandlingThrow.
+func (c *Config) nonWireguardPeerHandling() NonWireguardPeerHandling {
+	if c.NonWireguardPeerHandling == "" {
+		return NonWireguardPeerHandlingThrow
+	}
+	return c.NonWireguardPeerHandling
+}
+
+// validateNonWireguardPeerHandling returns an error if the handling is not known, or if the exclusion rules would not
+// be above the local table rule.
+func (c *Config) validateNonWireguardPeerHandling() error {
+	switch c.nonWireguardPeerHandling() {
+	case NonWireguardPeerHandlingThrow:
+	case NonWireguardPeerHandlingRuleExclude:
+		if c.RoutingRulePriority-c.RoutingRulePriorityRange <= 1 {
+			return &ConfigError{Field: "RoutingRulePriority", Value: c.RoutingRulePriority,
+				Reason: "must be more than 1 above RoutingRulePriorityRange to allow for the exclusion rules"}
+		}
+	default:
+		return &ConfigError{Field: "NonWireguardPeerHandling", Value: c.NonWireguardPeerHandling,
+			Reason: "must be throw or rule-exclude"}
+	}
+	return nil
+}
+
+// excludesNonWireguardPeersByRule returns true if the CIDRs of the peers that are not routed to wireguard have no
+// routes, see NonWireguardPeerHandlingRuleExclude.
+func (w *Wireguard) excludesNonWireguardPeersByRule() bool {
+	return w.nonWireguardHandling == NonWireguardPeerHandlingRuleExclude
+}
+
+// updateNonWireguardPeerHandling updates how the peers that are not routed to wireguard are handled. The routes of
+// those peers are recalculated, which replaces the throw routes, or adds them back, and the exclusion rules are
+// recalculated by the next Apply.
+func (w *Wireguard) updateNonWireguardPeerHandling(handling NonWireguardPeerHandling) {
+	w.logCxt.Debugf("UpdateConfig: nonWireguardPeerHandling=%v", handling)
+	if handling == w.nonWireguardHandling {
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"oldHandling": w.nonWireguardHandling,
+		"newHandling": handling,
+	}).Info("Wireguard handling of non-wireguard peers updated, replacing their routes")
+	w.nonWireguardHandling = handling
+	for name, node := range w.peers {
+		if !node.routingToWireguard {
+			update := w.getOrInitPeerUpdate(name)
+			update.cidrsReclassified = true
+			w.setPeerUpdate(name, update)
+		}
+	}
+	w.exclusionCIDRsDirty = true
+}
+
+// removeExcludedPeerRoute removes any route for a CIDR of a peer that is not routed to wireguard, which has no route
+// with NonWireguardPeerHandlingRuleExclude. The route is either a throw route from before the handling was changed, or
+// the route to wireguard of a peer that is no longer routed to wireguard.
+func (w *Wireguard) removeExcludedPeerRoute(cidr ip.CIDR) {
+	delete(w.routesPendingWireguard, cidr)
+	tableIndex, ok := w.cidrToTableIndex[cidr]
+	if !ok {
+		return
+	}
+	w.logCxt.Debugf("Removing route for %s, which is excluded from wireguard by rule", cidr)
+	delete(w.cidrToTableIndex, cidr)
+	w.routetables[tableIndex].RouteRemove(w.config.InterfaceName, cidr)
+	w.routetables[tableIndex].RouteRemove(routetable.InterfaceNone, cidr)
+	w.summary.routesRemoved++
+}
+
+// updateExclusionCIDRs recalculates the CIDRs that have exclusion rules after the routes of the peers have been
+// updated, flagging the routing rules to be reconciled if the CIDRs have changed.
+func (w *Wireguard) updateExclusionCIDRs() {
+	if len(w.peerUpdates) == 0 && !w.exclusionCIDRsDirty {
+		return
+	}
+	w.exclusionCIDRsDirty = false
+
+	var cidrs []ip.CIDR
+	if w.excludesNonWireguardPeersByRule() {
+		cidrs = w.calculateExclusionCIDRs()
+	}
+	if cidrsEqual(cidrs, w.exclusionCIDRs) {
+		return
+	}
+	w.logCxt.WithField("cidrs", cidrs).Debug("Exclusion rule CIDRs updated")
+	w.exclusionCIDRs = cidrs
+	w.inSyncRouteRule = false
+}
+
+// calculateExclusionCIDRs returns the sorted CIDRs of the peers that are not routed to wireguard that are within a
+// CIDR of a peer that is routed to wireguard. The other CIDRs of the peers that are not routed to wireguard do not
+// match any of our routes, so they need no exclusion rule.
+func (w *Wireguard) calculateExclusionCIDRs() []ip.CIDR {
+	routed := map[ip.CIDR]bool{}
+	for _, node := range w.peers {
+		if node.routingToWireguard {
+			node.cidrs.Iter(func(item interface{}) error {
+				routed[item.(ip.CIDR)] = true
+				return nil
+			})
+		}
+	}
+	if len(routed) == 0 {
+		return nil
+	}
+
+	cidrs := set.New()
+	for _, node := range w.peers {
+		if node.routingToWireguard {
+			continue
+		}
+		node.cidrs.Iter(func(item interface{}) error {
+			cidr := item.(ip.CIDR)
+			for prefix := int(cidr.Prefix()) - 1; prefix >= 0; prefix-- {
+				if routed[ip.CIDRFromAddrAndPrefix(cidr.Addr(), prefix)] {
+					cidrs.Add(cidr)
+					break
+				}
+			}
+			return nil
+		})
+	}
+	return sortCIDRs(cidrs)
+}
+
+// exclusionRules returns the exclusion rules of the exclusion CIDRs, which are one above the priority of our routing
+// rules. An exclusion rule looks up the main routing table for the traffic to the CIDR, so the traffic uses the
+// route of the CIDR in the main table as it would after a throw route. If the main table has no more specific route
+// than the default route, the lookup is suppressed and the traffic continues to our routing rules.
+func (w *Wireguard) exclusionRules(priority int) []*netlink.Rule {
+	var rules []*netlink.Rule
+	for _, cidr := range w.exclusionCIDRs {
+		rule := netlink.NewRule()
+		rule.Priority = priority - 1
+		rule.Table = unix.RT_TABLE_MAIN
+		if w.config.ipVersion() == 6 {
+			rule.Family = netlink.FAMILY_V6
+		}
+		dst := cidr.ToIPNet()
+		rule.Dst = &dst
+		rule.SuppressPrefixlen = 0
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// isExclusionRule returns true if the rule looks like one of our exclusion rules, whichever priority our routing
+// rules were moved to, including the priority of our routing rules before RoutingRulePriority was overridden, see
+// exclusionRules and NodeOverrides.
+func (w *Wireguard) isExclusionRule(rule netlink.Rule) bool {
+	if rule.Table != unix.RT_TABLE_MAIN || rule.SuppressPrefixlen != 0 || rule.Dst == nil {
+		return false
+	}
+	c := w.config
+	return rule.Priority == w.rulePriority-1 || (rule.Priority >= c.RoutingRulePriority-c.RoutingRulePriorityRange-1 &&
+		rule.Priority <= c.RoutingRulePriority+c.RoutingRulePriorityRange-1)
+}
+
+// reconcileExclusionRules ensures the exclusion rules for the priority of our routing rules are programmed, deleting
+// the other rules that look like our exclusion rules, e.g. those of CIDRs that no longer need to be excluded or of
+// the previous priority. With NonWireguardPeerHandlingThrow all of the exclusion rules are deleted.
+func (w *Wireguard) reconcileExclusionRules(
+	netlinkClient netlinkshim.Netlink, rules []netlink.Rule, priority int,
+) error {
+	newrules := w.exclusionRules(priority)
+	found := map[*netlink.Rule]bool{}
+	for _, rule := range rules {
+		if !w.isExclusionRule(rule) {
+			continue
+		}
+		if newrule := findRouteRule(newrules, rule); newrule != nil && !found[newrule] {
+			found[newrule] = true
+			continue
+		}
+		if err := netlinkClient.RuleDel(&rule); netlinkshim.IsNotExist(err) {
+			w.logCxt.Debug("Wireguard exclusion rule already deleted")
+		} else if err != nil {
+			w.logCxt.WithError(err).Error("Unable to delete wireguard exclusion rule")
+			return err
+		} else {
+			w.summary.rulesRemoved++
+		}
+	}
+
+	for _, newrule := range newrules {
+		if found[newrule] {
+			continue
+		}
+		if err := netlinkClient.RuleAdd(newrule); err != nil {
+			w.logCxt.WithError(err).Error("Unable to create wireguard exclusion rule")
+			return err
+		}
+		w.logCxt.Debugf("Added exclusion rule: %v", newrule)
+		w.summary.rulesAdded++
+	}
+	return nil
+}
+
+func cidrsEqual(a, b []ip.CIDR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+)
+
+var counterUnconfirmedDeviceReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "felix_wireguard_unconfirmed_device_reads",
+	Help: "Number of resyncs whose read of the wireguard device was missing peers that a second read found.",
+})
+
+func init() {
+	prometheus.MustRegister(counterUnconfirmedDeviceReads)
+}
+
+// readDeviceForResync reads the wireguard device for a resync. If the device is missing more than
+// Config.ResyncDivergencePercent of the peers that should be programmed, and the previous resync found the device
+// in-sync, the read is suspect: a read made while another process reads or updates the device may return only some of
+// the peers, and acting on it would reconfigure every peer that appears to be missing. The device is read again, and
+// the divergence is only acted on if the second read confirms it. Otherwise the read is reported as unconfirmed, and
+// the device is left as it is until the next resync.
+func (w *Wireguard) readDeviceForResync(wireguardClient netlinkshim.Wireguard) (*wgtypes.Device, bool, error) {
+	device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+	if err != nil || w.config.ResyncDivergencePercent <= 0 || !w.lastResyncClean {
+		return device, true, err
+	}
+	expected, missing := w.countMissingPeers(device)
+	if !w.divergent(expected, missing) {
+		return device, true, nil
+	}
+
+	logCxt := w.logCxt.WithFields(logrus.Fields{"expectedPeers": expected, "missingPeers": missing})
+	logCxt.Info("Wireguard device is missing many of the peers, reading the device again")
+	device, err = wireguardClient.DeviceByName(w.config.InterfaceName)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, missing := w.countMissingPeers(device); w.divergent(expected, missing) {
+		logCxt.WithField("missingPeersOnReread", missing).Warning(
+			"Wireguard device is still missing many of the peers, reconciling the device")
+		return device, true, nil
+	}
+	logCxt.Warning("Second read of the wireguard device found the missing peers, not reconciling until the next resync")
+	counterUnconfirmedDeviceReads.Inc()
+	return device, false, nil
+}
+
+// countMissingPeers returns the number of peers that should be programmed, and the number of those that the device
+// does not have.
+func (w *Wireguard) countMissingPeers(device *wgtypes.Device) (expected, missing int) {
+	devicePeers := make(map[wgtypes.Key]bool, len(device.Peers))
+	for i := range device.Peers {
+		devicePeers[device.Peers[i].PublicKey] = true
+	}
+	for name, node := range w.peers {
+		if !w.shouldProgramWireguardPeer(name, node) {
+			continue
+		}
+		expected++
+		if !devicePeers[node.publicKey] {
+			missing++
+		}
+	}
+	return expected, missing
+}
+
+// divergent returns true if more than Config.ResyncDivergencePercent of the expected peers are missing.
+func (w *Wireguard) divergent(expected, missing int) bool {
+	return expected > 0 && missing*100 > expected*w.config.ResyncDivergencePercent
+}
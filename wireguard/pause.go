@@ -0,0 +1,147 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMaxPauseDuration is the longest reconciliation is paused for if Config.MaxPauseDuration is not set.
+const defaultMaxPauseDuration = 10 * time.Minute
+
+// pauseState tracks whether reconciliation is paused, see Wireguard.Pause. The state is set outside of the Apply
+// processing and is shared with the routing tables, which may be applied independently by the dataplane, so it is
+// protected by a lock.
+type pauseState struct {
+	lock sync.Mutex
+
+	// Whether reconciliation is paused, the time it was paused, and whether a resume has been requested. The pause is
+	// only lifted by Apply, once it has queued a resync of all of the configuration.
+	paused     bool
+	pausedTime time.Time
+	resume     bool
+}
+
+// isPaused returns true if reconciliation is paused.
+func (p *pauseState) isPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+// maxPauseDuration returns the longest reconciliation is paused for before it is resumed automatically.
+func (c *Config) maxPauseDuration() time.Duration {
+	if c.MaxPauseDuration <= 0 {
+		return defaultMaxPauseDuration
+	}
+	return c.MaxPauseDuration
+}
+
+// Pause pauses reconciliation, e.g. while the node networking is reconfigured during maintenance. While paused, Apply
+// makes no netlink or wireguard calls, and nor do the routing tables when they are applied by the dataplane, but the
+// updates are still processed into the cached configuration. Once resumed, by Resume or automatically once paused for
+// Config.MaxPauseDuration, the next Apply resyncs all of the configuration to reconcile whatever was changed while
+// paused. Pausing again while paused cancels a requested resume, but does not extend the pause. Teardown is not
+// paused.
+func (w *Wireguard) Pause() {
+	w.pause.lock.Lock()
+	defer w.pause.lock.Unlock()
+	if w.pause.paused {
+		w.logCxt.Info("Wireguard reconciliation is already paused")
+		w.pause.resume = false
+		return
+	}
+	w.logCxt.WithField("maxPauseDuration", w.config.maxPauseDuration()).Warning("Pausing wireguard reconciliation")
+	w.pause.paused = true
+	w.pause.pausedTime = w.time.Now()
+	w.pause.resume = false
+}
+
+// Resume resumes the reconciliation paused by Pause. The pause is lifted by the next Apply, which is requested through
+// the kick callback.
+func (w *Wireguard) Resume() {
+	w.pause.lock.Lock()
+	resume := w.pause.paused && !w.pause.resume
+	w.pause.resume = w.pause.paused
+	w.pause.lock.Unlock()
+
+	if resume {
+		w.logCxt.Info("Resume of wireguard reconciliation requested")
+		w.kick()
+	}
+}
+
+// Paused returns true if reconciliation is paused, including if a resume has been requested but not yet applied.
+func (w *Wireguard) Paused() bool {
+	return w.pause.isPaused()
+}
+
+// ResumeAfter returns the time until reconciliation is resumed, or zero if it is not paused. Apply must be called after
+// this time for the pause to be lifted. This must be called from the same goroutine as Apply.
+func (w *Wireguard) ResumeAfter() time.Duration {
+	if w.tornDown {
+		return 0
+	}
+	w.pause.lock.Lock()
+	defer w.pause.lock.Unlock()
+	if !w.pause.paused {
+		return 0
+	}
+	after := w.config.maxPauseDuration() - w.time.Since(w.pause.pausedTime)
+	if w.pause.resume || after <= 0 {
+		// The resume is already due.
+		return time.Millisecond
+	}
+	return after
+}
+
+// applyPaused returns true if reconciliation is paused. If a resume has been requested, or the pause has reached
+// Config.MaxPauseDuration, the pause is lifted and a resync of all of the configuration is queued instead. This is
+// called from Apply.
+func (w *Wireguard) applyPaused() bool {
+	w.pause.lock.Lock()
+	defer w.pause.lock.Unlock()
+	if !w.pause.paused {
+		return false
+	}
+	pausedFor := w.time.Since(w.pause.pausedTime)
+	if !w.pause.resume && pausedFor < w.config.maxPauseDuration() {
+		w.logCxt.Debug("Wireguard reconciliation is paused - not applying updates")
+		return true
+	}
+
+	logCxt := w.logCxt.WithField("pausedFor", pausedFor)
+	if w.pause.resume {
+		logCxt.Info("Resuming wireguard reconciliation")
+	} else {
+		logCxt.Warning("Wireguard reconciliation paused for the maximum duration, resuming")
+	}
+
+	// Queue the resync before lifting the pause, so that the routing tables are not applied by the dataplane without
+	// first being resynced.
+	w.queueResync()
+	w.pause.paused = false
+	w.pause.resume = false
+	return false
+}
+
+// clearPause lifts the pause without a resync, e.g. when the configuration is torn down.
+func (w *Wireguard) clearPause() {
+	w.pause.lock.Lock()
+	defer w.pause.lock.Unlock()
+	w.pause.paused = false
+	w.pause.resume = false
+}
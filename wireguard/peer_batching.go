@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPeerBatchWindow is the window in which the updated peers are counted if Config.PeerBatchWindow is not set.
+const defaultPeerBatchWindow = 10 * time.Second
+
+var counterPeerBatches = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "felix_wireguard_peer_batches",
+	Help: "Number of bursts of wireguard peer updates that were held and applied as a single batch.",
+})
+
+func init() {
+	prometheus.MustRegister(counterPeerBatches)
+}
+
+// peerBatchState tracks the peers updated within the current window, and whether the programming of the peers is held
+// to coalesce a burst of updates, see Config.PeerBatchThreshold.
+type peerBatchState struct {
+	// The start of the window, and the peers updated within the window. The window starts with the first update after
+	// the previous window has ended or a batch has been flushed.
+	windowStart time.Time
+	peers       map[string]bool
+
+	// Whether the peer updates are held, and the time the held updates are due to be flushed.
+	holding   bool
+	flushTime time.Time
+}
+
+// peerBatchWindow returns the window in which the updated peers are counted.
+func (c *Config) peerBatchWindow() time.Duration {
+	if c.PeerBatchWindow <= 0 {
+		return defaultPeerBatchWindow
+	}
+	return c.PeerBatchWindow
+}
+
+// PeerBatchFlushAfter returns the time until the held peer updates are due to be flushed, or zero if no updates are
+// held. Apply must be called after this time for the held updates to be programmed. This must be called from the same
+// goroutine as Apply.
+func (w *Wireguard) PeerBatchFlushAfter() time.Duration {
+	if w.tornDown || !w.peerBatch.holding {
+		return 0
+	}
+	after := w.peerBatch.flushTime.Sub(w.time.Now())
+	if after <= 0 {
+		// The flush is already due.
+		return time.Millisecond
+	}
+	return after
+}
+
+// holdPeerBatch returns true if the programming of the updated peers and their routes should be held for this Apply,
+// because more than Config.PeerBatchThreshold peers have been updated within the window. The held updates remain in
+// the pending peer updates, and are merged with the later updates until the window ends or an update forces the batch
+// to be flushed, see peerBatchFlushReason. This is called from Apply once the link is known to be up.
+func (w *Wireguard) holdPeerBatch(linkUp bool) bool {
+	if w.config.PeerBatchThreshold <= 0 || len(w.peerUpdates) == 0 {
+		return false
+	}
+	b := &w.peerBatch
+	now := w.time.Now()
+	if !b.holding {
+		window := w.config.peerBatchWindow()
+		if b.peers == nil || now.Sub(b.windowStart) >= window {
+			b.windowStart = now
+			b.peers = map[string]bool{}
+		}
+		for name := range w.peerUpdates {
+			b.peers[name] = true
+		}
+		if len(b.peers) <= w.config.PeerBatchThreshold {
+			return false
+		}
+		b.holding = true
+		b.flushTime = b.windowStart.Add(window)
+		counterPeerBatches.Inc()
+		w.logCxt.WithFields(logrus.Fields{
+			"peers":     len(b.peers),
+			"flushTime": b.flushTime,
+		}).Info("Burst of wireguard peer updates, holding the peer programming to apply the updates as one batch")
+	}
+
+	reason := w.peerBatchFlushReason(linkUp, now)
+	if reason == "" {
+		w.logCxt.WithField("heldPeers", len(w.peerUpdates)).Debug("Holding the wireguard peer updates")
+		return true
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"heldPeers": len(w.peerUpdates),
+		"reason":    reason,
+	}).Info("Applying the held wireguard peer updates")
+	b.holding = false
+	b.peers = nil
+	return false
+}
+
+// peerBatchFlushReason returns the reason that the held peer updates must be applied by this Apply, or "" if they may
+// remain held. The updates are applied once the window has ended, and whenever the Apply programs the device or the
+// routes in full regardless. Updates that connectivity depends on are not held: an update of our own public key, which
+// the peers need our configuration to match, and a peer that had no public key, whose traffic is not encrypted until it
+// is programmed.
+func (w *Wireguard) peerBatchFlushReason(linkUp bool, now time.Time) string {
+	if !now.Before(w.peerBatch.flushTime) {
+		return "the batch window has ended"
+	} else if !linkUp || !w.inSyncWireguard || !w.inSyncRouteRule || len(w.routesPendingWireguard) > 0 {
+		return "the wireguard configuration is being resynced"
+	} else if !w.ourPublicKeyAgreesWithDataplaneMsg {
+		return "our public key is updated"
+	}
+	for _, rt := range w.routetables {
+		if !rt.InSync() {
+			return "the wireguard configuration is being resynced"
+		}
+	}
+	for name, update := range w.peerUpdates {
+		if update.publicKey == nil || *update.publicKey == zeroKey {
+			continue
+		}
+		if node := w.peers[name]; node == nil || node.publicKey == zeroKey {
+			return "a peer without a public key has a public key"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+// PendingWorkSummary describes the work that remains for Apply: the updates that have been queued and not yet applied,
+// and the configuration that a previous Apply did not complete, e.g. because it failed. The flags are conservative, an
+// update is flagged when it is queued even if it turns out to require no change.
+type PendingWorkSummary struct {
+	// Key is set if our public key has yet to be published, or if the public key of a node has been updated or removed.
+	// Encrypted traffic to and from the affected nodes is dropped until these are applied, so an Apply should be
+	// scheduled without waiting for other dataplane programming.
+	Key bool
+
+	// Peers is set if the wireguard peers are to be updated or resynced.
+	Peers bool
+
+	// Routes is set if the routes in the wireguard routing tables are to be updated or resynced.
+	Routes bool
+
+	// Rules is set if the routing rules, or the underlay routing, are to be updated.
+	Rules bool
+
+	// QueuedUpdates is the number of updates queued since the last Apply.
+	QueuedUpdates int
+}
+
+// pending returns true if there is any pending work.
+func (s PendingWorkSummary) pending() bool {
+	return s.Key || s.Peers || s.Routes || s.Rules || s.QueuedUpdates > 0
+}
+
+// merge adds the flags of the other summary to the summary.
+func (s *PendingWorkSummary) merge(other PendingWorkSummary) {
+	s.Key = s.Key || other.Key
+	s.Peers = s.Peers || other.Peers
+	s.Routes = s.Routes || other.Routes
+	s.Rules = s.Rules || other.Rules
+}
+
+// HasPendingWork returns true if there are updates that have not been applied, or configuration that the last Apply did
+// not complete. The work being applied by an Apply in progress remains pending until that Apply completes. This does
+// not query the dataplane, and may be called from any goroutine.
+func (w *Wireguard) HasPendingWork() bool {
+	return w.PendingWorkSummary().pending()
+}
+
+// PendingWorkSummary returns the details of the pending work, see HasPendingWork. This may be called from any
+// goroutine.
+func (w *Wireguard) PendingWorkSummary() PendingWorkSummary {
+	w.queuedUpdatesLock.Lock()
+	defer w.queuedUpdatesLock.Unlock()
+	summary := w.queuedWork
+	summary.merge(w.unappliedWork)
+	summary.QueuedUpdates = len(w.queuedUpdates)
+	return summary
+}
+
+// setUnappliedWork records the work that remains once an Apply or Teardown completes.
+func (w *Wireguard) setUnappliedWork(work PendingWorkSummary) {
+	w.queuedUpdatesLock.Lock()
+	defer w.queuedUpdatesLock.Unlock()
+	w.unappliedWork = work
+}
+
+// remainingWork returns the work left by the Apply that has just completed, derived from the in-sync state. There is
+// no work that an Apply can make progress on while wireguard is torn down or has an invalid routing table. While the
+// Apply is waiting for the wireguard link to come up, since the interface state change is queued as an update, or while
+// wireguard is not supported, only the throw routes and the routing rule are applied. The adopted peers that are left
+// intact until the datastore is in sync are not pending work, but the peer updates held in a batch are.
+func (w *Wireguard) remainingWork(waitingForLink bool) PendingWorkSummary {
+	if w.tornDown || w.routingTableErr != nil {
+		return PendingWorkSummary{}
+	}
+	if !w.config.Enabled {
+		// The wireguard configuration is removed until it is in-sync.
+		return PendingWorkSummary{
+			Peers:  !w.inSyncWireguard,
+			Routes: !w.inSyncWireguard,
+			Rules:  !w.inSyncWireguard,
+		}
+	}
+
+	routes := len(w.routesPendingWireguard) > 0
+	for _, rt := range w.RouteTableSyncers() {
+		routes = routes || !rt.InSync()
+	}
+	if waitingForLink || w.wireguardNotSupported {
+		return PendingWorkSummary{
+			Routes: routes,
+			Rules:  !w.inSyncRouteRule,
+		}
+	}
+	return PendingWorkSummary{
+		Key:    !w.ourPublicKeyAgreesWithDataplaneMsg && !(w.localAddressWaitReported && w.waitingForLocalAddress()),
+		Peers:  (!w.inSyncWireguard && !w.adopting()) || w.peerBatch.holding,
+		Routes: routes || w.peerBatch.holding,
+		Rules:  !w.inSyncRouteRule || (w.underlayEnabled() && !w.inSyncUnderlay),
+	}
+}
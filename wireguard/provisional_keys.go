@@ -0,0 +1,170 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// removedNode is the wireguard configuration of a node that has been removed, which is carried over to a node added
+// with the same endpoint address, see Config.ProvisionalKeyTimeout.
+type removedNode struct {
+	name          string
+	publicKey     wgtypes.Key
+	listeningPort int
+	removedTime   time.Time
+}
+
+// provisionalKey is the public key of a removed node that a node with the same endpoint address uses until its own key
+// arrives.
+type provisionalKey struct {
+	fromNode   string
+	publicKey  wgtypes.Key
+	expiryTime time.Time
+}
+
+// rememberRemovedNode remembers the key of a node that is being removed, so that it can be carried over to a node that
+// is added with the same endpoint address. The key is that of the programmed peer, so it is remembered even if the
+// wireguard configuration of the node was removed by the same batch of updates.
+func (w *Wireguard) rememberRemovedNode(name string) {
+	delete(w.provisionalKeys, name)
+	if w.config.ProvisionalKeyTimeout <= 0 {
+		return
+	}
+	node := w.peers[name]
+	if node == nil || node.publicKey == zeroKey || node.ipv4EndpointAddr == nil {
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{"node": name, "endpoint": node.ipv4EndpointAddr}).Debug(
+		"Remembering the key of the removed node for a node added with the same endpoint")
+	w.removedNodes[node.ipv4EndpointAddr] = &removedNode{
+		name:          name,
+		publicKey:     node.publicKey,
+		listeningPort: node.listeningPort,
+		removedTime:   w.time.Now(),
+	}
+}
+
+// carryOverRemovedNodeKey gives a node the key of a node removed within the timeout that had the same endpoint address,
+// unless the node already has a key or a pending update of its key. The key is provisional until the key of the node
+// arrives, see confirmProvisionalKey.
+func (w *Wireguard) carryOverRemovedNodeKey(name string, ipv4Addr ip.Addr, update *peerUpdateData) {
+	removed := w.removedNodes[ipv4Addr]
+	if removed == nil {
+		return
+	}
+	delete(w.removedNodes, ipv4Addr)
+	if removed.name == name || w.time.Since(removed.removedTime) >= w.config.ProvisionalKeyTimeout {
+		return
+	}
+	if update.publicKey != nil {
+		return
+	} else if existing := w.getProgrammedPeer(name); existing != nil && existing.publicKey != zeroKey {
+		return
+	}
+
+	w.logCxt.WithFields(logrus.Fields{
+		"node":        name,
+		"removedNode": removed.name,
+		"endpoint":    ipv4Addr,
+		"publicKey":   removed.publicKey,
+	}).Info("Node added with the endpoint of a recently removed node, using the key of that node provisionally")
+	publicKey := removed.publicKey
+	update.publicKey = &publicKey
+	w.setPeerListeningPort(name, update, removed.listeningPort)
+	w.provisionalKeys[name] = &provisionalKey{
+		fromNode:   removed.name,
+		publicKey:  publicKey,
+		expiryTime: w.time.Now().Add(w.config.ProvisionalKeyTimeout),
+	}
+}
+
+// confirmProvisionalKey forgets the provisional key of a node once its own wireguard configuration has been updated or
+// removed, which replaces the provisional key.
+func (w *Wireguard) confirmProvisionalKey(name string, publicKey wgtypes.Key) {
+	pk := w.provisionalKeys[name]
+	if pk == nil {
+		return
+	}
+	delete(w.provisionalKeys, name)
+	logCxt := w.logCxt.WithFields(logrus.Fields{"node": name, "removedNode": pk.fromNode})
+	if publicKey == pk.publicKey {
+		logCxt.Info("Provisional key of the node has been confirmed")
+	} else {
+		logCxt.Info("Provisional key of the node has been replaced")
+	}
+}
+
+// expireProvisionalKeys drops the provisional keys that have not been confirmed within the timeout, and forgets the
+// removed nodes whose keys can no longer be carried over.
+func (w *Wireguard) expireProvisionalKeys() {
+	if len(w.removedNodes) == 0 && len(w.provisionalKeys) == 0 {
+		return
+	}
+	for addr, removed := range w.removedNodes {
+		if w.time.Since(removed.removedTime) >= w.config.ProvisionalKeyTimeout {
+			delete(w.removedNodes, addr)
+		}
+	}
+	now := w.time.Now()
+	for name, pk := range w.provisionalKeys {
+		if now.Before(pk.expiryTime) {
+			continue
+		}
+		w.logCxt.WithFields(logrus.Fields{"node": name, "removedNode": pk.fromNode}).Warning(
+			"Provisional key of the node has not been confirmed, dropping the key")
+		delete(w.provisionalKeys, name)
+		update := w.getOrInitPeerUpdate(name)
+		update.publicKey = &zeroKey
+		w.setPeerListeningPort(name, update, 0)
+		w.setPeerUpdate(name, update)
+	}
+}
+
+// ProvisionalKeyExpiryAfter returns the time until the next provisional key is due to be dropped, or zero if there are
+// no provisional keys. Apply must be called after this time for the key to be dropped. This must be called from the
+// same goroutine as Apply.
+func (w *Wireguard) ProvisionalKeyExpiryAfter() time.Duration {
+	if len(w.provisionalKeys) == 0 {
+		return 0
+	}
+	var expiryAfter time.Duration
+	now := w.time.Now()
+	for _, pk := range w.provisionalKeys {
+		after := pk.expiryTime.Sub(now)
+		if after <= 0 {
+			// The expiry is already due.
+			return time.Millisecond
+		}
+		if expiryAfter == 0 || after < expiryAfter {
+			expiryAfter = after
+		}
+	}
+	return expiryAfter
+}
+
+// provisionalKeyFrom returns the name of the removed node whose key the node is using provisionally, or "" if the node
+// is not using a provisional key.
+func (w *Wireguard) provisionalKeyFrom(name string) string {
+	if pk := w.provisionalKeys[name]; pk != nil {
+		return pk.fromNode
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+)
+
+// NotSupported returns true if wireguard is enabled but has been found not to be supported, e.g. because the kernel
+// does not have the wireguard module, along with the time support is next re-probed. The re-probe time is zero if
+// support is only probed again on a resync. This may be called from any goroutine.
+func (w *Wireguard) NotSupported() (notSupported bool, reprobeTime time.Time) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.notSupported, w.reprobeTime
+}
+
+// ReprobeAfter returns the time until wireguard support is next re-probed, or zero if no re-probe is scheduled. Apply
+// must be called after this time for the re-probe to take place. This must be called from the same goroutine as Apply.
+func (w *Wireguard) ReprobeAfter() time.Duration {
+	if !w.config.Enabled || w.tornDown || !w.wireguardNotSupported || w.reprobeTime.IsZero() {
+		return 0
+	}
+	if after := w.reprobeTime.Sub(w.time.Now()); after > 0 {
+		return after
+	}
+	// The re-probe is already due.
+	return time.Millisecond
+}
+
+// scheduleReprobe schedules the next re-probe of wireguard support after it has been found not to be supported. The
+// first re-probe is after a short delay, in case wireguard is being set up at the same time as felix starts, and
+// subsequent re-probes use the configured interval.
+func (w *Wireguard) scheduleReprobe() {
+	var reprobeTime time.Time
+	if interval := w.config.NotSupportedReprobeInterval; interval > 0 {
+		delay := interval
+		if w.failedReprobes == 0 && delay > notSupportedFirstReprobeDelay {
+			delay = notSupportedFirstReprobeDelay
+		}
+		w.failedReprobes++
+		reprobeTime = w.time.Now().Add(delay)
+		w.logCxt.WithField("reprobeTime", reprobeTime).Info("Wireguard support will be re-probed")
+	}
+
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.notSupported = true
+	w.reprobeTime = reprobeTime
+}
+
+// reprobeDue returns true if a re-probe of wireguard support is scheduled and due.
+func (w *Wireguard) reprobeDue() bool {
+	return !w.reprobeTime.IsZero() && !w.time.Now().Before(w.reprobeTime)
+}
+
+// clearNotSupported records that wireguard is no longer known to be unsupported, either because it has been found to be
+// supported or because it is disabled. If wireguard is later found not to be supported the first re-probe delay is
+// used again.
+func (w *Wireguard) clearNotSupported() {
+	w.failedReprobes = 0
+	if !w.notSupported {
+		return
+	}
+	w.logCxt.Info("Wireguard is no longer flagged as not supported")
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.notSupported = false
+	w.reprobeTime = time.Time{}
+}
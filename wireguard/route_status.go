@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// RouteState is how a CIDR is programmed in the wireguard routing tables, see Wireguard.RouteStatuses.
+type RouteState string
+
+const (
+	// RouteStateUnicast is a CIDR that is routed to the wireguard interface, and encrypted for the peer.
+	RouteStateUnicast RouteState = "Unicast"
+	// RouteStateThrow is a CIDR that has a throw route, so that its traffic falls through to the next routing rule, e.g.
+	// the CIDR of a peer that is not routed to wireguard or a local CIDR.
+	RouteStateThrow RouteState = "Throw"
+	// RouteStatePending is a CIDR whose route to the wireguard interface is held back until the CIDR is programmed as an
+	// allowed IP of the peer, or whose route has yet to be programmed, e.g. because the routing table failed to apply.
+	// Any previous route of the CIDR is retained until then.
+	RouteStatePending RouteState = "Pending"
+	// RouteStateSuppressed is a CIDR of a peer that has no route, e.g. because the CIDR is excluded or the peer is
+	// excluded by rule, see NonWireguardPeerHandlingRuleExclude.
+	RouteStateSuppressed RouteState = "Suppressed"
+)
+
+// RouteStatus is the programming state of a CIDR in the wireguard routing tables.
+type RouteStatus struct {
+	CIDR  ip.CIDR
+	State RouteState
+
+	// Peer is the name of the node that the CIDR belongs to, or "" for a local CIDR.
+	Peer string
+
+	// TableIndex is the routing table of the route, or 0 if the CIDR has no route.
+	TableIndex int
+}
+
+// RouteStatuses returns the state of each CIDR that is programmed in the wireguard routing tables, and of each CIDR of
+// a peer that has no route, sorted by CIDR. The state is that of the last Apply, and is calculated from the cached
+// routes without reading the routing tables. No routes are reported if wireguard is not enabled or has been torn down.
+// This should be called from the same goroutine as Apply.
+func (w *Wireguard) RouteStatuses() []RouteStatus {
+	if !w.config.Enabled || w.tornDown {
+		return nil
+	}
+
+	statuses := map[ip.CIDR]RouteStatus{}
+	for _, rt := range w.RouteTableSyncers() {
+		for cidr := range rt.AppliedTargets(w.config.InterfaceName) {
+			statuses[cidr] = RouteStatus{CIDR: cidr, State: RouteStateUnicast, TableIndex: rt.TableIndex()}
+		}
+		for cidr, target := range rt.AppliedTargets(routetable.InterfaceNone) {
+			if target.Type == routetable.TargetTypeThrow {
+				statuses[cidr] = RouteStatus{CIDR: cidr, State: RouteStateThrow, TableIndex: rt.TableIndex()}
+			}
+		}
+	}
+	for cidr, pending := range w.routesPendingWireguard {
+		statuses[cidr] = RouteStatus{CIDR: cidr, State: RouteStatePending, TableIndex: w.tableIndexForCIDR(cidr),
+			Peer: pending.nodeName}
+	}
+	for cidr, name := range w.cidrToNodeName {
+		status, ok := statuses[cidr]
+		if !ok {
+			status = RouteStatus{CIDR: cidr, State: RouteStateSuppressed}
+			if tableIndex, ok := w.cidrToTableIndex[cidr]; ok {
+				// The route has been updated, but not yet applied.
+				status.State, status.TableIndex = RouteStatePending, tableIndex
+			}
+		}
+		status.Peer = name
+		statuses[cidr] = status
+	}
+
+	cidrs := set.New()
+	for cidr := range statuses {
+		cidrs.Add(cidr)
+	}
+	sorted := make([]RouteStatus, 0, len(statuses))
+	for _, cidr := range sortCIDRs(cidrs) {
+		sorted = append(sorted, statuses[cidr])
+	}
+	return sorted
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"sync"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// RouteTableSyncer wraps one of the routing tables owned by the wireguard module. The wireguard module updates the
+// routes and applies the table as part of its own Apply, but the table may also be synced independently by the
+// dataplane, so all access to the underlying routetable is serialized. The routes are held by the shared routetable,
+// so the cleanup grace period, the conntrack cleanup of removed routes and the handling of deleted links are the same
+// as for the other routing tables programmed by felix.
+type RouteTableSyncer struct {
+	lock       sync.Mutex
+	tableIndex int
+	routetable *routetable.RouteTable
+
+	// The pause state of the wireguard module, see Wireguard.Pause.
+	pause *pauseState
+
+	// The catch-all route to the wireguard interface, and the routes requested for the interface, while the routes to
+	// the interface are programmed through the catch-all route, see Config.CatchAllRoute. Nil otherwise.
+	catchAll *catchAllRoutes
+
+	// The numbers of the routes requested of the routing table, see RouteCounts.
+	unicastRoutes int
+	throwRoutes   int
+}
+
+func newRouteTableSyncer(tableIndex int, rt *routetable.RouteTable, pause *pauseState) *RouteTableSyncer {
+	return &RouteTableSyncer{
+		tableIndex: tableIndex,
+		routetable: rt,
+		pause:      pause,
+	}
+}
+
+// TableIndex returns the index of the routing table.
+func (r *RouteTableSyncer) TableIndex() int {
+	return r.tableIndex
+}
+
+func (r *RouteTableSyncer) OnIfaceStateChanged(ifaceName string, state ifacemonitor.State) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routetable.OnIfaceStateChanged(ifaceName, state)
+}
+
+func (r *RouteTableSyncer) QueueResync() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routetable.QueueResync()
+}
+
+// QueueRebuild queues a resync that also removes the routes on other interfaces from the routing table.
+func (r *RouteTableSyncer) QueueRebuild() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routetable.QueueRebuild()
+}
+
+// InSync returns true if the routing table has no pending updates.
+func (r *RouteTableSyncer) InSync() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.routetable.InSync()
+}
+
+// InterfaceInSync returns true if the routes of the interface have been applied, ignoring the pending conntrack
+// cleanups.
+func (r *RouteTableSyncer) InterfaceInSync(ifaceName string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.routetable.InterfaceInSync(ifaceName)
+}
+
+// Apply applies the routing table when it is synced by the dataplane. This does nothing while the wireguard module is
+// paused, see Wireguard.Pause.
+func (r *RouteTableSyncer) Apply() error {
+	if r.pause.isPaused() {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.routetable.Apply()
+	r.catchAllApplied(err)
+	return err
+}
+
+// ApplyWithContext applies the routing table with the netlink calls bounded by the context. This is used by the
+// wireguard module, which checks whether it is paused itself.
+func (r *RouteTableSyncer) ApplyWithContext(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.routetable.ApplyWithContext(ctx)
+	r.catchAllApplied(err)
+	return err
+}
+
+func (r *RouteTableSyncer) RouteUpdate(ifaceName string, target routetable.Target) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	defer r.countRouteChange(ifaceName, target.CIDR)()
+	if r.catchAll != nil {
+		r.catchAllRouteUpdate(ifaceName, target)
+		return
+	}
+	r.routetable.RouteUpdate(ifaceName, target)
+}
+
+func (r *RouteTableSyncer) RouteRemove(ifaceName string, cidr ip.CIDR) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	defer r.countRouteChange(ifaceName, cidr)()
+	if r.catchAll != nil {
+		r.catchAllRouteRemove(ifaceName, cidr)
+		return
+	}
+	r.routetable.RouteRemove(ifaceName, cidr)
+}
+
+// SetRoutes replaces the targets for an interface.
+func (r *RouteTableSyncer) SetRoutes(ifaceName string, targets []routetable.Target) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.countRoutes(ifaceName, r.targets(ifaceName), -1)
+	defer func() {
+		r.countRoutes(ifaceName, r.targets(ifaceName), 1)
+	}()
+	if r.catchAll != nil {
+		r.catchAllSetRoutes(ifaceName, targets)
+		return
+	}
+	r.routetable.SetRoutes(ifaceName, targets)
+}
+
+// Targets returns the expected targets for an interface, including any updates that have not yet been applied. While
+// the routes to the wireguard interface are programmed through the catch-all route, these are the routes requested
+// for the interface rather than the routes programmed.
+func (r *RouteTableSyncer) Targets(ifaceName string) map[ip.CIDR]routetable.Target {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.targets(ifaceName)
+}
+
+func (r *RouteTableSyncer) targets(ifaceName string) map[ip.CIDR]routetable.Target {
+	if r.catchAll != nil && ifaceName == r.catchAll.ifaceName {
+		return copyTargets(r.catchAll.requested)
+	}
+	return r.routetable.Targets(ifaceName)
+}
+
+// target returns the target for a CIDR on an interface, as in Targets.
+func (r *RouteTableSyncer) target(ifaceName string, cidr ip.CIDR) (routetable.Target, bool) {
+	if r.catchAll != nil && ifaceName == r.catchAll.ifaceName {
+		target, ok := r.catchAll.requested[cidr]
+		return target, ok
+	}
+	return r.routetable.Target(ifaceName, cidr)
+}
+
+// hasTarget returns true if there is a target for a CIDR on an interface, as in Targets.
+func (r *RouteTableSyncer) hasTarget(ifaceName string, cidr ip.CIDR) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.target(ifaceName, cidr)
+	return ok
+}
+
+// RouteCounts returns the number of the routes to an interface, and the number of the throw routes, that are requested
+// of the routing table, including the requests that have not yet been applied. As with Targets, the routes to the
+// wireguard interface are counted as requested while they are programmed through the catch-all route, and the
+// catch-all route itself is not counted. The counts are maintained as the routes are updated, so this is cheap.
+func (r *RouteTableSyncer) RouteCounts() (unicast, throw int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.unicastRoutes, r.throwRoutes
+}
+
+// countRouteChange returns a function that updates the route counts for the change in the target of a CIDR on an
+// interface since this was called.
+func (r *RouteTableSyncer) countRouteChange(ifaceName string, cidr ip.CIDR) func() {
+	before, existed := r.target(ifaceName, cidr)
+	return func() {
+		if existed {
+			r.countRoute(ifaceName, before, -1)
+		}
+		if after, exists := r.target(ifaceName, cidr); exists {
+			r.countRoute(ifaceName, after, 1)
+		}
+	}
+}
+
+// countRoutes adds delta to the route counts for each of the targets of an interface.
+func (r *RouteTableSyncer) countRoutes(ifaceName string, targets map[ip.CIDR]routetable.Target, delta int) {
+	for _, target := range targets {
+		r.countRoute(ifaceName, target, delta)
+	}
+}
+
+// countRoute adds delta to the count of the routes of the type of the target.
+func (r *RouteTableSyncer) countRoute(ifaceName string, target routetable.Target, delta int) {
+	if ifaceName != routetable.InterfaceNone {
+		r.unicastRoutes += delta
+	} else if target.Type == routetable.TargetTypeThrow {
+		r.throwRoutes += delta
+	}
+}
+
+// AppliedTargets returns the targets for an interface as of the last Apply, excluding any updates that have not yet
+// been applied. As with Targets, these are the routes requested for the wireguard interface while the routes are
+// programmed through the catch-all route.
+func (r *RouteTableSyncer) AppliedTargets(ifaceName string) map[ip.CIDR]routetable.Target {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.catchAll != nil && ifaceName == r.catchAll.ifaceName {
+		return copyTargets(r.catchAll.applied)
+	}
+	return r.routetable.AppliedTargets(ifaceName)
+}
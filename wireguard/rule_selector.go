@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+)
+
+// RuleSelector selects the traffic that our routing rules send to the wireguard routing tables, see
+// Config.RuleSelectors.
+type RuleSelector string
+
+const (
+	// RuleSelectorFwmark selects the traffic that does not have our firewall mark, i.e. all traffic other than the
+	// encrypted traffic sent by wireguard. This is the default selector.
+	RuleSelectorFwmark RuleSelector = "fwmark"
+	// RuleSelectorSource selects the traffic from the local pod CIDRs, see Wireguard.SetRuleSourceCIDRs.
+	RuleSelectorSource RuleSelector = "source"
+	// RuleSelectorIif selects the traffic arriving on the interfaces whose names start with Config.RuleIifPrefix.
+	RuleSelectorIif RuleSelector = "iif"
+)
+
+// defaultRuleIifPrefix is the prefix of the interfaces selected by RuleSelectorIif if Config.RuleIifPrefix is not set,
+// which is the prefix of the workload interfaces.
+const defaultRuleIifPrefix = "cali"
+
+// ruleSelectors returns the selectors of our routing rules, defaulting to RuleSelectorFwmark.
+func (c *Config) ruleSelectors() []RuleSelector {
+	if len(c.RuleSelectors) == 0 {
+		return []RuleSelector{RuleSelectorFwmark}
+	}
+	return c.RuleSelectors
+}
+
+// ruleIifPrefix returns the prefix of the interfaces selected by RuleSelectorIif.
+func (c *Config) ruleIifPrefix() string {
+	if c.RuleIifPrefix == "" {
+		return defaultRuleIifPrefix
+	}
+	return c.RuleIifPrefix
+}
+
+// validateRuleSelectors returns an error if any of the rule selectors is not known.
+func (c *Config) validateRuleSelectors() error {
+	for _, selector := range c.RuleSelectors {
+		switch selector {
+		case RuleSelectorFwmark, RuleSelectorSource, RuleSelectorIif:
+		default:
+			return &ConfigError{Field: "RuleSelectors", Value: c.RuleSelectors,
+				Reason: "must be one or more of fwmark, source and iif"}
+		}
+	}
+	return nil
+}
+
+// hasRuleSelector returns true if our routing rules use the selector.
+func (w *Wireguard) hasRuleSelector(selector RuleSelector) bool {
+	for _, s := range w.ruleSelectors {
+		if s == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRuleSourceCIDRs sets the local pod CIDRs, whose traffic is sent to the wireguard routing tables if the routing
+// rules use RuleSelectorSource. The CIDRs of the other IP version, and the CIDRs within another of the CIDRs, are
+// ignored. There are no routing rules until the CIDRs are set.
+func (w *Wireguard) SetRuleSourceCIDRs(cidrs []ip.CIDR) {
+	sources := set.New()
+	for _, cidr := range cidrs {
+		if cidr.Version() == w.config.ipVersion() {
+			sources.Add(cidr)
+		}
+	}
+	w.queueUpdate(PendingWorkSummary{Rules: true}, func() {
+		if sources.Equals(w.ruleSourceCIDRs) {
+			return
+		}
+		w.logCxt.WithField("cidrs", sortCIDRs(sources)).Debug("Routing rule source CIDRs updated")
+		w.ruleSourceCIDRs = sources
+		if w.hasRuleSelector(RuleSelectorSource) {
+			w.inSyncRouteRule = false
+		}
+	})
+}
+
+// onRuleIifStateChanged tracks the interfaces that are selected by RuleSelectorIif. A routing rule only matches the
+// exact name of the incoming interface, so there is a rule for each of the interfaces that are up.
+func (w *Wireguard) onRuleIifStateChanged(ifaceName string, state ifacemonitor.State) {
+	up := state == ifacemonitor.StateUp
+	if up == w.ruleIifNames.Contains(ifaceName) {
+		return
+	}
+	if up {
+		w.ruleIifNames.Add(ifaceName)
+	} else {
+		w.ruleIifNames.Discard(ifaceName)
+	}
+	if w.hasRuleSelector(RuleSelectorIif) {
+		w.inSyncRouteRule = false
+	}
+}
+
+// isRuleIif returns true if the interface may be selected by RuleSelectorIif.
+func (c *Config) isRuleIif(ifaceName string) bool {
+	return strings.HasPrefix(ifaceName, c.ruleIifPrefix()) && ifaceName != c.InterfaceName
+}
+
+// updateRuleSelectors updates the selectors of our routing rules. The rules of the previous selectors are replaced
+// by the next Apply.
+func (w *Wireguard) updateRuleSelectors(selectors []RuleSelector) {
+	w.logCxt.Debugf("UpdateConfig: ruleSelectors=%v", selectors)
+	if ruleSelectorsEqual(selectors, w.ruleSelectors) {
+		return
+	}
+	w.logCxt.WithFields(logrus.Fields{
+		"oldSelectors": w.ruleSelectors,
+		"newSelectors": selectors,
+	}).Info("Wireguard routing rule selectors updated, replacing the routing rules")
+	w.ruleSelectors = selectors
+	w.inSyncRouteRule = false
+}
+
+func ruleSelectorsEqual(a, b []RuleSelector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeRules returns the routing rules at the priority that send the selected traffic to the routing table. The
+// traffic must match all of the selectors, so there is a rule for each combination of the source CIDRs and incoming
+// interfaces.
+//
+// On its own the fwmark selector is an inverted match on our firewall mark. The inversion applies to the whole rule,
+// so when combined with the other selectors the rule instead matches the traffic whose firewall mark bit is clear.
+func (w *Wireguard) routeRules(priority, tableIndex int) []*netlink.Rule {
+	bySource, byIif := w.hasRuleSelector(RuleSelectorSource), w.hasRuleSelector(RuleSelectorIif)
+	sources := []ip.CIDR{nil}
+	if bySource {
+		sources = w.ruleSources()
+	}
+	iifNames := []string{""}
+	if byIif {
+		iifNames = sortStrings(w.ruleIifNames)
+	}
+
+	var rules []*netlink.Rule
+	for _, source := range sources {
+		for _, iifName := range iifNames {
+			rule := netlink.NewRule()
+			rule.Priority = priority
+			rule.Table = tableIndex
+			if w.config.ipVersion() == 6 {
+				rule.Family = netlink.FAMILY_V6
+			}
+			if w.hasRuleSelector(RuleSelectorFwmark) {
+				if !bySource && !byIif {
+					rule.Mark = w.config.FirewallMark
+					rule.Invert = true
+				} else {
+					rule.Mark = 0
+					rule.Mask = w.config.FirewallMark
+				}
+			}
+			if source != nil {
+				ipNet := source.ToIPNet()
+				rule.Src = &ipNet
+			}
+			rule.IifName = iifName
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ruleSources returns the sorted source CIDRs of the routing rules, omitting the CIDRs that are within another of the
+// CIDRs.
+func (w *Wireguard) ruleSources() []ip.CIDR {
+	var sources []ip.CIDR
+	for _, cidr := range sortCIDRs(w.ruleSourceCIDRs) {
+		// The CIDRs are sorted by address and then by prefix length, so a CIDR within another CIDR follows it.
+		if n := len(sources); n > 0 {
+			if last := sources[n-1].ToIPNet(); last.Contains(cidr.Addr().AsNetIP()) {
+				continue
+			}
+		}
+		sources = append(sources, cidr)
+	}
+	return sources
+}
+
+// sortStrings returns the strings in the set in sorted order.
+func sortStrings(s set.Set) []string {
+	strs := make([]string, 0, s.Len())
+	s.Iter(func(item interface{}) error {
+		strs = append(strs, item.(string))
+		return nil
+	})
+	sort.Strings(strs)
+	return strs
+}
+
+// hasOurRuleSignature returns true if the rule looks like one of our routing rules, whichever selectors were used to
+// program it, see routeRules. The rules without the fwmark selector are only identified by their priority.
+func (c *Config) hasOurRuleSignature(rule netlink.Rule) bool {
+	if rule.Invert && rule.Mark == c.FirewallMark {
+		return true
+	} else if !rule.Invert && rule.Mark == 0 && rule.Mask == c.FirewallMark {
+		return true
+	}
+	inPriorityRange := rule.Priority >= c.RoutingRulePriority-c.RoutingRulePriorityRange &&
+		rule.Priority <= c.RoutingRulePriority+c.RoutingRulePriorityRange
+	return inPriorityRange && rule.Mark <= 0 &&
+		(rule.Src != nil || strings.HasPrefix(rule.IifName, c.ruleIifPrefix()))
+}
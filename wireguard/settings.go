@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// The defaults of the settings, see NewConfig.
+	DefaultListeningPort       = 51820
+	DefaultRoutingRulePriority = 99
+	DefaultInterfaceName       = "wireguard.cali"
+	DefaultInterfaceNameV6     = "wg-v6.cali"
+
+	// The maximum length of an interface name, excluding the terminating null byte.
+	maxInterfaceNameLen = 15
+
+	// The lowest MTU of an IPv4 link, and of an IPv6 link. The wireguard device carries the traffic of its IP version.
+	minMTUIPv4 = 68
+	minMTUIPv6 = 1280
+	maxMTU     = 65535
+
+	// The priority of the rule to the main routing table. The wireguard rule must be matched before it.
+	mainRulePriority = 32766
+
+	// The longest keepalive interval, which wireguard configures in seconds as a 16 bit value.
+	maxPersistentKeepalive = 65535 * time.Second
+
+	// The largest DSCP value, which is 6 bits.
+	maxDSCP = 63
+)
+
+// Settings are the felix wireguard settings from which the Config is constructed, see NewConfig. A zero value takes
+// the default of the setting.
+type Settings struct {
+	Enabled   bool
+	IPVersion uint8
+
+	// ListeningPort defaults to DefaultListeningPort.
+	ListeningPort int
+	FirewallMark  int
+
+	// RoutingTableIndex is required unless the routing table is chosen by Config.RoutingTableIndexAuto.
+	RoutingTableIndex int
+
+	// RoutingRulePriority defaults to DefaultRoutingRulePriority.
+	RoutingRulePriority int
+
+	// InterfaceName defaults to DefaultInterfaceName, or DefaultInterfaceNameV6 for IPv6.
+	InterfaceName string
+
+	// MTU defaults to HostMTU less the wireguard overhead. If neither is set the MTU of the device is not changed.
+	MTU     int
+	HostMTU int
+}
+
+// ConfigOption sets one of the other options of the Config constructed by NewConfig.
+type ConfigOption func(config *Config)
+
+// ConfigError is returned by NewConfig and Config.Validate when a field of the Config is not valid.
+type ConfigError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid wireguard configuration: %s %v %s", e.Field, e.Value, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// NewConfig constructs the Config from the felix wireguard settings and the options, applying the defaults of the
+// settings, and validates it. The options are applied before the defaults, so an option cannot clear a default. The
+// Config is returned by value, so that each consumer has its own copy.
+func NewConfig(settings Settings, options ...ConfigOption) (Config, error) {
+	config := Config{
+		Enabled:             settings.Enabled,
+		IPVersion:           settings.IPVersion,
+		ListeningPort:       settings.ListeningPort,
+		FirewallMark:        settings.FirewallMark,
+		RoutingTableIndex:   settings.RoutingTableIndex,
+		RoutingRulePriority: settings.RoutingRulePriority,
+		InterfaceName:       settings.InterfaceName,
+		MTU:                 settings.MTU,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+
+	if config.ListeningPort == 0 {
+		config.ListeningPort = DefaultListeningPort
+	}
+	if config.RoutingRulePriority == 0 {
+		config.RoutingRulePriority = DefaultRoutingRulePriority
+	}
+	if config.InterfaceName == "" {
+		config.InterfaceName = DefaultInterfaceName
+		if config.ipVersion() == 6 {
+			config.InterfaceName = DefaultInterfaceNameV6
+		}
+	}
+	if config.MTU == 0 && settings.HostMTU > 0 {
+		// The peers are reached over an IPv4 underlay, see Wireguard.Overhead.
+		config.MTU = settings.HostMTU - OverheadForIPVersion(4)
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Validate returns a ConfigError if the Config is not valid. Only the interface name is required if wireguard is not
+// enabled, since that is all that is needed to remove the wireguard configuration, unless wireguard may be enabled by
+// the node override.
+func (c *Config) Validate() error {
+	if c.InterfaceName == "" || len(c.InterfaceName) > maxInterfaceNameLen {
+		return &ConfigError{Field: "InterfaceName", Value: c.InterfaceName,
+			Reason: fmt.Sprintf("must have 1 to %d characters", maxInterfaceNameLen)}
+	}
+	if c.IPVersion != 0 && c.IPVersion != 4 && c.IPVersion != 6 {
+		return &ConfigError{Field: "IPVersion", Value: c.IPVersion, Reason: "must be 4 or 6"}
+	}
+	if !c.mayBeEnabled() {
+		return nil
+	}
+	if c.ListeningPort <= 0 || c.ListeningPort > 65535 {
+		return &ConfigError{Field: "ListeningPort", Value: c.ListeningPort, Reason: "must be between 1 and 65535"}
+	}
+	if c.FirewallMark == 0 {
+		return &ConfigError{Field: "FirewallMark", Value: c.FirewallMark, Reason: "must be set"}
+	}
+	if c.RoutingRulePriority <= 0 || c.RoutingRulePriority >= mainRulePriority {
+		return &ConfigError{Field: "RoutingRulePriority", Value: c.RoutingRulePriority,
+			Reason: fmt.Sprintf("must be between 1 and %d", mainRulePriority-1)}
+	}
+	minMTU := minMTUIPv4
+	if c.ipVersion() == 6 {
+		minMTU = minMTUIPv6
+	}
+	if c.MTU != 0 && (c.MTU < minMTU || c.MTU > maxMTU) {
+		return &ConfigError{Field: "MTU", Value: c.MTU, Reason: fmt.Sprintf("must be between %d and %d", minMTU, maxMTU)}
+	}
+	if c.RoutingTableIndexAuto {
+		if c.RoutingTableIndexAutoMin <= 0 || c.RoutingTableIndexAutoMin > c.RoutingTableIndexAutoMax {
+			return &ConfigError{Field: "RoutingTableIndexAutoMin", Value: c.RoutingTableIndexAutoMin,
+				Reason: fmt.Sprintf("must be between 1 and RoutingTableIndexAutoMax %d", c.RoutingTableIndexAutoMax)}
+		}
+	} else if err := c.validateRoutingTableIndexes(); err != nil {
+		return &ConfigError{Field: "RoutingTableIndex", Value: c.routingTableIndexes(), Reason: "must not be 0", Err: err}
+	}
+	if c.CIDRFlapMaxMoves < 0 {
+		return &ConfigError{Field: "CIDRFlapMaxMoves", Value: c.CIDRFlapMaxMoves, Reason: "must not be negative"}
+	}
+	if c.PersistentKeepalive < 0 || c.PersistentKeepalive > maxPersistentKeepalive {
+		return &ConfigError{Field: "PersistentKeepalive", Value: c.PersistentKeepalive,
+			Reason: fmt.Sprintf("must be between 0 and %v", maxPersistentKeepalive)}
+	}
+	if c.AllowedIPsChunkSize < 0 {
+		return &ConfigError{Field: "AllowedIPsChunkSize", Value: c.AllowedIPsChunkSize, Reason: "must not be negative"}
+	}
+	if c.DSCP != nil && *c.DSCP > maxDSCP {
+		return &ConfigError{Field: "DSCP", Value: *c.DSCP, Reason: fmt.Sprintf("must be between 0 and %d", maxDSCP)}
+	}
+	if err := c.validateRuleSelectors(); err != nil {
+		return err
+	}
+	if err := c.validateNonWireguardPeerHandling(); err != nil {
+		return err
+	}
+	if err := c.validateCatchAllRoute(); err != nil {
+		return err
+	}
+	return nil
+}
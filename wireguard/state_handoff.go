@@ -0,0 +1,474 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// The version of the State. This must be incremented whenever the contents of the State, or their meaning, change, so
+// that the state of an instance of a different version is rejected.
+const stateVersion = 3
+
+// State is an opaque snapshot of the cached configuration of a converged Wireguard instance, see ExportState. It is
+// handed to the instance that replaces it, see ImportState, so that the new instance starts from the configuration that
+// is programmed rather than from an empty configuration.
+type State struct {
+	version  int
+	imported bool
+
+	// Our hostname and the configuration of the instance, which must be the same for the importing instance.
+	hostname string
+	config   Config
+
+	// The cached configuration of the peers.
+	peers                   map[string]*peerData
+	cidrToNodeName          map[ip.CIDR]string
+	publicKeyToNodeNames    map[wgtypes.Key]set.Set
+	allowedCIDRToNodeName   map[ip.CIDR]string
+	interfaceCIDRToNodeName map[ip.CIDR]string
+	nodeNameToInterfaceCIDR map[string]ip.CIDR
+	nodeNameToSecondaryAddr map[string]ip.Addr
+	endpointFailovers       map[string]endpointFailover
+	drainedNodes            set.Set
+	readyNodes              set.Set
+	optedOutNodes           set.Set
+	overLimitNodes          set.Set
+	deniedCIDRs             set.Set
+	nodeNames               nodeNameState
+
+	// The routing of the CIDRs, and the settings that may be changed by UpdateConfig.
+	localCIDRs                 map[ip.CIDR]RouteClass
+	localCIDRRoutes            map[ip.CIDR]int
+	cidrToRouteClass           map[ip.CIDR]RouteClass
+	cidrToTableIndex           map[ip.CIDR]int
+	excludeCIDRs               []ip.CIDR
+	cidrsExcludedEver          bool
+	exclusionCIDRs             []ip.CIDR
+	interfaceAddrSource        InterfaceAddressSource
+	interfaceAddrPool          ip.CIDR
+	datastoreIPv4InterfaceAddr ip.Addr
+	ruleSelectors              []RuleSelector
+	ruleSourceCIDRs            set.Set
+	ruleIifNames               set.Set
+	nonWireguardHandling       NonWireguardPeerHandling
+	catchAllRoute              bool
+	catchAllThrowCIDRs         []ip.CIDR
+	catchAllThrowRoutes        map[ip.CIDR]bool
+
+	// The programmed routes of each routing table, by the index of the table.
+	routes map[int]stateRoutes
+
+	// The programmed link and device.
+	linkIndex          int
+	ifaceUp            bool
+	rulePriority       int
+	mode               Mode
+	userspaceHelperRun bool
+	localConfig        *localConfig
+	capabilities       Capabilities
+	peerDiagnostics    map[string]PeerDiagnostics
+
+	// Our published key and addresses.
+	ourPublicKey            wgtypes.Key
+	intendedKey             *intendedKey
+	ourIPv4EndpointAddr     ip.Addr
+	ourIPv4InterfaceAddr    ip.Addr
+	publishGeneration       uint64
+	echoedPublishGeneration uint64
+}
+
+// stateRoutes are the programmed routes of a routing table, and the catch-all route if the routes to wireguard are
+// programmed through it.
+type stateRoutes struct {
+	wireguard []routetable.Target
+	throw     []routetable.Target
+	catchAll  *routetable.Target
+}
+
+// StateRejectedError is returned by ImportState if the state cannot be imported, in which case the instance starts
+// from an empty configuration as if no state had been imported.
+type StateRejectedError struct {
+	Reason string
+}
+
+func (e *StateRejectedError) Error() string {
+	return fmt.Sprintf("wireguard state rejected: %s", e.Reason)
+}
+
+// ExportState returns a snapshot of the cached configuration, e.g. so that the dataplane can hand the configuration to
+// the instance that replaces this one when the dataplane is reconstructed. The state is only exported once the last
+// Apply has converged: there must be no pending work and no transient state that is tracked by timers, such as damped
+// CIDRs or provisional keys. An error is returned otherwise, and the new instance should simply start from an empty
+// configuration. The netlink and wireguard clients of this instance are closed. This must be called from the same
+// goroutine as Apply.
+func (w *Wireguard) ExportState() (*State, error) {
+	if reason := w.notExportableReason(); reason != "" {
+		return nil, fmt.Errorf("wireguard state cannot be exported: %s", reason)
+	}
+
+	state := &State{
+		version:                    stateVersion,
+		hostname:                   w.hostname,
+		config:                     *w.config,
+		peers:                      map[string]*peerData{},
+		cidrToNodeName:             copyCIDRNames(w.cidrToNodeName),
+		publicKeyToNodeNames:       map[wgtypes.Key]set.Set{},
+		allowedCIDRToNodeName:      copyCIDRNames(w.allowedCIDRToNodeName),
+		interfaceCIDRToNodeName:    copyCIDRNames(w.interfaceCIDRToNodeName),
+		nodeNameToInterfaceCIDR:    map[string]ip.CIDR{},
+		nodeNameToSecondaryAddr:    map[string]ip.Addr{},
+		endpointFailovers:          map[string]endpointFailover{},
+		drainedNodes:               w.drainedNodes.Copy(),
+		readyNodes:                 w.readyNodes.Copy(),
+		optedOutNodes:              w.optedOutNodes.Copy(),
+		overLimitNodes:             w.overLimitNodes.Copy(),
+		deniedCIDRs:                w.deniedCIDRs.Copy(),
+		nodeNames:                  w.nodeNames.copy(),
+		localCIDRs:                 map[ip.CIDR]RouteClass{},
+		localCIDRRoutes:            copyCIDRTableIndexes(w.localCIDRRoutes),
+		cidrToRouteClass:           map[ip.CIDR]RouteClass{},
+		cidrToTableIndex:           copyCIDRTableIndexes(w.cidrToTableIndex),
+		excludeCIDRs:               append([]ip.CIDR(nil), w.excludeCIDRs...),
+		cidrsExcludedEver:          w.cidrsExcludedEver,
+		exclusionCIDRs:             append([]ip.CIDR(nil), w.exclusionCIDRs...),
+		interfaceAddrSource:        w.interfaceAddrSource,
+		interfaceAddrPool:          w.interfaceAddrPool,
+		datastoreIPv4InterfaceAddr: w.datastoreIPv4InterfaceAddr,
+		ruleSelectors:              append([]RuleSelector(nil), w.ruleSelectors...),
+		ruleSourceCIDRs:            w.ruleSourceCIDRs.Copy(),
+		ruleIifNames:               w.ruleIifNames.Copy(),
+		nonWireguardHandling:       w.nonWireguardHandling,
+		catchAllRoute:              w.catchAllRoute,
+		catchAllThrowCIDRs:         append([]ip.CIDR(nil), w.catchAllThrowCIDRs...),
+		catchAllThrowRoutes:        map[ip.CIDR]bool{},
+		routes:                     map[int]stateRoutes{},
+		linkIndex:                  w.linkIndex,
+		ifaceUp:                    w.ifaceUp,
+		rulePriority:               w.rulePriority,
+		userspaceHelperRun:         w.userspaceHelperRun,
+		ourPublicKey:               *w.ourPublicKey,
+		ourIPv4EndpointAddr:        w.ourIPv4EndpointAddr,
+		ourIPv4InterfaceAddr:       w.ourIPv4InterfaceAddr,
+		publishGeneration:          w.publishGeneration,
+		echoedPublishGeneration:    w.echoedPublishGeneration,
+	}
+	for name, node := range w.peers {
+		peer := *node
+		peer.cidrs = node.cidrs.Copy()
+		state.peers[name] = &peer
+	}
+	for key, names := range w.publicKeyToNodeNames {
+		state.publicKeyToNodeNames[key] = names.Copy()
+	}
+	for name, cidr := range w.nodeNameToInterfaceCIDR {
+		state.nodeNameToInterfaceCIDR[name] = cidr
+	}
+	for name, addr := range w.nodeNameToSecondaryAddr {
+		state.nodeNameToSecondaryAddr[name] = addr
+	}
+	for name, failover := range w.endpointFailovers {
+		state.endpointFailovers[name] = *failover
+	}
+	for cidr, class := range w.localCIDRs {
+		state.localCIDRs[cidr] = class
+	}
+	for cidr, class := range w.cidrToRouteClass {
+		state.cidrToRouteClass[cidr] = class
+	}
+	for cidr := range w.catchAllThrowRoutes {
+		state.catchAllThrowRoutes[cidr] = true
+	}
+	for tableIndex, rt := range w.routetables {
+		routes := stateRoutes{
+			wireguard: targetList(rt.AppliedTargets(w.config.InterfaceName)),
+			throw:     targetList(rt.AppliedTargets(routetable.InterfaceNone)),
+		}
+		if target, ok := rt.catchAllRoute(); ok {
+			routes.catchAll = &target
+		}
+		state.routes[tableIndex] = routes
+	}
+	if w.intendedKey != nil {
+		intended := *w.intendedKey
+		state.intendedKey = &intended
+	}
+
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	state.mode = w.mode
+	state.capabilities = w.capabilities
+	if w.localConfig != nil {
+		lc := *w.localConfig
+		state.localConfig = &lc
+	}
+	state.peerDiagnostics = make(map[string]PeerDiagnostics, len(w.peerDiagnostics))
+	for name, diag := range w.peerDiagnostics {
+		state.peerDiagnostics[name] = diag
+	}
+
+	// This instance is being replaced, so release its clients. They are recreated if this instance is applied again.
+	w.closeNetlinkClient()
+	w.closeWireguardClient()
+
+	w.logCxt.WithField("numPeers", len(state.peers)).Info("Exported wireguard state")
+	return state, nil
+}
+
+// notExportableReason returns the reason that the state cannot be exported, or "" if it can.
+func (w *Wireguard) notExportableReason() string {
+	switch {
+	case w.tornDown:
+		return "wireguard has been torn down"
+	case !w.config.Enabled:
+		return "wireguard is not enabled"
+	case w.routingTableErr != nil:
+		return "the wireguard routing tables are not valid"
+	case w.deviceOwner != nil:
+		return "the wireguard device is shared with the other IP version"
+	case w.Paused():
+		return "reconciliation is paused"
+	case w.HasPendingWork() || w.ourPublicKey == nil:
+		return "the configuration has not been applied"
+	case !w.linkUsable || w.wireguardNotSupported:
+		return "the wireguard link is not usable"
+	case !w.datastoreInSync || w.adopting():
+		return "the datastore is not in sync"
+	case len(w.provisionalKeys) > 0:
+		return "peers have provisional keys"
+	case len(w.peerKeyTransitions) > 0 || w.retiredPreviousKeys.Len() > 0 || w.localKeyTransition != nil:
+		return "keys are in transition"
+	case w.dampedCIDRs.Len() > 0:
+		return "CIDRs are damped"
+	case w.conntrackPending.Len() > 0:
+		return "conntrack cleanups are pending"
+	case w.numKeyConflicts > 0 || w.staleKeyRepublishDeferred:
+		return "the publication of our key is backing off"
+	}
+	return ""
+}
+
+// ImportState imports the state exported by the instance that this instance replaces, so that this instance starts
+// from the programmed configuration. The first Apply then verifies the link, addresses, rules and routes, which makes
+// no changes unless they have been changed out-of-band, and neither reconfigures the wireguard device nor republishes
+// our key. The updates queued before the import are applied on top of the imported configuration by the first Apply.
+//
+// The state is rejected with a StateRejectedError if it was exported by a different version, has already been
+// imported, or if our hostname or the configuration that determines what is programmed differ, e.g. the interface name
+// or the routing tables. The instance then starts from an empty configuration, as it would have without the import.
+// This must be called from the same goroutine as Apply, before the first Apply.
+func (w *Wireguard) ImportState(state *State) error {
+	if err := w.checkState(state); err != nil {
+		w.logCxt.WithError(err).Warn("Unable to import the wireguard state, starting from an empty configuration")
+		return err
+	}
+	state.imported = true
+
+	w.hostname = state.hostname
+	w.peers = state.peers
+	w.cidrToNodeName = state.cidrToNodeName
+	w.publicKeyToNodeNames = state.publicKeyToNodeNames
+	w.allowedCIDRToNodeName = state.allowedCIDRToNodeName
+	w.interfaceCIDRToNodeName = state.interfaceCIDRToNodeName
+	w.nodeNameToInterfaceCIDR = state.nodeNameToInterfaceCIDR
+	w.nodeNameToSecondaryAddr = state.nodeNameToSecondaryAddr
+	for name, failover := range state.endpointFailovers {
+		failover := failover
+		w.endpointFailovers[name] = &failover
+	}
+	w.drainedNodes = state.drainedNodes
+	w.readyNodes = state.readyNodes
+	w.optedOutNodes = state.optedOutNodes
+	w.updateOptedOutNodesSnapshot()
+	w.overLimitNodes = state.overLimitNodes
+	w.deniedCIDRs = state.deniedCIDRs
+	w.nodeNames = &state.nodeNames
+
+	w.localCIDRs = state.localCIDRs
+	w.localCIDRRoutes = state.localCIDRRoutes
+	w.cidrToRouteClass = state.cidrToRouteClass
+	w.cidrToTableIndex = state.cidrToTableIndex
+	w.excludeCIDRs = state.excludeCIDRs
+	w.cidrsExcludedEver = state.cidrsExcludedEver
+	w.exclusionCIDRs = state.exclusionCIDRs
+	w.interfaceAddrSource = state.interfaceAddrSource
+	w.interfaceAddrPool = state.interfaceAddrPool
+	w.datastoreIPv4InterfaceAddr = state.datastoreIPv4InterfaceAddr
+	w.ruleSelectors = state.ruleSelectors
+	w.ruleSourceCIDRs = state.ruleSourceCIDRs
+	w.ruleIifNames = state.ruleIifNames
+	w.nonWireguardHandling = state.nonWireguardHandling
+	w.catchAllRoute = state.catchAllRoute
+	w.catchAllThrowCIDRs = state.catchAllThrowCIDRs
+	w.catchAllThrowRoutes = state.catchAllThrowRoutes
+	w.recountAllPeerCapacities()
+
+	// The routing tables resync on their first Apply, which finds the routes already programmed. The catch-all route is
+	// set first, so that the routes to wireguard that it replaces are not programmed.
+	for tableIndex, routes := range state.routes {
+		rt := w.routetables[tableIndex]
+		if routes.catchAll != nil {
+			rt.setCatchAllRoute(w.config.InterfaceName, routes.catchAll)
+		}
+		rt.SetRoutes(routetable.InterfaceNone, routes.throw)
+		rt.SetRoutes(w.config.InterfaceName, routes.wireguard)
+		if state.ifaceUp {
+			rt.OnIfaceStateChanged(w.config.InterfaceName, ifacemonitor.StateUp)
+		}
+	}
+
+	// The link is still checked by the first Apply, and if it has been recreated in the meantime everything is resynced,
+	// see checkLinkIndex. The device is trusted to be in-sync, as it was for the exporting instance.
+	w.linkIndex = state.linkIndex
+	w.ifaceUp = state.ifaceUp
+	w.linkUsable = true
+	w.rulePriority = state.rulePriority
+	w.userspaceHelperRun = state.userspaceHelperRun
+	w.inSyncWireguard = true
+	w.datastoreInSync = true
+	w.adoptionDone = true
+
+	publicKey := state.ourPublicKey
+	w.ourPublicKey = &publicKey
+	w.intendedKey = state.intendedKey
+	w.ourIPv4EndpointAddr = state.ourIPv4EndpointAddr
+	w.ourIPv4InterfaceAddr = state.ourIPv4InterfaceAddr
+	w.ourPublicKeyAgreesWithDataplaneMsg = true
+	w.storedKey = publicKey
+	w.publishGeneration = state.publishGeneration
+	w.echoedPublishGeneration = state.echoedPublishGeneration
+
+	w.localConfigLock.Lock()
+	w.mode = state.mode
+	w.capabilities = state.capabilities
+	w.localConfig = state.localConfig
+	w.peerDiagnostics = state.peerDiagnostics
+	w.localConfigLock.Unlock()
+
+	w.setUnappliedWork(w.remainingWork(false))
+	w.logCxt.WithFields(logrus.Fields{
+		"numPeers":  len(w.peers),
+		"publicKey": publicKey,
+	}).Info("Imported wireguard state")
+	return nil
+}
+
+// checkState returns a StateRejectedError if the state cannot be imported.
+func (w *Wireguard) checkState(state *State) error {
+	reject := func(format string, args ...interface{}) error {
+		return &StateRejectedError{Reason: fmt.Sprintf(format, args...)}
+	}
+	switch {
+	case state == nil:
+		return reject("no state")
+	case state.version != stateVersion:
+		return reject("state version %d is not the supported version %d", state.version, stateVersion)
+	case state.imported:
+		return reject("state has already been imported")
+	case !w.HealthSnapshot().LastApplyStart.IsZero():
+		return reject("wireguard has already been applied")
+	case w.tornDown || w.routingTableErr != nil || w.deviceOwner != nil:
+		return reject("wireguard cannot import state")
+	}
+	hostname := w.hostname
+	if state.nodeNames.canonicalizer != nil {
+		hostname = state.nodeNames.canonicalizer(hostname)
+	}
+	if hostname != state.hostname {
+		return reject("hostname %q differs from the hostname %q of the state", hostname, state.hostname)
+	}
+	if !reflect.DeepEqual(programmedConfig(w.config), programmedConfig(&state.config)) {
+		return reject("the configuration differs from the configuration of the state")
+	}
+	return nil
+}
+
+// programmedConfig returns the configuration with the settings that do not affect what is programmed cleared, so that
+// the configuration of the instances can be compared. The routing table chosen by RoutingTableIndexAuto is compared,
+// and the settings of the node overrides file are compared once merged.
+func programmedConfig(config *Config) Config {
+	c := *config
+	c.RoutingTableIndexAuto, c.RoutingTableIndexAutoMin, c.RoutingTableIndexAutoMax = false, 0, 0
+	c.LogLevel = nil
+	c.ParentInterfaces = nil
+	c.ApplyTimeout = 0
+	c.RouteNetlinkTimeout = 0
+	c.NotSupportedReprobeInterval = 0
+	c.StaleHandshakeThreshold = 0
+	c.CapacityStatsInterval = 0
+	c.CoverageLogThreshold = 0
+	c.PeerBatchThreshold, c.PeerBatchWindow = 0, 0
+	c.AllowEnabledOverride = false
+	c.AdoptExistingDevice = false
+	c.MaxPauseDuration = 0
+	c.AllowedIPsChunkSize = 0
+	c.NodeOverridesFile = ""
+	return c
+}
+
+// copy returns a copy of the node name state, with the same canonicalizer.
+func (s *nodeNameState) copy() nodeNameState {
+	c := nodeNameState{
+		canonicalizer: s.canonicalizer,
+		seq:           s.seq,
+		endpointSeq:   map[string]uint64{},
+		keySeq:        map[string]uint64{},
+		interned:      map[string]string{},
+	}
+	for name, seq := range s.endpointSeq {
+		c.endpointSeq[name] = seq
+	}
+	for name, seq := range s.keySeq {
+		c.keySeq[name] = seq
+	}
+	for name := range s.interned {
+		c.interned[name] = name
+	}
+	return c
+}
+
+func copyCIDRNames(m map[ip.CIDR]string) map[ip.CIDR]string {
+	c := make(map[ip.CIDR]string, len(m))
+	for cidr, name := range m {
+		c[cidr] = name
+	}
+	return c
+}
+
+func copyCIDRTableIndexes(m map[ip.CIDR]int) map[ip.CIDR]int {
+	c := make(map[ip.CIDR]int, len(m))
+	for cidr, tableIndex := range m {
+		c[cidr] = tableIndex
+	}
+	return c
+}
+
+// targetList returns the targets as a list.
+func targetList(targets map[ip.CIDR]routetable.Target) []routetable.Target {
+	list := make([]routetable.Target, 0, len(targets))
+	for _, target := range targets {
+		list = append(list, target)
+	}
+	return list
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+// StatusUpdate is the status of the local wireguard configuration reported to the StatusCallback.
+type StatusUpdate struct {
+	// PublicKey is our public key, or the zero key while our key is withheld or withdrawn, see KeyState.
+	PublicKey wgtypes.Key
+
+	// ListeningPort and InterfaceName are the programmed listening port and the name of the wireguard interface.
+	ListeningPort int
+	InterfaceName string
+
+	// InterfaceAddr is the IPv4 address of the wireguard interface if the address is chosen locally, otherwise nil, see
+	// Config.InterfaceAddressSource.
+	InterfaceAddr ip.Addr
+
+	// RoutingTableIndex is the index of the default wireguard routing table, which may have been chosen locally, see
+	// Config.RoutingTableIndexAuto.
+	RoutingTableIndex int
+
+	// PreviousPublicKey is our previous public key during a key transition, which the peers may use until
+	// PreviousKeyDeadline, see Config.KeyTransitionTimeout. It is the zero key outside of a key transition.
+	PreviousPublicKey   wgtypes.Key
+	PreviousKeyDeadline time.Time
+
+	// KeyState is the state of our public key.
+	KeyState KeyState
+
+	// EnabledSource is what determines whether wireguard is enabled on this node, see Wireguard.Enabled. This is set by
+	// the wireguard module for every update.
+	EnabledSource EnabledSource
+}
+
+// StatusCallback is notified of the updates of the status of the local wireguard configuration. The callback may return
+// a KeyConflictError if the datastore holds a different key for our node.
+type StatusCallback func(update StatusUpdate) error
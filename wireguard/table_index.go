@@ -0,0 +1,135 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// validateRoutingTableIndexes returns ErrInvalidRoutingTableIndex if wireguard may be enabled and any of the wireguard
+// routing tables is table 0. Table 0 is the unspecified table: routes programmed in it are added to the main routing
+// table, and a resync of table 0 lists the routes in all of the routing tables.
+func (c *Config) validateRoutingTableIndexes() error {
+	if !c.mayBeEnabled() {
+		return nil
+	}
+	for _, tableIndex := range c.routingTableIndexes() {
+		if tableIndex <= 0 {
+			return ErrInvalidRoutingTableIndex
+		}
+	}
+	return nil
+}
+
+// isReservedRoutingTable returns true if the routing table is reserved by the kernel, so it is never chosen for the
+// wireguard routes.
+func isReservedRoutingTable(tableIndex int) bool {
+	switch tableIndex {
+	case unix.RT_TABLE_UNSPEC, unix.RT_TABLE_COMPAT, unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return true
+	}
+	return false
+}
+
+// selectRoutingTableIndex returns the routing table index chosen by Config.RoutingTableIndexAuto, or 0 if there is no
+// free routing table in the range. The routing rules and routing tables are scanned using new netlink clients, which
+// are closed again before returning. The scan is retried if it fails.
+func selectRoutingTableIndex(
+	config *Config,
+	newRuleNetlink func() (netlinkshim.Netlink, error),
+	newRouteNetlink func() (netlinkshim.Netlink, error),
+	logCxt *logrus.Entry,
+) (tableIndex int, err error) {
+	for attempt := 0; attempt < maxConnFailures; attempt++ {
+		if tableIndex, err = scanRoutingTables(config, newRuleNetlink, newRouteNetlink, logCxt); err == nil {
+			return tableIndex, nil
+		}
+		logCxt.WithError(err).Warning("Failed to scan the routing tables for a free wireguard routing table")
+	}
+	return 0, err
+}
+
+// scanRoutingTables chooses the routing table for the wireguard routes from the range in the configuration.
+//
+// If a rule with our signature, e.g. an inverted match on our firewall mark, jumps to a routing table in the range then
+// that table was chosen by a previous instance and is used again, so that the table does not change across restarts.
+// Otherwise the lowest routing table in the range that is not referenced by a rule and contains no routes is chosen.
+// The routing tables configured for the route classes, and the underlay routing table, are never chosen.
+func scanRoutingTables(
+	config *Config,
+	newRuleNetlink func() (netlinkshim.Netlink, error),
+	newRouteNetlink func() (netlinkshim.Netlink, error),
+	logCxt *logrus.Entry,
+) (int, error) {
+	inRange := func(tableIndex int) bool {
+		return tableIndex >= config.RoutingTableIndexAutoMin && tableIndex <= config.RoutingTableIndexAutoMax
+	}
+	inUse := set.New()
+	for _, tableIndex := range config.RoutingTableIndexByClass {
+		inUse.Add(tableIndex)
+	}
+	if config.UnderlayInterface != "" {
+		inUse.Add(config.UnderlayRoutingTableIndex)
+	}
+
+	ruleClient, err := newRuleNetlink()
+	if err != nil {
+		return 0, err
+	}
+	defer ruleClient.Delete()
+	rules, err := ruleClient.RuleList(config.netlinkFamily())
+	if err != nil {
+		return 0, err
+	}
+	for _, rule := range rules {
+		if config.hasOurRuleSignature(rule) && inRange(rule.Table) && !inUse.Contains(rule.Table) {
+			logCxt.WithField("tableIndex", rule.Table).Info("Found the wireguard routing table used previously")
+			return rule.Table, nil
+		}
+	}
+	for _, rule := range rules {
+		inUse.Add(rule.Table)
+	}
+
+	routeClient, err := newRouteNetlink()
+	if err != nil {
+		return 0, err
+	}
+	defer routeClient.Delete()
+	// Filtering on the unspecified table lists the routes in all of the routing tables.
+	routes, err := routeClient.RouteListFiltered(
+		config.netlinkFamily(), &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE,
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, route := range routes {
+		inUse.Add(route.Table)
+	}
+
+	for tableIndex := config.RoutingTableIndexAutoMin; tableIndex <= config.RoutingTableIndexAutoMax; tableIndex++ {
+		if tableIndex <= 0 || isReservedRoutingTable(tableIndex) || inUse.Contains(tableIndex) {
+			continue
+		}
+		logCxt.WithField("tableIndex", tableIndex).Info("Chose a free wireguard routing table")
+		return tableIndex, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// Teardown synchronously removes all of the configuration programmed by the wireguard module, whether or not wireguard
+// is enabled: the routing rules, the routes in the wireguard routing tables, the wireguard peers, and the wireguard
+// link along with its private key. This is used when the host is removed from the cluster, or when felix exits
+// permanently.
+//
+// Each step is attempted even if an earlier step fails, and a TeardownError is returned with the error of each step
+// that failed. Teardown may be called again, e.g. to retry a failed teardown. The netlink calls are bounded by
+// Config.ApplyTimeout.
+//
+// The withdrawal of our public key is published through the status callback with the zero key and KeyStateTornDown,
+// so that the peers stop programming us. Once torn down the Wireguard instance makes no further changes to the
+// dataplane: Apply does nothing and our public key is not published again. A new instance is required to program
+// wireguard again.
+//
+// If the device is shared with the instance for the other IP version, see DeviceOwner, only the allowed IPs of our IP
+// version are removed from the peers, and the link is left in place while the other instance is enabled.
+func (w *Wireguard) Teardown() error {
+	// Process the queued updates first, so that no update queued before the teardown is applied after it.
+	w.applyQueuedUpdates()
+	if !w.tornDown {
+		// Our key is withdrawn once torn down if the peers may have it.
+		w.ourPublicKeyAgreesWithDataplaneMsg = w.storedKey == zeroKey && (w.ourPublicKey == nil || *w.ourPublicKey == zeroKey)
+	}
+	w.tornDown = true
+	w.clearPause()
+	if w.deviceOwner != nil {
+		w.deviceOwner.release(w.config.ipVersion())
+	}
+	w.logCxt.Info("Tearing down the wireguard configuration")
+	w.trace.setCause("teardown")
+	defer w.trace.clearCauses()
+
+	ctx := context.Background()
+	if w.config.ApplyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.config.ApplyTimeout)
+		defer cancel()
+	}
+
+	var errs []error
+	netlinkClient, err := w.getNetlinkClient()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("netlink client: %v", err))
+	} else {
+		netlinkClient = netlinkshim.NetlinkWithContext(ctx, netlinkClient, 0)
+
+		// Remove the rules first so that no more traffic is routed using the wireguard routing tables.
+		if err := w.ensureNoRouteRule(netlinkClient); err != nil {
+			errs = append(errs, fmt.Errorf("routing rule: %v", err))
+		}
+		if err := w.ensureNoUnderlayRoutes(netlinkClient); err != nil {
+			errs = append(errs, fmt.Errorf("underlay routing: %v", err))
+		}
+	}
+
+	// Flush the routing tables while the link still exists, so that the routes to the link are found.
+	if err := w.flushRouteTables(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("routing tables: %v", err))
+	}
+
+	if err := w.ensureNoPeers(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("peers: %v", err))
+	}
+
+	// Deleting the link also removes the private key from the kernel.
+	if netlinkClient != nil {
+		if err := w.ensureNoLink(netlinkClient); err != nil {
+			errs = append(errs, fmt.Errorf("link: %v", err))
+		}
+	}
+
+	// Close the clients, they are not used again unless the teardown is retried.
+	w.closeNetlinkClient()
+	w.closeWireguardClient()
+
+	w.ourPublicKey = &zeroKey
+	w.forgetIntendedKey()
+	w.peerKeyTransitions = map[string]*peerKeyTransition{}
+	w.retiredPreviousKeys = set.New()
+	w.localKeyTransition = nil
+	w.setLocalConfig(nil)
+	w.setPeerDiagnostics(nil)
+	w.setAllInSync(false)
+
+	// Nothing more is applied once torn down, so there is no pending work.
+	w.setUnappliedWork(PendingWorkSummary{})
+
+	// Publish the withdrawal of our key once the link, and with it our private key, has been removed. If publishing
+	// fails, it is retried by a retry of the teardown.
+	if !w.ourPublicKeyAgreesWithDataplaneMsg {
+		if err := w.invokeStatusCallback(StatusUpdate{
+			ListeningPort:     w.config.ListeningPort,
+			InterfaceName:     w.config.InterfaceName,
+			RoutingTableIndex: w.config.RoutingTableIndex,
+			KeyState:          KeyStateTornDown,
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("public key: %v", err))
+		} else {
+			w.ourPublicKeyAgreesWithDataplaneMsg = true
+			w.storedKey = zeroKey
+		}
+	}
+
+	if len(errs) > 0 {
+		w.logCxt.WithField("numErrors", len(errs)).Warning("Failed to remove some of the wireguard configuration")
+		return &TeardownError{Errors: errs}
+	}
+	w.logCxt.Info("Wireguard configuration removed")
+	return nil
+}
+
+// flushRouteTables removes all of our routes from the wireguard routing tables. As with ensureDisabled, the routing
+// tables that are not the default table are applied, the routes to the wireguard link in the default table are removed
+// with the link.
+func (w *Wireguard) flushRouteTables(ctx context.Context) error {
+	var routetables []*RouteTableSyncer
+	w.clearRouteTargets()
+	for _, rt := range w.RouteTableSyncers() {
+		if rt.TableIndex() > 0 {
+			// Resync the table so that the routes programmed by a previous instance are also removed.
+			rt.QueueResync()
+			routetables = append(routetables, rt)
+		}
+	}
+	return w.applyRouteTables(ctx, routetables)
+}
+
+// clearRouteTargets removes all of our routes from the wireguard routing tables. The routes are removed from the
+// dataplane once the routing tables are applied.
+func (w *Wireguard) clearRouteTargets() {
+	w.catchAllThrowRoutes = map[ip.CIDR]bool{}
+	w.localCIDRRoutes = map[ip.CIDR]int{}
+	for _, rt := range w.RouteTableSyncers() {
+		rt.setCatchAllRoute(w.config.InterfaceName, nil)
+		rt.SetRoutes(w.config.InterfaceName, nil)
+		rt.SetRoutes(routetable.InterfaceNone, nil)
+	}
+}
+
+// ensureNoPeers removes all of the peers from the wireguard device, if there is one. If the wireguard client is not
+// available then there is no device to remove the peers from, or the peers are removed along with the link.
+func (w *Wireguard) ensureNoPeers(ctx context.Context) error {
+	wireguardClient, err := w.getWireguardClient()
+	if err != nil {
+		w.logCxt.WithError(err).Info("Wireguard client is not available, not removing peers")
+		return nil
+	}
+	wireguardClient = netlinkshim.WireguardWithContext(ctx, wireguardClient)
+
+	device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+	if netlinkshim.IsNotExist(err) {
+		w.logCxt.Debug("Wireguard device does not exist")
+		return nil
+	} else if err != nil {
+		w.closeWireguardClient()
+		return err
+	}
+	if len(device.Peers) == 0 {
+		return nil
+	}
+
+	w.logCxt.WithField("numPeers", len(device.Peers)).Info("Removing wireguard peers")
+	if err := wireguardClient.ConfigureDevice(w.config.InterfaceName, wgtypes.Config{ReplacePeers: true}); err != nil {
+		w.closeWireguardClient()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	netlinkshim "github.com/projectcalico/felix/netlink"
+	timeshim "github.com/projectcalico/felix/time"
+)
+
+// TraceOp is the type of a mutating netlink or wireguard operation recorded in the operation trace.
+type TraceOp string
+
+const (
+	TraceOpLinkAdd         TraceOp = "link-add"
+	TraceOpLinkDelete      TraceOp = "link-delete"
+	TraceOpLinkSetMTU      TraceOp = "link-set-mtu"
+	TraceOpLinkSetUp       TraceOp = "link-set-up"
+	TraceOpAddrAdd         TraceOp = "addr-add"
+	TraceOpAddrDelete      TraceOp = "addr-delete"
+	TraceOpRouteAdd        TraceOp = "route-add"
+	TraceOpRouteDelete     TraceOp = "route-delete"
+	TraceOpRouteReplace    TraceOp = "route-replace"
+	TraceOpRuleAdd         TraceOp = "rule-add"
+	TraceOpRuleDelete      TraceOp = "rule-delete"
+	TraceOpDeviceConfigure TraceOp = "device-configure"
+	TraceOpPeerUpdate      TraceOp = "peer-update"
+	TraceOpPeerRemove      TraceOp = "peer-remove"
+)
+
+// The cause of the operations made outside of an Apply, i.e. by the dataplane syncing the routing tables.
+const traceCauseRouteTableSync = "routing table sync"
+
+// The number of characters of a public key included in a trace entry, enough to identify the peer.
+const traceKeyPrefixLen = 8
+
+// TraceEntry is a mutating netlink or wireguard operation made by the wireguard module, see Config.TraceBufferSize.
+// Only the fields relevant to the operation are set. A configuration of the wireguard device is recorded as an entry
+// for each peer, and an entry for the device settings if these are configured. The private key is never recorded.
+type TraceEntry struct {
+	// The sequence number of the entry, counting from 1 since the module was created. A gap in the sequence numbers of
+	// the dumped entries indicates entries were overwritten.
+	Seq  uint64
+	Time time.Time
+	Op   TraceOp
+
+	// The CIDR of a route or an interface address, the routing table of a route or a rule, the priority of a rule, and
+	// the prefix of the public key of a peer.
+	CIDR       string
+	TableIndex int
+	Priority   int
+	PeerKey    string
+
+	// Any other detail of the operation, e.g. the type of a route or the number of allowed IPs of a peer.
+	Detail string
+
+	// Why the operation was made, e.g. the update of a node or a resync, and the error if the operation failed.
+	Cause string
+	Error string
+}
+
+// operationTrace is a ring buffer of the mutating netlink and wireguard operations, along with the causes of the
+// operations. A nil trace records nothing, so the trace is only created if enabled.
+//
+// The causes are annotated as the updates are processed, against the CIDRs and public keys that the operations refer
+// to, and against the nodes, which are resolved to the CIDRs and public key of the node by the Apply. An operation
+// with no annotated cause is attributed to the phase of the Apply. The causes are cleared once the Apply completes.
+//
+// The operations are recorded by the goroutines of an Apply, and by the routing tables when synced by the dataplane,
+// and the trace is dumped from any goroutine, so all access is serialized.
+type operationTrace struct {
+	time timeshim.Time
+
+	lock    sync.Mutex
+	entries []TraceEntry
+	numSeq  uint64
+
+	cause      string
+	cidrCauses map[ip.CIDR]string
+	keyCauses  map[wgtypes.Key]string
+	nodeCauses map[string]string
+}
+
+// newOperationTrace returns a trace holding the most recent operations, or nil if size is not positive.
+func newOperationTrace(size int, timeShim timeshim.Time) *operationTrace {
+	if size <= 0 {
+		return nil
+	}
+	t := &operationTrace{
+		time:    timeShim,
+		entries: make([]TraceEntry, 0, size),
+	}
+	t.clearCauses()
+	return t
+}
+
+// DumpTrace returns the operations in the trace, oldest first, or nil if the trace is not enabled, see
+// Config.TraceBufferSize. This may be called from any goroutine.
+func (w *Wireguard) DumpTrace() []TraceEntry {
+	return w.trace.dump()
+}
+
+func (t *operationTrace) dump() []TraceEntry {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entries := make([]TraceEntry, 0, len(t.entries))
+	if len(t.entries) == cap(t.entries) {
+		// The buffer is full, so the oldest entry is the one that is overwritten next.
+		next := int(t.numSeq % uint64(cap(t.entries)))
+		entries = append(entries, t.entries[next:]...)
+		return append(entries, t.entries[:next]...)
+	}
+	return append(entries, t.entries...)
+}
+
+// setCause sets the cause of the operations that have no annotated cause, i.e. the phase of the Apply.
+func (t *operationTrace) setCause(cause string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cause = cause
+}
+
+// clearCauses clears the causes once an Apply has completed.
+func (t *operationTrace) clearCauses() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cause = traceCauseRouteTableSync
+	t.cidrCauses = map[ip.CIDR]string{}
+	t.keyCauses = map[wgtypes.Key]string{}
+	t.nodeCauses = map[string]string{}
+}
+
+// annotateCIDR sets the cause of the operations on a CIDR, e.g. its route.
+func (t *operationTrace) annotateCIDR(cidr ip.CIDR, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cidrCauses[cidr] = fmt.Sprintf(format, args...)
+}
+
+// annotateKey sets the cause of the operations on the peer with the public key.
+func (t *operationTrace) annotateKey(key wgtypes.Key, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.keyCauses[key] = fmt.Sprintf(format, args...)
+}
+
+// annotateNode sets the cause of the operations on the peer and routes of a node, see resolveTraceCauses. The cause
+// of an update of the node replaces the cause of any earlier update in the same Apply.
+func (t *operationTrace) annotateNode(name string, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nodeCauses[name] = fmt.Sprintf(format, args...)
+}
+
+// applyCause returns the cause of the operations of an Apply that have no annotated cause.
+func (w *Wireguard) applyCause() string {
+	if w.fullRebuild {
+		return "full rebuild"
+	} else if !w.inSyncWireguard || !w.inSyncLink || !w.inSyncRouteRule {
+		return "resync"
+	}
+	return "dataplane update"
+}
+
+// resolveTraceCauses attributes the causes annotated against the nodes to the public keys and CIDRs of the nodes. The
+// cause of a CIDR annotated against the CIDR itself takes precedence. This is called before the peer updates are
+// applied to the cache, to resolve the previous keys and CIDRs of the nodes, and again afterwards to resolve the
+// new ones.
+func (w *Wireguard) resolveTraceCauses() {
+	t := w.trace
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for name, cause := range t.nodeCauses {
+		node := w.peers[name]
+		if node == nil {
+			continue
+		}
+		if node.publicKey != zeroKey {
+			t.keyCauses[node.publicKey] = cause
+		}
+		node.cidrs.Iter(func(item interface{}) error {
+			cidr := item.(ip.CIDR)
+			if _, ok := t.cidrCauses[cidr]; !ok {
+				t.cidrCauses[cidr] = cause
+			}
+			return nil
+		})
+	}
+}
+
+// record adds an operation to the trace, overwriting the oldest entry once the buffer is full. The cause is the cause
+// annotated against the public key of the entry, or else the CIDR, or else the cause of the phase of the Apply.
+func (t *operationTrace) record(entry TraceEntry, key wgtypes.Key, cidr ip.CIDR, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.numSeq++
+	entry.Seq = t.numSeq
+	entry.Time = t.time.Now()
+	if entry.Cause == "" {
+		entry.Cause = t.causeLocked(key, cidr)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if len(t.entries) < cap(t.entries) {
+		t.entries = append(t.entries, entry)
+	} else {
+		t.entries[(t.numSeq-1)%uint64(cap(t.entries))] = entry
+	}
+}
+
+func (t *operationTrace) causeLocked(key wgtypes.Key, cidr ip.CIDR) string {
+	if cause, ok := t.keyCauses[key]; ok && key != zeroKey {
+		return cause
+	}
+	if cidr != nil {
+		if cause, ok := t.cidrCauses[cidr]; ok {
+			return cause
+		}
+	}
+	return t.cause
+}
+
+// newNetlink wraps a netlink client factory so that the mutating calls of the clients are recorded in the trace.
+func (t *operationTrace) newNetlink(
+	newNetlink func() (netlinkshim.Netlink, error),
+) func() (netlinkshim.Netlink, error) {
+	if t == nil {
+		return newNetlink
+	}
+	return func() (netlinkshim.Netlink, error) {
+		nl, err := newNetlink()
+		if err != nil {
+			return nil, err
+		}
+		return &tracedNetlink{Netlink: nl, trace: t}, nil
+	}
+}
+
+// wireguard returns a wireguard client whose device configurations are recorded in the trace.
+func (t *operationTrace) wireguard(wg netlinkshim.Wireguard) netlinkshim.Wireguard {
+	if t == nil {
+		return wg
+	}
+	return &tracedWireguard{Wireguard: wg, trace: t}
+}
+
+// tracedNetlink records the mutating calls of a netlink client.
+type tracedNetlink struct {
+	netlinkshim.Netlink
+	trace *operationTrace
+}
+
+func (n *tracedNetlink) recordLink(op TraceOp, link netlink.Link, detail string, err error) {
+	if link != nil {
+		detail = fmt.Sprintf("name=%s %s", link.Attrs().Name, detail)
+	}
+	n.trace.record(TraceEntry{Op: op, Detail: detail}, zeroKey, nil, err)
+}
+
+func (n *tracedNetlink) LinkAdd(link netlink.Link) error {
+	err := n.Netlink.LinkAdd(link)
+	n.recordLink(TraceOpLinkAdd, link, fmt.Sprintf("type=%s", link.Type()), err)
+	return err
+}
+
+func (n *tracedNetlink) LinkDel(link netlink.Link) error {
+	err := n.Netlink.LinkDel(link)
+	n.recordLink(TraceOpLinkDelete, link, "", err)
+	return err
+}
+
+func (n *tracedNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	err := n.Netlink.LinkSetMTU(link, mtu)
+	n.recordLink(TraceOpLinkSetMTU, link, fmt.Sprintf("mtu=%d", mtu), err)
+	return err
+}
+
+func (n *tracedNetlink) LinkSetUp(link netlink.Link) error {
+	err := n.Netlink.LinkSetUp(link)
+	n.recordLink(TraceOpLinkSetUp, link, "", err)
+	return err
+}
+
+func (n *tracedNetlink) recordAddr(op TraceOp, addr *netlink.Addr, err error) {
+	entry := TraceEntry{Op: op}
+	if addr != nil && addr.IPNet != nil {
+		entry.CIDR = addr.IPNet.String()
+	}
+	n.trace.record(entry, zeroKey, nil, err)
+}
+
+func (n *tracedNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	err := n.Netlink.AddrAdd(link, addr)
+	n.recordAddr(TraceOpAddrAdd, addr, err)
+	return err
+}
+
+func (n *tracedNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	err := n.Netlink.AddrDel(link, addr)
+	n.recordAddr(TraceOpAddrDelete, addr, err)
+	return err
+}
+
+func (n *tracedNetlink) recordRoute(op TraceOp, route *netlink.Route, err error) {
+	entry := TraceEntry{
+		Op:         op,
+		TableIndex: route.Table,
+		Detail:     fmt.Sprintf("type=%s linkIndex=%d", routeTypeName(route.Type), route.LinkIndex),
+	}
+	var cidr ip.CIDR
+	if route.Dst != nil {
+		cidr = ip.CIDRFromIPNet(route.Dst)
+		entry.CIDR = cidr.String()
+	}
+	n.trace.record(entry, zeroKey, cidr, err)
+}
+
+// routeTypeName returns the name of the type of a route, as used by the ip command, for the common types.
+func routeTypeName(t int) string {
+	switch routeType(t) {
+	case syscall.RTN_UNICAST:
+		return "unicast"
+	case syscall.RTN_THROW:
+		return "throw"
+	case syscall.RTN_BLACKHOLE:
+		return "blackhole"
+	case syscall.RTN_UNREACHABLE:
+		return "unreachable"
+	}
+	return fmt.Sprint(t)
+}
+
+func (n *tracedNetlink) RouteAdd(route *netlink.Route) error {
+	err := n.Netlink.RouteAdd(route)
+	n.recordRoute(TraceOpRouteAdd, route, err)
+	return err
+}
+
+func (n *tracedNetlink) RouteDel(route *netlink.Route) error {
+	err := n.Netlink.RouteDel(route)
+	n.recordRoute(TraceOpRouteDelete, route, err)
+	return err
+}
+
+func (n *tracedNetlink) RouteReplace(route *netlink.Route) error {
+	err := n.Netlink.RouteReplace(route)
+	n.recordRoute(TraceOpRouteReplace, route, err)
+	return err
+}
+
+func (n *tracedNetlink) recordRule(op TraceOp, rule *netlink.Rule, err error) {
+	n.trace.record(TraceEntry{
+		Op:         op,
+		TableIndex: rule.Table,
+		Priority:   rule.Priority,
+		Detail:     fmt.Sprintf("mark=%#x invert=%v", rule.Mark, rule.Invert),
+	}, zeroKey, nil, err)
+}
+
+func (n *tracedNetlink) RuleAdd(rule *netlink.Rule) error {
+	err := n.Netlink.RuleAdd(rule)
+	n.recordRule(TraceOpRuleAdd, rule, err)
+	return err
+}
+
+func (n *tracedNetlink) RuleDel(rule *netlink.Rule) error {
+	err := n.Netlink.RuleDel(rule)
+	n.recordRule(TraceOpRuleDelete, rule, err)
+	return err
+}
+
+// tracedWireguard records the device configurations of a wireguard client.
+type tracedWireguard struct {
+	netlinkshim.Wireguard
+	trace *operationTrace
+}
+
+func (c *tracedWireguard) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	err := c.Wireguard.ConfigureDevice(name, cfg)
+	if cfg.PrivateKey != nil || cfg.ListenPort != nil || cfg.FirewallMark != nil || cfg.ReplacePeers {
+		detail := fmt.Sprintf("name=%s privateKey=%v", name, cfg.PrivateKey != nil)
+		if cfg.ListenPort != nil {
+			detail += fmt.Sprintf(" listenPort=%d", *cfg.ListenPort)
+		}
+		if cfg.FirewallMark != nil {
+			detail += fmt.Sprintf(" firewallMark=%#x", *cfg.FirewallMark)
+		}
+		if cfg.ReplacePeers {
+			detail += " replacePeers"
+		}
+		c.trace.record(TraceEntry{Op: TraceOpDeviceConfigure, Detail: detail}, zeroKey, nil, err)
+	}
+	for _, peer := range cfg.Peers {
+		entry := TraceEntry{Op: TraceOpPeerUpdate, PeerKey: peer.PublicKey.String()[:traceKeyPrefixLen]}
+		var cidr ip.CIDR
+		if peer.Remove {
+			entry.Op = TraceOpPeerRemove
+		} else {
+			entry.Detail = fmt.Sprintf("allowedIPs=%d replaceAllowedIPs=%v", len(peer.AllowedIPs),
+				peer.ReplaceAllowedIPs)
+			if peer.UpdateOnly {
+				entry.Detail += " updateOnly"
+			}
+			if len(peer.AllowedIPs) > 0 {
+				cidr = ip.CIDRFromIPNet(&peer.AllowedIPs[0])
+			}
+		}
+		c.trace.record(entry, peer.PublicKey, cidr, err)
+	}
+	return err
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// PathVerdict is how the traffic to a destination is handled by the wireguard routing, see Wireguard.WhatIf.
+type PathVerdict string
+
+const (
+	// PathVerdictEncrypted is traffic that is routed to the wireguard interface and encrypted for a peer.
+	PathVerdictEncrypted PathVerdict = "Encrypted"
+	// PathVerdictFallThrough is traffic that is sent to the wireguard routing tables but falls through to the next
+	// routing rule, either after a throw route or because no route matches, and so is not encrypted.
+	PathVerdictFallThrough PathVerdict = "FallThrough"
+	// PathVerdictBlackhole is traffic that is routed to the wireguard interface but is dropped, e.g. because no peer has
+	// an allowed IP for the destination.
+	PathVerdictBlackhole PathVerdict = "Blackhole"
+	// PathVerdictNotDiverted is traffic that our routing rules do not send to the wireguard routing tables.
+	PathVerdictNotDiverted PathVerdict = "NotDiverted"
+)
+
+// PathReport is the result of Wireguard.WhatIf for a destination.
+type PathReport struct {
+	Destination ip.Addr
+	Verdict     PathVerdict
+
+	// Reason explains why the traffic is not encrypted.
+	Reason string
+
+	// Route is the CIDR of the route that determined the verdict in the routing table TableIndex, or nil if no route
+	// matched.
+	Route      ip.CIDR
+	TableIndex int
+
+	// Peer, PublicKey and Endpoint identify the peer that the traffic is encrypted for. The peer is also set for a
+	// blackhole verdict if the peer has no endpoint.
+	Peer      string
+	PublicKey wgtypes.Key
+	Endpoint  *net.UDPAddr
+
+	// RuleSelectors are the selectors of our routing rules. The traffic is only sent to the wireguard routing tables if
+	// it matches all of the selectors, e.g. it is from one of the local pod CIDRs with RuleSelectorSource.
+	RuleSelectors []RuleSelector
+
+	// Diverged is set if the desired configuration handles the destination differently from the programmed
+	// configuration, e.g. because an update failed to apply or a route is held back, in which case Desired is the report
+	// for the desired configuration.
+	Diverged bool
+	Desired  *PathReport
+}
+
+// whatIfQuery is a WhatIf queued by QueueWhatIf.
+type whatIfQuery struct {
+	dst      ip.Addr
+	callback func(*PathReport, error)
+}
+
+// WhatIf reports how the traffic from this node to the destination is handled, by walking the cached configuration as
+// the kernel would: whether our routing rules send the traffic to the wireguard routing tables, the longest prefix
+// match among the routes in the tables in the order of their rules, and the peer whose allowed IPs match the
+// destination.
+//
+// The report is for the configuration programmed by the last Apply. If the desired configuration handles the
+// destination differently the report is flagged as diverged. Updates that have not yet been processed by an Apply are
+// not reflected in either configuration. This should be called from the same goroutine as Apply.
+func (w *Wireguard) WhatIf(dst ip.Addr) (*PathReport, error) {
+	if dst == nil {
+		return nil, fmt.Errorf("no destination address")
+	} else if dst.Version() != w.config.ipVersion() {
+		return nil, fmt.Errorf("destination %s is not IPv%d", dst, w.config.ipVersion())
+	}
+	report := w.walkPath(dst, true)
+	if desired := w.walkPath(dst, false); !reflect.DeepEqual(report, desired) {
+		report.Diverged = true
+		report.Desired = desired
+	}
+	return report, nil
+}
+
+// QueueWhatIf queues a WhatIf for the destination that is answered once the next Apply completes, and requests an
+// Apply. The callback is invoked from the goroutine calling Apply. This may be called from any goroutine, e.g. to serve
+// a diagnostics request.
+func (w *Wireguard) QueueWhatIf(dst ip.Addr, callback func(*PathReport, error)) {
+	w.queuedUpdatesLock.Lock()
+	w.whatIfQueries = append(w.whatIfQueries, whatIfQuery{dst: dst, callback: callback})
+	w.queuedUpdatesLock.Unlock()
+	w.kick()
+}
+
+// answerWhatIfQueries answers the queries queued by QueueWhatIf. This is called once an Apply completes.
+func (w *Wireguard) answerWhatIfQueries() {
+	w.queuedUpdatesLock.Lock()
+	queries := w.whatIfQueries
+	w.whatIfQueries = nil
+	w.queuedUpdatesLock.Unlock()
+
+	for _, query := range queries {
+		query.callback(w.WhatIf(query.dst))
+	}
+}
+
+// walkPath returns the report for the destination from either the programmed or the desired configuration.
+func (w *Wireguard) walkPath(dst ip.Addr, programmed bool) *PathReport {
+	report := &PathReport{Destination: dst, RuleSelectors: w.ruleSelectors}
+	if reason := w.notDivertedReason(dst, programmed); reason != "" {
+		report.Verdict = PathVerdictNotDiverted
+		report.Reason = reason
+		return report
+	}
+
+	// Our rules for each of the routing tables have the same priority, and are evaluated in the order they were added.
+	// A throw route, or no matching route, continues with the rule for the next table.
+	for _, rt := range w.RouteTableSyncers() {
+		target, ok := w.longestPrefixMatch(rt, dst, programmed)
+		if !ok {
+			continue
+		}
+		report.Route, report.TableIndex = target.CIDR, rt.TableIndex()
+		if target.Type == routetable.TargetTypeThrow {
+			report.Reason = w.throwRouteReason(target.CIDR)
+			continue
+		}
+		w.walkWireguardPath(report, dst, programmed)
+		return report
+	}
+	report.Verdict = PathVerdictFallThrough
+	if report.Route == nil {
+		report.Reason = "no route in the wireguard routing tables"
+	}
+	return report
+}
+
+// notDivertedReason returns the reason that our routing rules do not send the traffic to the destination to the
+// wireguard routing tables, or "" if they do.
+func (w *Wireguard) notDivertedReason(dst ip.Addr, programmed bool) string {
+	switch {
+	case w.tornDown:
+		return "wireguard has been torn down"
+	case !w.config.Enabled:
+		return "wireguard is not enabled"
+	case w.wireguardNotSupported:
+		return "wireguard is not supported"
+	case w.routingTableErr != nil:
+		return "the wireguard routing tables are not valid"
+	case programmed && !w.inSyncRouteRule:
+		return "the routing rules have not been programmed"
+	case len(w.routeRules(w.rulePriority, w.config.RoutingTableIndex)) == 0:
+		return "the routing rule selectors match no traffic"
+	}
+	for _, cidr := range w.exclusionCIDRs {
+		if ipNet := cidr.ToIPNet(); ipNet.Contains(dst.AsNetIP()) {
+			return fmt.Sprintf("the exclusion rule for %s looks up the main routing table first", cidr)
+		}
+	}
+	return ""
+}
+
+// longestPrefixMatch returns the route in the routing table with the longest prefix that contains the destination. The
+// desired routes include the routes to wireguard that are held back until the peer is programmed.
+func (w *Wireguard) longestPrefixMatch(rt *RouteTableSyncer, dst ip.Addr, programmed bool) (routetable.Target, bool) {
+	targets := func(ifaceName string) map[ip.CIDR]routetable.Target {
+		if programmed {
+			return rt.AppliedTargets(ifaceName)
+		}
+		return rt.Targets(ifaceName)
+	}
+	routes := targets(routetable.InterfaceNone)
+	for cidr, target := range targets(w.config.InterfaceName) {
+		routes[cidr] = target
+	}
+	if target, ok := rt.catchAllRoute(); ok {
+		// The routes to wireguard of the CIDRs that are not within a throw route are programmed through the catch-all
+		// route, which routes them the same.
+		if _, ok := routes[target.CIDR]; !ok {
+			routes[target.CIDR] = target
+		}
+	}
+	if !programmed {
+		for cidr, pending := range w.routesPendingWireguard {
+			if w.tableIndexForCIDR(cidr) == rt.TableIndex() {
+				routes[cidr] = pending.target
+			}
+		}
+	}
+
+	for prefix := int(dst.AsCIDR().Prefix()); prefix >= 0; prefix-- {
+		if target, ok := routes[ip.CIDRFromAddrAndPrefix(dst, prefix)]; ok {
+			return target, true
+		}
+	}
+	return routetable.Target{}, false
+}
+
+// throwRouteReason returns the reason for a throw route.
+func (w *Wireguard) throwRouteReason(cidr ip.CIDR) string {
+	if _, ok := w.localCIDRRoutes[cidr]; ok {
+		return fmt.Sprintf("throw route for local CIDR %s", cidr)
+	} else if w.catchAllThrowRoutes[cidr] {
+		return fmt.Sprintf("throw route for %s, which escapes the catch-all route", cidr)
+	}
+	name, ok := w.cidrToNodeName[cidr]
+	if !ok {
+		return fmt.Sprintf("throw route for %s", cidr)
+	} else if w.optedOutNodes.Contains(name) {
+		return fmt.Sprintf("throw route for %s of peer %s, which is excluded by policy", cidr, name)
+	} else if peer := w.peers[name]; peer != nil && peer.routingToWireguard {
+		return fmt.Sprintf("throw route for %s of peer %s, which is not programmed in wireguard", cidr, name)
+	}
+	return fmt.Sprintf("throw route for %s of peer %s, which is not routed to wireguard", cidr, name)
+}
+
+// walkWireguardPath completes the report for traffic routed to the wireguard interface. The device encrypts the
+// traffic for the peer with the longest allowed IP that contains the destination, and drops the traffic if there is no
+// such peer or the peer has no endpoint. A CIDR of a peer whose configuration failed to apply is only known to be
+// programmed once its held back route has been added.
+func (w *Wireguard) walkWireguardPath(report *PathReport, dst ip.Addr, programmed bool) {
+	report.Verdict = PathVerdictBlackhole
+	if !w.linkUsable {
+		report.Reason = "the wireguard link is not up"
+		return
+	}
+
+	for prefix := int(dst.AsCIDR().Prefix()); prefix >= 0; prefix-- {
+		cidr := ip.CIDRFromAddrAndPrefix(dst, prefix)
+		name, ok := w.cidrToNodeName[cidr]
+		if !ok {
+			continue
+		}
+		peer := w.peers[name]
+		if peer == nil || !w.wireguardCIDRs(peer).Contains(cidr) {
+			continue
+		} else if _, pending := w.routesPendingWireguard[cidr]; programmed && (pending || !peer.programmedInWireguard) {
+			// The route of a CIDR is held back until the CIDR is programmed as an allowed IP of the peer.
+			continue
+		} else if !programmed && !w.shouldProgramWireguardPeer(name, peer) {
+			continue
+		}
+
+		report.Peer, report.PublicKey = name, peer.publicKey
+		if report.Endpoint = w.endpointUDPAddr(name, peer); report.Endpoint == nil {
+			report.Reason = fmt.Sprintf("peer %s has no endpoint", name)
+			return
+		}
+		report.Verdict = PathVerdictEncrypted
+		return
+	}
+	report.Reason = fmt.Sprintf("no wireguard peer has an allowed IP for %s", dst)
+}
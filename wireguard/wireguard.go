@@ -15,12 +15,20 @@
 package wireguard
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"os/exec"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -41,22 +49,171 @@ const (
 	// For wireguard client connections we back off retries and only try to actually connect once every
 	// <wireguardClientRetryInterval> requests.
 	wireguardClientRetryInterval = 10
+
+	// A session is rejected by wireguard if there has been no handshake for 180s. Handshakes are renewed every 120s
+	// while there is traffic, so by default a handshake older than this indicates the peer is not reachable, see
+	// Config.StaleHandshakeThreshold.
+	staleHandshakeAge = 180 * time.Second
+
+	// The delay before wireguard support is first re-probed after it is found not to be supported, see
+	// Config.NotSupportedReprobeInterval.
+	notSupportedFirstReprobeDelay = 30 * time.Second
+
+	// The maximum number of peers configured in a single wireguard device configuration. Larger configurations may
+	// exceed the netlink message size and are split across multiple requests.
+	maxPeersPerConfigureDevice = 100
+
+	// The number of consecutive Applies that may find the wireguard device busy when deleting it while wireguard is
+	// disabled, before the failure is escalated, see LinkBusyError.
+	maxLinkBusyAttempts = 5
 )
 
 var (
 	ErrUpdateFailed                = errors.New("netlink update operation failed")
 	ErrNotSupportedTooManyFailures = errors.New("operation not supported (too many failures)")
-
-	// Internal types
-	errWrongInterfaceType = errors.New("incorrect interface type for wireguard")
+	ErrWrongLinkType               = errors.New("incorrect interface type for wireguard")
+	ErrInvalidRoutingTableIndex    = errors.New("invalid wireguard routing table index")
 
 	zeroKey = wgtypes.Key{}
+
+	gaugeSkippedPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_wireguard_skipped_peers",
+		Help: "Number of wireguard peers that are not programmed because the maximum number of peers is exceeded.",
+	})
+	gaugeSkippedAllowedIPs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_wireguard_skipped_allowed_ips",
+		Help: "Number of wireguard allowed IPs that are not programmed because the maximum per peer is exceeded.",
+	})
 )
 
+func init() {
+	prometheus.MustRegister(gaugeSkippedPeers, gaugeSkippedAllowedIPs)
+}
+
+// LimitExceededError is returned by LimitError when the configured maximum number of peers or allowed IPs per peer is
+// exceeded. The skipped peers and allowed IPs are not programmed in wireguard and are routed without wireguard.
+type LimitExceededError struct {
+	SkippedPeers      int
+	SkippedAllowedIPs int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("wireguard limits exceeded: %d peers and %d allowed IPs are not programmed",
+		e.SkippedPeers, e.SkippedAllowedIPs)
+}
+
+// UnderlayAddressError is returned by Apply when the source address of the wireguard traffic is not configured on the
+// underlay interface, see Config.UnderlayInterface. The underlay routing is removed until the address is configured.
+type UnderlayAddressError struct {
+	Interface string
+	Address   ip.Addr
+}
+
+func (e *UnderlayAddressError) Error() string {
+	return fmt.Sprintf("wireguard source address %s is not configured on underlay interface %s", e.Address, e.Interface)
+}
+
+// DeadlineExceededError is returned by Apply when the deadline of the Apply is exceeded, or its context is cancelled,
+// before all of the dataplane updates have been applied. Step is the step of the Apply that was abandoned, the
+// remaining steps are not attempted. The updates that were not applied are retried by the next Apply.
+type DeadlineExceededError struct {
+	Step string
+	Err  error
+}
+
+func (e *DeadlineExceededError) Error() string {
+	return fmt.Sprintf("wireguard apply abandoned during %s: %v", e.Step, e.Err)
+}
+
+func (e *DeadlineExceededError) Unwrap() error {
+	return e.Err
+}
+
+// LinkBusyError is returned by Apply when wireguard is disabled and the wireguard device could not be deleted because
+// it is busy, e.g. while traffic is flowing. The peers, routes and routing rules have already been removed, so traffic
+// is no longer routed to the device. This is retryable: the next Apply resumes the removal by deleting the device. If
+// the device is still busy after maxLinkBusyAttempts Applies the failure is escalated and an ApplyError is returned.
+type LinkBusyError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *LinkBusyError) Error() string {
+	return fmt.Sprintf("wireguard device busy, deletion attempted %d times: %v", e.Attempts, e.Err)
+}
+
+func (e *LinkBusyError) Unwrap() error {
+	return e.Err
+}
+
+// TeardownError is returned by Teardown when some of the wireguard configuration could not be removed. Errors has an
+// error for each of the steps of the teardown that failed.
+type TeardownError struct {
+	Errors []error
+}
+
+func (e *TeardownError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("wireguard teardown failed: %s", strings.Join(msgs, "; "))
+}
+
 const (
 	wireguardType = "wireguard"
+
+	// Userspace wireguard implementations use a tun device.
+	userspaceType = "tun"
+
+	// The wireguard encapsulation overhead: the outer IP header, an 8 byte UDP header and a 32 byte wireguard header
+	// and authentication tag.
+	overheadIPv4 = 20 + 8 + 32
+	overheadIPv6 = 40 + 8 + 32
+)
+
+// Mode is the implementation of the local wireguard device.
+type Mode string
+
+const (
+	ModeKernel    Mode = "kernel"
+	ModeUserspace Mode = "userspace"
+)
+
+// HandshakeState describes the most recent handshake with a peer, as reported by the wireguard device.
+type HandshakeState string
+
+const (
+	HandshakeStateNone   HandshakeState = "none"
+	HandshakeStateRecent HandshakeState = "recent"
+	HandshakeStateStale  HandshakeState = "stale"
 )
 
+// PeerDiagnostics contains the endpoint of a peer as configured from the datastore, along with the endpoint, last
+// handshake time and traffic counters reported by the wireguard device. The device endpoint is learned from the source
+// address of the last handshake, so it differs from the configured endpoint if the peer is behind NAT.
+type PeerDiagnostics struct {
+	PublicKey          wgtypes.Key
+	ConfiguredEndpoint *net.UDPAddr
+	KernelEndpoint     *net.UDPAddr
+	LastHandshakeTime  time.Time
+	HandshakeState     HandshakeState
+	ReceiveBytes       int64
+	TransmitBytes      int64
+
+	// SecondaryEndpoint is true if the peer is reached through the secondary address of the node after a failover, and
+	// EndpointFailovers is the number of times the endpoint has been switched, see Config.EndpointFailoverTimeout.
+	SecondaryEndpoint bool
+	EndpointFailovers int
+
+	// ProvisionalKeyFrom is the name of the removed node whose public key the peer is using until its own key arrives,
+	// see Config.ProvisionalKeyTimeout.
+	ProvisionalKeyFrom string
+}
+
+// noOpConnTrack disables the conntrack cleanup of the routetables. The routes of a CIDR move between the wireguard
+// interface and the throw routes, which the routetable sees as a removal of the CIDR from one of the interfaces, so the
+// conntrack entries are instead removed by the wireguard module, see SetConntrackCleaner.
 type noOpConnTrack struct{}
 
 func (*noOpConnTrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {}
@@ -64,32 +221,48 @@ func (*noOpConnTrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {}
 type peerData struct {
 	ipv4EndpointAddr      ip.Addr
 	publicKey             wgtypes.Key
+	listeningPort         int
 	cidrs                 set.Set
 	programmedInWireguard bool
 	routingToWireguard    bool
 }
 
+// isEmpty returns true if the peer has no configuration left, in which case there is nothing programmed for the peer.
+func (p *peerData) isEmpty() bool {
+	return p.ipv4EndpointAddr == nil && p.publicKey == zeroKey && p.listeningPort == 0 && p.cidrs.Len() == 0
+}
+
 func newPeerData() *peerData {
 	return &peerData{
 		cidrs: set.New(),
 	}
 }
 
-func (n *peerData) allowedCidrsForWireguard() []net.IPNet {
-	cidrs := make([]net.IPNet, 0, n.cidrs.Len())
-	n.cidrs.Iter(func(item interface{}) error {
-		cidrs = append(cidrs, item.(ip.CIDR).ToIPNet())
-		return nil
-	})
-	return cidrs
+// pendingRoute is a route to the wireguard interface that is held back until the wireguard configuration of the peer
+// has been applied. The route to the previous interface, if any, remains programmed until then.
+type pendingRoute struct {
+	nodeName     string
+	oldIfaceName string
+	target       routetable.Target
 }
 
 type peerUpdateData struct {
 	deleted             bool
+	statusUpdated       bool
+	cidrsReclassified   bool
 	ipv4EndpointAddr    *ip.Addr
 	publicKey           *wgtypes.Key
+	listeningPort       *int
 	allowedCidrsAdded   set.Set
 	allowedCidrsDeleted set.Set
+
+	// gatewayUpdated is set if the interface address of the peer has changed while the routes of the peer are via the
+	// interface address, see Config.RouteViaPeerTunnelIP, so that all of the routes of the peer are updated.
+	gatewayUpdated bool
+
+	// fromState is the lifecycle state of the node before its previous public key was cleared by the deletion
+	// processing, so that the state change is logged from the state before the update.
+	fromState NodeState
 }
 
 func newPeerUpdateData() *peerUpdateData {
@@ -100,10 +273,89 @@ func newPeerUpdateData() *peerUpdateData {
 }
 
 type Wireguard struct {
-	// Wireguard configuration (this will not change without a restart).
-	hostname string
-	config   *Config
-	logCxt   *logrus.Entry
+	// Wireguard configuration (this will not change without a restart), other than our hostname which is canonicalized
+	// once a node name canonicalizer is set, see SetNodeNameCanonicalizer, and the settings overridden by the node
+	// overrides file, which is re-read on a resync. The base configuration is the configuration without the overrides.
+	// Enabled may also be overridden on this node at runtime, see SetNodeOverrideEnabled.
+	hostname   string
+	config     *Config
+	baseConfig *Config
+	logCxt     *logrus.Entry
+
+	// The override of Config.Enabled on this node, or nil if the configuration is followed, see SetNodeOverrideEnabled.
+	enabledOverride *bool
+
+	// The excluded CIDRs, which may be changed by UpdateConfig, and whether any CIDRs have been excluded. Once CIDRs have
+	// been excluded, the routes of a peer routed to wireguard may include throw routes.
+	excludeCIDRs      []ip.CIDR
+	cidrsExcludedEver bool
+
+	// The verifier of the CIDRs attributed to the peers, see SetCIDRVerifier, and the CIDRs that it denied. Denied CIDRs
+	// are routed as if excluded. The number of denials since the last denial was logged rate limits the logs.
+	cidrVerifier          CIDRVerifier
+	deniedCIDRs           set.Set
+	numDeniedCIDRs        int
+	numDenialsSinceLog    int
+	lastDeniedCIDRLogTime time.Time
+
+	// The peers of an existing device adopted by the first resync of the device, see Config.AdoptExistingDevice, which
+	// are left intact until the datastore is in sync. Whether the adoption has been attempted, and whether the
+	// datastore is in sync, see DatastoreInSync.
+	adoptedPeers    set.Set
+	adoptionDone    bool
+	datastoreInSync bool
+
+	// The secondary addresses of the nodes, and the handshake monitoring of the peers with a secondary address, see
+	// Config.EndpointFailoverTimeout.
+	nodeNameToSecondaryAddr map[string]ip.Addr
+	endpointFailovers       map[string]*endpointFailover
+
+	// The keys of the recently removed nodes by their endpoint address, and the keys carried over to the nodes added
+	// with the same endpoint address, see Config.ProvisionalKeyTimeout.
+	removedNodes    map[ip.Addr]*removedNode
+	provisionalKeys map[string]*provisionalKey
+
+	// The key transitions of the nodes that published their previous key alongside a new key, and the previous keys
+	// whose peers are to be removed from the device, see Config.KeyTransitionTimeout.
+	peerKeyTransitions  map[string]*peerKeyTransition
+	retiredPreviousKeys set.Set
+
+	// The CIDRs of the local host and their route classes, and the routing table of each throw route programmed for
+	// them, see Config.LocalCIDRsAsThrow.
+	localCIDRs      map[ip.CIDR]RouteClass
+	localCIDRRoutes map[ip.CIDR]int
+
+	// The recent moves of the allowed CIDRs between peers, and the CIDRs whose moves are suppressed, see
+	// Config.CIDRFlapMaxMoves.
+	cidrFlaps   map[ip.CIDR]*cidrFlapState
+	dampedCIDRs set.Set
+
+	// The source of our interface address and the pool a derived address is chosen from, which may be changed by
+	// UpdateConfig, and our interface address from the local wireguard configuration in the datastore, which is only
+	// used if that is the source.
+	interfaceAddrSource        InterfaceAddressSource
+	interfaceAddrPool          ip.CIDR
+	datastoreIPv4InterfaceAddr ip.Addr
+
+	// The selectors of our routing rules, which may be changed by UpdateConfig, the local pod CIDRs selected by
+	// RuleSelectorSource and the interfaces that are up and may be selected by RuleSelectorIif.
+	ruleSelectors   []RuleSelector
+	ruleSourceCIDRs set.Set
+	ruleIifNames    set.Set
+
+	// How the peers that are not routed to wireguard are handled, which may be changed by UpdateConfig, and the CIDRs
+	// of those peers that have exclusion rules, see NonWireguardPeerHandlingRuleExclude. The exclusion CIDRs are
+	// recalculated when the peers are updated, or when flagged as dirty.
+	nonWireguardHandling NonWireguardPeerHandling
+	exclusionCIDRs       []ip.CIDR
+	exclusionCIDRsDirty  bool
+
+	// Whether the routes to the wireguard interface are programmed through the catch-all route, and the CIDRs that
+	// escape it, which may be changed by UpdateConfig, and the CIDRs of the throw routes programmed for them, see
+	// Config.CatchAllRoute.
+	catchAllRoute       bool
+	catchAllThrowCIDRs  []ip.CIDR
+	catchAllThrowRoutes map[ip.CIDR]bool
 
 	// Clients, client factories and testing shims.
 	newNetlinkClient                     func() (netlinkshim.Netlink, error)
@@ -114,34 +366,256 @@ type Wireguard struct {
 	numConsistentWireguardClientFailures int
 	time                                 timeshim.Time
 
-	// State information.
+	// The owner of the wireguard device if it is shared with the instance for the other IP version, otherwise nil.
+	deviceOwner *DeviceOwner
+
+	// State information. The rules are only listed and reconciled while they are not in-sync, i.e. on a resync, after a
+	// failed rule operation, or once the netlink client has been recreated, see getNetlinkClient. A rule deleted
+	// out-of-band is otherwise only restored by the next resync.
 	inSyncWireguard                    bool
 	inSyncLink                         bool
-	inSyncInterfaceAddr                bool
 	inSyncRouteRule                    bool
+	inSyncUnderlay                     bool
+	inSyncLocalRoutes                  bool
 	ifaceUp                            bool
+	linkUsable                         bool
+	linkIndex                          int
+	rulePriority                       int
 	wireguardNotSupported              bool
+	userspaceHelperRun                 bool
+	fullRebuild                        bool
+	tornDown                           bool
+	disableStep                        disableStep
+	linkBusyAttempts                   int
 	ourPublicKey                       *wgtypes.Key
+	intendedKey                        *intendedKey
+	ourIPv4EndpointAddr                ip.Addr
 	ourIPv4InterfaceAddr               ip.Addr
 	ourPublicKeyAgreesWithDataplaneMsg bool
+	localAddressWaitReported           bool
+
+	// Whether the interface has been reported up since the device configuration was last verified, see
+	// verifyDeviceAfterUp.
+	deviceVerificationDue bool
+
+	// The peers updated within the current window, and whether their programming is held, see holdPeerBatch.
+	peerBatch peerBatchState
+
+	// Whether the routing tables have been applied successfully. Until then the routing rules wait for the routing
+	// tables, so that the throw routes are in place before the rules, after that the rules are reconciled whether or
+	// not the routing tables are failing, see ApplyError.
+	routeTablesApplied bool
+
+	// The generation of our published public key, incremented each time the key is published, and the generation last
+	// echoed back in a local EndpointWireguardUpdate. A local update with a different key received while a publish is
+	// in-flight is a stale echo and does not trigger another publish, unless it is still unacknowledged at the next
+	// resync.
+	publishGeneration       uint64
+	echoedPublishGeneration uint64
+	staleEchoPending        bool
+
+	// The key stored for our node, which is the key the peers are using, and our key transition while the peers may
+	// still be using our previous key, see Config.KeyTransitionTimeout.
+	storedKey          wgtypes.Key
+	localKeyTransition *localKeyTransition
+
+	// The number of stale echoes of our key, and the time of the last republication of our key triggered by a stale
+	// echo once our publish had been acknowledged. Further republications are deferred until staleKeyRepublishInterval
+	// has passed, see onStaleKeyEcho.
+	numStaleKeyEchoes         int
+	lastStaleKeyRepublish     time.Time
+	staleKeyRepublishDeferred bool
+
+	// The number of consecutive key conflicts returned by the status callback, and the time the publication of our
+	// key is retried, see handleKeyConflict.
+	numKeyConflicts  int
+	publishRetryTime time.Time
 
 	// Current configuration
 	// - all peerData information
-	// - mapping between CIDRs and peerData
+	// - mapping between CIDRs and peerData, keyed by the exact CIDR since the CIDRs of peers may overlap
 	// - mapping between public key and peers - this does not include the "zero" key.
 	peers                map[string]*peerData
 	cidrToNodeName       map[ip.CIDR]string
 	publicKeyToNodeNames map[wgtypes.Key]set.Set
 
+	// Sources of the peer CIDRs
+	// - CIDRs added through EndpointAllowedCIDRAdd
+	// - the /32 CIDR of each peer's wireguard interface address
+	allowedCIDRToNodeName   map[ip.CIDR]string
+	interfaceCIDRToNodeName map[ip.CIDR]string
+	nodeNameToInterfaceCIDR map[string]ip.CIDR
+
+	// The nodes that have been administratively drained. These are not programmed in wireguard and their CIDRs have
+	// throw routes, but their cached configuration is retained so that they can be undrained.
+	drainedNodes set.Set
+
+	// The nodes that have reported that they are ready to receive wireguard traffic. If Config.RequirePeerReady is set,
+	// only ready nodes are programmed in wireguard.
+	readyNodes set.Set
+
+	// The nodes whose traffic is excluded from encryption by policy, see EndpointWireguardOptOut. These are not
+	// programmed in wireguard and their CIDRs have throw routes, as if they had no public key.
+	optedOutNodes set.Set
+
+	// The peers that could be programmed in wireguard, but are not because Config.MaxPeers is exceeded, and the error
+	// reporting the skipped peers and allowed IPs, returned by LimitError.
+	overLimitNodes set.Set
+	limitErr       *LimitExceededError
+
 	// Pending updates
 	peerUpdates           map[string]*peerUpdateData
 	cidrToNodeNameUpdates map[ip.CIDR]string
 
-	// Wireguard routing table
-	routetable *routetable.RouteTable
+	// Wireguard routing tables, keyed by table index.
+	routetables map[int]*RouteTableSyncer
+
+	// The cleaner of the conntrack entries of the CIDRs no longer routed to wireguard, the CIDRs queued for cleanup once
+	// the routes are applied, and the cleanups running in the background, see SetConntrackCleaner.
+	conntrackCleaner  ConntrackCleaner
+	conntrackPending  set.Set
+	conntrackInFlight map[ip.CIDR]chan struct{}
+
+	// Whether reconciliation is paused, shared with the routing tables, see Pause.
+	pause *pauseState
+
+	// The canonicalizer of the node names, and the order of the node updates, see SetNodeNameCanonicalizer.
+	nodeNames *nodeNameState
+
+	// Set if the routing table index is invalid, in which case there are no routing tables and Apply does nothing.
+	routingTableErr error
+
+	// The route class of each CIDR, and the index of the routing table each CIDR route is programmed in.
+	cidrToRouteClass map[ip.CIDR]RouteClass
+	cidrToTableIndex map[ip.CIDR]int
+
+	// Routes to the wireguard interface that are held back until the wireguard configuration of the peer has been
+	// applied, and the CIDRs whose routes to the wireguard interface are removed by the current Apply.
+	routesPendingWireguard map[ip.CIDR]pendingRoute
+	wireguardRoutesRemoved set.Set
+
+	// The allowed IPs of the wireguard device configurations applied by the current Apply, so that the routes for the
+	// chunks of allowed IPs that were configured are added even if the configuration of a later chunk fails.
+	configuredAllowedIPs map[ip.CIDR]bool
+
+	// The memory of the allowed IPs of the wireguard device configurations built by the current Apply.
+	allowedIPs allowedIPsPool
+
+	// The changes made by the current Apply, which are logged once the Apply completes.
+	summary applySummary
+
+	// The counts of the programmed peers and their allowed IPs, and the callback of the capacity stats, whether it has
+	// been called since it was set and the time it was last called, see SetCapacityStatsCallback.
+	capacity              capacityCounts
+	capacityStatsCallback CapacityStatsCallback
+	capacityStatsReported bool
+	capacityStatsTime     time.Time
+
+	// Whether a summary of the encryption coverage has been logged, and the coverage it logged, see
+	// Config.CoverageLogThreshold.
+	coverageLogged        bool
+	coverageLoggedPercent float64
+
+	// The time spent in each subsystem by the current Apply, and the callback of the timing, see
+	// SetApplyTimingCallback.
+	applyTiming         *applyTimer
+	applyTimingCallback ApplyTimingCallback
+
+	// The tolerance of the races of our route and rule updates with other processes, see BenignNetlinkRaces.
+	netlinkRaces *netlinkRaces
+
+	// The trace of the mutating netlink and wireguard operations, see DumpTrace. Nil if not enabled.
+	trace *operationTrace
+
+	// The reader of the kernel version used to probe the capabilities, see SetKernelVersionReader, and the configured
+	// keepalive that was last logged as not supported by the device.
+	kernelVersionReader KernelVersionReader
+	loggedKeepalive     time.Duration
+
+	// Callback function used to notify of public key updates for the local peerData, see StatusUpdate. While the
+	// endpoint address of our node is not known the zero key is reported with KeyStateWaitingForLocalAddress, see
+	// Config.PublishKeyWithoutEndpoint.
+	statusCallback StatusCallback
+
+	// Queued updates that have not yet been processed by Apply. The lock only protects the queue and the pending work,
+	// so the update methods never block behind the dataplane programming performed by Apply.
+	queuedUpdatesLock sync.Mutex
+	queuedUpdates     []func()
+
+	// The time the oldest of the queued updates was queued, see HealthSnapshot. This is protected by the queued updates
+	// lock.
+	queuedSince time.Time
+
+	// The work flagged by the queued updates, and the work being applied or left by the last Apply, returned by
+	// PendingWorkSummary. These are protected by the queued updates lock.
+	queuedWork    PendingWorkSummary
+	unappliedWork PendingWorkSummary
+
+	// Callback function used to request an Apply, and whether an Apply has been requested since the last Apply. The
+	// kicked flag is protected by the queued updates lock.
+	kickCallback func()
+	kicked       bool
+
+	// The queries queued by QueueWhatIf, answered once the next Apply completes. These are protected by the queued
+	// updates lock.
+	whatIfQueries []whatIfQuery
+
+	// The callbacks of the coverage reports queued by QueueCoverageReport, called once the next Apply completes. These
+	// are protected by the queued updates lock.
+	coverageQueries []func(CoverageReport)
+
+	// The progress of the Apply processing, returned by HealthSnapshot. This is queried while an Apply is in progress
+	// and so is protected by a lock.
+	healthLock sync.Mutex
+	health     HealthSnapshot
+
+	// The local wireguard configuration that has been programmed, returned by LocalConfig. This is queried outside of
+	// the Apply processing and so is protected by a lock.
+	localConfigLock sync.Mutex
+	localConfig     *localConfig
+	mode            Mode
+
+	// The source of the enabled state of wireguard on this node, returned by Enabled along with the state.
+	enabled       bool
+	enabledSource EnabledSource
+
+	// The peer diagnostics read from the device on the last resync, returned by PeerDiagnostics. These are only
+	// refreshed on a resync, or when the endpoints of the peers are checked for a failover, to limit the number of
+	// device queries.
+	peerDiagnostics map[string]PeerDiagnostics
+
+	// The sorted names of the opted out nodes, returned by OptedOutNodes.
+	optedOutNodesSnapshot []string
+
+	// The number of consecutive resyncs that found the wireguard device did not match the cached configuration,
+	// returned by DiscrepantResyncs.
+	discrepantResyncs int
+
+	// Whether the last counted resync found the wireguard device in-sync, and whether the read of the device by the
+	// current resync was not confirmed by a second read, see readDeviceForResync. Only accessed from Apply.
+	lastResyncClean       bool
+	deviceReadUnconfirmed bool
+
+	// The number of times the device was reprogrammed with the intended key, returned by KeyDriftsCorrected.
+	keyDriftsCorrected int
+
+	// Whether wireguard has been found not to be supported, and the time it is next re-probed, returned by
+	// NotSupported. The number of times wireguard has been found not to be supported since it was last supported is only
+	// accessed from Apply.
+	notSupported   bool
+	reprobeTime    time.Time
+	failedReprobes int
+
+	// The capabilities of the wireguard device, probed when the wireguard client is first created and returned by
+	// Capabilities. The configuration path and the compat module are derived from the mode.
+	capabilities Capabilities
+}
 
-	// Callback function used to notify of public key updates for the local peerData
-	statusCallback func(publicKey wgtypes.Key) error
+// localConfig is the programmed configuration of the local wireguard device.
+type localConfig struct {
+	publicKey wgtypes.Key
+	port      int
+	ifaceName string
 }
 
 func New(
@@ -149,7 +623,8 @@ func New(
 	config *Config,
 	netlinkTimeout time.Duration,
 	deviceRouteProtocol int,
-	statusCallback func(publicKey wgtypes.Key) error,
+	statusCallback StatusCallback,
+	kickCallback func(),
 ) *Wireguard {
 	return NewWithShims(
 		hostname,
@@ -157,63 +632,391 @@ func New(
 		netlinkshim.NewRealNetlink,
 		netlinkshim.NewRealNetlink,
 		netlinkshim.NewRealWireguard,
+		nil, // deviceOwner
 		netlinkTimeout,
 		timeshim.NewRealTime(),
 		deviceRouteProtocol,
 		statusCallback,
+		kickCallback,
 	)
 }
 
 // NewWithShims is a test constructor, which allows linkClient, arp and time to be replaced by shims.
+//
+// The optional deviceOwner is shared with the instance for the other IP version on a dual-stack node, see DeviceOwner.
+// The wireguard device is then accessed through the owner, and newWireguardDevice is not used.
+//
+// The optional kickCallback is invoked when an event makes an Apply useful without waiting for the next dataplane
+// update, e.g. the wireguard interface coming up. It must not block, and is not invoked again until the next Apply.
 func NewWithShims(
 	hostname string,
 	config *Config,
 	newRoutetableNetlink func() (netlinkshim.Netlink, error),
 	newWireguardNetlink func() (netlinkshim.Netlink, error),
 	newWireguardDevice func() (netlinkshim.Wireguard, error),
+	deviceOwner *DeviceOwner,
 	netlinkTimeout time.Duration,
 	timeShim timeshim.Time,
 	deviceRouteProtocol int,
-	statusCallback func(publicKey wgtypes.Key) error,
+	statusCallback StatusCallback,
+	kickCallback func(),
 ) *Wireguard {
-	// Create routetable. We provide dummy callbacks for ARP and conntrack processing.
-	rt := routetable.NewWithShims(
-		[]string{"^" + config.InterfaceName + "$", routetable.InterfaceNone},
-		4, // ipVersion
-		newRoutetableNetlink,
-		false, // vxlan
-		netlinkTimeout,
-		func(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error { return nil }, // addStaticARPEntry
-		&noOpConnTrack{},
-		timeShim,
-		nil, //deviceRouteSourceAddress
-		deviceRouteProtocol,
-		true, //removeExternalRoutes
-		config.RoutingTableIndex,
-	)
+	// The device settings of a shared device are those of the owner, and the device is accessed through the owner.
+	if deviceOwner != nil {
+		config = deviceOwner.deviceConfig(config)
+		ipVersion := config.ipVersion()
+		deviceOwner.register(ipVersion, config.Enabled)
+		newWireguardDevice = func() (netlinkshim.Wireguard, error) { return deviceOwner.newClient(ipVersion) }
+	}
+
+	logCxt := newLogger(config).WithFields(logrus.Fields{"enabled": config.Enabled, "wgIfaceName": config.InterfaceName})
+
+	// Choose the routing table if configured to do so. The configuration is copied so that the chosen index is not
+	// written to the caller's configuration.
+	if config.RoutingTableIndexAuto {
+		tableIndex, err := selectRoutingTableIndex(config, newWireguardNetlink, newRoutetableNetlink, logCxt)
+		if err != nil {
+			logCxt.WithError(err).Error("Unable to scan the routing tables for a free wireguard routing table")
+		} else if tableIndex == 0 {
+			logCxt.WithFields(logrus.Fields{
+				"min": config.RoutingTableIndexAutoMin,
+				"max": config.RoutingTableIndexAutoMax,
+			}).Error("No free wireguard routing table in range")
+		}
+		autoConfig := *config
+		autoConfig.RoutingTableIndex = tableIndex
+		config = &autoConfig
+	}
+
+	// Merge the node-local overrides over the configuration. The configuration without the overrides is kept, so that
+	// the overrides are merged again when the file is re-read.
+	baseConfig := config
+	if config.NodeOverridesFile != "" {
+		if merged := mergeNodeOverrides(config, deviceOwner, logCxt); merged != nil {
+			config = merged
+		}
+	}
+
+	// Programming the routes in routing table 0 would corrupt the main routing table, so if the routing table is invalid
+	// no routing tables are created and nothing is programmed.
+	tableIndexes := config.routingTableIndexes()
+	routingTableErr := config.validateRoutingTableIndexes()
+	if routingTableErr != nil {
+		logCxt.WithField("tableIndexes", tableIndexes).Error(
+			"Wireguard routing table index must not be 0 - wireguard will not be programmed")
+		tableIndexes = nil
+	}
+
+	// Create a routetable for each routing table. We provide dummy callbacks for ARP and conntrack processing.
+	//
+	// If StrictTableOwnership is set the routing tables are owned by the wireguard module so external routes are
+	// removed. This also means routes programmed with a previously configured route protocol are rewritten with the
+	// current protocol on the first resync. Otherwise only routes with our route protocol, or one of the legacy route
+	// protocols, are removed or rewritten, so that the routing tables may be shared with other static routes.
+	pause := &pauseState{}
+	timer := newApplyTimer(timeShim)
+	races := newNetlinkRaces(logCxt)
+	trace := newOperationTrace(config.TraceBufferSize, timeShim)
+	routetables := map[int]*RouteTableSyncer{}
+	routeNetlinkTimeout := netlinkTimeout
+	if config.RouteNetlinkTimeout > 0 {
+		routeNetlinkTimeout = config.RouteNetlinkTimeout
+	}
+	for _, tableIndex := range tableIndexes {
+		rt := routetable.NewWithShims(
+			[]string{"^" + config.InterfaceName + "$", routetable.InterfaceNone},
+			config.ipVersion(),
+			races.newNetlink(timer.newNetlink(trace.newNetlink(newRoutetableNetlink), subsystemRoutes)),
+			false, // vxlan
+			routeNetlinkTimeout,
+			func(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error { return nil }, // addStaticARPEntry
+			&noOpConnTrack{},
+			timeShim,
+			nil, //deviceRouteSourceAddress
+			deviceRouteProtocol,
+			config.StrictTableOwnership, //removeExternalRoutes
+			tableIndex,
+		)
+		// The routes of the CIDRs move between the throw routes and the wireguard interface in bulk, e.g. when a peer
+		// enables wireguard, so replace them in place rather than leaving the CIDRs without a route in between.
+		rt.EnableReplaceOnMove()
+		rt.SetLegacyRouteProtocols(config.LegacyRouteProtocols)
+		routetables[tableIndex] = newRouteTableSyncer(tableIndex, rt, pause)
+	}
 
-	return &Wireguard{
-		hostname:              hostname,
-		config:                config,
-		logCxt:                logrus.WithFields(logrus.Fields{"enabled": config.Enabled, "wgIfaceName": config.InterfaceName}),
-		newNetlinkClient:      newWireguardNetlink,
-		newWireguardClient:    newWireguardDevice,
-		time:                  timeShim,
-		peers:                 map[string]*peerData{},
-		cidrToNodeName:        map[ip.CIDR]string{},
-		publicKeyToNodeNames:  map[wgtypes.Key]set.Set{},
-		peerUpdates:           map[string]*peerUpdateData{},
-		cidrToNodeNameUpdates: map[ip.CIDR]string{},
-		routetable:            rt,
-		statusCallback:        statusCallback,
+	w := &Wireguard{
+		hostname:                hostname,
+		config:                  config,
+		baseConfig:              baseConfig,
+		excludeCIDRs:            append([]ip.CIDR(nil), config.ExcludeCIDRs...),
+		cidrsExcludedEver:       len(config.ExcludeCIDRs) > 0 || config.CIDRFlapThrowRoute,
+		interfaceAddrSource:     config.interfaceAddressSource(),
+		interfaceAddrPool:       config.InterfaceAddressPool,
+		ruleSelectors:           append([]RuleSelector(nil), config.ruleSelectors()...),
+		ruleSourceCIDRs:         set.New(),
+		ruleIifNames:            set.New(),
+		nonWireguardHandling:    config.nonWireguardPeerHandling(),
+		catchAllRoute:           config.CatchAllRoute,
+		catchAllThrowCIDRs:      append([]ip.CIDR(nil), config.CatchAllThrowCIDRs...),
+		catchAllThrowRoutes:     map[ip.CIDR]bool{},
+		logCxt:                  logCxt,
+		newNetlinkClient:        trace.newNetlink(newWireguardNetlink),
+		newWireguardClient:      newWireguardDevice,
+		deviceOwner:             deviceOwner,
+		time:                    timeShim,
+		peers:                   map[string]*peerData{},
+		cidrToNodeName:          map[ip.CIDR]string{},
+		publicKeyToNodeNames:    map[wgtypes.Key]set.Set{},
+		allowedCIDRToNodeName:   map[ip.CIDR]string{},
+		interfaceCIDRToNodeName: map[ip.CIDR]string{},
+		nodeNameToInterfaceCIDR: map[string]ip.CIDR{},
+		deniedCIDRs:             set.New(),
+		adoptedPeers:            set.New(),
+		cidrFlaps:               map[ip.CIDR]*cidrFlapState{},
+		nodeNameToSecondaryAddr: map[string]ip.Addr{},
+		endpointFailovers:       map[string]*endpointFailover{},
+		removedNodes:            map[ip.Addr]*removedNode{},
+		provisionalKeys:         map[string]*provisionalKey{},
+		peerKeyTransitions:      map[string]*peerKeyTransition{},
+		retiredPreviousKeys:     set.New(),
+		localCIDRs:              map[ip.CIDR]RouteClass{},
+		localCIDRRoutes:         map[ip.CIDR]int{},
+		dampedCIDRs:             set.New(),
+		drainedNodes:            set.New(),
+		readyNodes:              set.New(),
+		optedOutNodes:           set.New(),
+		overLimitNodes:          set.New(),
+		peerUpdates:             map[string]*peerUpdateData{},
+		cidrToNodeNameUpdates:   map[ip.CIDR]string{},
+		routetables:             routetables,
+		pause:                   pause,
+		applyTiming:             timer,
+		netlinkRaces:            races,
+		trace:                   trace,
+		kernelVersionReader:     readKernelVersion,
+		nodeNames:               newNodeNameState(),
+		conntrackPending:        set.New(),
+		conntrackInFlight:       map[ip.CIDR]chan struct{}{},
+		routingTableErr:         routingTableErr,
+		cidrToRouteClass:        map[ip.CIDR]RouteClass{},
+		cidrToTableIndex:        map[ip.CIDR]int{},
+		routesPendingWireguard:  map[ip.CIDR]pendingRoute{},
+		wireguardRoutesRemoved:  set.New(),
+		capacity:                capacityCounts{peers: map[string]peerCapacity{}},
+		statusCallback:          statusCallback,
+		kickCallback:            kickCallback,
+		mode:                    ModeKernel,
+		enabled:                 config.Enabled,
+		enabledSource:           EnabledSourceConfig,
+		rulePriority:            config.RoutingRulePriority,
 	}
+
+	// A derived interface address does not depend on any updates, so it is known from the start.
+	w.ourIPv4InterfaceAddr = w.selectInterfaceAddr()
+
+	// Nothing has been programmed yet.
+	w.unappliedWork = w.remainingWork(false)
+	return w
 }
 
 func (w *Wireguard) OnIfaceStateChanged(ifaceName string, state ifacemonitor.State) {
-	if w.config.InterfaceName != ifaceName {
-		w.logCxt.WithField("ifaceName", ifaceName).Debug("Ignoring interface state change, not the wireguard interface.")
+	if ifaceName != w.config.InterfaceName {
+		// Only a parent interface coming up is of interest, the state of other interfaces requires no work.
+		if state == ifacemonitor.StateUp && w.config.isParentInterface(ifaceName) {
+			w.queueUpdate(PendingWorkSummary{Peers: true, Rules: true}, func() { w.onParentIfaceUp(ifaceName) })
+			if w.config.Enabled {
+				w.kick()
+			}
+		} else if w.config.isRuleIif(ifaceName) {
+			// The interface may be selected by our routing rules. The rules are only updated if it is selected, and the
+			// interface change is applied along with the rest of the dataplane.
+			w.queueUpdate(PendingWorkSummary{}, func() { w.onRuleIifStateChanged(ifaceName, state) })
+		} else {
+			w.logCxt.WithField("ifaceName", ifaceName).Debug("Ignoring interface state change, not the wireguard interface.")
+		}
+		return
+	}
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true, Rules: true}, func() {
+		w.onIfaceStateChanged(ifaceName, state)
+	})
+	if w.config.Enabled && ifaceName == w.config.InterfaceName && state == ifacemonitor.StateUp {
+		// Programming of the peers and our public key is waiting for the interface to come up, so request an Apply now
+		// rather than waiting for the next dataplane update.
+		w.kick()
+	}
+}
+
+func (w *Wireguard) EndpointUpdate(name string, ipv4Addr ip.Addr) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Rules: true}, func() { w.endpointUpdate(w.nodeName(name), ipv4Addr) })
+}
+
+// EndpointRemove removes a node. The allowed CIDRs of the node and its ready status are removed with the node.
+func (w *Wireguard) EndpointRemove(name string) {
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true}, func() { w.endpointRemove(w.nodeName(name)) })
+}
+
+// EndpointAllowedCIDRAdd adds an allowed CIDR to a peer. An optional route class may be specified to determine which
+// routing table the CIDR route is programmed in, this defaults to RouteClassWorkload.
+func (w *Wireguard) EndpointAllowedCIDRAdd(name string, cidr ip.CIDR, class ...RouteClass) {
+	routeClass := RouteClassWorkload
+	if len(class) > 0 {
+		routeClass = class[0]
+	}
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() {
+		w.endpointAllowedCIDRAdd(w.nodeName(name), cidr, routeClass)
+	})
+}
+
+func (w *Wireguard) EndpointAllowedCIDRRemove(cidr ip.CIDR) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() { w.endpointAllowedCIDRRemove(cidr) })
+}
+
+// EndpointAllowedCIDRRemoveForNode removes an allowed CIDR from a peer. Unlike EndpointAllowedCIDRRemove, the CIDR is
+// only removed if it is still an allowed CIDR of the peer, so a late remove does not remove the CIDR from another peer
+// that has since claimed it.
+func (w *Wireguard) EndpointAllowedCIDRRemoveForNode(name string, cidr ip.CIDR) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() {
+		w.endpointAllowedCIDRRemoveForNode(w.nodeName(name), cidr)
+	})
+}
+
+// EndpointWireguardUpdate updates the wireguard configuration of a node. An optional listening port may be specified if
+// the node has reported the port it is listening on, otherwise the locally configured listening port is used to reach
+// the node.
+func (w *Wireguard) EndpointWireguardUpdate(
+	name string, publicKey wgtypes.Key, ipv4InterfaceAddr ip.Addr, listeningPort ...int,
+) {
+	port := 0
+	if len(listeningPort) > 0 {
+		port = listeningPort[0]
+	}
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true}, func() {
+		w.endpointWireguardUpdate(w.nodeName(name), publicKey, ipv4InterfaceAddr, port)
+	})
+}
+
+func (w *Wireguard) EndpointWireguardRemove(name string) {
+	w.queueUpdate(PendingWorkSummary{Key: true, Peers: true, Routes: true}, func() {
+		w.endpointWireguardRemove(w.nodeName(name))
+	})
+}
+
+// EndpointWireguardReady sets whether a node is ready to receive wireguard traffic. This is only used if
+// Config.RequirePeerReady is set, in which case a peer is not routed through wireguard until it is ready. This allows a
+// cluster to migrate to wireguard without blackholing traffic to nodes that have not yet enabled wireguard. The ready
+// status is cleared when the wireguard configuration of the node, or the node itself, is removed.
+func (w *Wireguard) EndpointWireguardReady(name string, ready bool) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() {
+		w.endpointWireguardReady(w.nodeName(name), ready)
+	})
+}
+
+// EndpointDrain administratively drains a peer, e.g. before the node is taken down for maintenance. The peer is
+// removed from wireguard and traffic to its CIDRs falls back to the underlying network, but its wireguard configuration
+// is retained. The drain remains in place, even if the peer is removed and re-added, until EndpointUndrain is called.
+func (w *Wireguard) EndpointDrain(name string) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() { w.endpointDrain(w.nodeName(name), true) })
+	if w.config.Enabled {
+		w.kick()
+	}
+}
+
+// EndpointUndrain reverses EndpointDrain, so traffic to the peer is encrypted once more.
+func (w *Wireguard) EndpointUndrain(name string) {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true}, func() { w.endpointDrain(w.nodeName(name), false) })
+	if w.config.Enabled {
+		w.kick()
+	}
+}
+
+func (w *Wireguard) QueueResync() {
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true, Rules: true}, func() { w.queueResync() })
+}
+
+// UpdateConfig updates the configuration that may be changed without a restart, which is currently Config.ExcludeCIDRs,
+// Config.InterfaceAddressSource, Config.InterfaceAddressPool, Config.RuleSelectors, Config.CatchAllRoute and
+// Config.CatchAllThrowCIDRs. The allowed CIDRs of the peers are reclassified, and the interface address, the routing
+// rules and the catch-all route are updated, by the next Apply. Changes to the other fields are ignored.
+func (w *Wireguard) UpdateConfig(config *Config) {
+	excludeCIDRs := append([]ip.CIDR(nil), config.ExcludeCIDRs...)
+	source, pool := config.interfaceAddressSource(), config.InterfaceAddressPool
+	ruleSelectors := append([]RuleSelector(nil), config.ruleSelectors()...)
+	nonWireguardPeerHandling := config.nonWireguardPeerHandling()
+	catchAllRoute, catchAllThrowCIDRs := config.CatchAllRoute, append([]ip.CIDR(nil), config.CatchAllThrowCIDRs...)
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true, Rules: true}, func() {
+		w.updateExcludeCIDRs(excludeCIDRs)
+		w.updateInterfaceAddressSource(source, pool)
+		w.updateRuleSelectors(ruleSelectors)
+		w.updateNonWireguardPeerHandling(nonWireguardPeerHandling)
+		w.updateCatchAllRoute(catchAllRoute, catchAllThrowCIDRs)
+	})
+}
+
+// QueueFullRebuild queues a resync that rebuilds the wireguard configuration from the cached configuration, rather than
+// correcting the discrepancies found. The device is configured with a single configuration that replaces all of the
+// peers and the allowed IPs of each peer, and the routes on other interfaces are removed from the wireguard routing
+// tables. This recovers from device configuration that a resync does not correct. The count of discrepant resyncs is
+// reset.
+func (w *Wireguard) QueueFullRebuild() {
+	w.localConfigLock.Lock()
+	w.discrepantResyncs = 0
+	w.localConfigLock.Unlock()
+	w.queueUpdate(PendingWorkSummary{Peers: true, Routes: true, Rules: true}, func() { w.queueFullRebuild() })
+}
+
+// queueUpdate queues an update for processing at the start of the next Apply, along with the work the update may
+// require, see PendingWorkSummary. The update methods may be called while an Apply is in progress, so they only touch
+// the queue. Updates queued during an Apply are handled by the next Apply.
+func (w *Wireguard) queueUpdate(work PendingWorkSummary, update func()) {
+	w.queuedUpdatesLock.Lock()
+	defer w.queuedUpdatesLock.Unlock()
+	if len(w.queuedUpdates) == 0 {
+		w.queuedSince = w.time.Now()
+	}
+	w.queuedUpdates = append(w.queuedUpdates, update)
+	w.queuedWork.merge(work)
+}
+
+// RequestApply requests an Apply through the kick callback, e.g. once a resync has been queued on an administrative
+// request rather than by the periodic resync of the dataplane. This may be called from any goroutine.
+func (w *Wireguard) RequestApply() {
+	w.kick()
+}
+
+// kick invokes the kick callback to request an Apply, unless an Apply has already been requested and not yet run.
+func (w *Wireguard) kick() {
+	if w.kickCallback == nil {
 		return
 	}
+	w.queuedUpdatesLock.Lock()
+	kicked := w.kicked
+	w.kicked = true
+	w.queuedUpdatesLock.Unlock()
+
+	if !kicked {
+		w.logCxt.Debug("Requesting an apply")
+		w.kickCallback()
+	}
+}
+
+// applyQueuedUpdates drains the update queue into the cached and pending configuration. The work of the updates
+// remains pending until the Apply completes. This is called from Apply.
+func (w *Wireguard) applyQueuedUpdates() {
+	w.queuedUpdatesLock.Lock()
+	updates := w.queuedUpdates
+	w.queuedUpdates = nil
+	w.queuedSince = time.Time{}
+	w.kicked = false
+	w.unappliedWork.merge(w.queuedWork)
+	w.queuedWork = PendingWorkSummary{}
+	w.queuedUpdatesLock.Unlock()
+
+	for _, update := range updates {
+		update()
+	}
+}
+
+func (w *Wireguard) onIfaceStateChanged(ifaceName string, state ifacemonitor.State) {
 	switch state {
 	case ifacemonitor.StateUp:
 		w.logCxt.Debug("Interface up, marking for route sync")
@@ -221,39 +1024,74 @@ func (w *Wireguard) OnIfaceStateChanged(ifaceName string, state ifacemonitor.Sta
 			w.ifaceUp = true
 			w.inSyncWireguard = false
 		}
+		// The interface may be reported up without having been reported down, e.g. after a suspend and resume, so
+		// verify the device is still configured, see verifyDeviceAfterUp.
+		w.deviceVerificationDue = true
 	case ifacemonitor.StateDown:
 		w.logCxt.Debug("Interface down")
 		w.ifaceUp = false
 	}
 
-	// Notify the wireguard routetable module.
-	w.routetable.OnIfaceStateChanged(ifaceName, state)
+	// Notify the wireguard routetable modules.
+	for _, rt := range w.routetables {
+		rt.OnIfaceStateChanged(ifaceName, state)
+	}
+}
+
+// onParentIfaceUp handles a parent interface coming up, see Config.ParentInterfaces. The routing rules, the underlay
+// routing and the wireguard device configuration are resynced by the next Apply. The interface address is reconciled
+// by every Apply, and the routing tables are not resynced since our routes are not on the parent interface.
+func (w *Wireguard) onParentIfaceUp(ifaceName string) {
+	if !w.config.Enabled {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	}
+	w.logCxt.WithField("ifaceName", ifaceName).Info(
+		"Parent interface up, resyncing the wireguard routing rules and device configuration")
+	w.inSyncRouteRule = false
+	w.inSyncUnderlay = false
+	w.inSyncWireguard = false
 }
 
-func (w *Wireguard) EndpointUpdate(name string, ipv4Addr ip.Addr) {
+func (w *Wireguard) endpointUpdate(name string, ipv4Addr ip.Addr) {
 	w.logCxt.Debugf("EndpointUpdate: name=%s; ipv4Addr=%v", name, ipv4Addr)
-	if !w.config.Enabled {
+	if !w.config.mayBeEnabled() {
 		w.logCxt.Debug("Not enabled - ignoring")
 		return
 	} else if name == w.hostname {
-		// We don't need our own IP address, just interested in the peers.
+		// Our own address is used as the source address of the wireguard traffic on the underlay interface, and may be
+		// used as our interface address.
+		if w.ourIPv4EndpointAddr != ipv4Addr {
+			w.logCxt.Debug("Local IPv4 address updated, resync the underlay routing")
+			w.localAddressUpdated(ipv4Addr)
+			w.ourIPv4EndpointAddr = ipv4Addr
+			w.inSyncUnderlay = false
+			w.updateOurInterfaceAddr()
+		}
 		return
 	}
 
+	w.nodeNames.endpointUpdated(name)
+	w.trace.annotateNode(name, "endpoint update for node %s", name)
 	update := w.getOrInitPeerUpdate(name)
-	if existing, ok := w.peers[name]; ok && existing.ipv4EndpointAddr == ipv4Addr {
+	if existing := w.getProgrammedPeer(name); existing != nil && existing.ipv4EndpointAddr == ipv4Addr {
 		w.logCxt.Debug("Update contains unchanged IPv4 address")
 		update.ipv4EndpointAddr = nil
 	} else {
 		w.logCxt.Debug("Update contains new IPv4 address")
 		update.ipv4EndpointAddr = &ipv4Addr
+		// Monitor the handshakes through the new primary address from when it is programmed.
+		delete(w.endpointFailovers, name)
+		if w.config.ProvisionalKeyTimeout > 0 {
+			w.carryOverRemovedNodeKey(name, ipv4Addr, update)
+		}
 	}
 	w.setPeerUpdate(name, update)
 }
 
-func (w *Wireguard) EndpointRemove(name string) {
+func (w *Wireguard) endpointRemove(name string) {
 	w.logCxt.Debugf("EndpointRemove: name=%s", name)
-	if !w.config.Enabled {
+	if !w.config.mayBeEnabled() {
 		w.logCxt.Debug("Not enabled - ignoring")
 		return
 	} else if name == w.hostname {
@@ -261,6 +1099,41 @@ func (w *Wireguard) EndpointRemove(name string) {
 		return
 	}
 
+	// The node is being deleted along with all of its CIDRs, so remove the node from the CIDR sources. The interface
+	// address of another node that was overridden by one of the node's allowed CIDRs is now required by that node.
+	if cidr, ok := w.nodeNameToInterfaceCIDR[name]; ok {
+		delete(w.nodeNameToInterfaceCIDR, name)
+		delete(w.interfaceCIDRToNodeName, cidr)
+		if _, ok := w.allowedCIDRToNodeName[cidr]; !ok {
+			delete(w.cidrToRouteClass, cidr)
+			w.deniedCIDRs.Discard(cidr)
+		}
+	}
+	var ifaceCIDRs []ip.CIDR
+	for cidr, cidrNodeName := range w.allowedCIDRToNodeName {
+		if cidrNodeName == name {
+			delete(w.allowedCIDRToNodeName, cidr)
+			delete(w.cidrToRouteClass, cidr)
+			w.deniedCIDRs.Discard(cidr)
+			if _, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+				ifaceCIDRs = append(ifaceCIDRs, cidr)
+			}
+		}
+	}
+	for cidr, cidrNodeName := range w.cidrToNodeNameUpdates {
+		if cidrNodeName == name {
+			delete(w.cidrToNodeNameUpdates, cidr)
+		}
+	}
+	w.trace.annotateNode(name, "removal of node %s", name)
+	w.readyNodes.Discard(name)
+	w.clearOptOut(name)
+	w.dampedNodeRemoved(name)
+	w.rememberRemovedNode(name)
+	w.nodeNames.nodeRemoved(name)
+	delete(w.nodeNameToSecondaryAddr, name)
+	delete(w.endpointFailovers, name)
+
 	if _, ok := w.peers[name]; ok {
 		// Node data exists, so store a blank update with a deleted flag. The delete will be applied first, and then any
 		// subsequent updates
@@ -273,40 +1146,178 @@ func (w *Wireguard) EndpointRemove(name string) {
 		w.logCxt.Debug("Node removed which has not yet been programmed - remove any pending update")
 		delete(w.peerUpdates, name)
 	}
+
+	for _, cidr := range ifaceCIDRs {
+		ifaceNodeName := w.interfaceCIDRToNodeName[cidr]
+		w.logCxt.Debugf("CIDR %s is still required as the interface address of node %s", cidr, ifaceNodeName)
+		w.addPeerCIDR(ifaceNodeName, cidr, RouteClassHost)
+	}
 }
 
-func (w *Wireguard) EndpointAllowedCIDRAdd(name string, cidr ip.CIDR) {
-	w.logCxt.Debugf("EndpointAllowedCIDRAdd: name=%s; cidr=%v", name, cidr)
-	if !w.config.Enabled {
+func (w *Wireguard) endpointAllowedCIDRAdd(name string, cidr ip.CIDR, class RouteClass) {
+	w.logCxt.Debugf("EndpointAllowedCIDRAdd: name=%s; cidr=%v; class=%s", name, cidr, class)
+	if !w.config.mayBeEnabled() {
 		w.logCxt.Debug("Not enabled - ignoring")
 		return
 	} else if name == w.hostname {
-		w.logCxt.Debug("Local update - ignoring")
+		w.localCIDRAdd(cidr, class)
+		return
+	} else if cidr.Version() != w.config.ipVersion() {
+		// The CIDR cannot be programmed in our routing tables, and including it would cause the configuration of the
+		// peer to fail. Drop it so that the other CIDRs of the peer are still programmed.
+		w.logCxt.Warningf("Ignoring IPv%d CIDR %s for node %s, only IPv%d is supported", cidr.Version(), cidr, name,
+			w.config.ipVersion())
+		return
+	} else if w.dampCIDRAdd(name, cidr, class) {
+		w.logCxt.Debugf("CIDR %s is damped - deferring its assignment to node %s", cidr, name)
+		return
+	}
+	w.assignAllowedCIDR(name, cidr, class)
+}
+
+// assignAllowedCIDR assigns an allowed CIDR to a node, removing it from any other node.
+func (w *Wireguard) assignAllowedCIDR(name string, cidr ip.CIDR, class RouteClass) {
+	if allowedNodeName, ok := w.allowedCIDRToNodeName[cidr]; ok && allowedNodeName != name {
+		// The CIDR has moved from a different peer without being removed first, so remove it from the other peer.
+		w.logCxt.Infof("CIDR %s moved from node %s to node %s", cidr, allowedNodeName, name)
+		w.removePeerCIDR(cidr)
+		w.trace.annotateNode(allowedNodeName, "CIDR %s moved from node %s to node %s", cidr, allowedNodeName, name)
+		w.trace.annotateNode(name, "CIDR %s moved from node %s to node %s", cidr, allowedNodeName, name)
+		w.trace.annotateCIDR(cidr, "CIDR %s moved from node %s to node %s", cidr, allowedNodeName, name)
+	} else if ifaceNodeName, ok := w.interfaceCIDRToNodeName[cidr]; ok && ifaceNodeName != name {
+		// The CIDR is the interface address of a different peer. The explicitly added CIDR takes precedence, so remove
+		// it from the other peer.
+		w.logCxt.Warningf("CIDR %s is also the interface address of node %s", cidr, ifaceNodeName)
+		w.removePeerCIDR(cidr)
+	}
+	if allowedNodeName, ok := w.allowedCIDRToNodeName[cidr]; !ok || allowedNodeName != name {
+		w.trace.annotateCIDR(cidr, "CIDR %s added to node %s", cidr, name)
+	}
+	w.allowedCIDRToNodeName[cidr] = name
+	w.addPeerCIDR(name, cidr, class)
+}
+
+func (w *Wireguard) endpointAllowedCIDRRemove(cidr ip.CIDR) {
+	w.logCxt.Debugf("EndpointAllowedCIDRRemove: cidr=%v", cidr)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	}
+	w.localCIDRRemove(cidr)
+	if w.dampCIDRRemove("", cidr) {
+		return
+	}
+	w.unassignAllowedCIDR(cidr)
+}
+
+// unassignAllowedCIDR removes an allowed CIDR from the node it is assigned to.
+func (w *Wireguard) unassignAllowedCIDR(cidr ip.CIDR) {
+	if name, ok := w.allowedCIDRToNodeName[cidr]; ok {
+		w.trace.annotateCIDR(cidr, "CIDR %s removed from node %s", cidr, name)
+	}
+	delete(w.allowedCIDRToNodeName, cidr)
+	w.removePeerCIDR(cidr)
+	if ifaceNodeName, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+		// The CIDR is still required for the interface address of a peer.
+		w.logCxt.Debugf("CIDR %s is still required as the interface address of node %s", cidr, ifaceNodeName)
+		w.addPeerCIDR(ifaceNodeName, cidr, RouteClassHost)
+	}
+}
+
+func (w *Wireguard) endpointAllowedCIDRRemoveForNode(name string, cidr ip.CIDR) {
+	w.logCxt.Debugf("EndpointAllowedCIDRRemoveForNode: name=%s; cidr=%v", name, cidr)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.localCIDRRemove(cidr)
+		return
+	} else if w.dampCIDRRemove(name, cidr) {
+		return
+	} else if allowedNodeName, ok := w.allowedCIDRToNodeName[cidr]; !ok || allowedNodeName != name {
+		w.logCxt.Debugf("CIDR %s is not an allowed CIDR of node %s - ignoring", cidr, name)
+		return
+	}
+	w.unassignAllowedCIDR(cidr)
+}
+
+// setPeerInterfaceCIDR updates the CIDR of the wireguard interface address of a peer. A nil CIDR indicates the peer
+// has no interface address. The CIDR is included in the peer's allowed CIDRs unless it has also been added through
+// EndpointAllowedCIDRAdd, in which case it remains until both have been removed.
+func (w *Wireguard) setPeerInterfaceCIDR(name string, cidr ip.CIDR) {
+	oldCIDR, hadCIDR := w.nodeNameToInterfaceCIDR[name]
+	if hadCIDR && cidr != nil && oldCIDR == cidr {
+		w.logCxt.Debugf("Interface address unchanged for node %s", name)
 		return
 	}
+	if hadCIDR {
+		w.logCxt.Debugf("Removing interface address %s for node %s", oldCIDR, name)
+		delete(w.nodeNameToInterfaceCIDR, name)
+		delete(w.interfaceCIDRToNodeName, oldCIDR)
+		if _, ok := w.allowedCIDRToNodeName[oldCIDR]; !ok {
+			w.removePeerCIDR(oldCIDR)
+		}
+	}
+	if cidr != nil {
+		if otherName, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+			// The interface address was previously claimed by another node, which must have since changed its
+			// address. Remove the address from the other node.
+			w.logCxt.Infof("Interface address %s moved from node %s to node %s", cidr, otherName, name)
+			w.setPeerInterfaceCIDR(otherName, nil)
+		}
+		w.logCxt.Debugf("Adding interface address %s for node %s", cidr, name)
+		w.nodeNameToInterfaceCIDR[name] = cidr
+		w.interfaceCIDRToNodeName[cidr] = name
+		if _, ok := w.allowedCIDRToNodeName[cidr]; !ok {
+			w.addPeerCIDR(name, cidr, RouteClassHost)
+		}
+	}
+	if w.config.RouteViaPeerTunnelIP && (hadCIDR || cidr != nil) {
+		// The routes of the peer are via its interface address, so update the gateway of each route.
+		update := w.getOrInitPeerUpdate(name)
+		update.gatewayUpdated = true
+		w.setPeerUpdate(name, update)
+	}
+}
+
+// addPeerCIDR updates the pending peer configuration to add a CIDR to a peer. The route class determines which routing
+// table the CIDR route is programmed in.
+func (w *Wireguard) addPeerCIDR(name string, cidr ip.CIDR, class RouteClass) {
+	w.cidrToRouteClass[cidr] = class
+	w.checkExcludedCIDR(name, cidr, w.excludeCIDRs)
+	wasDenied := w.deniedCIDRs.Contains(cidr)
+	denied := w.verifyCIDR(name, cidr)
+
+	// If the route class has changed such that the CIDR route is now in a different routing table, the route needs to
+	// be re-programmed even if the peer already has the CIDR.
+	tableIndex, ok := w.cidrToTableIndex[cidr]
+	moveRoute := ok && tableIndex != w.tableIndexForCIDR(cidr)
 
 	update := w.getOrInitPeerUpdate(name)
-	if existing, ok := w.peers[name]; ok && existing.cidrs.Contains(cidr) {
+	if existing := w.getProgrammedPeer(name); existing != nil && existing.cidrs.Contains(cidr) && !moveRoute {
 		// Adding the CIDR to a node that already has it. This may happen if there is a pending CIDR deletion for the
 		// node, so discard the deletion update.
 		w.logCxt.Debug("Node CIDR added which is already programmed - remove any pending delete")
 		update.allowedCidrsDeleted.Discard(cidr)
 		delete(w.cidrToNodeNameUpdates, cidr)
+		if denied != wasDenied {
+			// The CIDR verifier has changed its decision since the CIDR was programmed.
+			update.cidrsReclassified = true
+		}
 	} else {
-		// Adding the CIDR to a node that does not already have it.
+		// Adding the CIDR to a node that does not already have it, or the route needs moving to a different table.
 		w.logCxt.Debug("Node CIDR added which is not programmed")
+		update.allowedCidrsDeleted.Discard(cidr)
 		update.allowedCidrsAdded.Add(cidr)
 		w.cidrToNodeNameUpdates[cidr] = name
 	}
 	w.setPeerUpdate(name, update)
 }
 
-func (w *Wireguard) EndpointAllowedCIDRRemove(cidr ip.CIDR) {
-	w.logCxt.Debugf("EndpointAllowedCIDRRemove: cidr=%v", cidr)
-	if !w.config.Enabled {
-		w.logCxt.Debug("Not enabled - ignoring")
-		return
-	}
+// removePeerCIDR updates the pending peer configuration to remove a CIDR from whichever peer it is associated with.
+func (w *Wireguard) removePeerCIDR(cidr ip.CIDR) {
+	delete(w.cidrToRouteClass, cidr)
+	w.deniedCIDRs.Discard(cidr)
 
 	// Determine which node this CIDR belongs to. Check the updates first and then the processed.
 	name, ok := w.cidrToNodeNameUpdates[cidr]
@@ -323,9 +1334,11 @@ func (w *Wireguard) EndpointAllowedCIDRRemove(cidr ip.CIDR) {
 	w.logCxt.Debugf("CIDR found for node %s", name)
 
 	update := w.getOrInitPeerUpdate(name)
-	if existing, ok := w.peers[name]; ok && existing.cidrs.Contains(cidr) {
-		// Remove the CIDR from a node that already has the CIDR configured.
+	if existing := w.getProgrammedPeer(name); existing != nil && existing.cidrs.Contains(cidr) {
+		// Remove the CIDR from a node that already has the CIDR configured. There may be a pending addition if the
+		// route was being moved to a different routing table, so discard that too.
 		w.logCxt.Debug("Node CIDR removed")
+		update.allowedCidrsAdded.Discard(cidr)
 		update.allowedCidrsDeleted.Add(cidr)
 		w.cidrToNodeNameUpdates[cidr] = name
 	} else {
@@ -338,31 +1351,65 @@ func (w *Wireguard) EndpointAllowedCIDRRemove(cidr ip.CIDR) {
 	w.setPeerUpdate(name, update)
 }
 
-func (w *Wireguard) EndpointWireguardUpdate(name string, publicKey wgtypes.Key, ipv4InterfaceAddr ip.Addr) {
-	w.logCxt.Debugf("EndpointWireguardUpdate: name=%s; key=%s, ipv4Addr=%v", name, publicKey, ipv4InterfaceAddr)
-	if !w.config.Enabled {
+func (w *Wireguard) endpointWireguardUpdate(name string, publicKey wgtypes.Key, ipv4InterfaceAddr ip.Addr, port int) {
+	w.logCxt.Debugf("EndpointWireguardUpdate: name=%s; key=%s, ipv4Addr=%v, port=%d", name, publicKey, ipv4InterfaceAddr, port)
+	if !w.config.mayBeEnabled() {
 		w.logCxt.Debug("Not enabled - ignoring")
 		return
 	}
 
 	if name == w.hostname {
 		w.logCxt.Debug("Local wireguard info updated")
-		if w.ourPublicKey == nil || *w.ourPublicKey != publicKey {
+		w.storedKey = publicKey
+		// A zero port means the datastore does not store the port, in which case only the key is compared. If we publish
+		// our interface address, the address is also compared.
+		published := w.publishedInterfaceAddr()
+		if w.ourPublicKey != nil && *w.ourPublicKey == publicKey && (port == 0 || port == w.config.ListeningPort) &&
+			(published == nil || published == ipv4InterfaceAddr) {
+			// This is an echo of our public key, so the datastore is up to date with our latest publish.
+			w.logCxt.Debug("Stored public key matches key queried from dataplane")
+			w.echoedPublishGeneration = w.publishGeneration
+			w.staleEchoPending = false
+			w.staleKeyRepublishDeferred = false
+		} else if w.publishGeneration > w.echoedPublishGeneration {
+			// Our latest publish has not been echoed back yet, so this is a stale update that will be overwritten by
+			// the publish in-flight. Don't publish again, otherwise peers see the key flap.
+			w.logCxt.Debug("Stored public key does not match, but publish is in-flight - ignoring stale update")
+			w.countStaleKeyEcho()
+			w.staleEchoPending = true
+		} else if w.publishGeneration == 0 {
 			// Public key does not match that stored. Flag as not in-sync, we will update the value from the dataplane
 			// and publish.
 			w.logCxt.Debug("Stored public key does not match key queried from dataplane")
 			w.ourPublicKeyAgreesWithDataplaneMsg = false
+		} else {
+			// Our publish has been acknowledged but the datastore now holds a different key, either because it has
+			// been overwritten or because a slow datastore is echoing back a stale key. Publish again, limiting the
+			// rate of the republications.
+			w.logCxt.Debug("Stored public key does not match our acknowledged key")
+			w.onStaleKeyEcho()
 		}
-		if w.ourIPv4InterfaceAddr != ipv4InterfaceAddr {
-			w.logCxt.Debug("Local interface addr updated")
-			w.ourIPv4InterfaceAddr = ipv4InterfaceAddr
-			w.inSyncInterfaceAddr = false
+		if w.datastoreIPv4InterfaceAddr != ipv4InterfaceAddr {
+			w.logCxt.Debug("Local interface addr updated in the datastore")
+			w.datastoreIPv4InterfaceAddr = ipv4InterfaceAddr
+			w.updateOurInterfaceAddr()
 		}
 		return
 	}
 
+	if publicKey == zeroKey {
+		// A remote node with a zero key is not wireguard capable. Handle as a removal of the wireguard configuration so
+		// that the node is not programmed as a peer and its routes become throw routes.
+		w.logCxt.Infof("Peer %s has no valid public key, treating as not wireguard capable", name)
+		w.endpointWireguardRemove(name)
+		return
+	}
+
+	w.nodeNames.keyUpdated(name)
+	w.confirmProvisionalKey(name, publicKey)
+	w.trace.annotateNode(name, "wireguard update for node %s", name)
 	update := w.getOrInitPeerUpdate(name)
-	if existing, ok := w.peers[name]; ok && existing.publicKey == publicKey {
+	if existing := w.getProgrammedPeer(name); existing != nil && existing.publicKey == publicKey {
 		// Public key not updated
 		w.logCxt.Debug("Public key unchanged from programmed")
 		update.publicKey = nil
@@ -371,19 +1418,36 @@ func (w *Wireguard) EndpointWireguardUpdate(name string, publicKey wgtypes.Key,
 		w.logCxt.Debug("Storing updated public key")
 		update.publicKey = &publicKey
 	}
+	w.setPeerListeningPort(name, update, port)
 	w.setPeerUpdate(name, update)
+
+	// Route the peer's interface address over wireguard.
+	if ipv4InterfaceAddr != nil {
+		w.setPeerInterfaceCIDR(name, ipv4InterfaceAddr.AsCIDR())
+	} else {
+		w.setPeerInterfaceCIDR(name, nil)
+	}
 }
 
-func (w *Wireguard) EndpointWireguardRemove(name string) {
+func (w *Wireguard) endpointWireguardRemove(name string) {
 	w.logCxt.Debugf("EndpointWireguardRemove: name=%s", name)
-	if !w.config.Enabled {
+	if !w.config.mayBeEnabled() {
 		w.logCxt.Debug("Not enabled - ignoring")
 		return
 	}
 	if name == w.hostname {
-		w.EndpointWireguardUpdate(name, zeroKey, nil)
+		// Our wireguard configuration has been removed from the datastore, always publish our key again.
+		w.endpointWireguardUpdate(name, zeroKey, nil, 0)
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
 	}
 
+	// The node is no longer wireguard capable, so it is no longer ready or opted out. The public key is removed below,
+	// so there is no need for a separate status update.
+	w.readyNodes.Discard(name)
+	w.clearOptOut(name)
+	w.nodeNames.keyRemoved(name)
+	delete(w.provisionalKeys, name)
+
 	// If there is no existing peer and no existing update then exit.
 	if _, ok := w.peers[name]; ok {
 		w.logCxt.Debugf("Peer %s is programmed", name)
@@ -392,102 +1456,437 @@ func (w *Wireguard) EndpointWireguardRemove(name string) {
 		return
 	}
 
-	// Create update to remove the public key.
+	// Create update to remove the public key, the listening port and the interface address.
+	w.trace.annotateNode(name, "wireguard removal for node %s", name)
 	update := w.getOrInitPeerUpdate(name)
 	update.publicKey = &zeroKey
+	w.setPeerListeningPort(name, update, 0)
 	w.setPeerUpdate(name, update)
+	w.setPeerInterfaceCIDR(name, nil)
 }
 
-func (w *Wireguard) QueueResync() {
-	w.logCxt.Info("Queueing a resync of wireguard configuration")
-
-	// Flag for resync to ensure everything is still configured correctly.
-	// No need to resync the key. This will happen if the dataplane resync detects an inconsistency.
-	w.setAllInSync(false)
+func (w *Wireguard) endpointDrain(name string, drain bool) {
+	w.logCxt.Debugf("EndpointDrain: name=%s; drain=%v", name, drain)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.logCxt.Debug("Ignoring drain of the local node")
+		return
+	} else if w.drainedNodes.Contains(name) == drain {
+		w.logCxt.Debug("Drain state unchanged")
+		return
+	}
 
-	// Assume wireguard is supported unless we determine otherwise. If we determine unsupported then we'll short-circuit
-	// the Apply processing until the next resync.
-	w.wireguardNotSupported = false
+	if drain {
+		w.logCxt.Infof("Draining node %s", name)
+		w.drainedNodes.Add(name)
+	} else {
+		w.logCxt.Infof("Undraining node %s", name)
+		w.drainedNodes.Discard(name)
+	}
 
-	// Flag the routetable for resync.
-	w.routetable.QueueResync()
+	w.updatePeerStatus(name)
 }
 
-func (w *Wireguard) Apply() (err error) {
-	// If the key is not in-sync and is known then send as a status update.
-	defer func() {
-		// If we need to send the key then send on the callback method.
-		if !w.ourPublicKeyAgreesWithDataplaneMsg && w.ourPublicKey != nil {
-			w.logCxt.Infof("Public key out of sync or updated: %s", *w.ourPublicKey)
-			if errKey := w.statusCallback(*w.ourPublicKey); errKey != nil {
-				err = errKey
-				return
-			}
+// setPeerListeningPort updates the listening port reported by a peer. A zero port indicates the peer has not reported
+// its port, in which case the locally configured port is used.
+func (w *Wireguard) setPeerListeningPort(name string, update *peerUpdateData, port int) {
+	if existing := w.getProgrammedPeer(name); existing != nil && existing.listeningPort == port {
+		w.logCxt.Debug("Listening port unchanged from programmed")
+		update.listeningPort = nil
+	} else {
+		w.logCxt.Debugf("Storing updated listening port %d", port)
+		update.listeningPort = &port
+	}
+}
 
-			// We have sent the key status update.
-			w.ourPublicKeyAgreesWithDataplaneMsg = true
-		}
+func (w *Wireguard) endpointWireguardReady(name string, ready bool) {
+	w.logCxt.Debugf("EndpointWireguardReady: name=%s; ready=%v", name, ready)
+	if !w.config.mayBeEnabled() {
+		w.logCxt.Debug("Not enabled - ignoring")
+		return
+	} else if name == w.hostname {
+		w.logCxt.Debug("Local update - ignoring")
+		return
+	} else if w.readyNodes.Contains(name) == ready {
+		w.logCxt.Debug("Ready state unchanged")
+		return
+	}
+
+	if ready {
+		w.logCxt.Infof("Node %s is ready for wireguard traffic", name)
+		w.readyNodes.Add(name)
+	} else {
+		w.logCxt.Infof("Node %s is not ready for wireguard traffic", name)
+		w.readyNodes.Discard(name)
+	}
+
+	if w.config.RequirePeerReady {
+		w.updatePeerStatus(name)
+	}
+}
+
+// updatePeerStatus handles a change in the drain, ready or opt-out status of a node. If the peer is configured then
+// this creates an update so that its routes and wireguard configuration are recalculated. Otherwise, the status is
+// applied if the peer is added.
+func (w *Wireguard) updatePeerStatus(name string) {
+	if w.getProgrammedPeer(name) != nil {
+		update := w.getOrInitPeerUpdate(name)
+		update.statusUpdated = true
+		w.setPeerUpdate(name, update)
+	}
+}
+
+// updateExcludeCIDRs updates the excluded CIDRs. The peers with a CIDR that is excluded and was not, or vice versa, are
+// flagged as updated so that their routes and wireguard configuration are recalculated.
+func (w *Wireguard) updateExcludeCIDRs(excludeCIDRs []ip.CIDR) {
+	w.logCxt.Debugf("UpdateConfig: excludeCIDRs=%v", excludeCIDRs)
+	oldExcludeCIDRs := w.excludeCIDRs
+	w.excludeCIDRs = excludeCIDRs
+	w.cidrsExcludedEver = w.cidrsExcludedEver || len(excludeCIDRs) > 0
+
+	for name, node := range w.peers {
+		reclassified := false
+		node.cidrs.Iter(func(item interface{}) error {
+			cidr := item.(ip.CIDR)
+			wasExcluded := excludedBy(cidr, oldExcludeCIDRs) != nil
+			excluded := w.checkExcludedCIDR(name, cidr, excludeCIDRs)
+			if excluded != wasExcluded && !w.deniedCIDRs.Contains(cidr) && !w.isDampedThrowCIDR(cidr) {
+				w.logCxt.Infof("CIDR %s of node %s reclassified, excluded from wireguard: %v", cidr, name, excluded)
+				reclassified = true
+			}
+			return nil
+		})
+		if reclassified {
+			update := w.getOrInitPeerUpdate(name)
+			update.cidrsReclassified = true
+			w.setPeerUpdate(name, update)
+		}
+	}
+}
+
+// checkExcludedCIDR returns true if a CIDR of a peer is excluded from wireguard, logging a warning if the CIDR only
+// partially overlaps an excluded CIDR. The whole CIDR is then excluded.
+func (w *Wireguard) checkExcludedCIDR(name string, cidr ip.CIDR, excludeCIDRs []ip.CIDR) bool {
+	exclude := excludedBy(cidr, excludeCIDRs)
+	if exclude == nil {
+		return false
+	} else if exclude.Prefix() > cidr.Prefix() {
+		w.logCxt.Warningf("CIDR %s of node %s partially overlaps excluded CIDR %s, excluding the whole CIDR from wireguard",
+			cidr, name, exclude)
+	} else {
+		w.logCxt.Debugf("CIDR %s of node %s is excluded from wireguard by %s", cidr, name, exclude)
+	}
+	return true
+}
+
+func (w *Wireguard) queueResync() {
+	w.logCxt.Info("Queueing a resync of wireguard configuration")
+
+	// Apply any edit of the node overrides file.
+	w.reloadNodeOverrides()
+
+	// Flag for resync to ensure everything is still configured correctly.
+	// No need to resync the key. This will happen if the dataplane resync detects an inconsistency.
+	w.setAllInSync(false)
+
+	// If we ignored a stale key update and our publish has still not been echoed back, publish again in case the
+	// previous publish was lost.
+	if w.staleEchoPending && w.publishGeneration > w.echoedPublishGeneration {
+		w.logCxt.Info("Published key has not been acknowledged, publishing again")
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
+		w.staleEchoPending = false
+	}
+
+	// Assume wireguard is supported unless we determine otherwise. If we determine unsupported then we'll short-circuit
+	// the Apply processing until the next resync.
+	w.wireguardNotSupported = false
+
+	// Allow the userspace helper to be run again in case the userspace device has gone.
+	w.userspaceHelperRun = false
+
+	// Verify the CIDRs again, in case the ownership of a denied CIDR has since been confirmed or vice versa.
+	w.reverifyCIDRs()
+
+	// Flag the routetables for resync.
+	for _, rt := range w.routetables {
+		rt.QueueResync()
+	}
+}
+
+func (w *Wireguard) queueFullRebuild() {
+	w.logCxt.Info("Queueing a full rebuild of wireguard configuration")
+	w.queueResync()
+	w.fullRebuild = true
+	for _, rt := range w.routetables {
+		rt.QueueRebuild()
+	}
+}
+
+// Apply applies the queued updates to the dataplane, with the deadline configured by Config.ApplyTimeout.
+func (w *Wireguard) Apply() error {
+	ctx := context.Background()
+	if w.config.ApplyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.config.ApplyTimeout)
+		defer cancel()
+	}
+	return w.ApplyWithContext(ctx)
+}
+
+// ApplyWithContext applies the queued updates to the dataplane, with the netlink and wireguard calls bounded by the
+// context. Once the context is done the remaining steps are not attempted and a DeadlineExceededError is returned. The
+// updates that were not applied remain dirty and are retried by the next Apply.
+func (w *Wireguard) ApplyWithContext(ctx context.Context) (err error) {
+	// Record the start and end of the Apply for the liveness checks, see HealthSnapshot.
+	defer w.recordApplyStart()()
+
+	// Answer the queued what-if queries once everything else has been applied, see QueueWhatIf.
+	defer w.answerWhatIfQueries()
+
+	// Report the capacity stats once everything else has been applied, see SetCapacityStatsCallback.
+	defer w.reportCapacityStats()
+
+	// Report the encryption coverage once everything else has been applied, see QueueCoverageReport.
+	defer w.reportCoverage()
+
+	// Process the queued updates. Any updates received from this point on will be handled by the next Apply.
+	w.applyQueuedUpdates()
+	if !w.tornDown {
+		w.releaseDampedCIDRs()
+		w.expireProvisionalKeys()
+	}
+
+	// Once the Apply completes, including the publishing of our key, record the work that remains.
+	waitingForLink := false
+	defer func() {
+		w.setUnappliedWork(w.remainingWork(waitingForLink))
 	}()
 
-	// Get the netlink client - we should always be able to get this client.
+	if w.tornDown {
+		w.logCxt.Debug("Wireguard has been torn down - not applying updates")
+		return nil
+	} else if w.routingTableErr != nil {
+		// There are no routing tables, so nothing is programmed and no public key is published.
+		w.logCxt.Debug("Wireguard routing table is invalid - not applying updates")
+		return w.routingTableErr
+	} else if w.applyPaused() {
+		// The updates have been processed into the cached configuration, and are applied once resumed.
+		return nil
+	}
+
+	// Log a summary of the changes, and report the time spent in each subsystem, once the Apply completes.
+	start := w.time.Now()
+	w.summary = applySummary{}
+	w.applyTiming.reset()
+	w.allowedIPs.reset()
+	defer func() {
+		w.reportApplyTiming(w.time.Since(start))
+	}()
+
+	// Attribute the operations of the Apply that have no more specific cause to the Apply itself. The causes annotated
+	// as the updates were processed are cleared once the Apply completes.
+	w.trace.setCause(w.applyCause())
+	defer w.trace.clearCauses()
+
+	// If the key is not in-sync and is known then send as a status update. The key is only sent once the dataplane is
+	// ready for the peers to act on it, see keyPublicationReady, so that if the key is being regenerated or re-queried
+	// in this Apply only the final key is published rather than sending an intermediate key. The key of an adopted
+	// device is sent immediately, so that the peers do not see the key change.
+	defer func() {
+		// If we deferred republishing our key after a stale echo, republish once it is due. Once our key transition
+		// has ended, publish our key again without the previous key.
+		w.releaseStaleKeyRepublish()
+		w.expireLocalKeyTransition()
+
+		// If we need to send the key then send on the callback method.
+		if !w.ourPublicKeyAgreesWithDataplaneMsg && w.ourPublicKey != nil && w.keyPublicationReady() {
+			if w.publishBackingOff() {
+				w.logCxt.WithField("retryTime", w.publishRetryTime).Debug("Public key conflict, backing off publication")
+				return
+			}
+			if w.waitingForLocalAddress() {
+				if errWait := w.reportWaitingForLocalAddress(); errWait != nil {
+					err = errWait
+				}
+				return
+			}
+			w.logCxt.Infof("Public key out of sync or updated: %s", *w.ourPublicKey)
+			previousKey, previousKeyDeadline := w.keyTransitionToPublish(*w.ourPublicKey)
+			if errKey := w.invokeStatusCallback(StatusUpdate{
+				PublicKey:           *w.ourPublicKey,
+				ListeningPort:       w.config.ListeningPort,
+				InterfaceName:       w.config.InterfaceName,
+				InterfaceAddr:       w.publishedInterfaceAddr(),
+				RoutingTableIndex:   w.config.RoutingTableIndex,
+				PreviousPublicKey:   previousKey,
+				PreviousKeyDeadline: previousKeyDeadline,
+				KeyState:            w.publishedKeyState(),
+			}); errKey != nil {
+				if conflict, ok := errKey.(*KeyConflictError); ok {
+					errKey = w.handleKeyConflict(conflict)
+				}
+				if errKey != nil {
+					err = errKey
+				}
+				return
+			}
+
+			// We have sent the key status update.
+			w.ourPublicKeyAgreesWithDataplaneMsg = true
+			w.localAddressWaitReported = false
+			w.publishGeneration++
+			w.storedKey = *w.ourPublicKey
+			w.clearKeyConflicts()
+		}
+	}()
+
+	// Get the netlink client - we should always be able to get this client. The calls are bounded by the context, the
+	// client has no socket timeout of its own.
 	netlinkClient, err := w.getNetlinkClient()
 	if err != nil {
 		w.logCxt.Errorf("error obtaining link client: %v", err)
 		return err
 	}
+	netlinkClient = netlinkshim.NetlinkWithContext(ctx, netlinkClient, 0)
+
+	// The calls made by the link address reconciliation are all accounted to the addresses, the other calls to the
+	// subsystem of each call.
+	addrNetlinkClient := w.applyTiming.netlink(netlinkClient, subsystemAddress)
+	netlinkClient = w.netlinkRaces.netlink(w.applyTiming.netlink(netlinkClient, subsystemByCall))
 
 	// If wireguard is not enabled, then short-circuit the processing - ensure config is deleted.
 	if !w.config.Enabled {
 		w.logCxt.Info("Wireguard is not enabled")
 		if !w.inSyncWireguard {
 			w.logCxt.Debug("Wireguard is not in-sync - verifying wireguard configuration is removed")
-			if err := w.ensureDisabled(netlinkClient); err != nil {
-				return err
+			// Our public key is withdrawn part way through, see withdrawKey.
+			if err := w.ensureDisabled(ctx, netlinkClient); err != nil {
+				return w.applyError(ctx, "disable", err)
 			}
-
-			// Zero out the public key.
-			w.ourPublicKey = &zeroKey
 			w.inSyncWireguard = true
+			w.clearNotSupported()
 		}
 		return nil
 	}
 
-	if w.wireguardNotSupported {
-		w.logCxt.Info("Wireguard is not supported")
-		return
+	if w.wireguardNotSupported && w.reprobeDue() {
+		// Wireguard support may have been added since it was probed, e.g. by loading the kernel module, so probe again
+		// with a resync.
+		w.logCxt.Info("Re-probing whether wireguard is supported")
+		w.queueResync()
 	}
 
 	// --- Wireguard is enabled ---
 
+	// If necessary ensure the wireguard device is configured. The routes to the wireguard interface are only programmed
+	// once the link is up, until then the CIDRs of all of the peers have throw routes. These do not reference the link,
+	// so they are programmed whatever the state of the link, and any rule from a previous run that jumps to our routing
+	// tables falls through to the normal routing.
+	linkUp := false
+	var errLinkState error
+	if !w.inSyncLink {
+		w.logCxt.Debug("Ensure wireguard link is created and up")
+		if err := w.checkContext(ctx, "link"); err != nil {
+			return err
+		}
+		up, err := w.ensureLink(ctx, netlinkClient)
+		linkUp = up
+		if netlinkshim.IsNotSupported(err) {
+			// Wireguard is not supported, set everything to "in-sync" since there is not a lot of point doing anything
+			// else. We don't return an error in this case, instead we'll retry every resync period.
+			w.logCxt.Info("Wireguard is not supported - publishing no public key")
+			w.setNotSupported()
+		} else if err == ErrWrongLinkType {
+			// Another device is using the wireguard interface name and we are not configured to replace it. We cannot
+			// use wireguard so publish no public key, and report the error. We'll retry on the next resync.
+			w.logCxt.Error("Wireguard interface name is in use by a device that is not wireguard - publishing no public key")
+			w.setNotSupported()
+			errLinkState = ErrWrongLinkType
+		} else if err != nil {
+			// Error configuring link, pass up the stack. Close the netlink client as a precaution.
+			w.logCxt.WithError(err).Info("Unable to create wireguard link, retrying...")
+			w.closeNetlinkClient()
+			return w.applyError(ctx, "link", updateFailed(SubsystemLink, "link"))
+		} else if !linkUp {
+			// Wait for oper up notification.
+			w.logCxt.Info("Waiting for wireguard link to come up...")
+			waitingForLink = true
+		}
+	} else if w.wireguardNotSupported {
+		w.logCxt.Info("Wireguard is not supported")
+	}
+	w.setLinkUsable(linkUp)
+
+	// If a peer has had no handshake through its endpoint, switch to the other address of the node before the updates
+	// are applied.
+	if linkUp && w.inSyncWireguard {
+		w.checkEndpointFailovers(ctx)
+	}
+
+	// Hold the programming of the peers and their routes while a burst of peer updates is coalesced, see
+	// Config.PeerBatchThreshold. The updates remain pending until the Apply that flushes the batch.
+	if w.holdPeerBatch(linkUp) {
+		return nil
+	}
+
 	// We scan the updates multiple times to perform the following ordered updates:
 	// 1. Deletion of peers and wireguard peers (we handle these separately from other updates because it is easier
 	//    to handle a delete/re-add this way without needing to calculate delta configs.
 	// 2. Update of cached node configuration (we cannot be certain exactly what is programmable until updated)
-	// 3. Update of route table routes.
-	// 4. Construction of wireguard delta (if performing deltas, or re-sync of wireguard configuration)
-	// 5. Simultaneous updates of wireguard, routes and rules.
+	// 3. Selection of the peers to program if the maximum number of peers is exceeded.
+	// 4. Update of route table routes.
+	// 5. Construction of wireguard delta (if performing deltas, or re-sync of wireguard configuration)
+	// 6. Ordered updates of routes and wireguard, and then rules.
 	var conflictingKeys = set.New()
+	w.wireguardRoutesRemoved = set.New()
+	w.resolveTraceCauses()
 	wireguardPeerDelete := w.handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys)
 	w.updateCacheFromPeerUpdates(conflictingKeys)
-	w.updateRouteTableFromPeerUpdates()
+	w.resolveTraceCauses()
+	w.updateLimits()
+	var routedBefore set.Set
+	if w.conntrackCleanupEnabled() {
+		routedBefore = w.wireguardRouteCIDRs()
+	}
+	w.removeLocalCIDRRoutes()
+	w.removeCatchAllThrowRoutes()
+	w.updateRouteTableFromPeerUpdates(conflictingKeys)
+	w.updateExclusionCIDRs()
+	w.addLocalCIDRRoutes()
+	w.reconcileCatchAllRoute()
+	w.queueConntrackCleanups(routedBefore)
 
 	defer func() {
 		// Flag the programmed state to be the same as the expected state for each peer. We do this even if we failed to
 		// apply the update because the routetable processing also uses this to maintain details about whether or not it
 		// has routed to wireguard. In the event of a failed update or wireguard config, a full resync will be performed
-		// next iteration which ignores the programmedInWireguard flag.
-		if len(w.peerUpdates) > 0 {
+		// next iteration which ignores the programmedInWireguard flag. Peers sharing a conflicting public key may change
+		// state without having an update of their own.
+		if len(w.peerUpdates) > 0 || conflictingKeys.Len() > 0 {
 			for name, node := range w.peers {
 				if w.shouldProgramWireguardPeer(name, node) {
-					w.logCxt.Debugf("Flag node %s as programmed", name)
+					w.debugPeer("Flag node %s as programmed", name)
 					node.programmedInWireguard = true
 				} else {
-					w.logCxt.Debugf("Flag node %s as not programmed", name)
+					w.debugPeer("Flag node %s as not programmed", name)
 					node.programmedInWireguard = false
 				}
+				if w.capacity.peers[name].programmed != node.programmedInWireguard {
+					w.recountPeerCapacity(name)
+				}
 			}
 		}
 
+		// Remove the updated peers that have no configuration left, e.g. a node whose wireguard configuration is
+		// removed in the same Apply as the node itself, so that the cache does not retain nodes that have gone.
+		w.removeEmptyPeers()
+		for name := range w.peerUpdates {
+			w.recountPeerCapacity(name)
+		}
+		w.trackEndpointFailovers()
+
 		// All updates have been applied. Make sure we delete them after we exit - we will either have applied the deltas,
 		// or we'll need to do a full resync, in either case no need to keep the deltas.  Don't do this immediately because
 		// we may need them to calculate the wireguard config delta.
@@ -495,111 +1894,177 @@ func (w *Wireguard) Apply() (err error) {
 		w.cidrToNodeNameUpdates = map[ip.CIDR]string{}
 	}()
 
-	// If necessary ensure the wireguard device is configured. If this errors or if it is not yet oper up then no point
-	// doing anything else.
-	if !w.inSyncLink {
-		w.logCxt.Debug("Ensure wireguard link is created and up")
-		linkUp, err := w.ensureLink(netlinkClient)
+	// If the link is not usable, then no point doing anything else with the wireguard device. Program the throw routes
+	// and the routing rule.
+	if !linkUp {
+		if err := w.applyThrowRoutes(ctx, netlinkClient); err != nil {
+			return err
+		}
+		return errLinkState
+	}
+
+	// If the interface has been reported up, check that the device has not lost its configuration.
+	w.verifyDeviceAfterUp(ctx)
+
+	// If wireguard is in-sync construct the delta update from the peer updates. If there is nothing to delete or update
+	// then there is no need to query or configure the wireguard device at all, which avoids dumping the device
+	// configuration when only routes have changed.
+	var wireguardPeerUpdate *wgtypes.Config
+	if w.inSyncWireguard {
+		wireguardPeerUpdate = w.constructWireguardDeltaFromPeerUpdates(conflictingKeys)
+	}
+	updateWireguard := !w.inSyncWireguard || wireguardPeerDelete != nil || wireguardPeerUpdate != nil
+
+	// Get the wireguard client if required. This may not always be possible.
+	var wireguardClient netlinkshim.Wireguard
+	if updateWireguard {
+		wireguardClient, err = w.getWireguardClient()
 		if netlinkshim.IsNotSupported(err) {
-			// Wireguard is not supported, set everything to "in-sync" since there is not a lot of point doing anything
-			// else. We don't return an error in this case, instead we'll retry every resync period.
-			w.logCxt.Info("Wireguard is not supported - publishing no public key")
+			w.logCxt.Info("Wireguard is not supported - send zero-key status")
 			w.setNotSupported()
 			return nil
 		} else if err != nil {
-			// Error configuring link, pass up the stack. Close the netlink client as a precaution.
-			w.logCxt.WithError(err).Info("Unable to create wireguard link, retrying...")
-			w.closeNetlinkClient()
-			return ErrUpdateFailed
-		} else if !linkUp {
-			// Wait for oper up notification.
-			w.logCxt.Info("Waiting for wireguard link to come up...")
-			return nil
+			w.logCxt.WithError(err).Error("error obtaining wireguard client")
+			return updateFailed(SubsystemWireguard, "client")
 		}
+		wireguardClient = netlinkshim.WireguardWithContext(ctx, wireguardClient)
 	}
 
-	// Get the wireguard client. This may not always be possible.
-	wireguardClient, err := w.getWireguardClient()
-	if netlinkshim.IsNotSupported(err) {
-		w.logCxt.Info("Wireguard is not supported - send zero-key status")
-		w.setNotSupported()
-		return nil
-	} else if err != nil {
-		w.logCxt.WithError(err).Error("error obtaining wireguard client")
-		return ErrUpdateFailed
+	// The link is up and the wireguard client is available, so wireguard is supported.
+	w.clearNotSupported()
+
+	// The peer updates have been consumed, so if the wireguard configuration is not applied the device is resynced by
+	// the next Apply.
+	if err := w.checkContext(ctx, "routes"); err != nil {
+		w.inSyncWireguard = false
+		return err
 	}
 
-	// The following can be done in parallel:
-	// - Update the link address
-	// - Update the routetable
-	// - Update the wireguard device.
+	// The link address is reconciled in parallel with the routing and wireguard updates. The routing and wireguard
+	// updates are applied in order, so that traffic is not routed to the wireguard interface for a CIDR that is not an
+	// allowed IP of a peer, where it would be dropped:
+	// - Apply the routing tables. This removes the routes to the wireguard interface, or replaces them with throw
+	//   routes, before the CIDRs are removed from the allowed IPs. New routes to the wireguard interface are held back.
+	// - Apply the wireguard configuration. If the routing tables could not be applied, the peer configuration that may
+	//   remove allowed IPs is skipped, since the routes to those CIDRs may still be in place.
+	// - Add the held back routes to the wireguard interface, except for peers whose configuration was not applied, and
+	//   apply the routing tables again.
 	var wg sync.WaitGroup
 	var errLink, errWireguard, errRoutes error
 
-	// Update link address if out of sync.
-	if !w.inSyncInterfaceAddr {
-		w.logCxt.Info("Ensure wireguard interface address is correct")
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if errLink = w.ensureLinkAddressV4(netlinkClient); errLink == nil {
-				w.inSyncInterfaceAddr = true
-			}
-		}()
-	}
-
-	// Apply routetable updates.
-	w.logCxt.Debug("Apply routing table updates for wireguard")
+	// Reconcile the link addresses. We always check the addresses programmed on the link rather than tracking deltas,
+	// this ensures a previously failed delete, an out-of-band change or a recreated link is always corrected.
+	w.logCxt.Debug("Ensure wireguard interface address is correct")
+	checkLocalRoutes := !w.inSyncLocalRoutes
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errRoutes = w.routetable.Apply()
+		errLink = w.ensureLinkAddressV4(addrNetlinkClient, checkLocalRoutes)
 	}()
 
+	// Apply routetable updates.
+	w.logCxt.Debug("Apply routing table updates for wireguard")
+	errRoutes = w.applyRoutes(ctx)
+
 	// Apply wireguard configuration.
-	wg.Add(1)
-	var wireguardPeerUpdate *wgtypes.Config
-	var publicKey wgtypes.Key
-	go func() {
-		defer wg.Done()
+	skippedNodes := set.New()
+	skipped := false
+	w.configuredAllowedIPs = map[ip.CIDR]bool{}
+	if updateWireguard {
+		errWireguard = func() error {
+			var publicKey wgtypes.Key
+			var err error
+
+			// Update wireguard so that we are in-sync.
+			if w.inSyncWireguard {
+				// Wireguard configuration is in-sync, perform a delta update. Apply the delete and then the update that
+				// were constructed earlier. Flag as not in-sync until we have finished processing.
+				w.logCxt.Debug("Apply wireguard crypto routing delta update")
+				if errRoutes != nil {
+					wireguardPeerDelete = w.skipAllowedIPRemovals(wireguardPeerDelete, skippedNodes, &skipped)
+					wireguardPeerUpdate = w.skipAllowedIPRemovals(wireguardPeerUpdate, skippedNodes, &skipped)
+				}
+				if err = w.applyWireguardConfig(wireguardClient, wireguardPeerDelete); err != nil {
+					w.logCxt.WithError(err).Info("Failed to delete wireguard peers")
+					return err
+				}
+				if err = w.applyWireguardConfig(wireguardClient, wireguardPeerUpdate); err != nil {
+					w.logCxt.WithError(err).Info("Failed to create or update wireguard peers")
+					return err
+				}
+			} else {
+				// Wireguard configuration is not in-sync. Construct and apply the wireguard configuration required to
+				// synchronize with our cached data. A full rebuild may remove allowed IPs from any peer, so it is
+				// deferred until the routing tables have been applied.
+				rebuild := w.fullRebuild && errRoutes == nil && !w.adopting()
+				w.deviceReadUnconfirmed = false
+				if rebuild {
+					w.logCxt.Info("Apply wireguard full rebuild")
+					publicKey, wireguardPeerUpdate, err = w.constructWireguardConfigForRebuild(wireguardClient)
+				} else {
+					w.logCxt.Debug("Apply wireguard crypto routing resync")
+					publicKey, wireguardPeerUpdate, err = w.constructWireguardDeltaForResync(wireguardClient)
+				}
+				if err != nil {
+					w.logCxt.WithError(err).Info("Failed to construct a full wireguard delta for resync")
+					return err
+				}
 
-		// Update wireguard so that we are in-sync.
-		if w.inSyncWireguard {
-			// Wireguard configuration is in-sync, perform a delta update. First do the delete that was constructed
-			// earlier, then construct and apply the update. Flag as not in-sync until we have finished processing.
-			w.logCxt.Debug("Apply wireguard crypto routing delta update")
-			if errWireguard = w.applyWireguardConfig(wireguardClient, wireguardPeerDelete); errWireguard != nil {
-				w.logCxt.WithError(errWireguard).Info("Failed to delete wireguard peers")
-				return
-			}
-			wireguardPeerUpdate = w.constructWireguardDeltaFromPeerUpdates(conflictingKeys)
-			if errWireguard = w.applyWireguardConfig(wireguardClient, wireguardPeerUpdate); errWireguard != nil {
-				w.logCxt.WithError(errWireguard).Info("Failed to create or update wireguard peers")
-				return
-			}
-		} else {
-			// Wireguard configuration is not in-sync. Construct and apply the wireguard configuration required to
-			// synchronize with our cached data.
-			w.logCxt.Debug("Apply wireguard crypto routing resync")
-			if publicKey, wireguardPeerUpdate, errWireguard = w.constructWireguardDeltaForResync(wireguardClient); errWireguard != nil {
-				w.logCxt.WithError(errWireguard).Info("Failed to construct a full wireguard delta for resync")
-				return
-			} else if errWireguard = w.applyWireguardConfig(wireguardClient, wireguardPeerUpdate); errWireguard != nil {
-				w.logCxt.WithError(errWireguard).Info("Failed to update wireguard peers for resync")
-				return
-			} else if w.ourPublicKey == nil || *w.ourPublicKey != publicKey {
-				// The public key differs from the one we previously queried or this is the first time we queried it.
-				// Store and flag our key is not in sync so that a status update will be sent.
-				w.logCxt.Infof("Public key has been updated to %s, send status notification", publicKey)
-				w.ourPublicKey = &publicKey
-				w.ourPublicKeyAgreesWithDataplaneMsg = false
+				// Count the resyncs that found discrepancies. The first resync of the device and a resync that also
+				// applies peer updates are not counted, since the device is expected to differ, nor is a resync whose
+				// read of the device was not confirmed.
+				if !rebuild && !w.adopting() && w.ourPublicKey != nil && len(w.peerUpdates) == 0 &&
+					conflictingKeys.Len() == 0 && !w.deviceReadUnconfirmed {
+					w.countResync(wireguardPeerUpdate != nil)
+				}
+
+				if errRoutes != nil {
+					wireguardPeerUpdate = w.skipAllowedIPRemovals(wireguardPeerUpdate, skippedNodes, &skipped)
+				}
+				if err = w.applyWireguardConfig(wireguardClient, wireguardPeerUpdate); err != nil {
+					w.logCxt.WithError(err).Info("Failed to update wireguard peers for resync")
+					return err
+				}
+				if rebuild {
+					w.fullRebuild = false
+				}
+				if w.ourPublicKey == nil || *w.ourPublicKey != publicKey {
+					// The public key differs from the one we previously queried or this is the first time we queried it.
+					// Store and flag our key is not in sync so that a status update will be sent.
+					w.logCxt.Infof("Public key has been updated to %s, send status notification", publicKey)
+					w.ourPublicKey = &publicKey
+					w.ourPublicKeyAgreesWithDataplaneMsg = false
+				}
 			}
+
+			// If any of the peer configuration was skipped, or the read of the device was not confirmed, then resync on
+			// the next apply. While the adopted peers are left intact the device is resynced by each apply, so that the
+			// peer updates are applied around them.
+			w.inSyncWireguard = !skipped && !w.adopting() && !w.deviceReadUnconfirmed
+			return nil
+		}()
+	} else {
+		w.logCxt.Debug("Wireguard configuration is in-sync and there are no peer updates")
+	}
+
+	// Now the peers are configured, add the routes to the wireguard interface that were held back.
+	if errWireguard == nil && len(w.routesPendingWireguard) > 0 {
+		w.logCxt.Debug("Add routes to wireguard for the configured peers")
+		w.addPendingRoutes(skippedNodes)
+		if err := w.applyRouteTables(ctx, w.RouteTableSyncers()); err != nil {
+			errRoutes = err
 		}
-		w.inSyncWireguard = true
-	}()
+	} else if errWireguard != nil && len(w.configuredAllowedIPs) > 0 && len(w.routesPendingWireguard) > 0 {
+		w.logCxt.Debug("Add routes to wireguard for the chunks of allowed IPs that were configured")
+		w.addConfiguredChunkRoutes()
+		if err := w.applyRouteTables(ctx, w.RouteTableSyncers()); err != nil {
+			errRoutes = err
+		}
+	}
 
-	// Wait for the updates to complete.
+	// Wait for the link update to complete.
 	wg.Wait()
+	w.inSyncLocalRoutes = errLink == nil
 
 	if errWireguard != nil {
 		// Error applying the wireguard config. Close the wireguard client as a precaution - this will force us to open
@@ -607,6 +2072,17 @@ func (w *Wireguard) Apply() (err error) {
 		w.logCxt.Info("Wireguard programming failed, ensure full resync is performed next")
 		w.closeWireguardClient()
 		w.inSyncWireguard = false
+	} else if w.ourPublicKey != nil {
+		// The device is programmed with our key and listening port.
+		w.setLocalConfig(&localConfig{
+			publicKey: *w.ourPublicKey,
+			port:      w.config.ListeningPort,
+			ifaceName: w.config.InterfaceName,
+		})
+	}
+	if errWireguard == nil {
+		// Remove the peers of the previous keys of the nodes whose key transitions are over.
+		w.applyPeerKeyTransitions(ctx)
 	}
 	if errLink != nil {
 		// Error applying the link configuration. Close the netlink client as a precaution - this will force us to open
@@ -614,89 +2090,355 @@ func (w *Wireguard) Apply() (err error) {
 		w.closeNetlinkClient()
 	}
 
-	if errLink != nil || errRoutes != nil || errWireguard != nil {
-		return ErrUpdateFailed
+	// Each failure is attributed to the handle that failed, and only that handle has been closed. The routing rules are
+	// programmed through the link handle, so once the routing tables have been applied the rules are reconciled while
+	// the routetables are failing, but not until the wireguard configuration and the link address are in place.
+	failures := &ApplyError{}
+	if errLink != nil {
+		failures.add(SubsystemLink, "address")
+	}
+	if errRoutes != nil {
+		failures.add(SubsystemRoutes, "routes")
+	}
+	if errWireguard != nil {
+		failures.add(SubsystemWireguard, "wireguard")
+	}
+	if errLink != nil || errWireguard != nil || (errRoutes != nil && !w.rulesIndependentOfRoutes(ctx)) {
+		return w.applyError(ctx, failures.firstStep(), failures)
 	}
 
 	// Once the wireguard and routing configuration is in place we can add the routing rule to start using the new
-	// routing table.
+	// routing table. If the routing tables failed, the traffic to the CIDRs whose routes are missing falls through our
+	// routing tables.
 	w.logCxt.Debug("Ensure routing rule is configured")
 	if !w.inSyncRouteRule {
+		if err := w.checkContext(ctx, "rule"); err != nil {
+			return err
+		}
 		if err = w.ensureRouteRule(netlinkClient); err != nil {
 			// Error updating the ip rule - close the netlink client as a precaution.
 			w.closeNetlinkClient()
-			return ErrUpdateFailed
+			return w.applyError(ctx, "rule", failures.add(SubsystemLink, "rule"))
 		}
 
 		// Routing rule is now in-sync.
 		w.inSyncRouteRule = true
 	}
 
+	// On a node with multiple underlay interfaces, ensure the traffic sent by wireguard leaves through the underlay
+	// interface with the expected source address.
+	if !w.inSyncUnderlay && w.underlayEnabled() {
+		w.logCxt.Debug("Ensure underlay routing is configured")
+		if err := w.checkContext(ctx, "underlay"); err != nil {
+			return err
+		}
+		if err = w.ensureUnderlayRouting(netlinkClient); err != nil {
+			if _, ok := err.(*UnderlayAddressError); ok {
+				// The address is rechecked on the next Apply.
+				return err
+			}
+			w.closeNetlinkClient()
+			return w.applyError(ctx, "underlay", failures.add(SubsystemLink, "underlay"))
+		}
+		w.inSyncUnderlay = true
+	}
+
+	if errRoutes != nil {
+		return failures
+	}
 	return nil
 }
 
-// setNotSupported is called when we determine wireguard is not supported.
-func (w *Wireguard) setNotSupported() {
-	// Publish a zero-key back to the calc graph.
-	w.ourPublicKey = &zeroKey
-
-	// Indicate that we are now fully in-sync to prevent further queries/updates to the dataplane (until next resync).
-	w.setAllInSync(true)
+// rulesIndependentOfRoutes returns true if the routing rules are reconciled after the routing tables failed. The first
+// rules wait for the routing tables, so that the throw routes are in place before traffic is sent to our routing
+// tables, see Config.LocalCIDRsAsThrow. The rules are not reconciled once the Apply deadline has been exceeded.
+func (w *Wireguard) rulesIndependentOfRoutes(ctx context.Context) bool {
+	return w.routeTablesApplied && netlinkshim.ContextError(ctx) == nil
+}
 
-	// And flag wireguard is not supported to short circuit some of the Apply processing.
-	w.wireguardNotSupported = true
+// checkContext returns a DeadlineExceededError if the context of the Apply is done, in which case the step and the
+// remaining steps are not attempted.
+func (w *Wireguard) checkContext(ctx context.Context, step string) error {
+	if err := netlinkshim.ContextError(ctx); err != nil {
+		w.logCxt.WithError(err).Warningf("Apply deadline exceeded, skipping %s and the remaining steps", step)
+		return &DeadlineExceededError{Step: step, Err: err}
+	}
+	return nil
 }
 
-func (w *Wireguard) getOrInitPeer(name string) *peerData {
-	if n := w.peers[name]; n != nil {
-		return n
+// applyError returns the error for a failed step. If the context of the Apply is done the step failed because its
+// calls were abandoned, so this is a DeadlineExceededError.
+func (w *Wireguard) applyError(ctx context.Context, step string, err error) error {
+	if ctxErr := netlinkshim.ContextError(ctx); ctxErr != nil {
+		w.logCxt.WithError(ctxErr).Warningf("Apply deadline exceeded during %s, the remaining steps are skipped", step)
+		return &DeadlineExceededError{Step: step, Err: ctxErr}
 	}
-	return newPeerData()
+	return err
 }
 
-func (w *Wireguard) setPeer(name string, node *peerData) {
-	w.peers[name] = node
+// PublishGeneration returns the generation of our published public key, which is incremented each time the key is
+// published, and the generation that has been echoed back through a local EndpointWireguardUpdate. A publish is
+// in-flight while the published generation is greater than the echoed generation. This should be called from the
+// same goroutine as Apply.
+func (w *Wireguard) PublishGeneration() (published, echoed uint64) {
+	return w.publishGeneration, w.echoedPublishGeneration
 }
 
-func (w *Wireguard) getOrInitPeerUpdate(name string) *peerUpdateData {
-	if nu := w.peerUpdates[name]; nu != nil {
-		return nu
+// LocalConfig returns the public key, listening port and interface name programmed for the local wireguard device.
+// The ok flag is false if the device is not currently programmed, e.g. before the first successful Apply or when
+// wireguard is disabled or not supported. This may be called from any goroutine.
+func (w *Wireguard) LocalConfig() (publicKey wgtypes.Key, port int, ifaceName string, ok bool) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	if w.localConfig == nil {
+		return
 	}
-	return newPeerUpdateData()
+	return w.localConfig.publicKey, w.localConfig.port, w.localConfig.ifaceName, true
 }
 
-func (w *Wireguard) setPeerUpdate(name string, update *peerUpdateData) {
-	w.peerUpdates[name] = update
-}
+// PeerDiagnostics returns the diagnostics for each peer programmed in the wireguard device, keyed by node name. This
+// data is read from the device when the wireguard configuration is resynced, and is not updated by delta updates. The
+// handshake state is relative to the time of this call, a handshake older than Config.StaleHandshakeThreshold is
+// stale. This may be called from any goroutine.
+func (w *Wireguard) PeerDiagnostics() map[string]PeerDiagnostics {
+	staleThreshold := w.config.StaleHandshakeThreshold
+	if staleThreshold <= 0 {
+		staleThreshold = staleHandshakeAge
+	}
 
-// handlePeerAndRouteDeletionFromPeerUpdates handles wireguard peer deletion preparation:
-// -  Updates routing table to remove routes for permantently deleted peers
-// -  Creates a wireguard config update for deleted peers, or for peers whose public key has changed (which for
-//    wireguard is effectively a different peer)
-//
-// This method does not perform any dataplane updates.
-func (w *Wireguard) handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys set.Set) *wgtypes.Config {
-	var wireguardPeerDelete wgtypes.Config
-	for name, update := range w.peerUpdates {
-		// Get existing peer configuration. If peer not seen before then no deletion processing is required.
-		w.logCxt.Debugf("Handle peer and route deletion for node %s", name)
-		node := w.peers[name]
-		if node == nil {
-			w.logCxt.Debugf("No wireguard configuration for node %s", name)
-			continue
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	diags := make(map[string]PeerDiagnostics, len(w.peerDiagnostics))
+	for name, diag := range w.peerDiagnostics {
+		if diag.LastHandshakeTime.IsZero() {
+			diag.HandshakeState = HandshakeStateNone
+		} else if w.time.Since(diag.LastHandshakeTime) > staleThreshold {
+			diag.HandshakeState = HandshakeStateStale
+		} else {
+			diag.HandshakeState = HandshakeStateRecent
+		}
+		diags[name] = diag
+	}
+	return diags
+}
+
+// LimitError returns a *LimitExceededError if the configured maximum number of peers or allowed IPs per peer is
+// exceeded, or nil otherwise. The skipped peers and allowed IPs are programmed by a later Apply once there is room.
+// This should be called from the same goroutine as Apply.
+func (w *Wireguard) LimitError() error {
+	if w.limitErr == nil {
+		return nil
+	}
+	return w.limitErr
+}
+
+// DiscrepantResyncs returns the number of consecutive resyncs that found the wireguard device configuration did not
+// match the cached configuration. The first resync of the device and resyncs that also apply peer updates are not
+// counted. This may be called from any goroutine.
+func (w *Wireguard) DiscrepantResyncs() int {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.discrepantResyncs
+}
+
+// Mode returns whether the local wireguard device is a kernel or a userspace implementation. This may be called from
+// any goroutine.
+func (w *Wireguard) Mode() Mode {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	return w.mode
+}
+
+// Active returns true if wireguard is enabled and supported, and so traffic to wireguard capable peers is
+// encapsulated. This should be called from the same goroutine as Apply.
+func (w *Wireguard) Active() bool {
+	return w.config.Enabled && !w.wireguardNotSupported
+}
+
+// IPVersion returns the IP version of the allowed CIDRs and routes programmed by this instance.
+func (w *Wireguard) IPVersion() uint8 {
+	return w.config.ipVersion()
+}
+
+// Overhead returns the number of bytes added to each packet that is encapsulated by wireguard. Peers are only reached
+// over an IPv4 underlay.
+func (w *Wireguard) Overhead() int {
+	return OverheadForIPVersion(4)
+}
+
+// OverheadForIPVersion returns the number of bytes wireguard adds to each packet for an underlay of the specified IP
+// version: the outer IP and UDP headers, and the wireguard data message header and authentication tag.
+func OverheadForIPVersion(ipVersion uint8) int {
+	if ipVersion == 6 {
+		return overheadIPv6
+	}
+	return overheadIPv4
+}
+
+// setMode updates the mode of the local wireguard device.
+func (w *Wireguard) setMode(mode Mode) {
+	if w.mode == mode {
+		return
+	}
+	w.logCxt.WithField("mode", mode).Info("Wireguard device mode updated")
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.mode = mode
+}
+
+// setLocalConfig updates the programmed local configuration returned by LocalConfig. A nil value indicates the device
+// is not programmed.
+func (w *Wireguard) setLocalConfig(lc *localConfig) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.localConfig = lc
+}
+
+// setPeerDiagnostics updates the peer diagnostics returned by PeerDiagnostics.
+func (w *Wireguard) setPeerDiagnostics(diags map[string]PeerDiagnostics) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	w.peerDiagnostics = diags
+}
+
+// newPeerDiagnostics returns the diagnostics for a peer from the configured endpoint and the peer data reported by the
+// device. The device peer is nil if the peer is not yet programmed.
+func (w *Wireguard) newPeerDiagnostics(name string, node *peerData, devicePeer *wgtypes.Peer) PeerDiagnostics {
+	diag := PeerDiagnostics{
+		PublicKey:          node.publicKey,
+		ConfiguredEndpoint: w.endpointUDPAddr(name, node),
+		ProvisionalKeyFrom: w.provisionalKeyFrom(name),
+	}
+	if st := w.endpointFailovers[name]; st != nil {
+		diag.SecondaryEndpoint = st.usingSecondary
+		diag.EndpointFailovers = st.numFailovers
+	}
+	if devicePeer != nil {
+		diag.KernelEndpoint = devicePeer.Endpoint
+		diag.LastHandshakeTime = devicePeer.LastHandshakeTime
+		diag.ReceiveBytes = devicePeer.ReceiveBytes
+		diag.TransmitBytes = devicePeer.TransmitBytes
+	}
+	return diag
+}
+
+// refreshDeviceStats stores the endpoint, handshake time and traffic counters reported by the device for each peer
+// that should be programmed, returned by PeerDiagnostics. Peers that are not yet programmed in the device have no
+// statistics.
+func (w *Wireguard) refreshDeviceStats(device *wgtypes.Device) {
+	devicePeers := make(map[wgtypes.Key]*wgtypes.Peer, len(device.Peers))
+	for peerIdx := range device.Peers {
+		devicePeers[device.Peers[peerIdx].PublicKey] = &device.Peers[peerIdx]
+	}
+
+	diags := map[string]PeerDiagnostics{}
+	for name, node := range w.peers {
+		if !w.shouldProgramWireguardPeer(name, node) {
+			continue
+		}
+		diags[name] = w.newPeerDiagnostics(name, node, devicePeers[node.publicKey])
+	}
+	w.setPeerDiagnostics(diags)
+}
+
+// setNotSupported is called when we determine wireguard is not supported.
+func (w *Wireguard) setNotSupported() {
+	// Publish a zero-key back to the calc graph.
+	if w.ourPublicKey == nil || *w.ourPublicKey != zeroKey {
+		w.ourPublicKeyAgreesWithDataplaneMsg = false
+	}
+	w.ourPublicKey = &zeroKey
+	w.forgetIntendedKey()
+	w.setLocalConfig(nil)
+	w.setPeerDiagnostics(nil)
+
+	// Indicate that we are now fully in-sync to prevent further queries/updates to the dataplane (until next resync).
+	w.setAllInSync(true)
+
+	// And flag wireguard is not supported to short circuit some of the Apply processing.
+	w.wireguardNotSupported = true
+	w.scheduleReprobe()
+}
+
+func (w *Wireguard) getOrInitPeer(name string) *peerData {
+	if n := w.peers[name]; n != nil {
+		return n
+	}
+	return newPeerData()
+}
+
+// getProgrammedPeer returns the cached data for a peer, or nil if there is none or the peer is pending deletion. A peer
+// that is deleted and then updated again before the next Apply is re-created from the updates, so the updates must not
+// be compared against the cached data of the deleted peer.
+func (w *Wireguard) getProgrammedPeer(name string) *peerData {
+	if update := w.peerUpdates[name]; update != nil && update.deleted {
+		return nil
+	}
+	return w.peers[name]
+}
+
+func (w *Wireguard) setPeer(name string, node *peerData) {
+	w.peers[name] = node
+}
+
+// removeEmptyPeers removes the updated peers that have no configuration left and are not the interface address source
+// of any CIDR. The removal of a node may be followed by updates that remove the node's configuration, which would
+// otherwise leave an empty peer in the cache that is never removed.
+func (w *Wireguard) removeEmptyPeers() {
+	for name := range w.peerUpdates {
+		node := w.peers[name]
+		if node == nil || !node.isEmpty() {
+			continue
+		} else if _, ok := w.nodeNameToInterfaceCIDR[name]; ok {
+			continue
+		}
+		w.logCxt.Debugf("Peer %s has no configuration, removing from cache", name)
+		delete(w.peers, name)
+	}
+}
+
+func (w *Wireguard) getOrInitPeerUpdate(name string) *peerUpdateData {
+	if nu := w.peerUpdates[name]; nu != nil {
+		return nu
+	}
+	return newPeerUpdateData()
+}
+
+func (w *Wireguard) setPeerUpdate(name string, update *peerUpdateData) {
+	w.peerUpdates[name] = update
+}
+
+// handlePeerAndRouteDeletionFromPeerUpdates handles wireguard peer deletion preparation:
+// -  Updates routing table to remove routes for permantently deleted peers
+// -  Creates a wireguard config update for deleted peers, or for peers whose public key has changed (which for
+//    wireguard is effectively a different peer)
+//
+// This method does not perform any dataplane updates.
+func (w *Wireguard) handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys set.Set) *wgtypes.Config {
+	var wireguardPeerDelete wgtypes.Config
+	for name, update := range w.peerUpdates {
+		// Get existing peer configuration. If peer not seen before then no deletion processing is required.
+		w.logCxt.Debugf("Handle peer and route deletion for node %s", name)
+		node := w.peers[name]
+		if node == nil {
+			w.logCxt.Debugf("No wireguard configuration for node %s", name)
+			continue
 		}
 
 		if update.deleted {
 			// Node is deleted, so remove the node configuration and the associated routes.
 			w.logCxt.Infof("Node %s is deleted, remove associated routes and wireguard peer", name)
+			w.nodeStateChanged(name, node, node.lifecycleState(), NodeStateRemoving)
 			delete(w.peers, name)
+			w.recountPeerCapacity(name)
 
-			// Delete all of the node routes for the peerData and remove CIDR->node association. Note that we always
-			// update the routing table routes using delta updates even during a full resync. The routetable component
-			// takes care of its own kernel-cache synchronization.
+			// Delete all of the node routes for the peerData and remove CIDR->node association. The routes are either
+			// to the wireguard interface or throw routes, depending on whether we were routing to wireguard. Note that
+			// we always update the routing table routes using delta updates even during a full resync. The routetable
+			// component takes care of its own kernel-cache synchronization.
 			node.cidrs.Iter(func(item interface{}) error {
 				cidr := item.(ip.CIDR)
-				w.routetable.RouteRemove(w.config.InterfaceName, cidr)
+				w.removePeerRoute(node, cidr)
 				delete(w.cidrToNodeName, cidr)
 				w.logCxt.Debugf("Deleting route for %s", cidr)
 				return nil
@@ -713,13 +2455,24 @@ func (w *Wireguard) handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys se
 			continue
 		}
 
-		// If we aren't doing a full re-sync then delete the associated peer if it was previously configured.
+		// If we aren't doing a full re-sync then delete the associated peer if it was previously configured. If the
+		// node is in a key transition the peer of its previous key is kept, but its allowed IPs move to the peer of the
+		// new key.
 		if node.programmedInWireguard && w.inSyncWireguard {
-			w.logCxt.Debugf("Adding peer deletion config update for key %s", node.publicKey)
-			wireguardPeerDelete.Peers = append(wireguardPeerDelete.Peers, wgtypes.PeerConfig{
-				PublicKey: node.publicKey,
-				Remove:    true,
-			})
+			if !update.deleted && w.keepPreviousKeyPeer(name, node, *update.publicKey) {
+				w.logCxt.Debugf("Adding allowed IP removal config update for previous key %s", node.publicKey)
+				wireguardPeerDelete.Peers = append(wireguardPeerDelete.Peers, wgtypes.PeerConfig{
+					PublicKey:         node.publicKey,
+					UpdateOnly:        true,
+					ReplaceAllowedIPs: true,
+				})
+			} else {
+				w.logCxt.Debugf("Adding peer deletion config update for key %s", node.publicKey)
+				wireguardPeerDelete.Peers = append(wireguardPeerDelete.Peers, wgtypes.PeerConfig{
+					PublicKey: node.publicKey,
+					Remove:    true,
+				})
+			}
 			node.programmedInWireguard = false
 		}
 
@@ -735,6 +2488,9 @@ func (w *Wireguard) handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys se
 			w.logCxt.Infof("Removed node %s which claimed the same public key %s to at least one other node", name, node.publicKey)
 			conflictingKeys.Add(node.publicKey)
 		}
+		if !update.deleted {
+			update.fromState = node.lifecycleState()
+		}
 		node.publicKey = zeroKey
 	}
 
@@ -750,17 +2506,27 @@ func (w *Wireguard) handlePeerAndRouteDeletionFromPeerUpdates(conflictingKeys se
 // This method applies the current set of node updates on top of the current cache. It removes updates that are no
 // ops so that they are not re-processed further down the pipeline.
 func (w *Wireguard) updateCacheFromPeerUpdates(conflictingKeys set.Set) {
+	added := map[ip.CIDR]string{}
 	for name, update := range w.peerUpdates {
 		node := w.getOrInitPeer(name)
 
 		// This is a remote node configuration. Update the node data and the key to node mappings.
 		w.logCxt.Debugf("Updating cache from update for peer %s", name)
+		fromState := node.lifecycleState()
+		if update.fromState != "" {
+			fromState = update.fromState
+		}
 		updated := false
 		if update.ipv4EndpointAddr != nil {
 			w.logCxt.Debugf("Store IPv4 address %s", *update.ipv4EndpointAddr)
 			node.ipv4EndpointAddr = *update.ipv4EndpointAddr
 			updated = true
 		}
+		if update.listeningPort != nil {
+			w.logCxt.Debugf("Store listening port %d", *update.listeningPort)
+			node.listeningPort = *update.listeningPort
+			updated = true
+		}
 		if update.publicKey != nil {
 			w.logCxt.Debugf("Store public key %s", *update.publicKey)
 			node.publicKey = *update.publicKey
@@ -780,7 +2546,11 @@ func (w *Wireguard) updateCacheFromPeerUpdates(conflictingKeys set.Set) {
 			cidr := item.(ip.CIDR)
 			w.logCxt.Debugf("Discarding CIDR %s", cidr)
 			node.cidrs.Discard(cidr)
-			delete(w.cidrToNodeName, cidr)
+			if w.cidrToNodeName[cidr] == name {
+				// Only remove the CIDR association if it has not already been updated by the addition of the CIDR to
+				// another node.
+				delete(w.cidrToNodeName, cidr)
+			}
 			updated = true
 			return nil
 		})
@@ -789,101 +2559,234 @@ func (w *Wireguard) updateCacheFromPeerUpdates(conflictingKeys set.Set) {
 			w.logCxt.Debugf("Adding CIDR %s", cidr)
 			node.cidrs.Add(cidr)
 			w.cidrToNodeName[cidr] = name
+			added[cidr] = name
 			updated = true
 			return nil
 		})
+		if update.statusUpdated {
+			// The node data is unchanged, but the routes and wireguard configuration need recalculating. If the node
+			// shares its key, an opt-out also changes whether the other nodes claiming the key are programmed.
+			w.logCxt.Debug("Drain, ready or opt-out status updated")
+			if nodenames := w.publicKeyToNodeNames[node.publicKey]; nodenames != nil && nodenames.Len() > 1 {
+				conflictingKeys.Add(node.publicKey)
+			}
+			updated = true
+		}
+		if update.cidrsReclassified {
+			// The node data is unchanged, but the CIDRs excluded from wireguard have changed.
+			w.logCxt.Debug("CIDRs reclassified by the excluded CIDRs or the CIDR verifier")
+			updated = true
+		}
 
 		if updated {
 			// Node configuration updated. Store node data.
 			w.logCxt.Debug("Node updated")
 			w.setPeer(name, node)
+			w.nodeStateChanged(name, node, fromState, node.lifecycleState())
 		} else {
 			// No further update, delete update so it's not processed again.
 			w.logCxt.Debug("No updates for the node - remove node update to remove additional processing")
 			delete(w.peerUpdates, name)
 		}
 	}
+	w.logCIDROverlaps(added)
+}
+
+// updateLimits selects the peers to program in wireguard if Config.MaxPeers is exceeded. The peers that could be
+// programmed are selected in order of node name, so the selection is the same on every Apply and on every node. Peers
+// whose selection has changed are flagged as updated so that their routes and wireguard configuration are
+// recalculated. This also updates the count of skipped peers and allowed IPs.
+//
+// The selection is recalculated on every Apply, since the deletion of a peer frees up room without leaving a peer
+// update to process.
+//
+// This method does not perform any dataplane updates.
+func (w *Wireguard) updateLimits() {
+	overLimitNodes := set.New()
+	if w.config.MaxPeers > 0 {
+		var names []string
+		for name, node := range w.peers {
+			if w.canProgramWireguardPeer(name, node) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > w.config.MaxPeers {
+			sort.Strings(names)
+			for _, name := range names[w.config.MaxPeers:] {
+				overLimitNodes.Add(name)
+			}
+		}
+	}
+
+	// Flag the peers that have moved into or out of the selection as updated.
+	w.overLimitNodes.Iter(func(item interface{}) error {
+		if !overLimitNodes.Contains(item) {
+			w.logCxt.Infof("Peer %s is no longer over the maximum number of peers", item)
+			w.updatePeerStatus(item.(string))
+		}
+		return nil
+	})
+	overLimitNodes.Iter(func(item interface{}) error {
+		if !w.overLimitNodes.Contains(item) {
+			w.logCxt.Infof("Peer %s is over the maximum number of peers and will not be programmed", item)
+			w.updatePeerStatus(item.(string))
+		}
+		return nil
+	})
+	w.overLimitNodes = overLimitNodes
+
+	// Count the allowed IPs of the programmed peers that are over the limit.
+	skippedAllowedIPs := 0
+	if w.config.MaxAllowedIPsPerPeer > 0 {
+		for name, node := range w.peers {
+			numCIDRs := w.numIncludedCIDRs(node)
+			if numCIDRs > w.config.MaxAllowedIPsPerPeer && w.shouldProgramWireguardPeer(name, node) {
+				skippedAllowedIPs += numCIDRs - w.config.MaxAllowedIPsPerPeer
+			}
+		}
+	}
+
+	var limitErr *LimitExceededError
+	if overLimitNodes.Len() > 0 || skippedAllowedIPs > 0 {
+		limitErr = &LimitExceededError{
+			SkippedPeers:      overLimitNodes.Len(),
+			SkippedAllowedIPs: skippedAllowedIPs,
+		}
+	}
+	if limitErr != nil && (w.limitErr == nil || *limitErr != *w.limitErr) {
+		w.logCxt.WithError(limitErr).Warning("Wireguard limits exceeded, some peers will not use wireguard")
+	} else if limitErr == nil && w.limitErr != nil {
+		w.logCxt.Info("Wireguard limits are no longer exceeded")
+	}
+	w.limitErr = limitErr
+	gaugeSkippedPeers.Set(float64(overLimitNodes.Len()))
+	gaugeSkippedAllowedIPs.Set(float64(skippedAllowedIPs))
 }
 
-// updateRouteTable updates the route table from the node updates.
-func (w *Wireguard) updateRouteTableFromPeerUpdates() {
+// updateRouteTable updates the route table from the node updates. The routing for the peers claiming a conflicting
+// public key is also updated, since whether these peers are routed to wireguard may have changed even if the peer
+// itself has not been updated.
+func (w *Wireguard) updateRouteTableFromPeerUpdates(conflictingKeys set.Set) {
 	// Do all deletes first. Then adds or updates separarately. This ensures a CIDR that has been deleted from one node
 	// and added to another will not add first then delete (which will remove the route, since the route table does not
 	// care about destination node).
 	for name, update := range w.peerUpdates {
 		// Delete routes that are no longer required in routing.
 		node := w.getOrInitPeer(name)
-		ifaceName := routetable.InterfaceNone
-		if node != nil && node.programmedInWireguard {
-			ifaceName = w.config.InterfaceName
-		}
 		update.allowedCidrsDeleted.Iter(func(item interface{}) error {
-			w.logCxt.Debugf("Removing CIDR %s (node %s) from routetable interface %s", item, name, ifaceName)
-			cidr := item.(ip.CIDR)
-			w.routetable.RouteRemove(ifaceName, cidr)
+			w.logCxt.Debugf("Removing CIDR %s (node %s) from routetable", item, name)
+			w.removePeerRoute(node, item.(ip.CIDR))
 			return nil
 		})
 	}
 
 	// Now do the adds or updates. The routetable component will take care of routes that don't actually change and
 	// effectively no-op the delta.
-	for name, update := range w.peerUpdates {
+	names := set.New()
+	for name := range w.peerUpdates {
+		names.Add(name)
+	}
+	conflictingKeys.Iter(func(item interface{}) error {
+		if nodenames := w.publicKeyToNodeNames[item.(wgtypes.Key)]; nodenames != nil {
+			nodenames.Iter(func(item interface{}) error {
+				names.Add(item)
+				return nil
+			})
+		}
+		return nil
+	})
+	names.Iter(func(item interface{}) error {
+		name := item.(string)
 		w.logCxt.Debugf("Add/update routing for peer %s", name)
 		node := w.getOrInitPeer(name)
+		update := w.peerUpdates[name]
+		if update == nil {
+			// The peer has not been updated, but claims a conflicting public key.
+			update = newPeerUpdateData()
+		}
 
 		// If the node routing to wireguard does not match with whether we should route then we need to do a full
-		// route update, otherwise do an incremental update.
+		// route update. If the peer has more CIDRs than are programmed in wireguard then a CIDR update may change which
+		// of the other CIDRs are programmed, and if the excluded CIDRs have changed the CIDRs programmed have changed,
+		// so we also need to do a full route update. Otherwise do an incremental update.
 		var updateSet set.Set
-		shouldRouteToWireguard := w.shouldProgramWireguardPeer(name, node)
+		shouldRouteToWireguard := w.shouldRouteToWireguard(name, node)
+		limitedCIDRs := w.allowedIPsLimitApplies(node, update) || update.cidrsReclassified
 		if node.routingToWireguard != shouldRouteToWireguard {
 			w.logCxt.Debugf("Wireguard routing has changed from %v to %v - need to update full set of CIDRs", node.routingToWireguard, shouldRouteToWireguard)
 			updateSet = node.cidrs
+		} else if update.cidrsReclassified {
+			w.logCxt.Debug("Peer CIDRs reclassified - need to update full set of CIDRs")
+			updateSet = node.cidrs
+		} else if limitedCIDRs {
+			w.logCxt.Debug("Peer CIDRs exceed the maximum allowed IPs - need to update full set of CIDRs")
+			updateSet = node.cidrs
+		} else if update.gatewayUpdated {
+			w.logCxt.Debug("Peer interface address updated - need to update the gateway of the full set of CIDRs")
+			updateSet = node.cidrs
 		} else {
 			w.logCxt.Debugf("Wireguard routing has not changed from %v - only need to update added CIDRs", node.routingToWireguard)
 			updateSet = update.allowedCidrsAdded
 		}
 
-		var targetType routetable.TargetType
-		var ifaceName, deleteIfaceName string
-		if !shouldRouteToWireguard {
-			// If we should not route to wireguard then we need to use a throw directive to skip wireguard routing and
-			// return to normal routing. We may also need to delete the existing route to wireguard.
-			w.logCxt.Debug("Not routing to wireguard - set route type to throw")
-			targetType = routetable.TargetTypeThrow
-			ifaceName = routetable.InterfaceNone
-			deleteIfaceName = w.config.InterfaceName
-		} else {
-			// If we should route to wireguard then route to the wireguard interface. We may also need to delete the
-			// existing throw route that was used to circumvent wireguard routing.
-			w.logCxt.Debug("Routing to wireguard interface")
-			ifaceName = w.config.InterfaceName
-			deleteIfaceName = routetable.InterfaceNone
-		}
-
+		wireguardCIDRs := w.wireguardCIDRs(node)
 		updateSet.Iter(func(item interface{}) error {
 			cidr := item.(ip.CIDR)
 			w.logCxt.Debugf("Updating route for CIDR %s", cidr)
-			if node.routingToWireguard != shouldRouteToWireguard {
+
+			var targetType routetable.TargetType
+			var ifaceName, deleteIfaceName string
+			switch w.cidrRouteType(shouldRouteToWireguard, wireguardCIDRs, cidr) {
+			case peerRouteNone:
+				// The CIDR has no route, so the lookup of our routing tables falls through to the next rule.
+				w.removeExcludedPeerRoute(cidr)
+				return nil
+			case peerRouteThrow:
+				// If we should not route to wireguard then we need to use a throw directive to skip wireguard routing
+				// and return to normal routing. We may also need to delete the existing route to wireguard.
+				w.logCxt.Debug("Not routing to wireguard - set route type to throw")
+				targetType = routetable.TargetTypeThrow
+				ifaceName = routetable.InterfaceNone
+				deleteIfaceName = w.config.InterfaceName
+			case peerRouteWireguard:
+				// If we should route to wireguard then route to the wireguard interface. We may also need to delete the
+				// existing throw route that was used to circumvent wireguard routing.
+				w.logCxt.Debug("Routing to wireguard interface")
+				ifaceName = w.config.InterfaceName
+				deleteIfaceName = routetable.InterfaceNone
+			}
+
+			if ifaceName == w.config.InterfaceName && w.inSyncWireguard && !w.wireguardRoutesRemoved.Contains(cidr) {
+				// Hold back the route to wireguard until the CIDR has been added to the allowed IPs of the peer. If the
+				// CIDR is moving from another peer, the route is already to wireguard, so update it immediately. During a
+				// resync the peers may already be programmed, so the routes are updated immediately rather than removed
+				// by the routing table sync and added back.
+				w.logCxt.Debugf("Holding back route to wireguard for %s until the peer is configured", cidr)
+				pending := pendingRoute{nodeName: name, target: w.peerRouteTarget(targetType, name, cidr)}
+				if node.routingToWireguard != shouldRouteToWireguard || limitedCIDRs {
+					pending.oldIfaceName = deleteIfaceName
+				}
+				w.routesPendingWireguard[cidr] = pending
+			} else if node.routingToWireguard != shouldRouteToWireguard || limitedCIDRs {
 				// The wireguard setting has changed. It is possible that some of the entries we are "removing" were
 				// never added - the routetable component handles that gracefully. We need to do these deletes because
 				// routetable component groups by interface and we are essentially moving routes between the wireguard
 				// interface and the "none" interface.
 				w.logCxt.Debugf("Wireguard routing has changed - delete previous route for %s", deleteIfaceName)
-				w.routetable.RouteRemove(deleteIfaceName, cidr)
+				w.replaceRoute(deleteIfaceName, ifaceName, w.peerRouteTarget(targetType, name, cidr))
+			} else {
+				w.updateRoute(ifaceName, w.peerRouteTarget(targetType, name, cidr))
 			}
-			w.routetable.RouteUpdate(ifaceName, routetable.Target{
-				Type: targetType,
-				CIDR: cidr,
-			})
 			return nil
 		})
 		node.routingToWireguard = shouldRouteToWireguard
-	}
+		return nil
+	})
 }
 
 // constructWireguardDeltaFromPeerUpdates constructs a wireguard delta update from the set of peer updates.
 func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.Set) *wgtypes.Config {
-	// 4. If we are performing a wireguard delta update then construct the delta now.
+	// 5. If we are performing a wireguard delta update then construct the delta now.
 	var wireguardUpdate wgtypes.Config
 	if w.inSyncWireguard {
 		// Construct a wireguard delta update
@@ -898,7 +2801,9 @@ func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.S
 
 			if w.shouldProgramWireguardPeer(name, peer) {
 				// The wgpeer should be programmed in wireguard. We need to do a full CIDR re-sync if either:
-				// -  A CIDR was deleted (there is no API directive for deleting an allowed CIDR), or
+				// -  A CIDR was deleted (there is no API directive for deleting an allowed CIDR),
+				// -  The CIDRs exceed the maximum allowed IPs, so an update may change which CIDRs are programmed,
+				// -  The excluded CIDRs have changed, or
 				// -  The wgpeer has not been programmed.
 				logCxt.Debug("Peer should be programmed")
 				wgpeer := wgtypes.PeerConfig{
@@ -906,26 +2811,30 @@ func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.S
 					PublicKey:  peer.publicKey,
 				}
 				updatePeer := false
-				if !peer.programmedInWireguard || update.allowedCidrsDeleted.Len() > 0 {
-					logCxt.Debug("Peer not programmed or CIDRs were deleted - need to replace full set of CIDRs")
+				if !peer.programmedInWireguard || update.allowedCidrsDeleted.Len() > 0 || w.allowedIPsLimitApplies(peer, update) ||
+					update.cidrsReclassified {
+					logCxt.Debug("Peer not programmed, CIDRs were deleted, limited or reclassified - need to replace full set of CIDRs")
 					wgpeer.ReplaceAllowedIPs = true
-					wgpeer.AllowedIPs = peer.allowedCidrsForWireguard()
+					wgpeer.AllowedIPs = w.allowedCidrsForWireguard(peer)
 					updatePeer = true
 				} else if update.allowedCidrsAdded.Len() > 0 {
 					logCxt.Debug("Peer programmmed, no CIDRs deleted and CIDRs added")
-					wgpeer.AllowedIPs = make([]net.IPNet, 0, update.allowedCidrsAdded.Len())
-					update.allowedCidrsAdded.Iter(func(item interface{}) error {
-						wgpeer.AllowedIPs = append(wgpeer.AllowedIPs, item.(ip.CIDR).ToIPNet())
-						return nil
-					})
-					updatePeer = true
+					for _, cidr := range sortCIDRs(update.allowedCidrsAdded) {
+						if !w.isExcludedCIDR(cidr) {
+							wgpeer.AllowedIPs = append(wgpeer.AllowedIPs, cidr.ToIPNet())
+						}
+					}
+					updatePeer = len(wgpeer.AllowedIPs) > 0
 				}
 
-				if update.ipv4EndpointAddr != nil || !peer.programmedInWireguard {
-					logCxt.Infof("Peer endpoint address is updated: %v", update.ipv4EndpointAddr)
-					wgpeer.Endpoint = w.endpointUDPAddr(peer.ipv4EndpointAddr.AsNetIP())
+				if update.ipv4EndpointAddr != nil || update.listeningPort != nil || !peer.programmedInWireguard {
+					logCxt.Infof("Peer endpoint is updated: %v", w.endpointUDPAddr(name, peer))
+					wgpeer.Endpoint = w.endpointUDPAddr(name, peer)
 					updatePeer = true
 				}
+				if !peer.programmedInWireguard {
+					wgpeer.PersistentKeepaliveInterval = w.peerKeepalive()
+				}
 
 				if updatePeer {
 					logCxt.Debugf("Peer needs updating")
@@ -951,6 +2860,11 @@ func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.S
 			nodenames.Iter(func(item interface{}) error {
 				nodename := item.(string)
 				w.logCxt.Debugf("Processing peer %s", nodename)
+				if _, ok := w.peerUpdates[nodename]; ok {
+					// The peer has an update, so it has already been handled above.
+					w.logCxt.Debug("Peer already handled by delta update")
+					return nil
+				}
 				peer := w.peers[nodename]
 				if peer == nil || peer.programmedInWireguard == w.shouldProgramWireguardPeer(nodename, peer) {
 					// The peer programming matches the expected value, so nothing to do.
@@ -967,9 +2881,10 @@ func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.S
 					// The peer is not programmed and should be.  Add a delta create.
 					w.logCxt.Debug("Not programmed in wireguard, needs to be added now")
 					wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{
-						PublicKey:  peer.publicKey,
-						Endpoint:   w.endpointUDPAddr(peer.ipv4EndpointAddr.AsNetIP()),
-						AllowedIPs: peer.allowedCidrsForWireguard(),
+						PublicKey:                   peer.publicKey,
+						Endpoint:                    w.endpointUDPAddr(nodename, peer),
+						PersistentKeepaliveInterval: w.peerKeepalive(),
+						AllowedIPs:                  w.allowedCidrsForWireguard(peer),
 					})
 				}
 				return nil
@@ -987,14 +2902,21 @@ func (w *Wireguard) constructWireguardDeltaFromPeerUpdates(conflictingKeys set.S
 }
 
 // constructWireguardDeltaForResync checks the wireguard configuration matches the cached data and creates a delta
-// update to correct any discrepancies.
+// update to correct any discrepancies. The adopted peers of an existing device are left intact until the datastore is
+// in sync, see adoptDevice. If the read of the device is not confirmed, see readDeviceForResync, there is no update and
+// deviceReadUnconfirmed is set.
 func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim.Wireguard) (wgtypes.Key, *wgtypes.Config, error) {
 	// Get the wireguard device configuration.
-	device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+	device, confirmed, err := w.readDeviceForResync(wireguardClient)
 	if err != nil {
 		w.logCxt.Errorf("error querying wireguard configuration: %v", err)
 		return zeroKey, nil, err
 	}
+	if !confirmed {
+		w.deviceReadUnconfirmed = true
+		// The previous resync was clean, so our key is known.
+		return *w.ourPublicKey, nil, nil
+	}
 
 	// Determine if any configuration on the device needs updating
 	wireguardUpdate := wgtypes.Config{}
@@ -1010,32 +2932,50 @@ func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim
 		wireguardUpdateRequired = true
 	}
 
-	publicKey := device.PublicKey
-	if device.PrivateKey == zeroKey || device.PublicKey == zeroKey {
-		// One of the private or public key is not set. Generate a new private key and return the corresponding
-		// public key.
-		w.logCxt.Info("Generate new private/public keypair")
-		pkey, err := wgtypes.GeneratePrivateKey()
-		if err != nil {
-			w.logCxt.Errorf("error generating private-key: %v", err)
-			return zeroKey, nil, err
-		}
-		wireguardUpdate.PrivateKey = &pkey
+	// Check the device has the intended private key.
+	publicKey, privateKey, err := w.attestPrivateKey(device)
+	if err != nil {
+		return zeroKey, nil, err
+	} else if privateKey != nil {
+		wireguardUpdate.PrivateKey = privateKey
 		wireguardUpdateRequired = true
-
-		publicKey = pkey.PublicKey()
 	}
 
+	// If this is the first resync of an existing device then adopt its peers.
+	w.adoptDevice(device)
+
 	// Track which keys we have processed. The value indicates whether the data should be programmed in wireguard or
 	// not.
 	processedKeys := set.New()
 
+	// Refresh the peer statistics from the device peers.
+	w.refreshDeviceStats(device)
+
 	// Handle peers that are configured
+	w.resetPeerKeyTransitions()
 	for peerIdx := range device.Peers {
 		key := device.Peers[peerIdx].PublicKey
-		node := w.getNodeFromKey(key)
-		if node == nil {
-			w.logCxt.Infof("Peer key is not expected or associated with multiple peers: %v", key)
+		if w.adopting() && w.adoptedPeers.Contains(key) {
+			w.logCxt.Debugf("Leaving adopted peer intact until the datastore is in sync: %v", key)
+			processedKeys.Add(key)
+			continue
+		}
+		if w.keepDevicePreviousKeyPeer(key) {
+			w.logCxt.Debugf("Keeping the peer of a previous key during a key transition: %v", key)
+			processedKeys.Add(key)
+			if len(device.Peers[peerIdx].AllowedIPs) > 0 {
+				wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{
+					PublicKey:         key,
+					UpdateOnly:        true,
+					ReplaceAllowedIPs: true,
+				})
+				wireguardUpdateRequired = true
+			}
+			continue
+		}
+		name, node := w.getNodeFromKey(key)
+		if node == nil || !w.shouldProgramWireguardPeer(name, node) {
+			w.logCxt.Infof("Peer key is not expected, associated with multiple peers or should not be programmed: %v", key)
 			wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{
 				PublicKey: key,
 				Remove:    true,
@@ -1046,27 +2986,45 @@ func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim
 		}
 
 		w.logCxt.Debugf("Checking allowed CIDRs for node with key %v", key)
+		processedKeys.Add(key)
 		configuredCidrs := device.Peers[peerIdx].AllowedIPs
 		configuredAddr := device.Peers[peerIdx].Endpoint
 		replaceCidrs := false
+		var missingCidrs []net.IPNet
 
 		// Need to check programmed CIDRs against expected to see if any need deleting.
 		w.logCxt.Debug("Check programmed CIDRs for required deletions")
+		expectedCidrs := w.wireguardCIDRs(node)
+		configuredCidrSet := set.New()
 		for _, netCidr := range configuredCidrs {
 			cidr := ip.CIDRFromIPNet(&netCidr)
-			if !node.cidrs.Contains(cidr) {
+			if !expectedCidrs.Contains(cidr) {
 				// Need to delete an entry, so just replace
 				w.logCxt.Debugf("Unexpected CIDR configured: %s", cidr)
 				replaceCidrs = true
 				break
 			}
+			configuredCidrSet.Add(cidr)
+		}
+		if !replaceCidrs && configuredCidrSet.Len() != expectedCidrs.Len() {
+			// No unexpected CIDRs are configured, but some are missing, e.g. because the configuration of the chunks of
+			// allowed IPs of the peer failed part way. Append the missing CIDRs, which resumes from the failed chunk.
+			w.logCxt.Debug("Expected CIDRs are not configured")
+			for _, cidr := range w.allowedCidrsForWireguard(node) {
+				if !configuredCidrSet.Contains(ip.CIDRFromIPNet(&cidr)) {
+					missingCidrs = append(missingCidrs, cidr)
+				}
+			}
 		}
 
 		// If the CIDRs need replacing or the endpoint address needs updating then wireguardUpdate the entry.
-		expectedEndpointIP := node.ipv4EndpointAddr.AsNetIP()
-		replaceEndpointAddr := expectedEndpointIP != nil &&
-			(configuredAddr == nil || configuredAddr.Port != w.config.ListeningPort || !configuredAddr.IP.Equal(expectedEndpointIP))
-		if replaceCidrs || replaceEndpointAddr {
+		// A peer without an endpoint address keeps the endpoint learned by wireguard, see
+		// Config.ProgramPeersWithoutEndpoint.
+		expectedEndpoint := w.endpointUDPAddr(name, node)
+		replaceEndpointAddr := expectedEndpoint != nil && (configuredAddr == nil ||
+			configuredAddr.Port != expectedEndpoint.Port || !configuredAddr.IP.Equal(expectedEndpoint.IP))
+		replaceKeepalive := device.Peers[peerIdx].PersistentKeepaliveInterval != w.persistentKeepalive()
+		if replaceCidrs || replaceEndpointAddr || len(missingCidrs) > 0 || replaceKeepalive {
 			peer := wgtypes.PeerConfig{
 				PublicKey:         key,
 				UpdateOnly:        true,
@@ -1075,12 +3033,21 @@ func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim
 
 			if replaceEndpointAddr {
 				w.logCxt.Info("Endpoint address needs updating")
-				peer.Endpoint = w.endpointUDPAddr(expectedEndpointIP)
+				peer.Endpoint = expectedEndpoint
+			}
+
+			if replaceKeepalive {
+				w.logCxt.Info("Persistent keepalive needs updating")
+				keepalive := w.persistentKeepalive()
+				peer.PersistentKeepaliveInterval = &keepalive
 			}
 
 			if replaceCidrs {
 				w.logCxt.Info("AllowedIPs need replacing")
-				peer.AllowedIPs = node.allowedCidrsForWireguard()
+				peer.AllowedIPs = w.allowedCidrsForWireguard(node)
+			} else if len(missingCidrs) > 0 {
+				w.logCxt.Infof("%d AllowedIPs are missing", len(missingCidrs))
+				peer.AllowedIPs = missingCidrs
 			}
 
 			wireguardUpdate.Peers = append(wireguardUpdate.Peers, peer)
@@ -1101,9 +3068,10 @@ func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim
 
 		w.logCxt.Infof("Add peer to wireguard: node %s; key %v; ip: %v", name, node.publicKey, node.ipv4EndpointAddr)
 		wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{
-			PublicKey:  node.publicKey,
-			Endpoint:   w.endpointUDPAddr(node.ipv4EndpointAddr.AsNetIP()),
-			AllowedIPs: node.allowedCidrsForWireguard(),
+			PublicKey:                   node.publicKey,
+			Endpoint:                    w.endpointUDPAddr(name, node),
+			PersistentKeepaliveInterval: w.peerKeepalive(),
+			AllowedIPs:                  w.allowedCidrsForWireguard(node),
 		})
 		wireguardUpdateRequired = true
 	}
@@ -1117,10 +3085,75 @@ func (w *Wireguard) constructWireguardDeltaForResync(wireguardClient netlinkshim
 	return publicKey, nil, nil
 }
 
+// constructWireguardConfigForRebuild constructs the complete wireguard configuration from the cached data. This
+// replaces all of the peers on the device and the allowed IPs of each peer, so that the device matches the cached data
+// regardless of its current configuration. The device is programmed with the intended private key, see
+// attestPrivateKey.
+func (w *Wireguard) constructWireguardConfigForRebuild(wireguardClient netlinkshim.Wireguard) (wgtypes.Key, *wgtypes.Config, error) {
+	// Get the wireguard device configuration.
+	device, err := wireguardClient.DeviceByName(w.config.InterfaceName)
+	if err != nil {
+		w.logCxt.Errorf("error querying wireguard configuration: %v", err)
+		return zeroKey, nil, err
+	}
+
+	// The device is programmed with the intended private key, whether or not it has drifted.
+	publicKey, _, err := w.attestPrivateKey(device)
+	if err != nil {
+		return zeroKey, nil, err
+	}
+	privateKey := w.intendedKey.privateKey
+	wireguardUpdate := wgtypes.Config{
+		PrivateKey:   &privateKey,
+		ListenPort:   &w.config.ListeningPort,
+		FirewallMark: &w.config.FirewallMark,
+		ReplacePeers: true,
+	}
+
+	// The peers are recreated, so there are no device diagnostics until the next resync.
+	diags := map[string]PeerDiagnostics{}
+	defer w.setPeerDiagnostics(diags)
+
+	// The peers of the previous keys of the nodes in a key transition are removed, and are not recreated.
+	w.resetPeerKeyTransitions()
+
+	for name, node := range w.peers {
+		if !w.shouldProgramWireguardPeer(name, node) {
+			continue
+		}
+		w.logCxt.Debugf("Rebuild peer: node %s; key %v; ip: %v", name, node.publicKey, node.ipv4EndpointAddr)
+		diags[name] = w.newPeerDiagnostics(name, node, nil)
+		wireguardUpdate.Peers = append(wireguardUpdate.Peers, wgtypes.PeerConfig{
+			PublicKey:                   node.publicKey,
+			Endpoint:                    w.endpointUDPAddr(name, node),
+			PersistentKeepaliveInterval: w.peerKeepalive(),
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  w.allowedCidrsForWireguard(node),
+		})
+	}
+
+	return publicKey, &wireguardUpdate, nil
+}
+
+// countResync counts the consecutive resyncs that found discrepancies in the wireguard device configuration.
+func (w *Wireguard) countResync(discrepancies bool) {
+	w.localConfigLock.Lock()
+	defer w.localConfigLock.Unlock()
+	if discrepancies {
+		w.discrepantResyncs++
+	} else {
+		w.discrepantResyncs = 0
+	}
+	w.lastResyncClean = !discrepancies
+}
+
 // ensureLink checks that the wireguard link is configured correctly. Returns true if the link is oper up.
-func (w *Wireguard) ensureLink(netlinkClient netlinkshim.Netlink) (bool, error) {
+func (w *Wireguard) ensureLink(ctx context.Context, netlinkClient netlinkshim.Netlink) (bool, error) {
 	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
-	if netlinkshim.IsNotExist(err) {
+	if netlinkshim.IsNotExist(err) && w.mode == ModeUserspace {
+		// The userspace device is created externally. Wait for the interface to appear.
+		return false, w.startUserspaceDevice(ctx)
+	} else if netlinkshim.IsNotExist(err) {
 		// Create the wireguard device.
 		w.logCxt.Info("Wireguard device needs to be created")
 		attr := netlink.NewLinkAttrs()
@@ -1130,7 +3163,11 @@ func (w *Wireguard) ensureLink(netlinkClient netlinkshim.Netlink) (bool, error)
 			LinkType:  wireguardType,
 		}
 
-		if err := netlinkClient.LinkAdd(&lwg); err != nil {
+		if err := netlinkClient.LinkAdd(&lwg); netlinkshim.IsNotSupported(err) && w.config.EnableUserspaceFallback {
+			w.logCxt.Info("Kernel does not support wireguard, falling back to a userspace wireguard device")
+			w.setMode(ModeUserspace)
+			return false, w.startUserspaceDevice(ctx)
+		} else if err != nil {
 			return false, err
 		}
 
@@ -1146,251 +3183,1085 @@ func (w *Wireguard) ensureLink(netlinkClient netlinkshim.Netlink) (bool, error)
 		return false, err
 	}
 
-	if link.Type() != wireguardType {
-		w.logCxt.Errorf("interface %s is of type %s, not wireguard", w.config.InterfaceName, link.Type())
-		return false, errWrongInterfaceType
+	if link.Type() == userspaceType && w.config.EnableUserspaceFallback {
+		w.setMode(ModeUserspace)
+	} else if link.Type() == wireguardType {
+		w.setMode(ModeKernel)
+	} else if w.config.RepairWrongLinkType {
+		// Another device is using the wireguard interface name. Delete it and create the wireguard device in its place.
+		w.logCxt.Warnf("interface %s is of type %s, not wireguard - recreating as wireguard", w.config.InterfaceName, link.Type())
+		if err := netlinkClient.LinkDel(link); err != nil {
+			w.logCxt.WithError(err).Error("error deleting interface with incorrect type")
+			return false, err
+		}
+		return w.ensureLink(ctx, netlinkClient)
+	} else {
+		w.logCxt.Errorf("interface %s is of type %s, not wireguard", w.config.InterfaceName, link.Type())
+		return false, ErrWrongLinkType
+	}
+
+	// Check the link has not been recreated since we last programmed it.
+	w.checkLinkIndex(link.Attrs().Index)
+
+	// If necessary, update the MTU and admin status of the device.
+	w.logCxt.Debug("Wireguard device exists, checking settings")
+	attrs := link.Attrs()
+	oldMTU := attrs.MTU
+	if w.config.MTU != 0 && oldMTU != w.config.MTU {
+		w.logCxt.WithField("oldMTU", oldMTU).Info("Wireguard device MTU needs to be updated")
+		if err := netlinkClient.LinkSetMTU(link, w.config.MTU); err != nil {
+			w.logCxt.WithError(err).Warn("failed to set tunnel device MTU")
+			return false, err
+		}
+		w.logCxt.Info("Updated wireguard device MTU")
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		w.logCxt.WithField("flags", attrs.Flags).Info("Wireguard interface wasn't admin up, enabling it")
+		if err := netlinkClient.LinkSetUp(link); err != nil {
+			w.logCxt.WithError(err).Warn("failed to set wireguard device up")
+			return false, err
+		}
+		w.logCxt.Info("Set wireguard admin up")
+
+		if link, err = netlinkClient.LinkByName(w.config.InterfaceName); err != nil {
+			w.logCxt.WithError(err).Warn("failed to get link device after creating link")
+			return false, err
+		}
+	}
+
+	// Track whether the interface is oper up or not. We halt programming when it is down.
+	return link.Attrs().Flags&net.FlagUp != 0, nil
+}
+
+// startUserspaceDevice runs the configured helper to create the userspace wireguard device. The helper is run at most
+// once between resyncs. If no helper is configured the device is expected to be created externally. Userspace
+// implementations such as boringtun daemonize, so this waits for the helper to complete. The helper is killed if the
+// context of the Apply is done first, in which case it is run again by the next Apply.
+func (w *Wireguard) startUserspaceDevice(ctx context.Context) error {
+	if w.config.UserspaceHelper == "" || w.userspaceHelperRun {
+		w.logCxt.Info("Waiting for userspace wireguard device to be created...")
+		return nil
+	}
+	w.userspaceHelperRun = true
+
+	w.logCxt.WithField("helper", w.config.UserspaceHelper).Info("Running helper to create userspace wireguard device")
+	if err := exec.CommandContext(ctx, w.config.UserspaceHelper, w.config.InterfaceName).Run(); err != nil {
+		if ctx.Err() != nil {
+			w.userspaceHelperRun = false
+		}
+		w.logCxt.WithError(err).Error("error running userspace wireguard helper")
+		return err
+	}
+	return nil
+}
+
+// checkLinkIndex compares the index of the wireguard link with the index recorded when the link was last programmed.
+// If the link has been deleted and recreated out-of-band the kernel will have removed the routes and the device
+// configuration, so flag everything for resync to reprogram against the new link.
+func (w *Wireguard) checkLinkIndex(linkIndex int) {
+	if w.linkIndex != 0 && w.linkIndex != linkIndex {
+		w.logCxt.WithFields(logrus.Fields{
+			"oldLinkIndex": w.linkIndex,
+			"newLinkIndex": linkIndex,
+		}).Info("Wireguard link index has changed, resyncing wireguard configuration and routes")
+		w.inSyncWireguard = false
+		w.inSyncRouteRule = false
+		for _, rt := range w.routetables {
+			rt.QueueResync()
+		}
+
+		// The new link has not yet been programmed.
+		w.setLocalConfig(nil)
+		w.setPeerDiagnostics(nil)
+	}
+	w.linkIndex = linkIndex
+}
+
+// ensureNoLink checks that the wireguard link is not present. A shared link is left in place while it is used by the
+// instance for the other IP version, in which case the addresses of our IP version are removed from the link.
+func (w *Wireguard) ensureNoLink(netlinkClient netlinkshim.Netlink) error {
+	if w.deviceOwner != nil && w.deviceOwner.linkInUse(w.config.ipVersion()) {
+		w.logCxt.Debug("Wireguard device is used by the other IP version, not deleting it")
+		return w.ensureNoLinkAddresses(netlinkClient)
+	}
+	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
+	if err == nil {
+		// Wireguard device exists.
+		w.logCxt.Info("Wireguard is disabled, deleting device")
+		if err := netlinkClient.LinkDel(link); err != nil {
+			w.logCxt.Errorf("error deleting wireguard type link: %v", err)
+			return err
+		}
+		w.logCxt.Info("Deleted wireguard device")
+	} else if netlinkshim.IsNotExist(err) {
+		w.logCxt.Debug("Wireguard is disabled and does not exist")
+	} else if err != nil {
+		w.logCxt.Errorf("unable to determine if wireguard device exists: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ensureLinkAddressV4 ensures the wireguard link is set to the required local IP address.  It removes any other
+// addresses. The current addresses are always listed from the link so that this converges regardless of any previous
+// failures.
+//
+// The addresses are compared by IP and prefix length separately. An address with the required IP but a different
+// prefix length, e.g. one added manually, is replaced with the required address.
+//
+// If checkLocalRoutes is set, e.g. on a resync, or if an address is removed, the local routes of the link are also
+// checked for an address that is no longer required, see ensureNoStaleLocalRoutes.
+func (w *Wireguard) ensureLinkAddressV4(netlinkClient netlinkshim.Netlink, checkLocalRoutes bool) error {
+	w.logCxt.Debug("Setting local IPv4 address on link.")
+	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
+	if err != nil {
+		w.logCxt.WithError(err).Warning("Failed to get device")
+		return err
+	}
+	return w.reconcileLinkAddresses(netlinkClient, link, w.interfaceAddrsV4(), checkLocalRoutes)
+}
+
+// reconcileLinkAddresses ensures the addresses of our IP version on the link are the required addresses, mapped to
+// their prefix lengths, see ensureLinkAddressV4.
+func (w *Wireguard) reconcileLinkAddresses(
+	netlinkClient netlinkshim.Netlink, link netlink.Link, required map[ip.Addr]int, checkLocalRoutes bool,
+) error {
+
+	addrs, err := netlinkClient.AddrList(link, w.config.netlinkFamily())
+	if err != nil {
+		w.logCxt.WithError(err).Warn("failed to list interface addresses")
+		return err
+	}
+
+	// The required addresses are mapped to their prefix lengths. The IPs are not masked, so the CIDR form cannot be
+	// used for the comparison. The required addresses that are present are removed from the map as they are found, so
+	// the local routes are checked against a copy.
+	requiredAddrs := map[ip.Addr]int{}
+	for addr, prefixLen := range required {
+		requiredAddrs[addr] = prefixLen
+	}
+
+	for _, oldAddr := range addrs {
+		addr := ip.FromNetIP(oldAddr.IP)
+		prefixLen, _ := oldAddr.Mask.Size()
+		if requiredPrefixLen, ok := required[addr]; ok {
+			if prefixLen == requiredPrefixLen {
+				w.logCxt.WithField("addr", oldAddr.IPNet).Debug("Address already present.")
+				delete(required, addr)
+				continue
+			}
+			w.logCxt.WithFields(logrus.Fields{
+				"addr":              oldAddr.IPNet,
+				"requiredPrefixLen": requiredPrefixLen,
+			}).Info("Address present with the wrong prefix length, replacing it")
+		} else {
+			w.logCxt.WithField("oldAddr", oldAddr).Info("Removing old address")
+		}
+		if err := netlinkClient.AddrDel(link, &oldAddr); err != nil {
+			w.logCxt.WithError(err).Warn("failed to delete address from wireguard device")
+			return err
+		}
+		checkLocalRoutes = true
+	}
+
+	for addr, prefixLen := range required {
+		ipNet := net.IPNet{
+			IP:   addr.AsNetIP(),
+			Mask: net.CIDRMask(prefixLen, 8*len(addr.AsNetIP())),
+		}
+		w.logCxt.WithField("addr", ipNet).Info("address not present on wireguard device, adding it")
+		if err := netlinkClient.AddrAdd(link, &netlink.Addr{IPNet: &ipNet}); err != nil {
+			w.logCxt.WithError(err).WithField("addr", ipNet).Warn("failed to add address")
+			return err
+		}
+	}
+	w.logCxt.Debug("Address set.")
+
+	if checkLocalRoutes {
+		return w.ensureNoStaleLocalRoutes(netlinkClient, link, requiredAddrs)
+	}
+	return nil
+}
+
+// interfaceAddrsV4 returns the IPv4 addresses that should be configured on the wireguard link, mapped to the required
+// prefix length of each address.
+func (w *Wireguard) interfaceAddrsV4() map[ip.Addr]int {
+	addrs := map[ip.Addr]int{}
+	if w.ourIPv4InterfaceAddr != nil {
+		addrs[w.ourIPv4InterfaceAddr] = w.config.interfaceAddressPrefixLength(8 * len(w.ourIPv4InterfaceAddr.AsNetIP()))
+	}
+	return addrs
+}
+
+// ensureRouteRule ensures there is a single ip rule that jumps to each wireguard routing table, deleting any other
+// rules that jump to those tables. Rules that do not jump to a wireguard routing table belong to other components and
+// are never deleted. If another component has a rule at the configured priority, our rules are moved to the nearest
+// free priority within RoutingRulePriorityRange of the configured priority.
+func (w *Wireguard) ensureRouteRule(netlinkClient netlinkshim.Netlink) error {
+	// Get the programmed rules.
+	rules, err := netlinkClient.RuleList(w.config.netlinkFamily())
+	if err != nil {
+		return err
+	}
+
+	// Determine which priorities are occupied by rules owned by other components.
+	occupiedPriorities := set.New()
+	for _, rule := range rules {
+		if !w.ownsRoutingTable(rule.Table) && !w.isExclusionRule(rule) {
+			occupiedPriorities.Add(rule.Priority)
+		}
+	}
+
+	for {
+		priority, free := w.selectRulePriority(occupiedPriorities)
+		if !free {
+			w.logCxt.WithField("priority", priority).Warning(
+				"No free routing rule priority, sharing the priority with a rule owned by another component")
+		}
+
+		err = w.reconcileRouteRules(netlinkClient, rules, priority)
+		if err == nil {
+			err = w.reconcileExclusionRules(netlinkClient, rules, priority)
+		}
+		if netlinkshim.IsExist(err) && free {
+			// The rule conflicts with a rule we could not see in the listing. Treat the priority as occupied and try
+			// the next free priority.
+			w.logCxt.WithField("priority", priority).Info("Routing rule priority is in use, trying another priority")
+			occupiedPriorities.Add(priority)
+			if rules, err = netlinkClient.RuleList(w.config.netlinkFamily()); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if priority != w.rulePriority {
+			w.logCxt.WithFields(logrus.Fields{
+				"oldPriority": w.rulePriority,
+				"newPriority": priority,
+			}).Info("Wireguard routing rule priority updated")
+			w.rulePriority = priority
+			w.inSyncUnderlay = false
+		}
+		return nil
+	}
+}
+
+// selectRulePriority returns the priority to use for our routing rules, and whether the priority is free. The
+// previously selected priority is retained while it is free, so that our rules do not move back to the configured
+// priority when the other component's rule is deleted. If there are no free priorities in range, this returns the
+// configured priority.
+func (w *Wireguard) selectRulePriority(occupiedPriorities set.Set) (int, bool) {
+	configured := w.config.RoutingRulePriority
+	maxOffset := w.config.RoutingRulePriorityRange
+	inRange := func(priority int) bool {
+		// Priority 0 is reserved for the local table rule.
+		return priority > 0 && priority >= configured-maxOffset && priority <= configured+maxOffset
+	}
+
+	if inRange(w.rulePriority) && !occupiedPriorities.Contains(w.rulePriority) {
+		return w.rulePriority, true
+	}
+	for offset := 0; offset <= maxOffset; offset++ {
+		for _, priority := range []int{configured + offset, configured - offset} {
+			if inRange(priority) && !occupiedPriorities.Contains(priority) {
+				return priority, true
+			}
+		}
+	}
+	return configured, false
+}
+
+// reconcileRouteRules ensures the rules at the specified priority that send the selected traffic to each of the
+// wireguard routing tables are programmed, see routeRules. Rules that jump to a wireguard routing table and do not
+// match, e.g. the rules of previously configured selectors, or duplicate a matching rule, are deleted.
+func (w *Wireguard) reconcileRouteRules(netlinkClient netlinkshim.Netlink, rules []netlink.Rule, priority int) error {
+	// Add rule attributes for each of the routing tables.
+	newrules := map[int][]*netlink.Rule{}
+	for tableIndex := range w.routetables {
+		newrules[tableIndex] = w.routeRules(priority, tableIndex)
+	}
+
+	found := map[*netlink.Rule]bool{}
+	for _, rule := range rules {
+		if tableRules, ok := newrules[rule.Table]; ok {
+			w.logCxt.Debugf("Found rule to table %d", rule.Table)
+			if newrule := findRouteRule(tableRules, rule); newrule != nil && !found[newrule] {
+				w.logCxt.Debugf("Rule matches required rule")
+				found[newrule] = true
+				continue
+			}
+
+			// Rule does not match expected, or is a duplicate, delete it.
+			if err := netlinkClient.RuleDel(&rule); netlinkshim.IsNotExist(err) {
+				w.logCxt.Debug("Wireguard routing rule already deleted")
+			} else if err != nil {
+				w.logCxt.WithError(err).Error("Unable to delete wireguard routing rule")
+				return err
+			} else {
+				w.summary.rulesRemoved++
+			}
+		}
+	}
+
+	// Add the missing rules.
+	for _, tableIndex := range w.config.routingTableIndexes() {
+		for _, newrule := range newrules[tableIndex] {
+			if found[newrule] {
+				continue
+			}
+			if err := netlinkClient.RuleAdd(newrule); err != nil {
+				w.logCxt.WithError(err).Error("Unable to create wireguard routing rule")
+				return err
+			} else {
+				w.logCxt.Debugf("Added rule: %#v", newrule)
+				w.summary.rulesAdded++
+			}
+		}
+	}
+
+	return nil
+}
+
+// findRouteRule returns the required rule that matches the programmed rule, or nil if there is none.
+func findRouteRule(newrules []*netlink.Rule, rule netlink.Rule) *netlink.Rule {
+	for _, newrule := range newrules {
+		if reflect.DeepEqual(rule, *newrule) {
+			return newrule
+		}
+	}
+	return nil
+}
+
+// ensureNoRouteRule ensures the ip rule to jump to the wireguard table is configured. Since only the wireguard
+// module should be using the wireguard table (important to prevent routing loops), this method deletes any rules that
+// jump to that table and do not match the rule spec expected by this module, and will create the appropriate rule
+// if missing.
+func (w *Wireguard) ensureNoRouteRule(netlinkClient netlinkshim.Netlink) error {
+	// Get the programmed rules.
+	rules, err := netlinkClient.RuleList(w.config.netlinkFamily())
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if w.ownsRoutingTable(rule.Table) || w.isExclusionRule(rule) {
+			w.logCxt.Debugf("Found rule to table %d", rule.Table)
+
+			// Rule does not match expected, delete it.
+			if err := netlinkClient.RuleDel(&rule); netlinkshim.IsNotExist(err) {
+				w.logCxt.Debug("Wireguard routing rule already deleted")
+			} else if err != nil {
+				w.logCxt.WithError(err).Error("Unable to delete wireguard routing rule")
+				return err
+			} else {
+				w.summary.rulesRemoved++
+			}
+		}
+	}
+
+	return nil
+}
+
+// ownsRoutingTable returns true if the routing table is owned by the wireguard module, so that the rules to the table
+// are programmed by this module.
+func (w *Wireguard) ownsRoutingTable(tableIndex int) bool {
+	if _, ok := w.routetables[tableIndex]; ok {
+		return true
+	}
+	return w.underlayEnabled() && tableIndex == w.config.UnderlayRoutingTableIndex
+}
+
+// underlayEnabled returns true if the wireguard traffic is routed through a specific underlay interface, see
+// Config.UnderlayInterface.
+func (w *Wireguard) underlayEnabled() bool {
+	return w.config.UnderlayInterface != "" && w.config.UnderlayRoutingTableIndex != 0
+}
+
+// underlaySourceAddr returns the source address of the wireguard traffic on the underlay interface. This is
+// Config.UnderlaySourceIP if set, otherwise the endpoint address of this node, or nil if that is not yet known.
+func (w *Wireguard) underlaySourceAddr() ip.Addr {
+	if w.config.UnderlaySourceIP != nil {
+		return w.config.UnderlaySourceIP
+	}
+	return w.ourIPv4EndpointAddr
+}
+
+// ensureUnderlayRouting ensures the traffic sent by wireguard uses the underlay interface and source address. A rule
+// sends the packets with the wireguard firewall mark, which wireguard only sets on the packets sent from its listening
+// socket, to the underlay routing table. That table contains a default route through the underlay interface with the
+// source address, using the default gateway of the interface in the main table if there is one.
+//
+// If the source address is not configured on the underlay interface then the rule and route are removed, so that the
+// traffic is routed normally, and an UnderlayAddressError is returned.
+func (w *Wireguard) ensureUnderlayRouting(netlinkClient netlinkshim.Netlink) error {
+	sourceAddr := w.underlaySourceAddr()
+	if sourceAddr == nil {
+		w.logCxt.Info("Endpoint address of this node is not known, waiting to configure the underlay routing")
+		return nil
+	}
+	logCxt := w.logCxt.WithFields(logrus.Fields{
+		"underlayIface": w.config.UnderlayInterface,
+		"sourceAddr":    sourceAddr,
+	})
+
+	// Verify the source address is configured on the underlay interface.
+	link, err := netlinkClient.LinkByName(w.config.UnderlayInterface)
+	if netlinkshim.IsNotExist(err) {
+		logCxt.Warning("Underlay interface does not exist, removing the underlay routing")
+		if err := w.ensureNoUnderlayRoutes(netlinkClient); err != nil {
+			return err
+		}
+		return &UnderlayAddressError{Interface: w.config.UnderlayInterface, Address: sourceAddr}
+	} else if err != nil {
+		logCxt.WithError(err).Error("Unable to query the underlay interface")
+		return err
+	}
+	addrs, err := netlinkClient.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		logCxt.WithError(err).Error("Unable to list the addresses of the underlay interface")
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		found = found || addr.IP.Equal(sourceAddr.AsNetIP())
+	}
+	if !found {
+		logCxt.Warning("Source address is not configured on the underlay interface, removing the underlay routing")
+		if err := w.ensureNoUnderlayRoutes(netlinkClient); err != nil {
+			return err
+		}
+		return &UnderlayAddressError{Interface: w.config.UnderlayInterface, Address: sourceAddr}
+	}
+
+	// Determine the default route through the underlay interface.
+	route := netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Src:       sourceAddr.AsNetIP(),
+		Table:     w.config.UnderlayRoutingTableIndex,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	mainRoutes, err := netlinkClient.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		LinkIndex: route.LinkIndex,
+		Table:     syscall.RT_TABLE_MAIN,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		logCxt.WithError(err).Error("Unable to list the routes of the underlay interface")
+		return err
+	}
+	for _, mainRoute := range mainRoutes {
+		if mainRoute.Dst == nil && mainRoute.Gw != nil {
+			logCxt.Debugf("Using default gateway %s of the underlay interface", mainRoute.Gw)
+			route.Gw = mainRoute.Gw
+			route.Scope = netlink.SCOPE_UNIVERSE
+			break
+		}
+	}
+
+	// Reconcile the routes in the underlay routing table.
+	routes, err := netlinkClient.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Table: w.config.UnderlayRoutingTableIndex,
+	}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		logCxt.WithError(err).Error("Unable to list the routes in the underlay routing table")
+		return err
+	}
+	routeFound := false
+	for i := range routes {
+		existing := routes[i]
+		if !routeFound && existing.Dst == nil && existing.LinkIndex == route.LinkIndex && existing.Src.Equal(route.Src) &&
+			existing.Gw.Equal(route.Gw) && existing.Scope == route.Scope {
+			routeFound = true
+			continue
+		}
+		if err := netlinkClient.RouteDel(&existing); err != nil && !netlinkshim.IsNotExist(err) {
+			logCxt.WithError(err).Error("Unable to delete route in the underlay routing table")
+			return err
+		}
+		w.summary.routesRemoved++
+	}
+	if !routeFound {
+		if err := netlinkClient.RouteAdd(&route); err != nil {
+			logCxt.WithError(err).Error("Unable to add route to the underlay routing table")
+			return err
+		}
+		w.summary.routesAdded++
+	}
+
+	// Reconcile the rule to the underlay routing table.
+	rules, err := netlinkClient.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	newrule := netlink.NewRule()
+	newrule.Priority = w.rulePriority
+	newrule.Table = w.config.UnderlayRoutingTableIndex
+	newrule.Mark = w.config.FirewallMark
+	ruleFound := false
+	for i := range rules {
+		rule := rules[i]
+		if rule.Table != w.config.UnderlayRoutingTableIndex {
+			continue
+		}
+		if !ruleFound && reflect.DeepEqual(rule, *newrule) {
+			ruleFound = true
+			continue
+		}
+		if err := netlinkClient.RuleDel(&rule); err != nil && !netlinkshim.IsNotExist(err) {
+			logCxt.WithError(err).Error("Unable to delete underlay routing rule")
+			return err
+		}
+		w.summary.rulesRemoved++
+	}
+	if !ruleFound {
+		if err := netlinkClient.RuleAdd(newrule); err != nil {
+			logCxt.WithError(err).Error("Unable to create underlay routing rule")
+			return err
+		}
+		w.summary.rulesAdded++
+	}
+	return nil
+}
+
+// ensureNoUnderlayRoutes removes the routes in the underlay routing table, and the rules to the table.
+func (w *Wireguard) ensureNoUnderlayRoutes(netlinkClient netlinkshim.Netlink) error {
+	if !w.underlayEnabled() {
+		return nil
+	}
+
+	rules, err := netlinkClient.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		rule := rules[i]
+		if rule.Table != w.config.UnderlayRoutingTableIndex {
+			continue
+		}
+		if err := netlinkClient.RuleDel(&rule); netlinkshim.IsNotExist(err) {
+			w.logCxt.Debug("Underlay routing rule already deleted")
+		} else if err != nil {
+			w.logCxt.WithError(err).Error("Unable to delete underlay routing rule")
+			return err
+		} else {
+			w.summary.rulesRemoved++
+		}
+	}
+
+	routes, err := netlinkClient.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Table: w.config.UnderlayRoutingTableIndex,
+	}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if err := netlinkClient.RouteDel(&routes[i]); netlinkshim.IsNotExist(err) {
+			w.logCxt.Debug("Underlay route already deleted")
+		} else if err != nil {
+			w.logCxt.WithError(err).Error("Unable to delete route in the underlay routing table")
+			return err
+		} else {
+			w.summary.routesRemoved++
+		}
+	}
+	return nil
+}
+
+// disableStep is a step of the removal of the wireguard configuration while wireguard is disabled, see ensureDisabled.
+type disableStep int
+
+const (
+	disableStepPeers disableStep = iota
+	disableStepRoutes
+	disableStepRules
+	disableStepLink
+	disableStepDone
+)
+
+func (s disableStep) String() string {
+	switch s {
+	case disableStepPeers:
+		return "peers"
+	case disableStepRoutes:
+		return "routes"
+	case disableStepRules:
+		return "rules"
+	case disableStepLink:
+		return "link"
 	}
+	return "done"
+}
 
-	// If necessary, update the MTU and admin status of the device.
-	w.logCxt.Debug("Wireguard device exists, checking settings")
-	attrs := link.Attrs()
-	oldMTU := attrs.MTU
-	if w.config.MTU != 0 && oldMTU != w.config.MTU {
-		w.logCxt.WithField("oldMTU", oldMTU).Info("Wireguard device MTU needs to be updated")
-		if err := netlinkClient.LinkSetMTU(link, w.config.MTU); err != nil {
-			w.logCxt.WithError(err).Warn("failed to set tunnel device MTU")
-			return false, err
+// ensureDisabled ensures all calico-installed wireguard configuration is removed. The configuration is removed in
+// order: the peers are cleared so that no more traffic is encrypted, the routes are flushed from the wireguard routing
+// tables, the routing rules are removed, and finally the link is deleted. The routing rules are only removed once
+// there are no routes left in the wireguard routing tables, in which case the lookup falls through to the next rule, so
+// traffic falls back to the normal routing at each step rather than being routed to a device that is half removed.
+// Our public key is withdrawn once the routes are flushed, since the traffic is no longer diverted to the wireguard
+// routing tables, see keyPublicationReady.
+//
+// The progress is kept across Applies, so if a step fails the next Apply resumes from the failed step rather than
+// repeating the earlier steps. Once all of the steps complete the next removal, e.g. after a resync, starts again from
+// the first step.
+func (w *Wireguard) ensureDisabled(ctx context.Context, netlinkClient netlinkshim.Netlink) error {
+	for w.disableStep < disableStepDone {
+		if err := w.checkContext(ctx, "disable "+w.disableStep.String()); err != nil {
+			return err
 		}
-		w.logCxt.Info("Updated wireguard device MTU")
-	}
-	if attrs.Flags&net.FlagUp == 0 {
-		w.logCxt.WithField("flags", attrs.Flags).Info("Wireguard interface wasn't admin up, enabling it")
-		if err := netlinkClient.LinkSetUp(link); err != nil {
-			w.logCxt.WithError(err).Warn("failed to set wireguard device up")
-			return false, err
+		if err := w.applyDisableStep(ctx, netlinkClient); err != nil {
+			return err
 		}
-		w.logCxt.Info("Set wireguard admin up")
-
-		if link, err = netlinkClient.LinkByName(w.config.InterfaceName); err != nil {
-			w.logCxt.WithError(err).Warn("failed to get link device after creating link")
-			return false, err
+		w.logCxt.WithField("step", w.disableStep).Debug("Removed wireguard configuration")
+		if w.disableStep == disableStepRoutes {
+			w.withdrawKey()
 		}
+		w.disableStep++
 	}
+	w.disableStep = disableStepPeers
 
-	// Track whether the interface is oper up or not. We halt programming when it is down.
-	return link.Attrs().Flags&net.FlagUp != 0, nil
+	// The wireguard client is not used again while wireguard is disabled.
+	w.closeWireguardClient()
+	return nil
 }
 
-// ensureNoLink checks that the wireguard link is not present.
-func (w *Wireguard) ensureNoLink(netlinkClient netlinkshim.Netlink) error {
-	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
-	if err == nil {
-		// Wireguard device exists.
-		w.logCxt.Info("Wireguard is disabled, deleting device")
-		if err := netlinkClient.LinkDel(link); err != nil {
-			w.logCxt.Errorf("error deleting wireguard type link: %v", err)
+// applyDisableStep applies the current step of ensureDisabled.
+func (w *Wireguard) applyDisableStep(ctx context.Context, netlinkClient netlinkshim.Netlink) error {
+	switch w.disableStep {
+	case disableStepPeers:
+		if err := w.ensureNoPeersIfWireguard(ctx, netlinkClient); err != nil {
 			return err
 		}
-		w.logCxt.Info("Deleted wireguard device")
-	} else if netlinkshim.IsNotExist(err) {
-		w.logCxt.Debug("Wireguard is disabled and does not exist")
-	} else if err != nil {
-		w.logCxt.Errorf("unable to determine if wireguard device exists: %v", err)
-		return err
+	case disableStepRoutes:
+		// Only attempt automatic cleanup of the routing tables that are not the default table. The routetable
+		// configuration will be empty since we will not send updates, so applying this will remove the old routes if so
+		// configured. Routes are handled by a separate module which takes care of its own netlink client lifecycle.
+		var routetables []*RouteTableSyncer
+		for _, rt := range w.RouteTableSyncers() {
+			if rt.TableIndex() > 0 {
+				routetables = append(routetables, rt)
+			}
+		}
+		if err := w.applyRouteTables(ctx, routetables); err != nil {
+			return updateFailed(SubsystemRoutes, "disable routes")
+		}
+	case disableStepRules:
+		err := w.ensureNoRouteRule(netlinkClient)
+		if err == nil {
+			err = w.ensureNoUnderlayRoutes(netlinkClient)
+		}
+		if err != nil {
+			// Failed to delete the rule. Close the netlink client as a precaution.
+			w.closeNetlinkClient()
+			return updateFailed(SubsystemLink, "disable rules")
+		}
+	case disableStepLink:
+		err := w.ensureNoLink(netlinkClient)
+		if netlinkshim.IsBusy(err) {
+			w.linkBusyAttempts++
+			if w.linkBusyAttempts < maxLinkBusyAttempts {
+				w.logCxt.WithField("attempts", w.linkBusyAttempts).Warning(
+					"Wireguard device is busy, retrying the deletion on the next apply")
+				return &LinkBusyError{Attempts: w.linkBusyAttempts, Err: err}
+			}
+			w.logCxt.WithField("attempts", w.linkBusyAttempts).Error(
+				"Wireguard device is still busy, unable to delete it")
+			w.linkBusyAttempts = 0
+		} else if err == nil {
+			w.linkBusyAttempts = 0
+		}
+		if err != nil {
+			// Failed to delete the link. Close the netlink client as a precaution.
+			w.closeNetlinkClient()
+			return updateFailed(SubsystemLink, "disable link")
+		}
 	}
 	return nil
 }
 
-// ensureLinkAddressV4 ensures the wireguard link to set to the required local IP address.  It removes any other
-// addresses.
-func (w *Wireguard) ensureLinkAddressV4(netlinkClient netlinkshim.Netlink) error {
-	w.logCxt.Debug("Setting local IPv4 address on link.")
+// ensureNoPeersIfWireguard removes all of the peers from the wireguard device, if the link exists and is a wireguard
+// device. A device of another type using the interface name is deleted without removing any peers. Only the handle
+// that failed is closed, the netlink client if the link could not be read, otherwise the wireguard client.
+func (w *Wireguard) ensureNoPeersIfWireguard(ctx context.Context, netlinkClient netlinkshim.Netlink) error {
 	link, err := netlinkClient.LinkByName(w.config.InterfaceName)
-	if err != nil {
-		w.logCxt.WithError(err).Warning("Failed to get device")
-		return err
+	if netlinkshim.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		w.logCxt.WithError(err).Warning("Failed to read the wireguard link")
+		w.closeNetlinkClient()
+		return updateFailed(SubsystemLink, "disable peers")
+	} else if link.Type() != wireguardType && link.Type() != userspaceType {
+		w.logCxt.WithField("type", link.Type()).Debug("Interface is not a wireguard device, no peers to remove")
+		return nil
 	}
-
-	addrs, err := netlinkClient.AddrList(link, netlink.FAMILY_V4)
-	if err != nil {
-		w.logCxt.WithError(err).Warn("failed to list interface addresses")
-		return err
+	if err := w.ensureNoPeers(ctx); err != nil {
+		w.logCxt.WithError(err).Warning("Failed to remove the wireguard peers")
+		return updateFailed(SubsystemWireguard, "disable peers")
 	}
+	return nil
+}
 
-	var address net.IP
-	if w.ourIPv4InterfaceAddr != nil {
-		address = w.ourIPv4InterfaceAddr.AsNetIP()
+// RouteTableSyncers returns the routing tables owned by the wireguard module, ordered by table index.
+func (w *Wireguard) RouteTableSyncers() []*RouteTableSyncer {
+	var routetables []*RouteTableSyncer
+	for _, tableIndex := range w.config.routingTableIndexes() {
+		if rt, ok := w.routetables[tableIndex]; ok {
+			routetables = append(routetables, rt)
+		}
 	}
+	return routetables
+}
 
-	found := false
-	for _, oldAddr := range addrs {
-		if address != nil && oldAddr.IP.Equal(address) {
-			w.logCxt.Debug("Address already present.")
-			found = true
+// applyRouteTables applies the supplied routing tables. Tables that are in-sync are skipped.
+func (w *Wireguard) applyRouteTables(ctx context.Context, routetables []*RouteTableSyncer) error {
+	var lastErr error
+	for _, rt := range routetables {
+		if rt.InSync() {
+			w.logCxt.Debugf("Routing table %d is in-sync", rt.TableIndex())
 			continue
 		}
-		w.logCxt.WithField("oldAddr", oldAddr).Info("Removing old address")
-		if err := netlinkClient.AddrDel(link, &oldAddr); err != nil {
-			w.logCxt.WithError(err).Warn("failed to delete address from wireguard device")
-			return err
+		w.waitForConntrackCleanups(rt)
+		if err := rt.ApplyWithContext(ctx); err != nil {
+			w.logCxt.WithError(err).Infof("Failed to apply routing table %d", rt.TableIndex())
+			lastErr = err
 		}
 	}
+	if lastErr == nil {
+		// The routes of the CIDRs moved off wireguard have been removed, so remove their conntrack entries.
+		w.startConntrackCleanups()
+		w.routeTablesApplied = true
+	}
+	return lastErr
+}
 
-	if !found && address != nil {
-		w.logCxt.Info("address not present on wireguard device, adding it")
-		mask := net.CIDRMask(32, 32)
-		ipNet := net.IPNet{
-			IP:   address.Mask(mask), // Mask the IP to match ParseCIDR()'s behaviour.
-			Mask: mask,
-		}
-		addr := &netlink.Addr{
-			IPNet: &ipNet,
-		}
-		if err := netlinkClient.AddrAdd(link, addr); err != nil {
-			w.logCxt.WithError(err).WithField("addr", address).Warn("failed to add address")
-			return err
-		}
+// tableIndexForCIDR returns the index of the routing table used for the CIDR route based on its route class.
+func (w *Wireguard) tableIndexForCIDR(cidr ip.CIDR) int {
+	return w.config.routingTableIndexForClass(w.cidrToRouteClass[cidr])
+}
+
+// routeTarget returns the routetable target for a CIDR, applying the configured route scope and flags for the target
+// type.
+func (w *Wireguard) routeTarget(targetType routetable.TargetType, cidr ip.CIDR) routetable.Target {
+	target := routetable.Target{
+		Type: targetType,
+		CIDR: cidr,
 	}
-	w.logCxt.Debug("Address set.")
+	if targetType == routetable.TargetTypeThrow {
+		target.Scope = w.config.ThrowRouteScope
+	} else {
+		target.Scope = w.config.RouteScope
+		target.OnLink = w.config.RouteOnLink
+		target.Realm = w.config.routeRealm()
+	}
+	target.Priority = w.config.RoutePriority
+	return target
+}
 
-	return nil
+// peerRouteTarget returns the routetable target for a CIDR of a peer, as routeTarget. With Config.RouteViaPeerTunnelIP
+// the unicast route is via the interface address of the peer, unless the CIDR is the interface address itself or the
+// interface address is not known.
+func (w *Wireguard) peerRouteTarget(targetType routetable.TargetType, name string, cidr ip.CIDR) routetable.Target {
+	target := w.routeTarget(targetType, cidr)
+	if !w.config.RouteViaPeerTunnelIP || targetType == routetable.TargetTypeThrow {
+		return target
+	} else if _, ok := w.interfaceCIDRToNodeName[cidr]; ok {
+		return target
+	}
+	ifaceCIDR, ok := w.nodeNameToInterfaceCIDR[name]
+	if !ok || ifaceCIDR.Version() != cidr.Version() {
+		return target
+	}
+	scope := netlink.SCOPE_UNIVERSE
+	target.GW = ifaceCIDR.Addr()
+	target.Scope = &scope
+	target.OnLink = true
+	return target
 }
 
-// ensureRouteRule ensures that all ip rules that jump to the wireguard routing table are removed.
-func (w *Wireguard) ensureRouteRule(netlinkClient netlinkshim.Netlink) error {
-	// Add rule attributes.
-	newrule := netlink.NewRule()
-	newrule.Priority = w.config.RoutingRulePriority
-	newrule.Table = w.config.RoutingTableIndex
-	newrule.Mark = w.config.FirewallMark
-	newrule.Invert = true
+// updateRoute updates the route for a CIDR in the routing table for the route class of the CIDR. If the route is
+// programmed in a different routing table it is removed from that table.
+func (w *Wireguard) updateRoute(ifaceName string, target routetable.Target) {
+	w.setRoute(ifaceName, target)
+	w.summary.routesAdded++
+}
 
-	// Get the programmed rules.
-	rules, err := netlinkClient.RuleList(netlink.FAMILY_V4)
-	if err != nil {
-		return err
+// setRoute sets the route for a CIDR as updateRoute, without counting the route.
+func (w *Wireguard) setRoute(ifaceName string, target routetable.Target) {
+	tableIndex := w.tableIndexForCIDR(target.CIDR)
+	if oldTableIndex, ok := w.cidrToTableIndex[target.CIDR]; ok && oldTableIndex != tableIndex {
+		w.logCxt.Debugf("Moving route for %s from table %d to table %d", target.CIDR, oldTableIndex, tableIndex)
+		w.routetables[oldTableIndex].RouteRemove(w.config.InterfaceName, target.CIDR)
+		w.routetables[oldTableIndex].RouteRemove(routetable.InterfaceNone, target.CIDR)
 	}
+	delete(w.routesPendingWireguard, target.CIDR)
+	w.cidrToTableIndex[target.CIDR] = tableIndex
+	w.routetables[tableIndex].RouteUpdate(ifaceName, target)
+}
 
-	var found bool
-	for _, rule := range rules {
-		if rule.Table == w.config.RoutingTableIndex {
-			w.logCxt.Debugf("Found rule to table %d", w.config.RoutingTableIndex)
-			if reflect.DeepEqual(rule, *newrule) {
-				w.logCxt.Debugf("Rule matches required rule")
-				found = true
-				continue
-			}
+// replaceRoute updates the route for a CIDR, removing the route for the CIDR to the previous interface. The routing
+// table of the previous route is retained so that the route is also moved between tables if the table has changed.
+// Within the same routing table, the routing table replaces the previous route in place.
+func (w *Wireguard) replaceRoute(oldIfaceName, ifaceName string, target routetable.Target) {
+	tableIndex, ok := w.cidrToTableIndex[target.CIDR]
+	if !ok {
+		tableIndex = w.tableIndexForCIDR(target.CIDR)
+	}
+	w.routetables[tableIndex].RouteRemove(oldIfaceName, target.CIDR)
+	w.setRoute(ifaceName, target)
+	if ok {
+		w.summary.routesReplaced++
+	} else {
+		w.summary.routesAdded++
+	}
+}
 
-			// Rule does not match expected, delete it.
-			if err := netlinkClient.RuleDel(&rule); err != nil {
-				w.logCxt.WithError(err).Error("Unable to delete wireguard routing rule")
-				return err
-			}
-		}
+// removeRoute removes the route for a CIDR from the routing table it was programmed in.
+func (w *Wireguard) removeRoute(ifaceName string, cidr ip.CIDR) {
+	tableIndex, ok := w.cidrToTableIndex[cidr]
+	if !ok {
+		tableIndex = w.tableIndexForCIDR(cidr)
 	}
+	delete(w.cidrToTableIndex, cidr)
+	w.routetables[tableIndex].RouteRemove(ifaceName, cidr)
+	w.summary.routesRemoved++
+}
 
-	if found {
-		return nil
+// removePeerRoute removes the route for a CIDR of a peer. The route is to the wireguard interface if we are routing the
+// peer to wireguard, or a throw route otherwise. If the allowed IPs are limited or CIDRs have been excluded, some CIDRs
+// of a peer that is routed to wireguard have throw routes, and if the route to wireguard is held back the previous
+// route is still programmed, so in these cases the route is removed from both.
+func (w *Wireguard) removePeerRoute(node *peerData, cidr ip.CIDR) {
+	_, pending := w.routesPendingWireguard[cidr]
+	delete(w.routesPendingWireguard, cidr)
+	if node.routingToWireguard {
+		w.wireguardRoutesRemoved.Add(cidr)
 	}
 
-	// Add the missing rule.
-	if err := netlinkClient.RuleAdd(newrule); err != nil {
-		w.logCxt.WithError(err).Error("Unable to create wireguard routing rule")
-		return err
+	if !node.routingToWireguard && !pending && w.excludesNonWireguardPeersByRule() {
+		w.removeExcludedPeerRoute(cidr)
+	} else if w.config.MaxAllowedIPsPerPeer > 0 || w.cidrsExcludedEver || pending {
+		tableIndex, ok := w.cidrToTableIndex[cidr]
+		if !ok {
+			tableIndex = w.tableIndexForCIDR(cidr)
+		}
+		delete(w.cidrToTableIndex, cidr)
+		w.routetables[tableIndex].RouteRemove(w.config.InterfaceName, cidr)
+		w.routetables[tableIndex].RouteRemove(routetable.InterfaceNone, cidr)
+		w.summary.routesRemoved++
+	} else if node.routingToWireguard {
+		w.removeRoute(w.config.InterfaceName, cidr)
 	} else {
-		w.logCxt.Debugf("Added rule: %#v", newrule)
+		w.removeRoute(routetable.InterfaceNone, cidr)
 	}
-
-	return nil
 }
 
-// ensureNoRouteRule ensures the ip rule to jump to the wireguard table is configured. Since only the wireguard
-// module should be using the wireguard table (important to prevent routing loops), this method deletes any rules that
-// jump to that table and do not match the rule spec expected by this module, and will create the appropriate rule
-// if missing.
-func (w *Wireguard) ensureNoRouteRule(netlinkClient netlinkshim.Netlink) error {
-	// Get the programmed rules.
-	rules, err := netlinkClient.RuleList(netlink.FAMILY_V4)
-	if err != nil {
-		return err
+// addPendingRoutes adds the routes to the wireguard interface that were held back until the wireguard configuration of
+// the peer was applied. Routes for the skipped nodes, whose configuration was not applied, remain held back.
+func (w *Wireguard) addPendingRoutes(skippedNodes set.Set) {
+	for cidr, pending := range w.routesPendingWireguard {
+		if skippedNodes.Contains(pending.nodeName) {
+			w.logCxt.Debugf("Wireguard configuration of node %s was skipped, continue to hold back route for %s", pending.nodeName, cidr)
+			continue
+		}
+		w.logCxt.Debugf("Adding held back route to wireguard for %s", cidr)
+		w.addPendingRoute(pending)
 	}
+}
 
-	for _, rule := range rules {
-		if rule.Table == w.config.RoutingTableIndex {
-			w.logCxt.Debugf("Found rule to table %d", w.config.RoutingTableIndex)
+// addPendingRoute adds a route to the wireguard interface that was held back, replacing the route to the previous
+// interface if any.
+func (w *Wireguard) addPendingRoute(pending pendingRoute) {
+	if pending.oldIfaceName != "" {
+		w.replaceRoute(pending.oldIfaceName, w.config.InterfaceName, pending.target)
+	} else {
+		w.updateRoute(w.config.InterfaceName, pending.target)
+	}
+}
 
-			// Rule does not match expected, delete it.
-			if err := netlinkClient.RuleDel(&rule); netlinkshim.IsNotExist(err) {
-				w.logCxt.Debug("Wireguard routing rule already deleted")
-			} else if err != nil {
-				w.logCxt.WithError(err).Error("Unable to delete wireguard routing rule")
-				return err
+// skipAllowedIPRemovals returns the wireguard configuration without the peer configuration that may remove allowed IPs
+// from a peer, which is applied only once the routes to the wireguard interface for those allowed IPs are removed. The
+// nodes of the skipped peers are added to skippedNodes, and skipped is set if any peer configuration is skipped.
+func (w *Wireguard) skipAllowedIPRemovals(config *wgtypes.Config, skippedNodes set.Set, skipped *bool) *wgtypes.Config {
+	if config == nil {
+		return nil
+	}
+	filtered := *config
+	filtered.Peers = nil
+	for _, peer := range config.Peers {
+		if peer.Remove || (peer.UpdateOnly && peer.ReplaceAllowedIPs) {
+			w.logCxt.Infof("Routing update failed, skipping configuration of wireguard peer %s", peer.PublicKey)
+			*skipped = true
+			if nodenames := w.publicKeyToNodeNames[peer.PublicKey]; nodenames != nil {
+				nodenames.Iter(func(item interface{}) error {
+					skippedNodes.Add(item)
+					return nil
+				})
 			}
+			continue
 		}
+		filtered.Peers = append(filtered.Peers, peer)
+	}
+	if len(filtered.Peers) == 0 && filtered.PrivateKey == nil && filtered.ListenPort == nil && filtered.FirewallMark == nil {
+		return nil
 	}
+	return &filtered
+}
 
-	return nil
+// wireguardCIDRs returns the CIDRs of a peer that are programmed in wireguard if the peer is programmed. These are the
+// CIDRs that are not excluded, and if there are more than Config.MaxAllowedIPsPerPeer of those, the first CIDRs in
+// sorted order.
+func (w *Wireguard) wireguardCIDRs(node *peerData) set.Set {
+	includedCIDRs := w.includedCIDRs(node)
+	if w.config.MaxAllowedIPsPerPeer <= 0 || includedCIDRs.Len() <= w.config.MaxAllowedIPsPerPeer {
+		return includedCIDRs
+	}
+	cidrs := set.New()
+	for _, cidr := range sortCIDRs(includedCIDRs)[:w.config.MaxAllowedIPsPerPeer] {
+		cidrs.Add(cidr)
+	}
+	return cidrs
 }
 
-// ensureDisabled ensures all calico-installed wireguard configuration is removed.
-func (w *Wireguard) ensureDisabled(netlinkClient netlinkshim.Netlink) error {
-	var errRule, errLink, errRoutes error
-	wg := sync.WaitGroup{}
+// sortedWireguardCIDRs returns the CIDRs of a peer that are programmed in wireguard, as wireguardCIDRs, in sorted
+// order. The CIDRs are filtered and sorted in a single slice, rather than building the sets of the included CIDRs.
+func (w *Wireguard) sortedWireguardCIDRs(node *peerData) []ip.CIDR {
+	cidrs := make([]ip.CIDR, 0, node.cidrs.Len())
+	node.cidrs.Iter(func(item interface{}) error {
+		if cidr := item.(ip.CIDR); !w.isExcludedCIDR(cidr) {
+			cidrs = append(cidrs, cidr)
+		}
+		return nil
+	})
+	sortCIDRSlice(cidrs)
+	if w.config.MaxAllowedIPsPerPeer > 0 && len(cidrs) > w.config.MaxAllowedIPsPerPeer {
+		cidrs = cidrs[:w.config.MaxAllowedIPsPerPeer]
+	}
+	return cidrs
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errRule = w.ensureNoRouteRule(netlinkClient)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errLink = w.ensureNoLink(netlinkClient)
-	}()
-	if w.config.RoutingTableIndex > 0 {
-		// Only attempt automatic cleanup of the routing table if it is not the default table.
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			// The routetable configuration will be empty since we will not send updates, so applying this will remove the
-			// old routes if so configured.
-			errRoutes = w.routetable.Apply()
-		}()
-		wg.Wait()
+// numIncludedCIDRs returns the number of the CIDRs of a peer that are not excluded, see includedCIDRs.
+func (w *Wireguard) numIncludedCIDRs(node *peerData) int {
+	if len(w.excludeCIDRs) == 0 && w.deniedCIDRs.Len() == 0 && !w.config.CIDRFlapThrowRoute {
+		return node.cidrs.Len()
+	}
+	n := 0
+	node.cidrs.Iter(func(item interface{}) error {
+		if !w.isExcludedCIDR(item.(ip.CIDR)) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// includedCIDRs returns the CIDRs of a peer that are not excluded by Config.ExcludeCIDRs or denied by the CIDR verifier.
+func (w *Wireguard) includedCIDRs(node *peerData) set.Set {
+	if len(w.excludeCIDRs) == 0 && w.deniedCIDRs.Len() == 0 && !w.config.CIDRFlapThrowRoute {
+		return node.cidrs
+	}
+	cidrs := set.New()
+	node.cidrs.Iter(func(item interface{}) error {
+		if !w.isExcludedCIDR(item.(ip.CIDR)) {
+			cidrs.Add(item)
+		}
+		return nil
+	})
+	return cidrs
+}
+
+// allowedIPsLimitApplies returns true if the CIDRs of a peer have been updated and exceed, or exceeded before the
+// update, Config.MaxAllowedIPsPerPeer. The CIDRs programmed in wireguard may then have changed for CIDRs that were not
+// updated.
+func (w *Wireguard) allowedIPsLimitApplies(node *peerData, update *peerUpdateData) bool {
+	if w.config.MaxAllowedIPsPerPeer <= 0 || (update.allowedCidrsAdded.Len() == 0 && update.allowedCidrsDeleted.Len() == 0) {
+		return false
 	}
+	return node.cidrs.Len()+update.allowedCidrsDeleted.Len() > w.config.MaxAllowedIPsPerPeer
+}
 
-	if errRule != nil || errLink != nil {
-		// Failed to delete the rule or link.  Close the netlink client as a precaution.
-		w.closeNetlinkClient()
-		return ErrUpdateFailed
-	} else if errRoutes != nil {
-		// Routes are handled by a separate module which takes care of its own netlink client lifecycle.
-		return ErrUpdateFailed
+// allowedCidrsForWireguard returns the allowed IPs of a peer to program in wireguard, in sorted order so that the
+// allowed IPs are split into the same chunks by each Apply, see chunkPeers.
+func (w *Wireguard) allowedCidrsForWireguard(node *peerData) []net.IPNet {
+	return w.allowedIPs.allowedIPs(w.sortedWireguardCIDRs(node))
+}
+
+// shouldRouteToWireguard returns true if the CIDRs of the peer that are programmed in wireguard are routed to the
+// wireguard interface rather than having throw routes. This requires the wireguard link to be usable, see
+// setLinkUsable.
+func (w *Wireguard) shouldRouteToWireguard(name string, node *peerData) bool {
+	return w.linkUsable && w.shouldProgramWireguardPeer(name, node)
+}
+
+// setLinkUsable updates whether the wireguard link is up, so that routes to the wireguard interface can be programmed.
+// If this has changed then the routes of all of the peers are recalculated, replacing the throw routes of the wireguard
+// peers with routes to the wireguard interface, or vice versa.
+func (w *Wireguard) setLinkUsable(usable bool) {
+	if w.linkUsable == usable {
+		return
 	}
+	w.logCxt.WithField("linkUsable", usable).Info("Wireguard link usability changed, updating the routes of the peers")
+	w.linkUsable = usable
+	for name := range w.peers {
+		w.updatePeerStatus(name)
+	}
+}
 
+// applyThrowRoutes applies the routing tables and the routing rule while the wireguard link is not usable. The CIDRs of
+// all of the peers have throw routes, so the routing rule is harmless and is synced to remove the stale rules of a
+// previous run. The routes to the wireguard interface are programmed once the link is up.
+func (w *Wireguard) applyThrowRoutes(ctx context.Context, netlinkClient netlinkshim.Netlink) error {
+	if err := w.checkContext(ctx, "routes"); err != nil {
+		return err
+	}
+	w.logCxt.Debug("Apply routing table updates for wireguard while the link is not usable")
+	failures := &ApplyError{}
+	if err := w.applyRoutes(ctx); err != nil {
+		failures.add(SubsystemRoutes, "routes")
+		if !w.rulesIndependentOfRoutes(ctx) {
+			return w.applyError(ctx, "routes", failures)
+		}
+	}
+	if !w.inSyncRouteRule {
+		if err := w.checkContext(ctx, "rule"); err != nil {
+			return err
+		}
+		if err := w.ensureRouteRule(netlinkClient); err != nil {
+			// Error updating the ip rule - close the netlink client as a precaution.
+			w.closeNetlinkClient()
+			return w.applyError(ctx, "rule", failures.add(SubsystemLink, "rule"))
+		}
+		w.inSyncRouteRule = true
+	}
+	if failures.Failed(SubsystemRoutes) {
+		return failures
+	}
 	return nil
 }
 
 // shouldProgramWireguardPeer returns true if the peer configuration indicates the peer should be programmed in
-// wireguard. This requires:
-// -  A peer to have an IPv4 endpoint address
-// -  A peer to have a valid public key, and
-// -  Only a single peer to be claiming that public key
+// wireguard. This requires the peer to be programmable, see canProgramWireguardPeer, and to be within the maximum
+// number of peers.
 func (w *Wireguard) shouldProgramWireguardPeer(name string, node *peerData) bool {
-	if node.ipv4EndpointAddr == nil {
-		w.logCxt.Debugf("Peer %s should not be programmed, no endpoint address", name)
-		return false
-	} else if node.publicKey == zeroKey {
-		w.logCxt.Debugf("Peer %s should not be programmed, no valid public key", name)
+	if !w.canProgramWireguardPeer(name, node) {
 		return false
-	} else if w.publicKeyToNodeNames[node.publicKey].Len() != 1 {
-		w.logCxt.Debugf("Peer %s should not be programmed, multiple nodes are claiming the same key", name)
+	} else if containsName(w.overLimitNodes, name) {
+		w.debugPeer("Peer %s should not be programmed, maximum number of peers exceeded", name)
 		return false
 	}
-	w.logCxt.Debugf("Peer %s should be programmed", name)
+	w.debugPeer("Peer %s should be programmed", name)
 	return true
 }
 
+// canProgramWireguardPeer returns true if the peer configuration allows the peer to be programmed in wireguard, see
+// peerEligibility.
+func (w *Wireguard) canProgramWireguardPeer(name string, node *peerData) bool {
+	reason := w.peerEligibility(name, node)
+	if reason != peerEligible && w.logCxt.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		w.logCxt.Debugf("Peer %s should not be programmed, %s", name, reason)
+	}
+	return reason == peerEligible
+}
+
 // getWireguardClient returns a wireguard client for managing wireguard devices.
 func (w *Wireguard) getWireguardClient() (netlinkshim.Wireguard, error) {
 	if w.cachedWireguardClient == nil {
@@ -1408,7 +4279,10 @@ func (w *Wireguard) getWireguardClient() (netlinkshim.Wireguard, error) {
 				"Failed to connect to wireguard client")
 			return nil, err
 		}
-		w.cachedWireguardClient = client
+		// The device reads and writes are timed, see SetApplyTimingCallback, and the writes are traced, see
+		// Config.TraceBufferSize.
+		w.cachedWireguardClient = w.applyTiming.wireguard(w.trace.wireguard(client))
+		w.probeCapabilities()
 	}
 	if w.numConsistentWireguardClientFailures > 0 {
 		w.logCxt.WithField("numFailures", w.numConsistentWireguardClientFailures).Info(
@@ -1447,6 +4321,11 @@ func (w *Wireguard) getNetlinkClient() (netlinkshim.Netlink, error) {
 			return nil, err
 		}
 		w.cachedNetlinkClient = client
+
+		// The previous client is closed after a failure, which may have left the rules in an unknown state, so list and
+		// reconcile the rules with the new client.
+		w.inSyncRouteRule = false
+		w.inSyncUnderlay = false
 	}
 	if w.numConsistentNetlinkClientFailures > 0 {
 		w.logCxt.WithField("numFailures", w.numConsistentNetlinkClientFailures).Info(
@@ -1465,42 +4344,156 @@ func (w *Wireguard) closeNetlinkClient() {
 	w.cachedNetlinkClient = nil
 }
 
-// getNodeFromKey returns the node data associated with a key. If there is no node, or if multiple peers have claimed the
-// same key, this returns nil.
-func (w *Wireguard) getNodeFromKey(key wgtypes.Key) *peerData {
-	if item := getOnlyItemInSet(w.publicKeyToNodeNames[key]); item != nil {
-		return w.peers[item.(string)]
+// getNodeFromKey returns the node name and data associated with a key. If there is no node, or if multiple peers have
+// claimed the same key, this returns nil data. The nodes that are opted out of encryption are ignored.
+func (w *Wireguard) getNodeFromKey(key wgtypes.Key) (string, *peerData) {
+	nodenames := w.publicKeyToNodeNames[key]
+	if w.optedOutNodes.Len() > 0 && nodenames != nil {
+		nodenames = nodenames.Copy()
+		w.optedOutNodes.Iter(func(item interface{}) error {
+			nodenames.Discard(item)
+			return nil
+		})
 	}
-	return nil
+	if item := getOnlyItemInSet(nodenames); item != nil {
+		return item.(string), w.peers[item.(string)]
+	}
+	return "", nil
 }
 
-// applyWireguardConfig applies the wireguard configuration.
+// applyWireguardConfig applies the wireguard configuration. The peers are configured in batches of at most
+// maxPeersPerConfigureDevice, with the device configuration applied with the first batch.
 func (w *Wireguard) applyWireguardConfig(wireguardClient netlinkshim.Wireguard, c *wgtypes.Config) error {
 	w.logCxt.Debugf("Apply wireguard config update: %#v", c)
 	if c == nil {
 		// No config to apply.
 		return nil
 	}
-	return wireguardClient.ConfigureDevice(w.config.InterfaceName, *c)
+	config := *c
+	size := w.allowedIPsChunkSize()
+	chunks := chunkPeers(sortPeerConfigs(c.Peers), size)
+	for {
+		batch := chunks[:nextBatch(chunks, size)]
+		config.Peers = nil
+		for _, chunk := range batch {
+			config.Peers = append(config.Peers, chunk.PeerConfig)
+		}
+		if err := wireguardClient.ConfigureDevice(w.config.InterfaceName, config); netlinkshim.IsNoBufferSpace(err) {
+			w.limitAllowedIPsChunkSize(config.Peers)
+			return err
+		} else if err != nil {
+			return err
+		}
+		w.summary.deviceWrites++
+		for _, chunk := range batch {
+			if !chunk.continued {
+				w.summary.countPeers([]wgtypes.PeerConfig{chunk.PeerConfig})
+			}
+		}
+		w.trackConfiguredAllowedIPs(batch)
+		chunks = chunks[len(batch):]
+		if len(chunks) == 0 {
+			return nil
+		}
+		w.logCxt.Debugf("Apply next batch of wireguard peers, %d chunks remaining", len(chunks))
+		config = wgtypes.Config{}
+	}
 }
 
-// endpointUDPAddr converts the net IP and the configured listening port to a net UDP address.
-func (w *Wireguard) endpointUDPAddr(ip net.IP) *net.UDPAddr {
-	if ip == nil {
+// endpointUDPAddr returns the UDP address of a peer from its current endpoint IP and listening port. The locally
+// configured listening port is used if the peer has not reported its port. This is nil if the peer has no endpoint
+// address.
+func (w *Wireguard) endpointUDPAddr(name string, node *peerData) *net.UDPAddr {
+	addr := w.peerEndpointAddr(name, node)
+	if addr == nil {
 		return nil
 	}
 	return &net.UDPAddr{
-		IP:   ip,
-		Port: w.config.ListeningPort,
+		IP:   addr.AsNetIP(),
+		Port: w.peerListeningPort(node),
+	}
+}
+
+// peerListeningPort returns the listening port of a peer, or the locally configured port if the peer has not reported
+// its port.
+func (w *Wireguard) peerListeningPort(node *peerData) int {
+	if node.listeningPort != 0 {
+		return node.listeningPort
+	}
+	return w.config.ListeningPort
+}
+
+// peerKeepalive returns the persistent keepalive interval to configure on a new peer, or nil if keepalives are not
+// configured, see Config.PersistentKeepalive.
+func (w *Wireguard) peerKeepalive() *time.Duration {
+	if w.config.PersistentKeepalive == 0 {
+		return nil
 	}
+	keepalive := w.persistentKeepalive()
+	return &keepalive
 }
 
 // setAllInSync updates all of the internal "in-sync" markers.
 func (w *Wireguard) setAllInSync(inSync bool) {
 	w.inSyncWireguard = inSync
 	w.inSyncLink = inSync
-	w.inSyncInterfaceAddr = inSync
 	w.inSyncRouteRule = inSync
+	w.inSyncUnderlay = inSync
+	w.inSyncLocalRoutes = inSync
+}
+
+// sortCIDRs returns the CIDRs in the set sorted by address and then by prefix length.
+func sortCIDRs(s set.Set) []ip.CIDR {
+	cidrs := make([]ip.CIDR, 0, s.Len())
+	s.Iter(func(item interface{}) error {
+		cidrs = append(cidrs, item.(ip.CIDR))
+		return nil
+	})
+	sortCIDRSlice(cidrs)
+	return cidrs
+}
+
+// sortCIDRSlice sorts the CIDRs by address and then by prefix length.
+func sortCIDRSlice(cidrs []ip.CIDR) {
+	sort.Slice(cidrs, func(i, j int) bool { return cidrLess(cidrs[i], cidrs[j]) })
+}
+
+// cidrLess returns true if CIDR a sorts before CIDR b, by address and then by prefix length. The addresses of the same
+// IP version are compared without converting them to net.IPs, which would allocate on every comparison. An IPv4
+// address sorts as its IPv4-mapped IPv6 address.
+func cidrLess(a, b ip.CIDR) bool {
+	switch a := a.(type) {
+	case ip.V4CIDR:
+		if b, ok := b.(ip.V4CIDR); ok {
+			if x, y := a.Addr().(ip.V4Addr).AsUint32(), b.Addr().(ip.V4Addr).AsUint32(); x != y {
+				return x < y
+			}
+			return a.Prefix() < b.Prefix()
+		}
+	case ip.V6CIDR:
+		if b, ok := b.(ip.V6CIDR); ok {
+			x, y := a.Addr().(ip.V6Addr), b.Addr().(ip.V6Addr)
+			if c := bytes.Compare(x[:], y[:]); c != 0 {
+				return c < 0
+			}
+			return a.Prefix() < b.Prefix()
+		}
+	}
+	if c := bytes.Compare(a.Addr().AsNetIP().To16(), b.Addr().AsNetIP().To16()); c != 0 {
+		return c < 0
+	}
+	return a.Prefix() < b.Prefix()
+}
+
+// sortPeerConfigs returns a copy of the peer configurations sorted by public key, so that the device configurations are
+// deterministic. The order of the configurations of the same peer is retained, e.g. the removal of a peer before it is
+// added back.
+func sortPeerConfigs(peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	sorted := append([]wgtypes.PeerConfig(nil), peers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].PublicKey[:], sorted[j].PublicKey[:]) < 0
+	})
+	return sorted
 }
 
 // getOnlyItemInSet returns the only item in the set, or nil if the set is nil or the set does not contain only one
@@ -0,0 +1,341 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard_test
+
+import (
+	. "github.com/projectcalico/felix/wireguard"
+
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	mocknetlink "github.com/projectcalico/felix/netlink/mock"
+	mocktime "github.com/projectcalico/felix/time/mock"
+)
+
+const (
+	// The number of CIDRs routed to each peer by the scale tests.
+	scaleCIDRsPerPeer = 8
+
+	// The number of peers of the apply budget tests, which is large enough for an additional pass over all of the peers
+	// or routes to break the budgets.
+	budgetNumPeers = 1000
+
+	// The budgets of the netlink and wireguard calls, and of the allocations, of an Apply with budgetNumPeers. An Apply
+	// checks the link even if there are no changes. Queuing an update, or applying a single change, allocates
+	// independently of the number of peers, whereas a resync currently allocates a few times for each route. The
+	// budgets leave some headroom over the current counts, so that they only catch algorithmic regressions.
+	budgetNoChangeCalls      = 3
+	budgetNoChangeAllocs     = 100
+	budgetQueueUpdateAllocs  = 4
+	budgetSingleChangeCalls  = 6
+	budgetSingleChangeAllocs = 500
+	budgetResyncCalls        = 8
+	budgetResyncAllocs       = 6 * budgetNumPeers * scaleCIDRsPerPeer
+)
+
+// The number of peers of each benchmark.
+var benchmarkScales = []int{100, 1000, 5000}
+
+// scalePeer is a remote node of a scaleFixture.
+type scalePeer struct {
+	name     string
+	key      wgtypes.Key
+	endpoint ip.Addr
+	cidrs    []ip.CIDR
+}
+
+// scaleFixture is a wireguard module with mock dataplanes and a large number of peers, for the benchmarks and the
+// apply budget tests.
+type scaleFixture struct {
+	wgDataplane *mocknetlink.MockNetlinkDataplane
+	rtDataplane *mocknetlink.MockNetlinkDataplane
+	wg          *Wireguard
+	peers       []scalePeer
+}
+
+// newScaleFixture creates a wireguard module whose link is up, and the peers that are sent to it by sendPeers. The
+// CIDRs of the peers are consecutive /26 blocks in 10.128.0.0/9, and the endpoints are in 172.16.0.0/12.
+func newScaleFixture(numPeers int) *scaleFixture {
+	f := &scaleFixture{}
+	for i := 0; i < numPeers; i++ {
+		peer := scalePeer{
+			name:     fmt.Sprintf("scale-peer-%d", i),
+			key:      mustGeneratePrivateKey().PublicKey(),
+			endpoint: scaleAddr(172, 16, i+1),
+		}
+		for j := 0; j < scaleCIDRsPerPeer; j++ {
+			peer.cidrs = append(peer.cidrs, ip.CIDRFromAddrAndPrefix(scaleAddr(10, 128, (i*scaleCIDRsPerPeer+j)*64), 26))
+		}
+		f.peers = append(f.peers, peer)
+	}
+	f.restart()
+	return f
+}
+
+// restart replaces the wireguard module and the mock dataplanes with new ones, and brings up the link. The peers are
+// not sent to the new module.
+func (f *scaleFixture) restart() {
+	f.wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+	f.rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+	t := mocktime.NewMockTime()
+	// Setting an auto-increment greater than the route cleanup delay effectively
+	// disables the grace period.
+	t.SetAutoIncrement(11 * time.Second)
+
+	f.wg = NewWithShims(
+		hostname,
+		&Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		},
+		f.rtDataplane.NewMockNetlink,
+		f.wgDataplane.NewMockNetlink,
+		f.wgDataplane.NewMockWireguard,
+		nil,
+		10*time.Second,
+		t,
+		FelixRouteProtocol,
+		func(StatusUpdate) error { return nil },
+		func() {},
+	)
+
+	f.apply()
+	f.wgDataplane.SetIface(ifaceName, true, true)
+	f.wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	f.apply()
+}
+
+// scaleAddr returns the address at the offset from a.b.0.0.
+func scaleAddr(a, b, offset int) ip.Addr {
+	return ip.FromString(fmt.Sprintf("%d.%d.%d.%d", a, b+offset>>16, offset>>8&0xff, offset&0xff))
+}
+
+// sendPeers sends the updates of all of the peers, as in the initial snapshot from the datastore.
+func (f *scaleFixture) sendPeers() {
+	for _, peer := range f.peers {
+		f.wg.EndpointUpdate(peer.name, peer.endpoint)
+		f.wg.EndpointWireguardUpdate(peer.name, peer.key, nil)
+		for _, cidr := range peer.cidrs {
+			f.wg.EndpointAllowedCIDRAdd(peer.name, cidr)
+		}
+	}
+}
+
+// toggleCIDR removes the first CIDR of a peer, or adds it back if it was removed by the previous call.
+func (f *scaleFixture) toggleCIDR(peer int, removed bool) {
+	p := f.peers[peer%len(f.peers)]
+	if removed {
+		f.wg.EndpointAllowedCIDRAdd(p.name, p.cidrs[0])
+	} else {
+		f.wg.EndpointAllowedCIDRRemove(p.cidrs[0])
+	}
+}
+
+// apply applies the updates, panicking if the Apply fails, since the mock dataplanes are not failing.
+func (f *scaleFixture) apply() {
+	if err := f.wg.Apply(); err != nil {
+		panic(err)
+	}
+}
+
+// resetCounts resets the operation counts of the mock dataplanes.
+func (f *scaleFixture) resetCounts() {
+	f.wgDataplane.ResetDeltas()
+	f.rtDataplane.ResetDeltas()
+}
+
+// numNetlinkCalls returns the number of netlink and wireguard calls made since the counts were reset.
+func (f *scaleFixture) numNetlinkCalls() int {
+	return len(f.wgDataplane.Calls) + len(f.rtDataplane.Calls)
+}
+
+// benchmarkAtScale runs the benchmark for each of the benchmarkScales. setup is called for each scale with the timer
+// stopped, and returns the operation to benchmark.
+func benchmarkAtScale(b *testing.B, setup func(f *scaleFixture) func(i int)) {
+	// The mock dataplanes make assertions, and log each operation.
+	RegisterTestingT(b)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.WarnLevel)
+
+	for _, numPeers := range benchmarkScales {
+		b.Run(fmt.Sprintf("peers=%d", numPeers), func(b *testing.B) {
+			b.StopTimer()
+			f := newScaleFixture(numPeers)
+			op := setup(f)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				f.resetCounts()
+				b.StartTimer()
+				op(i)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(f.numNetlinkCalls()), "netlink-calls/op")
+			b.ReportMetric(float64(f.wgDataplane.NumWireguardDeviceConfigures), "configures/op")
+		})
+	}
+}
+
+// BenchmarkApplyInitialSync benchmarks the first Apply of the peers once the link is up. Each iteration restarts with a
+// new wireguard module and dataplanes.
+func BenchmarkApplyInitialSync(b *testing.B) {
+	benchmarkAtScale(b, func(f *scaleFixture) func(i int) {
+		return func(i int) {
+			b.StopTimer()
+			if i > 0 {
+				f.restart()
+			}
+			f.sendPeers()
+			b.StartTimer()
+			f.apply()
+		}
+	})
+}
+
+// BenchmarkApplySingleCIDRChange benchmarks an Apply that removes or adds back a single CIDR of a peer.
+func BenchmarkApplySingleCIDRChange(b *testing.B) {
+	benchmarkAtScale(b, func(f *scaleFixture) func(i int) {
+		f.sendPeers()
+		f.apply()
+		return func(i int) {
+			f.toggleCIDR(i/2, i%2 == 1)
+			f.apply()
+		}
+	})
+}
+
+// BenchmarkApplyResyncNoChanges benchmarks a resync of the dataplane when it is already in sync.
+func BenchmarkApplyResyncNoChanges(b *testing.B) {
+	benchmarkAtScale(b, func(f *scaleFixture) func(i int) {
+		f.sendPeers()
+		f.apply()
+		return func(i int) {
+			f.wg.QueueResync()
+			f.apply()
+		}
+	})
+}
+
+var _ = Describe("Wireguard apply budget", func() {
+	var f *scaleFixture
+
+	BeforeEach(func() {
+		f = newScaleFixture(budgetNumPeers)
+		f.sendPeers()
+		f.apply()
+		Expect(f.wg.LastApplyStats().PeersAdded).To(Equal(budgetNumPeers))
+		Expect(f.wg.LastApplyStats().RoutesAdded).To(Equal(budgetNumPeers * scaleCIDRsPerPeer))
+		f.resetCounts()
+	})
+
+	It("should make no calls other than checking the link if there are no changes", func() {
+		allocs := testing.AllocsPerRun(10, f.apply)
+		Expect(allocs).To(BeNumerically("<=", budgetNoChangeAllocs))
+
+		f.resetCounts()
+		f.apply()
+		Expect(f.wg.LastApplyStats()).To(Equal(ApplyStats{}))
+		Expect(f.wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(f.wgDataplane.NumWireguardDeviceReads).To(BeZero())
+		Expect(f.numNetlinkCalls()).To(BeNumerically("<=", budgetNoChangeCalls))
+	})
+
+	It("should apply a single CIDR change within the budget", func() {
+		removed := false
+		allocs := testing.AllocsPerRun(10, func() {
+			f.toggleCIDR(0, removed)
+			removed = !removed
+			f.apply()
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetSingleChangeAllocs))
+
+		f.resetCounts()
+		f.toggleCIDR(1, false)
+		f.apply()
+		Expect(f.wg.LastApplyStats()).To(Equal(ApplyStats{PeersUpdated: 1, RoutesRemoved: 1, DeviceWrites: 1}))
+		Expect(f.wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(f.wgDataplane.NumWireguardDeviceReads).To(BeZero())
+		Expect(f.numNetlinkCalls()).To(BeNumerically("<=", budgetSingleChangeCalls))
+	})
+
+	It("should queue the addition and removal of a CIDR within the budget", func() {
+		peer := 0
+		allocs := testing.AllocsPerRun(10, func() {
+			f.toggleCIDR(peer, false)
+			peer++
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetQueueUpdateAllocs))
+		f.apply()
+
+		peer = 0
+		allocs = testing.AllocsPerRun(10, func() {
+			f.toggleCIDR(peer, true)
+			peer++
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetQueueUpdateAllocs))
+	})
+
+	It("should apply the removal and the addition of a CIDR within the budget", func() {
+		// Each run removes, and then adds back, a CIDR of another peer, so that every run applies a change.
+		peer := 0
+		allocs := testing.AllocsPerRun(10, func() {
+			f.toggleCIDR(peer, false)
+			peer++
+			f.apply()
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetSingleChangeAllocs))
+		Expect(f.wg.LastApplyStats().RoutesRemoved).To(Equal(1))
+
+		peer = 0
+		allocs = testing.AllocsPerRun(10, func() {
+			f.toggleCIDR(peer, true)
+			peer++
+			f.apply()
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetSingleChangeAllocs))
+		Expect(f.wg.LastApplyStats().RoutesAdded).To(Equal(1))
+	})
+
+	It("should resync with no changes within the budget", func() {
+		allocs := testing.AllocsPerRun(3, func() {
+			f.wg.QueueResync()
+			f.apply()
+		})
+		Expect(allocs).To(BeNumerically("<=", budgetResyncAllocs))
+
+		f.resetCounts()
+		f.wg.QueueResync()
+		f.apply()
+		Expect(f.wg.LastApplyStats()).To(Equal(ApplyStats{}))
+		Expect(f.wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(f.wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+		Expect(f.numNetlinkCalls()).To(BeNumerically("<=", budgetResyncCalls))
+	})
+})
@@ -0,0 +1,580 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard_test
+
+import (
+	. "github.com/projectcalico/felix/wireguard"
+
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	mocknetlink "github.com/projectcalico/felix/netlink/mock"
+	mocktime "github.com/projectcalico/felix/time/mock"
+)
+
+const (
+	numPropertySequences = 2000
+	maxPropertyOps       = 40
+)
+
+var (
+	propertyNodes = []string{hostname, "node-a", "node-b", "node-c", "node-d"}
+	propertyCIDRs = []ip.CIDR{
+		ip.MustParseCIDROrIP("10.0.0.1/32"),
+		ip.MustParseCIDROrIP("10.0.0.2/32"),
+		ip.MustParseCIDROrIP("10.0.0.3/32"),
+		ip.MustParseCIDROrIP("10.1.1.0/24"),
+		ip.MustParseCIDROrIP("10.1.2.0/24"),
+		ip.MustParseCIDROrIP("10.1.3.0/26"),
+	}
+	propertyInterfaceAddrs = []ip.Addr{
+		nil,
+		ip.FromString("10.0.0.1"),
+		ip.FromString("10.0.0.2"),
+		ip.FromString("10.0.0.4"),
+	}
+	propertyEndpointAddrs = []ip.Addr{
+		ip.FromString("1.2.3.4"),
+		ip.FromString("1.2.3.5"),
+		ip.FromString("1.2.3.6"),
+	}
+	propertyClasses = []RouteClass{RouteClassWorkload, RouteClassHost}
+)
+
+// modelNode is the reference model of the configuration of a remote node.
+type modelNode struct {
+	endpoint      ip.Addr
+	publicKey     wgtypes.Key
+	interfaceAddr ip.Addr
+}
+
+// model is a reference model of the wireguard configuration. It calculates the expected peers and routes directly from
+// the full set of updates, without any of the delta processing.
+type model struct {
+	nodes        map[string]*modelNode
+	allowedCIDRs map[ip.CIDR]string
+	cidrClasses  map[ip.CIDR]RouteClass
+	drained      map[string]bool
+	ready        map[string]bool
+
+	// Whether peers must be ready to be programmed, and the maximum number of peers and allowed IPs per peer.
+	requireReady  bool
+	maxPeers      int
+	maxAllowedIPs int
+}
+
+func newModel(requireReady bool, maxPeers, maxAllowedIPs int) *model {
+	return &model{
+		requireReady:  requireReady,
+		maxPeers:      maxPeers,
+		maxAllowedIPs: maxAllowedIPs,
+		nodes:         map[string]*modelNode{},
+		allowedCIDRs:  map[ip.CIDR]string{},
+		cidrClasses:   map[ip.CIDR]RouteClass{},
+		drained:       map[string]bool{},
+		ready:         map[string]bool{},
+	}
+}
+
+func (m *model) node(name string) *modelNode {
+	if m.nodes[name] == nil {
+		m.nodes[name] = &modelNode{}
+	}
+	return m.nodes[name]
+}
+
+func (m *model) endpointUpdate(name string, addr ip.Addr) {
+	m.node(name).endpoint = addr
+}
+
+func (m *model) endpointRemove(name string) {
+	delete(m.nodes, name)
+	delete(m.ready, name)
+	for cidr, owner := range m.allowedCIDRs {
+		if owner == name {
+			delete(m.allowedCIDRs, cidr)
+		}
+	}
+}
+
+func (m *model) allowedCIDRAdd(name string, cidr ip.CIDR, class RouteClass) {
+	m.node(name)
+	m.allowedCIDRs[cidr] = name
+	m.cidrClasses[cidr] = class
+}
+
+func (m *model) allowedCIDRRemove(cidr ip.CIDR) {
+	delete(m.allowedCIDRs, cidr)
+}
+
+func (m *model) wireguardUpdate(name string, key wgtypes.Key, interfaceAddr ip.Addr) {
+	if key == zeroKey {
+		m.wireguardRemove(name)
+		return
+	}
+	if interfaceAddr != nil {
+		// An interface address claimed by another node is removed from that node.
+		for _, n := range m.nodes {
+			if n.interfaceAddr == interfaceAddr {
+				n.interfaceAddr = nil
+			}
+		}
+	}
+	n := m.node(name)
+	n.publicKey = key
+	n.interfaceAddr = interfaceAddr
+}
+
+func (m *model) wireguardRemove(name string) {
+	if n := m.nodes[name]; n != nil {
+		n.publicKey = zeroKey
+		n.interfaceAddr = nil
+	}
+	delete(m.ready, name)
+}
+
+func (m *model) wireguardReady(name string, ready bool) {
+	m.ready[name] = ready
+}
+
+func (m *model) drain(name string, drain bool) {
+	m.drained[name] = drain
+}
+
+// cidrs returns the allowed CIDRs of each node with the route class of each CIDR. The interface address of a node is
+// an allowed CIDR of the node unless it is explicitly added as an allowed CIDR.
+func (m *model) cidrs() (map[string][]ip.CIDR, map[ip.CIDR]RouteClass) {
+	nodeCIDRs := map[string][]ip.CIDR{}
+	classes := map[ip.CIDR]RouteClass{}
+	for cidr, name := range m.allowedCIDRs {
+		nodeCIDRs[name] = append(nodeCIDRs[name], cidr)
+		classes[cidr] = m.cidrClasses[cidr]
+	}
+	for name, n := range m.nodes {
+		if n.interfaceAddr == nil {
+			continue
+		}
+		cidr := n.interfaceAddr.AsCIDR()
+		if _, ok := m.allowedCIDRs[cidr]; !ok {
+			nodeCIDRs[name] = append(nodeCIDRs[name], cidr)
+			classes[cidr] = RouteClassHost
+		}
+	}
+	return nodeCIDRs, classes
+}
+
+// capable returns true if the node should be programmed as a wireguard peer, i.e. it is eligible and is one of the
+// first eligible nodes by name if there are more than the maximum number of peers.
+func (m *model) capable(name string) bool {
+	if !m.eligible(name) {
+		return false
+	} else if m.maxPeers == 0 {
+		return true
+	}
+	var names []string
+	for other := range m.nodes {
+		if m.eligible(other) {
+			names = append(names, other)
+		}
+	}
+	sort.Strings(names)
+	return sort.SearchStrings(names, name) < m.maxPeers
+}
+
+// eligible returns true if the node configuration allows it to be programmed as a wireguard peer.
+func (m *model) eligible(name string) bool {
+	n := m.nodes[name]
+	if n == nil || n.endpoint == nil || n.publicKey == zeroKey || m.drained[name] {
+		return false
+	} else if m.requireReady && !m.ready[name] {
+		return false
+	}
+	for other, o := range m.nodes {
+		if other != name && o.publicKey == n.publicKey {
+			return false
+		}
+	}
+	return true
+}
+
+// wireguardCIDRs returns the CIDRs of a node that are programmed in wireguard, i.e. the first CIDRs by address and
+// prefix length if there are more than the maximum number of allowed IPs.
+func (m *model) wireguardCIDRs(cidrs []ip.CIDR) map[ip.CIDR]bool {
+	sorted := append([]ip.CIDR(nil), cidrs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Addr().AsNetIP().To4(), sorted[j].Addr().AsNetIP().To4()
+		if !a.Equal(b) {
+			return string(a) < string(b)
+		}
+		return sorted[i].Prefix() < sorted[j].Prefix()
+	})
+	if m.maxAllowedIPs > 0 && len(sorted) > m.maxAllowedIPs {
+		sorted = sorted[:m.maxAllowedIPs]
+	}
+	selected := map[ip.CIDR]bool{}
+	for _, cidr := range sorted {
+		selected[cidr] = true
+	}
+	return selected
+}
+
+// expectedRoutes returns the expected route keys and route types.
+func (m *model) expectedRoutes(linkIndex int) map[string]int {
+	routes := map[string]int{}
+	nodeCIDRs, classes := m.cidrs()
+	for name, cidrs := range nodeCIDRs {
+		selected := m.wireguardCIDRs(cidrs)
+		for _, cidr := range cidrs {
+			table := tableIndex
+			if classes[cidr] == RouteClassHost {
+				table = tableIndexHost
+			}
+			if m.capable(name) && selected[cidr] {
+				routes[fmt.Sprintf("%d-%d-%s", table, linkIndex, cidr)] = syscall.RTN_UNICAST
+			} else {
+				routes[fmt.Sprintf("%d-%d-%s", table, 0, cidr)] = syscall.RTN_THROW
+			}
+		}
+	}
+	return routes
+}
+
+// expectedPeers returns the expected wireguard peers, with each peer formatted as the endpoint and the sorted allowed
+// IPs.
+func (m *model) expectedPeers() map[wgtypes.Key]string {
+	peers := map[wgtypes.Key]string{}
+	nodeCIDRs, _ := m.cidrs()
+	for name, n := range m.nodes {
+		if !m.capable(name) {
+			continue
+		}
+		var allowedIPs []string
+		for cidr := range m.wireguardCIDRs(nodeCIDRs[name]) {
+			allowedIPs = append(allowedIPs, cidr.String())
+		}
+		peers[n.publicKey] = formatPeer(fmt.Sprintf("%s:%d", n.endpoint, listeningPort), allowedIPs)
+	}
+	return peers
+}
+
+func formatPeer(endpoint string, allowedIPs []string) string {
+	sort.Strings(allowedIPs)
+	return endpoint + " " + strings.Join(allowedIPs, ",")
+}
+
+var _ = Describe("Wireguard property tests", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var m *model
+	var link *mocknetlink.MockLink
+	var keys []wgtypes.Key
+	var logLevel log.Level
+	var seed int64
+	var ops []string
+	var failed bool
+
+	BeforeEach(func() {
+		// The sequences generate a lot of logs, so only log errors.
+		logLevel = log.GetLevel()
+		log.SetLevel(log.ErrorLevel)
+
+		// The mock dataplane makes assertions from the wireguard goroutines, which are recovered without stopping the
+		// spec. Track the failures so that the sequence that caused them can be stopped and reported.
+		failed = false
+		RegisterFailHandler(func(message string, callerSkip ...int) {
+			failed = true
+			skip := 1
+			if len(callerSkip) > 0 {
+				skip += callerSkip[0]
+			}
+			Fail(message, skip)
+		})
+
+		for i := 0; i < 3; i++ {
+			keys = append(keys, mustGeneratePrivateKey().PublicKey())
+		}
+	})
+
+	AfterEach(func() {
+		RegisterFailHandler(Fail)
+		log.SetLevel(logLevel)
+		if CurrentGinkgoTestDescription().Failed {
+			// Output the sequence that failed so that it can be reproduced.
+			fmt.Fprintf(GinkgoWriter, "Failed with seed %d after:\n%s\n", seed, strings.Join(ops, "\n"))
+		}
+	})
+
+	setup := func(requireReady, limited bool) {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		// There is a routing table, and therefore a netlink connection, per table index.
+		rtDataplane.MaxOpenNetlinks = 2
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		config := &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			RoutingTableIndexByClass: map[RouteClass]int{
+				RouteClassHost: tableIndexHost,
+			},
+			InterfaceName:    ifaceName,
+			MTU:              mtu,
+			RequirePeerReady: requireReady,
+		}
+		if limited {
+			config.MaxPeers = 2
+			config.MaxAllowedIPsPerPeer = 2
+		}
+		m = newModel(requireReady, config.MaxPeers, config.MaxAllowedIPsPerPeer)
+
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		Expect(wg.Apply()).To(Succeed())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+	}
+
+	// randomOp applies a random update to both the wireguard module and the model, returning a description of the
+	// update.
+	randomOp := func(r *rand.Rand) string {
+		name := propertyNodes[r.Intn(len(propertyNodes))]
+		local := name == hostname
+		switch r.Intn(9) {
+		case 0:
+			addr := propertyEndpointAddrs[r.Intn(len(propertyEndpointAddrs))]
+			wg.EndpointUpdate(name, addr)
+			if !local {
+				m.endpointUpdate(name, addr)
+			}
+			return fmt.Sprintf("EndpointUpdate(%s, %s)", name, addr)
+		case 1:
+			wg.EndpointRemove(name)
+			if !local {
+				m.endpointRemove(name)
+			}
+			return fmt.Sprintf("EndpointRemove(%s)", name)
+		case 2, 3:
+			cidr := propertyCIDRs[r.Intn(len(propertyCIDRs))]
+			class := propertyClasses[r.Intn(len(propertyClasses))]
+			wg.EndpointAllowedCIDRAdd(name, cidr, class)
+			if !local {
+				m.allowedCIDRAdd(name, cidr, class)
+			}
+			return fmt.Sprintf("EndpointAllowedCIDRAdd(%s, %s, %s)", name, cidr, class)
+		case 4:
+			cidr := propertyCIDRs[r.Intn(len(propertyCIDRs))]
+			if r.Intn(2) == 0 {
+				wg.EndpointAllowedCIDRRemoveForNode(name, cidr)
+				if m.allowedCIDRs[cidr] == name {
+					m.allowedCIDRRemove(cidr)
+				}
+				return fmt.Sprintf("EndpointAllowedCIDRRemoveForNode(%s, %s)", name, cidr)
+			}
+			wg.EndpointAllowedCIDRRemove(cidr)
+			m.allowedCIDRRemove(cidr)
+			return fmt.Sprintf("EndpointAllowedCIDRRemove(%s)", cidr)
+		case 5:
+			// Use a small set of keys so that keys are shared between nodes, including the zero key.
+			key := zeroKey
+			if i := r.Intn(len(keys) + 1); i < len(keys) {
+				key = keys[i]
+			}
+			addr := propertyInterfaceAddrs[r.Intn(len(propertyInterfaceAddrs))]
+			wg.EndpointWireguardUpdate(name, key, addr)
+			if !local {
+				m.wireguardUpdate(name, key, addr)
+			}
+			return fmt.Sprintf("EndpointWireguardUpdate(%s, %s, %v)", name, key, addr)
+		case 6:
+			drain := r.Intn(2) == 0
+			if drain {
+				wg.EndpointDrain(name)
+			} else {
+				wg.EndpointUndrain(name)
+			}
+			if !local {
+				m.drain(name, drain)
+			}
+			return fmt.Sprintf("EndpointDrain(%s, %v)", name, drain)
+		case 7:
+			ready := r.Intn(2) == 0
+			wg.EndpointWireguardReady(name, ready)
+			if !local {
+				m.wireguardReady(name, ready)
+			}
+			return fmt.Sprintf("EndpointWireguardReady(%s, %v)", name, ready)
+		default:
+			wg.EndpointWireguardRemove(name)
+			if !local {
+				m.wireguardRemove(name)
+			}
+			return fmt.Sprintf("EndpointWireguardRemove(%s)", name)
+		}
+	}
+
+	// randomFailure injects a one-shot failure into the dataplane.
+	randomFailure := func(r *rand.Rand) string {
+		switch r.Intn(5) {
+		case 0:
+			rtDataplane.FailuresToSimulate |= mocknetlink.FailNextRouteAdd
+		case 1:
+			rtDataplane.FailuresToSimulate |= mocknetlink.FailNextRouteDel
+		case 2:
+			rtDataplane.FailuresToSimulate |= mocknetlink.FailNextRouteList
+		case 3:
+			wgDataplane.FailuresToSimulate |= mocknetlink.FailNextWireguardConfigureDevice
+		default:
+			wgDataplane.FailuresToSimulate |= mocknetlink.FailNextWireguardDeviceByName
+		}
+		return fmt.Sprintf("failures(rt=%v, wg=%v)", rtDataplane.FailuresToSimulate, wgDataplane.FailuresToSimulate)
+	}
+
+	// checkConverged checks the programmed peers and routes match the model.
+	checkConverged := func() {
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		routes := map[string]int{}
+		for key, route := range rtDataplane.RouteKeyToRoute {
+			routes[key] = route.Type
+		}
+		Expect(routes).To(Equal(m.expectedRoutes(link.LinkAttrs.Index)))
+
+		peers := map[wgtypes.Key]string{}
+		for key, peer := range link.WireguardPeers {
+			var allowedIPs []string
+			for _, ipnet := range peer.AllowedIPs {
+				allowedIPs = append(allowedIPs, ipnet.String())
+			}
+			peers[key] = formatPeer(fmt.Sprint(peer.Endpoint), allowedIPs)
+		}
+		Expect(peers).To(Equal(m.expectedPeers()))
+
+		// The capacity stats, which are maintained as the updates are applied, match the programmed configuration.
+		numAllowedIPs, numThrowRoutes := 0, 0
+		for _, peer := range link.WireguardPeers {
+			numAllowedIPs += len(peer.AllowedIPs)
+		}
+		for _, routeType := range routes {
+			if routeType == syscall.RTN_THROW {
+				numThrowRoutes++
+			}
+		}
+		stats := wg.CapacityStats()
+		Expect(stats.ProgrammedPeers).To(Equal(len(link.WireguardPeers)))
+		Expect(stats.AllowedIPs).To(Equal(numAllowedIPs))
+		Expect(stats.UnicastRoutes).To(Equal(len(routes) - numThrowRoutes))
+		Expect(stats.ThrowRoutes).To(Equal(numThrowRoutes))
+		Expect(stats.PendingRoutes).To(BeZero())
+	}
+
+	// applyUntilSuccess applies until there are no errors. Failures are one-shot, so this should not take more than a
+	// few attempts.
+	applyUntilSuccess := func() {
+		var err error
+		for i := 0; i < 5; i++ {
+			if err = wg.Apply(); err == nil {
+				break
+			}
+		}
+		Expect(failed).To(BeFalse())
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should maintain the invariants and converge for random sequences of updates", func() {
+		seed = time.Now().UnixNano()
+		r := rand.New(rand.NewSource(seed))
+
+		for i := 0; i < numPropertySequences; i++ {
+			// Alternate the sequences between requiring and not requiring the peers to be ready, and with and without
+			// limits on the number of peers and allowed IPs.
+			setup(i%2 == 1, i%4 >= 2)
+			ops = nil
+			for j := r.Intn(maxPropertyOps); j >= 0; j-- {
+				switch n := r.Intn(10); {
+				case n < 6:
+					ops = append(ops, randomOp(r))
+				case n < 8:
+					err := wg.Apply()
+					ops = append(ops, fmt.Sprintf("Apply() = %v", err))
+					if failed {
+						// The mock dataplane failed an assertion in the Apply.
+						return
+					}
+					Expect(wg.CheckInvariants()).To(Succeed())
+				case n < 9:
+					wg.QueueResync()
+					ops = append(ops, "QueueResync()")
+				default:
+					ops = append(ops, randomFailure(r))
+				}
+			}
+
+			// Clear any outstanding failures, and check the delta updates converge to the expected configuration.
+			ops = append(ops, "Converge")
+			rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNone
+			applyUntilSuccess()
+			checkConverged()
+
+			// A resync should not find anything else to fix.
+			wgDataplane.ResetDeltas()
+			rtDataplane.ResetDeltas()
+			ops = append(ops, "Resync")
+			wg.QueueResync()
+			applyUntilSuccess()
+			checkConverged()
+			Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		}
+	})
+})
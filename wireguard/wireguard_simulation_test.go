@@ -0,0 +1,634 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard_test
+
+import (
+	. "github.com/projectcalico/felix/wireguard"
+
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ip"
+	mocknetlink "github.com/projectcalico/felix/netlink/mock"
+	mocktime "github.com/projectcalico/felix/time/mock"
+)
+
+const (
+	numSimulationNodes = 4
+	numSimulationSeeds = 20
+
+	// Each step of the simulation advances the simulated time by simulationTick and applies every node.
+	simulationTick = 100 * time.Millisecond
+
+	// The clocks of the nodes auto-increment on every read, so they advance far faster than the simulated time. The key
+	// transitions are long enough that they are only ended by a handshake with the new key.
+	simulationKeyTransitionTimeout = 10000 * time.Hour
+)
+
+// simNode is a node in the simulation, with its own wireguard module and mock dataplanes.
+type simNode struct {
+	name        string
+	endpoint    ip.Addr
+	cidr        ip.CIDR
+	wgDataplane *mocknetlink.MockNetlinkDataplane
+	rtDataplane *mocknetlink.MockNetlinkDataplane
+	wg          *Wireguard
+	keyStates   []KeyState
+
+	// disabled starts the node with wireguard disabled, in which case its Applies may fail while the wireguard
+	// configuration is removed.
+	disabled bool
+}
+
+// simPreviousKey is the previous key published by a node in a key transition, and the deadline of the transition.
+type simPreviousKey struct {
+	key      wgtypes.Key
+	deadline time.Time
+}
+
+// simMessage is a datastore update in-flight to a node.
+type simMessage struct {
+	deliverAt time.Duration
+	node      *simNode
+	wg        *Wireguard
+	update    func(wg *Wireguard)
+}
+
+// simulation is a set of nodes connected through a simulated datastore. The public key published by a node through the
+// status callback is stored in the datastore, along with any previous key, and delivered to each node as an
+// EndpointWireguardUpdate after a random delay of up to maxDelay. Each delivery is dropped with probability
+// dropProbability. A node that misses an update receives it on the next datastore resync. A pair of nodes whose devices
+// have each other's key complete a handshake on each step.
+type simulation struct {
+	r               *rand.Rand
+	now             time.Duration
+	maxDelay        time.Duration
+	dropProbability float64
+	nodes           []*simNode
+	keys            map[string]wgtypes.Key
+	previousKeys    map[string]simPreviousKey
+	inFlight        []simMessage
+}
+
+func newSimulation(seed int64, maxDelay time.Duration, dropProbability float64) *simulation {
+	sim := &simulation{
+		r:               rand.New(rand.NewSource(seed)),
+		maxDelay:        maxDelay,
+		dropProbability: dropProbability,
+		keys:            map[string]wgtypes.Key{},
+		previousKeys:    map[string]simPreviousKey{},
+	}
+	for i := 0; i < numSimulationNodes; i++ {
+		sim.nodes = append(sim.nodes, &simNode{
+			name:        fmt.Sprintf("node-%d", i),
+			endpoint:    ip.FromString(fmt.Sprintf("10.0.0.%d", i+1)),
+			cidr:        ip.MustParseCIDROrIP(fmt.Sprintf("192.168.%d.0/24", i)),
+			wgDataplane: mocknetlink.NewMockNetlinkDataplane(),
+			rtDataplane: mocknetlink.NewMockNetlinkDataplane(),
+		})
+	}
+	return sim
+}
+
+// start starts the wireguard module of a node, replacing any previous instance as if felix had restarted. The device
+// and routes programmed by a previous instance are retained. The node is sent a snapshot of the datastore, and the
+// other nodes are sent its route announcement.
+func (sim *simulation) start(node *simNode) {
+	t := mocktime.NewMockTime()
+	// Setting an auto-increment greater than the route cleanup delay effectively
+	// disables the grace period for the simulation.
+	t.SetAutoIncrement(11 * time.Second)
+
+	// Drop the updates in-flight to a previous instance, the new instance is sent a snapshot instead.
+	var inFlight []simMessage
+	for _, msg := range sim.inFlight {
+		if msg.node != node {
+			inFlight = append(inFlight, msg)
+		}
+	}
+	sim.inFlight = inFlight
+
+	// The netlink and wireguard handles of a previous instance are closed when its process exits.
+	for _, dp := range []*mocknetlink.MockNetlinkDataplane{node.wgDataplane, node.rtDataplane} {
+		dp.NumOpenNetlinks = 0
+		dp.NetlinkOpen = false
+		dp.WireguardOpen = false
+	}
+
+	node.wg = NewWithShims(
+		node.name,
+		&Config{
+			Enabled:              !node.disabled,
+			ListeningPort:        listeningPort,
+			FirewallMark:         firewallMark,
+			RoutingRulePriority:  rulePriority,
+			RoutingTableIndex:    tableIndex,
+			InterfaceName:        ifaceName,
+			MTU:                  mtu,
+			KeyTransitionTimeout: simulationKeyTransitionTimeout,
+		},
+		node.rtDataplane.NewMockNetlink,
+		node.wgDataplane.NewMockNetlink,
+		node.wgDataplane.NewMockWireguard,
+		nil,
+		10*time.Second,
+		t,
+		FelixRouteProtocol,
+		func(update StatusUpdate) error {
+			node.keyStates = append(node.keyStates, update.KeyState)
+			sim.publish(node, update.PublicKey, simPreviousKey{
+				key:      update.PreviousPublicKey,
+				deadline: update.PreviousKeyDeadline,
+			})
+			return nil
+		},
+		nil,
+	)
+	if node.disabled {
+		_ = node.wg.Apply()
+		sim.sendSnapshot(node)
+		return
+	}
+	Expect(node.wg.Apply()).To(Succeed())
+	node.wgDataplane.SetIface(ifaceName, true, true)
+	node.rtDataplane.NameToLink[ifaceName] = node.wgDataplane.NameToLink[ifaceName]
+	node.wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+
+	sim.sendSnapshot(node)
+	sim.broadcast(node, func(wg *Wireguard) {
+		wg.EndpointUpdate(node.name, node.endpoint)
+		wg.EndpointAllowedCIDRAdd(node.name, node.cidr)
+	})
+}
+
+// publish stores the public key and the previous key of a node in the datastore and sends them to every node,
+// including the node itself.
+func (sim *simulation) publish(node *simNode, publicKey wgtypes.Key, previous simPreviousKey) {
+	sim.keys[node.name] = publicKey
+	sim.previousKeys[node.name] = previous
+	sim.broadcast(nil, func(wg *Wireguard) {
+		wg.EndpointWireguardUpdate(node.name, publicKey, nil)
+		wg.EndpointWireguardPreviousKey(node.name, previous.key, previous.deadline)
+	})
+}
+
+// broadcast sends an update to every running node other than the excluded node, after a random delay and subject to
+// the drop probability.
+func (sim *simulation) broadcast(exclude *simNode, update func(wg *Wireguard)) {
+	for _, node := range sim.nodes {
+		if node == exclude || node.wg == nil || sim.r.Float64() < sim.dropProbability {
+			continue
+		}
+		sim.inFlight = append(sim.inFlight, simMessage{
+			deliverAt: sim.now + time.Duration(sim.r.Int63n(int64(sim.maxDelay)+1)),
+			node:      node,
+			wg:        node.wg,
+			update:    update,
+		})
+	}
+}
+
+// sendSnapshot sends the current datastore contents to a node, including its own endpoint, as on a datastore resync.
+// The snapshot is not delayed or dropped.
+func (sim *simulation) sendSnapshot(node *simNode) {
+	for _, other := range sim.nodes {
+		if other.wg == nil {
+			continue
+		}
+		node.wg.EndpointUpdate(other.name, other.endpoint)
+		if other != node {
+			node.wg.EndpointAllowedCIDRAdd(other.name, other.cidr)
+		}
+		if key, ok := sim.keys[other.name]; ok {
+			previous := sim.previousKeys[other.name]
+			node.wg.EndpointWireguardUpdate(other.name, key, nil)
+			node.wg.EndpointWireguardPreviousKey(other.name, previous.key, previous.deadline)
+		}
+	}
+}
+
+// step advances the simulated time, delivers the updates that are due, and applies every running node.
+func (sim *simulation) step() {
+	sim.now += simulationTick
+	var inFlight []simMessage
+	for _, msg := range sim.inFlight {
+		if msg.deliverAt <= sim.now {
+			msg.update(msg.wg)
+		} else {
+			inFlight = append(inFlight, msg)
+		}
+	}
+	sim.inFlight = inFlight
+	for _, node := range sim.nodes {
+		if node.wg == nil {
+			continue
+		}
+		if err := node.wg.Apply(); !node.disabled {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+	sim.handshake()
+}
+
+// handshake completes a handshake between each pair of nodes whose devices have a peer with the key of the other.
+func (sim *simulation) handshake() {
+	for _, node := range sim.nodes {
+		link := node.wgDataplane.NameToLink[ifaceName]
+		for _, other := range sim.nodes {
+			otherLink := other.wgDataplane.NameToLink[ifaceName]
+			if other == node || link == nil || otherLink == nil {
+				continue
+			}
+			_, nodeHasOther := link.WireguardPeers[otherLink.WireguardPublicKey]
+			_, otherHasNode := otherLink.WireguardPeers[link.WireguardPublicKey]
+			if nodeHasOther && otherHasNode {
+				node.wgDataplane.WireguardPeerHandshake(ifaceName, otherLink.WireguardPublicKey)
+			}
+		}
+	}
+}
+
+// connected returns true if each of the nodes has a peer with the current key of the other, whose allowed IPs include
+// the CIDR of the other node, so that traffic flows between their CIDRs.
+func (sim *simulation) connected(node, other *simNode) bool {
+	hasPeer := func(from, to *simNode) bool {
+		link := from.wgDataplane.NameToLink[ifaceName]
+		toLink := to.wgDataplane.NameToLink[ifaceName]
+		if link == nil || toLink == nil {
+			return false
+		}
+		peer, ok := link.WireguardPeers[toLink.WireguardPublicKey]
+		if !ok {
+			return false
+		}
+		for i := range peer.AllowedIPs {
+			if ip.CIDRFromIPNet(&peer.AllowedIPs[i]) == to.cidr {
+				return true
+			}
+		}
+		return false
+	}
+	return hasPeer(node, other) && hasPeer(other, node)
+}
+
+// diverted returns true if the traffic of a node to the CIDR of another node is routed to the wireguard interface, i.e.
+// the node has our routing rule and a route to its wireguard device for the CIDR.
+func (sim *simulation) diverted(node, other *simNode) bool {
+	link := node.wgDataplane.NameToLink[ifaceName]
+	if link == nil {
+		return false
+	}
+	routekey := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, other.cidr)
+	if _, ok := node.rtDataplane.RouteKeyToRoute[routekey]; !ok {
+		return false
+	}
+	for _, rule := range node.wgDataplane.Rules {
+		if rule.Table == tableIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// dropped returns true if a node has no peer with the current key of the device of another node, and so drops the
+// traffic that the other node encrypts for it.
+func (sim *simulation) dropped(node, other *simNode) bool {
+	link := node.wgDataplane.NameToLink[ifaceName]
+	otherLink := other.wgDataplane.NameToLink[ifaceName]
+	if link == nil || otherLink == nil {
+		return true
+	}
+	_, ok := link.WireguardPeers[otherLink.WireguardPublicKey]
+	return !ok
+}
+
+// keyTransitionsPending returns true if a node still has a peer of the previous key of another node.
+func (sim *simulation) keyTransitionsPending() bool {
+	for _, node := range sim.nodes {
+		if node.wg != nil && node.wg.KeyTransitionCheckAfter() != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// converge stops dropping updates, delivers the updates in-flight, and then resyncs each node with the datastore until
+// there is nothing left to deliver.
+func (sim *simulation) converge() {
+	sim.dropProbability = 0
+	for i := 0; len(sim.inFlight) > 0; i++ {
+		Expect(i).To(BeNumerically("<", 1000), "updates were not delivered")
+		sim.step()
+	}
+	for _, node := range sim.nodes {
+		sim.sendSnapshot(node)
+		node.wg.QueueResync()
+	}
+	for i := 0; i == 0 || len(sim.inFlight) > 0 || sim.keyTransitionsPending(); i++ {
+		Expect(i).To(BeNumerically("<", 1000), "updates were not delivered")
+		sim.step()
+	}
+}
+
+// convergenceError returns an error if the nodes have not converged. Each node must have its published key programmed
+// in its device, a peer for every other node with the key that node published and its endpoint and CIDR, and a route to
+// the wireguard interface for the CIDR of every other node.
+func (sim *simulation) convergenceError() error {
+	for _, node := range sim.nodes {
+		link := node.wgDataplane.NameToLink[ifaceName]
+		if link == nil {
+			return fmt.Errorf("node %s has no wireguard device", node.name)
+		} else if key, ok := sim.keys[node.name]; !ok || link.WireguardPublicKey != key {
+			return fmt.Errorf("node %s has key %s, but published %s", node.name, link.WireguardPublicKey, key)
+		} else if len(link.WireguardPeers) != len(sim.nodes)-1 {
+			return fmt.Errorf("node %s has %d peers, expected %d", node.name, len(link.WireguardPeers), len(sim.nodes)-1)
+		}
+		for _, other := range sim.nodes {
+			if other == node {
+				continue
+			}
+			peer, ok := link.WireguardPeers[sim.keys[other.name]]
+			if !ok {
+				return fmt.Errorf("node %s has no peer for node %s with key %s", node.name, other.name, sim.keys[other.name])
+			}
+			expectedEndpoint := &net.UDPAddr{IP: other.endpoint.AsNetIP(), Port: listeningPort}
+			if peer.Endpoint == nil || peer.Endpoint.String() != expectedEndpoint.String() {
+				return fmt.Errorf("node %s has endpoint %v for node %s, expected %v", node.name, peer.Endpoint, other.name, expectedEndpoint)
+			}
+			if len(peer.AllowedIPs) != 1 || ip.CIDRFromIPNet(&peer.AllowedIPs[0]) != other.cidr {
+				return fmt.Errorf("node %s has allowed IPs %v for node %s, expected %s", node.name, peer.AllowedIPs, other.name, other.cidr)
+			}
+			routekey := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, other.cidr)
+			if _, ok := node.rtDataplane.RouteKeyToRoute[routekey]; !ok {
+				return fmt.Errorf("node %s has no wireguard route for node %s", node.name, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Wireguard multi-node simulation", func() {
+	var logLevel log.Level
+	var seed int64
+	var sim *simulation
+
+	BeforeEach(func() {
+		// The simulation generates a lot of logs, so only log errors.
+		logLevel = log.GetLevel()
+		log.SetLevel(log.ErrorLevel)
+		seed = time.Now().UnixNano()
+	})
+
+	AfterEach(func() {
+		log.SetLevel(logLevel)
+		if CurrentGinkgoTestDescription().Failed {
+			fmt.Fprintf(GinkgoWriter, "Failed with seed %d at %v\n", seed, sim.now)
+		}
+	})
+
+	// startAll starts every node at the same time, and runs the simulation for a while with updates being delayed and
+	// dropped.
+	startAll := func() {
+		sim = newSimulation(seed, 2*time.Second, 0.2)
+		for _, node := range sim.nodes {
+			sim.start(node)
+		}
+		for i := 0; i < 50; i++ {
+			sim.step()
+		}
+	}
+
+	It("should converge after a simultaneous startup", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			startAll()
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should converge after the key of one node is rotated", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			startAll()
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+
+			// Remove the key from the device, so that a new key is generated and published on the next resync.
+			node := sim.nodes[sim.r.Intn(len(sim.nodes))]
+			oldKey := sim.keys[node.name]
+			link := node.wgDataplane.NameToLink[ifaceName]
+			link.WireguardPrivateKey = wgtypes.Key{}
+			link.WireguardPublicKey = wgtypes.Key{}
+			node.wg.QueueResync()
+			sim.dropProbability = 0.2
+			for j := 0; j < 50; j++ {
+				sim.step()
+			}
+
+			sim.converge()
+			Expect(sim.keys[node.name]).NotTo(Equal(oldKey))
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should only lose connectivity during a key rotation until the new key has propagated", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			startAll()
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+
+			// Rotate the key of one node, and measure how long each other node is unable to reach it. The updates are
+			// delayed but not dropped, so the outage should be bounded by the delay of the update.
+			node := sim.nodes[sim.r.Intn(len(sim.nodes))]
+			oldKey := sim.keys[node.name]
+			link := node.wgDataplane.NameToLink[ifaceName]
+			link.WireguardPrivateKey = wgtypes.Key{}
+			link.WireguardPublicKey = wgtypes.Key{}
+			node.wg.QueueResync()
+			rotatedAt := sim.now
+			outages := map[string]time.Duration{}
+			keptOldKey := map[string]bool{}
+			for j := 0; j < 50; j++ {
+				sim.step()
+				for _, other := range sim.nodes {
+					if other == node {
+						continue
+					}
+					if _, ok := outages[other.name]; !ok && sim.connected(node, other) {
+						outages[other.name] = sim.now - rotatedAt
+					}
+					// Once the node has the new key, the peer of the old key is kept without any allowed IPs.
+					peers := other.wgDataplane.NameToLink[ifaceName].WireguardPeers
+					if _, ok := peers[sim.keys[node.name]]; !ok {
+						continue
+					}
+					if peer, ok := peers[oldKey]; ok {
+						Expect(peer.AllowedIPs).To(BeEmpty())
+						keptOldKey[other.name] = true
+					}
+				}
+			}
+			Expect(sim.keys[node.name]).NotTo(Equal(oldKey))
+			Expect(sim.previousKeys[node.name].key).To(Equal(oldKey))
+			Expect(outages).To(HaveLen(len(sim.nodes) - 1))
+			for name, outage := range outages {
+				Expect(outage).To(BeNumerically("<=", sim.maxDelay+2*simulationTick), "outage of node "+name)
+				Expect(keptOldKey).To(HaveKey(name))
+			}
+
+			// The peers of the old key are removed once there has been a handshake with the new key.
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should converge after one node is restarted", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			startAll()
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+
+			// The restarted node retains its device, and so its key.
+			node := sim.nodes[sim.r.Intn(len(sim.nodes))]
+			oldKey := sim.keys[node.name]
+			sim.dropProbability = 0.2
+			sim.start(node)
+			for j := 0; j < 50; j++ {
+				sim.step()
+			}
+
+			sim.converge()
+			Expect(sim.keys[node.name]).To(Equal(oldKey))
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should only withdraw the key of a disabled node once its traffic is no longer routed over wireguard", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			startAll()
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+
+			// Restart one node with wireguard disabled. The removal of its routes fails for a while, and its link stays
+			// busy for longer, so that the removal of its configuration spans many Applies.
+			node := sim.nodes[sim.r.Intn(len(sim.nodes))]
+			oldKey := sim.keys[node.name]
+			node.disabled = true
+			node.rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDel
+			node.rtDataplane.PersistFailures = true
+			node.wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkDelBusy
+			node.wgDataplane.PersistFailures = true
+			routeFailureSteps := 1 + sim.r.Intn(10)
+			const linkBusySteps = 40
+			sim.start(node)
+
+			for j := 0; j < 50; j++ {
+				if j == routeFailureSteps {
+					node.rtDataplane.PersistFailures = false
+					node.rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+				}
+				if j == linkBusySteps {
+					// The withdrawal of the key has reached every other node while the link is still busy.
+					for _, other := range sim.nodes {
+						if other != node {
+							Expect(sim.dropped(other, node)).To(BeTrue(), "peer of node "+other.name)
+						}
+					}
+					node.wgDataplane.PersistFailures = false
+					node.wgDataplane.FailuresToSimulate = mocknetlink.FailNone
+				}
+				sim.step()
+
+				// There is no window in which the node still routes its traffic to another node over wireguard while
+				// the other node has already dropped its peer.
+				for _, other := range sim.nodes {
+					if other != node && sim.diverted(node, other) {
+						Expect(sim.dropped(other, node)).To(BeFalse(),
+							fmt.Sprintf("node %s dropped node %s at %v", other.name, node.name, sim.now))
+					}
+				}
+			}
+			Expect(sim.keys[node.name]).To(Equal(wgtypes.Key{}))
+			Expect(node.wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			for _, other := range sim.nodes {
+				if other != node {
+					Expect(other.wgDataplane.NameToLink[ifaceName].WireguardPeers).NotTo(HaveKey(oldKey))
+				}
+			}
+		}
+	})
+
+	It("should only publish the key of a node once its endpoint address is known", func() {
+		for i := 0; i < numSimulationSeeds; i++ {
+			seed++
+			sim = newSimulation(seed, 2*time.Second, 0.2)
+			node := sim.nodes[sim.r.Intn(len(sim.nodes))]
+			endpoint := node.endpoint
+			node.endpoint = nil
+			for _, n := range sim.nodes {
+				sim.start(n)
+			}
+
+			// The node configures its device, but no other node programs a peer for it since its key is held back.
+			for j := 0; j < 50; j++ {
+				sim.step()
+				link := node.wgDataplane.NameToLink[ifaceName]
+				Expect(link).NotTo(BeNil())
+				Expect(link.WireguardPublicKey).NotTo(Equal(wgtypes.Key{}))
+				for _, other := range sim.nodes {
+					if other != node {
+						Expect(other.wgDataplane.NameToLink[ifaceName].WireguardPeers).NotTo(
+							HaveKey(link.WireguardPublicKey), "peer of node "+other.name)
+					}
+				}
+			}
+			Expect(sim.keys[node.name]).To(Equal(wgtypes.Key{}))
+			Expect(node.keyStates).To(Equal([]KeyState{KeyStateWaitingForLocalAddress}))
+			Expect(node.wg.LocalAddressError()).To(BeAssignableToTypeOf(&MissingLocalAddressError{}))
+
+			// Once the endpoint is known the key is published, and each peer of the node has the endpoint.
+			node.endpoint = endpoint
+			sim.broadcast(nil, func(wg *Wireguard) {
+				wg.EndpointUpdate(node.name, endpoint)
+			})
+			for j := 0; j < 50; j++ {
+				sim.step()
+				key := node.wgDataplane.NameToLink[ifaceName].WireguardPublicKey
+				for _, other := range sim.nodes {
+					if peer, ok := other.wgDataplane.NameToLink[ifaceName].WireguardPeers[key]; ok && other != node {
+						Expect(peer.Endpoint).NotTo(BeNil(), "peer of node "+other.name)
+					}
+				}
+			}
+			sim.converge()
+			Expect(sim.convergenceError()).NotTo(HaveOccurred())
+			Expect(node.keyStates[len(node.keyStates)-1]).To(Equal(KeyStatePublished))
+			Expect(node.wg.LocalAddressError()).NotTo(HaveOccurred())
+		}
+	})
+})
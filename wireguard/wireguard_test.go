@@ -17,16 +17,28 @@ package wireguard_test
 import (
 	. "github.com/projectcalico/felix/wireguard"
 
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
@@ -46,13 +58,17 @@ var (
 	peer4              = "peer4"
 	FelixRouteProtocol = syscall.RTPROT_BOOT
 	tableIndex         = 99
+	tableIndexHost     = 100
 	rulePriority       = 98
 	firewallMark       = 10
 	listeningPort      = 1000
 	mtu                = 2000
 
-	ipv4_int1 = ip.FromString("192.168.0.0")
-	ipv4_int2 = ip.FromString("192.168.10.0")
+	ipv4_int1       = ip.FromString("192.168.0.0")
+	ipv4_int2       = ip.FromString("192.168.10.0")
+	ipv4_int_peer1  = ip.FromString("192.168.20.1")
+	cidr_int_peer1  = ipv4_int_peer1.AsCIDR()
+	ipnet_int_peer1 = cidr_int_peer1.ToIPNet()
 
 	ipv4_host  = ip.FromString("1.2.3.0")
 	ipv4_peer1 = ip.FromString("1.2.3.5")
@@ -118,18 +134,35 @@ func (a *applyWithErrors) LastError() error {
 }
 
 type mockStatus struct {
-	numCallbacks int
-	err          error
-	key          wgtypes.Key
+	numCallbacks  int
+	err           error
+	key           wgtypes.Key
+	port          int
+	ifaceName     string
+	ifaceAddr     ip.Addr
+	tableIndex    int
+	previousKey   wgtypes.Key
+	deadline      time.Time
+	keyState      KeyState
+	enabledSource EnabledSource
 }
 
-func (m *mockStatus) status(publicKey wgtypes.Key) error {
-	log.Debugf("Status update with public key: %s", publicKey)
+func (m *mockStatus) status(update StatusUpdate) error {
+	log.Debugf("Status update with public key: %s; port: %d; iface: %s; addr: %v; table: %d", update.PublicKey,
+		update.ListeningPort, update.InterfaceName, update.InterfaceAddr, update.RoutingTableIndex)
 	m.numCallbacks++
 	if m.err != nil {
 		return m.err
 	}
-	m.key = publicKey
+	m.key = update.PublicKey
+	m.port = update.ListeningPort
+	m.ifaceName = update.InterfaceName
+	m.ifaceAddr = update.InterfaceAddr
+	m.tableIndex = update.RoutingTableIndex
+	m.previousKey = update.PreviousPublicKey
+	m.deadline = update.PreviousKeyDeadline
+	m.keyState = update.KeyState
+	m.enabledSource = update.EnabledSource
 
 	log.Debugf("Num callbacks: %d", m.numCallbacks)
 	return nil
@@ -141,12 +174,14 @@ var _ = Describe("Enable wireguard", func() {
 	var t *mocktime.MockTime
 	var s *mockStatus
 	var wg *Wireguard
+	var numKicks int
 
 	BeforeEach(func() {
 		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
 		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
 		t = mocktime.NewMockTime()
 		s = &mockStatus{}
+		numKicks = 0
 		// Setting an auto-increment greater than the route cleanup delay effectively
 		// disables the grace period for these tests.
 		t.SetAutoIncrement(11 * time.Second)
@@ -161,21 +196,32 @@ var _ = Describe("Enable wireguard", func() {
 				RoutingTableIndex:   tableIndex,
 				InterfaceName:       ifaceName,
 				MTU:                 mtu,
+
+				RoutingRulePriorityRange: 1,
 			},
 			rtDataplane.NewMockNetlink,
 			wgDataplane.NewMockNetlink,
 			wgDataplane.NewMockWireguard,
+			nil,
 			10*time.Second,
 			t,
 			FelixRouteProtocol,
 			s.status,
+			func() { numKicks++ },
 		)
+		wg.EndpointUpdate(hostname, ipv4_host)
 	})
 
 	It("should be constructable", func() {
 		Expect(wg).ToNot(BeNil())
 	})
 
+	It("should be active and report the IPv4 overhead", func() {
+		Expect(wg.Active()).To(BeTrue())
+		Expect(wg.Overhead()).To(Equal(60))
+		Expect(OverheadForIPVersion(6)).To(Equal(80))
+	})
+
 	Describe("create the wireguard link", func() {
 		var correctRule *netlink.Rule
 		BeforeEach(func() {
@@ -198,6 +244,39 @@ var _ = Describe("Enable wireguard", func() {
 			Expect(wgDataplane.WireguardOpen).To(BeFalse())
 		})
 
+		It("should not return the local config until the link is up and programmed", func() {
+			_, _, _, ok := wg.LocalConfig()
+			Expect(ok).To(BeFalse())
+
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			publicKey, port, name, ok := wg.LocalConfig()
+			Expect(ok).To(BeTrue())
+			Expect(publicKey).To(Equal(wgDataplane.NameToLink[ifaceName].WireguardPublicKey))
+			Expect(publicKey).To(Equal(s.key))
+			Expect(port).To(Equal(listeningPort))
+			Expect(name).To(Equal(ifaceName))
+		})
+
+		It("should not return the local config if programming the device fails", func() {
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+			err := wg.Apply()
+			Expect(err).To(HaveOccurred())
+			_, _, _, ok := wg.LocalConfig()
+			Expect(ok).To(BeFalse())
+
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			publicKey, _, _, ok := wg.LocalConfig()
+			Expect(ok).To(BeTrue())
+			Expect(publicKey).To(Equal(wgDataplane.NameToLink[ifaceName].WireguardPublicKey))
+		})
+
 		It("another apply will no-op until link is active", func() {
 			// Apply, but still not iface update
 			wgDataplane.ResetDeltas()
@@ -228,6 +307,39 @@ var _ = Describe("Enable wireguard", func() {
 			Expect(wgDataplane.WireguardOpen).To(BeFalse())
 		})
 
+		It("should request an apply when the wireguard interface comes up", func() {
+			Expect(numKicks).To(Equal(0))
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			Expect(numKicks).To(Equal(1))
+
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.WireguardOpen).To(BeTrue())
+			Expect(numKicks).To(Equal(1))
+		})
+
+		It("should not request an apply for other interfaces or for the interface going down", func() {
+			wgDataplane.AddIface(1919, ifaceName+".foobar", true, true)
+			wg.OnIfaceStateChanged(ifaceName+".foobar", ifacemonitor.StateUp)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+			Expect(numKicks).To(Equal(0))
+		})
+
+		It("should only request an apply once until the apply has been performed", func() {
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			Expect(numKicks).To(Equal(1))
+
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			Expect(numKicks).To(Equal(2))
+		})
+
 		It("should handle status update raising an error", func() {
 			wgDataplane.SetIface(ifaceName, true, true)
 			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
@@ -308,7 +420,95 @@ var _ = Describe("Enable wireguard", func() {
 				Expect(wgDataplane.DeletedRules[0]).To(Equal(*incorrectRule))
 			})
 
-			It("after endpoint update with incorrect key should program the interface address and resend same key as status", func() {
+			Describe("another component has a rule at the configured priority", func() {
+				var foreignRule, shiftedRule netlink.Rule
+				BeforeEach(func() {
+					foreignRule = netlink.Rule{Priority: rulePriority, Table: 200}
+					wgDataplane.Rules = append(wgDataplane.Rules, foreignRule)
+					wgDataplane.ResetDeltas()
+
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).ToNot(HaveOccurred())
+
+					shiftedRule = *correctRule
+					shiftedRule.Priority = rulePriority + 1
+				})
+
+				It("should move our rule to the next priority and leave the other rule in place", func() {
+					Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{*correctRule}))
+					Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{shiftedRule}))
+					Expect(wgDataplane.Rules).To(ContainElement(foreignRule))
+				})
+
+				It("should remember the priority after the other rule is deleted", func() {
+					Expect(wgDataplane.RuleDel(&foreignRule)).To(Succeed())
+					wgDataplane.ResetDeltas()
+
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(wgDataplane.AddedRules).To(BeEmpty())
+					Expect(wgDataplane.DeletedRules).To(BeEmpty())
+					Expect(wgDataplane.Rules).To(ContainElement(shiftedRule))
+				})
+
+				It("should move our rule if the remembered priority becomes occupied", func() {
+					otherRule := netlink.Rule{Priority: rulePriority + 1, Table: 201}
+					wgDataplane.Rules = append(wgDataplane.Rules, otherRule)
+					wgDataplane.ResetDeltas()
+
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).ToNot(HaveOccurred())
+					shiftedRule.Priority = rulePriority - 1
+					Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{shiftedRule}))
+					Expect(wgDataplane.Rules).To(ContainElement(foreignRule))
+					Expect(wgDataplane.Rules).To(ContainElement(otherRule))
+				})
+
+				It("should share the configured priority if there are no free priorities in range", func() {
+					wgDataplane.Rules = append(wgDataplane.Rules,
+						netlink.Rule{Priority: rulePriority + 1, Table: 201},
+						netlink.Rule{Priority: rulePriority - 1, Table: 202},
+					)
+					wgDataplane.ResetDeltas()
+
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{shiftedRule}))
+					Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{*correctRule}))
+				})
+			})
+
+			It("should try another priority if adding the rule fails because it exists", func() {
+				Expect(wgDataplane.RuleDel(correctRule)).To(Succeed())
+				wgDataplane.ResetDeltas()
+				wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAddExists
+
+				wg.QueueResync()
+				err := wg.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				shiftedRule := *correctRule
+				shiftedRule.Priority = rulePriority + 1
+				Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{shiftedRule}))
+			})
+
+			It("should delete a duplicate of our rule", func() {
+				wgDataplane.AllowDuplicateRules = true
+				Expect(wgDataplane.RuleAdd(correctRule)).To(Succeed())
+				wgDataplane.ResetDeltas()
+
+				wg.QueueResync()
+				err := wg.Apply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{*correctRule}))
+				Expect(wgDataplane.AddedRules).To(BeEmpty())
+				Expect(wgDataplane.Rules).To(ContainElement(*correctRule))
+			})
+
+			It("after stale endpoint update with incorrect key should program the interface address and not resend the key", func() {
 				link := wgDataplane.NameToLink[ifaceName]
 				Expect(link.WireguardPrivateKey).NotTo(Equal(zeroKey))
 				Expect(s.numCallbacks).To(Equal(1))
@@ -327,8 +527,84 @@ var _ = Describe("Enable wireguard", func() {
 				Expect(link.WireguardListenPort).To(Equal(listeningPort))
 				Expect(link.WireguardPrivateKey).To(Equal(key))
 				Expect(link.WireguardPrivateKey.PublicKey()).To(Equal(link.WireguardPublicKey))
+
+				// The published key has not been echoed back yet, so the update is stale and the key is not resent.
+				Expect(s.numCallbacks).To(Equal(1))
+				Expect(s.key).To(Equal(key.PublicKey()))
+				published, echoed := wg.PublishGeneration()
+				Expect(published).To(Equal(uint64(1)))
+				Expect(echoed).To(BeZero())
+
+				// The key is resent on resync if it still has not been echoed back.
+				wg.QueueResync()
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(2))
+				Expect(s.key).To(Equal(key.PublicKey()))
+
+				// Once echoed back there are no further updates on resync.
+				wg.EndpointWireguardUpdate(hostname, key.PublicKey(), ipv4)
+				wg.QueueResync()
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
 				Expect(s.numCallbacks).To(Equal(2))
+				published, echoed = wg.PublishGeneration()
+				Expect(published).To(Equal(uint64(2)))
+				Expect(echoed).To(Equal(uint64(2)))
+			})
+
+			It("after endpoint update with incorrect key once the key is echoed should resend same key as status", func() {
+				key := wgDataplane.NameToLink[ifaceName].WireguardPrivateKey
+				wg.EndpointWireguardUpdate(hostname, key.PublicKey(), nil)
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(1))
+
+				wg.EndpointWireguardUpdate(hostname, zeroKey, nil)
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(2))
+				Expect(s.key).To(Equal(key.PublicKey()))
+			})
+
+			It("should limit the republications of the key for repeated stale echoes", func() {
+				t.SetAutoIncrement(0)
+				key := wgDataplane.NameToLink[ifaceName].WireguardPrivateKey
+				wg.EndpointWireguardUpdate(hostname, key.PublicKey(), nil)
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(1))
+
+				// A slow datastore alternately echoes back a stale key and our key. Only the first stale echo is
+				// republished within the interval.
+				for i := 0; i < 10; i++ {
+					t.IncrementTime(time.Second)
+					wg.EndpointWireguardUpdate(hostname, zeroKey, nil)
+					err = wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					wg.EndpointWireguardUpdate(hostname, key.PublicKey(), nil)
+					err = wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+				}
+				Expect(s.numCallbacks).To(Equal(2))
+				Expect(wg.StaleKeyEchoes()).To(Equal(10))
+				Expect(wg.PublishRetryAfter()).To(BeZero())
+
+				// If the stale key is not followed by our key, the key is republished once the interval has passed.
+				wg.EndpointWireguardUpdate(hostname, zeroKey, nil)
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(2))
+				retryAfter := wg.PublishRetryAfter()
+				Expect(retryAfter).To(Equal(21 * time.Second))
+
+				t.IncrementTime(retryAfter)
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.numCallbacks).To(Equal(3))
 				Expect(s.key).To(Equal(key.PublicKey()))
+				Expect(wg.PublishRetryAfter()).To(BeZero())
+				Expect(wg.StaleKeyEchoes()).To(Equal(11))
 			})
 
 			It("after endpoint update with correct key should program the interface address and not send another status update", func() {
@@ -352,6 +628,49 @@ var _ = Describe("Enable wireguard", func() {
 				Expect(s.numCallbacks).To(Equal(1))
 			})
 
+			It("should converge on a single interface address after a failed address delete", func() {
+				wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int1)
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				link := wgDataplane.NameToLink[ifaceName]
+				Expect(link.Addrs).To(HaveLen(1))
+				Expect(link.Addrs[0].IP).To(Equal(ipv4_int1.AsNetIP()))
+
+				// Change the address and fail the delete of the old address.
+				wgDataplane.FailuresToSimulate = mocknetlink.FailNextAddrDel
+				wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int2)
+				err = wg.Apply()
+				Expect(err).To(HaveOccurred())
+
+				// The next two applies should succeed and leave only the new address.
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				link = wgDataplane.NameToLink[ifaceName]
+				Expect(link.Addrs).To(HaveLen(1))
+				Expect(link.Addrs[0].IP).To(Equal(ipv4_int2.AsNetIP()))
+			})
+
+			It("should remove a rogue interface address added out-of-band on resync", func() {
+				wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int1)
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+
+				rogue := ip.MustParseCIDROrIP("10.10.10.10/32").ToIPNet()
+				link := wgDataplane.NameToLink[ifaceName]
+				link.Addrs = append(link.Addrs, netlink.Addr{IPNet: &rogue})
+				Expect(link.Addrs).To(HaveLen(2))
+
+				wg.QueueResync()
+				err = wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				link = wgDataplane.NameToLink[ifaceName]
+				Expect(link.Addrs).To(HaveLen(1))
+				Expect(link.Addrs[0].IP).To(Equal(ipv4_int1.AsNetIP()))
+				Expect(wgDataplane.DeletedAddrs.Contains(rogue.String())).To(BeTrue())
+			})
+
 			Describe("create two wireguard peers with different public keys", func() {
 				var key_peer1, key_peer2 wgtypes.Key
 				var link *mocknetlink.MockLink
@@ -393,6 +712,130 @@ var _ = Describe("Enable wireguard", func() {
 					}))
 				})
 
+				It("should report peers with no handshake in the peer diagnostics after a resync", func() {
+					// The peers were added by a delta update, which does not read the device.
+					Expect(wg.PeerDiagnostics()).To(BeEmpty())
+
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					diags := wg.PeerDiagnostics()
+					Expect(diags).To(HaveLen(2))
+					Expect(diags[peer1]).To(Equal(PeerDiagnostics{
+						PublicKey:          key_peer1,
+						ConfiguredEndpoint: &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: 1000},
+						KernelEndpoint:     &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: 1000},
+						HandshakeState:     HandshakeStateNone,
+					}))
+					Expect(diags[peer2].HandshakeState).To(Equal(HandshakeStateNone))
+				})
+
+				It("should only refresh the peer diagnostics from the device on resync", func() {
+					// The handshake stays recent however many times the time is read by the Applies.
+					t.SetAutoIncrement(0)
+					natEndpoint := &net.UDPAddr{IP: net.ParseIP("10.10.10.10"), Port: 5000}
+					handshake := t.Now()
+					wgDataplane.SetWireguardPeerKernelState(ifaceName, key_peer1, natEndpoint, handshake)
+
+					// A delta update does not read the device.
+					wg.EndpointUpdate(peer2, ipv4_peer3)
+					err := wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(wg.PeerDiagnostics()).To(BeEmpty())
+
+					// The resync reads the kernel endpoint learned from the handshake.
+					wg.QueueResync()
+					err = wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					diags := wg.PeerDiagnostics()
+					Expect(diags).To(HaveLen(2))
+					Expect(diags[peer1]).To(Equal(PeerDiagnostics{
+						PublicKey:          key_peer1,
+						ConfiguredEndpoint: &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: 1000},
+						KernelEndpoint:     natEndpoint,
+						LastHandshakeTime:  handshake,
+						HandshakeState:     HandshakeStateRecent,
+					}))
+					Expect(diags[peer2]).To(Equal(PeerDiagnostics{
+						PublicKey:          key_peer2,
+						ConfiguredEndpoint: &net.UDPAddr{IP: ipv4_peer3.AsNetIP(), Port: 1000},
+						KernelEndpoint:     &net.UDPAddr{IP: ipv4_peer3.AsNetIP(), Port: 1000},
+						HandshakeState:     HandshakeStateNone,
+					}))
+				})
+
+				It("should flag a stale handshake in the peer diagnostics", func() {
+					handshake := t.Now().Add(-time.Hour)
+					wgDataplane.SetWireguardPeerKernelState(ifaceName, key_peer1, nil, handshake)
+					wg.QueueResync()
+					err := wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					diags := wg.PeerDiagnostics()
+					Expect(diags[peer1].LastHandshakeTime).To(Equal(handshake))
+					Expect(diags[peer1].HandshakeState).To(Equal(HandshakeStateStale))
+					Expect(diags[peer2].HandshakeState).To(Equal(HandshakeStateNone))
+				})
+
+				It("should not block updates during a slow apply and should converge", func() {
+					rtDataplane.NameToLink[ifaceName] = link
+					rtDataplane.LinkByNameSleep = 10 * time.Millisecond
+					wgDataplane.LinkByNameSleep = 10 * time.Millisecond
+
+					// Continually apply in the background.
+					stopApplying := make(chan struct{})
+					applyDone := make(chan struct{})
+					go func() {
+						defer GinkgoRecover()
+						defer close(applyDone)
+						for {
+							select {
+							case <-stopApplying:
+								return
+							default:
+								_ = wg.Apply()
+							}
+						}
+					}()
+
+					// Hammer the updates from multiple goroutines. Each CIDR is repeatedly added to and removed from
+					// peer1 and finally added to peer2.
+					var updaters sync.WaitGroup
+					for _, cidr := range []ip.CIDR{cidr_1, cidr_2, cidr_3, cidr_4} {
+						updaters.Add(1)
+						go func(cidr ip.CIDR) {
+							defer GinkgoRecover()
+							defer updaters.Done()
+							for i := 0; i < 100; i++ {
+								wg.EndpointAllowedCIDRAdd(peer1, cidr)
+								wg.EndpointAllowedCIDRRemove(cidr)
+							}
+							wg.EndpointAllowedCIDRAdd(peer2, cidr)
+						}(cidr)
+					}
+					updatesDone := make(chan struct{})
+					go func() {
+						updaters.Wait()
+						close(updatesDone)
+					}()
+
+					// The updates should not be blocked behind the slow Apply calls.
+					Eventually(updatesDone, "500ms").Should(BeClosed())
+					close(stopApplying)
+					Eventually(applyDone, "5s").Should(BeClosed())
+
+					// A final apply picks up any remaining updates.
+					rtDataplane.LinkByNameSleep = 0
+					wgDataplane.LinkByNameSleep = 0
+					err := wg.Apply()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(BeEmpty())
+					Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_3, ipnet_4))
+					for _, cidr := range []ip.CIDR{cidr_1, cidr_2, cidr_3, cidr_4} {
+						routekey := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)
+						Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey))
+					}
+				})
+
 				It("should have no updates for local EndpointUpdate and EndpointRemove msgs", func() {
 					wgDataplane.ResetDeltas()
 					rtDataplane.ResetDeltas()
@@ -662,6 +1105,30 @@ var _ = Describe("Enable wireguard", func() {
 							Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
 						})
 
+						It("should have no updates if re-adding a CIDR already programmed for the peer", func() {
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.AddedRouteKeys).To(HaveLen(0))
+							Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(0))
+							Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+						})
+
+						It("should add a single route if a CIDR is added twice to a peer before applying", func() {
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+							Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(0))
+							Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(3))
+						})
+
 						It("should have no updates if deleting an unknown CIDR", func() {
 							wgDataplane.ResetDeltas()
 							rtDataplane.ResetDeltas()
@@ -673,6 +1140,29 @@ var _ = Describe("Enable wireguard", func() {
 							Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
 						})
 
+						It("should ignore an IPv6 CIDR and still program the other CIDRs of the peer", func() {
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							cidr_v6 := ip.MustParseCIDROrIP("dead:beef::/122")
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_v6)
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+							Expect(rtDataplane.AddedRouteKeys).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_5)))
+							Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, cidr_5.ToIPNet()))
+
+							// Removing the IPv6 CIDR is a no-op.
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointAllowedCIDRRemove(cidr_v6)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.AddedRouteKeys).To(HaveLen(0))
+							Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(0))
+							Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+						})
+
 						It("should handle deletion of peers 2 and 3", func() {
 							wgDataplane.ResetDeltas()
 							rtDataplane.ResetDeltas()
@@ -694,47 +1184,354 @@ var _ = Describe("Enable wireguard", func() {
 							Expect(link.WireguardPeers).To(HaveLen(1))
 						})
 
-						Describe("move a route from peer1 to peer2 and a route from peer2 to peer3", func() {
-							BeforeEach(func() {
-								wg.EndpointAllowedCIDRRemove(cidr_2)
-								wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
-								wg.EndpointAllowedCIDRRemove(cidr_3)
-								wg.EndpointAllowedCIDRAdd(peer3, cidr_3)
-								rtDataplane.ResetDeltas()
-								err := wg.Apply()
-								Expect(err).NotTo(HaveOccurred())
-							})
+						It("should restore the dataplane state when a drained peer is undrained", func() {
+							routekey_1_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+							routekey_2_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)
+							routes := map[string]netlink.Route{}
+							for k, r := range rtDataplane.RouteKeyToRoute {
+								routes[k] = r
+							}
+							peers := map[wgtypes.Key]wgtypes.Peer{}
+							for k, p := range link.WireguardPeers {
+								peers[k] = p
+							}
+
+							By("draining peer1")
+							wg.EndpointDrain(peer1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+							Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2_throw))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_3))
+
+							By("undraining peer1")
+							wg.EndpointUndrain(peer1)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.RouteKeyToRoute).To(Equal(routes))
+							Expect(link.WireguardPeers).To(Equal(peers))
+						})
 
-							It("should have wireguard routes for peer1 and peer2", func() {
-								Expect(link.WireguardPeers).To(HaveKey(key_peer1))
-								Expect(link.WireguardPeers).To(HaveKey(key_peer2))
-								Expect(link.WireguardPeers[key_peer1]).To(Equal(wgtypes.Peer{
-									PublicKey: key_peer1,
-									Endpoint: &net.UDPAddr{
-										IP:   ipv4_peer1.AsNetIP(),
-										Port: 1000,
-									},
-									AllowedIPs: []net.IPNet{ipnet_1},
-								}))
-								Expect(link.WireguardPeers[key_peer2]).To(Equal(wgtypes.Peer{
-									PublicKey: key_peer2,
-									Endpoint: &net.UDPAddr{
-										IP:   ipv4_peer2.AsNetIP(),
-										Port: 1000,
-									},
-									AllowedIPs: []net.IPNet{ipnet_2},
-								}))
-							})
+						It("should keep a drained peer drained across a resync", func() {
+							routekey_1_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+							peer := link.WireguardPeers[key_peer1]
 
-							It("should reprogram the route to the non-wireguard peer only", func() {
-								Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
-								Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(1))
-								Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_3))
-								Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_3_throw))
-								Expect(rtDataplane.RouteKeyToRoute[routekey_3_throw]).To(Equal(netlink.Route{
-									Dst:      &ipnet_3,
-									Type:     syscall.RTN_THROW,
-									Protocol: FelixRouteProtocol,
+							wg.EndpointDrain(peer1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+
+							By("re-adding the peer to the dataplane and resyncing")
+							link.WireguardPeers[key_peer1] = peer
+							wg.QueueResync()
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+							Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+						})
+
+						It("should keep a peer drained when it is removed and re-added", func() {
+							wg.EndpointDrain(peer1)
+							wg.EndpointRemove(peer1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+
+							wg.EndpointUpdate(peer1, ipv4_peer1)
+							wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+							wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)))
+
+							wg.EndpointUndrain(peer1)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+						})
+
+						It("should treat a zero public key as not wireguard capable", func() {
+							routekey_1_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+							routekey_2_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)
+
+							By("updating peer1 to have a zero key")
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointWireguardUpdate(peer1, zeroKey, ipv4_int_peer1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+							Expect(link.WireguardPeers).NotTo(HaveKey(zeroKey))
+							Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2_throw))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_3))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(4))
+
+							By("updating peer3 to also have a zero key")
+							wgDataplane.ResetDeltas()
+							wg.EndpointWireguardUpdate(peer3, zeroKey, nil)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+							Expect(link.WireguardPeers).To(HaveLen(1))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4_throw))
+
+							By("resyncing")
+							wg.QueueResync()
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).To(HaveLen(1))
+							Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+
+							By("updating peer1 to have a valid key again")
+							rtDataplane.ResetDeltas()
+							wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+							Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2_throw))
+						})
+
+						It("should not read or configure the wireguard device for route only changes", func() {
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointAllowedCIDRAdd(peer3, cidr_5)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtDataplane.AddedRouteKeys.Contains(fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_5))).To(BeTrue())
+							Expect(wgDataplane.NumNewWireguardCalls).To(BeZero())
+							Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+							Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+						})
+
+						It("should configure but not read the wireguard device for peer changes", func() {
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+							wg.EndpointUpdate(peer1, ipv4_peer3)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.WireguardPeers[key_peer1].Endpoint.IP).To(Equal(ipv4_peer3.AsNetIP()))
+							Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+							Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+
+							// The routes are unchanged, so the routing table is not applied.
+							Expect(rtDataplane.AddedRouteKeys.Len()).To(BeZero())
+							Expect(rtDataplane.DeletedRouteKeys.Len()).To(BeZero())
+							for _, rt := range wg.RouteTableSyncers() {
+								Expect(rt.InSync()).To(BeTrue())
+							}
+						})
+
+						It("should read the wireguard device once on resync", func() {
+							wgDataplane.ResetDeltas()
+							wg.QueueResync()
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+							Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+
+							wgDataplane.ResetDeltas()
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+						})
+
+						It("should reprogram everything when the link is recreated with a new index", func() {
+							wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int1)
+							err := wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(link.Addrs).To(HaveLen(1))
+							oldPrivateKey := link.WireguardPrivateKey
+
+							// Delete and recreate the link out-of-band. The kernel removes the routes via the old link.
+							// There is no interface state change callback since the link is up before and after.
+							oldIndex := link.LinkAttrs.Index
+							link = wgDataplane.RecreateIface(oldIndex+10, ifaceName, true, true)
+							rtDataplane.RecreateIface(oldIndex+10, ifaceName, true, true)
+							Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+							wgDataplane.ResetDeltas()
+							rtDataplane.ResetDeltas()
+
+							err = wg.Apply()
+							Expect(err).NotTo(HaveOccurred())
+
+							// The device configuration and interface address are reprogrammed.
+							Expect(link.WireguardPrivateKey).NotTo(Equal(zeroKey))
+							Expect(link.WireguardPrivateKey).NotTo(Equal(oldPrivateKey))
+							Expect(link.WireguardListenPort).To(Equal(listeningPort))
+							Expect(link.WireguardFirewallMark).To(Equal(firewallMark))
+							Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+							Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(ipnet_3))
+							Expect(link.Addrs).To(HaveLen(1))
+							Expect(link.Addrs[0].IP).To(Equal(ipv4_int1.AsNetIP()))
+
+							// The routes are reprogrammed using the new link index.
+							for _, cidr := range []ip.CIDR{cidr_1, cidr_2, cidr_3} {
+								routekey := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)
+								Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey))
+							}
+							Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4_throw))
+
+							// The local config returns the key of the recreated device.
+							publicKey, _, _, ok := wg.LocalConfig()
+							Expect(ok).To(BeTrue())
+							Expect(publicKey).To(Equal(link.WireguardPublicKey))
+						})
+
+						Describe("peer1 has a wireguard interface address", func() {
+							var routekey_int_peer1 string
+							BeforeEach(func() {
+								routekey_int_peer1 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_int_peer1)
+								wgDataplane.ResetDeltas()
+								rtDataplane.ResetDeltas()
+								wg.EndpointWireguardUpdate(peer1, key_peer1, ipv4_int_peer1)
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+							})
+
+							It("should add the interface address to the peer config and route to wireguard", func() {
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_int_peer1))
+								Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(ipnet_3))
+								Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+								Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+								Expect(rtDataplane.RouteKeyToRoute[routekey_int_peer1]).To(Equal(netlink.Route{
+									LinkIndex: link.LinkAttrs.Index,
+									Dst:       &ipnet_int_peer1,
+									Type:      syscall.RTN_UNICAST,
+									Protocol:  FelixRouteProtocol,
+									Scope:     netlink.SCOPE_LINK,
+									Table:     tableIndex,
+								}))
+							})
+
+							It("should remove the interface address when the peer reports no interface address", func() {
+								wgDataplane.ResetDeltas()
+								rtDataplane.ResetDeltas()
+								wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+								Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+								Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(1))
+								Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_int_peer1))
+							})
+
+							It("should remove the interface address when the peer is removed", func() {
+								rtDataplane.ResetDeltas()
+								wg.EndpointRemove(peer1)
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+								Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_int_peer1))
+								Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_int_peer1))
+
+								By("adding the peer back without an interface address")
+								wg.EndpointUpdate(peer1, ipv4_peer1)
+								wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+								err = wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(BeEmpty())
+								Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_int_peer1))
+							})
+
+							It("should dedupe the interface address with an identical allowed CIDR", func() {
+								wgDataplane.ResetDeltas()
+								rtDataplane.ResetDeltas()
+								wg.EndpointAllowedCIDRAdd(peer1, cidr_int_peer1)
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+								Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+
+								By("removing the interface address and leaving the allowed CIDR")
+								wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+								err = wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+								Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_int_peer1))
+
+								By("removing the allowed CIDR")
+								wg.EndpointAllowedCIDRRemove(cidr_int_peer1)
+								err = wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_int_peer1))
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+							})
+
+							It("should keep the interface address when an identical allowed CIDR is removed", func() {
+								wg.EndpointAllowedCIDRAdd(peer1, cidr_int_peer1)
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+
+								wgDataplane.ResetDeltas()
+								rtDataplane.ResetDeltas()
+								wg.EndpointAllowedCIDRRemove(cidr_int_peer1)
+								err = wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+								Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+								Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+								Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_int_peer1))
+								Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_int_peer1))
+							})
+						})
+
+						Describe("move a route from peer1 to peer2 and a route from peer2 to peer3", func() {
+							BeforeEach(func() {
+								wg.EndpointAllowedCIDRRemove(cidr_2)
+								wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+								wg.EndpointAllowedCIDRRemove(cidr_3)
+								wg.EndpointAllowedCIDRAdd(peer3, cidr_3)
+								rtDataplane.ResetDeltas()
+								err := wg.Apply()
+								Expect(err).NotTo(HaveOccurred())
+							})
+
+							It("should have wireguard routes for peer1 and peer2", func() {
+								Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+								Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+								Expect(link.WireguardPeers[key_peer1]).To(Equal(wgtypes.Peer{
+									PublicKey: key_peer1,
+									Endpoint: &net.UDPAddr{
+										IP:   ipv4_peer1.AsNetIP(),
+										Port: 1000,
+									},
+									AllowedIPs: []net.IPNet{ipnet_1},
+								}))
+								Expect(link.WireguardPeers[key_peer2]).To(Equal(wgtypes.Peer{
+									PublicKey: key_peer2,
+									Endpoint: &net.UDPAddr{
+										IP:   ipv4_peer2.AsNetIP(),
+										Port: 1000,
+									},
+									AllowedIPs: []net.IPNet{ipnet_2},
+								}))
+							})
+
+							It("should reprogram the route to the non-wireguard peer only", func() {
+								Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+								Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+								Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_3_throw))
+								Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_3_throw))
+								Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_3))
+								Expect(rtDataplane.RouteKeyToRoute[routekey_3_throw]).To(Equal(netlink.Route{
+									Dst:      &ipnet_3,
+									Type:     syscall.RTN_THROW,
+									Protocol: FelixRouteProtocol,
 									Scope:    netlink.SCOPE_UNIVERSE,
 									Table:    tableIndex,
 								}))
@@ -784,9 +1581,10 @@ var _ = Describe("Enable wireguard", func() {
 							It("should reprogram the route to peer3 only", func() {
 								routekey_4 := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_4)
 								Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
-								Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(1))
-								Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_4_throw))
+								Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
 								Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_4))
+								Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_4))
+								Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_4_throw))
 								Expect(rtDataplane.RouteKeyToRoute[routekey_4]).To(Equal(netlink.Route{
 									LinkIndex: link.LinkAttrs.Index,
 									Dst:       &ipnet_4,
@@ -866,6 +1664,8 @@ var _ = Describe("Enable wireguard", func() {
 		It("should not create the wireguard interface", func() {
 			link := wgDataplane.NameToLink[ifaceName]
 			Expect(link).To(BeNil())
+			_, _, _, ok := wg.LocalConfig()
+			Expect(ok).To(BeFalse())
 		})
 
 		It("should not create the wireguard interface after another apply", func() {
@@ -882,6 +1682,37 @@ var _ = Describe("Enable wireguard", func() {
 			link := wgDataplane.NameToLink[ifaceName]
 			Expect(link).ToNot(BeNil())
 		})
+
+		It("should only be active once supported after a resync", func() {
+			Expect(wg.Active()).To(BeFalse())
+
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wg.Active()).To(BeTrue())
+		})
+
+		It("should only publish the generated key after a resync and not an intermediate key", func() {
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.key).To(Equal(zeroKey))
+
+			// The datastore has a key from a previous run, and the wireguard link is not yet up.
+			wg.EndpointWireguardUpdate(hostname, mustGeneratePrivateKey().PublicKey(), ipv4_peer1)
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.numCallbacks).To(Equal(1))
+
+			// Once the link is up the generated key is published.
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			link := wgDataplane.NameToLink[ifaceName]
+			Expect(s.numCallbacks).To(Equal(2))
+			Expect(s.key).To(Equal(link.WireguardPublicKey))
+			Expect(s.key).NotTo(Equal(zeroKey))
+		})
 	})
 
 	for _, testFailFlags := range []mocknetlink.FailFlags{
@@ -1194,15 +2025,17 @@ var _ = Describe("Wireguard (disabled)", func() {
 				RoutingRulePriority: rulePriority,
 				RoutingTableIndex:   tableIndex,
 				InterfaceName:       ifaceName,
-				MTU:                 1042,
+				MTU:                 mtu,
 			},
 			rtDataplane.NewMockNetlink,
 			wgDataplane.NewMockNetlink,
 			wgDataplane.NewMockWireguard,
+			nil,
 			10*time.Second,
 			t,
 			FelixRouteProtocol,
 			s.status,
+			nil,
 		)
 	})
 
@@ -1219,6 +2052,25 @@ var _ = Describe("Wireguard (disabled)", func() {
 		Expect(wgDataplane.NumLinkDeleteCalls).To(Equal(0))
 	})
 
+	It("should not be active", func() {
+		Expect(wg.Active()).To(BeFalse())
+	})
+
+	It("should only delete our routing rule", func() {
+		foreignRule := netlink.Rule{Priority: rulePriority, Table: 200}
+		ourRule := netlink.NewRule()
+		ourRule.Priority = rulePriority + 1
+		ourRule.Table = tableIndex
+		ourRule.Mark = 1
+		ourRule.Invert = true
+		wgDataplane.Rules = append(wgDataplane.Rules, foreignRule, *ourRule)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{*ourRule}))
+		Expect(wgDataplane.Rules).To(ContainElement(foreignRule))
+	})
+
 	It("should handle deletion of the wireguard link", func() {
 		wgDataplane.AddIface(1, ifaceName, true, true)
 		err := wg.Apply()
@@ -1226,6 +2078,8 @@ var _ = Describe("Wireguard (disabled)", func() {
 		Expect(wgDataplane.NumLinkAddCalls).To(Equal(0))
 		Expect(wgDataplane.NumLinkDeleteCalls).To(Equal(1))
 		Expect(wgDataplane.DeletedLinks).To(HaveKey(ifaceName))
+		_, _, _, ok := wg.LocalConfig()
+		Expect(ok).To(BeFalse())
 	})
 
 	Describe("With some endpoint updates", func() {
@@ -1255,6 +2109,147 @@ var _ = Describe("Wireguard (disabled)", func() {
 		})
 	})
 
+	Describe("with wireguard configuration to remove", func() {
+		var key_peer1 wgtypes.Key
+		var ourRule netlink.Rule
+		var routeKey string
+
+		BeforeEach(func() {
+			// The link, a peer, a route to the link and our rule remain from when wireguard was enabled.
+			link := wgDataplane.AddIface(1, ifaceName, true, true)
+			rtDataplane.AddIface(1, ifaceName, true, true)
+			key_peer1 = mustGeneratePrivateKey().PublicKey()
+			link.WireguardPeers = map[wgtypes.Key]wgtypes.Peer{
+				key_peer1: {PublicKey: key_peer1, AllowedIPs: []net.IPNet{cidr_1.ToIPNet()}},
+			}
+			rtDataplane.AddMockRoute(&netlink.Route{
+				LinkIndex: 1,
+				Dst:       &ipnet_1,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndex,
+			})
+			routeKey = fmt.Sprintf("%d-%d-%s", tableIndex, 1, cidr_1)
+			ourRule = netlink.Rule{Priority: rulePriority, Table: tableIndex, Mark: 1, Invert: true}
+			wgDataplane.Rules = append(wgDataplane.Rules, ourRule)
+		})
+
+		It("should remove the peers, routes, rule and link", func() {
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{ourRule}))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey))
+			Expect(wgDataplane.WireguardOpen).To(BeFalse())
+
+			By("not repeating the removal until a resync")
+			wgDataplane.ResetDeltas()
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.Calls).To(BeEmpty())
+		})
+
+		It("should only remove the rule once the peers and routes are removed, and resume after a failure", func() {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleDel
+			err := wg.Apply()
+			Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+			Expect(err.(*ApplyError).FailedSteps).To(Equal(map[Subsystem]string{SubsystemLink: "disable rules"}))
+
+			// The rule is still in place, but the traffic falls through the empty routing table.
+			link := wgDataplane.NameToLink[ifaceName]
+			Expect(link.WireguardPeers).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey))
+			Expect(wgDataplane.Rules).To(ContainElement(ourRule))
+			Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+
+			By("resuming from the rule")
+			wgDataplane.ResetDeltas()
+			rtDataplane.ResetDeltas()
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+			Expect(rtDataplane.Calls).NotTo(ContainElement("RouteListFiltered"))
+			Expect(wgDataplane.Rules).NotTo(ContainElement(ourRule))
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		})
+
+		It("should only withdraw our key once the routes are removed", func() {
+			numCallbacks := s.numCallbacks
+			rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDel
+			rtDataplane.PersistFailures = true
+			err := wg.Apply()
+			Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+			Expect(err.(*ApplyError).FailedSteps).To(Equal(map[Subsystem]string{SubsystemRoutes: "disable routes"}))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey))
+			Expect(s.numCallbacks).To(Equal(numCallbacks))
+
+			By("withdrawing our key once the routes are removed, although the rule removal fails")
+			rtDataplane.PersistFailures = false
+			rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleDel
+			err = wg.Apply()
+			Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+			Expect(err.(*ApplyError).FailedSteps).To(Equal(map[Subsystem]string{SubsystemLink: "disable rules"}))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey))
+			Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+			Expect(s.key).To(Equal(zeroKey))
+
+			By("not publishing the withdrawal again once the removal completes")
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.Rules).NotTo(ContainElement(ourRule))
+			Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+		})
+
+		It("should withdraw our key while the deletion of a busy link is retried", func() {
+			numCallbacks := s.numCallbacks
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkDelBusy
+			Expect(wg.Apply()).To(BeAssignableToTypeOf(&LinkBusyError{}))
+			Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+			Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+			Expect(s.key).To(Equal(zeroKey))
+		})
+
+		It("should retry the deletion of a busy link without removing the rule again", func() {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkDelBusy
+			err := wg.Apply()
+			Expect(err).To(BeAssignableToTypeOf(&LinkBusyError{}))
+			Expect(err.(*LinkBusyError).Attempts).To(Equal(1))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey))
+			Expect(wgDataplane.Rules).NotTo(ContainElement(ourRule))
+			Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+
+			By("resuming from the link")
+			wgDataplane.ResetDeltas()
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.Calls).NotTo(ContainElement("RuleList"))
+			Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		})
+
+		It("should escalate a link that stays busy", func() {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkDelBusy
+			wgDataplane.PersistFailures = true
+			for attempt := 1; attempt < 5; attempt++ {
+				err := wg.Apply()
+				Expect(err).To(BeAssignableToTypeOf(&LinkBusyError{}))
+				Expect(err.(*LinkBusyError).Attempts).To(Equal(attempt))
+			}
+			err := wg.Apply()
+			Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+			Expect(err.(*ApplyError).FailedSteps).To(Equal(map[Subsystem]string{SubsystemLink: "disable link"}))
+			Expect(wgDataplane.NumRuleDelCalls).To(Equal(1))
+
+			By("retrying again once escalated")
+			err = wg.Apply()
+			Expect(err).To(BeAssignableToTypeOf(&LinkBusyError{}))
+			Expect(err.(*LinkBusyError).Attempts).To(Equal(1))
+
+			wgDataplane.PersistFailures = false
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNone
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		})
+	})
+
 	for _, testFailFlags := range []mocknetlink.FailFlags{
 		mocknetlink.FailNextNewNetlink, mocknetlink.FailNextLinkDel, mocknetlink.FailNextLinkByName,
 		mocknetlink.FailNextRuleList, mocknetlink.FailNextRuleDel, mocknetlink.FailNextRouteList,
@@ -1341,3 +2336,12180 @@ var _ = Describe("Wireguard (disabled)", func() {
 		})
 	}
 })
+
+var _ = Describe("Wireguard route protocol migration", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+	var routekey_1, routekey_2 string
+
+	const (
+		linkIndex           = 10
+		legacyRouteProtocol = 80
+	)
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		// Simulate a restart after a change of route protocol. The wireguard link exists and the routes were
+		// programmed with the old route protocol.
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipnet_1,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  legacyRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		})
+		rtDataplane.AddMockRoute(&netlink.Route{
+			Dst:      &ipnet_2,
+			Type:     syscall.RTN_THROW,
+			Protocol: legacyRouteProtocol,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		})
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)
+
+		config = &Config{
+			Enabled:              true,
+			ListeningPort:        listeningPort,
+			FirewallMark:         firewallMark,
+			RoutingRulePriority:  rulePriority,
+			RoutingTableIndex:    tableIndex,
+			InterfaceName:        ifaceName,
+			MTU:                  mtu,
+			StrictTableOwnership: true,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	expectRoutesMigrated := func() {
+		It("should rewrite the routes with the new route protocol on the first resync", func() {
+			Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_1))
+			Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_2))
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_1))
+			Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(netlink.Route{
+				LinkIndex: linkIndex,
+				Dst:       &ipnet_1,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndex,
+			}))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(netlink.Route{
+				Dst:      &ipnet_2,
+				Type:     syscall.RTN_THROW,
+				Protocol: FelixRouteProtocol,
+				Scope:    netlink.SCOPE_UNIVERSE,
+				Table:    tableIndex,
+			}))
+		})
+
+		It("should not rewrite the routes on subsequent resyncs", func() {
+			for i := 0; i < 3; i++ {
+				rtDataplane.ResetDeltas()
+				wg.QueueResync()
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+				Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+			}
+		})
+	}
+
+	Context("with strict table ownership", func() {
+		expectRoutesMigrated()
+	})
+
+	Context("with legacy route protocols and without strict table ownership", func() {
+		BeforeEach(func() {
+			config.StrictTableOwnership = false
+			config.LegacyRouteProtocols = []int{legacyRouteProtocol}
+		})
+
+		expectRoutesMigrated()
+	})
+
+	Context("without legacy route protocols or strict table ownership", func() {
+		BeforeEach(func() {
+			config.StrictTableOwnership = false
+		})
+
+		It("should leave the routes with the old route protocol in place", func() {
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1].Protocol).To(Equal(legacyRouteProtocol))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2].Protocol).To(Equal(legacyRouteProtocol))
+		})
+	})
+})
+
+func scopePointer(scope netlink.Scope) *netlink.Scope {
+	return &scope
+}
+
+var _ = Describe("Wireguard route scope and onlink flag", func() {
+	const linkIndex = 10
+
+	for _, testConfig := range []struct {
+		routeScope         *netlink.Scope
+		routeOnLink        bool
+		throwRouteScope    *netlink.Scope
+		expectedScope      netlink.Scope
+		expectedThrowScope netlink.Scope
+	}{
+		{nil, false, nil, netlink.SCOPE_LINK, netlink.SCOPE_UNIVERSE},
+		{nil, true, nil, netlink.SCOPE_LINK, netlink.SCOPE_UNIVERSE},
+		{scopePointer(netlink.SCOPE_UNIVERSE), false, nil, netlink.SCOPE_UNIVERSE, netlink.SCOPE_UNIVERSE},
+		{scopePointer(netlink.SCOPE_UNIVERSE), true, nil, netlink.SCOPE_UNIVERSE, netlink.SCOPE_UNIVERSE},
+		{scopePointer(netlink.SCOPE_LINK), true, scopePointer(netlink.SCOPE_LINK), netlink.SCOPE_LINK, netlink.SCOPE_LINK},
+	} {
+		testConfig := testConfig
+		desc := fmt.Sprintf("with route scope %v, onlink %v and throw route scope %v",
+			testConfig.expectedScope, testConfig.routeOnLink, testConfig.expectedThrowScope)
+
+		Describe(desc, func() {
+			var wgDataplane *mocknetlink.MockNetlinkDataplane
+			var rtDataplane *mocknetlink.MockNetlinkDataplane
+			var t *mocktime.MockTime
+			var s *mockStatus
+			var wg *Wireguard
+			var routekey_1, routekey_2 string
+			var expectedRoute, expectedThrowRoute netlink.Route
+
+			BeforeEach(func() {
+				wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+				rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+				t = mocktime.NewMockTime()
+				s = &mockStatus{}
+				// Setting an auto-increment greater than the route cleanup delay effectively
+				// disables the grace period for these tests.
+				t.SetAutoIncrement(11 * time.Second)
+
+				wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+				rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+				routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+				routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)
+				expectedRoute = netlink.Route{
+					LinkIndex: linkIndex,
+					Dst:       &ipnet_1,
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  FelixRouteProtocol,
+					Scope:     testConfig.expectedScope,
+					Table:     tableIndex,
+				}
+				if testConfig.routeOnLink {
+					expectedRoute.SetFlag(syscall.RTNH_F_ONLINK)
+				}
+				expectedThrowRoute = netlink.Route{
+					Dst:      &ipnet_2,
+					Type:     syscall.RTN_THROW,
+					Protocol: FelixRouteProtocol,
+					Scope:    testConfig.expectedThrowScope,
+					Table:    tableIndex,
+				}
+
+				wg = NewWithShims(
+					hostname,
+					&Config{
+						Enabled:             true,
+						ListeningPort:       listeningPort,
+						FirewallMark:        firewallMark,
+						RoutingRulePriority: rulePriority,
+						RoutingTableIndex:   tableIndex,
+						InterfaceName:       ifaceName,
+						MTU:                 mtu,
+						RouteScope:          testConfig.routeScope,
+						RouteOnLink:         testConfig.routeOnLink,
+						ThrowRouteScope:     testConfig.throwRouteScope,
+					},
+					rtDataplane.NewMockNetlink,
+					wgDataplane.NewMockNetlink,
+					wgDataplane.NewMockWireguard,
+					nil,
+					10*time.Second,
+					t,
+					FelixRouteProtocol,
+					s.status,
+					nil,
+				)
+
+				wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+				wg.EndpointUpdate(peer1, ipv4_peer1)
+				wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				wg.EndpointUpdate(peer2, ipv4_peer2)
+				wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should program the routes with the configured scope and flags", func() {
+				Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+				Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(expectedRoute))
+				Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(expectedThrowRoute))
+			})
+
+			It("should not update the routes on resync", func() {
+				rtDataplane.ResetDeltas()
+				wg.QueueResync()
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+				Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+			})
+
+			It("should restore the scope and flags after an out-of-band change on resync", func() {
+				// Modify the routes, flipping the onlink flag and changing the scope.
+				modifiedRoute := expectedRoute
+				modifiedRoute.Flags ^= syscall.RTNH_F_ONLINK
+				modifiedRoute.Scope = netlink.SCOPE_HOST
+				rtDataplane.AddMockRoute(&modifiedRoute)
+				modifiedThrowRoute := expectedThrowRoute
+				modifiedThrowRoute.Scope = netlink.SCOPE_HOST
+				rtDataplane.AddMockRoute(&modifiedThrowRoute)
+
+				rtDataplane.ResetDeltas()
+				wg.QueueResync()
+				err := wg.Apply()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_1))
+				Expect(rtDataplane.UpdatedRouteKeys).To(HaveKey(routekey_2))
+				Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(expectedRoute))
+				Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(expectedThrowRoute))
+			})
+		})
+	}
+})
+
+var _ = Describe("Wireguard with multiple routing tables", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		// There is a routing table, and therefore a netlink connection, per table index.
+		rtDataplane.MaxOpenNetlinks = 2
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			RoutingTableIndexByClass: map[RouteClass]int{
+				RouteClassHost: tableIndexHost,
+			},
+			InterfaceName: ifaceName,
+			MTU:           mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	})
+
+	It("should have a route table syncer per routing table", func() {
+		rts := wg.RouteTableSyncers()
+		Expect(rts).To(HaveLen(2))
+		Expect(rts[0].TableIndex()).To(Equal(tableIndex))
+		Expect(rts[1].TableIndex()).To(Equal(tableIndexHost))
+	})
+
+	Describe("with wireguard enabled and a peer", func() {
+		var link *mocknetlink.MockLink
+		var key_peer1 wgtypes.Key
+		var routekey_1, routekey_2, routekey_1_host, routekey_2_host string
+
+		JustBeforeEach(func() {
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			link = wgDataplane.NameToLink[ifaceName]
+			Expect(link).ToNot(BeNil())
+			rtDataplane.NameToLink[ifaceName] = link
+			routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)
+			routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_2)
+			routekey_1_host = fmt.Sprintf("%d-%d-%s", tableIndexHost, link.LinkAttrs.Index, cidr_1)
+			routekey_2_host = fmt.Sprintf("%d-%d-%s", tableIndexHost, link.LinkAttrs.Index, cidr_2)
+
+			wg.EndpointWireguardUpdate(hostname, s.key, nil)
+			key_peer1 = mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_2, RouteClassHost)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should add a routing rule for each routing table", func() {
+			Expect(wgDataplane.NumRuleAddCalls).To(Equal(2))
+			var tables []int
+			for _, rule := range wgDataplane.Rules {
+				if rule.Mark == 0 {
+					// Ignore the default rules.
+					continue
+				}
+				Expect(rule.Mark).To(Equal(firewallMark))
+				Expect(rule.Invert).To(BeTrue())
+				tables = append(tables, rule.Table)
+			}
+			Expect(tables).To(ConsistOf(tableIndex, tableIndexHost))
+		})
+
+		It("should route each CIDR in the routing table for its route class", func() {
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2_host))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_host))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2_host]).To(Equal(netlink.Route{
+				LinkIndex: link.LinkAttrs.Index,
+				Dst:       &ipnet_2,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndexHost,
+			}))
+		})
+
+		It("should move a route between routing tables when the route class changes", func() {
+			rtDataplane.ResetDeltas()
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1, RouteClassHost)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_2, RouteClassWorkload)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_host))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2_host))
+			Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_1))
+			Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routekey_2_host))
+		})
+
+		It("should remove routes from each routing table", func() {
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			wg.EndpointAllowedCIDRRemove(cidr_2)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2_host))
+		})
+	})
+
+	Describe("with wireguard disabled", func() {
+		BeforeEach(func() {
+			config.Enabled = false
+
+			// Create the interface, and rules and routes in each of the routing tables.
+			wgDataplane.AddIface(1, ifaceName, true, true)
+			rtDataplane.AddIface(1, ifaceName, true, true)
+			wgDataplane.Rules = []netlink.Rule{
+				{
+					Priority: 0,
+					Table:    255,
+				},
+				{
+					Table:  tableIndex,
+					Mark:   firewallMark,
+					Invert: true,
+				},
+				{
+					Table:  tableIndexHost,
+					Mark:   firewallMark,
+					Invert: true,
+				},
+			}
+			rtDataplane.AddMockRoute(&netlink.Route{
+				LinkIndex: 1,
+				Dst:       &ipnet_1,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndex,
+			})
+			rtDataplane.AddMockRoute(&netlink.Route{
+				LinkIndex: 1,
+				Dst:       &ipnet_2,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndexHost,
+			})
+		})
+
+		It("should remove the rules and routes for each routing table", func() {
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			Expect(wgDataplane.Rules).To(Equal([]netlink.Rule{
+				{
+					Priority: 0,
+					Table:    255,
+				},
+			}))
+			Expect(rtDataplane.RouteKeyToRoute).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Wireguard underlay interface", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+	var underlay *mocknetlink.MockLink
+	var underlayRule *netlink.Rule
+
+	underlayIfaceName := "eth1"
+	underlayIfaceIndex := 20
+	underlayTableIndex := 101
+	underlayGateway := net.ParseIP("1.2.3.254").To4()
+	underlayRouteKey := fmt.Sprintf("%d-%d-%v", underlayTableIndex, underlayIfaceIndex, nil)
+
+	newWireguard := func() *Wireguard {
+		return NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	// enable creates the wireguard link and sets it up, and configures the endpoint address of this node.
+	enable := func(wg *Wireguard) error {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		return wg.Apply()
+	}
+
+	// markRules returns the programmed rules that match the firewall mark, ignoring the default rules.
+	markRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Mark != 0 {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+	underlayRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range markRules() {
+			if rule.Table == underlayTableIndex {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+
+			UnderlayInterface:         underlayIfaceName,
+			UnderlayRoutingTableIndex: underlayTableIndex,
+		}
+
+		// The underlay interface has a default route through a gateway in the main table.
+		underlay = wgDataplane.AddIface(underlayIfaceIndex, underlayIfaceName, true, true)
+		wgDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: underlayIfaceIndex,
+			Gw:        underlayGateway,
+		})
+
+		underlayRule = netlink.NewRule()
+		underlayRule.Priority = rulePriority
+		underlayRule.Table = underlayTableIndex
+		underlayRule.Mark = firewallMark
+	})
+
+	It("should return an error and not add the underlay rule if the address is not on the interface", func() {
+		wg := newWireguard()
+		err := enable(wg)
+		Expect(err).To(Equal(&UnderlayAddressError{Interface: underlayIfaceName, Address: ipv4_host}))
+		Expect(underlayRules()).To(BeEmpty())
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(underlayRouteKey))
+
+		// The address is verified again on the next apply.
+		err = wg.Apply()
+		Expect(err).To(BeAssignableToTypeOf(&UnderlayAddressError{}))
+
+		underlay.Addrs = []netlink.Addr{{IPNet: &net.IPNet{IP: ipv4_host.AsNetIP(), Mask: net.CIDRMask(24, 32)}}}
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(underlayRules()).To(Equal([]netlink.Rule{*underlayRule}))
+	})
+
+	It("should verify a configured source address instead of the endpoint address", func() {
+		sourceIP := ip.FromString("10.0.0.1")
+		config.UnderlaySourceIP = sourceIP
+		underlay.Addrs = []netlink.Addr{{IPNet: &net.IPNet{IP: ipv4_host.AsNetIP(), Mask: net.CIDRMask(24, 32)}}}
+
+		// The source address is verified as soon as the link is up.
+		wg := newWireguard()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).To(Equal(&UnderlayAddressError{Interface: underlayIfaceName, Address: sourceIP}))
+		Expect(underlayRules()).To(BeEmpty())
+	})
+
+	Describe("with the address on the underlay interface", func() {
+		var wg *Wireguard
+
+		BeforeEach(func() {
+			underlay.Addrs = []netlink.Addr{{IPNet: &net.IPNet{IP: ipv4_host.AsNetIP(), Mask: net.CIDRMask(24, 32)}}}
+			wg = newWireguard()
+			err := enable(wg)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should add the underlay rule alongside the wireguard rule", func() {
+			wireguardRule := netlink.NewRule()
+			wireguardRule.Priority = rulePriority
+			wireguardRule.Table = tableIndex
+			wireguardRule.Mark = firewallMark
+			wireguardRule.Invert = true
+			Expect(markRules()).To(ConsistOf(*wireguardRule, *underlayRule))
+		})
+
+		It("should add a default route through the underlay gateway with the source address", func() {
+			Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(underlayRouteKey))
+			Expect(wgDataplane.RouteKeyToRoute[underlayRouteKey]).To(Equal(netlink.Route{
+				LinkIndex: underlayIfaceIndex,
+				Src:       ipv4_host.AsNetIP(),
+				Gw:        underlayGateway,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Table:     underlayTableIndex,
+			}))
+		})
+
+		It("should not reprogram the underlay rule and route on resync", func() {
+			numRuleAddCalls := wgDataplane.NumRuleAddCalls
+			wgDataplane.ResetDeltas()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.NumRuleAddCalls).To(Equal(numRuleAddCalls))
+			Expect(wgDataplane.AddedRouteKeys).NotTo(HaveKey(underlayRouteKey))
+			Expect(underlayRules()).To(Equal([]netlink.Rule{*underlayRule}))
+		})
+
+		It("should remove the underlay rule and route if the address is removed", func() {
+			underlay.Addrs = nil
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).To(BeAssignableToTypeOf(&UnderlayAddressError{}))
+			Expect(underlayRules()).To(BeEmpty())
+			Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(underlayRouteKey))
+		})
+
+		It("should remove the underlay rule and route when wireguard is disabled", func() {
+			// Start a new instance with wireguard disabled. The old instance still holds its netlink connections, but
+			// the mock only supports one wireguard client, so treat that as closed.
+			config.Enabled = false
+			wgDataplane.MaxOpenNetlinks = 2
+			rtDataplane.MaxOpenNetlinks = 2
+			wgDataplane.WireguardOpen = false
+			wg = newWireguard()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(markRules()).To(BeEmpty())
+			Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(underlayRouteKey))
+		})
+	})
+
+	It("should not add an underlay rule if no underlay interface is configured", func() {
+		config.UnderlayInterface = ""
+		underlay.Addrs = []netlink.Addr{{IPNet: &net.IPNet{IP: ipv4_host.AsNetIP(), Mask: net.CIDRMask(24, 32)}}}
+		err := enable(newWireguard())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(underlayRules()).To(BeEmpty())
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(underlayRouteKey))
+		Expect(markRules()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Wireguard full rebuild", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1, key_peer2 wgtypes.Key
+	var routekey_1, routekey_2 string
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)
+		routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_2)
+
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveLen(2))
+	})
+
+	// seedGarbage modifies the device configuration out-of-band: an extra peer, an extra allowed IP on peer1, the wrong
+	// endpoint port for peer2 and the wrong listening port.
+	seedGarbage := func() {
+		peer := link.WireguardPeers[key_peer1]
+		peer.AllowedIPs = append(peer.AllowedIPs, ipnet_3)
+		link.WireguardPeers[key_peer1] = peer
+		peer = link.WireguardPeers[key_peer2]
+		peer.Endpoint = &net.UDPAddr{IP: ipv4_peer2.AsNetIP(), Port: 1}
+		link.WireguardPeers[key_peer2] = peer
+		key_extra := mustGeneratePrivateKey().PublicKey()
+		link.WireguardPeers[key_extra] = wgtypes.Peer{
+			PublicKey:  key_extra,
+			Endpoint:   &net.UDPAddr{IP: ipv4_peer3.AsNetIP(), Port: listeningPort},
+			AllowedIPs: []net.IPNet{ipnet_4},
+		}
+		link.WireguardListenPort = 2
+	}
+
+	It("should converge the device and routing table in a single apply with a single device configuration", func() {
+		privateKey := link.WireguardPrivateKey
+		seedGarbage()
+
+		// Add an unexpected route on the wireguard interface and a route on another interface to the routing table.
+		rtDataplane.AddIface(50, "eth9", true, true)
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: link.LinkAttrs.Index,
+			Dst:       &ipnet_3,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		})
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: 50,
+			Dst:       &ipnet_4,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		})
+
+		wgDataplane.ResetDeltas()
+		wg.QueueFullRebuild()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(link.WireguardPrivateKey).To(Equal(privateKey))
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(link.WireguardFirewallMark).To(Equal(firewallMark))
+		Expect(link.WireguardPeers).To(Equal(map[wgtypes.Key]wgtypes.Peer{
+			key_peer1: {
+				PublicKey:  key_peer1,
+				Endpoint:   &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: listeningPort},
+				AllowedIPs: []net.IPNet{ipnet_1},
+			},
+			key_peer2: {
+				PublicKey:  key_peer2,
+				Endpoint:   &net.UDPAddr{IP: ipv4_peer2.AsNetIP(), Port: listeningPort},
+				AllowedIPs: []net.IPNet{ipnet_2},
+			},
+		}))
+
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+
+		By("performing a normal resync after the rebuild")
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(0))
+	})
+
+	It("should count the consecutive resyncs that find discrepancies", func() {
+		Expect(wg.DiscrepantResyncs()).To(Equal(0))
+
+		for i := 1; i <= 2; i++ {
+			seedGarbage()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wg.DiscrepantResyncs()).To(Equal(i))
+		}
+
+		By("resetting the count when a resync finds no discrepancies")
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.DiscrepantResyncs()).To(Equal(0))
+
+		By("resetting the count when a full rebuild is queued")
+		seedGarbage()
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.DiscrepantResyncs()).To(Equal(1))
+		wg.QueueFullRebuild()
+		Expect(wg.DiscrepantResyncs()).To(Equal(0))
+	})
+
+	It("should not count a resync that also applies peer updates", func() {
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.DiscrepantResyncs()).To(Equal(0))
+	})
+
+	It("should defer the rebuild until the routing table is applied", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteList | mocknetlink.FailNextRouteDel
+		rtDataplane.PersistFailures = true
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		seedGarbage()
+		wgDataplane.ResetDeltas()
+		wg.QueueFullRebuild()
+		err := wg.Apply()
+		Expect(err).To(HaveOccurred())
+
+		// The allowed IP is still routed so is not removed from peer1.
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ContainElement(ipnet_1))
+
+		rtDataplane.FailuresToSimulate = 0
+		rtDataplane.PersistFailures = false
+		wgDataplane.ResetDeltas()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveLen(2))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(BeEmpty())
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+	})
+})
+
+var _ = Describe("Wireguard userspace fallback", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		config = &Config{
+			Enabled:                 true,
+			ListeningPort:           listeningPort,
+			FirewallMark:            firewallMark,
+			RoutingRulePriority:     rulePriority,
+			RoutingTableIndex:       tableIndex,
+			InterfaceName:           ifaceName,
+			MTU:                     mtu,
+			EnableUserspaceFallback: true,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+
+		// The kernel does not support wireguard.
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkAddNotSupported
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// addUserspaceDevice simulates the userspace implementation creating its tun device.
+	addUserspaceDevice := func(idx int) *mocknetlink.MockLink {
+		link := wgDataplane.AddIface(idx, ifaceName, true, true)
+		link.LinkType = "tun"
+		rtDataplane.NameToLink[ifaceName] = link
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		return link
+	}
+
+	It("should fall back to userspace mode and wait for the device", func() {
+		Expect(wgDataplane.NumLinkAddCalls).To(Equal(1))
+		Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		Expect(wg.Mode()).To(Equal(ModeUserspace))
+		Expect(s.numCallbacks).To(BeZero())
+
+		By("not attempting to create the kernel device again")
+		wgDataplane.ResetDeltas()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+		Expect(wg.Mode()).To(Equal(ModeUserspace))
+	})
+
+	It("should program peers and routes once the userspace device appears", func() {
+		key_peer1 := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardOpen).To(BeFalse())
+
+		link := addUserspaceDevice(50)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(wg.Mode()).To(Equal(ModeUserspace))
+		Expect(link.WireguardPrivateKey).NotTo(Equal(zeroKey))
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(link.WireguardFirewallMark).To(Equal(firewallMark))
+		Expect(link.WireguardPeers).To(HaveLen(1))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).To(Equal(link.WireguardPublicKey))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, 50, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)))
+
+		publicKey, port, name, ok := wg.LocalConfig()
+		Expect(ok).To(BeTrue())
+		Expect(publicKey).To(Equal(link.WireguardPublicKey))
+		Expect(port).To(Equal(listeningPort))
+		Expect(name).To(Equal(ifaceName))
+
+		By("resyncing the userspace device configuration")
+		link.WireguardPeers = nil
+		link.WireguardListenPort = 1000
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1))
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	Context("with a userspace helper", func() {
+		var tempDir, helperOutput string
+
+		// helperCalls returns the interface name passed on each run of the helper.
+		helperCalls := func() []string {
+			out, err := ioutil.ReadFile(helperOutput)
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Fields(string(out))
+		}
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "felix-wireguard-")
+			Expect(err).NotTo(HaveOccurred())
+			helperOutput = filepath.Join(tempDir, "calls")
+			config.UserspaceHelper = filepath.Join(tempDir, "helper")
+			script := "#!/bin/sh\necho $1 >> " + helperOutput + "\n"
+			Expect(ioutil.WriteFile(config.UserspaceHelper, []byte(script), 0700)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+
+		It("should run the helper once until the next resync", func() {
+			Expect(helperCalls()).To(Equal([]string{ifaceName}))
+
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helperCalls()).To(HaveLen(1))
+
+			wg.QueueResync()
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helperCalls()).To(HaveLen(2))
+
+			By("not running the helper once the device exists")
+			addUserspaceDevice(50)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wg.QueueResync()
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helperCalls()).To(HaveLen(2))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPrivateKey).NotTo(Equal(zeroKey))
+		})
+
+		It("should kill the helper once the apply deadline is exceeded, and run it again", func() {
+			slowMarker := filepath.Join(tempDir, "slow")
+			script := "#!/bin/sh\necho $1 >> " + helperOutput + "\nif [ -f " + slowMarker + " ]; then sleep 10; fi\n"
+			Expect(ioutil.WriteFile(config.UserspaceHelper, []byte(script), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(slowMarker, nil, 0600)).To(Succeed())
+			Expect(helperCalls()).To(HaveLen(1))
+
+			wg.QueueResync()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := wg.ApplyWithContext(ctx)
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			deadlineErr, ok := err.(*DeadlineExceededError)
+			Expect(ok).To(BeTrue(), fmt.Sprintf("unexpected error %v", err))
+			Expect(deadlineErr.Step).To(Equal("link"))
+			Expect(helperCalls()).To(HaveLen(2))
+
+			By("running the helper again once it completes in time")
+			Expect(os.Remove(slowMarker)).To(Succeed())
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helperCalls()).To(HaveLen(3))
+		})
+	})
+
+	Context("with the userspace fallback disabled", func() {
+		BeforeEach(func() {
+			config.EnableUserspaceFallback = false
+		})
+
+		It("should treat wireguard as not supported and not accept a tun device", func() {
+			Expect(wg.Mode()).To(Equal(ModeKernel))
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.key).To(Equal(zeroKey))
+
+			addUserspaceDevice(50)
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).To(HaveOccurred())
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPrivateKey).To(Equal(zeroKey))
+		})
+	})
+})
+
+var _ = Describe("Wireguard with another device using the interface name", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+	})
+
+	// addSquattingDevice adds a dummy device using the wireguard interface name, replacing any existing device.
+	addSquattingDevice := func(idx int) {
+		link := wgDataplane.RecreateIface(idx, ifaceName, true, true)
+		link.LinkType = "dummy"
+		rtDataplane.NameToLink[ifaceName] = link
+	}
+
+	Context("with repair disabled", func() {
+		It("should report the wrong link type and publish no public key", func() {
+			addSquattingDevice(5)
+			err := wg.Apply()
+			Expect(err).To(Equal(ErrWrongLinkType))
+			Expect(wgDataplane.NumLinkDeleteCalls).To(BeZero())
+			Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+			Expect(wgDataplane.WireguardOpen).To(BeFalse())
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.key).To(Equal(zeroKey))
+
+			By("not retrying until the next resync")
+			wgDataplane.ResetDeltas()
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.NumNewNetlinkCalls).To(BeZero())
+
+			wg.QueueResync()
+			err = wg.Apply()
+			Expect(err).To(Equal(ErrWrongLinkType))
+			Expect(s.numCallbacks).To(Equal(1))
+
+			By("creating the wireguard device once the other device is removed")
+			delete(wgDataplane.NameToLink, ifaceName)
+			wg.QueueResync()
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			link := wgDataplane.NameToLink[ifaceName]
+			Expect(link.LinkType).To(Equal("wireguard"))
+			Expect(s.numCallbacks).To(Equal(2))
+			Expect(s.key).To(Equal(link.WireguardPublicKey))
+		})
+
+		It("should publish no public key if the wireguard device is replaced", func() {
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.key).NotTo(Equal(zeroKey))
+
+			addSquattingDevice(5)
+			wg.QueueResync()
+			err = wg.Apply()
+			Expect(err).To(Equal(ErrWrongLinkType))
+			Expect(s.numCallbacks).To(Equal(2))
+			Expect(s.key).To(Equal(zeroKey))
+		})
+	})
+
+	Context("with repair enabled", func() {
+		BeforeEach(func() {
+			config.RepairWrongLinkType = true
+		})
+
+		It("should delete the other device and create the wireguard device", func() {
+			addSquattingDevice(5)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.NumLinkDeleteCalls).To(Equal(1))
+			Expect(wgDataplane.NumLinkAddCalls).To(Equal(1))
+			link := wgDataplane.NameToLink[ifaceName]
+			Expect(link.LinkType).To(Equal("wireguard"))
+			Expect(link.LinkAttrs.Index).NotTo(Equal(5))
+
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPrivateKey).NotTo(Equal(zeroKey))
+			Expect(s.key).To(Equal(link.WireguardPublicKey))
+		})
+
+		It("should reprogram routes to the recreated wireguard device", func() {
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			link := wgDataplane.NameToLink[ifaceName]
+			rtDataplane.NameToLink[ifaceName] = link
+
+			key_peer1 := mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)))
+
+			By("replacing the wireguard device with another device")
+			oldIndex := link.LinkAttrs.Index
+			rtDataplane.RecreateIface(oldIndex+10, ifaceName, true, true)
+			addSquattingDevice(oldIndex + 10)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			// The device is recreated with a fresh index. The kernel notifies the interface state changes.
+			link = wgDataplane.NameToLink[ifaceName]
+			Expect(link.LinkType).To(Equal("wireguard"))
+			Expect(link.LinkAttrs.Index).NotTo(Equal(oldIndex))
+			Expect(link.LinkAttrs.Index).NotTo(Equal(oldIndex + 10))
+			wgDataplane.SetIface(ifaceName, true, true)
+			rtDataplane.NameToLink[ifaceName] = link
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(link.WireguardPrivateKey).NotTo(Equal(zeroKey))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, oldIndex, cidr_1)))
+			Expect(s.key).To(Equal(link.WireguardPublicKey))
+		})
+	})
+})
+
+var _ = Describe("Wireguard interface address prefix length", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+	var link *mocknetlink.MockLink
+
+	ifaceAddr := ip.FromString("192.168.10.1")
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+
+		wg.EndpointWireguardUpdate(hostname, s.key, ifaceAddr)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// setLinkAddress replaces the addresses on the wireguard device, as if an admin had changed the address manually.
+	setLinkAddress := func(prefixLen int) {
+		link.Addrs = []netlink.Addr{{
+			IPNet: &net.IPNet{IP: ifaceAddr.AsNetIP(), Mask: net.CIDRMask(prefixLen, 32)},
+		}}
+		wgDataplane.ResetDeltas()
+	}
+
+	// expectStableAcrossResyncs checks that further resyncs do not modify the interface address.
+	expectStableAcrossResyncs := func(expected string) {
+		for i := 0; i < 3; i++ {
+			wgDataplane.ResetDeltas()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.AddedAddrs.Len()).To(BeZero())
+			Expect(wgDataplane.DeletedAddrs.Len()).To(BeZero())
+			Expect(link.Addrs).To(HaveLen(1))
+			Expect(link.Addrs[0].IPNet.String()).To(Equal(expected))
+		}
+	}
+
+	Context("with the default prefix length", func() {
+		It("should program a /32 address", func() {
+			Expect(link.Addrs).To(HaveLen(1))
+			Expect(link.Addrs[0].IPNet.String()).To(Equal("192.168.10.1/32"))
+			expectStableAcrossResyncs("192.168.10.1/32")
+		})
+
+		It("should replace an address with a different prefix length exactly once", func() {
+			setLinkAddress(24)
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.DeletedAddrs.Len()).To(Equal(1))
+			Expect(wgDataplane.DeletedAddrs.Contains("192.168.10.1/24")).To(BeTrue())
+			Expect(wgDataplane.AddedAddrs.Len()).To(Equal(1))
+			Expect(wgDataplane.AddedAddrs.Contains("192.168.10.1/32")).To(BeTrue())
+			expectStableAcrossResyncs("192.168.10.1/32")
+		})
+	})
+
+	Context("with a /24 prefix length", func() {
+		BeforeEach(func() {
+			config.InterfaceAddressPrefixLength = 24
+		})
+
+		It("should program a /24 address and not flap it on resync", func() {
+			Expect(link.Addrs).To(HaveLen(1))
+			Expect(link.Addrs[0].IPNet.String()).To(Equal("192.168.10.1/24"))
+			expectStableAcrossResyncs("192.168.10.1/24")
+		})
+
+		It("should replace a /32 address exactly once", func() {
+			setLinkAddress(32)
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wgDataplane.DeletedAddrs.Len()).To(Equal(1))
+			Expect(wgDataplane.DeletedAddrs.Contains("192.168.10.1/32")).To(BeTrue())
+			Expect(wgDataplane.AddedAddrs.Len()).To(Equal(1))
+			Expect(wgDataplane.AddedAddrs.Contains("192.168.10.1/24")).To(BeTrue())
+			expectStableAcrossResyncs("192.168.10.1/24")
+		})
+	})
+
+	Context("with a prefix length longer than the address", func() {
+		BeforeEach(func() {
+			config.InterfaceAddressPrefixLength = 64
+		})
+
+		It("should program a /32 address", func() {
+			Expect(link.Addrs).To(HaveLen(1))
+			Expect(link.Addrs[0].IPNet.String()).To(Equal("192.168.10.1/32"))
+		})
+	})
+})
+
+var _ = Describe("Wireguard migration requiring peers to be ready", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1 wgtypes.Key
+	var routekey_1, routekey_1_throw string
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				RequirePeerReady:    true,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)
+		routekey_1_throw = fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+
+		// Peer1 has published its key, but has not yet switched to wireguard.
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should use a throw route for a peer with a key that is not ready", func() {
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+
+		By("resyncing while the peer is not ready")
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+	})
+
+	It("should flip the route to wireguard exactly when the peer becomes ready", func() {
+		By("marking the peer as not ready, which is a no-op")
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardReady(peer1, false)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+
+		By("marking the peer as ready")
+		wg.EndpointWireguardReady(peer1, true)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+		Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_1))
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+
+		By("marking the peer as not ready again")
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardReady(peer1, false)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+		Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routekey_1_throw))
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+	})
+
+	It("should clear the ready status when the peer's wireguard configuration is removed", func() {
+		wg.EndpointWireguardReady(peer1, true)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+
+		wg.EndpointWireguardRemove(peer1)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+
+		By("re-adding the key without the peer being ready")
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+	})
+
+	It("should not program a ready peer until its key is known", func() {
+		wg.EndpointWireguardRemove(peer1)
+		wg.EndpointWireguardReady(peer1, true)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+	})
+})
+
+var _ = Describe("Wireguard peer and allowed IP limits", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)
+	}
+	routekeyThrow := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+	})
+
+	Describe("with more peers than fit in a single device configuration", func() {
+		const numPeers = 250
+		var keys []wgtypes.Key
+
+		JustBeforeEach(func() {
+			wgDataplane.MaxPeersPerWireguardConfigure = 100
+			keys = nil
+			for i := 0; i < numPeers; i++ {
+				name := fmt.Sprintf("peer-%03d", i)
+				key := mustGeneratePrivateKey().PublicKey()
+				keys = append(keys, key)
+				wg.EndpointWireguardUpdate(name, key, nil)
+				wg.EndpointUpdate(name, ip.FromString(fmt.Sprintf("10.10.%d.%d", i/200, i%200+1)))
+				wg.EndpointAllowedCIDRAdd(name, ip.MustParseCIDROrIP(fmt.Sprintf("172.16.%d.0/24", i)))
+			}
+			wgDataplane.ResetDeltas()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should configure the peers in batches", func() {
+			Expect(link.WireguardPeers).To(HaveLen(numPeers))
+			for _, key := range keys {
+				Expect(link.WireguardPeers).To(HaveKey(key))
+			}
+			Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(3))
+		})
+
+		It("should configure the peers in batches on a resync", func() {
+			link.WireguardPeers = nil
+			wgDataplane.ResetDeltas()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(numPeers))
+			Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(3))
+		})
+	})
+
+	Describe("with a maximum number of peers", func() {
+		var key_peer1, key_peer2, key_peer3 wgtypes.Key
+
+		BeforeEach(func() {
+			config.MaxPeers = 2
+		})
+
+		JustBeforeEach(func() {
+			// Add the peers in reverse order, the selection is by node name.
+			key_peer1 = mustGeneratePrivateKey().PublicKey()
+			key_peer2 = mustGeneratePrivateKey().PublicKey()
+			key_peer3 = mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+			wg.EndpointUpdate(peer3, ipv4_peer3)
+			wg.EndpointAllowedCIDRAdd(peer3, cidr_3)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+			wg.EndpointUpdate(peer2, ipv4_peer2)
+			wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only program the first peers by node name", func() {
+			Expect(link.WireguardPeers).To(HaveLen(2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_2)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_3)))
+			Expect(wg.LimitError()).To(Equal(&LimitExceededError{SkippedPeers: 1}))
+		})
+
+		It("should keep the same selection on a resync", func() {
+			wgDataplane.ResetDeltas()
+			rtDataplane.ResetDeltas()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(2))
+			Expect(link.WireguardPeers).NotTo(HaveKey(key_peer3))
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		})
+
+		It("should program a skipped peer once there is room", func() {
+			wg.EndpointRemove(peer1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_3)))
+			Expect(wg.LimitError()).NotTo(HaveOccurred())
+		})
+
+		It("should skip a programmed peer when a peer earlier in the selection is added", func() {
+			wg.EndpointRemove(peer1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			err = wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(link.WireguardPeers).NotTo(HaveKey(key_peer3))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_3)))
+		})
+
+		It("should not count peers that cannot be programmed", func() {
+			wg.EndpointDrain(peer1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+			Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+			Expect(wg.LimitError()).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("with a maximum number of allowed IPs per peer", func() {
+		var key_peer1 wgtypes.Key
+
+		BeforeEach(func() {
+			config.MaxAllowedIPsPerPeer = 2
+		})
+
+		JustBeforeEach(func() {
+			key_peer1 = mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only program the first CIDRs", func() {
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_2)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_3)))
+			Expect(wg.LimitError()).To(Equal(&LimitExceededError{SkippedAllowedIPs: 1}))
+		})
+
+		It("should replace a CIDR that is earlier in the selection", func() {
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_4)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_1)))
+			Expect(wg.LimitError()).To(Equal(&LimitExceededError{SkippedAllowedIPs: 1}))
+		})
+
+		It("should program a skipped CIDR once there is room", func() {
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_3)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_1)))
+			Expect(wg.LimitError()).NotTo(HaveOccurred())
+		})
+
+		It("should correct the programmed CIDRs on a resync", func() {
+			peer := link.WireguardPeers[key_peer1]
+			peer.AllowedIPs = []net.IPNet{ipnet_1, ipnet_2, ipnet_3}
+			link.WireguardPeers[key_peer1] = peer
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+		})
+	})
+})
+
+var _ = Describe("Wireguard excluded CIDRs", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1 wgtypes.Key
+
+	// cidr_1 is within the first exclusion and cidr_2 partially overlaps the second exclusion.
+	excludeCIDRs := []ip.CIDR{
+		ip.MustParseCIDROrIP("192.168.0.0/23"),
+		ip.MustParseCIDROrIP("192.168.2.128/25"),
+	}
+	cidr_excluded := ip.MustParseCIDROrIP("192.168.0.64/26")
+
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)
+	}
+	routekeyThrow := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr)
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectExcluded := func(cidrs ...ip.CIDR) {
+		for _, cidr := range cidrs {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr)))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).NotTo(ContainElement(cidr.ToIPNet()))
+		}
+	}
+	expectIncluded := func(cidrs ...ip.CIDR) {
+		for _, cidr := range cidrs {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr)))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ContainElement(cidr.ToIPNet()))
+		}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		apply()
+	})
+
+	Describe("with the exclusions configured before the CIDRs are added", func() {
+		BeforeEach(func() {
+			config.ExcludeCIDRs = excludeCIDRs
+		})
+
+		It("should program throw routes for the excluded and overlapping CIDRs", func() {
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_3))
+			expectExcluded(cidr_1, cidr_2)
+			expectIncluded(cidr_3)
+		})
+
+		It("should exclude a CIDR added to a programmed peer", func() {
+			wgDataplane.ResetDeltas()
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_excluded)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_3, ipnet_4))
+			expectExcluded(cidr_1, cidr_2, cidr_excluded)
+			expectIncluded(cidr_3, cidr_4)
+		})
+
+		It("should not reconfigure the peer when only an excluded CIDR is added", func() {
+			wgDataplane.ResetDeltas()
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_excluded)
+			apply()
+			Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+			expectExcluded(cidr_excluded)
+		})
+
+		It("should remove the throw route of a removed excluded CIDR", func() {
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_1)))
+		})
+
+		It("should keep the exclusions on a resync", func() {
+			peer := link.WireguardPeers[key_peer1]
+			peer.AllowedIPs = []net.IPNet{ipnet_1, ipnet_2, ipnet_3}
+			link.WireguardPeers[key_peer1] = peer
+			wg.QueueResync()
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_3))
+			expectExcluded(cidr_1, cidr_2)
+		})
+
+		It("should include the CIDRs when the exclusions are removed", func() {
+			wg.UpdateConfig(&Config{})
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_3))
+			expectIncluded(cidr_1, cidr_2, cidr_3)
+		})
+
+		It("should remove a CIDR whose exclusion is removed in the same apply", func() {
+			wg.UpdateConfig(&Config{})
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_1)))
+		})
+	})
+
+	Describe("with the exclusions configured after the CIDRs are added", func() {
+		It("should initially include all of the CIDRs", func() {
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_3))
+			expectIncluded(cidr_1, cidr_2, cidr_3)
+		})
+
+		It("should reclassify the CIDRs when the exclusions are configured", func() {
+			wg.UpdateConfig(&Config{ExcludeCIDRs: excludeCIDRs})
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_3))
+			expectExcluded(cidr_1, cidr_2)
+			expectIncluded(cidr_3)
+		})
+
+		It("should reclassify the CIDRs when the exclusions are changed", func() {
+			wg.UpdateConfig(&Config{ExcludeCIDRs: excludeCIDRs})
+			apply()
+			wg.UpdateConfig(&Config{ExcludeCIDRs: []ip.CIDR{cidr_3}})
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+			expectExcluded(cidr_3)
+			expectIncluded(cidr_1, cidr_2)
+		})
+
+		It("should exclude a CIDR added in the same apply as the exclusions", func() {
+			wg.UpdateConfig(&Config{ExcludeCIDRs: excludeCIDRs})
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_excluded)
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_3))
+			expectExcluded(cidr_1, cidr_2, cidr_excluded)
+		})
+	})
+})
+
+var _ = Describe("Wireguard routing table ownership", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var strict bool
+	var userRoute_1, userThrowRoute_2, userThrowRoute_3 netlink.Route
+	var routekey_1, routekey_2, routekey_3 string
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		// The routing table is shared with static routes for the CIDR of a wireguard peer, the CIDR of a peer that does
+		// not support wireguard, and a CIDR that is not a peer CIDR.
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		userRoute_1 = netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipnet_1,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  syscall.RTPROT_STATIC,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		}
+		rtDataplane.AddMockRoute(&userRoute_1)
+		userThrowRoute_2 = netlink.Route{
+			Dst:      &ipnet_2,
+			Type:     syscall.RTN_THROW,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		}
+		rtDataplane.AddMockRoute(&userThrowRoute_2)
+		userThrowRoute_3 = netlink.Route{
+			Dst:      &ipnet_3,
+			Type:     syscall.RTN_THROW,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		}
+		rtDataplane.AddMockRoute(&userThrowRoute_3)
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_2)
+		routekey_3 = fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_3)
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:              true,
+				ListeningPort:        listeningPort,
+				FirewallMark:         firewallMark,
+				RoutingRulePriority:  rulePriority,
+				RoutingTableIndex:    tableIndex,
+				InterfaceName:        ifaceName,
+				MTU:                  mtu,
+				StrictTableOwnership: strict,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("with strict ownership", func() {
+		BeforeEach(func() {
+			strict = true
+		})
+
+		It("should replace the conflicting routes and remove the other routes", func() {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1].Protocol).To(Equal(FelixRouteProtocol))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2].Protocol).To(Equal(FelixRouteProtocol))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_3))
+		})
+	})
+
+	Describe("without strict ownership", func() {
+		BeforeEach(func() {
+			strict = false
+		})
+
+		It("should leave the routes with another protocol in place", func() {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(3))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(userRoute_1))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(userThrowRoute_2))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_3]).To(Equal(userThrowRoute_3))
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+
+			By("resyncing")
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		})
+
+		It("should leave a conflicting route in place when the peer CIDR is removed", func() {
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			wg.EndpointRemove(peer2)
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(3))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(userRoute_1))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(userThrowRoute_2))
+		})
+
+		It("should program our routes once the conflicting routes are removed", func() {
+			rtDataplane.RemoveMockRoute(&userRoute_1)
+			rtDataplane.RemoveMockRoute(&userThrowRoute_2)
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rtDataplane.RouteKeyToRoute[routekey_1].Protocol).To(Equal(FelixRouteProtocol))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_2].Protocol).To(Equal(FelixRouteProtocol))
+			Expect(rtDataplane.RouteKeyToRoute[routekey_3]).To(Equal(userThrowRoute_3))
+		})
+	})
+})
+
+var _ = Describe("Wireguard route priority", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var strict bool
+	var backupRoute_1, backupRoute_2 netlink.Route
+
+	const linkIndex = 10
+
+	newWireguard := func(priority int) *Wireguard {
+		return NewWithShims(
+			hostname,
+			&Config{
+				Enabled:              true,
+				ListeningPort:        listeningPort,
+				FirewallMark:         firewallMark,
+				RoutingRulePriority:  rulePriority,
+				RoutingTableIndex:    tableIndex,
+				InterfaceName:        ifaceName,
+				MTU:                  mtu,
+				StrictTableOwnership: strict,
+				RoutePriority:        priority,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	applyPeers := func() {
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	routeKey := func(linkIndex int, cidr ip.CIDR, priority int) string {
+		return fmt.Sprintf("%d-%d-%s-%d", tableIndex, linkIndex, cidr, priority)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		// The routing table contains lower preference backup routes for the peer CIDRs, which throw the traffic back
+		// to the main routing table.
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		backupRoute_1 = netlink.Route{
+			Dst:      &ipnet_1,
+			Type:     syscall.RTN_THROW,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+			Priority: 200,
+		}
+		rtDataplane.AddMockRoute(&backupRoute_1)
+		backupRoute_2 = netlink.Route{
+			Dst:      &ipnet_2,
+			Type:     syscall.RTN_THROW,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+			Priority: 200,
+		}
+		rtDataplane.AddMockRoute(&backupRoute_2)
+	})
+
+	JustBeforeEach(func() {
+		wg = newWireguard(100)
+		applyPeers()
+	})
+
+	Describe("without strict ownership", func() {
+		BeforeEach(func() {
+			strict = false
+		})
+
+		It("should program our routes alongside the backup routes", func() {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(4))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_1, 100)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_2, 100)))
+			Expect(rtDataplane.RouteKeyToRoute[routeKey(0, cidr_1, 200)]).To(Equal(backupRoute_1))
+			Expect(rtDataplane.RouteKeyToRoute[routeKey(0, cidr_2, 200)]).To(Equal(backupRoute_2))
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+
+			By("resyncing")
+			rtDataplane.ResetDeltas()
+			wg.QueueResync()
+			err := wg.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		})
+
+		It("should replace each route once when restarted with a new priority", func() {
+			// The netlink and wireguard handles of the previous instance are closed when its process exits.
+			for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+				dp.NumOpenNetlinks = 0
+				dp.NetlinkOpen = false
+				dp.WireguardOpen = false
+			}
+			rtDataplane.ResetDeltas()
+			wg = newWireguard(50)
+			applyPeers()
+
+			var routeCalls []string
+			for _, call := range rtDataplane.Calls {
+				if call == "RouteAdd" || call == "RouteDel" || call == "RouteReplace" {
+					routeCalls = append(routeCalls, call)
+				}
+			}
+			Expect(routeCalls).To(Equal([]string{"RouteAdd", "RouteDel", "RouteAdd", "RouteDel"}))
+			Expect(rtDataplane.AddedRouteKeys).To(HaveLen(2))
+			Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routeKey(linkIndex, cidr_1, 50)))
+			Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routeKey(0, cidr_2, 50)))
+			Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(2))
+			Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routeKey(linkIndex, cidr_1, 100)))
+			Expect(rtDataplane.DeletedRouteKeys).To(HaveKey(routeKey(0, cidr_2, 100)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(4))
+			Expect(rtDataplane.RouteKeyToRoute[routeKey(0, cidr_1, 200)]).To(Equal(backupRoute_1))
+			Expect(rtDataplane.RouteKeyToRoute[routeKey(0, cidr_2, 200)]).To(Equal(backupRoute_2))
+		})
+	})
+
+	Describe("with strict ownership", func() {
+		BeforeEach(func() {
+			strict = true
+		})
+
+		It("should remove the backup routes", func() {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_1, 100)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_2, 100)))
+		})
+	})
+})
+
+var _ = Describe("Wireguard peer statistics", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	resync := func() map[string]PeerDiagnostics {
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		return wg.PeerDiagnostics()
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		wgDataplane.Time = t
+		wgDataplane.AddIface(10, ifaceName, true, true)
+		rtDataplane.AddIface(10, ifaceName, true, true)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                 true,
+				ListeningPort:           listeningPort,
+				FirewallMark:            firewallMark,
+				RoutingRulePriority:     rulePriority,
+				RoutingTableIndex:       tableIndex,
+				InterfaceName:           ifaceName,
+				MTU:                     mtu,
+				StaleHandshakeThreshold: time.Minute,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should report the handshake time and traffic counters of a peer after a resync", func() {
+		diags := resync()
+		Expect(diags[peer1].HandshakeState).To(Equal(HandshakeStateNone))
+		Expect(diags[peer1].ReceiveBytes).To(BeZero())
+		Expect(diags[peer1].TransmitBytes).To(BeZero())
+
+		handshake := t.Now()
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		wgDataplane.AddWireguardPeerTraffic(ifaceName, key_peer1, 1000, 2000)
+		wgDataplane.AddWireguardPeerTraffic(ifaceName, key_peer1, 500, 0)
+
+		// The statistics are only read from the device on a resync.
+		Expect(wg.PeerDiagnostics()[peer1].ReceiveBytes).To(BeZero())
+
+		diags = resync()
+		Expect(diags[peer1]).To(Equal(PeerDiagnostics{
+			PublicKey:          key_peer1,
+			ConfiguredEndpoint: &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: 1000},
+			KernelEndpoint:     &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: 1000},
+			LastHandshakeTime:  handshake,
+			HandshakeState:     HandshakeStateRecent,
+			ReceiveBytes:       1500,
+			TransmitBytes:      2000,
+		}))
+	})
+
+	It("should flag a peer with no handshake for longer than the configured threshold as stale", func() {
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		diags := resync()
+		Expect(diags[peer1].HandshakeState).To(Equal(HandshakeStateRecent))
+
+		t.IncrementTime(50 * time.Second)
+		Expect(wg.PeerDiagnostics()[peer1].HandshakeState).To(Equal(HandshakeStateRecent))
+
+		t.IncrementTime(20 * time.Second)
+		Expect(wg.PeerDiagnostics()[peer1].HandshakeState).To(Equal(HandshakeStateStale))
+
+		By("completing a new handshake")
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		diags = resync()
+		Expect(diags[peer1].HandshakeState).To(Equal(HandshakeStateRecent))
+	})
+
+	It("should report the statistics of a stale device read until the next resync", func() {
+		wgDataplane.AddWireguardPeerTraffic(ifaceName, key_peer1, 1000, 2000)
+		diags := resync()
+		Expect(diags[peer1].ReceiveBytes).To(Equal(int64(1000)))
+
+		wgDataplane.AddWireguardPeerTraffic(ifaceName, key_peer1, 1000, 2000)
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardDeviceByNameStale
+		diags = resync()
+		Expect(diags[peer1].ReceiveBytes).To(Equal(int64(1000)))
+		Expect(diags[peer1].TransmitBytes).To(Equal(int64(2000)))
+
+		diags = resync()
+		Expect(diags[peer1].ReceiveBytes).To(Equal(int64(2000)))
+		Expect(diags[peer1].TransmitBytes).To(Equal(int64(4000)))
+	})
+})
+
+var _ = Describe("Wireguard listening port migration", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_local, key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+	newListeningPort := listeningPort + 1
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		// Simulate a restart after a change of listening port. The wireguard link exists with our key and the old
+		// listening port.
+		privateKey := mustGeneratePrivateKey()
+		key_local = privateKey.PublicKey()
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		link = wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		link.WireguardPrivateKey = privateKey
+		link.WireguardPublicKey = key_local
+		link.WireguardListenPort = listeningPort
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       newListeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+
+		// Neither peer has migrated to the new port yet. Peer 2 does not report its port.
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil, listeningPort)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should program the new port and publish it with our key and interface name", func() {
+		Expect(link.WireguardPrivateKey.PublicKey()).To(Equal(key_local))
+		Expect(link.WireguardListenPort).To(Equal(newListeningPort))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).To(Equal(key_local))
+		Expect(s.port).To(Equal(newListeningPort))
+		Expect(s.ifaceName).To(Equal(ifaceName))
+	})
+
+	It("should use the reported port for a peer and the local port for a peer that does not report its port", func() {
+		Expect(link.WireguardPeers[key_peer1].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer1.AsNetIP(),
+			Port: listeningPort,
+		}))
+		Expect(link.WireguardPeers[key_peer2].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer2.AsNetIP(),
+			Port: newListeningPort,
+		}))
+	})
+
+	It("should only reprogram the endpoint of a peer that announces its new port", func() {
+		wgDataplane.ResetDeltas()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil, newListeningPort)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.ConfiguredWireguardPeers.Len()).To(Equal(1))
+		Expect(wgDataplane.ConfiguredWireguardPeers.Contains(key_peer1)).To(BeTrue())
+		Expect(link.WireguardPeers[key_peer1].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer1.AsNetIP(),
+			Port: newListeningPort,
+		}))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(Equal([]net.IPNet{ipnet_1}))
+
+		By("resyncing")
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+	})
+
+	It("should revert to the local port when a peer stops reporting its port", func() {
+		wgDataplane.ResetDeltas()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.ConfiguredWireguardPeers.Len()).To(Equal(1))
+		Expect(link.WireguardPeers[key_peer1].Endpoint.Port).To(Equal(newListeningPort))
+	})
+
+	It("should fix the endpoint port of a peer on resync", func() {
+		peer := link.WireguardPeers[key_peer1]
+		peer.Endpoint = &net.UDPAddr{IP: ipv4_peer1.AsNetIP(), Port: newListeningPort}
+		link.WireguardPeers[key_peer1] = peer
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.ConfiguredWireguardPeers.Len()).To(Equal(1))
+		Expect(link.WireguardPeers[key_peer1].Endpoint.Port).To(Equal(listeningPort))
+	})
+
+	It("should publish again if the datastore has the old port", func() {
+		By("echoing the new port")
+		wg.EndpointWireguardUpdate(hostname, key_local, nil, newListeningPort)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(1))
+
+		By("overwriting the datastore with the old port")
+		wg.EndpointWireguardUpdate(hostname, key_local, nil, listeningPort)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.port).To(Equal(newListeningPort))
+
+		By("echoing the key without a port")
+		wg.EndpointWireguardUpdate(hostname, key_local, nil)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(2))
+	})
+})
+
+var _ = Describe("Wireguard apply ordering", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1, key_peer2, key_peer3 wgtypes.Key
+	var routekey_1, routekey_2, routekey_3, routekey_4 string
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		link = wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		key_peer3 = mustGeneratePrivateKey().PublicKey()
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)
+		routekey_3 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_3)
+		routekey_4 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_4)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		// Peer 3 does not support wireguard, so is routed with a throw route.
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		wg.EndpointUpdate(peer3, ipv4_peer3)
+		wg.EndpointAllowedCIDRAdd(peer3, cidr_4)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_3))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4_throw))
+	})
+
+	It("should not route a new CIDR to wireguard until it is an allowed IP of the peer", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_5)
+		err := wg.Apply()
+		Expect(err).To(HaveOccurred())
+		Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(Equal([]net.IPNet{cidr_3.ToIPNet()}))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_5)))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(Equal([]net.IPNet{cidr_3.ToIPNet(), cidr_5.ToIPNet()}))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_5)))
+	})
+
+	It("should keep the throw route for a peer until the peer is programmed in wireguard", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		err := wg.Apply()
+		Expect(err).To(HaveOccurred())
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer3))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4_throw))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_4))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_4_throw))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4))
+	})
+
+	It("should not remove an allowed IP of a peer until the route to wireguard is removed", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDel
+		rtDataplane.PersistFailures = true
+		wg.EndpointAllowedCIDRRemove(cidr_2)
+		err := wg.Apply()
+		Expect(err).To(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(Equal([]net.IPNet{cidr_1.ToIPNet(), cidr_2.ToIPNet()}))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		rtDataplane.PersistFailures = false
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(Equal([]net.IPNet{cidr_1.ToIPNet()}))
+	})
+
+	It("should not remove a peer until its routes to wireguard are removed, and still program other peers", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDel | mocknetlink.FailNextRouteReplace
+		rtDataplane.PersistFailures = true
+		wg.EndpointWireguardRemove(peer2)
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		err := wg.Apply()
+		Expect(err).To(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_3))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		rtDataplane.PersistFailures = false
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_3))
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer2))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer3))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4))
+	})
+})
+
+var _ = Describe("Wireguard interface address source", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+
+	pool := ip.MustParseCIDROrIP("10.100.0.0/16")
+	ipv4_datastore := ip.FromString("10.200.0.1")
+
+	newWireguard := func(hostname string) *Wireguard {
+		return NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	// enable creates the wireguard link and sets it up, so that our public key is published.
+	enable := func(wg *Wireguard) {
+		Expect(wg.Apply()).To(Succeed())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+	}
+
+	linkAddrs := func() []net.IP {
+		var addrs []net.IP
+		for _, addr := range wgDataplane.NameToLink[ifaceName].Addrs {
+			addrs = append(addrs, addr.IP)
+		}
+		return addrs
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		t.SetAutoIncrement(11 * time.Second)
+
+		// Our key is published before our node IP is known, so that the updates of the published address are seen.
+		config = &Config{
+			Enabled:                   true,
+			ListeningPort:             listeningPort,
+			FirewallMark:              firewallMark,
+			RoutingRulePriority:       rulePriority,
+			RoutingTableIndex:         tableIndex,
+			InterfaceName:             ifaceName,
+			MTU:                       mtu,
+			PublishKeyWithoutEndpoint: true,
+		}
+	})
+
+	It("should derive the same address in the pool for the same hostname", func() {
+		addr := DeriveInterfaceAddr(pool, hostname)
+		Expect(addr).NotTo(BeNil())
+		Expect(pool.(ip.V4CIDR).ContainsV4(addr.(ip.V4Addr))).To(BeTrue())
+		Expect(addr).NotTo(Equal(pool.Addr()))
+		Expect(addr).NotTo(Equal(ip.FromString("10.100.255.255")))
+		Expect(DeriveInterfaceAddr(pool, hostname)).To(Equal(addr))
+		Expect(DeriveInterfaceAddr(pool, "other-host")).NotTo(Equal(addr))
+
+		// Small pools use all of their addresses, and there is no address without an IPv4 pool.
+		Expect(DeriveInterfaceAddr(ip.MustParseCIDROrIP("10.0.0.7/32"), hostname)).To(Equal(ip.FromString("10.0.0.7")))
+		Expect([]ip.Addr{ip.FromString("10.0.0.6"), ip.FromString("10.0.0.7")}).To(
+			ContainElement(DeriveInterfaceAddr(ip.MustParseCIDROrIP("10.0.0.6/31"), hostname)))
+		Expect(DeriveInterfaceAddr(nil, hostname)).To(BeNil())
+		Expect(DeriveInterfaceAddr(ip.MustParseCIDROrIP("fd00::/64"), hostname)).To(BeNil())
+	})
+
+	It("should use the address from the datastore and not publish it by default", func() {
+		wg := newWireguard(hostname)
+		enable(wg)
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.ifaceAddr).To(BeNil())
+
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_datastore)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{ipv4_datastore.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	It("should use the node IP, ignoring the address in the datastore", func() {
+		config.InterfaceAddressSource = InterfaceAddressSourceNodeIP
+		wg := newWireguard(hostname)
+		enable(wg)
+		Expect(linkAddrs()).To(BeEmpty())
+
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_datastore)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{ipv4_host.AsNetIP()}))
+
+		// The address is published with our key, until the datastore has the address.
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.ifaceAddr).To(Equal(ipv4_host))
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_host)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(s.numCallbacks).To(Equal(2))
+
+		// A new node IP is published and replaces the old address.
+		wg.EndpointUpdate(hostname, ipv4_peer1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{ipv4_peer1.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(3))
+		Expect(s.ifaceAddr).To(Equal(ipv4_peer1))
+	})
+
+	It("should program and publish the same derived address after a restart", func() {
+		config.InterfaceAddressSource = InterfaceAddressSourceDerived
+		config.InterfaceAddressPool = pool
+		derived := DeriveInterfaceAddr(pool, hostname)
+
+		wg := newWireguard(hostname)
+		enable(wg)
+		Expect(linkAddrs()).To(Equal([]net.IP{derived.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.ifaceAddr).To(Equal(derived))
+
+		// Once the publish has been echoed, a different address in the datastore is overwritten by publishing again.
+		wg.EndpointWireguardUpdate(hostname, s.key, derived)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(s.numCallbacks).To(Equal(1))
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_datastore)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{derived.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.ifaceAddr).To(Equal(derived))
+
+		// After a restart on a new dataplane the same address is programmed and published.
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wg = newWireguard(hostname)
+		enable(wg)
+		Expect(linkAddrs()).To(Equal([]net.IP{derived.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.ifaceAddr).To(Equal(derived))
+	})
+
+	It("should replace the old address when the source is changed", func() {
+		config.InterfaceAddressSource = InterfaceAddressSourceDerived
+		config.InterfaceAddressPool = pool
+		derived := DeriveInterfaceAddr(pool, hostname)
+		wg := newWireguard(hostname)
+		enable(wg)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.EndpointWireguardUpdate(hostname, s.key, derived)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{derived.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(1))
+
+		// Switching to the node IP replaces the derived address, and publishes the node IP.
+		wg.UpdateConfig(&Config{InterfaceAddressSource: InterfaceAddressSourceNodeIP})
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{ipv4_host.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.ifaceAddr).To(Equal(ipv4_host))
+
+		// Switching to the datastore replaces the node IP with the address from the datastore, which is not published.
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_datastore)
+		wg.UpdateConfig(&Config{})
+		Expect(wg.Apply()).To(Succeed())
+		Expect(linkAddrs()).To(Equal([]net.IP{ipv4_datastore.AsNetIP()}))
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+})
+
+var _ = Describe("Wireguard apply deadline", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1 wgtypes.Key
+	var routekey_1 string
+
+	const linkIndex = 10
+	const applyTimeout = 50 * time.Millisecond
+
+	expectDeadlineExceeded := func(err error, step string) {
+		Expect(err).To(HaveOccurred())
+		deadlineErr, ok := err.(*DeadlineExceededError)
+		Expect(ok).To(BeTrue(), fmt.Sprintf("unexpected error %v", err))
+		Expect(deadlineErr.Step).To(Equal(step))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		link = wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				ApplyTimeout:        applyTimeout,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+	})
+
+	It("should apply everything within the deadline", func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+	})
+
+	It("should make no calls if the context is already cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := wg.ApplyWithContext(ctx)
+		expectDeadlineExceeded(err, "link")
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(wgDataplane.Calls).To(BeEmpty())
+		Expect(rtDataplane.Calls).To(BeEmpty())
+
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+	})
+
+	It("should not block beyond the deadline on a slow route update", func() {
+		rtDataplane.CallLatency = map[string]time.Duration{"RouteAdd": 2 * time.Second}
+		start := time.Now()
+		err := wg.Apply()
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		expectDeadlineExceeded(err, "routes")
+
+		// The wireguard configuration and the rule were not attempted.
+		Expect(wgDataplane.Calls).NotTo(ContainElement("ConfigureDevice"))
+		Expect(wgDataplane.Calls).NotTo(ContainElement("RuleAdd"))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+
+		// The socket timeout of the routing table is restored.
+		Expect(rtDataplane.SocketTimeout).To(Equal(10 * time.Second))
+
+		// The updates remain dirty and are applied by the next Apply.
+		rtDataplane.CallLatency = nil
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+	})
+
+	It("should keep the progress made before the deadline and skip the remaining steps", func() {
+		// The wireguard device configuration cannot be interrupted, so it completes after the deadline.
+		wgDataplane.CallLatency = map[string]time.Duration{"ConfigureDevice": 2 * applyTimeout}
+		err := wg.Apply()
+		expectDeadlineExceeded(err, "rule")
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+
+		// The rule is not checked after the deadline.
+		Expect(wgDataplane.Calls).NotTo(ContainElement("RuleList"))
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+
+		// The next Apply only adds the rule.
+		wgDataplane.CallLatency = nil
+		wgDataplane.ResetDeltas()
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+		Expect(wgDataplane.Calls).NotTo(ContainElement("ConfigureDevice"))
+	})
+})
+
+var _ = Describe("Wireguard not supported re-probe", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+	var wg *Wireguard
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.ImmediateLinkUp = true
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+
+		config = &Config{
+			Enabled:                     true,
+			ListeningPort:               listeningPort,
+			FirewallMark:                firewallMark,
+			RoutingRulePriority:         rulePriority,
+			RoutingTableIndex:           tableIndex,
+			InterfaceName:               ifaceName,
+			MTU:                         mtu,
+			NotSupportedReprobeInterval: 30 * time.Minute,
+		}
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+	})
+
+	for _, testFailFlags := range []mocknetlink.FailFlags{
+		mocknetlink.FailNextLinkAddNotSupported, mocknetlink.FailNextNewWireguardNotSupported,
+	} {
+		failFlags := testFailFlags
+
+		Describe(fmt.Sprintf("with wireguard not supported (%v)", failFlags), func() {
+			// numProbes returns the number of times wireguard support has been probed since the deltas were reset.
+			numProbes := func() int {
+				if failFlags == mocknetlink.FailNextLinkAddNotSupported {
+					return wgDataplane.NumLinkAddCalls
+				}
+				return wgDataplane.NumNewWireguardCalls
+			}
+
+			// expectNotSupported checks wireguard is reported as not supported, with the re-probe after the delay.
+			expectNotSupported := func(reprobeAfter time.Duration) {
+				Expect(wg.Active()).To(BeFalse())
+				Expect(s.key).To(Equal(zeroKey))
+				notSupported, reprobeTime := wg.NotSupported()
+				Expect(notSupported).To(BeTrue())
+				Expect(reprobeTime).To(Equal(t.Now().Add(reprobeAfter)))
+				Expect(wg.ReprobeAfter()).To(Equal(reprobeAfter))
+			}
+
+			BeforeEach(func() {
+				if failFlags == mocknetlink.FailNextNewWireguardNotSupported {
+					// The wireguard client is only created once the link exists.
+					wgDataplane.AddIface(10, ifaceName, true, true)
+				}
+				wgDataplane.FailuresToSimulate = failFlags
+				Expect(wg.Apply()).To(Succeed())
+				Expect(s.numCallbacks).To(Equal(1))
+				expectNotSupported(30 * time.Second)
+				wgDataplane.ResetDeltas()
+			})
+
+			It("should re-probe after the first delay and then at the interval until supported", func() {
+				By("not re-probing before the first delay")
+				t.IncrementTime(29 * time.Second)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(BeZero())
+				expectNotSupported(time.Second)
+
+				By("re-probing after the first delay")
+				wgDataplane.FailuresToSimulate = failFlags
+				t.IncrementTime(time.Second)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(Equal(1))
+				expectNotSupported(30 * time.Minute)
+				Expect(s.numCallbacks).To(Equal(1))
+
+				By("not re-probing before the interval")
+				t.IncrementTime(29 * time.Minute)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(Equal(1))
+				expectNotSupported(time.Minute)
+
+				By("programming wireguard once a re-probe finds it is supported")
+				t.IncrementTime(time.Minute)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(Equal(2))
+				link := wgDataplane.NameToLink[ifaceName]
+				Expect(link).NotTo(BeNil())
+				Expect(wg.Active()).To(BeTrue())
+				Expect(s.numCallbacks).To(Equal(2))
+				Expect(s.key).To(Equal(link.WireguardPublicKey))
+				Expect(s.key).NotTo(Equal(zeroKey))
+				notSupported, reprobeTime := wg.NotSupported()
+				Expect(notSupported).To(BeFalse())
+				Expect(reprobeTime.IsZero()).To(BeTrue())
+				Expect(wg.ReprobeAfter()).To(BeZero())
+			})
+
+			It("should use the first delay again if wireguard is later found not to be supported", func() {
+				t.IncrementTime(30 * time.Second)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(wg.Active()).To(BeTrue())
+
+				// The link is deleted and the kernel module unloaded, which is noticed on a resync.
+				delete(wgDataplane.NameToLink, ifaceName)
+				wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkAddNotSupported
+				wg.QueueResync()
+				Expect(wg.Apply()).To(Succeed())
+				expectNotSupported(30 * time.Second)
+			})
+
+			It("should not re-probe if the interval is zero", func() {
+				config.NotSupportedReprobeInterval = 0
+				t.IncrementTime(30 * time.Second)
+				wgDataplane.FailuresToSimulate = failFlags
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(Equal(1))
+				wgDataplane.ResetDeltas()
+
+				t.IncrementTime(24 * time.Hour)
+				Expect(wg.Apply()).To(Succeed())
+				Expect(numProbes()).To(BeZero())
+				notSupported, reprobeTime := wg.NotSupported()
+				Expect(notSupported).To(BeTrue())
+				Expect(reprobeTime.IsZero()).To(BeTrue())
+				Expect(wg.ReprobeAfter()).To(BeZero())
+			})
+		})
+	}
+})
+
+var _ = Describe("Wireguard teardown", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var config *Config
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+
+	newWireguard := func() *Wireguard {
+		return NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	// ourRules returns the routing rules to the wireguard routing table.
+	ourRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table == tableIndex {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+
+	// expectNothingRemains checks that none of our configuration remains in the dataplane.
+	expectNothingRemains := func() {
+		Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		Expect(ourRules()).To(BeEmpty())
+		for routeKey := range rtDataplane.RouteKeyToRoute {
+			Expect(routeKey).NotTo(HavePrefix(fmt.Sprintf("%d-", tableIndex)))
+		}
+		_, _, _, ok := wg.LocalConfig()
+		Expect(ok).To(BeFalse())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+		wg = newWireguard()
+
+		// A wireguard peer routed through wireguard, and a peer without a key that has a throw route.
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+	})
+
+	It("should succeed without changes if never applied to a clean dataplane", func() {
+		Expect(wg.Teardown()).To(Succeed())
+		expectNothingRemains()
+		Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+		Expect(wgDataplane.NumLinkDeleteCalls).To(BeZero())
+		Expect(wgDataplane.NumRuleDelCalls).To(BeZero())
+		Expect(wgDataplane.NetlinkOpen).To(BeFalse())
+		Expect(wgDataplane.WireguardOpen).To(BeFalse())
+		Expect(s.numCallbacks).To(BeZero())
+	})
+
+	It("should remove the configuration left by a previous instance if never applied", func() {
+		link := wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		link.WireguardPeers = map[wgtypes.Key]wgtypes.Peer{key_peer1: {PublicKey: key_peer1}}
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rule := netlink.NewRule()
+		rule.Priority = rulePriority
+		rule.Table = tableIndex
+		rule.Mark = firewallMark
+		rule.Invert = true
+		wgDataplane.Rules = append(wgDataplane.Rules, *rule)
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipnet_1,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		})
+		rtDataplane.AddMockRoute(&netlink.Route{
+			Dst:      &ipnet_2,
+			Type:     syscall.RTN_THROW,
+			Protocol: FelixRouteProtocol,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		})
+
+		Expect(wg.Teardown()).To(Succeed())
+		expectNothingRemains()
+		Expect(link.WireguardPeers).To(BeEmpty())
+	})
+
+	It("should remove the link if partially applied", func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+
+		Expect(wg.Teardown()).To(Succeed())
+		expectNothingRemains()
+	})
+
+	It("should remove the peers and routes if the rule was not added", func() {
+		// The rule is first synced while the link is not up.
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		Expect(wg.Apply()).NotTo(Succeed())
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		Expect(wg.Apply()).NotTo(Succeed())
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(BeEmpty())
+		Expect(ourRules()).To(BeEmpty())
+
+		Expect(wg.Teardown()).To(Succeed())
+		expectNothingRemains()
+		Expect(link.WireguardPeers).To(BeEmpty())
+	})
+
+	Describe("when fully converged", func() {
+		var link *mocknetlink.MockLink
+
+		BeforeEach(func() {
+			Expect(wg.Apply()).To(Succeed())
+			wgDataplane.SetIface(ifaceName, true, true)
+			rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			Expect(wg.Apply()).To(Succeed())
+
+			link = wgDataplane.NameToLink[ifaceName]
+			Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(ourRules()).To(HaveLen(1))
+			Expect(s.numCallbacks).To(Equal(1))
+		})
+
+		It("should remove everything and not program wireguard again", func() {
+			Expect(wg.Teardown()).To(Succeed())
+			expectNothingRemains()
+			Expect(link.WireguardPeers).To(BeEmpty())
+
+			// The withdrawal of our key is published.
+			Expect(s.numCallbacks).To(Equal(2))
+			Expect(s.key).To(Equal(zeroKey))
+			Expect(s.keyState).To(Equal(KeyStateTornDown))
+
+			// Further updates and applies make no changes.
+			wgDataplane.ResetDeltas()
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+			wg.QueueResync()
+			Expect(wg.Apply()).To(Succeed())
+			expectNothingRemains()
+			Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+			Expect(s.numCallbacks).To(Equal(2))
+		})
+
+		It("should be safe to call more than once", func() {
+			Expect(wg.Teardown()).To(Succeed())
+			Expect(wg.Teardown()).To(Succeed())
+			expectNothingRemains()
+			Expect(wgDataplane.NumLinkDeleteCalls).To(Equal(1))
+			Expect(s.numCallbacks).To(Equal(2))
+		})
+
+		It("should retry publishing the withdrawal of our key", func() {
+			s.err = errors.New("datastore unavailable")
+			err := wg.Teardown()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("public key"))
+			expectNothingRemains()
+
+			s.err = nil
+			Expect(wg.Teardown()).To(Succeed())
+			Expect(s.numCallbacks).To(Equal(3))
+			Expect(s.key).To(Equal(zeroKey))
+			Expect(s.keyState).To(Equal(KeyStateTornDown))
+		})
+
+		It("should remove the configuration even if wireguard has since been disabled", func() {
+			config.Enabled = false
+			Expect(wg.Teardown()).To(Succeed())
+			expectNothingRemains()
+		})
+
+		It("should attempt every step and return the errors of the steps that failed", func() {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleDel
+			err := wg.Teardown()
+			Expect(err).To(HaveOccurred())
+			teardownErr, ok := err.(*TeardownError)
+			Expect(ok).To(BeTrue(), fmt.Sprintf("unexpected error %v", err))
+			Expect(teardownErr.Errors).To(HaveLen(1))
+			Expect(err.Error()).To(ContainSubstring("routing rule"))
+
+			// The other steps were still attempted, and a retry removes the rule.
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			Expect(ourRules()).To(HaveLen(1))
+			Expect(wg.Teardown()).To(Succeed())
+			expectNothingRemains()
+		})
+	})
+})
+
+var _ = Describe("Wireguard node removal", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1, key_peer2 wgtypes.Key
+
+	// tableRoutes returns the keys of the routes in the wireguard routing table.
+	tableRoutes := func() []string {
+		var keys []string
+		for routeKey := range rtDataplane.RouteKeyToRoute {
+			if strings.HasPrefix(routeKey, fmt.Sprintf("%d-", tableIndex)) {
+				keys = append(keys, routeKey)
+			}
+		}
+		return keys
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		// Bring up the wireguard link.
+		Expect(wg.Apply()).To(Succeed())
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+		link = wgDataplane.NameToLink[ifaceName]
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers).To(HaveLen(2))
+		Expect(tableRoutes()).To(HaveLen(3))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should remove the routes and cached CIDRs of a node removed without removing its CIDRs", func() {
+		// The CIDR removes were missed, e.g. across a restart, so the node is removed with its CIDRs.
+		wg.EndpointRemove(peer1)
+		wg.EndpointWireguardRemove(peer1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers).To(HaveLen(1))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+		Expect(tableRoutes()).To(ConsistOf(fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_3)))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		wg.EndpointRemove(peer2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(tableRoutes()).To(BeEmpty())
+		Expect(wg.CheckInvariants()).To(Succeed())
+		Expect(wg.CachedStateSize()).To(BeZero())
+	})
+
+	It("should allow the CIDRs of a removed node to be added to another node", func() {
+		wg.EndpointRemove(peer1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet(), cidr_3.ToIPNet()))
+		Expect(tableRoutes()).To(HaveLen(2))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should remove an allowed CIDR for the node that owns it", func() {
+		wg.EndpointAllowedCIDRRemoveForNode(peer1, cidr_2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(tableRoutes()).To(HaveLen(2))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should ignore the removal of an allowed CIDR that has moved to another node", func() {
+		wg.EndpointAllowedCIDRRemove(cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).To(Succeed())
+
+		// A late removal for the previous owner leaves the CIDR with the new owner.
+		wg.EndpointAllowedCIDRRemoveForNode(peer1, cidr_2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(cidr_2.ToIPNet(), cidr_3.ToIPNet()))
+		Expect(tableRoutes()).To(HaveLen(3))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should not grow the cached state as nodes churn", func() {
+		wg.EndpointRemove(peer1)
+		wg.EndpointRemove(peer2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.CachedStateSize()).To(BeZero())
+
+		for i := 0; i < 200; i++ {
+			name := fmt.Sprintf("churn-%d", i)
+			nodeIP := ip.FromString(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+			wg.EndpointUpdate(name, nodeIP)
+			wg.EndpointWireguardUpdate(name, mustGeneratePrivateKey().PublicKey(), nil)
+			wg.EndpointWireguardReady(name, true)
+			wg.EndpointAllowedCIDRAdd(name, ip.MustParseCIDROrIP(fmt.Sprintf("10.%d.%d.0/24", 100+i/256, i%256)))
+			wg.EndpointAllowedCIDRAdd(name, ip.MustParseCIDROrIP(fmt.Sprintf("10.%d.%d.0/24", 200+i/256, i%256)))
+			Expect(wg.Apply()).To(Succeed())
+			Expect(link.WireguardPeers).To(HaveLen(1))
+
+			// The node is removed along with its wireguard configuration, without removing its CIDRs.
+			wg.EndpointRemove(name)
+			wg.EndpointWireguardRemove(name)
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.CheckInvariants()).To(Succeed())
+			Expect(wg.CachedStateSize()).To(BeZero())
+		}
+		Expect(link.WireguardPeers).To(BeEmpty())
+		Expect(tableRoutes()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Wireguard apply summary logging", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var hook *logtest.Hook
+	var logLevel log.Level
+
+	const linkIndex = 10
+
+	// summaries returns the apply summaries that have been logged.
+	summaries := func() []*log.Entry {
+		var entries []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "wireguard apply:") {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	BeforeEach(func() {
+		logLevel = log.InfoLevel
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		t := mocktime.NewMockTime()
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		// The wireguard logger takes a copy of the hooks of the standard logger, so install the test hook only while
+		// the wireguard module is created.
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		hook = logtest.NewGlobal()
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				LogLevel:            &logLevel,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		log.StandardLogger().Hooks = stdHooks
+
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should log a summary of the initial programming", func() {
+		entries := summaries()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Level).To(Equal(log.InfoLevel))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersAdded", 2))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersRemoved", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersUpdated", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("routesAdded", 2))
+		Expect(entries[0].Data).To(HaveKeyWithValue("routesRemoved", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("rulesAdded", 1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("rulesRemoved", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("deviceWrites", 1))
+		Expect(entries[0].Data).To(HaveKey("took"))
+	})
+
+	It("should log the time of each subsystem", func() {
+		entries := summaries()
+		Expect(entries).To(HaveLen(1))
+		for _, field := range []string{
+			"linkTime", "addressTime", "rulesTime", "deviceReadTime", "deviceConfigureTime", "routesTime",
+		} {
+			Expect(entries[0].Data).To(HaveKeyWithValue(field, BeAssignableToTypeOf(time.Duration(0))))
+		}
+	})
+
+	It("should not log a summary when an apply changes nothing", func() {
+		hook.Reset()
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summaries()).To(BeEmpty())
+	})
+
+	It("should log a summary of removed and updated peers", func() {
+		hook.Reset()
+		wg.EndpointRemove(peer1)
+		wg.EndpointWireguardRemove(peer1)
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+
+		entries := summaries()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersAdded", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersRemoved", 1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("peersUpdated", 1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("routesAdded", 1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("routesRemoved", 1))
+		Expect(entries[0].Data).To(HaveKeyWithValue("rulesAdded", 0))
+		Expect(entries[0].Data).To(HaveKeyWithValue("deviceWrites", 2))
+	})
+
+	It("should not log debug logs at the info level", func() {
+		for _, entry := range hook.AllEntries() {
+			Expect(entry.Level).NotTo(Equal(log.DebugLevel))
+		}
+	})
+
+	Describe("with the debug level", func() {
+		BeforeEach(func() {
+			logLevel = log.DebugLevel
+		})
+
+		It("should log debug logs without changing the standard logger level", func() {
+			debug := false
+			for _, entry := range hook.AllEntries() {
+				debug = debug || entry.Level == log.DebugLevel
+			}
+			Expect(debug).To(BeTrue())
+			Expect(log.GetLevel()).NotTo(Equal(log.DebugLevel))
+		})
+	})
+})
+
+var _ = Describe("Wireguard routing table index", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+
+	const linkIndex = 10
+
+	newWireguard := func(config *Config) *Wireguard {
+		config.Enabled = true
+		config.ListeningPort = listeningPort
+		config.FirewallMark = firewallMark
+		config.RoutingRulePriority = rulePriority
+		config.InterfaceName = ifaceName
+		config.MTU = mtu
+		return NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	applyPeers := func() error {
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		return wg.Apply()
+	}
+
+	routeKey := func(tableIndex int) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	}
+
+	ourRule := func(tableIndex int) netlink.Rule {
+		rule := netlink.NewRule()
+		rule.Priority = rulePriority
+		rule.Table = tableIndex
+		rule.Mark = firewallMark
+		rule.Invert = true
+		return *rule
+	}
+
+	// The netlink and wireguard handles of the previous instance are closed when its process exits.
+	restart := func() {
+		for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			dp.NumOpenNetlinks = 0
+			dp.NetlinkOpen = false
+			dp.WireguardOpen = false
+			dp.ResetDeltas()
+		}
+		s = &mockStatus{}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+	})
+
+	It("should reject routing table 0 and program nothing", func() {
+		wg = newWireguard(&Config{RoutingTableIndex: 0})
+		Expect(wg.RouteTableSyncers()).To(BeEmpty())
+
+		err := applyPeers()
+		Expect(err).To(Equal(ErrInvalidRoutingTableIndex))
+		Expect(rtDataplane.RouteKeyToRoute).To(BeEmpty())
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+		Expect(s.numCallbacks).To(Equal(0))
+
+		By("resyncing")
+		wg.QueueResync()
+		err = wg.Apply()
+		Expect(err).To(Equal(ErrInvalidRoutingTableIndex))
+		Expect(rtDataplane.RouteKeyToRoute).To(BeEmpty())
+	})
+
+	It("should reject routing table 0 for a route class", func() {
+		wg = newWireguard(&Config{
+			RoutingTableIndex:        tableIndex,
+			RoutingTableIndexByClass: map[RouteClass]int{RouteClassHost: 0},
+		})
+		Expect(wg.RouteTableSyncers()).To(BeEmpty())
+		Expect(applyPeers()).To(Equal(ErrInvalidRoutingTableIndex))
+		Expect(rtDataplane.RouteKeyToRoute).To(BeEmpty())
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+	})
+
+	It("should allow routing table 0 while disabled", func() {
+		wg = NewWithShims(
+			hostname,
+			&Config{Enabled: false, InterfaceName: ifaceName},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	Describe("chosen automatically", func() {
+		var defaultRules []netlink.Rule
+		var foreignRule netlink.Rule
+
+		autoConfig := func() *Config {
+			return &Config{RoutingTableIndexAuto: true, RoutingTableIndexAutoMin: 100, RoutingTableIndexAutoMax: 103}
+		}
+
+		BeforeEach(func() {
+			// Table 100 is used by a rule, and table 101 contains a route, both owned by other components.
+			defaultRules = append([]netlink.Rule(nil), wgDataplane.Rules...)
+			foreignRule = *netlink.NewRule()
+			foreignRule.Priority = 50
+			foreignRule.Table = 100
+			wgDataplane.Rules = append(wgDataplane.Rules, foreignRule)
+			rtDataplane.AddMockRoute(&netlink.Route{
+				Dst:      &ipnet_2,
+				Type:     syscall.RTN_THROW,
+				Protocol: syscall.RTPROT_STATIC,
+				Scope:    netlink.SCOPE_UNIVERSE,
+				Table:    101,
+			})
+
+			wg = newWireguard(autoConfig())
+			Expect(applyPeers()).NotTo(HaveOccurred())
+		})
+
+		It("should choose a routing table that is not in use", func() {
+			Expect(wg.RouteTableSyncers()).To(HaveLen(1))
+			Expect(wg.RouteTableSyncers()[0].TableIndex()).To(Equal(102))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(102)))
+			Expect(wgDataplane.Rules).To(ContainElement(foreignRule))
+			Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{ourRule(102)}))
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.tableIndex).To(Equal(102))
+
+			By("resyncing")
+			rtDataplane.ResetDeltas()
+			wgDataplane.ResetDeltas()
+			wg.QueueResync()
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+			Expect(wgDataplane.AddedRules).To(BeEmpty())
+			Expect(wgDataplane.DeletedRules).To(BeEmpty())
+		})
+
+		It("should rediscover the routing table after a restart", func() {
+			// Free up the lower tables, which would otherwise be chosen.
+			wgDataplane.Rules = append(defaultRules, ourRule(102))
+			rtDataplane.RemoveMockRoute(&netlink.Route{Dst: &ipnet_2, Table: 101})
+			restart()
+
+			wg = newWireguard(autoConfig())
+			Expect(applyPeers()).NotTo(HaveOccurred())
+			Expect(wg.RouteTableSyncers()[0].TableIndex()).To(Equal(102))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(102)))
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(wgDataplane.AddedRules).To(BeEmpty())
+			Expect(wgDataplane.DeletedRules).To(BeEmpty())
+			Expect(s.tableIndex).To(Equal(102))
+		})
+
+		It("should not reuse a routing table whose rule has another mark", func() {
+			otherRule := ourRule(102)
+			otherRule.Mark = firewallMark + 1
+			wgDataplane.Rules = append(defaultRules, foreignRule, otherRule)
+			restart()
+
+			wg = newWireguard(autoConfig())
+			Expect(applyPeers()).NotTo(HaveOccurred())
+			Expect(s.tableIndex).To(Equal(103))
+			Expect(wgDataplane.Rules).To(ContainElement(otherRule))
+			Expect(wgDataplane.Rules).To(ContainElement(ourRule(103)))
+		})
+
+		It("should rediscover the routing table of a rule programmed with the source selector", func() {
+			sourceRule := *netlink.NewRule()
+			sourceRule.Priority = rulePriority
+			sourceRule.Table = 102
+			sourceRule.Src = &ipnet_1
+			wgDataplane.Rules = append(defaultRules, sourceRule)
+			rtDataplane.RemoveMockRoute(&netlink.Route{Dst: &ipnet_2, Table: 101})
+			restart()
+
+			// The rule is replaced by the rule of the configured selectors.
+			wg = newWireguard(autoConfig())
+			Expect(applyPeers()).NotTo(HaveOccurred())
+			Expect(s.tableIndex).To(Equal(102))
+			Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{sourceRule}))
+			Expect(wgDataplane.AddedRules).To(Equal([]netlink.Rule{ourRule(102)}))
+		})
+
+		It("should program nothing if there is no free routing table", func() {
+			restart()
+			config := autoConfig()
+			config.RoutingTableIndexAutoMax = 101
+			wgDataplane.Rules = append(defaultRules, foreignRule)
+
+			wg = newWireguard(config)
+			Expect(wg.RouteTableSyncers()).To(BeEmpty())
+			Expect(applyPeers()).To(Equal(ErrInvalidRoutingTableIndex))
+			Expect(wgDataplane.AddedRules).To(BeEmpty())
+			Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+			Expect(s.numCallbacks).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("Wireguard shared dual-stack device", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s4, s6 *mockStatus
+	var owner *DeviceOwner
+	var wg4, wg6 *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const tableIndexV6 = 98
+
+	var (
+		cidr_v6      = ip.MustParseCIDROrIP("2001:db8:1::/64")
+		ipv6_host    = ip.FromString("2001:db8::1")
+		ipv6_peer1   = ip.FromString("2001:db8::5")
+		ipnet_cidrV6 = cidr_v6.ToIPNet()
+	)
+
+	newWireguard := func(ipVersion uint8, tableIndex int, s *mockStatus) *Wireguard {
+		return NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				IPVersion:           ipVersion,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			owner,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	routeKey := func(tableIndex int, cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, wgDataplane.NameToLink[ifaceName].LinkAttrs.Index, cidr)
+	}
+
+	apply := func() {
+		Expect(wg4.Apply()).To(Succeed())
+		Expect(wg6.Apply()).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		// Each instance opens its own netlink clients.
+		wgDataplane.MaxOpenNetlinks = 2
+		rtDataplane.MaxOpenNetlinks = 2
+		t = mocktime.NewMockTime()
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		s4 = &mockStatus{}
+		s6 = &mockStatus{}
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+
+		owner = NewDeviceOwner(&Config{
+			InterfaceName: ifaceName,
+			ListeningPort: listeningPort,
+			FirewallMark:  firewallMark,
+			MTU:           mtu,
+		}, wgDataplane.NewMockWireguard)
+		wg4 = newWireguard(4, tableIndex, s4)
+		wg6 = newWireguard(6, tableIndexV6, s6)
+		wg4.EndpointUpdate(hostname, ipv4_host)
+		wg6.EndpointUpdate(hostname, ipv6_host)
+
+		// Bring up the shared wireguard link.
+		apply()
+		Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+		wg4.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg6.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+
+		wg4.EndpointUpdate(peer1, ipv4_peer1)
+		wg4.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg4.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg6.EndpointUpdate(peer1, ipv6_peer1)
+		wg6.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg6.EndpointAllowedCIDRAdd(peer1, cidr_v6)
+		apply()
+	})
+
+	It("should create a single link with a single key", func() {
+		Expect(wgDataplane.NameToLink).To(HaveLen(1))
+		Expect(wgDataplane.NumLinkAddCalls).To(Equal(1))
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(link.WireguardFirewallMark).To(Equal(firewallMark))
+
+		Expect(s4.key).NotTo(Equal(zeroKey))
+		Expect(s4.key).To(Equal(link.WireguardPublicKey))
+		Expect(s6.key).To(Equal(s4.key))
+		Expect(s6.port).To(Equal(listeningPort))
+		Expect(s4.tableIndex).To(Equal(tableIndex))
+		Expect(s6.tableIndex).To(Equal(tableIndexV6))
+	})
+
+	It("should merge the allowed IPs of both IP versions into a single peer", func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPeers).To(HaveLen(1))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet(), ipnet_cidrV6))
+		// The endpoint of the IPv4 instance is used.
+		Expect(link.WireguardPeers[key_peer1].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer1.AsNetIP(),
+			Port: listeningPort,
+		}))
+
+		By("resyncing both instances")
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		wg4.QueueResync()
+		wg6.QueueResync()
+		apply()
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet(), ipnet_cidrV6))
+	})
+
+	It("should program independent routing tables and rules for each IP version", func() {
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(tableIndex, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(tableIndexV6, cidr_v6)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(tableIndex, cidr_v6)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(tableIndexV6, cidr_1)))
+
+		families := map[int]int{}
+		for _, rule := range wgDataplane.AddedRules {
+			families[rule.Table] = rule.Family
+		}
+		Expect(families).To(HaveLen(2))
+		Expect(families[tableIndex]).NotTo(Equal(netlink.FAMILY_V6))
+		Expect(families[tableIndexV6]).To(Equal(netlink.FAMILY_V6))
+	})
+
+	It("should keep the allowed IPs of the other IP version when removing a CIDR", func() {
+		wg4.EndpointAllowedCIDRRemove(cidr_1)
+		apply()
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_cidrV6))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(tableIndex, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(tableIndexV6, cidr_v6)))
+	})
+
+	It("should keep the peer while it is used by the other IP version", func() {
+		wg6.EndpointRemove(peer1)
+		wg6.EndpointWireguardRemove(peer1)
+		apply()
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+
+		wg4.EndpointRemove(peer1)
+		wg4.EndpointWireguardRemove(peer1)
+		apply()
+		Expect(link.WireguardPeers).To(BeEmpty())
+	})
+
+	It("should leave the link and the other IP version in place when one instance is torn down", func() {
+		Expect(wg6.Teardown()).To(Succeed())
+		Expect(wg4.Apply()).To(Succeed())
+		Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPublicKey).To(Equal(s4.key))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(tableIndex, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(tableIndexV6, cidr_v6)))
+
+		By("tearing down the last instance")
+		Expect(wg4.Teardown()).To(Succeed())
+		Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+	})
+
+	It("should remove the interface address and its local route when the link is left in place", func() {
+		wg4.EndpointWireguardUpdate(hostname, s4.key, ipv4_int1)
+		apply()
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.Addrs).To(HaveLen(1))
+		localRoute := mocknetlink.LocalRouteForAddr(link, &link.Addrs[0])
+		localRouteKey := mocknetlink.KeyForRoute(&localRoute)
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey))
+
+		// The local route lingers once the address is removed, so it is removed explicitly.
+		wgDataplane.LocalRoutesLinger = true
+		Expect(wg4.Teardown()).To(Succeed())
+		Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+		Expect(link.Addrs).To(BeEmpty())
+		Expect(wgDataplane.DeletedRouteKeys.Contains(localRouteKey)).To(BeTrue())
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(localRouteKey))
+		Expect(wg6.Apply()).To(Succeed())
+	})
+})
+
+var _ = Describe("Wireguard pending work", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	newWireguard := func(enabled bool) *Wireguard {
+		return NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             enabled,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	// bringUpLink applies the creation of the link and then brings it up.
+	bringUpLink := func() {
+		wg.EndpointUpdate(hostname, ipv4_host)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.HasPendingWork()).To(BeFalse(), "no work is possible until the link is up")
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	It("should report the work of a new instance until it has converged", func() {
+		wg = newWireguard(true)
+		Expect(wg.HasPendingWork()).To(BeTrue())
+		Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{Key: true, Peers: true, Routes: true, Rules: true}))
+
+		bringUpLink()
+		Expect(wg.HasPendingWork()).To(BeTrue())
+		Expect(wg.PendingWorkSummary().Key).To(BeTrue())
+		Expect(wg.PendingWorkSummary().QueuedUpdates).To(Equal(1))
+
+		Expect(wg.Apply()).To(Succeed())
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(wg.HasPendingWork()).To(BeFalse())
+		Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{}))
+	})
+
+	It("should report no work for a disabled instance once the configuration is removed", func() {
+		wg = newWireguard(false)
+		Expect(wg.HasPendingWork()).To(BeTrue())
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.HasPendingWork()).To(BeFalse())
+	})
+
+	Describe("with the link up", func() {
+		BeforeEach(func() {
+			wg = newWireguard(true)
+			bringUpLink()
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should flag the updates until they are applied", func() {
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{
+				Key: true, Peers: true, Routes: true, Rules: true, QueuedUpdates: 3,
+			}))
+
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+			Expect(wg.HasPendingWork()).To(BeFalse())
+			Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{}))
+
+			By("adding a CIDR")
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+			Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{Peers: true, Routes: true, QueuedUpdates: 1}))
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+
+			By("removing the key of the peer")
+			wg.EndpointWireguardRemove(peer1)
+			Expect(wg.PendingWorkSummary().Key).To(BeTrue())
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).NotTo(HaveKey(key_peer1))
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should flag a resync until it is applied", func() {
+			wg.QueueResync()
+			summary := wg.PendingWorkSummary()
+			Expect(summary.Key).To(BeFalse())
+			Expect(summary.Peers).To(BeTrue())
+			Expect(summary.Routes).To(BeTrue())
+			Expect(summary.Rules).To(BeTrue())
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should keep the work pending while the wireguard configuration fails", func() {
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+			Expect(wg.Apply()).To(HaveOccurred())
+			Expect(wg.HasPendingWork()).To(BeTrue())
+			Expect(wg.PendingWorkSummary().Peers).To(BeTrue())
+			Expect(wg.PendingWorkSummary().QueuedUpdates).To(BeZero())
+
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should keep the key pending until it is published", func() {
+			// Once our key has been echoed back, it is published again if the datastore disagrees with the dataplane.
+			wg.EndpointWireguardUpdate(hostname, s.key, nil)
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+			wg.EndpointWireguardUpdate(hostname, zeroKey, nil)
+			s.err = errors.New("publish failed")
+			Expect(wg.Apply()).To(HaveOccurred())
+			Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{Key: true}))
+
+			s.err = nil
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should report no work once torn down", func() {
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			Expect(wg.HasPendingWork()).To(BeTrue())
+			Expect(wg.Teardown()).To(Succeed())
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+
+		It("should be safe to query the work concurrently with updates and Apply", func() {
+			done := make(chan struct{})
+			var queried sync.WaitGroup
+			queried.Add(1)
+			go func() {
+				defer queried.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						wg.HasPendingWork()
+						wg.PendingWorkSummary()
+					}
+				}
+			}()
+
+			for i := 0; i < 20; i++ {
+				wg.EndpointUpdate(peer1, ipv4_peer1)
+				wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				Expect(wg.Apply()).To(Succeed())
+			}
+			close(done)
+			queried.Wait()
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("Wireguard parent interfaces", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				ParentInterfaces:    []*regexp.Regexp{regexp.MustCompile("^eth0$"), regexp.MustCompile("^bond.*")},
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		// Bring up the wireguard link and program a peer.
+		Expect(wg.Apply()).To(Succeed())
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+		Expect(wg.HasPendingWork()).To(BeFalse())
+
+		// The kernel flushes the routing rule and the wireguard peer while the parent interface is down.
+		wgDataplane.Rules = wgDataplane.Rules[:len(wgDataplane.Rules)-1]
+		delete(wgDataplane.NameToLink[ifaceName].WireguardPeers, key_peer1)
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+	})
+
+	for _, parent := range []string{"eth0", "bond1"} {
+		parent := parent
+		It(fmt.Sprintf("should resync the rules and device when parent interface %s comes up", parent), func() {
+			wg.OnIfaceStateChanged(parent, ifacemonitor.StateDown)
+			Expect(wg.HasPendingWork()).To(BeFalse())
+
+			wg.OnIfaceStateChanged(parent, ifacemonitor.StateUp)
+			summary := wg.PendingWorkSummary()
+			Expect(summary.Rules).To(BeTrue())
+			Expect(summary.Peers).To(BeTrue())
+			Expect(summary.Routes).To(BeFalse())
+
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.AddedRules).To(HaveLen(1))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer1].AllowedIPs).To(
+				ConsistOf(cidr_1.ToIPNet()))
+
+			// The routes are not on the parent interface, so they are not listed again.
+			Expect(rtDataplane.Calls).NotTo(ContainElement("RouteListFiltered"))
+			Expect(wg.HasPendingWork()).To(BeFalse())
+		})
+	}
+
+	It("should ignore interfaces that are not parent interfaces", func() {
+		wg.OnIfaceStateChanged("eth1", ifacemonitor.StateUp)
+		wg.OnIfaceStateChanged("eth00", ifacemonitor.StateUp)
+		Expect(wg.HasPendingWork()).To(BeFalse())
+
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(BeZero())
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).NotTo(HaveKey(key_peer1))
+	})
+})
+
+var _ = Describe("Wireguard CIDR verifier", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1 wgtypes.Key
+	var denied map[ip.CIDR]bool
+	var verified []string
+	var setVerifierFirst bool
+
+	// verifier is a fake verifier that denies the CIDRs in denied, and records the CIDRs it verifies.
+	verifier := func(nodeName string, cidr ip.CIDR) bool {
+		verified = append(verified, fmt.Sprintf("%s/%s", nodeName, cidr))
+		return !denied[cidr]
+	}
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)
+	}
+	routekeyThrow := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr)
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectDenied := func(cidrs ...ip.CIDR) {
+		for _, cidr := range cidrs {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr)))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).NotTo(ContainElement(cidr.ToIPNet()))
+		}
+	}
+	expectAllowed := func(cidrs ...ip.CIDR) {
+		for _, cidr := range cidrs {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr)))
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ContainElement(cidr.ToIPNet()))
+		}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		denied = map[ip.CIDR]bool{cidr_1: true}
+		verified = nil
+		setVerifierFirst = true
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		if setVerifierFirst {
+			wg.SetCIDRVerifier(verifier)
+		}
+
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		err = wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+		Expect(link).ToNot(BeNil())
+		rtDataplane.NameToLink[ifaceName] = link
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		apply()
+	})
+
+	It("should verify each CIDR with the node it is attributed to", func() {
+		Expect(verified).To(ConsistOf(
+			fmt.Sprintf("%s/%s", peer1, cidr_1),
+			fmt.Sprintf("%s/%s", peer1, cidr_2),
+			fmt.Sprintf("%s/%s", peer1, cidr_3),
+		))
+	})
+
+	It("should program a throw route for a denied CIDR", func() {
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+		expectDenied(cidr_1)
+		expectAllowed(cidr_2, cidr_3)
+		numDenied, numDenials := wg.DeniedCIDRs()
+		Expect(numDenied).To(Equal(1))
+		Expect(numDenials).To(Equal(1))
+	})
+
+	It("should only follow a changed decision on a resync", func() {
+		denied = map[ip.CIDR]bool{cidr_3: true}
+		apply()
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+		expectDenied(cidr_1)
+
+		wg.QueueResync()
+		apply()
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2))
+		expectDenied(cidr_3)
+		expectAllowed(cidr_1, cidr_2)
+
+		denied = map[ip.CIDR]bool{}
+		wg.QueueResync()
+		apply()
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_3))
+		expectAllowed(cidr_1, cidr_2, cidr_3)
+		numDenied, numDenials := wg.DeniedCIDRs()
+		Expect(numDenied).To(BeZero())
+		Expect(numDenials).To(Equal(2))
+	})
+
+	It("should not count a CIDR that is denied again on a resync", func() {
+		wg.QueueResync()
+		apply()
+		expectDenied(cidr_1)
+		numDenied, numDenials := wg.DeniedCIDRs()
+		Expect(numDenied).To(Equal(1))
+		Expect(numDenials).To(Equal(1))
+	})
+
+	It("should verify a CIDR again when it moves to another node", func() {
+		key_peer2 := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		verified = nil
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		apply()
+		Expect(verified).To(ConsistOf(fmt.Sprintf("%s/%s", peer2, cidr_1)))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+		Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_1)))
+	})
+
+	It("should remove the throw route of a removed denied CIDR", func() {
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_1)))
+		numDenied, _ := wg.DeniedCIDRs()
+		Expect(numDenied).To(BeZero())
+	})
+
+	It("should allow all of the CIDRs when the verifier is removed", func() {
+		wg.SetCIDRVerifier(nil)
+		apply()
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_2, ipnet_3))
+		expectAllowed(cidr_1, cidr_2, cidr_3)
+	})
+
+	It("should rate limit the warnings for denied CIDRs", func() {
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		hook := logtest.NewGlobal()
+		defer func() {
+			log.StandardLogger().Hooks = stdHooks
+		}()
+		warnings := func() []*log.Entry {
+			var entries []*log.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "denied by the CIDR verifier") {
+					entries = append(entries, entry)
+				}
+			}
+			return entries
+		}
+
+		t.IncrementTime(time.Hour)
+		t.SetAutoIncrement(0)
+		denied = map[ip.CIDR]bool{cidr_1: true, cidr_4: true, cidr_5: true}
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+		apply()
+		Expect(warnings()).To(HaveLen(1))
+
+		t.IncrementTime(time.Minute)
+		wg.EndpointAllowedCIDRRemove(cidr_4)
+		apply()
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+		apply()
+		Expect(warnings()).To(HaveLen(2))
+		Expect(warnings()[1].Data).To(HaveKeyWithValue("deniedSinceLog", 2))
+		Expect(warnings()[1].Data).To(HaveKeyWithValue("numDenied", 3))
+	})
+
+	Describe("with the verifier set after the CIDRs are added", func() {
+		BeforeEach(func() {
+			setVerifierFirst = false
+		})
+
+		It("should initially allow all of the CIDRs", func() {
+			Expect(verified).To(BeEmpty())
+			expectAllowed(cidr_1, cidr_2, cidr_3)
+		})
+
+		It("should reclassify the CIDRs when the verifier is set", func() {
+			wg.SetCIDRVerifier(verifier)
+			apply()
+			Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_2, ipnet_3))
+			expectDenied(cidr_1)
+			expectAllowed(cidr_2, cidr_3)
+		})
+	})
+})
+
+var _ = Describe("Wireguard throw routes while the link is not usable", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, wgDataplane.NameToLink[ifaceName].LinkAttrs.Index, cidr)
+	}
+	routekeyThrow := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr)
+	}
+	apply := func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectThrow := func(cidrs ...ip.CIDR) {
+		for _, cidr := range cidrs {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr)))
+		}
+	}
+	ourRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.AddedRules {
+			if rule.Table == tableIndex {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+
+		// peer1 is wireguard capable and peer2 is not.
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+	})
+
+	Describe("with the link stuck pending", func() {
+		BeforeEach(func() {
+			apply()
+			Expect(wgDataplane.NameToLink).To(HaveKey(ifaceName))
+		})
+
+		It("should program throw routes for all of the peers and the routing rule", func() {
+			expectThrow(cidr_1, cidr_2)
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(ourRules()).To(HaveLen(1))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(BeEmpty())
+			Expect(s.numCallbacks).To(BeZero())
+		})
+
+		It("should program the throw route of a CIDR added while the link is pending", func() {
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+			apply()
+			expectThrow(cidr_1, cidr_2, cidr_3)
+		})
+
+		It("should replace the throw routes of the wireguard peers once the link is up", func() {
+			wgDataplane.SetIface(ifaceName, true, true)
+			rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			apply()
+
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_1)))
+			expectThrow(cidr_2)
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1))
+			Expect(ourRules()).To(HaveLen(1))
+		})
+
+		It("should return to throw routes if the link is set down", func() {
+			wgDataplane.SetIface(ifaceName, true, true)
+			rtDataplane.NameToLink[ifaceName] = wgDataplane.NameToLink[ifaceName]
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+
+			// The link is set up again, but is not up by the end of the apply. The routes to the link are removed by
+			// the kernel along with the link state, the mock leaves them in place.
+			wgDataplane.SetIface(ifaceName, false, false)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+			apply()
+			expectThrow(cidr_1, cidr_2)
+		})
+	})
+
+	Describe("with wireguard not supported", func() {
+		BeforeEach(func() {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkAddNotSupported
+			apply()
+		})
+
+		It("should program throw routes for all of the peers", func() {
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			expectThrow(cidr_1, cidr_2)
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(2))
+		})
+
+		It("should program the throw route of a CIDR added while not supported", func() {
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+			apply()
+			expectThrow(cidr_1, cidr_2, cidr_3)
+		})
+	})
+})
+
+var _ = Describe("Wireguard adoption of an existing device", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1, key_peer2, key_peer3 wgtypes.Key
+	var adoptedKey wgtypes.Key
+
+	const linkIndex = 10
+
+	newWireguard := func(adopt bool) *Wireguard {
+		w := NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				AdoptExistingDevice: adopt,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		w.EndpointUpdate(hostname, ipv4_host)
+		return w
+	}
+	apply := func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	addPeer := func(name string, key wgtypes.Key, addr ip.Addr, cidr ip.CIDR) {
+		wg.EndpointUpdate(name, addr)
+		wg.EndpointWireguardUpdate(name, key, nil)
+		wg.EndpointAllowedCIDRAdd(name, cidr)
+	}
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+
+	// The netlink and wireguard handles of the previous instance are closed when its process exits.
+	restart := func(adopt bool) {
+		for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			dp.NumOpenNetlinks = 0
+			dp.NetlinkOpen = false
+			dp.WireguardOpen = false
+			dp.ResetDeltas()
+		}
+		s = &mockStatus{}
+		wg = newWireguard(adopt)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		key_peer3 = mustGeneratePrivateKey().PublicKey()
+
+		// The device is programmed by the previous felix.
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = newWireguard(false)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		addPeer(peer1, key_peer1, ipv4_peer1, cidr_1)
+		addPeer(peer2, key_peer2, ipv4_peer2, cidr_2)
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(2))
+		adoptedKey = s.key
+		Expect(adoptedKey).NotTo(Equal(zeroKey))
+	})
+
+	It("should make no changes to the device if the kernel matches the datastore", func() {
+		restart(true)
+		apply()
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).To(Equal(adoptedKey))
+		Expect(wg.PendingWorkSummary().Key).To(BeFalse())
+		Expect(wg.PendingWorkSummary().Peers).To(BeFalse())
+
+		By("receiving the peers")
+		addPeer(peer1, key_peer1, ipv4_peer1, cidr_1)
+		apply()
+		addPeer(peer2, key_peer2, ipv4_peer2, cidr_2)
+		apply()
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+
+		By("receiving the in-sync signal")
+		wg.DatastoreInSync()
+		apply()
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(link().WireguardPeers).To(HaveLen(2))
+		Expect(link().WireguardPrivateKey.PublicKey()).To(Equal(adoptedKey))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).To(Equal(adoptedKey))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)))
+	})
+
+	It("should remove the adopted peers that the datastore does not confirm once in sync", func() {
+		restart(true)
+		addPeer(peer1, key_peer1, ipv4_peer1, cidr_1)
+		apply()
+		Expect(link().WireguardPeers).To(HaveKey(key_peer2))
+
+		wg.DatastoreInSync()
+		Expect(wg.PendingWorkSummary().Peers).To(BeTrue())
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(s.key).To(Equal(adoptedKey))
+	})
+
+	It("should leave the configuration of a confirmed peer intact until in sync", func() {
+		restart(true)
+		addPeer(peer1, key_peer1, ipv4_peer1, cidr_3)
+		apply()
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+
+		wg.DatastoreInSync()
+		apply()
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_3.ToIPNet()))
+	})
+
+	It("should add new peers alongside the adopted peers", func() {
+		restart(true)
+		addPeer(peer3, key_peer3, ipv4_peer3, cidr_3)
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(3))
+		Expect(link().WireguardPeers[key_peer3].AllowedIPs).To(ConsistOf(cidr_3.ToIPNet()))
+
+		By("removing the new peer")
+		wg.EndpointWireguardRemove(peer3)
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(2))
+		Expect(link().WireguardPeers).NotTo(HaveKey(key_peer3))
+	})
+
+	It("should resync as usual if the datastore is in sync before the first apply", func() {
+		restart(true)
+		addPeer(peer1, key_peer1, ipv4_peer1, cidr_1)
+		wg.DatastoreInSync()
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(s.key).To(Equal(adoptedKey))
+	})
+
+	It("should remove the peers that have not been received if not adopting", func() {
+		restart(false)
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(s.key).To(Equal(adoptedKey))
+	})
+})
+
+var _ = Describe("Wireguard configuration construction", func() {
+	var settings Settings
+
+	BeforeEach(func() {
+		settings = Settings{
+			Enabled:           true,
+			FirewallMark:      firewallMark,
+			RoutingTableIndex: tableIndex,
+		}
+	})
+
+	expectConfigError := func(err error, field string) {
+		Expect(err).To(HaveOccurred())
+		var configErr *ConfigError
+		Expect(errors.As(err, &configErr)).To(BeTrue())
+		Expect(configErr.Field).To(Equal(field))
+	}
+
+	It("should apply the defaults", func() {
+		config, err := NewConfig(settings)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(Config{
+			Enabled:             true,
+			ListeningPort:       DefaultListeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: DefaultRoutingRulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       DefaultInterfaceName,
+		}))
+	})
+
+	It("should default the interface name of IPv6", func() {
+		settings.IPVersion = 6
+		config, err := NewConfig(settings)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.InterfaceName).To(Equal(DefaultInterfaceNameV6))
+	})
+
+	It("should derive the MTU from the host MTU", func() {
+		settings.HostMTU = 1500
+		config, err := NewConfig(settings)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.MTU).To(Equal(1500 - OverheadForIPVersion(4)))
+
+		By("preferring the configured MTU")
+		settings.MTU = mtu
+		config, err = NewConfig(settings)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.MTU).To(Equal(mtu))
+	})
+
+	It("should keep the configured settings and apply the options", func() {
+		settings.ListeningPort = listeningPort
+		settings.RoutingRulePriority = rulePriority
+		settings.InterfaceName = ifaceName
+		config, err := NewConfig(settings, func(c *Config) {
+			c.MaxPeers = 10
+		}, func(c *Config) {
+			c.StrictTableOwnership = true
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.ListeningPort).To(Equal(listeningPort))
+		Expect(config.RoutingRulePriority).To(Equal(rulePriority))
+		Expect(config.InterfaceName).To(Equal(ifaceName))
+		Expect(config.MaxPeers).To(Equal(10))
+		Expect(config.StrictTableOwnership).To(BeTrue())
+	})
+
+	It("should reject an invalid routing table index", func() {
+		settings.RoutingTableIndex = 0
+		_, err := NewConfig(settings)
+		expectConfigError(err, "RoutingTableIndex")
+		Expect(errors.Is(err, ErrInvalidRoutingTableIndex)).To(BeTrue())
+
+		By("choosing the routing table automatically")
+		_, err = NewConfig(settings, func(c *Config) {
+			c.RoutingTableIndexAuto = true
+			c.RoutingTableIndexAutoMin = 1000
+			c.RoutingTableIndexAutoMax = 1999
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = NewConfig(settings, func(c *Config) {
+			c.RoutingTableIndexAuto = true
+			c.RoutingTableIndexAutoMin = 2000
+			c.RoutingTableIndexAutoMax = 1999
+		})
+		expectConfigError(err, "RoutingTableIndexAutoMin")
+	})
+
+	It("should reject invalid settings", func() {
+		invalid := func(update func(s *Settings), field string) {
+			s := settings
+			update(&s)
+			_, err := NewConfig(s)
+			expectConfigError(err, field)
+		}
+		invalid(func(s *Settings) { s.ListeningPort = 65536 }, "ListeningPort")
+		invalid(func(s *Settings) { s.FirewallMark = 0 }, "FirewallMark")
+		invalid(func(s *Settings) { s.RoutingRulePriority = 32766 }, "RoutingRulePriority")
+		invalid(func(s *Settings) { s.InterfaceName = "wireguard.calico" }, "InterfaceName")
+		invalid(func(s *Settings) { s.IPVersion = 5 }, "IPVersion")
+		invalid(func(s *Settings) { s.MTU = 67 }, "MTU")
+		invalid(func(s *Settings) { s.IPVersion = 6; s.MTU = 1279 }, "MTU")
+		invalid(func(s *Settings) { s.HostMTU = 100 }, "MTU")
+	})
+
+	It("should validate the DSCP and report the DSCP marking", func() {
+		config, err := NewConfig(settings)
+		Expect(err).NotTo(HaveOccurred())
+		_, enabled := config.DSCPMarking()
+		Expect(enabled).To(BeFalse())
+
+		dscp := uint8(46)
+		config, err = NewConfig(settings, func(c *Config) { c.DSCP = &dscp })
+		Expect(err).NotTo(HaveOccurred())
+		marking, enabled := config.DSCPMarking()
+		Expect(enabled).To(BeTrue())
+		Expect(marking).To(Equal(uint8(46)))
+
+		By("not marking the traffic if wireguard is disabled")
+		config.Enabled = false
+		_, enabled = config.DSCPMarking()
+		Expect(enabled).To(BeFalse())
+
+		dscp = 64
+		_, err = NewConfig(settings, func(c *Config) { c.DSCP = &dscp })
+		expectConfigError(err, "DSCP")
+	})
+
+	It("should only require the interface name if not enabled", func() {
+		config, err := NewConfig(Settings{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(Config{
+			ListeningPort:       DefaultListeningPort,
+			RoutingRulePriority: DefaultRoutingRulePriority,
+			InterfaceName:       DefaultInterfaceName,
+		}))
+		Expect((&Config{}).Validate()).To(HaveOccurred())
+	})
+
+	It("should apply the defaults and keep the routing table of a disabled config", func() {
+		config, err := NewConfig(Settings{FirewallMark: 0x100000, RoutingTableIndex: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(Config{
+			ListeningPort:       DefaultListeningPort,
+			FirewallMark:        0x100000,
+			RoutingRulePriority: DefaultRoutingRulePriority,
+			RoutingTableIndex:   1,
+			InterfaceName:       DefaultInterfaceName,
+		}))
+	})
+})
+
+var _ = Describe("Wireguard key conflicts", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+	var storedPrivateKey wgtypes.Key
+	var published []wgtypes.Key
+	var conflict bool
+	var onConflict func()
+
+	const linkIndex = 10
+
+	// status simulates a datastore holding the key of another felix for our node while conflict is set.
+	status := func(update StatusUpdate) error {
+		published = append(published, update.PublicKey)
+		if !conflict {
+			return nil
+		}
+		if onConflict != nil {
+			onConflict()
+		}
+		return &KeyConflictError{StoredKey: storedPrivateKey.PublicKey()}
+	}
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	// otherFelixProgramsDevice simulates another felix for our node programming its key on the shared device.
+	otherFelixProgramsDevice := func() {
+		link().WireguardPrivateKey = storedPrivateKey
+		link().WireguardPublicKey = storedPrivateKey.PublicKey()
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		storedPrivateKey = mustGeneratePrivateKey()
+		published = nil
+		conflict = true
+		onConflict = nil
+
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	})
+
+	It("should adopt the stored key on a fresh start", func() {
+		onConflict = otherFelixProgramsDevice
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(1))
+		Expect(published[0]).NotTo(Equal(storedPrivateKey.PublicKey()))
+
+		publicKey, _, _, ok := wg.LocalConfig()
+		Expect(ok).To(BeTrue())
+		Expect(publicKey).To(Equal(storedPrivateKey.PublicKey()))
+		Expect(wg.PublishRetryAfter()).To(BeZero())
+		Expect(wg.PendingWorkSummary().Key).To(BeFalse())
+
+		By("not publishing again")
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(1))
+	})
+
+	It("should back off publication with decelerating retries if the key cannot be adopted", func() {
+		err := wg.Apply()
+		var conflictErr *KeyConflictError
+		Expect(errors.As(err, &conflictErr)).To(BeTrue())
+		Expect(conflictErr.StoredKey).To(Equal(storedPrivateKey.PublicKey()))
+		Expect(published).To(HaveLen(1))
+		Expect(wg.PublishRetryAfter()).To(Equal(5 * time.Second))
+
+		By("not publishing until the retry is due")
+		t.IncrementTime(4 * time.Second)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(1))
+		Expect(wg.PendingWorkSummary().Key).To(BeTrue())
+		Expect(wg.PublishRetryAfter()).To(Equal(time.Second))
+
+		By("doubling the delay on each conflict")
+		var delays []time.Duration
+		for i := 0; i < 8; i++ {
+			t.IncrementTime(wg.PublishRetryAfter())
+			Expect(wg.Apply()).To(HaveOccurred())
+			delays = append(delays, wg.PublishRetryAfter())
+		}
+		Expect(published).To(HaveLen(9))
+		Expect(delays).To(Equal([]time.Duration{
+			10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second,
+			5 * time.Minute, 5 * time.Minute, 5 * time.Minute,
+		}))
+
+		By("resetting the back off once the key is published")
+		conflict = false
+		t.IncrementTime(wg.PublishRetryAfter())
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(10))
+		Expect(wg.PublishRetryAfter()).To(BeZero())
+		Expect(wg.PendingWorkSummary().Key).To(BeFalse())
+	})
+
+	It("should not adopt the stored key if a peer is carrying traffic", func() {
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		onConflict = func() {
+			otherFelixProgramsDevice()
+			wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		}
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wg.PublishRetryAfter()).To(Equal(5 * time.Second))
+		publicKey, _, _, _ := wg.LocalConfig()
+		Expect(publicKey).NotTo(Equal(storedPrivateKey.PublicKey()))
+	})
+
+	It("should back off publication if a conflict is reported once our key has been published", func() {
+		conflict = false
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(1))
+
+		By("republishing our key when asked to")
+		conflict = true
+		wg.RepublishKey()
+		Expect(wg.PendingWorkSummary().Key).To(BeTrue())
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(published).To(HaveLen(2))
+		Expect(published[1]).To(Equal(published[0]))
+		Expect(wg.PublishRetryAfter()).To(Equal(5 * time.Second))
+
+		By("publishing again once the conflict is resolved")
+		conflict = false
+		t.IncrementTime(wg.PublishRetryAfter())
+		Expect(wg.Apply()).To(Succeed())
+		Expect(published).To(HaveLen(3))
+		Expect(wg.PublishRetryAfter()).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard CIDR flap damping", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+	var throwRoute bool
+
+	const linkIndex = 10
+	const holdDown = 30 * time.Second
+
+	routekey := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekeyThrow := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	// move moves cidr_1 to the node a second later, resetting the dataplane deltas so that only the operations for the
+	// move are counted.
+	move := func(name string) {
+		t.IncrementTime(time.Second)
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		wg.EndpointAllowedCIDRAdd(name, cidr_1)
+		apply()
+	}
+	expectAssignedTo := func(key, other wgtypes.Key) {
+		Expect(link().WireguardPeers[key].AllowedIPs).To(ContainElement(ipnet_1))
+		Expect(link().WireguardPeers[other].AllowedIPs).NotTo(ContainElement(ipnet_1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+	}
+	expectNoOperations := func() {
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(0))
+		Expect(rtDataplane.AddedRouteKeys.Len()).To(Equal(0))
+		Expect(rtDataplane.DeletedRouteKeys.Len()).To(Equal(0))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		throwRoute = false
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				CIDRFlapMaxMoves:    2,
+				CIDRFlapWindow:      time.Minute,
+				CIDRFlapHoldDown:    holdDown,
+				CIDRFlapThrowRoute:  throwRoute,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		apply()
+		expectAssignedTo(key_peer1, key_peer2)
+	})
+
+	It("should not damp moves within the limit", func() {
+		move(peer2)
+		expectAssignedTo(key_peer2, key_peer1)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		move(peer1)
+		expectAssignedTo(key_peer1, key_peer2)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(wg.DampingReleaseAfter()).To(BeZero())
+	})
+
+	It("should not count moves outside of the window", func() {
+		for i := 0; i < 3; i++ {
+			t.IncrementTime(time.Minute)
+			move(peer2)
+			expectAssignedTo(key_peer2, key_peer1)
+			t.IncrementTime(time.Minute)
+			move(peer1)
+			expectAssignedTo(key_peer1, key_peer2)
+		}
+		Expect(wg.DampingReleaseAfter()).To(BeZero())
+	})
+
+	Context("with a flapping CIDR", func() {
+		JustBeforeEach(func() {
+			move(peer2)
+			move(peer1)
+			move(peer2)
+		})
+
+		It("should keep the last stable assignment until the CIDR is stable", func() {
+			expectAssignedTo(key_peer1, key_peer2)
+			expectNoOperations()
+			for i := 0; i < 5; i++ {
+				move(peer1)
+				expectNoOperations()
+				move(peer2)
+				expectNoOperations()
+			}
+			expectAssignedTo(key_peer1, key_peer2)
+			Expect(wg.DampingReleaseAfter()).To(Equal(holdDown))
+
+			// The hold-down is extended by each move.
+			t.IncrementTime(holdDown / 2)
+			move(peer1)
+			t.IncrementTime(holdDown / 2)
+			apply()
+			expectAssignedTo(key_peer1, key_peer2)
+			Expect(wg.DampingReleaseAfter()).To(Equal(holdDown / 2))
+			move(peer2)
+			expectNoOperations()
+
+			// Once the CIDR is stable the latest assignment is programmed, and a single move is not damped.
+			t.IncrementTime(holdDown)
+			Expect(wg.DampingReleaseAfter()).To(Equal(time.Millisecond))
+			wgDataplane.ResetDeltas()
+			apply()
+			expectAssignedTo(key_peer2, key_peer1)
+			Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+			Expect(wg.DampingReleaseAfter()).To(BeZero())
+			move(peer1)
+			expectAssignedTo(key_peer1, key_peer2)
+		})
+
+		It("should count a removal followed by an addition as a move", func() {
+			t.IncrementTime(holdDown)
+			apply()
+			expectAssignedTo(key_peer2, key_peer1)
+
+			for i := 0; i < 3; i++ {
+				t.IncrementTime(time.Second)
+				wgDataplane.ResetDeltas()
+				rtDataplane.ResetDeltas()
+				wg.EndpointAllowedCIDRRemove(cidr_1)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				wg.EndpointAllowedCIDRRemove(cidr_1)
+				wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+				apply()
+			}
+			expectAssignedTo(key_peer2, key_peer1)
+			expectNoOperations()
+			Expect(wg.DampingReleaseAfter()).NotTo(BeZero())
+		})
+
+		It("should remove a CIDR that is removed while damped once it is stable", func() {
+			wg.EndpointAllowedCIDRRemoveForNode(peer1, cidr_1)
+			apply()
+			expectAssignedTo(key_peer1, key_peer2)
+			wg.EndpointAllowedCIDRRemoveForNode(peer2, cidr_1)
+			apply()
+			expectAssignedTo(key_peer1, key_peer2)
+
+			t.IncrementTime(holdDown)
+			apply()
+			Expect(link().WireguardPeers[key_peer1].AllowedIPs).NotTo(ContainElement(ipnet_1))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey))
+			Expect(wg.DampingReleaseAfter()).To(BeZero())
+		})
+
+		It("should not assign a damped CIDR to a node that has been removed", func() {
+			wg.EndpointRemove(peer2)
+			apply()
+			t.IncrementTime(holdDown)
+			apply()
+			Expect(link().WireguardPeers).NotTo(HaveKey(key_peer2))
+			Expect(link().WireguardPeers[key_peer1].AllowedIPs).NotTo(ContainElement(ipnet_1))
+		})
+	})
+
+	Context("with throw routes for damped CIDRs", func() {
+		BeforeEach(func() {
+			throwRoute = true
+		})
+
+		It("should program a throw route until the CIDR is stable", func() {
+			move(peer2)
+			move(peer1)
+			move(peer2)
+			Expect(link().WireguardPeers[key_peer1].AllowedIPs).NotTo(ContainElement(ipnet_1))
+			Expect(link().WireguardPeers[key_peer2].AllowedIPs).NotTo(ContainElement(ipnet_1))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey))
+			for i := 0; i < 5; i++ {
+				move(peer1)
+				expectNoOperations()
+				move(peer2)
+				expectNoOperations()
+			}
+
+			t.IncrementTime(holdDown)
+			apply()
+			expectAssignedTo(key_peer2, key_peer1)
+			Expect(wg.DampingReleaseAfter()).To(BeZero())
+		})
+	})
+})
+
+var _ = Describe("Wireguard routes in the shared routing table", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+
+	const linkIndex = 10
+
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+	routekeyThrow := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+
+		// Simulate a restart. The wireguard link exists with the routes programmed by the previous felix, which include
+		// routes for CIDRs that are no longer expected.
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		for _, ipnet := range []net.IPNet{ipnet_1, ipnet_3} {
+			ipnet := ipnet
+			rtDataplane.AddMockRoute(&netlink.Route{
+				LinkIndex: linkIndex,
+				Dst:       &ipnet,
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  FelixRouteProtocol,
+				Scope:     netlink.SCOPE_LINK,
+				Table:     tableIndex,
+			})
+		}
+		rtDataplane.AddMockRoute(&netlink.Route{
+			Dst:      &ipnet_4,
+			Type:     syscall.RTN_THROW,
+			Protocol: FelixRouteProtocol,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		})
+
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+	})
+
+	It("should tidy up throw routes immediately and wait for the grace period for routes on the link", func() {
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_3)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow(cidr_4)))
+
+		t.IncrementTime(11 * time.Second)
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr_3)))
+	})
+
+	It("should not leave routes behind on a deleted link once it is recreated", func() {
+		t.IncrementTime(11 * time.Second)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_4)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_4)))
+
+		// Delete and recreate the link out-of-band. The kernel removes the routes via the old link but not the throw
+		// routes, and within the grace period the routes are reprogrammed on the new link.
+		wgDataplane.RecreateIface(linkIndex+1, ifaceName, true, true)
+		rtDataplane.RecreateIface(linkIndex+1, ifaceName, true, true)
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		for _, cidr := range []ip.CIDR{cidr_1, cidr_2} {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex+1, cidr)))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey(cidr)))
+		}
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow(cidr_4)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("Wireguard endpoint failover", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+	const timeout = 30 * time.Second
+	ipv4_secondary1 := ip.FromString("10.20.30.40")
+
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	// applyAfter applies after the duration, resetting the dataplane deltas so that only the operations of the apply are
+	// counted.
+	applyAfter := func(d time.Duration) {
+		t.IncrementTime(d)
+		wgDataplane.ResetDeltas()
+		apply()
+	}
+	endpointIP := func(key wgtypes.Key) net.IP {
+		return link().WireguardPeers[key].Endpoint.IP
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		wgDataplane.Time = t
+		s = &mockStatus{}
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                 true,
+				ListeningPort:           listeningPort,
+				FirewallMark:            firewallMark,
+				RoutingRulePriority:     rulePriority,
+				RoutingTableIndex:       tableIndex,
+				InterfaceName:           ifaceName,
+				MTU:                     mtu,
+				EndpointFailoverTimeout: timeout,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		// Peer 1 has a secondary address, peer 2 does not.
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointSecondaryUpdate(peer1, ipv4_secondary1)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		apply()
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(endpointIP(key_peer2)).To(Equal(ipv4_peer2.AsNetIP()))
+	})
+
+	It("should only schedule a check for the peer with a secondary address", func() {
+		Expect(wg.FailoverCheckAfter()).To(Equal(timeout))
+		t.IncrementTime(10 * time.Second)
+		Expect(wg.FailoverCheckAfter()).To(Equal(20 * time.Second))
+	})
+
+	It("should fail over to the secondary address if there is no handshake", func() {
+		applyAfter(timeout - time.Second)
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(0))
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+
+		applyAfter(time.Second)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		Expect(endpointIP(key_peer2)).To(Equal(ipv4_peer2.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(Equal(timeout))
+
+		diags := wg.PeerDiagnostics()
+		Expect(diags[peer1].SecondaryEndpoint).To(BeTrue())
+		Expect(diags[peer1].EndpointFailovers).To(Equal(1))
+		Expect(diags[peer1].ConfiguredEndpoint.IP).To(Equal(ipv4_secondary1.AsNetIP()))
+		Expect(diags[peer2].SecondaryEndpoint).To(BeFalse())
+		Expect(diags[peer2].EndpointFailovers).To(BeZero())
+	})
+
+	It("should not fail over if there is a handshake through the primary address", func() {
+		t.IncrementTime(time.Second)
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		applyAfter(timeout)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(0))
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(BeZero())
+		Expect(wg.PeerDiagnostics()[peer1].EndpointFailovers).To(BeZero())
+	})
+
+	It("should stay on the secondary address once there is a handshake through it", func() {
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		t.IncrementTime(time.Second)
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		applyAfter(timeout)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(0))
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(BeZero())
+	})
+
+	It("should switch back to the primary address if the secondary address also fails", func() {
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(wg.PeerDiagnostics()[peer1].SecondaryEndpoint).To(BeFalse())
+		Expect(wg.PeerDiagnostics()[peer1].EndpointFailovers).To(Equal(2))
+
+		t.IncrementTime(time.Second)
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1)
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(BeZero())
+	})
+
+	It("should revert to the primary address when the secondary address is removed", func() {
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		wg.EndpointSecondaryUpdate(peer1, nil)
+		applyAfter(0)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(BeZero())
+	})
+
+	It("should monitor the new primary address when the primary address changes", func() {
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+		wg.EndpointUpdate(peer1, ipv4_peer3)
+		applyAfter(0)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_peer3.AsNetIP()))
+		Expect(wg.FailoverCheckAfter()).To(Equal(timeout))
+		applyAfter(timeout)
+		Expect(endpointIP(key_peer1)).To(Equal(ipv4_secondary1.AsNetIP()))
+	})
+})
+
+var _ = Describe("Wireguard local CIDRs", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var localCIDRsAsThrow bool
+
+	const linkIndex = 10
+
+	routekey := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_local)
+	routekeyThrow := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_local)
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		localCIDRsAsThrow = false
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				LocalCIDRsAsThrow:   localCIDRsAsThrow,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	})
+
+	It("should ignore the local CIDRs by default", func() {
+		wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey))
+	})
+
+	Context("with the local CIDRs as throw routes", func() {
+		BeforeEach(func() {
+			localCIDRsAsThrow = true
+		})
+
+		It("should program a throw route for a local CIDR and remove it with the CIDR", func() {
+			wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+			Expect(rtDataplane.RouteKeyToRoute[routekeyThrow].Type).To(Equal(syscall.RTN_THROW))
+
+			wg.EndpointAllowedCIDRRemoveForNode(hostname, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+
+			wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+
+			wg.EndpointAllowedCIDRRemove(cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+		})
+
+		It("should route a local CIDR for a remote node that claims it, and restore the throw route after", func() {
+			key_peer1 := mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(hostname, s.key, nil)
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey))
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+
+			wg.EndpointAllowedCIDRRemoveForNode(peer1, cidr_local)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+		})
+
+		for _, linkUp := range []bool{true, false} {
+			linkUp := linkUp
+			It(fmt.Sprintf("should program the throw routes before the routing rule on first enable (link up: %v)", linkUp),
+				func() {
+					if !linkUp {
+						wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+						wgDataplane.NameToLink[ifaceName].LinkAttrs.Flags = 0
+					}
+					// The routes cannot be added, so the rule is not added either.
+					wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+					rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAdd
+					rtDataplane.PersistFailures = true
+					Expect(wg.Apply()).To(HaveOccurred())
+					Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekeyThrow))
+					Expect(wgDataplane.AddedRules).To(BeEmpty())
+
+					rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+					rtDataplane.PersistFailures = false
+					err := wg.Apply()
+					if linkUp {
+						Expect(err).NotTo(HaveOccurred())
+					}
+					Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow))
+					Expect(wgDataplane.AddedRules).To(HaveLen(1))
+				})
+		}
+	})
+})
+
+var _ = Describe("Wireguard pause", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var numKicks int
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+	const maxPause = 5 * time.Minute
+
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekey_2 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	hasRule := func() bool {
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table == tableIndex {
+				return true
+			}
+		}
+		return false
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	// applyPaused applies the wireguard module and the routing tables, as the dataplane does, and checks that no
+	// netlink or wireguard calls are made.
+	applyPaused := func() {
+		apply()
+		for _, rt := range wg.RouteTableSyncers() {
+			Expect(rt.Apply()).To(Succeed())
+		}
+		Expect(wg.Paused()).To(BeTrue())
+		Expect(wgDataplane.Calls).To(BeEmpty())
+		Expect(rtDataplane.Calls).To(BeEmpty())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		numKicks = 0
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				MaxPauseDuration:    maxPause,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			func() { numKicks++ },
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		apply()
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(hasRule()).To(BeTrue())
+
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		numKicks = 0
+		wg.Pause()
+	})
+
+	It("should accumulate the updates while paused, and resync once resumed", func() {
+		Expect(wg.Paused()).To(BeTrue())
+		Expect(wg.ResumeAfter()).To(Equal(maxPause))
+
+		By("making no calls while the maintenance changes the dataplane")
+		delete(link().WireguardPeers, key_peer1)
+		delete(rtDataplane.RouteKeyToRoute, routekey_1)
+		wgDataplane.Rules = wgDataplane.Rules[:len(wgDataplane.Rules)-1]
+		Expect(hasRule()).To(BeFalse())
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		wg.QueueResync()
+		applyPaused()
+		applyPaused()
+		Expect(wg.PendingWorkSummary()).To(Equal(PendingWorkSummary{Peers: true, Routes: true, Rules: true}))
+		Expect(link().WireguardPeers).NotTo(HaveKey(key_peer2))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+
+		By("resuming on the next apply")
+		wg.Resume()
+		Expect(numKicks).To(Equal(1))
+		Expect(wg.Paused()).To(BeTrue())
+		Expect(wg.ResumeAfter()).To(Equal(time.Millisecond))
+		apply()
+		Expect(wg.Paused()).To(BeFalse())
+		Expect(wg.ResumeAfter()).To(BeZero())
+		Expect(wg.HasPendingWork()).To(BeFalse())
+
+		By("reconciling the changes made while paused")
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link().WireguardPeers).To(HaveKey(key_peer2))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+		Expect(hasRule()).To(BeTrue())
+	})
+
+	It("should resume automatically after the maximum pause duration", func() {
+		t.IncrementTime(maxPause - time.Second)
+		delete(link().WireguardPeers, key_peer1)
+		applyPaused()
+		Expect(wg.ResumeAfter()).To(Equal(time.Second))
+
+		t.IncrementTime(time.Second)
+		apply()
+		Expect(wg.Paused()).To(BeFalse())
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(numKicks).To(BeZero())
+	})
+
+	It("should not extend the pause when paused again, and ignore a resume when not paused", func() {
+		t.IncrementTime(time.Minute)
+		wg.Pause()
+		Expect(wg.ResumeAfter()).To(Equal(maxPause - time.Minute))
+
+		By("cancelling a requested resume")
+		wg.Resume()
+		wg.Pause()
+		applyPaused()
+
+		wg.Resume()
+		apply()
+		Expect(wg.Paused()).To(BeFalse())
+		numKicks = 0
+		wg.Resume()
+		Expect(numKicks).To(BeZero())
+		Expect(wg.Paused()).To(BeFalse())
+	})
+
+	It("should tear down while paused", func() {
+		Expect(wg.Teardown()).To(Succeed())
+		Expect(wg.Paused()).To(BeFalse())
+		Expect(hasRule()).To(BeFalse())
+		Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+	})
+})
+
+var _ = Describe("Wireguard conntrack cleanup", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var conntrackCleanup bool
+	var key_peer1, key_peer2, key_peer3 wgtypes.Key
+
+	var cleanedLock sync.Mutex
+	var cleaned []ip.CIDR
+	cleaner := func(cidr ip.CIDR) {
+		cleanedLock.Lock()
+		defer cleanedLock.Unlock()
+		cleaned = append(cleaned, cidr)
+	}
+	getCleaned := func() []ip.CIDR {
+		cleanedLock.Lock()
+		defer cleanedLock.Unlock()
+		return append([]ip.CIDR(nil), cleaned...)
+	}
+
+	const linkIndex = 10
+
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekeyThrow_1 := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+	routekey_4 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_4)
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		conntrackCleanup = true
+		cleaned = nil
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				ConntrackCleanup:    conntrackCleanup,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.SetConntrackCleaner(cleaner)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		// Peers 1 and 2 are routed to wireguard, peer 3 has no key and so has throw routes.
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		key_peer3 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		wg.EndpointUpdate(peer3, ipv4_peer3)
+		wg.EndpointAllowedCIDRAdd(peer3, cidr_4)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+	})
+
+	It("should clean up a CIDR once when its route to wireguard is removed", func() {
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+		Eventually(getCleaned).Should(Equal([]ip.CIDR{cidr_1}))
+
+		apply()
+		Consistently(getCleaned, "100ms", "10ms").Should(Equal([]ip.CIDR{cidr_1}))
+	})
+
+	It("should clean up the CIDRs of a peer that no longer supports wireguard", func() {
+		wg.EndpointWireguardRemove(peer1)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekeyThrow_1))
+		Eventually(getCleaned).Should(ConsistOf(cidr_1, cidr_2))
+		Consistently(getCleaned, "100ms", "10ms").Should(HaveLen(2))
+	})
+
+	It("should not clean up a CIDR that is newly routed to wireguard", func() {
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_4))
+		Consistently(getCleaned, "100ms", "10ms").Should(BeEmpty())
+	})
+
+	It("should not clean up a CIDR whose route to wireguard is only updated", func() {
+		wg.EndpointAllowedCIDRRemoveForNode(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer2].AllowedIPs).To(
+			ContainElement(cidr_1.ToIPNet()))
+		Consistently(getCleaned, "100ms", "10ms").Should(BeEmpty())
+	})
+
+	It("should only clean up once the routes have been applied", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		Expect(wg.ApplyWithContext(ctx)).To(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Consistently(getCleaned, "100ms", "10ms").Should(BeEmpty())
+
+		apply()
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+		Eventually(getCleaned).Should(Equal([]ip.CIDR{cidr_1}))
+	})
+
+	Context("with conntrack cleanup disabled", func() {
+		BeforeEach(func() {
+			conntrackCleanup = false
+		})
+
+		It("should not clean up a CIDR when its route to wireguard is removed", func() {
+			wg.EndpointAllowedCIDRRemove(cidr_1)
+			apply()
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+			Consistently(getCleaned, "100ms", "10ms").Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Wireguard node name canonicalization", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekey_2 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)
+	routekey_3 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_3)
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	apply := func() {
+		err := wg.Apply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			"My-Host.",
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	canonicalize := func(name string) string {
+		return strings.TrimRight(strings.ToLower(name), ".")
+	}
+
+	It("should merge the entries of a node split across differently formatted names", func() {
+		By("sending the endpoint, key and CIDRs of the node under different names")
+		wg.EndpointUpdate("Peer1.", ipv4_peer1)
+		wg.EndpointWireguardUpdate("peer1", key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd("PEER1", cidr_1)
+		wg.EndpointAllowedCIDRAdd("peer1", cidr_2)
+		apply()
+
+		By("checking that neither entry is programmed as a peer")
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+
+		By("canonicalizing the names")
+		wg.SetNodeNameCanonicalizer(canonicalize)
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		peer := link().WireguardPeers[key_peer1]
+		Expect(peer.Endpoint.IP).To(Equal(ipv4_peer1.AsNetIP()))
+		Expect(peer.AllowedIPs).To(ConsistOf(cidr_1.ToIPNet(), cidr_2.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+
+		By("canonicalizing the names of subsequent updates")
+		wg.EndpointAllowedCIDRAdd("Peer1", cidr_3)
+		apply()
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(3))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_3))
+
+		wg.EndpointRemove("PEER1.")
+		wg.EndpointWireguardRemove("PEER1.")
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+	})
+
+	It("should prefer the newest endpoint and key when merging", func() {
+		wg.EndpointUpdate("peer1", ipv4_peer1)
+		wg.EndpointWireguardUpdate("Peer1", key_peer1, nil)
+		wg.EndpointUpdate("Peer1", ipv4_peer2)
+		wg.EndpointWireguardUpdate("peer1", key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd("Peer1", cidr_1)
+		wg.SetNodeNameCanonicalizer(canonicalize)
+		apply()
+
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(link().WireguardPeers).To(HaveKey(key_peer2))
+		peer := link().WireguardPeers[key_peer2]
+		Expect(peer.Endpoint.IP).To(Equal(ipv4_peer2.AsNetIP()))
+		Expect(peer.AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+	})
+
+	It("should merge a node that is already programmed", func() {
+		wg.EndpointUpdate("peer1", ipv4_peer1)
+		wg.EndpointWireguardUpdate("peer1", key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd("peer1", cidr_1)
+		wg.EndpointAllowedCIDRAdd("Peer1", cidr_2)
+		wg.EndpointWireguardReady("Peer1", true)
+		apply()
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+
+		wg.SetNodeNameCanonicalizer(canonicalize)
+		apply()
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet(), cidr_2.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+	})
+
+	It("should canonicalize our hostname", func() {
+		wg.SetNodeNameCanonicalizer(canonicalize)
+		wg.EndpointUpdate("MY-HOST", ipv4_host)
+		wg.EndpointWireguardUpdate("my-host", key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd("My-Host", cidr_1)
+		apply()
+
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(s.key).To(Equal(link().WireguardPublicKey))
+	})
+})
+
+var _ = Describe("Wireguard routing rule selectors", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+
+	const linkIndex = 10
+
+	cidr_pods := ip.MustParseCIDROrIP("10.0.0.0/24")
+	cidr_pods2 := ip.MustParseCIDROrIP("10.0.1.0/24")
+	cidr_borrowed := ip.MustParseCIDROrIP("10.0.0.5/32")
+
+	// The netlink and wireguard handles of a previous instance are closed when its process exits.
+	newWireguard := func(enabled bool, selectors ...RuleSelector) {
+		for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			dp.NumOpenNetlinks = 0
+			dp.NetlinkOpen = false
+			dp.WireguardOpen = false
+		}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             enabled,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				RuleSelectors:       selectors,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	// ourRules returns the rules to the wireguard routing table, the default rules are to other tables.
+	ourRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table == tableIndex {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+	rule := func(configure func(rule *netlink.Rule)) netlink.Rule {
+		r := netlink.NewRule()
+		r.Priority = rulePriority
+		r.Table = tableIndex
+		configure(r)
+		return *r
+	}
+	fwmarkRule := rule(func(r *netlink.Rule) {
+		r.Mark = firewallMark
+		r.Invert = true
+	})
+	sourceRule := func(cidr ip.CIDR) netlink.Rule {
+		return rule(func(r *netlink.Rule) {
+			ipNet := cidr.ToIPNet()
+			r.Src = &ipNet
+		})
+	}
+	iifRule := func(ifaceName string) netlink.Rule {
+		return rule(func(r *netlink.Rule) { r.IifName = ifaceName })
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+	})
+
+	It("should program the inverted fwmark rule by default", func() {
+		newWireguard(true)
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods})
+		wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateUp)
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{fwmarkRule}))
+	})
+
+	It("should program a rule for each of the source CIDRs", func() {
+		newWireguard(true, RuleSelectorSource)
+		apply()
+		Expect(ourRules()).To(BeEmpty())
+
+		// The CIDRs of the other IP version, and the CIDRs within another CIDR, do not have rules.
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods, cidr_borrowed, cidr_pods2, ip.MustParseCIDROrIP("fd00::/122")})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{sourceRule(cidr_pods), sourceRule(cidr_pods2)}))
+
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods2})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{sourceRule(cidr_pods2)}))
+		Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{sourceRule(cidr_pods)}))
+
+		// An unchanged update requires no work.
+		wgDataplane.ResetDeltas()
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods2})
+		apply()
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+		Expect(wgDataplane.DeletedRules).To(BeEmpty())
+	})
+
+	It("should program a rule for each of the selected interfaces that are up", func() {
+		newWireguard(true, RuleSelectorIif)
+		wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateUp)
+		wg.OnIfaceStateChanged("cali5678", ifacemonitor.StateUp)
+		wg.OnIfaceStateChanged("eth0", ifacemonitor.StateUp)
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{iifRule("cali1234"), iifRule("cali5678")}))
+
+		wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateDown)
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{iifRule("cali5678")}))
+	})
+
+	It("should combine the selectors, matching the traffic without the firewall mark bit", func() {
+		newWireguard(true, RuleSelectorFwmark, RuleSelectorSource, RuleSelectorIif)
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods})
+		wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateUp)
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{rule(func(r *netlink.Rule) {
+			ipNet := cidr_pods.ToIPNet()
+			r.Src = &ipNet
+			r.IifName = "cali1234"
+			r.Mark = 0
+			r.Mask = firewallMark
+		})}))
+	})
+
+	It("should migrate between the rule forms when the selectors are updated", func() {
+		newWireguard(true)
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{fwmarkRule}))
+
+		wg.UpdateConfig(&Config{RuleSelectors: []RuleSelector{RuleSelectorSource}})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{sourceRule(cidr_pods)}))
+		Expect(wgDataplane.DeletedRules).To(Equal([]netlink.Rule{fwmarkRule}))
+
+		wg.UpdateConfig(&Config{})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{fwmarkRule}))
+	})
+
+	It("should replace the rules of a previous instance with other selectors", func() {
+		newWireguard(true, RuleSelectorIif)
+		wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateUp)
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{iifRule("cali1234")}))
+
+		newWireguard(true, RuleSelectorSource)
+		wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods})
+		apply()
+		Expect(ourRules()).To(Equal([]netlink.Rule{sourceRule(cidr_pods)}))
+	})
+
+	for _, selector := range []RuleSelector{RuleSelectorSource, RuleSelectorIif} {
+		selector := selector
+		It(fmt.Sprintf("should remove the %s rules when disabled or torn down", selector), func() {
+			programRules := func() {
+				newWireguard(true, selector)
+				wg.SetRuleSourceCIDRs([]ip.CIDR{cidr_pods})
+				wg.OnIfaceStateChanged("cali1234", ifacemonitor.StateUp)
+				apply()
+				Expect(ourRules()).To(HaveLen(1))
+			}
+
+			programRules()
+			newWireguard(false, selector)
+			apply()
+			Expect(ourRules()).To(BeEmpty())
+
+			programRules()
+			Expect(wg.Teardown()).NotTo(HaveOccurred())
+			Expect(ourRules()).To(BeEmpty())
+		})
+	}
+
+	It("should reject an unknown selector", func() {
+		config := &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			RuleSelectors:       []RuleSelector{RuleSelectorSource, "dst"},
+		}
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ConfigError).Field).To(Equal("RuleSelectors"))
+	})
+})
+
+var _ = Describe("Wireguard private key attestation", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s *mockStatus
+	var wg *Wireguard
+	var hook *logtest.Hook
+
+	const linkIndex = 10
+
+	// newWireguard creates the wireguard module logging at trace level to the test hook. The netlink and wireguard
+	// handles of a previous instance are closed when its process exits.
+	newWireguard := func() {
+		for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			dp.NumOpenNetlinks = 0
+			dp.NetlinkOpen = false
+			dp.WireguardOpen = false
+		}
+		logLevel := log.TraceLevel
+		// The wireguard logger takes a copy of the hooks of the standard logger, so install the test hook only while
+		// the wireguard module is created.
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		log.StandardLogger().AddHook(hook)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				LogLevel:            &logLevel,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		log.StandardLogger().Hooks = stdHooks
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		s = &mockStatus{}
+		hook = new(logtest.Hook)
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		newWireguard()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		apply()
+		Expect(wgDataplane.ConfiguredWireguardPrivateKeys).To(HaveLen(1))
+		Expect(s.key).To(Equal(link().WireguardPublicKey))
+	})
+
+	It("should reprogram our key if the key of the device is changed out of band", func() {
+		publicKey := s.key
+		numCallbacks := s.numCallbacks
+		wgDataplane.SetWireguardPrivateKey(ifaceName, mustGeneratePrivateKey())
+
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		apply()
+		Expect(wgDataplane.ConfiguredWireguardPrivateKeys).To(HaveLen(1))
+		Expect(link().WireguardPublicKey).To(Equal(publicKey))
+		Expect(wg.KeyDriftsCorrected()).To(Equal(1))
+
+		By("not publishing a new key")
+		Expect(s.key).To(Equal(publicKey))
+		Expect(s.numCallbacks).To(Equal(numCallbacks))
+		localKey, _, _, _ := wg.LocalConfig()
+		Expect(localKey).To(Equal(publicKey))
+
+		By("not reprogramming the key once corrected")
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		apply()
+		Expect(wgDataplane.ConfiguredWireguardPrivateKeys).To(BeEmpty())
+		Expect(wg.KeyDriftsCorrected()).To(Equal(1))
+	})
+
+	It("should not reprogram the key of the device if it has not changed", func() {
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		apply()
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(wg.KeyDriftsCorrected()).To(BeZero())
+	})
+
+	It("should reprogram our key on a full rebuild", func() {
+		publicKey := s.key
+		wgDataplane.SetWireguardPrivateKey(ifaceName, mustGeneratePrivateKey())
+
+		wgDataplane.ResetDeltas()
+		wg.QueueFullRebuild()
+		apply()
+		Expect(link().WireguardPublicKey).To(Equal(publicKey))
+		Expect(wg.KeyDriftsCorrected()).To(Equal(1))
+		Expect(s.key).To(Equal(publicKey))
+	})
+
+	It("should adopt the key of the device on a restart", func() {
+		publicKey := s.key
+		newWireguard()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+
+		wgDataplane.ResetDeltas()
+		apply()
+		Expect(wgDataplane.ConfiguredWireguardPrivateKeys).To(BeEmpty())
+		Expect(link().WireguardPublicKey).To(Equal(publicKey))
+		Expect(wg.KeyDriftsCorrected()).To(BeZero())
+	})
+
+	It("should generate a new key once the device is recreated", func() {
+		publicKey := s.key
+		delete(wgDataplane.NameToLink, ifaceName)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+		apply()
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+
+		Expect(link().WireguardPublicKey).NotTo(Equal(publicKey))
+		Expect(s.key).To(Equal(link().WireguardPublicKey))
+		Expect(wg.KeyDriftsCorrected()).To(BeZero())
+	})
+
+	It("should never log a private key", func() {
+		privateKeys := []wgtypes.Key{link().WireguardPrivateKey}
+		setKeyOutOfBand := func() {
+			privateKey := mustGeneratePrivateKey()
+			privateKeys = append(privateKeys, privateKey)
+			wgDataplane.SetWireguardPrivateKey(ifaceName, privateKey)
+		}
+
+		By("correcting drift on a resync")
+		setKeyOutOfBand()
+		wg.QueueResync()
+		apply()
+
+		By("correcting drift on a full rebuild")
+		setKeyOutOfBand()
+		wg.QueueFullRebuild()
+		apply()
+
+		By("adopting the key of the device on a restart")
+		newWireguard()
+		apply()
+		setKeyOutOfBand()
+		wg.QueueResync()
+		apply()
+
+		By("generating a new key once the device is recreated")
+		delete(wgDataplane.NameToLink, ifaceName)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateDown)
+		apply()
+		wgDataplane.SetIface(ifaceName, true, true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		privateKeys = append(privateKeys, link().WireguardPrivateKey)
+		Expect(wg.KeyDriftsCorrected()).To(Equal(1))
+
+		var lines []string
+		for _, entry := range hook.AllEntries() {
+			line, err := entry.String()
+			Expect(err).NotTo(HaveOccurred())
+			lines = append(lines, line)
+		}
+		Expect(strings.Join(lines, "\n")).To(ContainSubstring(link().WireguardPublicKey.String()))
+		for _, privateKey := range privateKeys {
+			Expect(privateKey.String()).To(HaveLen(44))
+			for _, line := range lines {
+				Expect(line).NotTo(ContainSubstring(privateKey.String()))
+			}
+		}
+	})
+})
+
+var _ = Describe("Wireguard non-wireguard peer handling", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+
+	const linkIndex = 10
+	const ethLinkIndex = 2
+
+	// The address of peer2, which does not support wireguard, borrowed from the IPAM block of peer1.
+	cidr_borrowed := ip.MustParseCIDROrIP("192.168.1.7/32")
+	ipnet_borrowed := cidr_borrowed.ToIPNet()
+	ipnet_pools := ip.MustParseCIDROrIP("192.168.0.0/16").ToIPNet()
+
+	newWireguard := func(handling NonWireguardPeerHandling) {
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                  true,
+				ListeningPort:            listeningPort,
+				FirewallMark:             firewallMark,
+				RoutingRulePriority:      rulePriority,
+				RoutingTableIndex:        tableIndex,
+				InterfaceName:            ifaceName,
+				MTU:                      mtu,
+				NonWireguardPeerHandling: handling,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	// lookup returns the interface of the route that the kernel would use for the traffic to the address, with the
+	// firewall mark.
+	lookup := func(addr string, mark int) int {
+		route := wgDataplane.RouteLookup(rtDataplane, ip.FromString(addr), nil, "", mark)
+		Expect(route).NotTo(BeNil())
+		return route.LinkIndex
+	}
+	ourRoutes := func() []netlink.Route {
+		var routes []netlink.Route
+		for _, route := range rtDataplane.RouteKeyToRoute {
+			if route.Table == tableIndex {
+				routes = append(routes, route)
+			}
+		}
+		return routes
+	}
+	throwRoute := func(ipNet net.IPNet) netlink.Route {
+		return netlink.Route{
+			Dst:      &ipNet,
+			Type:     syscall.RTN_THROW,
+			Protocol: FelixRouteProtocol,
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Table:    tableIndex,
+		}
+	}
+	exclusionRule := func(ipNet net.IPNet) netlink.Rule {
+		rule := netlink.NewRule()
+		rule.Priority = rulePriority - 1
+		rule.Table = syscall.RT_TABLE_MAIN
+		rule.Dst = &ipNet
+		rule.SuppressPrefixlen = 0
+		return *rule
+	}
+	exclusionRules := func() []netlink.Rule {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Priority == rulePriority-1 {
+				rules = append(rules, rule)
+			}
+		}
+		return rules
+	}
+	expectForwarding := func() {
+		By("checking that only the traffic to the wireguard peer is routed to wireguard")
+		Expect(lookup("192.168.1.1", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.2.1", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("192.168.1.7", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("8.8.8.8", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("192.168.1.1", firewallMark)).To(Equal(ethLinkIndex))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(ethLinkIndex, "eth0", true, true)
+
+		// The main table routes the IP pools, and the rest of the traffic, out of eth0.
+		rtDataplane.AddMockRoute(&netlink.Route{LinkIndex: ethLinkIndex, Table: syscall.RT_TABLE_MAIN})
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: ethLinkIndex,
+			Dst:       &ipnet_pools,
+			Table:     syscall.RT_TABLE_MAIN,
+		})
+	})
+
+	addPeers := func() {
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_borrowed)
+	}
+
+	It("should program throw routes for the non-wireguard peers by default", func() {
+		newWireguard("")
+		addPeers()
+		apply()
+		Expect(ourRoutes()).To(ContainElement(throwRoute(ipnet_2)))
+		Expect(ourRoutes()).To(ContainElement(throwRoute(ipnet_borrowed)))
+		Expect(exclusionRules()).To(BeEmpty())
+		expectForwarding()
+	})
+
+	It("should program exclusion rules instead of throw routes with rule-exclude", func() {
+		newWireguard(NonWireguardPeerHandlingRuleExclude)
+		addPeers()
+		apply()
+		Expect(ourRoutes()).To(HaveLen(1))
+		Expect(ourRoutes()[0].Dst).To(Equal(&ipnet_1))
+		Expect(ourRoutes()[0].LinkIndex).To(Equal(linkIndex))
+
+		// Only the borrowed address needs an exclusion rule, the other CIDR of peer2 matches none of our routes.
+		Expect(exclusionRules()).To(Equal([]netlink.Rule{exclusionRule(ipnet_borrowed)}))
+		expectForwarding()
+
+		By("removing the exclusion rule once the borrowed address is released")
+		wg.EndpointAllowedCIDRRemove(cidr_borrowed)
+		apply()
+		Expect(exclusionRules()).To(BeEmpty())
+		Expect(lookup("192.168.1.7", 0)).To(Equal(linkIndex))
+	})
+
+	It("should replace the routes of a peer that stops supporting wireguard", func() {
+		newWireguard(NonWireguardPeerHandlingRuleExclude)
+		addPeers()
+		apply()
+
+		wg.EndpointWireguardRemove(peer1)
+		apply()
+		Expect(ourRoutes()).To(BeEmpty())
+		Expect(exclusionRules()).To(BeEmpty())
+		Expect(lookup("192.168.1.1", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("192.168.1.7", 0)).To(Equal(ethLinkIndex))
+	})
+
+	It("should clean up the structures of the previous handling when it is updated", func() {
+		newWireguard(NonWireguardPeerHandlingThrow)
+		addPeers()
+		apply()
+
+		By("switching to rule-exclude")
+		wg.UpdateConfig(&Config{NonWireguardPeerHandling: NonWireguardPeerHandlingRuleExclude})
+		apply()
+		Expect(ourRoutes()).To(HaveLen(1))
+		Expect(exclusionRules()).To(Equal([]netlink.Rule{exclusionRule(ipnet_borrowed)}))
+		expectForwarding()
+
+		By("switching back to throw routes")
+		wg.UpdateConfig(&Config{NonWireguardPeerHandling: NonWireguardPeerHandlingThrow})
+		apply()
+		Expect(ourRoutes()).To(HaveLen(3))
+		Expect(ourRoutes()).To(ContainElement(throwRoute(ipnet_2)))
+		Expect(ourRoutes()).To(ContainElement(throwRoute(ipnet_borrowed)))
+		Expect(exclusionRules()).To(BeEmpty())
+		expectForwarding()
+	})
+
+	It("should clean up the structures of the previous handling across a restart", func() {
+		newWireguard(NonWireguardPeerHandlingRuleExclude)
+		addPeers()
+		apply()
+
+		for _, dp := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			dp.NumOpenNetlinks = 0
+			dp.NetlinkOpen = false
+			dp.WireguardOpen = false
+		}
+		newWireguard(NonWireguardPeerHandlingThrow)
+		addPeers()
+		apply()
+		Expect(ourRoutes()).To(ContainElement(throwRoute(ipnet_borrowed)))
+		Expect(exclusionRules()).To(BeEmpty())
+		expectForwarding()
+	})
+
+	It("should remove the exclusion rules when torn down", func() {
+		newWireguard(NonWireguardPeerHandlingRuleExclude)
+		addPeers()
+		apply()
+		Expect(exclusionRules()).To(HaveLen(1))
+
+		Expect(wg.Teardown()).NotTo(HaveOccurred())
+		Expect(exclusionRules()).To(BeEmpty())
+	})
+
+	It("should validate the handling", func() {
+		config := &Config{
+			Enabled:                  true,
+			ListeningPort:            listeningPort,
+			FirewallMark:             firewallMark,
+			RoutingRulePriority:      rulePriority,
+			RoutingTableIndex:        tableIndex,
+			InterfaceName:            ifaceName,
+			NonWireguardPeerHandling: "drop",
+		}
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ConfigError).Field).To(Equal("NonWireguardPeerHandling"))
+
+		config.NonWireguardPeerHandling = NonWireguardPeerHandlingRuleExclude
+		Expect(config.Validate()).NotTo(HaveOccurred())
+		config.RoutingRulePriority = 1
+		err = config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ConfigError).Field).To(Equal("RoutingRulePriority"))
+	})
+})
+
+var _ = Describe("Wireguard allowed IPs chunks", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+	const numCIDRs = 8000
+	const chunkSize = 1000
+
+	// The CIDRs of the peer in sorted order, which is the order they are chunked in.
+	var cidrs []ip.CIDR
+	for i := 0; i < numCIDRs; i++ {
+		cidrs = append(cidrs, ip.MustParseCIDROrIP(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)))
+	}
+	routekey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	numRoutes := func() int {
+		n := 0
+		for _, cidr := range cidrs {
+			if _, ok := rtDataplane.RouteKeyToRoute[routekey(cidr)]; ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wgDataplane.MaxAllowedIPsPerWireguardConfigure = chunkSize
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				AllowedIPsChunkSize: chunkSize,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		for _, cidr := range cidrs {
+			wg.EndpointAllowedCIDRAdd(peer1, cidr)
+		}
+		wgDataplane.ResetDeltas()
+	})
+
+	It("should configure the allowed IPs of a peer in chunks", func() {
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+
+		// The chunks of peer1 are full, so peer2 is configured by a separate configuration.
+		Expect(wgDataplane.WireguardConfigureAllowedIPs).To(ConsistOf(
+			chunkSize, chunkSize, chunkSize, chunkSize, chunkSize, chunkSize, chunkSize, chunkSize, 1,
+		))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(numCIDRs))
+		Expect(numRoutes()).To(Equal(numCIDRs))
+		Expect(wg.LastApplyStats().PeersAdded).To(Equal(2))
+
+		By("replacing the allowed IPs in chunks once a CIDR is removed")
+		wgDataplane.ResetDeltas()
+		wg.EndpointAllowedCIDRRemove(cidrs[0])
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(8))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(numCIDRs - 1))
+		Expect(wg.LastApplyStats().PeersUpdated).To(Equal(1))
+	})
+
+	It("should only add the routes of the configured chunks and resume from the failed chunk", func() {
+		wgDataplane.FailWireguardConfigureCall = 4
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(3 * chunkSize))
+		Expect(numRoutes()).To(Equal(3 * chunkSize))
+		for _, cidr := range cidrs[:3*chunkSize] {
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey(cidr)))
+		}
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+
+		// The resync appends the allowed IPs that are missing, rather than replacing all of them again.
+		wgDataplane.ResetDeltas()
+		wgDataplane.FailWireguardConfigureCall = 0
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigureAllowedIPs).To(Equal([]int{
+			chunkSize, chunkSize, chunkSize, chunkSize, chunkSize,
+		}))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(numCIDRs))
+		Expect(numRoutes()).To(Equal(numCIDRs))
+	})
+
+	It("should fail a configuration that exceeds the size limit", func() {
+		wgDataplane.MaxAllowedIPsPerWireguardConfigure = chunkSize - 1
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(numRoutes()).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard node overrides", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var tempDir, overridesFile string
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	writeOverrides := func(overrides string) {
+		Expect(ioutil.WriteFile(overridesFile, []byte(overrides), 0600)).To(Succeed())
+	}
+	newWireguard := func() {
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				NodeOverridesFile:   overridesFile,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	resync := func() {
+		wg.QueueResync()
+		apply()
+	}
+	rulePriorities := func() []int {
+		var priorities []int
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table == tableIndex {
+				priorities = append(priorities, rule.Priority)
+			}
+		}
+		return priorities
+	}
+	// expectSettings checks the settings programmed on the device, the routing rule and the peer, and the published
+	// listening port.
+	expectSettings := func(port, mtu, priority int, keepalive time.Duration) {
+		Expect(link().WireguardListenPort).To(Equal(port))
+		Expect(s.port).To(Equal(port))
+		Expect(link().LinkAttrs.MTU).To(Equal(mtu))
+		Expect(rulePriorities()).To(Equal([]int{priority}))
+		Expect(link().WireguardPeers[key_peer1].PersistentKeepaliveInterval).To(Equal(keepalive))
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "felix-wireguard-")
+		Expect(err).NotTo(HaveOccurred())
+		overridesFile = filepath.Join(tempDir, "overrides.json")
+
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(tempDir)
+	})
+
+	It("should use the configuration if there is no overrides file", func() {
+		newWireguard()
+		apply()
+		expectSettings(listeningPort, mtu, rulePriority, 0)
+	})
+
+	It("should merge the overrides over the configuration", func() {
+		writeOverrides(`{"listeningPort": 51821, "mtu": 1380, "persistentKeepalive": 25}`)
+		newWireguard()
+		apply()
+
+		// The routing rule priority is not overridden.
+		expectSettings(51821, 1380, rulePriority, 25*time.Second)
+	})
+
+	It("should apply an edit of the overrides file on a resync", func() {
+		writeOverrides(`{"listeningPort": 51821, "mtu": 1380, "persistentKeepalive": 25}`)
+		newWireguard()
+		apply()
+
+		By("not applying the edit until a resync")
+		writeOverrides(`{"listeningPort": 51822, "routingRulePriority": 90, "persistentKeepalive": 0}`)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		apply()
+		expectSettings(51821, 1380, rulePriority, 25*time.Second)
+
+		By("applying the edit on a resync, reverting the settings that are no longer overridden")
+		resync()
+		expectSettings(51822, mtu, 90, 0)
+
+		By("reverting to the configuration once the file is removed")
+		Expect(os.Remove(overridesFile)).To(Succeed())
+		resync()
+		expectSettings(listeningPort, mtu, rulePriority, 0)
+	})
+
+	It("should retain the previous overrides if the file is malformed or not valid", func() {
+		writeOverrides(`{"listeningPort": 51821, "mtu": 1380}`)
+		newWireguard()
+		apply()
+		expectSettings(51821, 1380, rulePriority, 0)
+
+		for _, overrides := range []string{
+			`{"listeningPort": 51822,`,
+			`{"listenPort": 51822}`,
+			`{"listeningPort": "51822"}`,
+			`{"listeningPort": 70000}`,
+			`{"mtu": 20}`,
+			`{"persistentKeepalive": -1}`,
+			`{"routingRulePriority": 40000}`,
+		} {
+			By("writing " + overrides)
+			writeOverrides(overrides)
+			resync()
+			expectSettings(51821, 1380, rulePriority, 0)
+		}
+
+		By("applying the overrides once the file is fixed")
+		writeOverrides(`{"listeningPort": 51822}`)
+		resync()
+		expectSettings(51822, mtu, rulePriority, 0)
+	})
+
+	It("should use the configuration if the overrides file is malformed at startup", func() {
+		writeOverrides(`listeningPort: 51821`)
+		newWireguard()
+		apply()
+		expectSettings(listeningPort, mtu, rulePriority, 0)
+	})
+})
+
+var _ = Describe("Wireguard peers without an endpoint", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekey_1_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	newWireguard := func(programPeersWithoutEndpoint bool) {
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                     true,
+				ListeningPort:               listeningPort,
+				FirewallMark:                firewallMark,
+				RoutingRulePriority:         rulePriority,
+				RoutingTableIndex:           tableIndex,
+				InterfaceName:               ifaceName,
+				MTU:                         mtu,
+				ProgramPeersWithoutEndpoint: programPeersWithoutEndpoint,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectThrowRoute := func() {
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+	}
+	expectProgrammed := func() {
+		Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link().WireguardPeers[key_peer1].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer1.AsNetIP(),
+			Port: listeningPort,
+		}))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	Context("without ProgramPeersWithoutEndpoint", func() {
+		BeforeEach(func() {
+			newWireguard(false)
+		})
+
+		It("should use a throw route for a peer with a key but no endpoint until the endpoint arrives", func() {
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			apply()
+			expectThrowRoute()
+
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			apply()
+			expectProgrammed()
+		})
+
+		It("should use a throw route for a peer with an endpoint but no key until the key arrives", func() {
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			apply()
+			expectThrowRoute()
+
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			apply()
+			expectProgrammed()
+		})
+
+		Context("with a programmed peer", func() {
+			BeforeEach(func() {
+				wg.EndpointUpdate(peer1, ipv4_peer1)
+				wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				apply()
+				expectProgrammed()
+			})
+
+			It("should remove the peer and its routes on an EndpointRemove without an EndpointWireguardRemove", func() {
+				wg.EndpointRemove(peer1)
+				apply()
+				Expect(link().WireguardPeers).To(BeEmpty())
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+
+				By("ignoring the late EndpointWireguardRemove")
+				wg.EndpointWireguardRemove(peer1)
+				apply()
+				Expect(link().WireguardPeers).To(BeEmpty())
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+			})
+
+			It("should not program a peer whose key is updated after its endpoint was removed", func() {
+				wg.EndpointRemove(peer1)
+				wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				apply()
+				expectThrowRoute()
+
+				By("programming the peer again once the endpoint is updated")
+				wg.EndpointUpdate(peer1, ipv4_peer1)
+				apply()
+				expectProgrammed()
+			})
+
+			It("should use a throw route on an EndpointWireguardRemove before the EndpointRemove", func() {
+				wg.EndpointWireguardRemove(peer1)
+				apply()
+				expectThrowRoute()
+
+				wg.EndpointRemove(peer1)
+				apply()
+				Expect(link().WireguardPeers).To(BeEmpty())
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+			})
+		})
+	})
+
+	Context("with ProgramPeersWithoutEndpoint", func() {
+		BeforeEach(func() {
+			newWireguard(true)
+		})
+
+		It("should program a peer with a key but no endpoint without an endpoint", func() {
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			apply()
+			Expect(link().WireguardPeers).To(HaveKey(key_peer1))
+			Expect(link().WireguardPeers[key_peer1].Endpoint).To(BeNil())
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+
+			By("leaving the endpoint learned by wireguard on a resync")
+			learned := &net.UDPAddr{IP: ipv4_peer2.AsNetIP(), Port: listeningPort}
+			peer := link().WireguardPeers[key_peer1]
+			peer.Endpoint = learned
+			link().WireguardPeers[key_peer1] = peer
+			wg.QueueResync()
+			apply()
+			Expect(link().WireguardPeers[key_peer1].Endpoint).To(Equal(learned))
+
+			By("programming the endpoint once it arrives")
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			apply()
+			expectProgrammed()
+		})
+	})
+})
+
+var _ = Describe("Wireguard health snapshot", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var wg *Wireguard
+	var block bool
+	var entered, release chan struct{}
+
+	const linkIndex = 10
+	const timeout = 60 * time.Second
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		block = false
+		entered = make(chan struct{}, 1)
+		release = make(chan struct{})
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			func(StatusUpdate) error {
+				if block {
+					// Simulate a status callback that blocks, e.g. on a full channel.
+					entered <- struct{}{}
+					<-release
+				}
+				return nil
+			},
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	})
+
+	It("should report a stall while the status callback is blocked, and recover once unblocked", func() {
+		block = true
+		done := make(chan error, 1)
+		go func() {
+			done <- wg.Apply()
+		}()
+		Eventually(entered).Should(Receive())
+
+		snapshot := wg.HealthSnapshot()
+		Expect(snapshot.ApplyInProgress).To(BeTrue())
+		Expect(snapshot.StatusCallbackInProgress).To(BeTrue())
+		Expect(snapshot.Stalled(timeout)).NotTo(HaveOccurred())
+
+		t.IncrementTime(2 * timeout)
+		Expect(wg.HealthSnapshot().Stalled(timeout)).To(MatchError(ContainSubstring("blocked in the status callback")))
+
+		close(release)
+		Eventually(done).Should(Receive(BeNil()))
+		snapshot = wg.HealthSnapshot()
+		Expect(snapshot.ApplyInProgress).To(BeFalse())
+		Expect(snapshot.StatusCallbackInProgress).To(BeFalse())
+		Expect(snapshot.LongestStatusCallback).To(Equal(2 * timeout))
+		Expect(snapshot.LastApplyEnd).To(Equal(snapshot.Time))
+		Expect(snapshot.Stalled(timeout)).NotTo(HaveOccurred())
+	})
+
+	It("should report a stall if updates are pending without an apply", func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.HealthSnapshot().PendingSince.IsZero()).To(BeTrue())
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		Expect(wg.HealthSnapshot().PendingSince).To(Equal(t.Now()))
+		t.IncrementTime(timeout)
+		Expect(wg.HealthSnapshot().Stalled(timeout)).NotTo(HaveOccurred())
+		t.IncrementTime(time.Second)
+		Expect(wg.HealthSnapshot().Stalled(timeout)).To(MatchError(ContainSubstring("without an apply")))
+
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.HealthSnapshot().Stalled(timeout)).NotTo(HaveOccurred())
+	})
+
+	It("should not report a stall for the updates queued before the first apply", func() {
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		t.IncrementTime(2 * timeout)
+		Expect(wg.HealthSnapshot().Stalled(timeout)).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("Wireguard provisional keys", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+	const timeout = 30 * time.Second
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekey_1_throw := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_1)
+
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectRoutedWithKey := func(key wgtypes.Key) {
+		Expect(link().WireguardPeers).To(HaveLen(1))
+		Expect(link().WireguardPeers).To(HaveKey(key))
+		Expect(link().WireguardPeers[key].Endpoint).To(Equal(&net.UDPAddr{
+			IP:   ipv4_peer1.AsNetIP(),
+			Port: listeningPort,
+		}))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1_throw))
+	}
+	// provisionalKeyFrom returns the diagnostics of peer2, which are refreshed by a resync.
+	provisionalKeyFrom := func() string {
+		wg.QueueResync()
+		apply()
+		Expect(wg.PeerDiagnostics()).To(HaveKey(peer2))
+		return wg.PeerDiagnostics()[peer2].ProvisionalKeyFrom
+	}
+	// renameNode removes peer1 and adds peer2 with the same endpoint address and allowed CIDR, without the wireguard
+	// configuration of peer2.
+	renameNode := func() {
+		wg.EndpointWireguardRemove(peer1)
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		wg.EndpointRemove(peer1)
+		wg.EndpointUpdate(peer2, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:               true,
+				ListeningPort:         listeningPort,
+				FirewallMark:          firewallMark,
+				RoutingRulePriority:   rulePriority,
+				RoutingTableIndex:     tableIndex,
+				InterfaceName:         ifaceName,
+				MTU:                   mtu,
+				ProvisionalKeyTimeout: timeout,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		apply()
+		expectRoutedWithKey(key_peer1)
+	})
+
+	It("should carry the key over to a renamed node without a throw route, until the key is confirmed", func() {
+		renameNode()
+		apply()
+		expectRoutedWithKey(key_peer1)
+		Expect(provisionalKeyFrom()).To(Equal(peer1))
+		expectRoutedWithKey(key_peer1)
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(Equal(timeout))
+
+		By("confirming the key once the wireguard configuration of the renamed node arrives")
+		t.IncrementTime(timeout / 2)
+		wg.EndpointWireguardUpdate(peer2, key_peer1, nil)
+		apply()
+		expectRoutedWithKey(key_peer1)
+		Expect(provisionalKeyFrom()).To(BeEmpty())
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(BeZero())
+
+		By("keeping the key after the timeout")
+		t.IncrementTime(timeout)
+		apply()
+		expectRoutedWithKey(key_peer1)
+	})
+
+	It("should replace the provisional key with the key of the renamed node", func() {
+		renameNode()
+		apply()
+		expectRoutedWithKey(key_peer1)
+
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		apply()
+		expectRoutedWithKey(key_peer2)
+		Expect(provisionalKeyFrom()).To(BeEmpty())
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(BeZero())
+	})
+
+	It("should drop the provisional key once the timeout expires", func() {
+		renameNode()
+		apply()
+		expectRoutedWithKey(key_peer1)
+
+		t.IncrementTime(timeout - time.Second)
+		apply()
+		expectRoutedWithKey(key_peer1)
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(Equal(time.Second))
+
+		t.IncrementTime(time.Second)
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(Equal(time.Millisecond))
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_1))
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(BeZero())
+
+		By("programming the peer once its own key arrives")
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		apply()
+		expectRoutedWithKey(key_peer2)
+	})
+
+	It("should not carry the key over once the removed node is older than the timeout", func() {
+		wg.EndpointWireguardRemove(peer1)
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		wg.EndpointRemove(peer1)
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+
+		t.IncrementTime(timeout)
+		wg.EndpointUpdate(peer2, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+		Expect(wg.ProvisionalKeyExpiryAfter()).To(BeZero())
+	})
+
+	It("should not carry the key over to a node added with another endpoint address", func() {
+		wg.EndpointRemove(peer1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		apply()
+		Expect(link().WireguardPeers).To(BeEmpty())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1_throw))
+	})
+})
+
+var _ = Describe("Wireguard independent netlink handles", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+	routekey_1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	routekey_2 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)
+
+	newWireguard := func(enabled bool) *Wireguard {
+		return NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             enabled,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				RouteNetlinkTimeout: 3 * time.Second,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+	}
+	failedSteps := func(err error) map[Subsystem]string {
+		Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		return err.(*ApplyError).FailedSteps
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg = newWireguard(true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+	})
+
+	It("should use the route netlink timeout for the routing tables", func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(rtDataplane.SocketTimeout).To(Equal(3 * time.Second))
+	})
+
+	It("should program the routes while the routing rule is failing", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		wgDataplane.PersistFailures = true
+		Expect(failedSteps(wg.Apply())).To(Equal(map[Subsystem]string{SubsystemLink: "rule"}))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_1))
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+
+		By("programming further routes through the route handle without reconnecting it")
+		rtDataplane.ResetDeltas()
+		wgDataplane.ResetDeltas()
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		Expect(failedSteps(wg.Apply())).To(Equal(map[Subsystem]string{SubsystemLink: "rule"}))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(2))
+		Expect(wgDataplane.NumNewNetlinkCalls).To(Equal(1))
+		Expect(rtDataplane.NumNewNetlinkCalls).To(BeZero())
+
+		By("adding the rule once the link handle recovers")
+		wgDataplane.PersistFailures = false
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNone
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+	})
+
+	It("should reconcile the routing rule while the routing tables are failing", func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+		ourRule := wgDataplane.AddedRules[0]
+
+		By("removing our rule, and failing the route handle")
+		wgDataplane.Rules = nil
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAdd
+		rtDataplane.PersistFailures = true
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.QueueResync()
+		Expect(failedSteps(wg.Apply())).To(Equal(map[Subsystem]string{SubsystemRoutes: "routes"}))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_2))
+		Expect(wgDataplane.Rules).To(Equal([]netlink.Rule{ourRule}))
+		Expect(rtDataplane.NumNewNetlinkCalls).NotTo(BeZero())
+		Expect(wgDataplane.NumNewNetlinkCalls).To(BeZero())
+
+		By("programming the routes once the route handle recovers")
+		rtDataplane.PersistFailures = false
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+		Expect(wg.Apply()).To(Succeed())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey_2))
+	})
+
+	It("should attribute the failures of both handles in the same apply", func() {
+		Expect(wg.Apply()).To(Succeed())
+		wgDataplane.Rules = nil
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAdd
+		rtDataplane.PersistFailures = true
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.QueueResync()
+		err := wg.Apply()
+		Expect(failedSteps(err)).To(Equal(map[Subsystem]string{SubsystemLink: "rule", SubsystemRoutes: "routes"}))
+		Expect(err.(*ApplyError).Failed(SubsystemWireguard)).To(BeFalse())
+		Expect(err.Error()).To(Equal("wireguard apply failed: link (rule), routes (routes)"))
+	})
+
+	It("should not close the link handle when the wireguard client fails to remove the peers", func() {
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveLen(1))
+
+		// The wireguard configuration left by the enabled instance is removed by a disabled instance, as after a
+		// restart, which closes the handles of the enabled instance.
+		wgDataplane.NumOpenNetlinks = 0
+		wgDataplane.WireguardOpen = false
+		rtDataplane.NumOpenNetlinks = 0
+		wg = newWireguard(false)
+		wgDataplane.ResetDeltas()
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		Expect(failedSteps(wg.Apply())).To(Equal(map[Subsystem]string{SubsystemWireguard: "disable peers"}))
+		Expect(wgDataplane.NumNewNetlinkCalls).To(Equal(1))
+		Expect(wgDataplane.NumNewWireguardCalls).To(Equal(1))
+
+		By("reconnecting only the wireguard client")
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+		Expect(wgDataplane.NumNewNetlinkCalls).To(BeZero())
+		Expect(wgDataplane.NumNewWireguardCalls).To(Equal(1))
+	})
+})
+
+var _ = Describe("Wireguard what-if path reports", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+	cidr_outer := ip.MustParseCIDROrIP("10.42.0.0/16")
+	cidr_inner := ip.MustParseCIDROrIP("10.42.7.0/24")
+	cidr_nonwg := ip.MustParseCIDROrIP("10.42.7.8/29")
+
+	whatIf := func(dst string) *PathReport {
+		report, err := wg.WhatIf(ip.FromString(dst))
+		Expect(err).NotTo(HaveOccurred())
+		return report
+	}
+	endpoint := func(addr ip.Addr) *net.UDPAddr {
+		return &net.UDPAddr{IP: addr.AsNetIP(), Port: listeningPort}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_outer)
+	})
+
+	It("should report the longest prefix match among the nested CIDRs of different peers", func() {
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_inner)
+		wg.EndpointUpdate(peer3, ipv4_peer3)
+		wg.EndpointAllowedCIDRAdd(peer3, cidr_nonwg)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+
+		Expect(whatIf("10.42.1.1")).To(Equal(&PathReport{
+			Destination:   ip.FromString("10.42.1.1"),
+			Verdict:       PathVerdictEncrypted,
+			Route:         cidr_outer,
+			TableIndex:    tableIndex,
+			Peer:          peer1,
+			PublicKey:     key_peer1,
+			Endpoint:      endpoint(ipv4_peer1),
+			RuleSelectors: []RuleSelector{RuleSelectorFwmark},
+		}))
+
+		report := whatIf("10.42.7.1")
+		Expect(report.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Route).To(Equal(cidr_inner))
+		Expect(report.Peer).To(Equal(peer2))
+		Expect(report.PublicKey).To(Equal(key_peer2))
+		Expect(report.Endpoint).To(Equal(endpoint(ipv4_peer2)))
+		Expect(report.Diverged).To(BeFalse())
+
+		report = whatIf("10.42.7.9")
+		Expect(report.Verdict).To(Equal(PathVerdictFallThrough))
+		Expect(report.Route).To(Equal(cidr_nonwg))
+		Expect(report.Peer).To(BeEmpty())
+		Expect(report.Reason).To(ContainSubstring("of peer peer3, which is not routed to wireguard"))
+
+		report = whatIf("10.43.0.1")
+		Expect(report.Verdict).To(Equal(PathVerdictFallThrough))
+		Expect(report.Route).To(BeNil())
+		Expect(report.Reason).To(Equal("no route in the wireguard routing tables"))
+
+		By("rejecting a destination of the other IP version")
+		_, err := wg.WhatIf(ip.FromString("2001:db8::1"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should flag a destination whose programmed path diverges from the desired path", func() {
+		Expect(wg.Apply()).To(Succeed())
+
+		By("failing to configure the peer of a nested CIDR, which holds back its route")
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		wgDataplane.PersistFailures = true
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_inner)
+		Expect(wg.Apply()).To(HaveOccurred())
+
+		report := whatIf("10.42.7.1")
+		Expect(report.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Route).To(Equal(cidr_outer))
+		Expect(report.Peer).To(Equal(peer1))
+		Expect(report.Diverged).To(BeTrue())
+		Expect(report.Desired.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Desired.Route).To(Equal(cidr_inner))
+		Expect(report.Desired.Peer).To(Equal(peer2))
+		Expect(whatIf("10.42.1.1").Diverged).To(BeFalse())
+
+		By("converging once the peer is configured")
+		wgDataplane.PersistFailures = false
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNone
+		Expect(wg.Apply()).To(Succeed())
+		report = whatIf("10.42.7.1")
+		Expect(report.Peer).To(Equal(peer2))
+		Expect(report.Diverged).To(BeFalse())
+		Expect(report.Desired).To(BeNil())
+	})
+
+	It("should flag the traffic as not diverted until the routing rule is programmed", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		Expect(wg.Apply()).To(HaveOccurred())
+
+		report := whatIf("10.42.1.1")
+		Expect(report.Verdict).To(Equal(PathVerdictNotDiverted))
+		Expect(report.Reason).To(Equal("the routing rules have not been programmed"))
+		Expect(report.Diverged).To(BeTrue())
+		Expect(report.Desired.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Desired.Peer).To(Equal(peer1))
+
+		Expect(wg.Apply()).To(Succeed())
+		report = whatIf("10.42.1.1")
+		Expect(report.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Diverged).To(BeFalse())
+	})
+
+	It("should answer a queued query once the next apply completes", func() {
+		var report *PathReport
+		wg.QueueWhatIf(ip.FromString("10.42.1.1"), func(r *PathReport, err error) {
+			Expect(err).NotTo(HaveOccurred())
+			report = r
+		})
+		Expect(report).To(BeNil())
+		Expect(wg.Apply()).To(Succeed())
+		Expect(report).NotTo(BeNil())
+		Expect(report.Verdict).To(Equal(PathVerdictEncrypted))
+		Expect(report.Peer).To(Equal(peer1))
+	})
+})
+
+var _ = Describe("Wireguard rule state caching", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+
+	const linkIndex = 10
+	const numApplies = 5
+
+	// applyUnchanged applies without any updates, returning the number of rule listings.
+	applyUnchanged := func() int {
+		wgDataplane.ResetDeltas()
+		for i := 0; i < numApplies; i++ {
+			Expect(wg.Apply()).To(Succeed())
+		}
+		return wgDataplane.NumRuleListCalls
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+	})
+
+	It("should not list the rules on applies without changes", func() {
+		Expect(applyUnchanged()).To(BeZero())
+
+		By("not listing the rules for peer updates")
+		wgDataplane.ResetDeltas()
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NumRuleListCalls).To(BeZero())
+	})
+
+	It("should list the rules once when a resync is queued", func() {
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NumRuleListCalls).To(Equal(1))
+		Expect(applyUnchanged()).To(BeZero())
+	})
+
+	It("should list the rules again after a failed rule operation", func() {
+		ourRule := wgDataplane.AddedRules[0]
+		Expect(wgDataplane.RuleDel(&ourRule)).To(Succeed())
+		wg.QueueResync()
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAdd
+		Expect(wg.Apply()).To(HaveOccurred())
+
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NumRuleListCalls).To(Equal(1))
+		Expect(wgDataplane.AddedRules).To(HaveLen(1))
+		Expect(applyUnchanged()).To(BeZero())
+	})
+
+	It("should list the rules once the netlink client has been recreated", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextAddrList
+		Expect(wg.Apply()).To(HaveOccurred())
+
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.NumNewNetlinkCalls).To(Equal(1))
+		Expect(wgDataplane.NumRuleListCalls).To(Equal(1))
+		Expect(wgDataplane.AddedRules).To(BeEmpty())
+		Expect(applyUnchanged()).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard deterministic ordering", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var keys []wgtypes.Key
+
+	const linkIndex = 10
+
+	// Added in reverse order, so that the programming is not in the order of the updates.
+	peerCIDRs := []ip.CIDR{
+		ip.MustParseCIDROrIP("192.168.12.0/24"),
+		ip.MustParseCIDROrIP("192.168.11.0/24"),
+		ip.MustParseCIDROrIP("192.168.10.0/24"),
+		ip.MustParseCIDROrIP("10.0.0.0/24"),
+	}
+	sortedPeerCIDRs := []net.IPNet{peerCIDRs[3].ToIPNet(), peerCIDRs[2].ToIPNet(), peerCIDRs[1].ToIPNet(),
+		peerCIDRs[0].ToIPNet()}
+
+	// configuredKeys returns the public keys of the peers of each wireguard device configuration, in order.
+	configuredKeys := func() []wgtypes.Key {
+		var configured []wgtypes.Key
+		for _, peers := range wgDataplane.WireguardConfigurePeers {
+			for _, peer := range peers {
+				configured = append(configured, peer.PublicKey)
+			}
+		}
+		return configured
+	}
+
+	// sortedKeys returns the keys sorted in the order of their bytes.
+	sortedKeys := func() []wgtypes.Key {
+		sorted := append([]wgtypes.Key(nil), keys...)
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+		return sorted
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+
+		keys = nil
+		for i, name := range []string{peer1, peer2, peer3, peer4} {
+			key := mustGeneratePrivateKey().PublicKey()
+			keys = append(keys, key)
+			wg.EndpointUpdate(name, ip.FromString(fmt.Sprintf("172.16.0.%d", i+1)))
+			wg.EndpointWireguardUpdate(name, key, nil)
+		}
+		for _, cidr := range peerCIDRs {
+			wg.EndpointAllowedCIDRAdd(peer1, cidr)
+		}
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(Succeed())
+	})
+
+	It("should configure the peers in the order of their public keys", func() {
+		Expect(configuredKeys()).To(Equal(sortedKeys()))
+
+		By("configuring the peers in the same order after a rebuild")
+		wgDataplane.ResetDeltas()
+		wg.QueueFullRebuild()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(configuredKeys()).To(Equal(sortedKeys()))
+	})
+
+	It("should configure the allowed IPs in the order of their CIDRs", func() {
+		Expect(wgDataplane.WireguardConfigurePeers).To(HaveLen(1))
+		for _, peer := range wgDataplane.WireguardConfigurePeers[0] {
+			if peer.PublicKey == keys[0] {
+				Expect(peer.AllowedIPs).To(Equal(sortedPeerCIDRs))
+			}
+		}
+
+		By("adding the allowed IPs to the programmed peer in the order of their CIDRs")
+		wgDataplane.ResetDeltas()
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.WireguardConfigurePeers).To(HaveLen(1))
+		Expect(wgDataplane.WireguardConfigurePeers[0]).To(HaveLen(1))
+		Expect(wgDataplane.WireguardConfigurePeers[0][0].ReplaceAllowedIPs).To(BeFalse())
+		Expect(wgDataplane.WireguardConfigurePeers[0][0].AllowedIPs).To(Equal([]net.IPNet{
+			cidr_1.ToIPNet(), cidr_2.ToIPNet(), cidr_3.ToIPNet(),
+		}))
+	})
+
+	It("should add and delete the routes in the order of their CIDRs", func() {
+		var expected []string
+		for _, cidr := range sortedPeerCIDRs {
+			expected = append(expected, fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr.String()))
+		}
+		Expect(rtDataplane.AddedRouteKeyOrder).To(Equal(expected))
+
+		By("deleting the routes in the order of their CIDRs")
+		rtDataplane.ResetDeltas()
+		for _, cidr := range peerCIDRs {
+			wg.EndpointAllowedCIDRRemove(cidr)
+		}
+		Expect(wg.Apply()).To(Succeed())
+		Expect(rtDataplane.DeletedRouteKeyOrder).To(Equal(expected))
+	})
+
+	It("should not reconfigure a peer whose allowed IPs are reordered in the device", func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		peer := link.WireguardPeers[keys[0]]
+		Expect(peer.AllowedIPs).To(HaveLen(len(peerCIDRs)))
+		reordered := make([]net.IPNet, 0, len(peer.AllowedIPs))
+		for i := len(peer.AllowedIPs) - 1; i >= 0; i-- {
+			reordered = append(reordered, peer.AllowedIPs[i])
+		}
+		peer.AllowedIPs = reordered
+		link.WireguardPeers[keys[0]] = peer
+
+		wgDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard route statuses", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+
+	newWireguard := func(enabled bool) *Wireguard {
+		return NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             enabled,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			func(StatusUpdate) error { return nil },
+			nil,
+		)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = newWireguard(true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		Expect(wg.Apply()).To(Succeed())
+	})
+
+	It("should report the routes of the peers", func() {
+		Expect(wg.RouteStatuses()).To(Equal([]RouteStatus{
+			{CIDR: cidr_1, State: RouteStateUnicast, Peer: peer1, TableIndex: tableIndex},
+			{CIDR: cidr_2, State: RouteStateUnicast, Peer: peer1, TableIndex: tableIndex},
+			{CIDR: cidr_3, State: RouteStateThrow, Peer: peer2, TableIndex: tableIndex},
+		}))
+
+		By("reporting the route of peer2 once it is a wireguard peer")
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		Expect(wg.RouteStatuses()[2].State).To(Equal(RouteStateThrow))
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()[2]).To(Equal(
+			RouteStatus{CIDR: cidr_3, State: RouteStateUnicast, Peer: peer2, TableIndex: tableIndex},
+		))
+	})
+
+	It("should report a CIDR that has moved to another peer", func() {
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRRemove(cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()).To(Equal([]RouteStatus{
+			{CIDR: cidr_1, State: RouteStateUnicast, Peer: peer1, TableIndex: tableIndex},
+			{CIDR: cidr_2, State: RouteStateUnicast, Peer: peer2, TableIndex: tableIndex},
+			{CIDR: cidr_3, State: RouteStateUnicast, Peer: peer2, TableIndex: tableIndex},
+		}))
+	})
+
+	It("should report the routes of peers with conflicting keys", func() {
+		wg.EndpointWireguardUpdate(peer2, key_peer1, nil)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()).To(Equal([]RouteStatus{
+			{CIDR: cidr_1, State: RouteStateThrow, Peer: peer1, TableIndex: tableIndex},
+			{CIDR: cidr_2, State: RouteStateThrow, Peer: peer1, TableIndex: tableIndex},
+			{CIDR: cidr_3, State: RouteStateThrow, Peer: peer2, TableIndex: tableIndex},
+		}))
+
+		By("reporting the routes once the conflict is resolved")
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		Expect(wg.Apply()).To(Succeed())
+		for _, status := range wg.RouteStatuses() {
+			Expect(status.State).To(Equal(RouteStateUnicast))
+		}
+	})
+
+	It("should report the routes that are held back as pending", func() {
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wg.RouteStatuses()[2]).To(Equal(
+			RouteStatus{CIDR: cidr_3, State: RouteStatePending, Peer: peer2, TableIndex: tableIndex},
+		))
+
+		By("reporting the route once the peer is programmed")
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()[2].State).To(Equal(RouteStateUnicast))
+	})
+
+	It("should report the CIDRs of excluded peers as suppressed", func() {
+		wg.UpdateConfig(&Config{NonWireguardPeerHandling: NonWireguardPeerHandlingRuleExclude})
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()[2]).To(Equal(RouteStatus{CIDR: cidr_3, State: RouteStateSuppressed, Peer: peer2}))
+	})
+
+	It("should not report routes once torn down", func() {
+		Expect(wg.Teardown()).To(Succeed())
+		Expect(wg.RouteStatuses()).To(BeEmpty())
+	})
+
+	It("should not report routes if wireguard is disabled", func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wg = newWireguard(false)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wg.RouteStatuses()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Wireguard interface address local routes", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var s mockStatus
+	var link *mocknetlink.MockLink
+
+	const linkIndex = 10
+
+	// localRoute returns the local route of the interface address.
+	localRoute := func(addr ip.Addr) netlink.Route {
+		ipNet := addr.AsCIDR().ToIPNet()
+		return mocknetlink.LocalRouteForAddr(link, &netlink.Addr{IPNet: &ipNet})
+	}
+
+	// localRouteKey returns the key of the local route of the interface address.
+	localRouteKey := func(addr ip.Addr) string {
+		route := localRoute(addr)
+		return mocknetlink.KeyForRoute(&route)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		link = wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		s = mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).To(Succeed())
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int1)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.Addrs).To(HaveLen(1))
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey(ipv4_int1)))
+	})
+
+	It("should remove the local route of the previous address when the address changes", func() {
+		wgDataplane.LocalRoutesLinger = true
+		wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int2)
+		Expect(wg.Apply()).To(Succeed())
+		Expect(link.Addrs).To(HaveLen(1))
+		Expect(link.Addrs[0].IP).To(Equal(ipv4_int2.AsNetIP()))
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(localRouteKey(ipv4_int1)))
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey(ipv4_int2)))
+	})
+
+	It("should remove a stale local route on resync", func() {
+		stale := ip.FromString("10.10.10.10")
+		staleRoute := localRoute(stale)
+		wgDataplane.AddMockRoute(&staleRoute)
+
+		By("not listing the local routes on an apply without changes")
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey(stale)))
+
+		wg.QueueResync()
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(localRouteKey(stale)))
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey(ipv4_int1)))
+		Expect(link.Addrs).To(HaveLen(1))
+	})
+
+	It("should retry the removal of a stale local route on the next apply", func() {
+		stale := ip.FromString("10.10.10.10")
+		staleRoute := localRoute(stale)
+		wgDataplane.AddMockRoute(&staleRoute)
+
+		wg.QueueResync()
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDel
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wgDataplane.RouteKeyToRoute).To(HaveKey(localRouteKey(stale)))
+
+		Expect(wg.Apply()).To(Succeed())
+		Expect(wgDataplane.RouteKeyToRoute).NotTo(HaveKey(localRouteKey(stale)))
+	})
+})
+
+var _ = Describe("Wireguard apply timing", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var s mockStatus
+	var wg *Wireguard
+	var took []time.Duration
+	var timings []ApplyTiming
+
+	const linkIndex = 10
+	const step = time.Millisecond
+
+	linkCalls := []string{"LinkList", "LinkByName", "LinkAdd", "LinkDel", "LinkSetMTU", "LinkSetUp"}
+	addrCalls := []string{"AddrList", "AddrAdd", "AddrDel"}
+	ruleCalls := []string{"RuleList", "RuleAdd", "RuleDel"}
+	routeCalls := []string{"RouteListFiltered", "RouteAdd", "RouteReplace", "RouteDel"}
+	deviceCalls := []string{"DeviceByName", "ConfigureDevice"}
+	var allCalls []string
+	for _, calls := range [][]string{linkCalls, addrCalls, ruleCalls, routeCalls, deviceCalls} {
+		allCalls = append(allCalls, calls...)
+	}
+
+	// advanceOnCalls advances the mock time by the step on each of the calls to the dataplane.
+	advanceOnCalls := func(dataplane *mocknetlink.MockNetlinkDataplane, calls ...string) {
+		dataplane.CallClock = t
+		dataplane.CallClockSteps = map[string]time.Duration{}
+		for _, call := range calls {
+			dataplane.CallClockSteps[call] = step
+		}
+	}
+
+	// callTime returns the time taken by the calls made to the dataplane.
+	callTime := func(dataplane *mocknetlink.MockNetlinkDataplane, calls ...string) time.Duration {
+		var total time.Duration
+		for _, made := range dataplane.Calls {
+			for _, call := range calls {
+				if made == call {
+					total += dataplane.CallClockSteps[call]
+				}
+			}
+		}
+		return total
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		t = mocktime.NewMockTime()
+		s = mockStatus{}
+		took, timings = nil, nil
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.SetApplyTimingCallback(func(applyTook time.Duration, timing ApplyTiming) {
+			took = append(took, applyTook)
+			timings = append(timings, timing)
+		})
+	})
+
+	It("should time the link, rule and route calls while the link is coming up", func() {
+		advanceOnCalls(wgDataplane, allCalls...)
+		advanceOnCalls(rtDataplane, allCalls...)
+		Expect(wg.Apply()).To(Succeed())
+
+		// The link addresses are not reconciled until the link is up, so all of the calls are made in turn.
+		Expect(timings).To(HaveLen(1))
+		Expect(timings[0]).To(Equal(ApplyTiming{
+			Link:   callTime(wgDataplane, linkCalls...),
+			Rules:  callTime(wgDataplane, ruleCalls...),
+			Routes: callTime(wgDataplane, routeCalls...) + callTime(rtDataplane, allCalls...),
+		}))
+		Expect(timings[0].Link).NotTo(BeZero())
+		Expect(timings[0].Rules).NotTo(BeZero())
+		Expect(timings[0].Routes).NotTo(BeZero())
+		Expect(took[0]).To(Equal(callTime(wgDataplane, allCalls...) + callTime(rtDataplane, allCalls...)))
+	})
+
+	Context("with the link up and in-sync", func() {
+		BeforeEach(func() {
+			Expect(wg.Apply()).To(Succeed())
+			wgDataplane.SetIface(ifaceName, true, true)
+			wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+			Expect(wg.Apply()).To(Succeed())
+			Expect(s.key).NotTo(Equal(zeroKey))
+			Expect(wg.Apply()).To(Succeed())
+			wgDataplane.ResetDeltas()
+			rtDataplane.ResetDeltas()
+			took, timings = nil, nil
+		})
+
+		It("should report zero for the subsystems that have no work", func() {
+			advanceOnCalls(wgDataplane, allCalls...)
+			advanceOnCalls(rtDataplane, allCalls...)
+			Expect(wg.Apply()).To(Succeed())
+
+			// The link is looked up by each Apply, and the addresses of the link are always checked. The link is
+			// looked up before the addresses are reconciled, so the times are not affected by the reconciliation.
+			Expect(timings).To(HaveLen(1))
+			Expect(timings[0]).To(Equal(ApplyTiming{Link: step, Address: callTime(wgDataplane, allCalls...) - step}))
+			Expect(rtDataplane.Calls).To(BeEmpty())
+		})
+
+		It("should account the address calls to the addresses when the interface address changes", func() {
+			advanceOnCalls(wgDataplane, allCalls...)
+			advanceOnCalls(rtDataplane, allCalls...)
+			wg.EndpointWireguardUpdate(hostname, s.key, ipv4_int1)
+			Expect(wg.Apply()).To(Succeed())
+			Expect(wgDataplane.Calls).To(ContainElement("AddrAdd"))
+
+			// The link lookup of the address reconciliation is accounted to the addresses.
+			Expect(timings).To(HaveLen(1))
+			Expect(timings[0]).To(Equal(ApplyTiming{Link: step, Address: callTime(wgDataplane, allCalls...) - step}))
+			Expect(timings[0].Address).To(Equal(callTime(wgDataplane, addrCalls...) + step))
+			Expect(rtDataplane.Calls).To(BeEmpty())
+			Expect(took[0]).To(Equal(timings[0].Link + timings[0].Address))
+		})
+
+		It("should time the device and route calls when a peer is added", func() {
+			// The link addresses are reconciled in parallel with the device and route calls, so only the calls that
+			// are not made by the reconciliation advance the time.
+			advanceOnCalls(wgDataplane, deviceCalls...)
+			advanceOnCalls(rtDataplane, allCalls...)
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			Expect(wg.Apply()).To(Succeed())
+
+			Expect(timings).To(HaveLen(1))
+			Expect(timings[0].DeviceConfigure).To(Equal(callTime(wgDataplane, "ConfigureDevice")))
+			Expect(timings[0].DeviceConfigure).NotTo(BeZero())
+			Expect(timings[0].DeviceRead).To(Equal(callTime(wgDataplane, "DeviceByName")))
+			Expect(timings[0].Routes).To(Equal(callTime(rtDataplane, allCalls...)))
+			Expect(timings[0].Routes).NotTo(BeZero())
+			Expect(timings[0].Link).To(BeZero())
+			Expect(timings[0].Rules).To(BeZero())
+		})
+
+		It("should not call a removed callback", func() {
+			wg.SetApplyTimingCallback(nil)
+			Expect(wg.Apply()).To(Succeed())
+			Expect(timings).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Wireguard capabilities", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+	var kernelVersion string
+	var kernelVersionErr error
+	var numReads int
+
+	const linkIndex = 10
+
+	link := func() *mocknetlink.MockLink {
+		return wgDataplane.NameToLink[ifaceName]
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		kernelVersion = "Linux version 5.10.0-8-amd64 (debian-kernel@lists.debian.org) #1 SMP Debian 5.10.46-4"
+		kernelVersionErr = nil
+		numReads = 0
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.SetKernelVersionReader(func() (io.Reader, error) {
+			numReads++
+			if kernelVersionErr != nil {
+				return nil, kernelVersionErr
+			}
+			return strings.NewReader(kernelVersion), nil
+		})
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	})
+
+	It("should probe the capabilities once when the wireguard client is created", func() {
+		Expect(wg.Capabilities()).To(Equal(Capabilities{}))
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.Capabilities()).To(Equal(Capabilities{
+			Probed:               true,
+			KernelVersion:        "5.10.0",
+			ConfigurationPath:    ConfigurationPathNetlink,
+			PresharedKeys:        true,
+			KeepaliveGranularity: time.Second,
+			MaxKeepalive:         65535 * time.Second,
+		}))
+		Expect(numReads).To(Equal(1))
+
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(numReads).To(Equal(1))
+	})
+
+	Context("with a kernel that predates the in-tree wireguard module", func() {
+		BeforeEach(func() {
+			kernelVersion = "Linux version 4.19.0-17-amd64 (debian-kernel@lists.debian.org) #1 SMP Debian 4.19.194-3"
+		})
+
+		It("should report the compat module", func() {
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			caps := wg.Capabilities()
+			Expect(caps.KernelVersion).To(Equal("4.19.0"))
+			Expect(caps.ConfigurationPath).To(Equal(ConfigurationPathNetlink))
+			Expect(caps.CompatModule).To(BeTrue())
+		})
+
+		It("should not report the compat module for a userspace device", func() {
+			config.EnableUserspaceFallback = true
+			link().LinkType = "tun"
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wg.Mode()).To(Equal(ModeUserspace))
+			caps := wg.Capabilities()
+			Expect(caps.ConfigurationPath).To(Equal(ConfigurationPathUserspace))
+			Expect(caps.CompatModule).To(BeFalse())
+		})
+	})
+
+	It("should assume the in-tree module if the kernel version cannot be read", func() {
+		kernelVersionErr = errors.New("no such file")
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		caps := wg.Capabilities()
+		Expect(caps.Probed).To(BeTrue())
+		Expect(caps.KernelVersion).To(BeEmpty())
+		Expect(caps.CompatModule).To(BeFalse())
+	})
+
+	It("should assume the in-tree module if the kernel version cannot be parsed", func() {
+		kernelVersion = "garbage"
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		caps := wg.Capabilities()
+		Expect(caps.Probed).To(BeTrue())
+		Expect(caps.KernelVersion).To(BeEmpty())
+		Expect(caps.CompatModule).To(BeFalse())
+	})
+
+	It("should configure fewer allowed IPs at a time once a configuration is too large", func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		key_peer1 := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		for i := 0; i < 8; i++ {
+			wg.EndpointAllowedCIDRAdd(peer1, ip.MustParseCIDROrIP(fmt.Sprintf("192.168.%d.0/24", i)))
+		}
+		wgDataplane.MaxAllowedIPsPerWireguardConfigure = 3
+
+		By("halving the allowed IPs of the rejected configuration")
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigureAllowedIPs).To(Equal([]int{8}))
+		Expect(wg.Capabilities().MaxAllowedIPsPerConfiguration).To(Equal(4))
+
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigureAllowedIPs).To(Equal([]int{4}))
+		Expect(wg.Capabilities().MaxAllowedIPsPerConfiguration).To(Equal(2))
+
+		By("configuring the allowed IPs in chunks that fit")
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigureAllowedIPs).To(Equal([]int{2, 2, 2, 2}))
+		Expect(link().WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(8))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	})
+
+	It("should not lower the chunk size for other configuration errors", func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wgDataplane.FailWireguardConfigureCall = wgDataplane.NumWireguardDeviceConfigures + 1
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wg.Capabilities().MaxAllowedIPsPerConfiguration).To(BeZero())
+	})
+
+	Context("with a keepalive interval that is not a whole number of seconds", func() {
+		BeforeEach(func() {
+			config.PersistentKeepalive = 1500 * time.Millisecond
+		})
+
+		It("should round up the keepalive interval and keep it in sync", func() {
+			key_peer1 := mustGeneratePrivateKey().PublicKey()
+			wg.EndpointUpdate(peer1, ipv4_peer1)
+			wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link().WireguardPeers[key_peer1].PersistentKeepaliveInterval).To(Equal(2 * time.Second))
+
+			By("not updating the keepalive interval on a resync")
+			wgDataplane.ResetDeltas()
+			wg.QueueResync()
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		})
+	})
+})
+
+var _ = Describe("Wireguard DSCP", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+
+	const linkIndex = 10
+
+	route := func(linkIndex int, cidr ip.CIDR) netlink.Route {
+		key := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(key))
+		return rtDataplane.RouteKeyToRoute[key]
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		dscp := uint8(46)
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+			DSCP:                &dscp,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	It("should program the DSCP as the realm of the routes to the wireguard interface", func() {
+		Expect(route(linkIndex, cidr_1).Realm).To(Equal(46))
+
+		By("not setting the realm of the throw routes")
+		Expect(route(0, cidr_2).Type).To(Equal(syscall.RTN_THROW))
+		Expect(route(0, cidr_2).Realm).To(BeZero())
+	})
+
+	It("should correct the realm of a route on a resync", func() {
+		key := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		wrong := rtDataplane.RouteKeyToRoute[key]
+		wrong.Realm = 0
+		rtDataplane.RouteKeyToRoute[key] = wrong
+
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(route(linkIndex, cidr_1).Realm).To(Equal(46))
+	})
+
+	Context("without a DSCP", func() {
+		BeforeEach(func() {
+			config.DSCP = nil
+		})
+
+		It("should not set the realm of the routes", func() {
+			Expect(route(linkIndex, cidr_1).Realm).To(BeZero())
+		})
+	})
+
+	Context("with IPv6", func() {
+		BeforeEach(func() {
+			config.IPVersion = 6
+		})
+
+		It("should not set the realm of the routes", func() {
+			_, enabled := config.DSCPMarking()
+			Expect(enabled).To(BeTrue())
+			for _, r := range rtDataplane.RouteKeyToRoute {
+				Expect(r.Realm).To(BeZero())
+			}
+		})
+	})
+})
+
+var _ = Describe("Wireguard state handoff", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var config *Config
+	var old *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+
+	newWireguard := func(config *Config) *Wireguard {
+		return NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+	}
+
+	// mutations returns the netlink and wireguard calls that change the dataplane.
+	mutations := func() []string {
+		var calls []string
+		for _, d := range []*mocknetlink.MockNetlinkDataplane{wgDataplane, rtDataplane} {
+			for _, call := range d.Calls {
+				switch call {
+				case "LinkAdd", "LinkDel", "LinkSetMTU", "LinkSetUp", "AddrAdd", "AddrDel", "RuleAdd", "RuleDel",
+					"RouteAdd", "RouteReplace", "RouteDel", "ConfigureDevice":
+					calls = append(calls, call)
+				}
+			}
+		}
+		return calls
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		// The routing tables of both instances hold a netlink client.
+		rtDataplane.MaxOpenNetlinks = 2
+
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+		old = newWireguard(config)
+		old.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		old.EndpointUpdate(hostname, ipv4_host)
+		old.EndpointUpdate(peer1, ipv4_peer1)
+		old.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		old.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		old.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		old.EndpointUpdate(peer2, ipv4_peer2)
+		old.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		old.DatastoreInSync()
+		Expect(old.Apply()).NotTo(HaveOccurred())
+		Expect(old.HasPendingWork()).To(BeFalse())
+		Expect(s.numCallbacks).To(Equal(1))
+
+		wgDataplane.ResetDeltas()
+		rtDataplane.ResetDeltas()
+	})
+
+	It("should start from the exported state and make no changes on the first apply", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+
+		wg := newWireguard(config)
+		Expect(wg.ImportState(state)).To(Succeed())
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		Expect(mutations()).To(BeEmpty())
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(wg.HasPendingWork()).To(BeFalse())
+		Expect(wg.CheckInvariants()).To(Succeed())
+		Expect(wg.RouteStatuses()).To(Equal(old.RouteStatuses()))
+
+		key, port, name, ok := wg.LocalConfig()
+		Expect(ok).To(BeTrue())
+		Expect(key).To(Equal(s.key))
+		Expect(port).To(Equal(listeningPort))
+		Expect(name).To(Equal(ifaceName))
+	})
+
+	It("should apply the updates queued before the import on top of the imported state", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+
+		wg := newWireguard(config)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+		Expect(wg.ImportState(state)).To(Succeed())
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		Expect(rtDataplane.AddedRouteKeys.Len()).To(Equal(1))
+		Expect(rtDataplane.AddedRouteKeys.Contains(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_4))).To(BeTrue())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(wgDataplane.WireguardConfigurePeers).To(HaveLen(1))
+		Expect(wgDataplane.WireguardConfigurePeers[0]).To(HaveLen(1))
+		Expect(wgDataplane.WireguardConfigurePeers[0][0].PublicKey).To(Equal(key_peer1))
+		Expect(wgDataplane.WireguardConfigurePeers[0][0].ReplaceAllowedIPs).To(BeFalse())
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should accept a state whose configuration differs in settings that do not affect the programming", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+
+		newConfig := *config
+		newConfig.ApplyTimeout = time.Minute
+		newConfig.StaleHandshakeThreshold = time.Hour
+		wg := newWireguard(&newConfig)
+		Expect(wg.ImportState(state)).To(Succeed())
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(mutations()).To(BeEmpty())
+	})
+
+	It("should reject a state whose configuration differs, and start from an empty configuration", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+
+		newConfig := *config
+		newConfig.ListeningPort = listeningPort + 1
+		wg := newWireguard(&newConfig)
+		err = wg.ImportState(state)
+		Expect(err).To(BeAssignableToTypeOf(&StateRejectedError{}))
+
+		// Without the peers, the first apply removes them from the device.
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(mutations()).To(ContainElement("ConfigureDevice"))
+		Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(BeEmpty())
+	})
+
+	It("should reject a state of another version", func() {
+		wg := newWireguard(config)
+		err := wg.ImportState(&State{})
+		Expect(err).To(BeAssignableToTypeOf(&StateRejectedError{}))
+		Expect(err.Error()).To(ContainSubstring("state version 0"))
+	})
+
+	It("should reject a state that has already been imported", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newWireguard(config).ImportState(state)).To(Succeed())
+		Expect(newWireguard(config).ImportState(state)).To(BeAssignableToTypeOf(&StateRejectedError{}))
+	})
+
+	It("should reject a state once wireguard has been applied", func() {
+		state, err := old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+		wg := newWireguard(config)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.ImportState(state)).To(BeAssignableToTypeOf(&StateRejectedError{}))
+	})
+
+	It("should not export the state while there is pending work", func() {
+		old.EndpointAllowedCIDRAdd(peer1, cidr_4)
+		_, err := old.ExportState()
+		Expect(err).To(MatchError(ContainSubstring("has not been applied")))
+
+		Expect(old.Apply()).NotTo(HaveOccurred())
+		_, err = old.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not export the state until the datastore is in sync", func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		wg := newWireguard(config)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.HasPendingWork()).To(BeFalse())
+		_, err := wg.ExportState()
+		Expect(err).To(MatchError(ContainSubstring("datastore is not in sync")))
+
+		wg.DatastoreInSync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		_, err = wg.ExportState()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+// routeCallsAddBeforeDelete returns true if all of the route adds and replaces in the netlink calls are made before the
+// first route delete.
+func routeCallsAddBeforeDelete(calls []string) bool {
+	deleted := false
+	for _, call := range calls {
+		switch call {
+		case "RouteDel":
+			deleted = true
+		case "RouteAdd", "RouteReplace":
+			if deleted {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var _ = Describe("Wireguard catch-all route", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+	const ethLinkIndex = 2
+
+	// The underlay CIDR of the nodes, and an address of peer1 within the CIDR of peer2, which does not support
+	// wireguard.
+	cidr_underlay := ip.MustParseCIDROrIP("1.2.3.0/24")
+	ipnet_underlay := cidr_underlay.ToIPNet()
+	cidr_peer1_in_4 := ip.MustParseCIDROrIP("192.168.4.7/32")
+	ipnet_peer1_in_4 := cidr_peer1_in_4.ToIPNet()
+	ipnet_local := cidr_local.ToIPNet()
+	ipnet_default := ip.MustParseCIDROrIP("0.0.0.0/0").ToIPNet()
+
+	newConfig := func(catchAllRoute bool) *Config {
+		return &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+			LocalCIDRsAsThrow:   true,
+			CatchAllRoute:       catchAllRoute,
+			CatchAllThrowCIDRs:  []ip.CIDR{cidr_underlay},
+		}
+	}
+	newWireguard := func(catchAllRoute bool) {
+		wg = NewWithShims(
+			hostname,
+			newConfig(catchAllRoute),
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+	}
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	lookup := func(addr string, mark int) int {
+		route := wgDataplane.RouteLookup(rtDataplane, ip.FromString(addr), nil, "", mark)
+		Expect(route).NotTo(BeNil())
+		return route.LinkIndex
+	}
+	ourRoutes := func() []netlink.Route {
+		var routes []netlink.Route
+		for _, route := range rtDataplane.RouteKeyToRoute {
+			if route.Table == tableIndex {
+				routes = append(routes, route)
+			}
+		}
+		return routes
+	}
+	hasRoute := func(ipNet net.IPNet, linkIndex int) bool {
+		for _, route := range ourRoutes() {
+			if route.Dst.String() == ipNet.String() && route.LinkIndex == linkIndex {
+				return true
+			}
+		}
+		return false
+	}
+	expectThrowRoutes := func() {
+		for _, ipNet := range []net.IPNet{ipnet_local, ipnet_2, ipnet_4} {
+			Expect(hasRoute(ipNet, 0)).To(BeTrue(), "no throw route for %s", ipNet.String())
+		}
+	}
+	expectCatchAllForwarding := func() {
+		By("checking that the traffic to all but the thrown CIDRs is routed to wireguard")
+		Expect(lookup("192.168.1.1", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.4.7", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.4.8", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("192.168.2.1", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("192.180.0.1", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("1.2.3.5", 0)).To(Equal(ethLinkIndex))
+		Expect(lookup("8.8.8.8", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.1.1", firewallMark)).To(Equal(ethLinkIndex))
+	}
+	expectCatchAllRoutes := func() {
+		Expect(wg.CatchAllRouteEnabled()).To(BeTrue())
+		Expect(hasRoute(ipnet_default, linkIndex)).To(BeTrue())
+		Expect(hasRoute(ipnet_1, linkIndex)).To(BeFalse())
+		Expect(hasRoute(ipnet_peer1_in_4, linkIndex)).To(BeTrue())
+		Expect(hasRoute(ipnet_underlay, 0)).To(BeTrue())
+		expectThrowRoutes()
+		expectCatchAllForwarding()
+	}
+	expectCIDRRoutes := func() {
+		Expect(wg.CatchAllRouteEnabled()).To(BeFalse())
+		Expect(hasRoute(ipnet_default, linkIndex)).To(BeFalse())
+		Expect(hasRoute(ipnet_1, linkIndex)).To(BeTrue())
+		Expect(hasRoute(ipnet_peer1_in_4, linkIndex)).To(BeTrue())
+		Expect(hasRoute(ipnet_underlay, 0)).To(BeFalse())
+		expectThrowRoutes()
+		Expect(lookup("192.168.1.1", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.4.7", 0)).To(Equal(linkIndex))
+		Expect(lookup("8.8.8.8", 0)).To(Equal(ethLinkIndex))
+	}
+	expectAllowedIPsUnchanged := func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnet_1, ipnet_peer1_in_4))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(ethLinkIndex, "eth0", true, true)
+		rtDataplane.AddMockRoute(&netlink.Route{LinkIndex: ethLinkIndex, Table: syscall.RT_TABLE_MAIN})
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	addPeers := func() {
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+		wg.EndpointAllowedCIDRAdd(hostname, cidr_local)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_peer1_in_4)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_4)
+	}
+
+	It("should program the catch-all route in place of the routes of the CIDRs", func() {
+		newWireguard(true)
+		addPeers()
+		apply()
+		expectCatchAllRoutes()
+		expectAllowedIPsUnchanged()
+
+		By("keeping the route of a CIDR within a throw route as it is removed and added")
+		wg.EndpointAllowedCIDRRemove(cidr_peer1_in_4)
+		apply()
+		Expect(hasRoute(ipnet_peer1_in_4, linkIndex)).To(BeFalse())
+		Expect(lookup("192.168.4.7", 0)).To(Equal(ethLinkIndex))
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_peer1_in_4)
+		apply()
+		expectCatchAllRoutes()
+
+		By("programming the route of a wireguard CIDR once its throw route is removed")
+		wg.EndpointAllowedCIDRRemove(cidr_4)
+		apply()
+		Expect(hasRoute(ipnet_4, 0)).To(BeFalse())
+		Expect(hasRoute(ipnet_peer1_in_4, linkIndex)).To(BeFalse())
+		Expect(lookup("192.168.4.7", 0)).To(Equal(linkIndex))
+		Expect(lookup("192.168.4.8", 0)).To(Equal(linkIndex))
+	})
+
+	It("should not program the catch-all route until the throw routes are programmed", func() {
+		newWireguard(true)
+		addPeers()
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAdd
+		rtDataplane.PersistFailures = true
+		Expect(wg.Apply()).To(HaveOccurred())
+		Expect(wg.CatchAllRouteEnabled()).To(BeFalse())
+		Expect(hasRoute(ipnet_default, linkIndex)).To(BeFalse())
+
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNone
+		rtDataplane.PersistFailures = false
+		apply()
+		expectCatchAllRoutes()
+	})
+
+	It("should switch between the catch-all route and the routes of the CIDRs when updated", func() {
+		newWireguard(false)
+		addPeers()
+		apply()
+		expectCIDRRoutes()
+
+		By("enabling the catch-all route")
+		wg.UpdateConfig(newConfig(true))
+		apply()
+		expectCatchAllRoutes()
+		expectAllowedIPsUnchanged()
+
+		By("disabling the catch-all route")
+		wg.UpdateConfig(newConfig(false))
+		apply()
+		expectCIDRRoutes()
+		expectAllowedIPsUnchanged()
+	})
+
+	It("should never leave the traffic with neither the catch-all route nor the routes of the CIDRs", func() {
+		routekeyDefault := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, ipnet_default.String())
+		routekey1 := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		routekeyUnderlay := fmt.Sprintf("%d-%d-%s", tableIndex, 0, cidr_underlay)
+		indexOf := func(keys []string, key string) int {
+			for idx, k := range keys {
+				if k == key {
+					return idx
+				}
+			}
+			return -1
+		}
+		newWireguard(false)
+		addPeers()
+		apply()
+
+		By("adding the throw routes before the catch-all route, which replaces the routes of the CIDRs")
+		rtDataplane.ResetDeltas()
+		wg.UpdateConfig(newConfig(true))
+		apply()
+		Expect(indexOf(rtDataplane.AddedRouteKeyOrder, routekeyUnderlay)).To(BeNumerically(">=", 0))
+		Expect(indexOf(rtDataplane.AddedRouteKeyOrder, routekeyUnderlay)).To(BeNumerically("<",
+			indexOf(rtDataplane.AddedRouteKeyOrder, routekeyDefault)))
+		Expect(rtDataplane.DeletedRouteKeyOrder).To(Equal([]string{routekey1}))
+		Expect(routeCallsAddBeforeDelete(rtDataplane.Calls)).To(BeTrue())
+
+		By("adding the routes of the CIDRs before removing the catch-all route, and then the throw routes")
+		rtDataplane.ResetDeltas()
+		wg.UpdateConfig(newConfig(false))
+		apply()
+		Expect(rtDataplane.AddedRouteKeyOrder).To(Equal([]string{routekey1}))
+		Expect(rtDataplane.DeletedRouteKeyOrder).To(Equal([]string{routekeyDefault, routekeyUnderlay}))
+		Expect(routeCallsAddBeforeDelete(rtDataplane.Calls)).To(BeTrue())
+	})
+
+	It("should validate the catch-all route", func() {
+		config := newConfig(true)
+		Expect(config.Validate()).NotTo(HaveOccurred())
+
+		config.LocalCIDRsAsThrow = false
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ConfigError).Field).To(Equal("LocalCIDRsAsThrow"))
+
+		config = newConfig(true)
+		config.NonWireguardPeerHandling = NonWireguardPeerHandlingRuleExclude
+		err = config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ConfigError).Field).To(Equal("NonWireguardPeerHandling"))
+	})
+})
+
+var _ = Describe("Wireguard netlink races", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var mockTime *mocktime.MockTime
+
+	const linkIndex = 10
+
+	routeKey := func(linkIndex int, cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+
+	removeOurRules := func() {
+		var rules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table != tableIndex {
+				rules = append(rules, rule)
+			}
+		}
+		wgDataplane.Rules = rules
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		mockTime = mocktime.NewMockTime()
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mockTime,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.BenignNetlinkRaces()).To(BeZero())
+	})
+
+	It("should treat a route added by another process as added", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAddRace
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(Equal(1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_3)))
+	})
+
+	It("should replace a route added by another process with other content", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAddRaceConflict
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(BeZero())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_3)))
+		Expect(rtDataplane.RouteKeyToRoute[routeKey(linkIndex, cidr_3)].Protocol).To(Equal(FelixRouteProtocol))
+		Expect(rtDataplane.Calls).To(ContainElement("RouteReplace"))
+	})
+
+	It("should treat a route deleted by another process as deleted", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDelRace
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(Equal(1))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(linkIndex, cidr_1)))
+	})
+
+	It("should retry the delete of a route that is still programmed", func() {
+		rtDataplane.ResetDeltas()
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteDelRaceConflict
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(BeZero())
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_1)))
+
+		By("deleting the route on a resync once the cleanup grace period has passed")
+		mockTime.IncrementTime(11 * time.Second)
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.BenignNetlinkRaces()).To(BeZero())
+		Expect(rtDataplane.DeletedRouteKeyOrder).To(Equal([]string{routeKey(linkIndex, cidr_1)}))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(linkIndex, cidr_1)))
+	})
+
+	It("should treat a rule added by another process as added", func() {
+		rules := wgDataplane.Rules
+		removeOurRules()
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAddRace
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(Equal(1))
+		Expect(wgDataplane.Rules).To(ConsistOf(rules))
+	})
+
+	It("should retry the add of a rule that conflicts with a rule added by another process", func() {
+		removeOurRules()
+		numRuleAddCalls := wgDataplane.NumRuleAddCalls
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleAddRaceConflict
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(BeZero())
+		var ourRules []netlink.Rule
+		for _, rule := range wgDataplane.Rules {
+			if rule.Table == tableIndex {
+				ourRules = append(ourRules, rule)
+			}
+		}
+		Expect(ourRules).To(HaveLen(1))
+		Expect(wgDataplane.NumRuleAddCalls - numRuleAddCalls).To(Equal(2))
+	})
+
+	It("should treat a rule deleted by another process as deleted", func() {
+		rules := wgDataplane.Rules
+		stale := netlink.NewRule()
+		stale.Priority = rulePriority
+		stale.Table = tableIndex
+		stale.Mark = 0x99
+		wgDataplane.Rules = append(wgDataplane.Rules, *stale)
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleDelRace
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		Expect(wg.BenignNetlinkRaces()).To(Equal(1))
+		Expect(wgDataplane.Rules).To(ConsistOf(rules))
+	})
+})
+
+var _ = Describe("Wireguard key transition", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var mockTime *mocktime.MockTime
+	var key_peer1, key_peer1_new wgtypes.Key
+
+	const linkIndex = 10
+	const timeout = time.Minute
+
+	devicePeers := func() map[wgtypes.Key]wgtypes.Peer {
+		return wgDataplane.NameToLink[ifaceName].WireguardPeers
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		mockTime = mocktime.NewMockTime()
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:              true,
+				ListeningPort:        listeningPort,
+				FirewallMark:         firewallMark,
+				RoutingRulePriority:  rulePriority,
+				RoutingTableIndex:    tableIndex,
+				InterfaceName:        ifaceName,
+				MTU:                  mtu,
+				KeyTransitionTimeout: timeout,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mockTime,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer1_new = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+	})
+
+	// rotateLocalKey loses the key of the device, so that a new key is generated.
+	rotateLocalKey := func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		link.WireguardPrivateKey = zeroKey
+		link.WireguardPublicKey = zeroKey
+		wg.QueueResync()
+	}
+
+	// rotatePeer1 publishes a new key for peer1, with its previous key and the deadline of its key transition.
+	rotatePeer1 := func(deadline time.Time) {
+		wg.EndpointWireguardUpdate(peer1, key_peer1_new, nil)
+		wg.EndpointWireguardPreviousKey(peer1, key_peer1, deadline)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+
+	It("should not publish a previous key for the first key", func() {
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).NotTo(Equal(zeroKey))
+		Expect(s.previousKey).To(Equal(zeroKey))
+		Expect(wg.PublishRetryAfter()).To(BeZero())
+	})
+
+	It("should publish the previous key alongside a new key until the deadline", func() {
+		previousKey := s.key
+		rotateLocalKey()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(2))
+		newKey := s.key
+		Expect(newKey).NotTo(Equal(previousKey))
+		Expect(s.previousKey).To(Equal(previousKey))
+		Expect(s.deadline).To(Equal(mockTime.Now().Add(timeout)))
+		Expect(wg.PublishRetryAfter()).To(Equal(timeout))
+
+		By("ending the key transition at the deadline")
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+		mockTime.IncrementTime(timeout)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(3))
+		Expect(s.key).To(Equal(newKey))
+		Expect(s.previousKey).To(Equal(zeroKey))
+		Expect(wg.PublishRetryAfter()).To(BeZero())
+	})
+
+	It("should keep the peer of the previous key without allowed IPs until there is a handshake with the new key", func() {
+		rotatePeer1(mockTime.Now().Add(timeout))
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+		Expect(devicePeers()[key_peer1].AllowedIPs).To(BeEmpty())
+		Expect(devicePeers()).To(HaveKey(key_peer1_new))
+		Expect(devicePeers()[key_peer1_new].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+		Expect(wg.KeyTransitionCheckAfter()).To(Equal(5 * time.Second))
+
+		// Without a handshake the peer is kept.
+		mockTime.IncrementTime(5 * time.Second)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+
+		wgDataplane.WireguardPeerHandshake(ifaceName, key_peer1_new)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).NotTo(HaveKey(key_peer1))
+		Expect(devicePeers()).To(HaveKey(key_peer1_new))
+		Expect(wg.KeyTransitionCheckAfter()).To(BeZero())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	})
+
+	It("should remove the peer of the previous key at the deadline", func() {
+		rotatePeer1(mockTime.Now().Add(2 * time.Second))
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+		Expect(wg.KeyTransitionCheckAfter()).To(Equal(2 * time.Second))
+
+		mockTime.IncrementTime(2 * time.Second)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).NotTo(HaveKey(key_peer1))
+		Expect(devicePeers()).To(HaveKey(key_peer1_new))
+		Expect(wg.KeyTransitionCheckAfter()).To(BeZero())
+	})
+
+	It("should cap the deadline of a peer by the key transition timeout", func() {
+		rotatePeer1(mockTime.Now().Add(24 * time.Hour))
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+
+		mockTime.IncrementTime(timeout)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).NotTo(HaveKey(key_peer1))
+	})
+
+	It("should remove the peer of the previous key when the node ends its key transition", func() {
+		rotatePeer1(mockTime.Now().Add(timeout))
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+
+		wg.EndpointWireguardPreviousKey(peer1, zeroKey, time.Time{})
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).NotTo(HaveKey(key_peer1))
+		Expect(devicePeers()).To(HaveKey(key_peer1_new))
+	})
+
+	It("should not keep a previous key that has become the key of another node", func() {
+		wg.EndpointWireguardUpdate(peer2, key_peer1, nil)
+		rotatePeer1(mockTime.Now().Add(timeout))
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+		Expect(devicePeers()[key_peer1].AllowedIPs).To(ConsistOf(cidr_2.ToIPNet()))
+		Expect(devicePeers()[key_peer1_new].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(wg.KeyTransitionCheckAfter()).To(BeZero())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	})
+
+	It("should keep the peer of the previous key across a resync but not a full rebuild", func() {
+		rotatePeer1(mockTime.Now().Add(timeout))
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).To(HaveKey(key_peer1))
+		Expect(devicePeers()[key_peer1].AllowedIPs).To(BeEmpty())
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+
+		wg.QueueFullRebuild()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(devicePeers()).NotTo(HaveKey(key_peer1))
+		Expect(devicePeers()).To(HaveKey(key_peer1_new))
+		Expect(wg.KeyTransitionCheckAfter()).To(BeZero())
+	})
+
+	It("should refuse to hand off the state while the keys are in transition", func() {
+		rotatePeer1(mockTime.Now().Add(timeout))
+		_, err := wg.ExportState()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Wireguard key transition disabled", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(10, ifaceName, true, true)
+		rtDataplane.AddIface(10, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+	})
+
+	It("should neither publish nor keep previous keys", func() {
+		previousKey := s.key
+		link := wgDataplane.NameToLink[ifaceName]
+		link.WireguardPrivateKey = zeroKey
+		link.WireguardPublicKey = zeroKey
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.key).NotTo(Equal(previousKey))
+		Expect(s.previousKey).To(Equal(zeroKey))
+
+		key_peer1 := mustGeneratePrivateKey().PublicKey()
+		key_peer1_new := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointWireguardUpdate(peer1, key_peer1_new, nil)
+		wg.EndpointWireguardPreviousKey(peer1, key_peer1, time.Now().Add(time.Hour))
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		peers := wgDataplane.NameToLink[ifaceName].WireguardPeers
+		Expect(peers).NotTo(HaveKey(key_peer1))
+		Expect(peers).To(HaveKey(key_peer1_new))
+		Expect(wg.KeyTransitionCheckAfter()).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard overlapping CIDRs", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var hook *logtest.Hook
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+
+	// A block of peer2 within the block of peer1, e.g. after a block handoff.
+	cidr_1_sub := ip.MustParseCIDROrIP("192.168.1.64/26")
+
+	routeKey := func(cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+	allowedIPs := func(key wgtypes.Key) []net.IPNet {
+		return wgDataplane.NameToLink[ifaceName].WireguardPeers[key].AllowedIPs
+	}
+	overlapWarnings := func() int {
+		n := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "overlaps a CIDR of another peer") {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		hook = new(logtest.Hook)
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+
+		// The wireguard logger takes a copy of the hooks of the standard logger, so install the test hook only while
+		// the wireguard module is created.
+		logLevel := log.WarnLevel
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		log.StandardLogger().AddHook(hook)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				LogLevel:            &logLevel,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		log.StandardLogger().Hooks = stdHooks
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	expectBothProgrammed := func() {
+		Expect(allowedIPs(key_peer1)).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(allowedIPs(key_peer2)).To(ConsistOf(cidr_2.ToIPNet(), cidr_1_sub.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(cidr_1_sub)))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectOnlyCovering := func() {
+		Expect(allowedIPs(key_peer1)).To(ConsistOf(cidr_1.ToIPNet()))
+		Expect(allowedIPs(key_peer2)).To(ConsistOf(cidr_2.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(cidr_1_sub)))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+	expectOnlyCovered := func() {
+		Expect(allowedIPs(key_peer1)).To(BeEmpty())
+		Expect(allowedIPs(key_peer2)).To(ConsistOf(cidr_2.ToIPNet(), cidr_1_sub.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(cidr_1_sub)))
+		Expect(wg.CheckInvariants()).NotTo(HaveOccurred())
+	}
+
+	for _, coveringFirst := range []bool{true, false} {
+		coveringFirst := coveringFirst
+		Describe(fmt.Sprintf("with the covering CIDR added first: %v", coveringFirst), func() {
+			BeforeEach(func() {
+				if coveringFirst {
+					wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+					Expect(wg.Apply()).NotTo(HaveOccurred())
+					Expect(overlapWarnings()).To(BeZero())
+					wg.EndpointAllowedCIDRAdd(peer2, cidr_1_sub)
+				} else {
+					wg.EndpointAllowedCIDRAdd(peer2, cidr_1_sub)
+					Expect(wg.Apply()).NotTo(HaveOccurred())
+					Expect(overlapWarnings()).To(BeZero())
+					wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				}
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+			})
+
+			It("should program both CIDRs and warn once about the overlap", func() {
+				expectBothProgrammed()
+				Expect(overlapWarnings()).To(Equal(1))
+
+				// The warning is not repeated for unrelated updates.
+				wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				Expect(overlapWarnings()).To(Equal(1))
+			})
+
+			It("should keep the covering CIDR when the covered CIDR is removed", func() {
+				wg.EndpointAllowedCIDRRemove(cidr_1_sub)
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				expectOnlyCovering()
+			})
+
+			It("should keep the covered CIDR when the covering CIDR is removed", func() {
+				wg.EndpointAllowedCIDRRemove(cidr_1)
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				expectOnlyCovered()
+			})
+
+			It("should keep the other CIDR when one is removed and the other added in the same update", func() {
+				wg.EndpointAllowedCIDRRemove(cidr_1_sub)
+				wg.EndpointAllowedCIDRRemove(cidr_1)
+				wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				expectOnlyCovering()
+			})
+
+			It("should keep both CIDRs across a full rebuild", func() {
+				wg.QueueFullRebuild()
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				expectBothProgrammed()
+			})
+		})
+	}
+
+	It("should not warn about overlapping CIDRs of the same peer", func() {
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1_sub)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(allowedIPs(key_peer1)).To(ConsistOf(cidr_1.ToIPNet(), cidr_1_sub.ToIPNet()))
+		Expect(overlapWarnings()).To(BeZero())
+	})
+})
+
+var _ = Describe("Wireguard operation trace", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var key_peer1, key_peer2 wgtypes.Key
+	var traceBufferSize int
+
+	const linkIndex = 10
+
+	keyPrefix := func(key wgtypes.Key) string {
+		return key.String()[:8]
+	}
+	// newEntries returns the entries of the trace recorded since the entry with the sequence number.
+	newEntries := func(since uint64) []TraceEntry {
+		var entries []TraceEntry
+		for _, entry := range wg.DumpTrace() {
+			if entry.Seq > since {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+	lastSeq := func() uint64 {
+		entries := wg.DumpTrace()
+		if len(entries) == 0 {
+			return 0
+		}
+		return entries[len(entries)-1].Seq
+	}
+
+	BeforeEach(func() {
+		traceBufferSize = 100
+	})
+
+	JustBeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				TraceBufferSize:     traceBufferSize,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	It("should attribute the peer updates of a CIDR move to the move", func() {
+		seq := lastSeq()
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		// The peer the CIDR moved from has its allowed IPs replaced, the peer it moved to has the CIDR added.
+		byKey := map[string]TraceEntry{}
+		for _, entry := range newEntries(seq) {
+			Expect(entry.Op).To(Equal(TraceOpPeerUpdate))
+			Expect(entry.Cause).To(Equal("CIDR 192.168.1.0/24 moved from node peer1 to node peer2"))
+			Expect(entry.Error).To(BeEmpty())
+			byKey[entry.PeerKey] = entry
+		}
+		Expect(byKey).To(HaveLen(2))
+		Expect(byKey[keyPrefix(key_peer1)].Detail).To(ContainSubstring("allowedIPs=0 replaceAllowedIPs=true"))
+		Expect(byKey[keyPrefix(key_peer2)].Detail).To(ContainSubstring("allowedIPs=1 replaceAllowedIPs=false"))
+	})
+
+	It("should attribute the operations of a node update to the CIDR or the node", func() {
+		seq := lastSeq()
+		wg.EndpointUpdate(peer1, ipv4_peer3)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		entries := newEntries(seq)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Op).To(Equal(TraceOpPeerUpdate))
+		Expect(entries[0].PeerKey).To(Equal(keyPrefix(key_peer1)))
+		Expect(entries[0].Cause).To(Equal("endpoint update for node peer1"))
+		Expect(entries[1].Op).To(Equal(TraceOpRouteAdd))
+		Expect(entries[1].CIDR).To(Equal(cidr_3.String()))
+		Expect(entries[1].TableIndex).To(Equal(tableIndex))
+		Expect(entries[1].Cause).To(Equal("CIDR 192.168.3.0/24 added to node peer1"))
+	})
+
+	It("should attribute the operations of a node removal to the removal", func() {
+		seq := lastSeq()
+		wg.EndpointRemove(peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		entries := newEntries(seq)
+		Expect(entries).To(HaveLen(2))
+		for _, entry := range entries {
+			Expect(entry.Cause).To(Equal("removal of node peer1"))
+		}
+		Expect(entries[0].Op).To(Equal(TraceOpRouteDelete))
+		Expect(entries[0].CIDR).To(Equal(cidr_1.String()))
+		Expect(entries[1].Op).To(Equal(TraceOpPeerRemove))
+		Expect(entries[1].PeerKey).To(Equal(keyPrefix(key_peer1)))
+	})
+
+	It("should attribute the correction of a route removed out of band to the resync", func() {
+		route := rtDataplane.RouteKeyToRoute[fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)]
+		rtDataplane.RemoveMockRoute(&route)
+		seq := lastSeq()
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		entries := newEntries(seq)
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Op).To(Equal(TraceOpRouteAdd))
+		Expect(entries[0].CIDR).To(Equal(cidr_2.String()))
+		Expect(entries[0].Cause).To(Equal("resync"))
+	})
+
+	It("should record the error of a failed operation", func() {
+		seq := lastSeq()
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteAdd
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_3)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		// The route table retries the failed route add.
+		var routeAdds []TraceEntry
+		for _, entry := range newEntries(seq) {
+			if entry.Op == TraceOpRouteAdd {
+				Expect(entry.CIDR).To(Equal(cidr_3.String()))
+				routeAdds = append(routeAdds, entry)
+			}
+		}
+		Expect(routeAdds).To(HaveLen(2))
+		Expect(routeAdds[0].Error).NotTo(BeEmpty())
+		Expect(routeAdds[1].Error).To(BeEmpty())
+	})
+
+	Describe("with a small buffer", func() {
+		BeforeEach(func() {
+			traceBufferSize = 4
+		})
+
+		It("should keep only the most recent operations, oldest first", func() {
+			entries := wg.DumpTrace()
+			Expect(entries).To(HaveLen(4))
+			Expect(entries[0].Seq).To(BeNumerically(">", 1))
+			for i := 1; i < len(entries); i++ {
+				Expect(entries[i].Seq).To(Equal(entries[i-1].Seq + 1))
+			}
+			seq := lastSeq()
+
+			wg.EndpointRemove(peer1)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			entries = wg.DumpTrace()
+			Expect(entries).To(HaveLen(4))
+			Expect(entries[3].Seq).To(Equal(seq + 2))
+			Expect(entries[3].Op).To(Equal(TraceOpPeerRemove))
+			Expect(entries[2].Op).To(Equal(TraceOpRouteDelete))
+			Expect(entries[1].Seq).To(Equal(seq))
+		})
+	})
+
+	Describe("with the trace disabled", func() {
+		BeforeEach(func() {
+			traceBufferSize = 0
+		})
+
+		It("should record nothing", func() {
+			Expect(wg.DumpTrace()).To(BeNil())
+		})
+	})
+})
+
+var _ = Describe("Wireguard route replacement", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var cidrs []ip.CIDR
+
+	const linkIndex = 10
+	const numCIDRs = 100
+
+	routeKey := func(linkIndex int, cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+	expectRoutes := func(linkIndex int) {
+		ExpectWithOffset(1, rtDataplane.RouteKeyToRoute).To(HaveLen(numCIDRs))
+		for _, cidr := range cidrs {
+			ExpectWithOffset(1, rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr)))
+		}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		// Peer1 has not yet enabled wireguard, so its CIDRs have throw routes.
+		cidrs = nil
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		for i := 0; i < numCIDRs; i++ {
+			cidr := ip.MustParseCIDROrIP(fmt.Sprintf("10.10.%d.0/24", i))
+			cidrs = append(cidrs, cidr)
+			wg.EndpointAllowedCIDRAdd(peer1, cidr)
+		}
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectRoutes(0)
+		rtDataplane.ResetDeltas()
+	})
+
+	It("should replace the routes in place when the peer enables and disables wireguard", func() {
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectRoutes(linkIndex)
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.AddedRouteKeys).To(HaveLen(numCIDRs))
+		Expect(wg.LastApplyStats().RoutesReplaced).To(Equal(numCIDRs))
+		Expect(wg.LastApplyStats().RoutesAdded).To(BeZero())
+		Expect(wg.LastApplyStats().RoutesRemoved).To(BeZero())
+
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardRemove(peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectRoutes(0)
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.AddedRouteKeys).To(HaveLen(numCIDRs))
+		Expect(wg.LastApplyStats().RoutesReplaced).To(Equal(numCIDRs))
+	})
+
+	It("should leave the routes in sync after replacing them", func() {
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		rtDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectRoutes(linkIndex)
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should delete a route and add it back if the replace fails", func() {
+		rtDataplane.FailuresToSimulate = mocknetlink.FailNextRouteReplace
+		wg.EndpointWireguardUpdate(peer1, mustGeneratePrivateKey().PublicKey(), nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.FailuresToSimulate).To(Equal(mocknetlink.FailNone))
+		expectRoutes(linkIndex)
+		Expect(rtDataplane.DeletedRouteKeys).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Wireguard local endpoint address", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+		}
+	})
+
+	JustBeforeEach(func() {
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	It("should configure the device but hold back our key until our endpoint address is known", func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link.WireguardPublicKey).NotTo(Equal(zeroKey))
+		Expect(s.numCallbacks).To(Equal(1))
+		Expect(s.key).To(Equal(zeroKey))
+		Expect(s.ifaceAddr).To(BeNil())
+		Expect(s.keyState).To(Equal(KeyStateWaitingForLocalAddress))
+		Expect(wg.LocalAddressError()).To(Equal(&MissingLocalAddressError{Hostname: hostname}))
+		Expect(wg.PendingWorkSummary().Key).To(BeFalse())
+
+		By("accepting the updates of the peers without reporting again")
+		key_peer1 := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)))
+		Expect(s.numCallbacks).To(Equal(1))
+
+		By("publishing our key once our endpoint address is known")
+		wg.EndpointUpdate(hostname, ipv4_host)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(2))
+		Expect(s.key).To(Equal(link.WireguardPublicKey))
+		Expect(s.keyState).To(Equal(KeyStatePublished))
+		Expect(s.previousKey).To(Equal(zeroKey))
+		Expect(wg.LocalAddressError()).NotTo(HaveOccurred())
+	})
+
+	It("should withdraw our key while our endpoint address is removed", func() {
+		wg.EndpointUpdate(hostname, ipv4_host)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		publicKey := s.key
+		Expect(publicKey).NotTo(Equal(zeroKey))
+
+		wg.EndpointUpdate(hostname, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(3))
+		Expect(s.key).To(Equal(zeroKey))
+		Expect(s.keyState).To(Equal(KeyStateWaitingForLocalAddress))
+
+		// A new address does not change our key.
+		wg.EndpointUpdate(hostname, ipv4_peer2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(4))
+		Expect(s.key).To(Equal(publicKey))
+		Expect(s.keyState).To(Equal(KeyStatePublished))
+	})
+
+	It("should report again if the report of the missing address fails", func() {
+		wg.EndpointUpdate(hostname, ipv4_host)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		s.err = errors.New("datastore unavailable")
+		wg.EndpointUpdate(hostname, nil)
+		Expect(wg.Apply()).To(MatchError("datastore unavailable"))
+		Expect(wg.PendingWorkSummary().Key).To(BeTrue())
+
+		s.err = nil
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.key).To(Equal(zeroKey))
+		Expect(s.keyState).To(Equal(KeyStateWaitingForLocalAddress))
+		Expect(wg.PendingWorkSummary().Key).To(BeFalse())
+	})
+
+	Describe("with PublishKeyWithoutEndpoint", func() {
+		BeforeEach(func() {
+			config.PublishKeyWithoutEndpoint = true
+		})
+
+		It("should publish our key before our endpoint address is known", func() {
+			Expect(s.numCallbacks).To(Equal(1))
+			Expect(s.key).To(Equal(wgDataplane.NameToLink[ifaceName].WireguardPublicKey))
+			Expect(s.keyState).To(Equal(KeyStatePublished))
+			Expect(wg.LocalAddressError()).NotTo(HaveOccurred())
+
+			// Learning our address does not publish our key again.
+			wg.EndpointUpdate(hostname, ipv4_host)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(s.numCallbacks).To(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("Wireguard encryption opt-out", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+
+	routeKey := func(linkIndex int, cidr ip.CIDR) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+	})
+
+	It("should not program a peer that is opted out before it is programmed", func() {
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointWireguardOptOut(peer1, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_2)))
+		Expect(wg.OptedOutNodes()).To(Equal([]string{peer1}))
+		Expect(wg.CheckInvariants()).To(Succeed())
+
+		report, err := wg.WhatIf(cidr_1.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Verdict).To(Equal(PathVerdictFallThrough))
+		Expect(report.Reason).To(ContainSubstring("excluded by policy"))
+	})
+
+	It("should remove a programmed peer when it is opted out and reprogram only that peer", func() {
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		routes := map[string]netlink.Route{}
+		for k, r := range rtDataplane.RouteKeyToRoute {
+			routes[k] = r
+		}
+		peers := map[wgtypes.Key]wgtypes.Peer{}
+		for k, p := range link.WireguardPeers {
+			peers[k] = p
+		}
+
+		By("opting out peer1")
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardOptOut(peer1, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+		Expect(link.WireguardPeers[key_peer2]).To(Equal(peers[key_peer2]))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(linkIndex, cidr_1)))
+		Expect(rtDataplane.AddedRouteKeys).To(HaveLen(1))
+		Expect(rtDataplane.AddedRouteKeys).To(HaveKey(routeKey(0, cidr_1)))
+		Expect(wg.LastApplyStats().PeersRemoved).To(Equal(1))
+		Expect(wg.LastApplyStats().PeersUpdated).To(BeZero())
+
+		By("opting out peer1 again, which is a no-op")
+		rtDataplane.ResetDeltas()
+		wgDataplane.ResetDeltas()
+		wg.EndpointWireguardOptOut(peer1, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+
+		By("opting peer1 back in")
+		wg.EndpointWireguardOptOut(peer1, false)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute).To(Equal(routes))
+		Expect(link.WireguardPeers).To(Equal(peers))
+		Expect(wg.OptedOutNodes()).To(BeEmpty())
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should keep a peer opted out across a resync", func() {
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		peer := link.WireguardPeers[key_peer1]
+		wg.EndpointWireguardOptOut(peer1, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+
+		By("re-adding the peer to the dataplane and resyncing")
+		link.WireguardPeers[key_peer1] = peer
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).NotTo(HaveKey(key_peer1))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+	})
+
+	It("should clear the opt-out when the wireguard configuration of the node is removed", func() {
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointWireguardOptOut(peer1, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.OptedOutNodes()).To(Equal([]string{peer1}))
+
+		wg.EndpointWireguardRemove(peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.OptedOutNodes()).To(BeEmpty())
+
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_1)))
+		Expect(wg.CheckInvariants()).To(Succeed())
+	})
+
+	It("should ignore the opt-out of the local node", func() {
+		wg.EndpointWireguardOptOut(hostname, true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.OptedOutNodes()).To(BeEmpty())
+	})
+
+	Describe("with a node that claims the key of another node", func() {
+		BeforeEach(func() {
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveKey(key_peer2))
+		})
+
+		It("should not remove the peer of the other node if the node is opted out", func() {
+			peer := link.WireguardPeers[key_peer2]
+			wgDataplane.ResetDeltas()
+			wg.EndpointWireguardUpdate(peer1, key_peer2, nil)
+			wg.EndpointWireguardOptOut(peer1, true)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wgDataplane.WireguardConfigUpdated).To(BeFalse())
+			Expect(link.WireguardPeers).To(Equal(map[wgtypes.Key]wgtypes.Peer{key_peer2: peer}))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_2)))
+
+			By("resyncing, which keeps the peer of the other node")
+			wg.QueueResync()
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(Equal(map[wgtypes.Key]wgtypes.Peer{key_peer2: peer}))
+			Expect(wg.CheckInvariants()).To(Succeed())
+
+			By("opting the node back in, which removes both peers as conflicting")
+			wg.EndpointWireguardOptOut(peer1, false)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_2)))
+		})
+
+		It("should program the peer of the other node once the conflicting node is opted out", func() {
+			wg.EndpointWireguardUpdate(peer1, key_peer2, nil)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(BeEmpty())
+
+			wg.EndpointWireguardOptOut(peer1, true)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(link.WireguardPeers).To(HaveLen(1))
+			Expect(link.WireguardPeers[key_peer2].AllowedIPs).To(ConsistOf(cidr_2.ToIPNet()))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0, cidr_1)))
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex, cidr_2)))
+			Expect(wg.CheckInvariants()).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Wireguard node lifecycle", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var hook *logtest.Hook
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+
+	routeKey := func(linkIndex int) string {
+		return fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+	}
+	newWireguard := func(programPeersWithoutEndpoint bool) {
+		// The wireguard logger takes a copy of the hooks of the standard logger, so install the test hook only while
+		// the wireguard module is created.
+		logLevel := log.DebugLevel
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		log.StandardLogger().AddHook(hook)
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                     true,
+				ListeningPort:               listeningPort,
+				FirewallMark:                firewallMark,
+				RoutingRulePriority:         rulePriority,
+				RoutingTableIndex:           tableIndex,
+				InterfaceName:               ifaceName,
+				MTU:                         mtu,
+				ProgramPeersWithoutEndpoint: programPeersWithoutEndpoint,
+				LogLevel:                    &logLevel,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		log.StandardLogger().Hooks = stdHooks
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	// transitions returns the lifecycle transitions of peer1 that have been logged, as "from->to".
+	transitions := func() []string {
+		var t []string
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Node lifecycle state changed" && entry.Data["node"] == peer1 {
+				t = append(t, fmt.Sprintf("%v->%v", entry.Data["from"], entry.Data["to"]))
+			}
+		}
+		return t
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		hook = new(logtest.Hook)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	// The operations of the lifecycle entries, which are applied to peer1 in order.
+	const (
+		opEndpoint       = "endpoint"
+		opEndpointNil    = "endpoint-nil"
+		opKey            = "key"
+		opKeyRemove      = "key-remove"
+		opCIDR           = "cidr"
+		opRemove         = "remove"
+		opDrain          = "drain"
+		opOptOut         = "opt-out"
+		opApply          = "apply"
+		routeNone        = "none"
+		routeThrow       = "throw"
+		routeToWireguard = "wireguard"
+	)
+
+	DescribeTable("should track the lifecycle state of a node and program it accordingly",
+		func(programPeersWithoutEndpoint bool, ops []string, expectedTransitions []string, expectedState NodeState,
+			expectProgrammed bool, expectedRoute string) {
+			newWireguard(programPeersWithoutEndpoint)
+			for _, op := range ops {
+				switch op {
+				case opEndpoint:
+					wg.EndpointUpdate(peer1, ipv4_peer1)
+				case opEndpointNil:
+					wg.EndpointUpdate(peer1, nil)
+				case opKey:
+					wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+				case opKeyRemove:
+					wg.EndpointWireguardRemove(peer1)
+				case opCIDR:
+					wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+				case opRemove:
+					wg.EndpointRemove(peer1)
+				case opDrain:
+					wg.EndpointDrain(peer1)
+				case opOptOut:
+					wg.EndpointWireguardOptOut(peer1, true)
+				case opApply:
+					Expect(wg.Apply()).NotTo(HaveOccurred())
+				default:
+					Fail("unknown operation " + op)
+				}
+			}
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wg.CheckInvariants()).To(Succeed())
+
+			Expect(transitions()).To(Equal(expectedTransitions))
+			Expect(wg.NodeState(peer1)).To(Equal(expectedState))
+			if expectProgrammed {
+				Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(HaveKey(key_peer1))
+			} else {
+				Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers).To(BeEmpty())
+			}
+			switch expectedRoute {
+			case routeNone:
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(0)))
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(linkIndex)))
+			case routeThrow:
+				Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(0)))
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(linkIndex)))
+			case routeToWireguard:
+				Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey(linkIndex)))
+				Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey(0)))
+			}
+		},
+
+		// Transitions towards a complete node.
+		Entry("a node without configuration", false,
+			nil, nil, NodeStateUnknown, false, routeNone),
+		Entry("a node with only CIDRs", false,
+			[]string{opCIDR}, nil, NodeStateUnknown, false, routeThrow),
+		Entry("unknown to endpoint-only", false,
+			[]string{opCIDR, opEndpoint}, []string{"unknown->endpoint-only"},
+			NodeStateEndpointOnly, false, routeThrow),
+		Entry("unknown to key-only", false,
+			[]string{opCIDR, opKey}, []string{"unknown->key-only"},
+			NodeStateKeyOnly, false, routeThrow),
+		Entry("unknown to complete", false,
+			[]string{opCIDR, opEndpoint, opKey}, []string{"unknown->complete"},
+			NodeStateComplete, true, routeToWireguard),
+		Entry("endpoint-only to complete", false,
+			[]string{opCIDR, opEndpoint, opApply, opKey}, []string{"unknown->endpoint-only", "endpoint-only->complete"},
+			NodeStateComplete, true, routeToWireguard),
+		Entry("key-only to complete", false,
+			[]string{opCIDR, opKey, opApply, opEndpoint}, []string{"unknown->key-only", "key-only->complete"},
+			NodeStateComplete, true, routeToWireguard),
+
+		// Transitions away from a complete node.
+		Entry("complete to endpoint-only", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opKeyRemove},
+			[]string{"unknown->complete", "complete->endpoint-only"},
+			NodeStateEndpointOnly, false, routeThrow),
+		Entry("complete to key-only", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opEndpointNil},
+			[]string{"unknown->complete", "complete->key-only"},
+			NodeStateKeyOnly, false, routeThrow),
+		Entry("endpoint-only to unknown", false,
+			[]string{opCIDR, opEndpoint, opApply, opEndpointNil},
+			[]string{"unknown->endpoint-only", "endpoint-only->unknown"},
+			NodeStateUnknown, false, routeThrow),
+		Entry("key-only to unknown", false,
+			[]string{opCIDR, opKey, opApply, opKeyRemove},
+			[]string{"unknown->key-only", "key-only->unknown"},
+			NodeStateUnknown, false, routeThrow),
+
+		// Removal of the node from each state.
+		Entry("removal of a complete node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opRemove},
+			[]string{"unknown->complete", "complete->removing"},
+			NodeStateUnknown, false, routeNone),
+		Entry("removal of an endpoint-only node", false,
+			[]string{opCIDR, opEndpoint, opApply, opRemove},
+			[]string{"unknown->endpoint-only", "endpoint-only->removing"},
+			NodeStateUnknown, false, routeNone),
+		Entry("removal of a key-only node", false,
+			[]string{opCIDR, opKey, opApply, opRemove},
+			[]string{"unknown->key-only", "key-only->removing"},
+			NodeStateUnknown, false, routeNone),
+		Entry("removal of a node with only CIDRs", false,
+			[]string{opCIDR, opApply, opRemove}, []string{"unknown->removing"},
+			NodeStateUnknown, false, routeNone),
+
+		// Half removed nodes.
+		Entry("wireguard removal before the removal of the node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opKeyRemove, opApply, opRemove},
+			[]string{"unknown->complete", "complete->endpoint-only", "endpoint-only->removing"},
+			NodeStateUnknown, false, routeNone),
+		Entry("wireguard removal after the removal of the node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opRemove, opApply, opKeyRemove},
+			[]string{"unknown->complete", "complete->removing"},
+			NodeStateUnknown, false, routeNone),
+		Entry("key update after the removal of the node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opRemove, opKey, opCIDR},
+			[]string{"unknown->complete", "complete->removing", "unknown->key-only"},
+			NodeStateKeyOnly, false, routeThrow),
+		Entry("CIDR update after the removal of the node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opRemove, opApply, opCIDR},
+			[]string{"unknown->complete", "complete->removing"},
+			NodeStateUnknown, false, routeThrow),
+		Entry("removal and re-add of the node", false,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opRemove, opEndpoint, opKey, opCIDR},
+			[]string{"unknown->complete", "complete->removing", "unknown->complete"},
+			NodeStateComplete, true, routeToWireguard),
+
+		// Complete nodes that are not eligible to be programmed.
+		Entry("complete but drained", false,
+			[]string{opCIDR, opEndpoint, opKey, opDrain}, []string{"unknown->complete"},
+			NodeStateComplete, false, routeThrow),
+		Entry("complete but opted out of encryption", false,
+			[]string{opCIDR, opEndpoint, opKey, opOptOut}, []string{"unknown->complete"},
+			NodeStateComplete, false, routeThrow),
+
+		// Key-only nodes are programmed without an endpoint with ProgramPeersWithoutEndpoint.
+		Entry("unknown to key-only with ProgramPeersWithoutEndpoint", true,
+			[]string{opCIDR, opKey}, []string{"unknown->key-only"},
+			NodeStateKeyOnly, true, routeToWireguard),
+		Entry("complete to key-only with ProgramPeersWithoutEndpoint", true,
+			[]string{opCIDR, opEndpoint, opKey, opApply, opEndpointNil},
+			[]string{"unknown->complete", "complete->key-only"},
+			NodeStateKeyOnly, true, routeToWireguard),
+		Entry("endpoint-only to unknown with ProgramPeersWithoutEndpoint", true,
+			[]string{opCIDR, opEndpoint, opApply, opEndpointNil},
+			[]string{"unknown->endpoint-only", "endpoint-only->unknown"},
+			NodeStateUnknown, false, routeThrow),
+	)
+})
+
+var _ = Describe("Wireguard partial device reads", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var link *mocknetlink.MockLink
+	var key_peer1, key_peer2, key_peer3 wgtypes.Key
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:                 true,
+				ListeningPort:           listeningPort,
+				FirewallMark:            firewallMark,
+				RoutingRulePriority:     rulePriority,
+				RoutingTableIndex:       tableIndex,
+				InterfaceName:           ifaceName,
+				MTU:                     mtu,
+				ResyncDivergencePercent: 50,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		link = wgDataplane.NameToLink[ifaceName]
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		key_peer3 = mustGeneratePrivateKey().PublicKey()
+		for _, p := range []struct {
+			name string
+			addr ip.Addr
+			key  wgtypes.Key
+			cidr ip.CIDR
+		}{
+			{peer1, ipv4_peer1, key_peer1, cidr_1},
+			{peer2, ipv4_peer2, key_peer2, cidr_2},
+			{peer3, ipv4_peer3, key_peer3, cidr_3},
+		} {
+			wg.EndpointUpdate(p.name, p.addr)
+			wg.EndpointWireguardUpdate(p.name, p.key, nil)
+			wg.EndpointAllowedCIDRAdd(p.name, p.cidr)
+		}
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(HaveLen(3))
+
+		// A resync finds the device in-sync.
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.DiscrepantResyncs()).To(BeZero())
+		wgDataplane.ResetDeltas()
+	})
+
+	It("should leave the device as it is if a second read finds the missing peers", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardDeviceByNamePartial
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(2))
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(wg.DiscrepantResyncs()).To(BeZero())
+		Expect(wg.HasPendingWork()).To(BeTrue())
+
+		By("resyncing the device again on the next apply")
+		wgDataplane.ResetDeltas()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+		Expect(wg.HasPendingWork()).To(BeFalse())
+	})
+
+	It("should only add the peers that a second read confirms are missing", func() {
+		delete(link.WireguardPeers, key_peer1)
+		delete(link.WireguardPeers, key_peer3)
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(2))
+		Expect(wgDataplane.WireguardConfigurePeers).To(HaveLen(1))
+		var keys []wgtypes.Key
+		for _, peer := range wgDataplane.WireguardConfigurePeers[0] {
+			Expect(peer.Remove).To(BeFalse())
+			keys = append(keys, peer.PublicKey)
+		}
+		Expect(keys).To(ConsistOf(key_peer1, key_peer3))
+		Expect(link.WireguardPeers).To(HaveLen(3))
+		Expect(wg.DiscrepantResyncs()).To(Equal(1))
+		Expect(wg.HasPendingWork()).To(BeFalse())
+	})
+
+	It("should not read the device again unless the previous resync was clean", func() {
+		delete(link.WireguardPeers, key_peer1)
+		delete(link.WireguardPeers, key_peer2)
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.DiscrepantResyncs()).To(Equal(1))
+
+		wgDataplane.ResetDeltas()
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardDeviceByNamePartial
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(1))
+		Expect(link.WireguardPeers).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("Wireguard capacity stats", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var wg *Wireguard
+	var reported []CapacityStats
+	var key_peer1, key_peer2, key_peer3 wgtypes.Key
+
+	const linkIndex = 10
+
+	apply := func() CapacityStats {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).To(Succeed())
+		return wg.CapacityStats()
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		t = mocktime.NewMockTime()
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:               true,
+				ListeningPort:         listeningPort,
+				FirewallMark:          firewallMark,
+				RoutingRulePriority:   rulePriority,
+				RoutingTableIndex:     tableIndex,
+				InterfaceName:         ifaceName,
+				MTU:                   mtu,
+				MaxAllowedIPsPerPeer:  2,
+				CapacityStatsInterval: time.Minute,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		reported = nil
+		wg.SetCapacityStatsCallback(func(stats CapacityStats) {
+			reported = append(reported, stats)
+		})
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(apply()).To(Equal(CapacityStats{}))
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		key_peer3 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		wg.EndpointUpdate(peer3, ipv4_peer3)
+		wg.EndpointAllowedCIDRAdd(peer3, cidr_4)
+		Expect(apply()).To(Equal(CapacityStats{
+			ProgrammedPeers: 2,
+			AllowedIPs:      3,
+			UnicastRoutes:   3,
+			ThrowRoutes:     1,
+			TopPeers: []PeerCapacity{
+				{Name: peer1, CIDRs: 2, AllowedIPs: 2},
+				{Name: peer2, CIDRs: 1, AllowedIPs: 1},
+				{Name: peer3, CIDRs: 1},
+			},
+		}))
+	})
+
+	It("should count a peer once it is programmed, and stop counting it once it is removed", func() {
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		stats := apply()
+		Expect(stats.ProgrammedPeers).To(Equal(3))
+		Expect(stats.AllowedIPs).To(Equal(4))
+		Expect(stats.UnicastRoutes).To(Equal(4))
+		Expect(stats.ThrowRoutes).To(BeZero())
+		Expect(stats.TopPeers).To(ContainElement(PeerCapacity{Name: peer3, CIDRs: 1, AllowedIPs: 1}))
+
+		wg.EndpointRemove(peer1)
+		Expect(apply()).To(Equal(CapacityStats{
+			ProgrammedPeers: 2,
+			AllowedIPs:      2,
+			UnicastRoutes:   2,
+			TopPeers: []PeerCapacity{
+				{Name: peer2, CIDRs: 1, AllowedIPs: 1},
+				{Name: peer3, CIDRs: 1, AllowedIPs: 1},
+			},
+		}))
+	})
+
+	It("should move the counts of a CIDR that moves between peers", func() {
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_1)
+		wg.EndpointAllowedCIDRRemove(cidr_4)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_4)
+		Expect(apply()).To(Equal(CapacityStats{
+			ProgrammedPeers: 2,
+			AllowedIPs:      3,
+			UnicastRoutes:   3,
+			ThrowRoutes:     1,
+			TopPeers: []PeerCapacity{
+				{Name: peer2, CIDRs: 3, AllowedIPs: 2},
+				{Name: peer1, CIDRs: 1, AllowedIPs: 1},
+			},
+		}))
+	})
+
+	It("should count the CIDRs beyond the maximum allowed IPs of a peer as throw routes", func() {
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+		stats := apply()
+		Expect(stats.AllowedIPs).To(Equal(3))
+		Expect(stats.UnicastRoutes).To(Equal(3))
+		Expect(stats.ThrowRoutes).To(Equal(2))
+		Expect(stats.TopPeers[0]).To(Equal(PeerCapacity{Name: peer1, CIDRs: 3, AllowedIPs: 2}))
+	})
+
+	It("should not count the peers with a conflicting public key as programmed", func() {
+		wg.EndpointWireguardUpdate(peer3, key_peer1, nil)
+		Expect(apply()).To(Equal(CapacityStats{
+			ProgrammedPeers: 1,
+			AllowedIPs:      1,
+			UnicastRoutes:   1,
+			ThrowRoutes:     3,
+			TopPeers: []PeerCapacity{
+				{Name: peer1, CIDRs: 2},
+				{Name: peer2, CIDRs: 1, AllowedIPs: 1},
+				{Name: peer3, CIDRs: 1},
+			},
+		}))
+
+		By("counting the peer again once the conflict is resolved")
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		stats := apply()
+		Expect(stats.ProgrammedPeers).To(Equal(3))
+		Expect(stats.AllowedIPs).To(Equal(4))
+	})
+
+	It("should only count the routes of a peer once its route to wireguard is no longer held back", func() {
+		wgDataplane.FailuresToSimulate = mocknetlink.FailNextWireguardConfigureDevice
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		Expect(wg.Apply()).To(HaveOccurred())
+		stats := wg.CapacityStats()
+		Expect(stats.PendingRoutes).To(Equal(1))
+		Expect(stats.UnicastRoutes).To(Equal(3))
+		Expect(stats.ThrowRoutes).To(Equal(1))
+		Expect(stats.SuppressedCIDRs).To(BeZero())
+
+		stats = apply()
+		Expect(stats.PendingRoutes).To(BeZero())
+		Expect(stats.UnicastRoutes).To(Equal(4))
+		Expect(stats.ThrowRoutes).To(BeZero())
+	})
+
+	It("should report the stats at most once per interval", func() {
+		Expect(reported).To(HaveLen(1))
+		Expect(reported[0]).To(Equal(CapacityStats{}))
+
+		wg.EndpointWireguardUpdate(peer3, key_peer3, nil)
+		apply()
+		Expect(reported).To(HaveLen(1))
+
+		t.IncrementTime(time.Minute)
+		Expect(apply()).To(Equal(reported[1]))
+		Expect(reported[1].ProgrammedPeers).To(Equal(3))
+
+		By("reporting on the next apply once the callback is set again")
+		wg.SetCapacityStatsCallback(func(stats CapacityStats) {
+			reported = append(reported, stats)
+		})
+		apply()
+		Expect(reported).To(HaveLen(3))
+
+		By("reporting nothing once the callback is removed")
+		wg.SetCapacityStatsCallback(nil)
+		t.IncrementTime(time.Minute)
+		apply()
+		Expect(reported).To(HaveLen(3))
+	})
+
+	It("should report no counts once wireguard is torn down", func() {
+		Expect(wg.Teardown()).To(Succeed())
+		Expect(wg.CapacityStats()).To(Equal(CapacityStats{}))
+	})
+})
+
+var _ = Describe("Wireguard node override of the enabled state", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var s *mockStatus
+	var wg *Wireguard
+	var config *Config
+	var key_peer1 wgtypes.Key
+	var ourRule netlink.Rule
+	enabled, disabled := true, false
+
+	apply := func() {
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CheckInvariants()).To(Succeed())
+	}
+
+	// bringUp brings up the link created by the last Apply, and applies the configuration of the link.
+	bringUp := func() *mocknetlink.MockLink {
+		link := wgDataplane.NameToLink[ifaceName]
+		Expect(link).NotTo(BeNil())
+		wgDataplane.SetIface(ifaceName, true, true)
+		rtDataplane.NameToLink[ifaceName] = link
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		apply()
+		return link
+	}
+
+	expectProgrammed := func(link *mocknetlink.MockLink, cidrs ...ip.CIDR) {
+		var ipnets []net.IPNet
+		for _, cidr := range cidrs {
+			ipnets = append(ipnets, cidr.ToIPNet())
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr)))
+		}
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(ipnets))
+		Expect(wgDataplane.Rules).To(ContainElement(ourRule))
+		Expect(s.key).To(Equal(link.WireguardPublicKey))
+		Expect(s.keyState).To(Equal(KeyStatePublished))
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		s = &mockStatus{}
+		config = &Config{
+			AllowEnabledOverride: true,
+			ListeningPort:        listeningPort,
+			FirewallMark:         firewallMark,
+			RoutingRulePriority:  rulePriority,
+			RoutingTableIndex:    tableIndex,
+			InterfaceName:        ifaceName,
+			MTU:                  mtu,
+		}
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		rule := netlink.NewRule()
+		rule.Priority = rulePriority
+		rule.Table = tableIndex
+		rule.Mark = firewallMark
+		rule.Invert = true
+		ourRule = *rule
+	})
+
+	JustBeforeEach(func() {
+		t := mocktime.NewMockTime()
+		// Disable the grace period of the route removals.
+		t.SetAutoIncrement(11 * time.Second)
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		apply()
+	})
+
+	Describe("with wireguard disabled by the configuration", func() {
+		It("should program the cached configuration once enabled by the override, and remove it once cleared", func() {
+			Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+			_, source := wg.Enabled()
+			Expect(source).To(Equal(EnabledSourceConfig))
+
+			By("programming the peers received while disabled once enabled")
+			wg.SetNodeOverrideEnabled(&enabled)
+			apply()
+			Expect(wgDataplane.NumLinkAddCalls).To(Equal(1))
+			link := bringUp()
+			expectProgrammed(link, cidr_1)
+			isEnabled, source := wg.Enabled()
+			Expect(isEnabled).To(BeTrue())
+			Expect(source).To(Equal(EnabledSourceOverride))
+
+			By("removing the configuration once the override is cleared")
+			wg.SetNodeOverrideEnabled(nil)
+			apply()
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+			Expect(wgDataplane.Rules).NotTo(ContainElement(ourRule))
+			Expect(s.key).To(Equal(zeroKey))
+			Expect(s.keyState).To(Equal(KeyStateDisabled))
+			isEnabled, source = wg.Enabled()
+			Expect(isEnabled).To(BeFalse())
+			Expect(source).To(Equal(EnabledSourceConfig))
+		})
+
+		Describe("without AllowEnabledOverride", func() {
+			BeforeEach(func() {
+				config.AllowEnabledOverride = false
+			})
+
+			It("should ignore the override", func() {
+				wg.SetNodeOverrideEnabled(&enabled)
+				apply()
+				Expect(wgDataplane.NumLinkAddCalls).To(BeZero())
+				isEnabled, source := wg.Enabled()
+				Expect(isEnabled).To(BeFalse())
+				Expect(source).To(Equal(EnabledSourceConfig))
+			})
+		})
+	})
+
+	Describe("with wireguard enabled by the configuration", func() {
+		BeforeEach(func() {
+			config.Enabled = true
+		})
+
+		It("should remove the configuration in order once disabled by the override, and restore it once cleared", func() {
+			link := bringUp()
+			expectProgrammed(link, cidr_1)
+			routeKey := fmt.Sprintf("%d-%d-%s", tableIndex, link.LinkAttrs.Index, cidr_1)
+
+			By("removing the peers and routes and withdrawing our key before the rule")
+			wg.SetNodeOverrideEnabled(&disabled)
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextRuleDel
+			err := wg.Apply()
+			Expect(errors.Is(err, ErrUpdateFailed)).To(BeTrue())
+			Expect(err.(*ApplyError).FailedSteps).To(Equal(map[Subsystem]string{SubsystemLink: "disable rules"}))
+			Expect(link.WireguardPeers).To(BeEmpty())
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey))
+			Expect(wgDataplane.Rules).To(ContainElement(ourRule))
+			Expect(s.key).To(Equal(zeroKey))
+			Expect(s.keyState).To(Equal(KeyStateDisabledByOverride))
+			Expect(s.enabledSource).To(Equal(EnabledSourceOverride))
+			isEnabled, source := wg.Enabled()
+			Expect(isEnabled).To(BeFalse())
+			Expect(source).To(Equal(EnabledSourceOverride))
+
+			By("removing the rule and the link")
+			apply()
+			Expect(wgDataplane.Rules).NotTo(ContainElement(ourRule))
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+
+			By("caching the updates while disabled")
+			wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+			apply()
+			Expect(wgDataplane.NameToLink).NotTo(HaveKey(ifaceName))
+
+			By("programming the cached configuration once the override is cleared")
+			wg.SetNodeOverrideEnabled(nil)
+			apply()
+			link = bringUp()
+			expectProgrammed(link, cidr_1, cidr_2)
+			Expect(s.enabledSource).To(Equal(EnabledSourceConfig))
+			isEnabled, source = wg.Enabled()
+			Expect(isEnabled).To(BeTrue())
+			Expect(source).To(Equal(EnabledSourceConfig))
+		})
+
+		It("should publish our status again if the override agrees with the configuration", func() {
+			link := bringUp()
+			expectProgrammed(link, cidr_1)
+			Expect(s.enabledSource).To(Equal(EnabledSourceConfig))
+			numCallbacks := s.numCallbacks
+
+			wg.SetNodeOverrideEnabled(&enabled)
+			apply()
+			Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+			Expect(s.key).To(Equal(link.WireguardPublicKey))
+			Expect(s.keyState).To(Equal(KeyStatePublished))
+			Expect(s.enabledSource).To(Equal(EnabledSourceOverride))
+			Expect(wgDataplane.NumLinkAddCalls).To(Equal(1))
+
+			By("not publishing again if the override is unchanged")
+			wg.SetNodeOverrideEnabled(&enabled)
+			apply()
+			Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+		})
+	})
+})
+
+var _ = Describe("Wireguard CIDRs in non-canonical form", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var key_peer1 wgtypes.Key
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		t := mocktime.NewMockTime()
+		// Disable the grace period of the route removals.
+		t.SetAutoIncrement(11 * time.Second)
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	It("should not leak the routes or allowed IPs of CIDRs added and removed in different forms", func() {
+		for _, forms := range [][2]string{
+			{"10.0.5.7/24", "10.0.5.0/24"},
+			{"10.0.5.0/24", "10.0.5.7/24"},
+			{"10.0.5.7", "10.0.5.7/32"},
+		} {
+			added := ip.MustParseCIDROrIP(forms[0])
+			wg.EndpointAllowedCIDRAdd(peer1, added)
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wg.CheckInvariants()).To(Succeed())
+			routeKey := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, added)
+			Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routeKey))
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer1].AllowedIPs).To(HaveLen(1))
+
+			wg.EndpointAllowedCIDRRemove(ip.MustParseCIDROrIP(forms[1]))
+			Expect(wg.Apply()).NotTo(HaveOccurred())
+			Expect(wg.CheckInvariants()).To(Succeed())
+			Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routeKey), "route of %s not removed by %s", forms[0], forms[1])
+			Expect(wgDataplane.NameToLink[ifaceName].WireguardPeers[key_peer1].AllowedIPs).To(BeEmpty())
+		}
+	})
+})
+
+var _ = Describe("Wireguard encryption coverage report", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var config *Config
+	var hook *logtest.Hook
+	var key_peer1, key_peer2 wgtypes.Key
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		hook = new(logtest.Hook)
+		logLevel := log.InfoLevel
+		config = &Config{
+			Enabled:             true,
+			ListeningPort:       listeningPort,
+			FirewallMark:        firewallMark,
+			RoutingRulePriority: rulePriority,
+			RoutingTableIndex:   tableIndex,
+			InterfaceName:       ifaceName,
+			MTU:                 mtu,
+			LogLevel:            &logLevel,
+		}
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+	})
+
+	// newWireguard creates the wireguard module with peer1, which has cidr_1 and cidr_2, and peer2, which has cidr_3,
+	// and applies the peers. The link exists unless wireguard is not supported.
+	newWireguard := func(supported bool) {
+		if supported {
+			wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+			rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		} else {
+			wgDataplane.FailuresToSimulate = mocknetlink.FailNextLinkAddNotSupported
+		}
+		t := mocktime.NewMockTime()
+		// Disable the grace period of the route removals.
+		t.SetAutoIncrement(11 * time.Second)
+
+		// The wireguard logger takes a copy of the hooks of the standard logger, so install the test hook only while
+		// the wireguard module is created.
+		stdHooks := log.StandardLogger().Hooks
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+		log.StandardLogger().AddHook(hook)
+		s := &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			config,
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		log.StandardLogger().Hooks = stdHooks
+
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_2)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_3)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	}
+	// coverageLogs returns the percentages of the coverage summaries that have been logged.
+	coverageLogs := func() []interface{} {
+		var percents []interface{}
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Wireguard encryption coverage changed" {
+				percents = append(percents, entry.Data["percent"])
+			}
+		}
+		return percents
+	}
+
+	It("should report all of the CIDRs as tunneled once the peers are programmed", func() {
+		newWireguard(true)
+		report := wg.CoverageReport()
+		Expect(report.Active).To(BeTrue())
+		Expect(report.CIDRs).To(Equal(3))
+		Expect(report.Tunneled).To(Equal(3))
+		Expect(report.Percent).To(Equal(100.0))
+		Expect(report.FallThrough).To(BeEmpty())
+		Expect(report.Peers).To(Equal([]PeerCoverage{
+			{Name: peer1, CIDRs: 2, Tunneled: 2, FallThrough: map[CoverageReason]int{}},
+			{Name: peer2, CIDRs: 1, Tunneled: 1, FallThrough: map[CoverageReason]int{}},
+		}))
+	})
+
+	It("should not include the interface addresses of the peers", func() {
+		newWireguard(true)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, ipv4_int_peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CoverageReport().CIDRs).To(Equal(3))
+	})
+
+	It("should report the CIDRs of the peers with a conflicting key", func() {
+		newWireguard(true)
+		wg.EndpointWireguardUpdate(peer2, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		report := wg.CoverageReport()
+		Expect(report.Tunneled).To(BeZero())
+		Expect(report.Percent).To(BeZero())
+		Expect(report.FallThrough).To(Equal(map[CoverageReason]int{CoverageReasonConflict: 3}))
+	})
+
+	It("should report the excluded CIDRs", func() {
+		config.ExcludeCIDRs = []ip.CIDR{cidr_2}
+		newWireguard(true)
+		report := wg.CoverageReport()
+		Expect(report.Tunneled).To(Equal(2))
+		Expect(report.FallThrough).To(Equal(map[CoverageReason]int{CoverageReasonExcluded: 1}))
+		Expect(report.Peers[0]).To(Equal(PeerCoverage{
+			Name: peer1, CIDRs: 2, Tunneled: 1, FallThrough: map[CoverageReason]int{CoverageReasonExcluded: 1},
+		}))
+	})
+
+	It("should report the CIDRs of a node whose wireguard configuration has been removed", func() {
+		newWireguard(true)
+		wg.EndpointWireguardRemove(peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		report := wg.CoverageReport()
+		Expect(report.CIDRs).To(Equal(3))
+		Expect(report.Tunneled).To(Equal(1))
+		Expect(report.Peers[0]).To(Equal(PeerCoverage{
+			Name: peer1, CIDRs: 2, FallThrough: map[CoverageReason]int{CoverageReasonNoKey: 2},
+		}))
+
+		By("removing the CIDRs from the report once the node is removed")
+		wg.EndpointRemove(peer1)
+		wg.EndpointAllowedCIDRRemove(cidr_1)
+		wg.EndpointAllowedCIDRRemove(cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		report = wg.CoverageReport()
+		Expect(report.CIDRs).To(Equal(1))
+		Expect(report.Percent).To(Equal(100.0))
+		Expect(report.Peers).To(HaveLen(1))
+	})
+
+	It("should report all of the CIDRs as inactive if wireguard is not supported", func() {
+		newWireguard(false)
+		report := wg.CoverageReport()
+		Expect(report.Active).To(BeFalse())
+		Expect(report.CIDRs).To(Equal(3))
+		Expect(report.Tunneled).To(BeZero())
+		Expect(report.FallThrough).To(Equal(map[CoverageReason]int{CoverageReasonInactive: 3}))
+	})
+
+	It("should answer a queued report once the next Apply completes", func() {
+		newWireguard(true)
+		var reports []CoverageReport
+		wg.QueueCoverageReport(func(report CoverageReport) {
+			reports = append(reports, report)
+		})
+		wg.EndpointWireguardRemove(peer2)
+		Expect(reports).To(BeEmpty())
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(reports).To(HaveLen(1))
+		Expect(reports[0].Tunneled).To(Equal(2))
+		Expect(reports[0].FallThrough).To(Equal(map[CoverageReason]int{CoverageReasonNoKey: 1}))
+
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(reports).To(HaveLen(1))
+	})
+
+	It("should not log the coverage without a threshold", func() {
+		newWireguard(true)
+		wg.EndpointWireguardRemove(peer2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(coverageLogs()).To(BeEmpty())
+	})
+
+	It("should log the coverage when it changes by more than the threshold", func() {
+		config.CoverageLogThreshold = 40
+		newWireguard(true)
+		Expect(coverageLogs()).To(Equal([]interface{}{100.0}))
+
+		By("not logging a change within the threshold")
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_4)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_5)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointAllowedCIDRAdd(peer2, ip.MustParseCIDROrIP("192.168.6.0/24"))
+		wg.EndpointWireguardRemove(peer2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.CoverageReport().Percent).To(BeNumerically("~", 66.67, 0.01))
+		Expect(coverageLogs()).To(Equal([]interface{}{100.0}))
+
+		By("logging a change beyond the threshold")
+		wg.EndpointWireguardRemove(peer1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(coverageLogs()).To(Equal([]interface{}{100.0, 0.0}))
+		entries := hook.AllEntries()
+		last := entries[len(entries)-1]
+		Expect(last.Message).To(Equal("Wireguard encryption coverage changed"))
+		Expect(last.Data).To(HaveKeyWithValue("previousPercent", 100.0))
+		Expect(last.Data).To(HaveKeyWithValue(string(CoverageReasonNoKey), 6))
+	})
+})
+
+var _ = Describe("Wireguard device verification after the interface comes up", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var s *mockStatus
+	var key_peer1 wgtypes.Key
+	var publishedKey wgtypes.Key
+
+	const linkIndex = 10
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		s = &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			mocktime.NewMockTime(),
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		publishedKey = s.key
+		Expect(publishedKey).NotTo(Equal(zeroKey))
+		wg.EndpointWireguardUpdate(hostname, publishedKey, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	// clearDevice clears the device configuration as the resume scripts of a suspended node may, leaving the link and
+	// its index as they were.
+	clearDevice := func(clearKey bool) *mocknetlink.MockLink {
+		link := wgDataplane.NameToLink[ifaceName]
+		if clearKey {
+			link.WireguardPrivateKey = zeroKey
+			link.WireguardPublicKey = zeroKey
+		}
+		link.WireguardListenPort = 0
+		link.WireguardFirewallMark = 0
+		link.WireguardPeers = nil
+		return link
+	}
+	// expectDeviceProgrammed checks the device has our published key, our listening port and firewall mark, and peer1.
+	expectDeviceProgrammed := func(link *mocknetlink.MockLink) {
+		Expect(link.LinkAttrs.Index).To(Equal(linkIndex))
+		Expect(link.WireguardPublicKey).To(Equal(publishedKey))
+		Expect(link.WireguardListenPort).To(Equal(listeningPort))
+		Expect(link.WireguardFirewallMark).To(Equal(firewallMark))
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link.WireguardPeers[key_peer1].AllowedIPs).To(ConsistOf(cidr_1.ToIPNet()))
+	}
+
+	It("should restore the cleared device on the next Apply once the interface is reported up", func() {
+		link := clearDevice(true)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectDeviceProgrammed(link)
+
+		By("keeping the published key")
+		Expect(s.key).To(Equal(publishedKey))
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	It("should restore the peers of the device if only the peers are cleared", func() {
+		link := clearDevice(false)
+		link.WireguardListenPort = listeningPort
+		link.WireguardFirewallMark = firewallMark
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectDeviceProgrammed(link)
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	It("should restore a zeroed key of the device if the rest of the configuration is intact", func() {
+		link := wgDataplane.NameToLink[ifaceName]
+		link.WireguardPrivateKey = zeroKey
+		link.WireguardPublicKey = zeroKey
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		expectDeviceProgrammed(link)
+		Expect(s.key).To(Equal(publishedKey))
+		Expect(s.numCallbacks).To(Equal(1))
+	})
+
+	It("should only read the device if its configuration is intact", func() {
+		wgDataplane.NumWireguardDeviceReads = 0
+		wgDataplane.NumWireguardDeviceConfigures = 0
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeZero())
+
+		By("not reading the device again until the interface is reported up again")
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wgDataplane.NumWireguardDeviceReads).To(Equal(1))
+	})
+
+	It("should not verify the device unless the interface is reported up", func() {
+		link := clearDevice(true)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(link.WireguardPeers).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Wireguard routes via the peer tunnel IP", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var wg *Wireguard
+	var s *mockStatus
+	var key_peer1, key_peer2 wgtypes.Key
+	var routekey_1, routekey_2, routekey_int_peer1 string
+
+	const linkIndex = 10
+	ipv4_int_peer2 := ip.FromString("192.168.20.2")
+
+	// deviceRoute is the route to the wireguard interface used when the tunnel IP of the peer is not known.
+	deviceRoute := func(ipNet net.IPNet) netlink.Route {
+		return netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipNet,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		}
+	}
+	// gatewayRoute is the route to the wireguard interface via the tunnel IP of the peer.
+	gatewayRoute := func(ipNet net.IPNet, gw ip.Addr) netlink.Route {
+		route := netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipNet,
+			Gw:        gw.AsNetIP(),
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Table:     tableIndex,
+		}
+		route.SetFlag(syscall.RTNH_F_ONLINK)
+		return route
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t := mocktime.NewMockTime()
+		// Setting an auto-increment greater than the route cleanup delay effectively
+		// disables the grace period for these tests.
+		t.SetAutoIncrement(11 * time.Second)
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		routekey_1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_1)
+		routekey_2 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_2)
+		routekey_int_peer1 = fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr_int_peer1)
+
+		s = &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:              true,
+				ListeningPort:        listeningPort,
+				FirewallMark:         firewallMark,
+				RoutingRulePriority:  rulePriority,
+				RoutingTableIndex:    tableIndex,
+				InterfaceName:        ifaceName,
+				MTU:                  mtu,
+				RouteViaPeerTunnelIP: true,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		key_peer1 = mustGeneratePrivateKey().PublicKey()
+		key_peer2 = mustGeneratePrivateKey().PublicKey()
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointWireguardUpdate(peer1, key_peer1, ipv4_int_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		wg.EndpointUpdate(peer2, ipv4_peer2)
+		wg.EndpointWireguardUpdate(peer2, key_peer2, nil)
+		wg.EndpointAllowedCIDRAdd(peer2, cidr_2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+	})
+
+	It("should route the CIDRs of a peer via its tunnel IP, and the tunnel IP via the device", func() {
+		Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(gatewayRoute(ipnet_1, ipv4_int_peer1)))
+		Expect(rtDataplane.RouteKeyToRoute[routekey_int_peer1]).To(Equal(deviceRoute(ipnet_int_peer1)))
+	})
+
+	It("should fall back to a device route for a peer with no tunnel IP", func() {
+		Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(deviceRoute(ipnet_2)))
+	})
+
+	It("should rewrite only the routes of a peer when its tunnel IP changes", func() {
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardUpdate(peer2, key_peer2, ipv4_int_peer2)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(gatewayRoute(ipnet_2, ipv4_int_peer2)))
+		Expect(rtDataplane.UpdatedRouteKeys.Contains(routekey_2)).To(BeTrue())
+		Expect(rtDataplane.UpdatedRouteKeys.Contains(routekey_1)).To(BeFalse())
+		Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(gatewayRoute(ipnet_1, ipv4_int_peer1)))
+	})
+
+	It("should fall back to device routes when the tunnel IP of a peer is removed", func() {
+		rtDataplane.ResetDeltas()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(deviceRoute(ipnet_1)))
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey_int_peer1))
+		Expect(rtDataplane.UpdatedRouteKeys.Contains(routekey_2)).To(BeFalse())
+	})
+
+	It("should not update the routes on resync", func() {
+		rtDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.AddedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.DeletedRouteKeys).To(BeEmpty())
+		Expect(rtDataplane.UpdatedRouteKeys).To(BeEmpty())
+	})
+
+	It("should replace device routes with gateway routes on resync", func() {
+		// The routes programmed before the option was enabled are device routes.
+		rtDataplane.AddMockRoute(&netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &ipnet_1,
+			Type:      syscall.RTN_UNICAST,
+			Protocol:  FelixRouteProtocol,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     tableIndex,
+		})
+		rtDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.UpdatedRouteKeys.Contains(routekey_1)).To(BeTrue())
+		Expect(rtDataplane.RouteKeyToRoute[routekey_1]).To(Equal(gatewayRoute(ipnet_1, ipv4_int_peer1)))
+	})
+
+	It("should replace gateway routes with device routes on resync for a peer with no tunnel IP", func() {
+		route := gatewayRoute(ipnet_2, ipv4_int_peer2)
+		rtDataplane.AddMockRoute(&route)
+		rtDataplane.ResetDeltas()
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(rtDataplane.UpdatedRouteKeys.Contains(routekey_2)).To(BeTrue())
+		Expect(rtDataplane.RouteKeyToRoute[routekey_2]).To(Equal(deviceRoute(ipnet_2)))
+	})
+})
+
+var _ = Describe("Wireguard peer update batching", func() {
+	var wgDataplane *mocknetlink.MockNetlinkDataplane
+	var rtDataplane *mocknetlink.MockNetlinkDataplane
+	var t *mocktime.MockTime
+	var wg *Wireguard
+	var s *mockStatus
+	var link *mocknetlink.MockLink
+	var keys []wgtypes.Key
+
+	const (
+		linkIndex      = 10
+		numPeers       = 200
+		batchThreshold = 10
+		batchWindow    = 10 * time.Second
+	)
+	peerName := func(i int) string {
+		return fmt.Sprintf("batch-peer-%03d", i)
+	}
+	peerCIDR := func(i int) ip.CIDR {
+		return ip.MustParseCIDROrIP(fmt.Sprintf("10.%d.%d.0/24", 100+i/250, i%250))
+	}
+	// expectPeerKeys checks the device has the current key of each peer, with the CIDR of the peer.
+	expectPeerKeys := func() {
+		Expect(link.WireguardPeers).To(HaveLen(numPeers))
+		for i := 0; i < numPeers; i++ {
+			Expect(link.WireguardPeers).To(HaveKey(keys[i]), "peer %d", i)
+			Expect(link.WireguardPeers[keys[i]].AllowedIPs).To(ContainElement(peerCIDR(i).ToIPNet()))
+		}
+	}
+	// rotateKeys publishes a new key for each of the peers, applying after every batchThreshold peers as the dataplane
+	// does while the updates arrive.
+	rotateKeys := func(from, to int) {
+		for i := from; i < to; i++ {
+			keys[i] = mustGeneratePrivateKey().PublicKey()
+			wg.EndpointWireguardUpdate(peerName(i), keys[i], nil)
+			if (i+1)%batchThreshold == 0 {
+				Expect(wg.Apply()).NotTo(HaveOccurred())
+				t.IncrementTime(100 * time.Millisecond)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		wgDataplane = mocknetlink.NewMockNetlinkDataplane()
+		rtDataplane = mocknetlink.NewMockNetlinkDataplane()
+		t = mocktime.NewMockTime()
+		wgDataplane.AddIface(linkIndex, ifaceName, true, true)
+		rtDataplane.AddIface(linkIndex, ifaceName, true, true)
+		s = &mockStatus{}
+		wg = NewWithShims(
+			hostname,
+			&Config{
+				Enabled:             true,
+				ListeningPort:       listeningPort,
+				FirewallMark:        firewallMark,
+				RoutingRulePriority: rulePriority,
+				RoutingTableIndex:   tableIndex,
+				InterfaceName:       ifaceName,
+				MTU:                 mtu,
+				PeerBatchThreshold:  batchThreshold,
+				PeerBatchWindow:     batchWindow,
+			},
+			rtDataplane.NewMockNetlink,
+			wgDataplane.NewMockNetlink,
+			wgDataplane.NewMockWireguard,
+			nil,
+			10*time.Second,
+			t,
+			FelixRouteProtocol,
+			s.status,
+			nil,
+		)
+		wg.EndpointUpdate(hostname, ipv4_host)
+		wg.OnIfaceStateChanged(ifaceName, ifacemonitor.StateUp)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		wg.EndpointWireguardUpdate(hostname, s.key, nil)
+
+		// The peers are new, so they are programmed immediately even though there are more than the threshold.
+		keys = make([]wgtypes.Key, numPeers)
+		for i := 0; i < numPeers; i++ {
+			keys[i] = mustGeneratePrivateKey().PublicKey()
+			wg.EndpointUpdate(peerName(i), ip.FromString(fmt.Sprintf("10.200.%d.%d", i/250, i%250+1)))
+			wg.EndpointWireguardUpdate(peerName(i), keys[i], nil)
+			wg.EndpointAllowedCIDRAdd(peerName(i), peerCIDR(i))
+		}
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		link = wgDataplane.NameToLink[ifaceName]
+		expectPeerKeys()
+		wgDataplane.NumWireguardDeviceConfigures = 0
+	})
+
+	It("should not hold the updates of a few peers", func() {
+		rotateKeys(0, batchThreshold)
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(BeNumerically(">", 0))
+		expectPeerKeys()
+	})
+
+	It("should apply a burst of key rotations with a bounded number of device configurations", func() {
+		// The updates of the first Apply do not exceed the threshold, so they are applied. The updates of the following
+		// Applies of the burst are held.
+		rotateKeys(0, batchThreshold)
+		configuresPerApply := wgDataplane.NumWireguardDeviceConfigures
+		Expect(configuresPerApply).To(BeNumerically(">", 0))
+		rotateKeys(batchThreshold, numPeers)
+		Expect(wgDataplane.NumWireguardDeviceConfigures).To(Equal(configuresPerApply))
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically(">", 0))
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically("<=", batchWindow))
+		Expect(link.WireguardPeers).NotTo(HaveKey(keys[numPeers-1]))
+		Expect(wg.HasPendingWork()).To(BeTrue())
+
+		By("holding the routes of the held peers")
+		cidr := ip.MustParseCIDROrIP("10.150.0.0/24")
+		wg.EndpointAllowedCIDRAdd(peerName(numPeers-1), cidr)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		routekey := fmt.Sprintf("%d-%d-%s", tableIndex, linkIndex, cidr)
+		Expect(rtDataplane.RouteKeyToRoute).NotTo(HaveKey(routekey))
+
+		By("applying the held updates once the window has ended")
+		t.IncrementTime(wg.PeerBatchFlushAfter())
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		expectPeerKeys()
+		Expect(link.WireguardPeers[keys[numPeers-1]].AllowedIPs).To(ContainElement(cidr.ToIPNet()))
+		Expect(rtDataplane.RouteKeyToRoute).To(HaveKey(routekey))
+
+		// The held updates of the 19 Applies of the burst are applied together, which may take more than one device
+		// configuration if the allowed IPs are chunked, but far fewer than an Apply of each.
+		Expect(wgDataplane.NumWireguardDeviceConfigures - configuresPerApply).To(BeNumerically("<=", 2*configuresPerApply))
+		Expect(wg.HasPendingWork()).To(BeFalse())
+	})
+
+	It("should apply the held updates immediately when a peer without a key has a key", func() {
+		rotateKeys(0, numPeers/2)
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically(">", 0))
+
+		wg.EndpointUpdate(peer1, ipv4_peer1)
+		wg.EndpointAllowedCIDRAdd(peer1, cidr_1)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically(">", 0))
+
+		key_peer1 := mustGeneratePrivateKey().PublicKey()
+		wg.EndpointWireguardUpdate(peer1, key_peer1, nil)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		Expect(link.WireguardPeers).To(HaveKey(key_peer1))
+		Expect(link.WireguardPeers).To(HaveKey(keys[numPeers/2-1]))
+	})
+
+	It("should apply the held updates immediately when our public key is to be published", func() {
+		rotateKeys(0, numPeers/2)
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically(">", 0))
+		numCallbacks := s.numCallbacks
+
+		wg.EndpointWireguardRemove(hostname)
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		Expect(s.numCallbacks).To(Equal(numCallbacks + 1))
+		Expect(link.WireguardPeers).To(HaveKey(keys[numPeers/2-1]))
+	})
+
+	It("should apply the held updates immediately on a resync", func() {
+		rotateKeys(0, numPeers/2)
+		Expect(wg.PeerBatchFlushAfter()).To(BeNumerically(">", 0))
+
+		wg.QueueResync()
+		Expect(wg.Apply()).NotTo(HaveOccurred())
+		Expect(wg.PeerBatchFlushAfter()).To(BeZero())
+		Expect(link.WireguardPeers).To(HaveKey(keys[numPeers/2-1]))
+	})
+})